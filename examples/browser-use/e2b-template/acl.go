@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// AdminACL grants management endpoints per role (-adminACL) instead of all
+// or nothing, e.g. letting support read anomalies and checkpoints without
+// being able to change mocks or purge data. Each role has its own bearer
+// tokens and the routes it may call, named by their patterns as registered
+// ("GET /admin/anomalies", "DELETE /sessions/{id}/data") or "*" for all.
+// The -adminToken token keeps access to every endpoint.
+type AdminACL struct {
+	roles []*adminRole
+
+	allowed int64
+	denied  int64
+}
+
+type adminRole struct {
+	name   string
+	Tokens []string `json:"tokens"`
+	Allow  []string `json:"allow"`
+}
+
+/*
+Load the roles file. Example:
+
+	{
+	  "support": {"tokens": ["s3cr3t"], "allow": ["GET /admin/anomalies", "GET /admin/checkpoint"]},
+	  "oncall": {"tokens": ["0nc4ll"], "allow": ["*"]}
+	}
+*/
+func LoadAdminACL(path string) (*AdminACL, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var roles map[string]*adminRole
+	if err := json.Unmarshal(data, &roles); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	acl := &AdminACL{}
+	for name, role := range roles {
+		role.name = name
+		for _, token := range role.Tokens {
+			if token == "" {
+				return nil, fmt.Errorf("%s: role %s has an empty token", path, name)
+			}
+		}
+		for _, pattern := range role.Allow {
+			method, route, ok := strings.Cut(pattern, " ")
+			if pattern != "*" && (!ok || method != strings.ToUpper(method) || !strings.HasPrefix(route, "/")) {
+				return nil, fmt.Errorf("%s: role %s: %q is not a route such as \"GET /admin/anomalies\"", path, name, pattern)
+			}
+		}
+		acl.roles = append(acl.roles, role)
+	}
+	sort.Slice(acl.roles, func(i, j int) bool { return acl.roles[i].name < acl.roles[j].name })
+	return acl, nil
+}
+
+// The role a bearer token belongs to, or nil. Every token is compared so
+// that the time taken does not tell which role came close.
+func (a *AdminACL) role(token string) *adminRole {
+	if a == nil {
+		return nil
+	}
+	var found *adminRole
+	for _, role := range a.roles {
+		for _, t := range role.Tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+				found = role
+			}
+		}
+	}
+	return found
+}
+
+func (r *adminRole) allows(pattern string) bool {
+	for _, allowed := range r.Allow {
+		if allowed == "*" || allowed == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// Check a request carrying a role's token, answering 403 when the role may
+// not call the route
+func (a *AdminACL) authorize(w http.ResponseWriter, r *http.Request, role *adminRole) bool {
+	if role.allows(r.Pattern) {
+		atomic.AddInt64(&a.allowed, 1)
+		return true
+	}
+	atomic.AddInt64(&a.denied, 1)
+	log.Printf("🔐 Role %s denied %s (from %s)", role.name, r.Pattern, actorLabel(r, a))
+	http.Error(w, fmt.Sprintf("Forbidden: role %s may not call %s", role.name, r.Pattern), http.StatusForbidden)
+	return false
+}
+
+func (a *AdminACL) Metrics() map[string]interface{} {
+	return map[string]interface{}{
+		"admin_acl_roles":         len(a.roles),
+		"admin_acl_allowed_total": atomic.LoadInt64(&a.allowed),
+		"admin_acl_denied_total":  atomic.LoadInt64(&a.denied),
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// RateDetector is the built-in analyzer. It flags sessions whose command
+// rate, navigation rate or number of distinct domains in a window exceeds
+// a threshold, e.g. the rapid login-page reloads of credential stuffing.
+// A zero threshold disables that check.
+type RateDetector struct {
+	MaxMethodsPerSec     float64
+	MaxNavigationsPerMin float64
+	MaxDomains           int
+}
+
+// Parse "methodsPerSec=100,navigationsPerMin=30,domains=30" over the defaults
+func NewRateDetector(spec string) (*RateDetector, error) {
+	d := &RateDetector{MaxMethodsPerSec: 100, MaxNavigationsPerMin: 30, MaxDomains: 30}
+	for _, item := range splitList(spec) {
+		key, value, _ := strings.Cut(item, "=")
+		n, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid threshold %q", item)
+		}
+		switch strings.TrimSpace(key) {
+		case "methodsPerSec":
+			d.MaxMethodsPerSec = n
+		case "navigationsPerMin":
+			d.MaxNavigationsPerMin = n
+		case "domains":
+			d.MaxDomains = int(n)
+		default:
+			return nil, fmt.Errorf("unknown threshold %q", key)
+		}
+	}
+	return d, nil
+}
+
+func (d *RateDetector) Name() string {
+	return "rate-detector"
+}
+
+func (d *RateDetector) Analyze(stats *SessionStats) []Anomaly {
+	var anomalies []Anomaly
+	if d.MaxMethodsPerSec > 0 && stats.MethodsPerSec > d.MaxMethodsPerSec {
+		anomalies = append(anomalies, Anomaly{
+			Kind:   "command_rate",
+			Detail: fmt.Sprintf("%.1f commands/s (limit %.1f)", stats.MethodsPerSec, d.MaxMethodsPerSec),
+		})
+	}
+	if d.MaxNavigationsPerMin > 0 && stats.NavigationsPerMin > d.MaxNavigationsPerMin {
+		anomalies = append(anomalies, Anomaly{
+			Kind:   "navigation_rate",
+			Detail: fmt.Sprintf("%.1f navigations/min (limit %.1f)", stats.NavigationsPerMin, d.MaxNavigationsPerMin),
+		})
+	}
+	if d.MaxDomains > 0 && len(stats.Domains) > d.MaxDomains {
+		anomalies = append(anomalies, Anomaly{
+			Kind:   "domain_spread",
+			Detail: fmt.Sprintf("%d distinct domains (limit %d)", len(stats.Domains), d.MaxDomains),
+		})
+	}
+	return anomalies
+}
+
+/*
+Handle GET /admin/anomalies
+Returns the last window's statistics of connected sessions and recent
+anomalies. With Accept: text/event-stream, streams new anomalies instead.
+*/
+func (c *ChromeDevToolsClient) handleAnomalies(w http.ResponseWriter, r *http.Request) {
+	if !c.traffic.Enabled() {
+		http.Error(w, "Traffic analysis is disabled (set -anomalyWindow)", http.StatusNotFound)
+		return
+	}
+	if !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		sessions, anomalies := c.traffic.Snapshot()
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"sessions":  sessions,
+			"anomalies": anomalies,
+		})
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	anomalies, cancel := c.traffic.Subscribe()
+	defer cancel()
+	for {
+		select {
+		case a := <-anomalies:
+			writeSSE(w, "anomaly", AnomalyEvent{newEventHeader("anomaly"), a})
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
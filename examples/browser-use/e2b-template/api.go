@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// How long a blocking API call may take when -timeout is 0 and the caller
+// does not say
+const defaultAPIDeadline = 30 * time.Second
+
+// Proxy-owned HTTP API. Requests that match none of these routes are passed
+// through to Chrome unchanged.
+func (c *ChromeDevToolsClient) registerRoutes() {
+	c.api.HandleFunc("GET /readyz", c.handleReadyz)
+	c.api.HandleFunc("GET /health/gateway", c.handleGatewayHealth)
+	c.api.HandleFunc("GET /config", c.handleConfig)
+	c.api.HandleFunc("GET /version", c.handleVersion)
+	c.api.HandleFunc("GET /events/schemas", c.handleEventSchemas)
+	c.api.HandleFunc("POST /wait", c.handleWait)
+	c.api.HandleFunc("POST /batch", c.handleBatch)
+	c.api.HandleFunc("GET /macros", c.handleListMacros)
+	c.api.HandleFunc("POST /macros/{name}", c.handleRunMacro)
+	c.api.HandleFunc("GET /captures", c.handleListCaptures)
+	c.api.HandleFunc("GET /captures/{id}", c.handleGetCapture)
+	c.api.HandleFunc("GET /sessions/{id}/video", c.handleGetVideo)
+	c.api.HandleFunc("GET /sessions/{id}/thumbnails", c.handleListThumbnails)
+	c.api.HandleFunc("GET /sessions/{id}/thumbnails/{thumbnail}", c.handleGetThumbnail)
+	c.api.HandleFunc("GET /sessions/{id}/recordings", c.handleListRecordings)
+	c.api.HandleFunc("GET /sessions/{id}/recordings/{recording}", c.handleGetRecording)
+	c.api.HandleFunc("GET /targets", c.handleListTargets)
+	c.api.HandleFunc("POST /targets/{id}/labels", c.handleSetLabels)
+	c.api.HandleFunc("GET /targets/{id}/frames", c.handleGetFrames)
+	c.api.HandleFunc("GET /targets/{id}/screencast", c.handleScreencast)
+	c.api.HandleFunc("GET /targets/{id}/screenshot", c.handleScreenshot)
+	c.api.HandleFunc("POST /targets/{id}/pdf", c.handlePrintPDF)
+	c.api.HandleFunc("POST /targets/{id}/navigate", c.handleNavigate)
+	c.api.HandleFunc("POST /targets/{id}/evaluate", c.handleEvaluate)
+	c.api.HandleFunc("GET /targets/{id}/cookies", c.handleGetCookies)
+	c.api.HandleFunc("POST /targets/{id}/cookies", c.handleSetCookies)
+	c.api.HandleFunc("GET /targets/{id}/console", c.handleGetConsole)
+	c.api.HandleFunc("POST /targets/{id}/trace/start", c.handleTraceStart)
+	c.api.HandleFunc("POST /targets/{id}/trace/stop", c.handleTraceStop)
+	c.api.HandleFunc("POST /targets/{id}/coverage/start", c.handleCoverageStart)
+	c.api.HandleFunc("POST /targets/{id}/coverage/stop", c.handleCoverageStop)
+	c.api.HandleFunc("POST /targets/{id}/upload", c.handleUploadFile)
+	c.api.HandleFunc("PUT /targets/{id}/throttle", c.handleSetTargetThrottle)
+	c.api.HandleFunc("DELETE /targets/{id}/throttle", c.handleSetTargetThrottle)
+	c.api.HandleFunc("GET /downloads", c.handleListDownloads)
+	c.api.HandleFunc("GET /downloads/{name}", c.handleGetDownload)
+	c.api.HandleFunc("GET /targets/{id}/window", c.handleGetWindow)
+	c.api.HandleFunc("PUT /targets/{id}/window", c.handleSetWindow)
+	c.api.HandleFunc("POST /targets/{id}/activate", c.handleActivateTarget)
+	c.api.HandleFunc("POST /layout/tile", c.handleTile)
+	c.api.HandleFunc("GET /search", c.handleSearch)
+	c.api.HandleFunc("GET /robots/report", c.handleRobotsReport)
+	c.api.HandleFunc("POST /reserve", c.handleReserve)
+	c.api.HandleFunc("POST /reserve/{token}/redeem", c.handleRedeem)
+	c.api.HandleFunc("DELETE /reserve/{token}", c.handleRelease)
+	c.api.HandleFunc("POST /lease", c.handleLease)
+	c.api.HandleFunc("GET /lease/queue/{ticket}", c.handleLeaseQueue)
+	c.api.HandleFunc("GET /channels", c.handleChannels)
+	c.api.HandleFunc("DELETE /lease/{token}", c.handleRelease)
+	c.api.HandleFunc("POST /tasks", c.handleCreateTask)
+	c.api.HandleFunc("GET /tasks", c.handleListTasks)
+	c.api.HandleFunc("GET /tasks/{id}", c.handleGetTask)
+
+	c.api.HandleFunc("GET /admin/mocks", c.requireAdmin(c.handleGetMocks))
+	c.api.HandleFunc("POST /admin/mocks", c.requireAdmin(c.handleSetMocks))
+	c.api.HandleFunc("GET /admin/checkpoint", c.requireAdmin(c.handleGetCheckpoint))
+	c.api.HandleFunc("GET /admin/config", c.requireAdmin(c.handleAdminConfig))
+	c.api.HandleFunc("GET /admin/deprecations", c.requireAdmin(c.handleDeprecations))
+	c.api.HandleFunc("GET /admin/anomalies", c.requireAdmin(c.handleAnomalies))
+	c.api.HandleFunc("GET /admin/query", c.requireAdmin(c.handleStoreQuery))
+	c.api.HandleFunc("POST /admin/upgrade", c.requireAdmin(c.handleUpgrade))
+	c.api.HandleFunc("GET /admin/throttle", c.requireAdmin(c.handleGetThrottle))
+	c.api.HandleFunc("PUT /admin/throttle", c.requireAdmin(c.handleSetThrottle))
+	c.api.HandleFunc("GET /admin/breakglass", c.requireAdmin(c.handleListBreakGlass))
+	c.api.HandleFunc("POST /admin/breakglass", c.requireAdmin(c.handleMintBreakGlass))
+	c.api.HandleFunc("DELETE /admin/breakglass/{id}", c.requireAdmin(c.handleRevokeBreakGlass))
+	c.api.HandleFunc("DELETE /artifacts", c.requireAdmin(c.handlePurgeIdentity))
+	c.api.HandleFunc("DELETE /sessions/{id}/data", c.requireAdmin(c.handlePurgeSession))
+	c.api.HandleFunc("GET /sessions", c.requireAdmin(c.handleListSessions))
+	c.api.HandleFunc("POST /admin/sessions:closeAll", c.requireAdmin(c.handleCloseAllSessions))
+	c.api.HandleFunc("POST /admin/targets:closeByUrlPattern", c.requireAdmin(c.handleCloseTargetsByURL))
+}
+
+// Admin endpoints require the -adminToken bearer token when one is
+// configured, or the token of an -adminACL role allowed to call them
+func (c *ChromeDevToolsClient) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == "" && c.acl == nil {
+			c.serveAdmin(next, w, r)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1 {
+			c.serveAdmin(next, w, r)
+			return
+		}
+		role := c.acl.role(token)
+		if role == nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if c.acl.authorize(w, r, role) {
+			c.serveAdmin(next, w, r)
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Decode a JSON request body, replying 400 on failure
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(v); err != nil {
+		http.Error(w, "Invalid JSON body: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// apiDeadline bounds how long a blocking API call may work on a request
+// that asked for requested (0 or less for as long as allowed). It stays
+// below the server write timeout so the result can still be sent: a second
+// below it, or a quarter of it when -timeout is too short to spare that.
+func (c *ChromeDevToolsClient) apiDeadline(requested time.Duration) time.Duration {
+	timeout := c.client.Timeout
+	if timeout <= 0 {
+		if requested > 0 {
+			return requested
+		}
+		return defaultAPIDeadline
+	}
+	limit := max(timeout-time.Second, timeout*3/4)
+	if requested <= 0 || requested > limit {
+		return limit
+	}
+	return requested
+}
+
+// Write one server-sent event with a JSON payload
+func writeSSE(w http.ResponseWriter, event string, v interface{}) {
+	data, _ := json.Marshal(v)
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+}
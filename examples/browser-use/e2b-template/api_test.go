@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAPIDeadline(t *testing.T) {
+	tests := []struct {
+		timeout   time.Duration
+		requested time.Duration
+		want      time.Duration
+	}{
+		{30 * time.Second, 0, 29 * time.Second},
+		{30 * time.Second, 5 * time.Second, 5 * time.Second},
+		{30 * time.Second, time.Minute, 29 * time.Second},
+		// Too short to spare a second
+		{time.Second, 0, 750 * time.Millisecond},
+		{time.Second, 5 * time.Second, 750 * time.Millisecond},
+		{time.Second, 100 * time.Millisecond, 100 * time.Millisecond},
+		// No -timeout
+		{0, 0, defaultAPIDeadline},
+		{0, time.Hour, time.Hour},
+	}
+	for _, tt := range tests {
+		c := &ChromeDevToolsClient{client: &http.Client{Timeout: tt.timeout}}
+		if got := c.apiDeadline(tt.requested); got != tt.want {
+			t.Errorf("apiDeadline(%v) with -timeout %v = %v, want %v", tt.requested, tt.timeout, got, tt.want)
+		}
+	}
+}
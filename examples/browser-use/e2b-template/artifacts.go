@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Artifact describes one file kept in the artifact store
+type Artifact struct {
+	ID          string            `json:"id"`
+	Kind        string            `json:"kind"`
+	Name        string            `json:"name"`
+	Size        int64             `json:"size"`
+	ContentType string            `json:"contentType,omitempty"`
+	CreatedAt   time.Time         `json:"createdAt"`
+	Meta        map[string]string `json:"meta,omitempty"`
+	// Content is sealed with the sandbox's artifact key
+	Encrypted bool `json:"encrypted,omitempty"`
+	// Codec the content is compressed with before sealing, and the
+	// size it was stored at
+	Codec      string `json:"codec,omitempty"`
+	StoredSize int64  `json:"storedSize,omitempty"`
+}
+
+// ArtifactStore keeps captured files under <dir>/<kind>/<id> with a JSONL
+// index, so artifacts survive proxy restarts. File contents are compressed
+// with the store's codec and, with a cipher, encrypted at rest; the index
+// holds only metadata.
+type ArtifactStore struct {
+	clock Clock
+	dir   string
+	aead  cipher.AEAD
+	codec *Codec
+	level int
+
+	mu    sync.RWMutex
+	items map[string]*Artifact
+}
+
+func NewArtifactStore(clock Clock, dir string, aead cipher.AEAD, codec *Codec, level int) (*ArtifactStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &ArtifactStore{clock: clock, dir: dir, aead: aead, codec: codec, level: level, items: make(map[string]*Artifact)}
+
+	f, err := os.Open(s.indexPath())
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var a Artifact
+		if err := json.Unmarshal(scanner.Bytes(), &a); err == nil {
+			s.items[a.ID] = &a
+		}
+	}
+	return s, scanner.Err()
+}
+
+func (s *ArtifactStore) indexPath() string {
+	return filepath.Join(s.dir, "index.jsonl")
+}
+
+func (s *ArtifactStore) path(a *Artifact) string {
+	return filepath.Join(s.dir, a.Kind, a.ID)
+}
+
+func newArtifactID(clock Clock) string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return fmt.Sprintf("%d-%s", clock.Now().UnixMilli(), hex.EncodeToString(b))
+}
+
+// Put stores data as a new artifact of the given kind
+func (s *ArtifactStore) Put(kind, name string, data []byte, contentType string, meta map[string]string) (*Artifact, error) {
+	a := &Artifact{
+		ID:          newArtifactID(s.clock),
+		Kind:        kind,
+		Name:        name,
+		Size:        int64(len(data)),
+		ContentType: contentType,
+		CreatedAt:   s.clock.Now(),
+		Meta:        meta,
+	}
+	if s.codec != nil && s.codec.Name != "none" {
+		encoded, err := s.codec.encode(data, s.level)
+		if err != nil {
+			return nil, err
+		}
+		data, a.Codec, a.StoredSize = encoded, s.codec.Name, int64(len(encoded))
+	}
+	if s.aead != nil {
+		data = sealArtifact(s.aead, a.ID, data)
+		a.Encrypted = true
+	}
+	if err := os.MkdirAll(filepath.Join(s.dir, kind), 0o755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(s.path(a), data, 0o644); err != nil {
+		return nil, err
+	}
+
+	line, _ := json.Marshal(a)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.indexPath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return nil, err
+	}
+	s.items[a.ID] = a
+	return a, nil
+}
+
+// List returns matching artifacts, oldest first
+func (s *ArtifactStore) List(match func(*Artifact) bool) []*Artifact {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var out []*Artifact
+	for _, a := range s.items {
+		if match == nil || match(a) {
+			out = append(out, a)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// Session returns the artifacts of a kind that belong to a session: a page
+// target id, or the session ID the page was leased with, oldest first
+func (s *ArtifactStore) Session(kind, id string) []*Artifact {
+	return s.List(func(a *Artifact) bool {
+		return a.Kind == kind && belongsToSession(a, id)
+	})
+}
+
+func belongsToSession(a *Artifact, id string) bool {
+	return a.Meta["targetId"] == id || a.Meta["label.session"] == id
+}
+
+func (s *ArtifactStore) Get(id string) (*Artifact, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	a, ok := s.items[id]
+	return a, ok
+}
+
+// Delete removes matching artifacts and their files, rewriting the index so
+// no metadata of them remains on disk
+func (s *ArtifactStore) Delete(match func(*Artifact) bool) ([]*Artifact, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deleted []*Artifact
+	var removeErr error
+	for id, a := range s.items {
+		if !match(a) {
+			continue
+		}
+		// Artifacts whose file can't be removed stay listed so a retry finds them
+		if err := os.Remove(s.path(a)); err != nil && !os.IsNotExist(err) {
+			removeErr = err
+			continue
+		}
+		delete(s.items, id)
+		deleted = append(deleted, a)
+	}
+	sort.Slice(deleted, func(i, j int) bool { return deleted[i].ID < deleted[j].ID })
+	if len(deleted) == 0 {
+		return nil, removeErr
+	}
+
+	var index bytes.Buffer
+	for _, a := range s.items {
+		line, _ := json.Marshal(a)
+		index.Write(append(line, '\n'))
+	}
+	tmp := s.indexPath() + ".tmp"
+	if err := os.WriteFile(tmp, index.Bytes(), 0o644); err != nil {
+		return deleted, err
+	}
+	if err := os.Rename(tmp, s.indexPath()); err != nil {
+		return deleted, err
+	}
+	return deleted, removeErr
+}
+
+// Open returns the content of an artifact, decompressed
+func (s *ArtifactStore) Open(id string) (io.ReadCloser, *Artifact, error) {
+	content, a, err := s.openStored(id)
+	if err != nil || a.Codec == "" {
+		return content, a, err
+	}
+	codec, ok := codecs[a.Codec]
+	if !ok {
+		content.Close()
+		return nil, nil, fmt.Errorf("artifact %s is compressed with %s, which this build lacks", id, a.Codec)
+	}
+	r, err := codec.NewReader(content)
+	if err != nil {
+		content.Close()
+		return nil, nil, err
+	}
+	return &decodedArtifact{ReadCloser: r, stored: content}, a, nil
+}
+
+// decodedArtifact closes the stored file along with its decoder
+type decodedArtifact struct {
+	io.ReadCloser
+	stored io.Closer
+}
+
+func (d *decodedArtifact) Close() error {
+	d.ReadCloser.Close()
+	return d.stored.Close()
+}
+
+// The content of an artifact as stored, decrypted
+func (s *ArtifactStore) openStored(id string) (io.ReadCloser, *Artifact, error) {
+	a, ok := s.Get(id)
+	if !ok || strings.ContainsAny(id, `/\`) {
+		return nil, nil, os.ErrNotExist
+	}
+	if a.Encrypted {
+		if s.aead == nil {
+			return nil, nil, fmt.Errorf("artifact %s is encrypted and no key is configured", id)
+		}
+		data, err := os.ReadFile(s.path(a))
+		if err != nil {
+			return nil, nil, err
+		}
+		plaintext, err := openArtifact(s.aead, a.ID, data)
+		if err != nil {
+			return nil, nil, err
+		}
+		return io.NopCloser(bytes.NewReader(plaintext)), a, nil
+	}
+	f, err := os.Open(s.path(a))
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, a, nil
+}
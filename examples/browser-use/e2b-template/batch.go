@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+type batchCommand struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+type batchRequest struct {
+	TargetID    string         `json:"targetId"`
+	Commands    []batchCommand `json:"commands"`
+	StopOnError bool           `json:"stopOnError"`
+	TimeoutMs   int            `json:"timeoutMs"`
+}
+
+type batchResult struct {
+	Method string          `json:"method"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *CDPError       `json:"error,omitempty"`
+}
+
+/*
+Handle POST /batch, running CDP commands in order over one upstream session
+Request example:
+
+	{
+	   "targetId": "27E1...",
+	   "stopOnError": true,
+	   "commands": [
+	      {"method": "Page.navigate", "params": {"url": "https://example.com"}},
+	      {"method": "Runtime.evaluate", "params": {"expression": "document.title"}}
+	   ]
+	}
+
+Response contains one entry per executed command; with stopOnError the list
+ends at the first failure.
+*/
+func (c *ChromeDevToolsClient) handleBatch(w http.ResponseWriter, r *http.Request) {
+	var req batchRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if len(req.Commands) == 0 {
+		http.Error(w, "commands must not be empty", http.StatusBadRequest)
+		return
+	}
+	for i, cmd := range req.Commands {
+		if cmd.Method == "" {
+			http.Error(w, fmt.Sprintf("commands[%d]: method is required", i), http.StatusBadRequest)
+			return
+		}
+		if !c.allowCommands(w, r, cmd.Method) {
+			return
+		}
+		if err := c.protection.Check(cmd.Method, cmd.Params, apiCaller(r)); err != nil {
+			http.Error(w, fmt.Sprintf("commands[%d]: %s", i, err.Message), http.StatusForbidden)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), c.apiDeadline(time.Duration(req.TimeoutMs)*time.Millisecond))
+	defer cancel()
+
+	results := make([]batchResult, 0, len(req.Commands))
+	failed := false
+	err := c.control.WithSession(ctx, req.TargetID, func(conn *CDPConn, sessionID string) error {
+		for _, cmd := range req.Commands {
+			var params interface{}
+			if len(cmd.Params) > 0 {
+				params = cmd.Params
+			}
+			result, err := conn.Call(ctx, sessionID, cmd.Method, params)
+
+			var cdpErr *CDPError
+			switch {
+			case err == nil:
+				results = append(results, batchResult{Method: cmd.Method, Result: result})
+			case errors.As(err, &cdpErr):
+				failed = true
+				results = append(results, batchResult{Method: cmd.Method, Error: cdpErr})
+				if req.StopOnError {
+					return nil
+				}
+			default:
+				// Transport failure or timeout, later commands cannot run either
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.errorCount++
+		log.Printf("❌ Batch failed after %d/%d commands: %v", len(results), len(req.Commands), err)
+		http.Error(w, fmt.Sprintf("Batch failed after %d commands: %v", len(results), err), http.StatusBadGateway)
+		return
+	}
+
+	log.Printf("📦 Batch executed %d/%d commands", len(results), len(req.Commands))
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"results":   results,
+		"completed": len(results),
+		"failed":    failed,
+	})
+}
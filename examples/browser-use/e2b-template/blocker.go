@@ -0,0 +1,520 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// filterList is one parsed EasyList-style list. Only network rules are
+// supported: cosmetic rules are ignored, and so are network rules with an
+// option the blocker cannot honour (e.g. $csp=, $redirect=, $popup), as
+// dropping the option would block more than the rule asks for.
+type filterList struct {
+	source string
+
+	// Rules anchored to a host ("||host^...", "||host/..."), by that host;
+	// a request only meets those of its host and its parent domains
+	hosts          map[string][]*filterRule
+	exceptionHosts map[string][]*filterRule
+	// The other rules, tried on every request
+	patterns   []*filterRule
+	exceptions []*filterRule
+	// Rules left out for their options
+	skipped int
+}
+
+// filterRule is a network rule with its options
+type filterRule struct {
+	// Nil for "||host^" rules, which match every URL of the host
+	re *regexp.Regexp
+	// $third-party (1) or $~third-party (-1)
+	thirdParty int
+	// $script, $image, ... as CDP resource types; $~script, ... excluded
+	types, notTypes map[string]bool
+	// $domain=: hosts of the pages the rule applies on, or not
+	domains, notDomains map[string]bool
+	// $important rules are not undone by exceptions
+	important bool
+}
+
+// filterRequest is what rules are matched against
+type filterRequest struct {
+	url  string
+	host string
+	// CDP resource type, e.g. Script
+	resourceType string
+	// Host of the page making the request; empty when unknown
+	pageHost string
+}
+
+// Filter resource type options and the CDP resource types they stand for
+var filterResourceTypes = map[string][]string{
+	"script":         {"Script"},
+	"image":          {"Image"},
+	"stylesheet":     {"Stylesheet"},
+	"font":           {"Font"},
+	"media":          {"Media"},
+	"xmlhttprequest": {"XHR", "Fetch"},
+	"xhr":            {"XHR", "Fetch"},
+	"websocket":      {"WebSocket"},
+	"ping":           {"Ping", "CSPViolationReport"},
+	"other":          {"Other", "TextTrack", "EventSource", "Manifest", "SignedExchange", "Prefetch", "Preflight"},
+}
+
+func parseFilterList(source string, r io.Reader) (*filterList, error) {
+	list := &filterList{
+		source:         source,
+		hosts:          make(map[string][]*filterRule),
+		exceptionHosts: make(map[string][]*filterRule),
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") || isCosmeticFilter(line) {
+			continue
+		}
+
+		exception := strings.HasPrefix(line, "@@")
+		line = strings.TrimPrefix(line, "@@")
+		pattern, options := splitFilterOptions(line)
+		if pattern == "" {
+			continue
+		}
+		rule, ok := parseFilterOptions(options)
+		if !ok {
+			list.skipped++
+			continue
+		}
+
+		// "||host^" matches every URL of the host without an expression
+		host, anchored := filterHostAnchor(pattern)
+		if !anchored || strings.TrimSuffix(pattern, "^") != "||"+host {
+			re, err := regexp.Compile("(?i)" + filterExpression(pattern))
+			if err != nil {
+				list.skipped++
+				continue
+			}
+			rule.re = re
+		}
+
+		switch {
+		case anchored && exception:
+			list.exceptionHosts[host] = append(list.exceptionHosts[host], rule)
+		case anchored:
+			list.hosts[host] = append(list.hosts[host], rule)
+		case exception:
+			list.exceptions = append(list.exceptions, rule)
+		default:
+			list.patterns = append(list.patterns, rule)
+		}
+	}
+	return list, scanner.Err()
+}
+
+// Split a rule into its pattern and its options. A "/regex/" rule keeps
+// any "$" inside the expression.
+func splitFilterOptions(line string) (string, string) {
+	if len(line) > 2 && strings.HasPrefix(line, "/") && strings.HasSuffix(line, "/") {
+		return line, ""
+	}
+	if i := strings.LastIndex(line, "$"); i >= 0 {
+		return line[:i], line[i+1:]
+	}
+	return line, ""
+}
+
+// Parse the options of a rule, reporting false when one is not supported
+func parseFilterOptions(options string) (*filterRule, bool) {
+	rule := &filterRule{}
+	if options == "" {
+		return rule, true
+	}
+	for _, option := range strings.Split(options, ",") {
+		option = strings.ToLower(strings.TrimSpace(option))
+		name, value, _ := strings.Cut(option, "=")
+		negated := strings.HasPrefix(name, "~")
+		name = strings.TrimPrefix(name, "~")
+		switch {
+		case name == "third-party" || name == "3p":
+			rule.thirdParty = 1
+			if negated {
+				rule.thirdParty = -1
+			}
+		case name == "first-party" || name == "1p":
+			rule.thirdParty = -1
+			if negated {
+				rule.thirdParty = 1
+			}
+		case name == "domain" && value != "" && !negated:
+			for _, d := range strings.Split(value, "|") {
+				if d, excluded := strings.CutPrefix(d, "~"); excluded {
+					rule.notDomains = addFilterKey(rule.notDomains, d)
+				} else {
+					rule.domains = addFilterKey(rule.domains, d)
+				}
+			}
+		case name == "important" && !negated:
+			rule.important = true
+		case name == "match-case" && !negated:
+			// Rules are matched case-insensitively; a case-sensitive one
+			// matching less is safer left out than widened
+			return nil, false
+		case filterResourceTypes[name] != nil && value == "":
+			for _, t := range filterResourceTypes[name] {
+				if negated {
+					rule.notTypes = addFilterKey(rule.notTypes, t)
+				} else {
+					rule.types = addFilterKey(rule.types, t)
+				}
+			}
+		default:
+			return nil, false
+		}
+	}
+	return rule, true
+}
+
+func addFilterKey(set map[string]bool, key string) map[string]bool {
+	if set == nil {
+		set = make(map[string]bool)
+	}
+	set[key] = true
+	return set
+}
+
+// The host a "||host" rule is anchored to, when it is a plain host name
+// ending at a separator, so that the rule can be indexed by it
+func filterHostAnchor(pattern string) (string, bool) {
+	rest, ok := strings.CutPrefix(pattern, "||")
+	if !ok {
+		return "", false
+	}
+	end := strings.IndexAny(rest, "^/:|*")
+	if end <= 0 || rest[end] == '*' || rest[end] == '|' {
+		return "", false
+	}
+	return strings.ToLower(rest[:end]), true
+}
+
+func isCosmeticFilter(line string) bool {
+	for _, sep := range []string{"##", "#@#", "#?#", "#$#"} {
+		if strings.Contains(line, sep) {
+			return true
+		}
+	}
+	return false
+}
+
+// The regular expression of a pattern: a "/regex/" rule as is, the
+// filter syntax (||, |, ^, *) translated
+func filterExpression(pattern string) string {
+	if len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		return pattern[1 : len(pattern)-1]
+	}
+	return filterToRegexp(pattern)
+}
+
+// Translate the filter syntax (||, |, ^, *) into a regular expression
+func filterToRegexp(filter string) string {
+	var b strings.Builder
+	switch {
+	case strings.HasPrefix(filter, "||"):
+		b.WriteString(`^[a-z][a-z0-9+.-]*://([^/]*\.)?`)
+		filter = filter[2:]
+	case strings.HasPrefix(filter, "|"):
+		b.WriteString("^")
+		filter = filter[1:]
+	}
+	endAnchor := strings.HasSuffix(filter, "|")
+	filter = strings.TrimSuffix(filter, "|")
+
+	for _, ch := range filter {
+		switch ch {
+		case '*':
+			b.WriteString(".*")
+		case '^':
+			b.WriteString(`([^a-zA-Z0-9_.%-]|$)`)
+		default:
+			b.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	if endAnchor {
+		b.WriteString("$")
+	}
+	return b.String()
+}
+
+func domainMatch(set map[string]bool, host string) bool {
+	for host != "" {
+		if set[host] {
+			return true
+		}
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			break
+		}
+		host = host[i+1:]
+	}
+	return false
+}
+
+// Call fn with the rules indexed under host and its parent domains until
+// it returns true
+func hostRules(index map[string][]*filterRule, host string, fn func(*filterRule) bool) bool {
+	for host != "" {
+		for _, rule := range index[host] {
+			if fn(rule) {
+				return true
+			}
+		}
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			break
+		}
+		host = host[i+1:]
+	}
+	return false
+}
+
+// The site of a host, for $third-party: its last two labels, or three
+// under a two-letter country code with a short second level (co.uk,
+// com.au). An approximation of the registrable domain without the public
+// suffix list.
+func siteOf(host string) string {
+	labels := strings.Split(strings.TrimSuffix(host, "."), ".")
+	n := 2
+	if len(labels) > 2 && len(labels[len(labels)-1]) == 2 && len(labels[len(labels)-2]) <= 3 {
+		n = 3
+	}
+	if len(labels) <= n {
+		return host
+	}
+	return strings.Join(labels[len(labels)-n:], ".")
+}
+
+func (r *filterRule) match(req *filterRequest) bool {
+	if (r.types != nil && !r.types[req.resourceType]) || r.notTypes[req.resourceType] {
+		return false
+	}
+	// Rules scoped to pages never apply when the page is unknown
+	if r.thirdParty != 0 {
+		if req.pageHost == "" || (siteOf(req.host) != siteOf(req.pageHost)) != (r.thirdParty > 0) {
+			return false
+		}
+	}
+	if r.domains != nil && (req.pageHost == "" || !domainMatch(r.domains, req.pageHost)) {
+		return false
+	}
+	if r.notDomains != nil && (req.pageHost == "" || domainMatch(r.notDomains, req.pageHost)) {
+		return false
+	}
+	return r.re == nil || r.re.MatchString(req.url)
+}
+
+// Whether a rule blocks the request and no exception allows it, unless the
+// rule is $important
+func (l *filterList) matches(req *filterRequest) bool {
+	blocked, important := false, false
+	check := func(rule *filterRule) bool {
+		if rule.match(req) {
+			blocked = true
+			important = rule.important
+		}
+		return important
+	}
+	if !hostRules(l.hosts, req.host, check) {
+		for _, rule := range l.patterns {
+			if check(rule) {
+				break
+			}
+		}
+	}
+	if !blocked || important {
+		return blocked
+	}
+	allowed := func(rule *filterRule) bool { return rule.match(req) }
+	if hostRules(l.exceptionHosts, req.host, allowed) {
+		return false
+	}
+	for _, rule := range l.exceptions {
+		if rule.match(req) {
+			return false
+		}
+	}
+	return true
+}
+
+func (l *filterList) size() int {
+	n := len(l.patterns) + len(l.exceptions)
+	for _, rules := range l.hosts {
+		n += len(rules)
+	}
+	for _, rules := range l.exceptionHosts {
+		n += len(rules)
+	}
+	return n
+}
+
+// RequestBlocker fails requests matching the configured filter lists
+type RequestBlocker struct {
+	clock   Clock
+	sources []string
+	refresh time.Duration
+	client  *http.Client
+
+	mu      sync.RWMutex
+	lists   map[string]*filterList
+	blocked map[string]int64
+	loadErr map[string]string
+}
+
+func NewRequestBlocker(clock Clock, sources []string, refresh time.Duration, client *http.Client) *RequestBlocker {
+	b := &RequestBlocker{
+		clock:   clock,
+		sources: sources,
+		refresh: refresh,
+		client:  client,
+		lists:   make(map[string]*filterList),
+		blocked: make(map[string]int64),
+		loadErr: make(map[string]string),
+	}
+	b.reload()
+	if refresh > 0 {
+		go func() {
+			ticker := clock.NewTicker(refresh)
+			for range ticker.C() {
+				b.reload()
+			}
+		}()
+	}
+	return b
+}
+
+// Reload every list, keeping the previous rules of lists that fail to load
+func (b *RequestBlocker) reload() {
+	for _, source := range b.sources {
+		list, err := b.load(source)
+		b.mu.Lock()
+		if err != nil {
+			b.loadErr[source] = err.Error()
+			log.Printf("⚠️ Failed to load filter list %s: %v", source, err)
+		} else {
+			delete(b.loadErr, source)
+			b.lists[source] = list
+			log.Printf("🛡️ Loaded filter list %s (%d rules, %d skipped for unsupported options)", source, list.size(), list.skipped)
+		}
+		b.mu.Unlock()
+	}
+}
+
+func (b *RequestBlocker) load(source string) (*filterList, error) {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		resp, err := b.client.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("GET %s: %s", source, resp.Status)
+		}
+		return parseFilterList(source, resp.Body)
+	}
+
+	f, err := os.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseFilterList(source, f)
+}
+
+// Match returns the list blocking a request of the given resource type to
+// rawURL from a page at pageURL, if any
+func (b *RequestBlocker) Match(rawURL, resourceType, pageURL string) (string, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "ws" && u.Scheme != "wss") {
+		return "", false
+	}
+	req := &filterRequest{url: rawURL, host: strings.ToLower(u.Hostname()), resourceType: resourceType}
+	if page, err := url.Parse(pageURL); err == nil {
+		req.pageHost = strings.ToLower(page.Hostname())
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, source := range b.sources {
+		if list, ok := b.lists[source]; ok && list.matches(req) {
+			return source, true
+		}
+	}
+	return "", false
+}
+
+func (b *RequestBlocker) HandleRequestPaused(ctx context.Context, s *PageSession, ev *FetchRequestPaused) bool {
+	// Never block top-level navigations, only subresources
+	if ev.IsResponseStage() || ev.ResourceType == "Document" {
+		return false
+	}
+	// The page a request comes from is told by its Referer, which may be
+	// cut to the origin but not the host; without one, by the page's URL
+	// when it was attached
+	pageURL := ev.Request.Headers["Referer"]
+	if pageURL == "" {
+		pageURL = s.Target.URL
+	}
+	source, ok := b.Match(ev.Request.URL, ev.ResourceType, pageURL)
+	if !ok {
+		return false
+	}
+
+	b.mu.Lock()
+	b.blocked[source]++
+	b.mu.Unlock()
+
+	s.Call(ctx, "Fetch.failRequest", map[string]interface{}{
+		"requestId":   ev.RequestID,
+		"errorReason": "BlockedByClient",
+	})
+	return true
+}
+
+func (b *RequestBlocker) Metrics() map[string]interface{} {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	var total int64
+	byList := make(map[string]int64, len(b.sources))
+	rules := make(map[string]int, len(b.sources))
+	skipped := make(map[string]int, len(b.sources))
+	for _, source := range b.sources {
+		byList[source] = b.blocked[source]
+		total += b.blocked[source]
+		if list, ok := b.lists[source]; ok {
+			rules[source] = list.size()
+			skipped[source] = list.skipped
+		}
+	}
+	errors := make(map[string]string, len(b.loadErr))
+	for k, v := range b.loadErr {
+		errors[k] = v
+	}
+	return map[string]interface{}{
+		"blocker_blocked_total":   total,
+		"blocker_blocked_by_list": byList,
+		"blocker_rules_by_list":   rules,
+		"blocker_skipped_by_list": skipped,
+		"blocker_load_errors":     errors,
+	}
+}
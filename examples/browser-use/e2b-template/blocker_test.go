@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFilterListOptions(t *testing.T) {
+	list, err := parseFilterList("test", strings.NewReader(`! comment
+||ads.example^
+||cdn.example/track/*$script,third-party
+||widgets.example^$domain=news.example|~sports.news.example
+/banner[0-9]+\.gif$/
+||popup.example^$popup
+@@||ads.example/allowed^
+||strict.example^$important
+@@||strict.example^
+example.com##.ad
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.skipped != 1 {
+		t.Errorf("skipped = %d, want 1 ($popup)", list.skipped)
+	}
+	if len(list.patterns) != 1 || len(list.hosts["cdn.example"]) != 1 {
+		t.Errorf("rules not indexed by host: %d patterns, hosts %v", len(list.patterns), list.hosts)
+	}
+
+	tests := []struct {
+		url, resourceType, pageURL string
+		want                       bool
+	}{
+		{"https://ads.example/x.js", "Script", "", true},
+		{"https://sub.ads.example/x.js", "Script", "", true},
+		{"https://notads.example/x.js", "Script", "", false},
+		{"https://ads.example/allowed", "Script", "", false},
+		// Resource type and party
+		{"https://cdn.example/track/a", "Script", "https://shop.example/", true},
+		{"https://cdn.example/track/a", "Image", "https://shop.example/", false},
+		{"https://cdn.example/track/a", "Script", "https://www.cdn.example/", false},
+		{"https://cdn.example/track/a", "Script", "", false},
+		// Page domains
+		{"https://widgets.example/w.js", "Script", "https://news.example/", true},
+		{"https://widgets.example/w.js", "Script", "https://sports.news.example/", false},
+		{"https://widgets.example/w.js", "Script", "https://other.example/", false},
+		// Regular expressions, case-insensitive like the other rules
+		{"https://img.example/BANNER12.gif", "Image", "", true},
+		{"https://img.example/banner.gif", "Image", "", false},
+		// Skipped rule
+		{"https://popup.example/", "Document", "", false},
+		// $important beats exceptions
+		{"https://strict.example/", "Script", "", true},
+	}
+	b := &RequestBlocker{sources: []string{"test"}, lists: map[string]*filterList{"test": list}}
+	for _, tt := range tests {
+		if _, got := b.Match(tt.url, tt.resourceType, tt.pageURL); got != tt.want {
+			t.Errorf("Match(%s, %s, %q) = %v, want %v", tt.url, tt.resourceType, tt.pageURL, got, tt.want)
+		}
+	}
+}
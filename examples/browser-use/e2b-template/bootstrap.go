@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const maxAcceptLanguageLength = 256
+
+var (
+	cookieJarNamePattern  = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+	localePattern         = regexp.MustCompile(`^[A-Za-z]{2,3}(?:[-_][A-Za-z0-9]{2,8})*$`)
+	acceptLanguagePattern = regexp.MustCompile(`^[A-Za-z0-9*_,;=. -]+$`)
+)
+
+// bootstrapSpec describes how a target is prepared before it is handed to
+// an agent, so the agent starts on a ready page instead of doing setup
+type bootstrapSpec struct {
+	StartURL  string        `json:"startUrl,omitempty"`
+	Viewport  *viewportSpec `json:"viewport,omitempty"`
+	UserAgent string        `json:"userAgent,omitempty"`
+	// Name of a cookie jar file in -cookieJarDir (<name>.json holding a
+	// Network.setCookies cookie array)
+	CookieJar string `json:"cookieJar,omitempty"`
+	// BCP 47 locale such as "zh-CN", applied to JS Intl and Accept-Language
+	Locale string `json:"locale,omitempty"`
+	// Accept-Language header and navigator.languages, e.g.
+	// "zh-CN,zh;q=0.9,en;q=0.8"; defaults to the locale and its language
+	AcceptLanguage string `json:"acceptLanguage,omitempty"`
+}
+
+// Validate rejects malformed fields before a target is created for them
+func (b *bootstrapSpec) Validate() error {
+	if b.Locale != "" && !localePattern.MatchString(b.Locale) {
+		return fmt.Errorf("invalid locale %q", b.Locale)
+	}
+	if b.AcceptLanguage != "" && (len(b.AcceptLanguage) > maxAcceptLanguageLength || !acceptLanguagePattern.MatchString(b.AcceptLanguage)) {
+		return fmt.Errorf("invalid acceptLanguage %q", b.AcceptLanguage)
+	}
+	return nil
+}
+
+// Accept-Language for a locale: "zh-CN" prefers zh-CN, then any zh
+func acceptLanguageFor(locale string) string {
+	locale = strings.ReplaceAll(locale, "_", "-")
+	if lang, _, ok := strings.Cut(locale, "-"); ok {
+		return locale + "," + lang + ";q=0.9"
+	}
+	return locale
+}
+
+func loadCookieJar(name string) (json.RawMessage, error) {
+	if cookieJarDir == "" {
+		return nil, fmt.Errorf("cookie jars are disabled (set -cookieJarDir)")
+	}
+	if !cookieJarNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid cookie jar name %q", name)
+	}
+	data, err := os.ReadFile(filepath.Join(cookieJarDir, name+".json"))
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(data) {
+		return nil, fmt.Errorf("cookie jar %q is not valid JSON", name)
+	}
+	return data, nil
+}
+
+// Apply runs the bootstrap steps on an attached session. Emulation settings
+// last only as long as that session stays attached.
+func (b *bootstrapSpec) Apply(ctx context.Context, conn *CDPConn, sessionID string) error {
+	if b.Viewport != nil {
+		scale := b.Viewport.DeviceScaleFactor
+		if scale == 0 {
+			scale = 1
+		}
+		if _, err := conn.Call(ctx, sessionID, "Emulation.setDeviceMetricsOverride", map[string]interface{}{
+			"width":             b.Viewport.Width,
+			"height":            b.Viewport.Height,
+			"deviceScaleFactor": scale,
+			"mobile":            b.Viewport.Mobile,
+		}); err != nil {
+			return fmt.Errorf("set viewport: %w", err)
+		}
+	}
+
+	if b.UserAgent != "" || b.Locale != "" || b.AcceptLanguage != "" {
+		userAgent := b.UserAgent
+		if userAgent == "" {
+			var version struct {
+				UserAgent string `json:"userAgent"`
+			}
+			if err := conn.CallResult(ctx, "", "Browser.getVersion", nil, &version); err != nil {
+				return fmt.Errorf("get user agent: %w", err)
+			}
+			userAgent = version.UserAgent
+		}
+		params := map[string]interface{}{"userAgent": userAgent}
+		if b.AcceptLanguage != "" {
+			params["acceptLanguage"] = b.AcceptLanguage
+		} else if b.Locale != "" {
+			params["acceptLanguage"] = acceptLanguageFor(b.Locale)
+		}
+		if _, err := conn.Call(ctx, sessionID, "Emulation.setUserAgentOverride", params); err != nil {
+			return fmt.Errorf("set user agent: %w", err)
+		}
+	}
+	if b.Locale != "" {
+		if _, err := conn.Call(ctx, sessionID, "Emulation.setLocaleOverride", map[string]interface{}{"locale": strings.ReplaceAll(b.Locale, "_", "-")}); err != nil {
+			return fmt.Errorf("set locale: %w", err)
+		}
+	}
+
+	if b.CookieJar != "" {
+		cookies, err := loadCookieJar(b.CookieJar)
+		if err != nil {
+			return fmt.Errorf("load cookie jar: %w", err)
+		}
+		if _, err := conn.Call(ctx, sessionID, "Network.setCookies", map[string]interface{}{"cookies": cookies}); err != nil {
+			return fmt.Errorf("set cookies: %w", err)
+		}
+	}
+
+	if b.StartURL != "" {
+		if _, err := conn.Call(ctx, sessionID, "Page.navigate", map[string]interface{}{"url": b.StartURL}); err != nil {
+			return fmt.Errorf("navigate: %w", err)
+		}
+		if err := waitForLoad(ctx, conn, sessionID); err != nil {
+			return fmt.Errorf("wait for start page: %w", err)
+		}
+	}
+	return nil
+}
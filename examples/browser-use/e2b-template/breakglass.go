@@ -0,0 +1,302 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	breakGlassHeader     = "X-PPIO-Break-Glass"
+	defaultBreakGlassTTL = 15 * time.Minute
+	maxBreakGlassTTL     = time.Hour
+	// Audit events kept in memory for GET /admin/breakglass
+	breakGlassAuditSize = 200
+)
+
+// breakGlassGrant is a short-lived elevated token for one target. The
+// secret token is only returned when minted; listings show the grant id.
+type breakGlassGrant struct {
+	ID        string    `json:"id"`
+	TargetID  string    `json:"targetId"`
+	Reason    string    `json:"reason"`
+	CreatedBy string    `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	Uses      int       `json:"uses"`
+	Revoked   bool      `json:"revoked,omitempty"`
+
+	token string
+}
+
+type breakGlassEvent struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	GrantID  string    `json:"grantId"`
+	TargetID string    `json:"targetId"`
+	// Authenticated admin who minted or revoked the grant
+	Actor string `json:"actor,omitempty"`
+	// Unverified X-PPIO-Actor name given with it
+	ClaimedActor string `json:"claimedActor,omitempty"`
+	Detail       string `json:"detail,omitempty"`
+}
+
+// The grant a WebSocket upgrade was admitted with, in its request context
+type breakGlassGrantKey struct{}
+
+// BreakGlass issues time-boxed tokens that let support bypass the proxy's
+// session policy (WebSocket URL signing and the CDP method policy) for a
+// single target, e.g. to reattach to a customer session whose one-time URL
+// was consumed.
+// Every mint, use, revocation and expiry is audit logged.
+type BreakGlass struct {
+	clock Clock
+
+	mu     sync.Mutex
+	grants map[string]*breakGlassGrant
+	audit  []breakGlassEvent
+	// Called with each audit event, under b.mu
+	onAudit []func(breakGlassEvent)
+}
+
+func NewBreakGlass(clock Clock) *BreakGlass {
+	return &BreakGlass{clock: clock, grants: make(map[string]*breakGlassGrant)}
+}
+
+// Caller must hold b.mu
+func (b *BreakGlass) record(event string, g *breakGlassGrant, detail string) {
+	b.recordBy(event, g, "", "", detail)
+}
+
+// Record an event an admin caused. Caller must hold b.mu.
+func (b *BreakGlass) recordBy(event string, g *breakGlassGrant, actor, claimed, detail string) {
+	log.Printf("🔓 BREAK-GLASS %s grant=%s target=%s %s", event, g.ID, g.TargetID, detail)
+	ev := breakGlassEvent{Time: b.clock.Now(), Event: event, GrantID: g.ID, TargetID: g.TargetID, Actor: actor, ClaimedActor: claimed, Detail: detail}
+	b.audit = append(b.audit, ev)
+	if len(b.audit) > breakGlassAuditSize {
+		b.audit = b.audit[len(b.audit)-breakGlassAuditSize:]
+	}
+	for _, fn := range b.onAudit {
+		fn(ev)
+	}
+}
+
+// OnAudit registers fn to receive every audit event, e.g. to persist them
+func (b *BreakGlass) OnAudit(fn func(breakGlassEvent)) {
+	b.onAudit = append(b.onAudit, fn)
+}
+
+// Drop expired grants, auditing each. Caller must hold b.mu.
+func (b *BreakGlass) expire(now time.Time) {
+	for id, g := range b.grants {
+		if !now.Before(g.ExpiresAt) {
+			if !g.Revoked {
+				b.record("expired", g, "")
+			}
+			delete(b.grants, id)
+		}
+	}
+}
+
+// Mint a grant for the authenticated actor createdBy; claimed is the
+// unverified name the caller gave, recorded alongside
+func (b *BreakGlass) Mint(targetID, reason, createdBy, claimed string, ttl time.Duration) *breakGlassGrant {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.clock.Now()
+	b.expire(now)
+	g := &breakGlassGrant{
+		ID:        newToken()[:12],
+		TargetID:  targetID,
+		Reason:    reason,
+		CreatedBy: createdBy,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+		token:     newToken(),
+	}
+	b.grants[g.ID] = g
+	b.recordBy("minted", g, createdBy, claimed, fmtBreakGlassDetail("by", createdBy, "claimed", claimed, "ttl", ttl.String(), "reason", reason))
+	return g
+}
+
+// Authorize returns the grant matching the request's break-glass header for
+// the target, or nil. Each successful use is audited.
+func (b *BreakGlass) Authorize(r *http.Request, targetID string) *breakGlassGrant {
+	token := r.Header.Get(breakGlassHeader)
+	if token == "" {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.expire(b.clock.Now())
+	for _, g := range b.grants {
+		if g.Revoked || subtle.ConstantTimeCompare([]byte(token), []byte(g.token)) != 1 {
+			continue
+		}
+		if g.TargetID != targetID {
+			b.record("denied", g, fmtBreakGlassDetail("path", r.URL.Path, "from", r.RemoteAddr))
+			return nil
+		}
+		g.Uses++
+		b.record("used", g, fmtBreakGlassDetail("path", r.URL.Path, "from", r.RemoteAddr))
+		return g
+	}
+	return nil
+}
+
+func (b *BreakGlass) Revoke(id, revokedBy, claimed string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	g, ok := b.grants[id]
+	if !ok || g.Revoked {
+		return false
+	}
+	g.Revoked = true
+	b.recordBy("revoked", g, revokedBy, claimed, fmtBreakGlassDetail("by", revokedBy, "claimed", claimed))
+	return true
+}
+
+// Snapshot returns the active grants and the recent audit trail
+func (b *BreakGlass) Snapshot() ([]breakGlassGrant, []breakGlassEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.expire(b.clock.Now())
+	grants := make([]breakGlassGrant, 0, len(b.grants))
+	for _, g := range b.grants {
+		grants = append(grants, *g)
+	}
+	sort.Slice(grants, func(i, j int) bool { return grants[i].CreatedAt.Before(grants[j].CreatedAt) })
+	return grants, append([]breakGlassEvent(nil), b.audit...)
+}
+
+func (b *BreakGlass) Metrics() map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	active := 0
+	for _, g := range b.grants {
+		if !g.Revoked && b.clock.Now().Before(g.ExpiresAt) {
+			active++
+		}
+	}
+	return map[string]interface{}{"break_glass_active": active}
+}
+
+// Format key=value pairs for audit lines, quoting values and leaving out
+// empty ones
+func fmtBreakGlassDetail(pairs ...string) string {
+	var parts []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i+1] == "" {
+			continue
+		}
+		parts = append(parts, pairs[i]+"="+strconv.Quote(pairs[i+1]))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Target id of a /devtools/page/<id> WebSocket path, or "" for others
+func devtoolsTargetID(path string) string {
+	id, ok := strings.CutPrefix(path, "/devtools/page/")
+	if !ok {
+		return ""
+	}
+	return id
+}
+
+// Header in which callers may name the person behind a request. Anyone can
+// set it, so it is only recorded next to the authenticated actor.
+const actorHeader = "X-PPIO-Actor"
+
+// Identify the caller for the audit trail by the credentials it presented:
+// "admin" for the -adminToken token, "role:<name>" for an -adminACL role's,
+// otherwise "anonymous@<address>"
+func requestActor(r *http.Request, acl *AdminACL) string {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1 {
+		return "admin"
+	}
+	if role := acl.role(token); role != nil {
+		return "role:" + role.name
+	}
+	return "anonymous@" + r.RemoteAddr
+}
+
+// The unverified name the caller gave in X-PPIO-Actor
+func claimedActor(r *http.Request) string {
+	return r.Header.Get(actorHeader)
+}
+
+// The caller for log lines: the authenticated actor and any claimed name
+func actorLabel(r *http.Request, acl *AdminACL) string {
+	actor := requestActor(r, acl)
+	if claimed := claimedActor(r); claimed != "" {
+		return fmt.Sprintf("%s (claims %q)", actor, claimed)
+	}
+	return actor
+}
+
+/*
+Handle POST /admin/breakglass
+Request example:
+
+	{"targetId": "27E1...", "reason": "TICKET-123 customer stuck on captcha", "ttlMs": 600000}
+
+Returns the grant including its secret token, to be sent as the
+X-PPIO-Break-Glass header on the WebSocket upgrade. The reason is required
+and the TTL is capped at one hour.
+*/
+func (c *ChromeDevToolsClient) handleMintBreakGlass(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		TargetID string `json:"targetId"`
+		Reason   string `json:"reason"`
+		TTLMs    int    `json:"ttlMs"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.TargetID == "" || req.Reason == "" {
+		http.Error(w, "targetId and reason are required", http.StatusBadRequest)
+		return
+	}
+	ttl := time.Duration(req.TTLMs) * time.Millisecond
+	if ttl <= 0 {
+		ttl = defaultBreakGlassTTL
+	}
+	if ttl > maxBreakGlassTTL {
+		ttl = maxBreakGlassTTL
+	}
+
+	g := c.breakGlass.Mint(req.TargetID, req.Reason, requestActor(r, c.acl), claimedActor(r), ttl)
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"id":        g.ID,
+		"token":     g.token,
+		"header":    breakGlassHeader,
+		"targetId":  g.TargetID,
+		"expiresAt": g.ExpiresAt,
+	})
+}
+
+// Handle GET /admin/breakglass, listing active grants and the audit trail
+func (c *ChromeDevToolsClient) handleListBreakGlass(w http.ResponseWriter, r *http.Request) {
+	grants, audit := c.breakGlass.Snapshot()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"grants": grants,
+		"audit":  audit,
+	})
+}
+
+// Handle DELETE /admin/breakglass/{id}, revoking a grant before it expires
+func (c *ChromeDevToolsClient) handleRevokeBreakGlass(w http.ResponseWriter, r *http.Request) {
+	if !c.breakGlass.Revoke(r.PathValue("id"), requestActor(r, c.acl), claimedActor(r)) {
+		http.Error(w, "unknown or revoked grant", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
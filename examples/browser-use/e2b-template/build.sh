@@ -78,25 +78,29 @@ check_dependencies() {
 
 # 编译 Go 反向代理
 compile_proxy() {
-    log_step "编译 Go 反向代理为 Linux x86 二进制文件..."
+    log_step "编译 Go 反向代理为 Linux 二进制文件..."
     
     # 设置编译参数
     export GOOS=linux
-    export GOARCH=amd64
+    # ARM64 沙箱可用 GOARCH=arm64 ./build.sh 编译
+    export GOARCH="${GOARCH:-amd64}"
     export CGO_ENABLED=0
     
     # 编译输出文件名
     OUTPUT_FILE="reverse-proxy"
+    # 版本号写入二进制，出现在启动时的 JSON 就绪行中
+    VERSION="${VERSION:-$(git describe --tags --always --dirty 2>/dev/null || echo dev)}"
     
     log_info "编译配置:"
-    echo "  源文件: reverse-proxy.go"
+    echo "  源文件: *.go"
     echo "  目标文件: $OUTPUT_FILE"
     echo "  目标系统: $GOOS"
     echo "  目标架构: $GOARCH"
     echo "  CGO: $CGO_ENABLED"
+    echo "  版本: $VERSION"
     
     # 开始编译
-    if go build -ldflags="-s -w" -o "$OUTPUT_FILE" reverse-proxy.go; then
+    if go build -ldflags="-s -w -X main.version=$VERSION" -o "$OUTPUT_FILE" *.go; then
         log_success "反向代理编译成功!"
         
         # 显示文件信息
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Bulk maintenance endpoints, so that fleet scripts make one request per
+// sandbox instead of one per session or target over high-latency links.
+// Each takes dryRun=true to list what it would close.
+
+/*
+Handle POST /admin/sessions:closeAll
+Query parameters, all optional and combined:
+
+	olderThan=1h   sessions connected longer ago than this
+	target=<id>    sessions of this target ("browser" for the browser endpoint)
+	task=<id>      sessions of this task
+	dryRun=true    list the sessions without closing them
+
+Closes the matching client WebSocket sessions (those GET /sessions lists)
+and returns their usage up to then.
+*/
+func (c *ChromeDevToolsClient) handleCloseAllSessions(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var olderThan time.Duration
+	if v := query.Get("olderThan"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			http.Error(w, "olderThan must be a duration such as 1h", http.StatusBadRequest)
+			return
+		}
+		olderThan = d
+	}
+	dryRun, _ := strconv.ParseBool(query.Get("dryRun"))
+	targetID, taskID := query.Get("target"), query.Get("task")
+	cutoff := c.clock.Now().Add(-olderThan)
+
+	closed := c.traffic.CloseSessions(func(s *SessionSummary) bool {
+		return (olderThan == 0 || s.ConnectedAt.Before(cutoff)) &&
+			(targetID == "" || s.TargetID == targetID) &&
+			(taskID == "" || s.TaskID == taskID)
+	}, dryRun)
+	if !dryRun && len(closed) > 0 {
+		log.Printf("🧹 Closed %d sessions in bulk (olderThan %q, target %q, task %q) for %s", len(closed), query.Get("olderThan"), targetID, taskID, actorLabel(r, c.acl))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"dryRun":   dryRun,
+		"sessions": closed,
+	})
+}
+
+type closedTarget struct {
+	TargetID string `json:"targetId"`
+	Type     string `json:"type"`
+	URL      string `json:"url"`
+	Error    string `json:"error,omitempty"`
+}
+
+/*
+Handle POST /admin/targets:closeByUrlPattern
+Request example:
+
+	{"pattern": "https://*.example.com/checkout*", "dryRun": false}
+
+Closes every page whose URL matches the pattern (* and ? wildcards, as in
+-capturePatterns). Returns the pages with an error for each that could not
+be closed.
+*/
+func (c *ChromeDevToolsClient) handleCloseTargetsByURL(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Pattern string `json:"pattern"`
+		DryRun  bool   `json:"dryRun"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Pattern == "" {
+		http.Error(w, "pattern is required", http.StatusBadRequest)
+		return
+	}
+	match := compileURLPattern(req.Pattern)
+	if !req.DryRun && !c.allowCommands(w, r, "Target.closeTarget") {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), c.client.Timeout)
+	defer cancel()
+	infos, err := c.listTargets(ctx)
+	if err != nil {
+		http.Error(w, "Failed to list targets: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	conn, err := c.control.Conn()
+	if err != nil {
+		http.Error(w, "Browser unavailable: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	targets := []closedTarget{}
+	failed := 0
+	for _, info := range infos {
+		if info.Type != "page" || !match.MatchString(info.URL) {
+			continue
+		}
+		target := closedTarget{TargetID: info.TargetID, Type: info.Type, URL: info.URL}
+		if !req.DryRun {
+			if _, err := conn.Call(ctx, "", "Target.closeTarget", map[string]string{"targetId": info.TargetID}); err != nil {
+				target.Error = err.Error()
+				failed++
+			}
+		}
+		targets = append(targets, target)
+	}
+	if !req.DryRun && len(targets) > 0 {
+		log.Printf("🧹 Closed %d pages matching %q in bulk (%d failed) for %s", len(targets)-failed, req.Pattern, failed, actorLabel(r, c.acl))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"dryRun":  req.DryRun,
+		"targets": targets,
+	})
+}
@@ -0,0 +1,57 @@
+package main
+
+import "sort"
+
+// Field -advertiseCapabilities adds to /json/version. Clients that do not
+// know it ignore it, as they do any field Chrome adds.
+const capabilitiesField = "ppio-proxy"
+
+// ProxyCapabilities tells clients which proxy features this instance
+// offers, so they can use them without probing
+type ProxyCapabilities struct {
+	Version string `json:"version"`
+	// Capabilities by name, see capabilities
+	Features           []string `json:"features"`
+	EventSchemaVersion int      `json:"eventSchemaVersion"`
+	// Sec-WebSocket-Protocol values the proxy implements itself
+	Subprotocols []string `json:"subprotocols,omitempty"`
+}
+
+func (c *ChromeDevToolsClient) capabilities() *ProxyCapabilities {
+	// Endpoints every proxy serves
+	features := []string{"labels", "leases", "pdf", "screenshot", "trace", "coverage", "event-schemas"}
+	optional := map[string]bool{
+		"multiplex":      featureEnabled("cdp-multiplexing"),
+		"priority-lanes": featureEnabled("priority-lanes"),
+		"compression":    c.compression != nil,
+		"policy":         cdpAllow != "" || cdpDeny != "",
+		"records":        c.cdpRecorder != nil,
+		"mocks":          c.mocks != nil,
+		"console":        c.console != nil,
+		"signed-urls":    urlSigningKey != "",
+		"events":         c.outbox != nil,
+		"state":          c.state != nil,
+		"upgrade":        chromeBinary == "" && chromeChannels == "",
+		"downloads":      c.downloads != nil,
+		"throttle":       c.throttle != nil,
+	}
+	for name, enabled := range optional {
+		if enabled {
+			features = append(features, name)
+		}
+	}
+	sort.Strings(features)
+
+	var subprotocols []string
+	for _, protocol := range []string{subprotocolMsgpack, subprotocolCBOR, subprotocolDelta} {
+		if proxySubprotocol(protocol) {
+			subprotocols = append(subprotocols, protocol)
+		}
+	}
+	return &ProxyCapabilities{
+		Version:            version,
+		Features:           features,
+		EventSchemaVersion: EventSchemaVersion,
+		Subprotocols:       subprotocols,
+	}
+}
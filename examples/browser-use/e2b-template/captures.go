@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Compile a Fetch-style URL pattern ('*' and '?' wildcards, '\' escapes)
+func compileURLPattern(pattern string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch ch := pattern[i]; ch {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				b.WriteString(regexp.QuoteMeta(string(pattern[i])))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+// ResponseCapture stores bodies of responses matching the configured URL
+// patterns in the artifact store
+type ResponseCapture struct {
+	patterns []string
+	matchers []*regexp.Regexp
+	store    *ArtifactStore
+
+	captured int64
+	failed   int64
+}
+
+func NewResponseCapture(patterns []string, store *ArtifactStore) *ResponseCapture {
+	rc := &ResponseCapture{patterns: patterns, store: store}
+	for _, p := range patterns {
+		rc.matchers = append(rc.matchers, compileURLPattern(p))
+	}
+	return rc
+}
+
+func (rc *ResponseCapture) ResponsePatterns() []string {
+	return rc.patterns
+}
+
+func (rc *ResponseCapture) matches(rawURL string) bool {
+	for _, re := range rc.matchers {
+		if re.MatchString(rawURL) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rc *ResponseCapture) HandleRequestPaused(ctx context.Context, s *PageSession, ev *FetchRequestPaused) bool {
+	// Redirects and failed responses have no body to capture
+	if !ev.IsResponseStage() || ev.ResponseErrorReason != "" || (ev.ResponseStatusCode >= 300 && ev.ResponseStatusCode < 400) {
+		return false
+	}
+	if !rc.matches(ev.Request.URL) {
+		return false
+	}
+
+	var body struct {
+		Body          string `json:"body"`
+		Base64Encoded bool   `json:"base64Encoded"`
+	}
+	if err := s.Conn.CallResult(ctx, s.SessionID, "Fetch.getResponseBody", map[string]interface{}{"requestId": ev.RequestID}, &body); err != nil {
+		atomic.AddInt64(&rc.failed, 1)
+		log.Printf("⚠️ Failed to capture %s: %v", ev.Request.URL, err)
+		return false
+	}
+	data := []byte(body.Body)
+	if body.Base64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(body.Body)
+		if err != nil {
+			atomic.AddInt64(&rc.failed, 1)
+			return false
+		}
+		data = decoded
+	}
+
+	var contentType string
+	for _, h := range ev.ResponseHeaders {
+		if strings.EqualFold(h.Name, "Content-Type") {
+			contentType = h.Value
+		}
+	}
+	meta := map[string]string{
+		"url":      ev.Request.URL,
+		"method":   ev.Request.Method,
+		"status":   strconv.Itoa(ev.ResponseStatusCode),
+		"targetId": s.Target.TargetID,
+	}
+	// Keep the target's labels so captures can be purged by identity later
+	for k, v := range s.labels.Get(s.Target.TargetID) {
+		meta["label."+k] = v
+	}
+	_, err := rc.store.Put("capture", ev.Request.URL, data, contentType, meta)
+	if err != nil {
+		atomic.AddInt64(&rc.failed, 1)
+		log.Printf("⚠️ Failed to store capture of %s: %v", ev.Request.URL, err)
+		return false
+	}
+	atomic.AddInt64(&rc.captured, 1)
+
+	// The body was only read; the interceptor still continues the response
+	return false
+}
+
+func (rc *ResponseCapture) Metrics() map[string]interface{} {
+	return map[string]interface{}{
+		"captures_total":        atomic.LoadInt64(&rc.captured),
+		"captures_failed_total": atomic.LoadInt64(&rc.failed),
+	}
+}
+
+/*
+Handle GET /captures, listing captured responses
+Query parameters: url (substring match), targetId, limit (newest first)
+*/
+func (c *ChromeDevToolsClient) handleListCaptures(w http.ResponseWriter, r *http.Request) {
+	if c.artifacts == nil {
+		http.Error(w, "Artifact store is disabled (set -artifactDir)", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	urlFilter, targetFilter := query.Get("url"), query.Get("targetId")
+
+	captures := c.artifacts.List(func(a *Artifact) bool {
+		return a.Kind == "capture" &&
+			strings.Contains(a.Meta["url"], urlFilter) &&
+			(targetFilter == "" || a.Meta["targetId"] == targetFilter)
+	})
+	if limit, err := strconv.Atoi(query.Get("limit")); err == nil && limit > 0 && len(captures) > limit {
+		captures = captures[len(captures)-limit:]
+	}
+
+	entries := make([]map[string]interface{}, 0, len(captures))
+	for i := len(captures) - 1; i >= 0; i-- {
+		a := captures[i]
+		entries = append(entries, map[string]interface{}{
+			"id":          a.ID,
+			"url":         a.Meta["url"],
+			"method":      a.Meta["method"],
+			"status":      a.Meta["status"],
+			"targetId":    a.Meta["targetId"],
+			"contentType": a.ContentType,
+			"size":        a.Size,
+			"capturedAt":  a.CreatedAt,
+			"bodyUrl":     "/captures/" + a.ID,
+		})
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// Handle GET /captures/{id}, returning the raw captured body
+func (c *ChromeDevToolsClient) handleGetCapture(w http.ResponseWriter, r *http.Request) {
+	if c.artifacts == nil {
+		http.Error(w, "Artifact store is disabled (set -artifactDir)", http.StatusNotFound)
+		return
+	}
+	body, a, err := c.artifacts.Open(r.PathValue("id"))
+	if err != nil || a.Kind != "capture" {
+		if err == nil {
+			body.Close()
+		}
+		if err == nil || os.IsNotExist(err) {
+			http.Error(w, "Capture not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	defer body.Close()
+
+	if a.ContentType != "" {
+		w.Header().Set("Content-Type", a.ContentType)
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(a.Size, 10))
+	io.Copy(w, body)
+}
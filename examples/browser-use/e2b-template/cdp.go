@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CDPMessage is the wire format shared by commands, responses and events
+type CDPMessage struct {
+	ID        int64           `json:"id,omitempty"`
+	SessionID string          `json:"sessionId,omitempty"`
+	Method    string          `json:"method,omitempty"`
+	Params    json.RawMessage `json:"params,omitempty"`
+	Result    json.RawMessage `json:"result,omitempty"`
+	Error     *CDPError       `json:"error,omitempty"`
+}
+
+// CDPError is the error object returned by Chrome for a failed command
+type CDPError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    string `json:"data,omitempty"`
+}
+
+func (e *CDPError) Error() string {
+	if e.Data != "" {
+		return fmt.Sprintf("CDP error %d: %s (%s)", e.Code, e.Message, e.Data)
+	}
+	return fmt.Sprintf("CDP error %d: %s", e.Code, e.Message)
+}
+
+// CDPConn is a CDP client over a single WebSocket. Commands may be issued
+// concurrently; responses are matched by id and events are delivered to
+// subscribers on the reader goroutine.
+type CDPConn struct {
+	ws     *WebSocketConn
+	nextID int64
+
+	mu      sync.Mutex
+	pending map[int64]chan *CDPMessage
+	subs    map[int64]func(*CDPMessage)
+	nextSub int64
+
+	done chan struct{}
+	err  error
+}
+
+func DialCDP(wsURL string, timeout time.Duration) (*CDPConn, error) {
+	ws, err := DialWebSocket(wsURL, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &CDPConn{
+		ws:      ws,
+		pending: make(map[int64]chan *CDPMessage),
+		subs:    make(map[int64]func(*CDPMessage)),
+		done:    make(chan struct{}),
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+func (c *CDPConn) readLoop() {
+	var err error
+	defer func() {
+		c.mu.Lock()
+		c.err = err
+		for id, ch := range c.pending {
+			close(ch)
+			delete(c.pending, id)
+		}
+		close(c.done)
+		c.mu.Unlock()
+	}()
+
+	for {
+		var data []byte
+		_, data, err = c.ws.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var msg CDPMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			continue
+		}
+
+		if msg.ID != 0 {
+			c.mu.Lock()
+			ch, ok := c.pending[msg.ID]
+			delete(c.pending, msg.ID)
+			c.mu.Unlock()
+			if ok {
+				ch <- &msg
+			}
+			continue
+		}
+
+		c.mu.Lock()
+		handlers := make([]func(*CDPMessage), 0, len(c.subs))
+		for _, fn := range c.subs {
+			handlers = append(handlers, fn)
+		}
+		c.mu.Unlock()
+		for _, fn := range handlers {
+			fn(&msg)
+		}
+	}
+}
+
+// Call sends a command and waits for its response. An empty sessionID
+// addresses the target the connection was opened against.
+func (c *CDPConn) Call(ctx context.Context, sessionID, method string, params interface{}) (json.RawMessage, error) {
+	msg := CDPMessage{
+		ID:        atomic.AddInt64(&c.nextID, 1),
+		SessionID: sessionID,
+		Method:    method,
+	}
+	if params != nil {
+		raw, err := json.Marshal(params)
+		if err != nil {
+			return nil, err
+		}
+		msg.Params = raw
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan *CDPMessage, 1)
+	c.mu.Lock()
+	if c.isClosed() {
+		c.mu.Unlock()
+		return nil, c.closedError()
+	}
+	c.pending[msg.ID] = ch
+	c.mu.Unlock()
+
+	if err := c.ws.WriteMessage(wsOpText, data); err != nil {
+		c.mu.Lock()
+		delete(c.pending, msg.ID)
+		c.mu.Unlock()
+		return nil, err
+	}
+
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return nil, c.closedError()
+		}
+		if resp.Error != nil {
+			return nil, resp.Error
+		}
+		return resp.Result, nil
+	case <-ctx.Done():
+		c.mu.Lock()
+		delete(c.pending, msg.ID)
+		c.mu.Unlock()
+		return nil, fmt.Errorf("%s: %w", method, ctx.Err())
+	}
+}
+
+// Subscribe registers an event handler. Handlers run on the reader goroutine
+// and must not block or issue Calls synchronously.
+func (c *CDPConn) Subscribe(fn func(*CDPMessage)) (unsubscribe func()) {
+	c.mu.Lock()
+	c.nextSub++
+	id := c.nextSub
+	c.subs[id] = fn
+	c.mu.Unlock()
+
+	return func() {
+		c.mu.Lock()
+		delete(c.subs, id)
+		c.mu.Unlock()
+	}
+}
+
+// Done is closed once the underlying WebSocket has stopped reading
+func (c *CDPConn) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *CDPConn) Close() error {
+	return c.ws.Close()
+}
+
+// Must be called with c.mu held
+func (c *CDPConn) isClosed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *CDPConn) closedError() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return fmt.Errorf("CDP connection closed: %w", c.err)
+	}
+	return fmt.Errorf("CDP connection closed")
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Name of the browser on -targetPort (or launched from -chromeBinary) when
+// leases pick a channel
+const defaultChannel = "default"
+
+// Lease modes; headless is the default
+const (
+	modeHeadless = "headless"
+	modeHeadful  = "headful"
+)
+
+var (
+	channelNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+	errUnknownMode     = errors.New("mode must be headless or headful")
+)
+
+// ChromeChannel is a supervised Chrome instance besides the default
+// browser: an additional install such as beta next to stable, or a headful
+// instance of an install, that leases can be pinned to
+type ChromeChannel struct {
+	Name    string
+	Binary  string
+	Headful bool
+
+	upstream   *Upstream
+	supervisor *Supervisor
+	control    *ControlSession
+}
+
+// ChannelSet holds the running channel instances by name. Headful
+// instances are named <channel>:headful and launched on first use.
+type ChannelSet struct {
+	mu     sync.RWMutex
+	byName map[string]*ChromeChannel
+	// Serializes on-demand launches
+	launchMu sync.Mutex
+}
+
+func NewChannelSet() *ChannelSet {
+	return &ChannelSet{byName: make(map[string]*ChromeChannel)}
+}
+
+func (s *ChannelSet) Get(name string) *ChromeChannel {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.byName[name]
+}
+
+func (s *ChannelSet) add(ch *ChromeChannel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byName[ch.Name] = ch
+}
+
+// List returns the instances sorted by name
+func (s *ChannelSet) List() []*ChromeChannel {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]*ChromeChannel, 0, len(s.byName))
+	for _, ch := range s.byName {
+		list = append(list, ch)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Name of the instance serving a channel in a mode; empty is the default
+// headless browser
+func channelInstance(channel, mode string) string {
+	if channel == defaultChannel {
+		channel = ""
+	}
+	if mode != modeHeadful {
+		return channel
+	}
+	if channel == "" {
+		channel = defaultChannel
+	}
+	return channel + ":" + modeHeadful
+}
+
+// Parse -chromeChannels: name=binary pairs, comma-separated
+func parseChromeChannels(value string) (map[string]string, error) {
+	channels := make(map[string]string)
+	for _, item := range splitList(value) {
+		name, binary, ok := strings.Cut(item, "=")
+		name, binary = strings.TrimSpace(name), strings.TrimSpace(binary)
+		if !ok || binary == "" {
+			return nil, fmt.Errorf("%q is not name=binary", item)
+		}
+		if !channelNamePattern.MatchString(name) || name == defaultChannel {
+			return nil, fmt.Errorf("invalid channel name %q", name)
+		}
+		if _, dup := channels[name]; dup {
+			return nil, fmt.Errorf("channel %q listed twice", name)
+		}
+		channels[name] = binary
+	}
+	return channels, nil
+}
+
+// Launch a channel instance under its own supervisor, on a free port with
+// its own profile directory
+func (c *ChromeDevToolsClient) launchChannel(name, binary string, headful bool) (*ChromeChannel, error) {
+	port, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+	upstream := NewUpstream("")
+	ch := &ChromeChannel{
+		Name:       name,
+		Binary:     binary,
+		Headful:    headful,
+		upstream:   upstream,
+		supervisor: NewSupervisor(c.clock, binary, chromeDataDir+"-"+strings.ReplaceAll(name, ":", "."), false, upstream),
+		control:    NewControlSession(upstream, c.client),
+	}
+	ch.supervisor.Headful = headful
+	// Leases of this instance lived in the old browser
+	ch.supervisor.OnFailover(func() { c.reservations.Reset(name) })
+	if err := ch.supervisor.Start(port); err != nil {
+		return nil, err
+	}
+	c.channels.add(ch)
+	c.reservations.AddChannel(name, ch.control)
+	log.Printf("🧭 Chrome channel %s: %s on %s", name, binary, upstream.HostPort())
+	return ch, nil
+}
+
+// Launch every channel of -chromeChannels
+func (c *ChromeDevToolsClient) startChannels() {
+	if chromeChannels == "" {
+		return
+	}
+	binaries, err := parseChromeChannels(chromeChannels)
+	if err != nil {
+		log.Fatalf("❌ Invalid -chromeChannels: %v", err)
+	}
+	for name, binary := range binaries {
+		if _, err := c.launchChannel(name, binary, false); err != nil {
+			log.Fatalf("❌ Failed to start Chrome channel %s: %v", name, err)
+		}
+	}
+}
+
+// Make sure the instance a lease for channel and mode is created in runs,
+// launching the channel's headful instance on first use
+func (c *ChromeDevToolsClient) ensureInstance(channel, mode string) error {
+	if mode != "" && mode != modeHeadless && mode != modeHeadful {
+		return errUnknownMode
+	}
+	if !c.reservations.HasChannel(channelInstance(channel, "")) {
+		return fmt.Errorf("%w %q", errUnknownChannel, channel)
+	}
+	if mode != modeHeadful {
+		return nil
+	}
+
+	name := channelInstance(channel, mode)
+	c.channels.launchMu.Lock()
+	defer c.channels.launchMu.Unlock()
+	if c.channels.Get(name) != nil {
+		return nil
+	}
+	binary := chromeBinary
+	if ch := c.channels.Get(channelInstance(channel, "")); ch != nil {
+		binary = ch.Binary
+	}
+	if binary == "" {
+		return errors.New("headful mode requires a supervised Chrome (-chromeBinary)")
+	}
+	if runtime.GOOS == "linux" && os.Getenv("DISPLAY") == "" {
+		return errors.New("headful mode requires an X display (DISPLAY is not set)")
+	}
+	if _, err := c.launchChannel(name, binary, true); err != nil {
+		return fmt.Errorf("failed to start headful Chrome: %w", err)
+	}
+	return nil
+}
+
+// Validate the channel and mode of a lease request and start its instance,
+// writing the error response when that fails
+func (c *ChromeDevToolsClient) resolveInstance(w http.ResponseWriter, req reserveRequest) bool {
+	err := c.ensureInstance(req.Channel, req.Mode)
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, errUnknownChannel), errors.Is(err, errUnknownMode):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Printf("❌ Lease instance unavailable: %v", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	}
+	return false
+}
+
+// Upstream a request path is relayed to: the channel instance owning the
+// page target, otherwise the default browser
+func (c *ChromeDevToolsClient) upstreamFor(path string) *Upstream {
+	if id := devtoolsTargetID(path); id != "" {
+		if name := c.reservations.ChannelOf(id); name != "" {
+			if ch := c.channels.Get(name); ch != nil {
+				return ch.upstream
+			}
+		}
+	}
+	return c.upstream
+}
+
+type channelStatus struct {
+	Name    string `json:"name"`
+	Binary  string `json:"binary,omitempty"`
+	Headful bool   `json:"headful,omitempty"`
+	Target  string `json:"target"`
+	Healthy bool   `json:"healthy"`
+	Browser string `json:"browser,omitempty"`
+	Error   string `json:"error,omitempty"`
+	Leases  int    `json:"leases"`
+}
+
+// Probe one browser's /json/version
+func (c *ChromeDevToolsClient) probeChannel(status *channelStatus) *channelStatus {
+	var version struct {
+		Browser string `json:"Browser"`
+	}
+	if err := getJSON(c.client, fmt.Sprintf("http://%s/json/version", status.Target), &version); err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	status.Healthy = true
+	status.Browser = version.Browser
+	return status
+}
+
+// Status of every channel instance, by name
+func (c *ChromeDevToolsClient) channelStatuses() []*channelStatus {
+	leases := c.reservations.LeasesByChannel()
+	var statuses []*channelStatus
+	for _, ch := range c.channels.List() {
+		statuses = append(statuses, c.probeChannel(&channelStatus{
+			Name:    ch.Name,
+			Binary:  ch.Binary,
+			Headful: ch.Headful,
+			Target:  ch.upstream.HostPort(),
+			Leases:  leases[ch.Name],
+		}))
+	}
+	return statuses
+}
+
+// Handle GET /channels, the browser instances leases can be pinned to
+func (c *ChromeDevToolsClient) handleChannels(w http.ResponseWriter, r *http.Request) {
+	leases := c.reservations.LeasesByChannel()
+	browser := c.probeChannel(&channelStatus{
+		Name:   defaultChannel,
+		Binary: chromeBinary,
+		Target: c.upstream.HostPort(),
+		Leases: leases[defaultChannel],
+	})
+	writeJSON(w, http.StatusOK, map[string]interface{}{"channels": append([]*channelStatus{browser}, c.channelStatuses()...)})
+}
+
+func (c *ChromeDevToolsClient) channelMetrics() map[string]interface{} {
+	leases := c.reservations.LeasesByChannel()
+	channels := make(map[string]interface{})
+	for _, ch := range c.channels.List() {
+		metrics := ch.supervisor.Metrics()
+		delete(metrics, "chrome_standby_ready")
+		metrics["leases_active"] = leases[ch.Name]
+		channels[ch.Name] = metrics
+	}
+	return map[string]interface{}{
+		"chrome_channels": channels,
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TargetCheckpoint is the last known state of one page target
+type TargetCheckpoint struct {
+	TargetID string `json:"targetId"`
+	URL      string `json:"url"`
+	Width    int    `json:"width,omitempty"`
+	Height   int    `json:"height,omitempty"`
+
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// Checkpoint is a lightweight snapshot of browser state used to rebuild
+// targets after a Chrome crash
+type Checkpoint struct {
+	TakenAt time.Time          `json:"takenAt"`
+	Targets []TargetCheckpoint `json:"targets"`
+	Cookies json.RawMessage    `json:"-"`
+}
+
+// Checkpointer periodically snapshots page URLs, window sizes and cookies,
+// and replays them into a replacement browser before clients are switched
+// over to it
+type Checkpointer struct {
+	clock    Clock
+	control  *ControlSession
+	labels   *TargetLabels
+	interval time.Duration
+
+	mu       sync.Mutex
+	last     *Checkpoint
+	taken    int64
+	restored int64
+	// Restored targets: old target id -> id in the replacement browser
+	moved map[string]string
+}
+
+func NewCheckpointer(clock Clock, control *ControlSession, labels *TargetLabels, interval time.Duration) *Checkpointer {
+	return &Checkpointer{clock: clock, control: control, labels: labels, interval: interval}
+}
+
+func (k *Checkpointer) Run() {
+	ticker := k.clock.NewTicker(k.interval)
+	defer ticker.Stop()
+	for range ticker.C() {
+		cp, err := k.take()
+		if err != nil {
+			// Keep the previous checkpoint; Chrome may be going down
+			continue
+		}
+		k.mu.Lock()
+		k.last = cp
+		k.taken++
+		k.mu.Unlock()
+	}
+}
+
+func (k *Checkpointer) take() (*Checkpoint, error) {
+	conn, err := k.control.Conn()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), k.control.timeout)
+	defer cancel()
+
+	var targets struct {
+		TargetInfos []TargetInfo `json:"targetInfos"`
+	}
+	if err := conn.CallResult(ctx, "", "Target.getTargets", nil, &targets); err != nil {
+		return nil, err
+	}
+	cp := &Checkpoint{TakenAt: k.clock.Now()}
+	for _, info := range targets.TargetInfos {
+		if info.Type != "page" || strings.HasPrefix(info.URL, "devtools://") {
+			continue
+		}
+		tc := TargetCheckpoint{TargetID: info.TargetID, URL: info.URL, Labels: k.labels.Get(info.TargetID)}
+		var window struct {
+			Bounds struct {
+				Width  int `json:"width"`
+				Height int `json:"height"`
+			} `json:"bounds"`
+		}
+		if err := conn.CallResult(ctx, "", "Browser.getWindowForTarget", map[string]interface{}{"targetId": info.TargetID}, &window); err == nil {
+			tc.Width, tc.Height = window.Bounds.Width, window.Bounds.Height
+		}
+		cp.Targets = append(cp.Targets, tc)
+	}
+
+	var cookies struct {
+		Cookies json.RawMessage `json:"cookies"`
+	}
+	if err := conn.CallResult(ctx, "", "Storage.getCookies", nil, &cookies); err != nil {
+		return nil, err
+	}
+	cp.Cookies = cookies.Cookies
+	return cp, nil
+}
+
+// Restore replays the last checkpoint into the browser at hostPort
+func (k *Checkpointer) Restore(hostPort string) {
+	k.mu.Lock()
+	cp := k.last
+	k.mu.Unlock()
+	if cp == nil {
+		return
+	}
+
+	conn, err := NewControlSession(NewUpstream(hostPort), k.control.client).Dial()
+	if err != nil {
+		log.Printf("⚠️ Checkpoint restore cannot reach Chrome: %v", err)
+		return
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), k.control.timeout)
+	defer cancel()
+
+	if len(cp.Cookies) > 0 {
+		if _, err := conn.Call(ctx, "", "Storage.setCookies", map[string]interface{}{"cookies": cp.Cookies}); err != nil {
+			log.Printf("⚠️ Checkpoint restore failed to set cookies: %v", err)
+		}
+	}
+	restored := 0
+	for _, tc := range cp.Targets {
+		params := map[string]interface{}{"url": tc.URL}
+		if tc.Width > 0 && tc.Height > 0 {
+			params["width"], params["height"] = tc.Width, tc.Height
+		}
+		var created struct {
+			TargetID string `json:"targetId"`
+		}
+		if err := conn.CallResult(ctx, "", "Target.createTarget", params, &created); err != nil {
+			log.Printf("⚠️ Checkpoint restore failed for %s: %v", tc.URL, err)
+			continue
+		}
+		// Labels follow the target to its new id
+		k.labels.Set(created.TargetID, tc.Labels)
+		k.mu.Lock()
+		if k.moved == nil {
+			k.moved = make(map[string]string)
+		}
+		k.moved[tc.TargetID] = created.TargetID
+		k.mu.Unlock()
+		log.Printf("💾 Restored %s as %s (was %s)", tc.URL, k.labels.Describe(created.TargetID), tc.TargetID)
+		restored++
+	}
+
+	k.mu.Lock()
+	k.restored += int64(restored)
+	k.mu.Unlock()
+	log.Printf("💾 Restored %d/%d targets from checkpoint taken %v ago", restored, len(cp.Targets), k.clock.Since(cp.TakenAt).Round(time.Second))
+}
+
+// Moved returns the id a target was restored under after a failover, or
+// targetID when it was not restored
+func (k *Checkpointer) Moved(targetID string) string {
+	if k == nil {
+		return targetID
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	// Follow the target through several failovers
+	for i := 0; i < len(k.moved); i++ {
+		next, ok := k.moved[targetID]
+		if !ok {
+			break
+		}
+		targetID = next
+	}
+	return targetID
+}
+
+func (k *Checkpointer) Metrics() map[string]interface{} {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return map[string]interface{}{
+		"checkpoints_total":           k.taken,
+		"checkpoint_targets_restored": k.restored,
+	}
+}
+
+// Handle GET /admin/checkpoint, showing the latest checkpoint
+func (c *ChromeDevToolsClient) handleGetCheckpoint(w http.ResponseWriter, r *http.Request) {
+	if c.checkpoints == nil {
+		http.Error(w, "Checkpointing is disabled (set -checkpointInterval)", http.StatusNotFound)
+		return
+	}
+	k := c.checkpoints
+	k.mu.Lock()
+	cp := k.last
+	k.mu.Unlock()
+	if cp == nil {
+		http.Error(w, "No checkpoint taken yet", http.StatusNotFound)
+		return
+	}
+
+	var cookies []json.RawMessage
+	json.Unmarshal(cp.Cookies, &cookies)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"takenAt": cp.TakenAt,
+		"targets": cp.Targets,
+		"cookies": len(cookies),
+	})
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const cdpUsage = `Usage:
+  reverse-proxy cdp send   --method Page.navigate --params '{"url":"https://example.com"}'
+  reverse-proxy cdp listen --domain Network
+
+Common flags:
+  --proxy    Proxy base URL (default http://127.0.0.1:9223)
+  --target   Target id, or "browser" for the browser endpoint (default: first page)
+  --timeout  Timeout in seconds (default 30)
+`
+
+// Entry point for the "cdp" subcommand, returns the process exit code
+func runCDPCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, cdpUsage)
+		return 2
+	}
+
+	fs := flag.NewFlagSet("cdp "+args[0], flag.ContinueOnError)
+	proxyURL := fs.String("proxy", "http://127.0.0.1:9223", "Proxy base URL")
+	target := fs.String("target", "", "Target id, or \"browser\" for the browser endpoint")
+	timeoutSec := fs.Int("timeout", 30, "Timeout in seconds")
+	method := fs.String("method", "", "CDP method to send")
+	params := fs.String("params", "", "CDP params as a JSON object")
+	domain := fs.String("domain", "", "CDP domain to listen to")
+	duration := fs.Duration("duration", 0, "Stop listening after this long (0 = until interrupted)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	// Usage errors are reported before anything is dialed
+	var p json.RawMessage
+	switch args[0] {
+	case "send":
+		if *method == "" {
+			fmt.Fprintln(os.Stderr, "❌ --method is required")
+			return 2
+		}
+		if d, m, ok := strings.Cut(*method, "."); !ok || d == "" || m == "" || strings.Contains(m, ".") {
+			fmt.Fprintf(os.Stderr, "❌ --method %q is not of the form Domain.method\n", *method)
+			return 2
+		}
+		if *params != "" {
+			if !json.Valid([]byte(*params)) {
+				fmt.Fprintln(os.Stderr, "❌ --params is not valid JSON")
+				return 2
+			}
+			p = json.RawMessage(*params)
+		}
+	case "listen":
+		if *domain == "" {
+			fmt.Fprintln(os.Stderr, "❌ --domain is required")
+			return 2
+		}
+		if strings.Contains(*domain, ".") {
+			fmt.Fprintf(os.Stderr, "❌ --domain %q is a domain name such as Network, not a method\n", *domain)
+			return 2
+		}
+	default:
+		fmt.Fprint(os.Stderr, cdpUsage)
+		return 2
+	}
+
+	timeout := time.Duration(*timeoutSec) * time.Second
+	wsURL, err := resolveDebuggerURL(*proxyURL, *target, timeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ Failed to resolve target: %v\n", err)
+		return 1
+	}
+
+	conn, err := DialCDP(wsURL, timeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ Failed to connect to %s: %v\n", wsURL, err)
+		return 1
+	}
+	defer conn.Close()
+
+	if args[0] == "send" {
+		return cdpSend(conn, *method, p, timeout)
+	}
+	return cdpListen(conn, *domain, *duration, timeout)
+}
+
+func cdpSend(conn *CDPConn, method string, p json.RawMessage, timeout time.Duration) int {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	result, err := conn.Call(ctx, "", method, p)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %s failed: %v\n", method, err)
+		return 1
+	}
+	fmt.Println(string(result))
+	return 0
+}
+
+// Print domain events as JSON lines. The connection's reader must not wait
+// for stdout, so events beyond the buffer are dropped and counted.
+func cdpListen(conn *CDPConn, domain string, duration, timeout time.Duration) int {
+	prefix := domain + "."
+	events := make(chan *CDPMessage, 256)
+	var dropped int64
+	unsubscribe := conn.Subscribe(func(msg *CDPMessage) {
+		if strings.HasPrefix(msg.Method, prefix) {
+			select {
+			case events <- msg:
+			default:
+				atomic.AddInt64(&dropped, 1)
+			}
+		}
+	})
+	defer unsubscribe()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	_, err := conn.Call(ctx, "", domain+".enable", nil)
+	cancel()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %s.enable failed: %v\n", domain, err)
+		return 1
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	var stop <-chan time.Time
+	if duration > 0 {
+		stop = time.After(duration)
+	}
+
+	// Report drops as they happen and once more on the way out
+	reportDropped := func() {
+		if n := atomic.SwapInt64(&dropped, 0); n > 0 {
+			fmt.Fprintf(os.Stderr, "⚠️ Dropped %d %s events: output is not keeping up\n", n, domain)
+		}
+	}
+	defer reportDropped()
+
+	enc := json.NewEncoder(os.Stdout)
+	for {
+		select {
+		case msg := <-events:
+			reportDropped()
+			enc.Encode(msg)
+		case <-conn.Done():
+			fmt.Fprintln(os.Stderr, "❌ Connection closed")
+			return 1
+		case <-interrupt:
+			return 0
+		case <-stop:
+			return 0
+		}
+	}
+}
+
+// Look up the debugger URL for a target through the proxy and point it back
+// at the proxy address, since the rewritten host may only be valid publicly.
+func resolveDebuggerURL(proxyURL, target string, timeout time.Duration) (string, error) {
+	base := strings.TrimSuffix(proxyURL, "/")
+	client := &http.Client{Timeout: timeout}
+
+	var debuggerURL string
+	if target == browserTargetID {
+		var version map[string]interface{}
+		if err := getJSON(client, base+"/json/version", &version); err != nil {
+			return "", err
+		}
+		debuggerURL, _ = version["webSocketDebuggerUrl"].(string)
+	} else {
+		var targets []map[string]interface{}
+		if err := getJSON(client, base+"/json/list", &targets); err != nil {
+			return "", err
+		}
+		for _, t := range targets {
+			if (target == "" && t["type"] == "page") || (target != "" && t["id"] == target) {
+				debuggerURL, _ = t["webSocketDebuggerUrl"].(string)
+				break
+			}
+		}
+	}
+	if debuggerURL == "" {
+		return "", fmt.Errorf("no debugger URL found for target %q", target)
+	}
+
+	u, err := url.Parse(debuggerURL)
+	if err != nil {
+		return "", err
+	}
+	return httpToWebSocketScheme(base) + u.RequestURI(), nil
+}
+
+func getJSON(client *http.Client, rawURL string, v interface{}) error {
+	resp, err := client.Get(rawURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", rawURL, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
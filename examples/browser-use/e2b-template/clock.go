@@ -0,0 +1,67 @@
+package main
+
+import "time"
+
+// Clock is the time source of the time-dependent parts of the proxy:
+// reservation expiry, the lease queue, caches, keepalive, idle timeouts,
+// rate limits, URL signing, break-glass grants, the supervisor's health
+// checks and restarts, checkpoints, retries and polling loops, and the
+// timestamps of records and artifacts. They take one instead of calling
+// the time package so that tests can drive them with a FakeClock
+// (clock_test.go) rather than sleeping. Network deadlines and context
+// timeouts stay on real time, as do the command-line tools (cli, soak,
+// conformance and the codec benchmark).
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	After(d time.Duration) <-chan time.Time
+	AfterFunc(d time.Duration, f func()) ClockTimer
+	NewTicker(d time.Duration) ClockTicker
+}
+
+type ClockTimer interface {
+	Stop() bool
+}
+
+type ClockTicker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// The real clock
+var systemClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Since(t time.Time) time.Duration        { return time.Since(t) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func (realClock) AfterFunc(d time.Duration, f func()) ClockTimer {
+	return time.AfterFunc(d, f)
+}
+
+func (realClock) NewTicker(d time.Duration) ClockTicker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct{ *time.Ticker }
+
+func (t realTicker) C() <-chan time.Time { return t.Ticker.C }
+
+// Process start. time.Now carries a monotonic clock reading, so durations
+// measured from it are immune to the wall clock jumps sandboxes see when
+// their clock is synced after a pause or snapshot restore. Timestamps kept
+// as integers (for atomics) lose that reading, so they are taken as
+// offsets from here instead of Unix times.
+var processStart = time.Now()
+
+// Nanoseconds since the process started, by clock
+func monotonicNow(clock Clock) int64 {
+	return int64(clock.Since(processStart))
+}
+
+// Time elapsed since a monotonicNow reading
+func monotonicSince(clock Clock, ns int64) time.Duration {
+	return time.Duration(monotonicNow(clock) - ns)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// FakeClock is a Clock for tests that only moves when advanced. Timers and
+// tickers fire from Advance, in time order; AfterFunc functions run on the
+// advancing goroutine, so their effects are visible once Advance returns.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+type fakeWaiter struct {
+	clock  *FakeClock
+	at     time.Time
+	period time.Duration
+	ch     chan time.Time
+	fn     func()
+	done   bool
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (f *FakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *FakeClock) Since(t time.Time) time.Duration {
+	return f.Now().Sub(t)
+}
+
+func (f *FakeClock) After(d time.Duration) <-chan time.Time {
+	return f.add(d, 0, nil).ch
+}
+
+func (f *FakeClock) AfterFunc(d time.Duration, fn func()) ClockTimer {
+	return f.add(d, 0, fn)
+}
+
+func (f *FakeClock) NewTicker(d time.Duration) ClockTicker {
+	if d <= 0 {
+		panic("non-positive interval for FakeClock.NewTicker")
+	}
+	return fakeTicker{f.add(d, d, nil)}
+}
+
+func (f *FakeClock) add(d, period time.Duration, fn func()) *fakeWaiter {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w := &fakeWaiter{clock: f, at: f.now.Add(d), period: period, fn: fn}
+	if fn == nil {
+		// Like time.Ticker, ticks are dropped while the reader lags
+		w.ch = make(chan time.Time, 1)
+	}
+	f.waiters = append(f.waiters, w)
+	return w
+}
+
+// BlockUntil waits until n timers or tickers are pending, for code that
+// sets them up on its own goroutine
+func (f *FakeClock) BlockUntil(n int) {
+	for {
+		f.mu.Lock()
+		pending := 0
+		for _, w := range f.waiters {
+			if !w.done {
+				pending++
+			}
+		}
+		f.mu.Unlock()
+		if pending >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Advance moves the clock forward by d, firing the timers and ticks that
+// fall due on the way
+func (f *FakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	end := f.now.Add(d)
+	for {
+		var next *fakeWaiter
+		for _, w := range f.waiters {
+			if !w.done && !w.at.After(end) && (next == nil || w.at.Before(next.at)) {
+				next = w
+			}
+		}
+		if next == nil {
+			break
+		}
+		f.now = next.at
+		if next.period > 0 {
+			next.at = next.at.Add(next.period)
+		} else {
+			next.done = true
+		}
+		now := f.now
+		f.mu.Unlock()
+		if next.fn != nil {
+			next.fn()
+		} else {
+			select {
+			case next.ch <- now:
+			default:
+			}
+		}
+		f.mu.Lock()
+	}
+	f.now = end
+	pending := f.waiters[:0]
+	for _, w := range f.waiters {
+		if !w.done {
+			pending = append(pending, w)
+		}
+	}
+	f.waiters = pending
+	f.mu.Unlock()
+}
+
+// Stop reports whether the timer was still pending
+func (w *fakeWaiter) Stop() bool {
+	w.clock.mu.Lock()
+	defer w.clock.mu.Unlock()
+	pending := !w.done
+	w.done = true
+	return pending
+}
+
+type fakeTicker struct{ w *fakeWaiter }
+
+func (t fakeTicker) C() <-chan time.Time { return t.w.ch }
+func (t fakeTicker) Stop()               { t.w.Stop() }
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Codec compresses stored artifacts (-artifactCodec) and uploaded
+// recordings (-uploadCodec). Codecs register themselves by name, as zstd
+// does from zstd.go, so one can be added without touching callers.
+type Codec struct {
+	Name string
+	// Appended to the keys of uploaded objects, e.g. ".gz"
+	Extension   string
+	ContentType string
+	// Level range; level -1 selects the codec's default
+	MinLevel, MaxLevel int
+	NewWriter          func(w io.Writer, level int) (io.WriteCloser, error)
+	NewReader          func(r io.Reader) (io.ReadCloser, error)
+}
+
+var codecs = map[string]*Codec{}
+
+func registerCodec(c *Codec) {
+	codecs[c.Name] = c
+}
+
+func init() {
+	registerCodec(&Codec{
+		Name: "none",
+		NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return nopWriteCloser{w}, nil
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(r), nil
+		},
+	})
+	registerCodec(&Codec{
+		Name:        "gzip",
+		Extension:   ".gz",
+		ContentType: "application/gzip",
+		MinLevel:    gzip.HuffmanOnly,
+		MaxLevel:    gzip.BestCompression,
+		NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return gzip.NewWriterLevel(w, level)
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	})
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// Resolve a codec flag; "none" compresses nothing
+func lookupCodec(name string, level int) (*Codec, error) {
+	c, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec %q (available: %s)", name, strings.Join(codecNames(), ", "))
+	}
+	if level != -1 && c.Name != "none" && (level < c.MinLevel || level > c.MaxLevel) {
+		return nil, fmt.Errorf("codec %s takes levels %d to %d, got %d", c.Name, c.MinLevel, c.MaxLevel, level)
+	}
+	return c, nil
+}
+
+func codecNames() []string {
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// The levels each codec takes, for flag help
+func codecLevelRanges() string {
+	var ranges []string
+	for _, name := range codecNames() {
+		if c := codecs[name]; c.Name != "none" {
+			ranges = append(ranges, fmt.Sprintf("%s %d to %d", name, c.MinLevel, c.MaxLevel))
+		}
+	}
+	return strings.Join(ranges, ", ")
+}
+
+// Compress data with the codec at level
+func (c *Codec) encode(data []byte, level int) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := c.NewWriter(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Compress the file at path into a new file at out, returning its size
+func (c *Codec) encodeFile(path, out string, level int) (int64, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	f, err := os.Create(out)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	w, err := c.NewWriter(f, level)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := io.Copy(w, in); err != nil {
+		return 0, err
+	}
+	if err := w.Close(); err != nil {
+		return 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), f.Sync()
+}
+
+const codecsUsage = `Usage:
+  reverse-proxy codecs [--levels -1,1,9] <file>...
+
+Compresses the files (e.g. CDP recordings) with every codec and level and
+reports the ratio and speed of each, to pick -artifactCodec and -uploadCodec.
+`
+
+// Entry point for the "codecs" subcommand, returns the process exit code
+func runCodecsCommand(args []string) int {
+	fs := flag.NewFlagSet("codecs", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, codecsUsage) }
+	levelList := fs.String("levels", "-1,1,9", "Comma-separated levels to try; levels a codec does not take are skipped")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	var levels []int
+	for _, item := range splitList(*levelList) {
+		var level int
+		if _, err := fmt.Sscan(item, &level); err != nil {
+			fmt.Fprintf(os.Stderr, "❌ Invalid level %q\n", item)
+			return 2
+		}
+		levels = append(levels, level)
+	}
+	var input []byte
+	for _, path := range fs.Args() {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+			return 1
+		}
+		input = append(input, data...)
+	}
+
+	fmt.Printf("%-8s %5s %12s %7s %12s %12s\n", "CODEC", "LEVEL", "BYTES", "RATIO", "ENCODE MB/s", "DECODE MB/s")
+	for _, name := range codecNames() {
+		for _, level := range levels {
+			c, err := lookupCodec(name, level)
+			if err != nil {
+				continue
+			}
+			start := time.Now()
+			encoded, err := c.encode(input, level)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "❌ %s level %d: %v\n", name, level, err)
+				return 1
+			}
+			encodeTime := time.Since(start)
+			start = time.Now()
+			r, err := c.NewReader(bytes.NewReader(encoded))
+			if err == nil {
+				_, err = io.Copy(io.Discard, r)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "❌ %s level %d: %v\n", name, level, err)
+				return 1
+			}
+			decodeTime := time.Since(start)
+			fmt.Printf("%-8s %5d %12d %7.2f %12.1f %12.1f\n", name, level, len(encoded),
+				float64(len(input))/float64(len(encoded)), megabytesPerSecond(len(input), encodeTime), megabytesPerSecond(len(input), decodeTime))
+			if name == "none" {
+				break
+			}
+		}
+	}
+	return 0
+}
+
+func megabytesPerSecond(n int, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(n) / (1 << 20) / d.Seconds()
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"os/exec"
+	"testing"
+)
+
+// A CDP recording-like input: JSON frames with repeated structure and
+// varying ids, URLs and timings
+func sampleRecording(size int) []byte {
+	rng := rand.New(rand.NewSource(1))
+	var buf bytes.Buffer
+	for id := 1; buf.Len() < size; id++ {
+		fmt.Fprintf(&buf, `{"t":%d,"dir":"recv","msg":{"method":"Network.requestWillBeSent","params":{"requestId":"%d.%d","loaderId":"%X","documentURL":"https://example.com/page/%d","request":{"url":"https://cdn.example.com/assets/%x.js","method":"GET","headers":{"Accept":"*/*","User-Agent":"Mozilla/5.0"}},"timestamp":%.6f}}}`+"\n",
+			1700000000000+id*17, rng.Intn(1000), id, rng.Int63(), rng.Intn(50), rng.Int31(), rng.Float64()*1e5)
+	}
+	return buf.Bytes()[:size]
+}
+
+func decodeAll(t testing.TB, c *Codec, data []byte) []byte {
+	t.Helper()
+	r, err := c.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("%s: decode: %v", c.Name, err)
+	}
+	return out
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	random := make([]byte, 300<<10)
+	rng.Read(random)
+	inputs := map[string][]byte{
+		"empty":     nil,
+		"one byte":  {'x'},
+		"run":       bytes.Repeat([]byte{'a'}, 200<<10),
+		"random":    random,
+		"recording": sampleRecording(3 << 20),
+		"block":     sampleRecording(zstdBlockMaxSize),
+	}
+	for _, name := range codecNames() {
+		c := codecs[name]
+		for _, level := range []int{-1, c.MinLevel, c.MaxLevel} {
+			for input, data := range inputs {
+				encoded, err := c.encode(data, level)
+				if err != nil {
+					t.Fatalf("%s level %d, %s: %v", name, level, input, err)
+				}
+				if got := decodeAll(t, c, encoded); !bytes.Equal(got, data) {
+					t.Errorf("%s level %d, %s: round trip changed %d bytes into %d", name, level, input, len(data), len(got))
+				}
+			}
+		}
+	}
+}
+
+func TestZstdCompresses(t *testing.T) {
+	data := sampleRecording(1 << 20)
+	encoded, err := codecs["zstd"].encode(data, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ratio := float64(len(data)) / float64(len(encoded)); ratio < 2 {
+		t.Errorf("recording compressed only %.2fx", ratio)
+	}
+}
+
+func TestXXH64(t *testing.T) {
+	tests := []struct {
+		input string
+		want  uint64
+	}{
+		{"", 0xEF46DB3751D8E999},
+		{"a", 0xD24EC4F1A98C6E5B},
+		{"abc", 0x44BC2CF5AD770999},
+		{"Nobody inspects the spammish repetition", 0xFBCEA83C8A378BF1},
+	}
+	for _, tt := range tests {
+		for split := 0; split <= len(tt.input); split++ {
+			x := newXXH64()
+			x.Write([]byte(tt.input[:split]))
+			x.Write([]byte(tt.input[split:]))
+			if got := x.Sum64(); got != tt.want {
+				t.Errorf("XXH64(%q) split at %d = %#x, want %#x", tt.input, split, got, tt.want)
+			}
+		}
+	}
+}
+
+// The reference implementation must read what the codec writes and the
+// codec must read what it writes at every level, Huffman literals and
+// FSE-compressed tables included
+func TestZstdReferenceInterop(t *testing.T) {
+	zstd, err := exec.LookPath("zstd")
+	if err != nil {
+		t.Skip("zstd is not installed")
+	}
+	c := codecs["zstd"]
+	data := sampleRecording(2 << 20)
+
+	encoded, err := c.encode(data, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(zstd, "-d", "-c")
+	cmd.Stdin = bytes.NewReader(encoded)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("zstd -d: %v", err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Fatalf("zstd -d decoded %d bytes, want %d", len(out), len(data))
+	}
+
+	for _, level := range []string{"-1", "-3", "-9", "-19", "--ultra", "--fast=5"} {
+		args := []string{"-c", "-q", level}
+		if level == "--ultra" {
+			args = append(args, "-22")
+		}
+		cmd := exec.Command(zstd, args...)
+		cmd.Stdin = bytes.NewReader(data)
+		reference, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("zstd %s: %v", level, err)
+		}
+		if got := decodeAll(t, c, reference); !bytes.Equal(got, data) {
+			t.Errorf("zstd %s: decoded %d bytes, want %d", level, len(got), len(data))
+		}
+	}
+}
+
+func TestZstdRejectsCorruption(t *testing.T) {
+	c := codecs["zstd"]
+	encoded, err := c.encode(sampleRecording(64<<10), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The content checksum catches what the block structure does not
+	for _, at := range []int{20, len(encoded) / 2, len(encoded) - 1} {
+		corrupt := append([]byte(nil), encoded...)
+		corrupt[at] ^= 0x40
+		r, _ := c.NewReader(bytes.NewReader(corrupt))
+		if _, err := io.ReadAll(r); err == nil {
+			t.Errorf("flipping a bit of byte %d went unnoticed", at)
+		}
+	}
+	r, _ := c.NewReader(bytes.NewReader(encoded[:len(encoded)-10]))
+	if _, err := io.ReadAll(r); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated stream: err = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func benchmarkLevels(c *Codec) []int {
+	if c.Name == "none" {
+		return []int{-1}
+	}
+	return []int{c.MinLevel, -1, c.MaxLevel}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	data := sampleRecording(4 << 20)
+	for _, name := range codecNames() {
+		c := codecs[name]
+		for _, level := range benchmarkLevels(c) {
+			b.Run(fmt.Sprintf("%s/level=%d", name, level), func(b *testing.B) {
+				b.SetBytes(int64(len(data)))
+				var size int
+				for i := 0; i < b.N; i++ {
+					encoded, err := c.encode(data, level)
+					if err != nil {
+						b.Fatal(err)
+					}
+					size = len(encoded)
+				}
+				b.ReportMetric(float64(len(data))/float64(size), "ratio")
+			})
+		}
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	data := sampleRecording(4 << 20)
+	for _, name := range codecNames() {
+		c := codecs[name]
+		for _, level := range benchmarkLevels(c) {
+			encoded, err := c.encode(data, level)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Run(fmt.Sprintf("%s/level=%d", name, level), func(b *testing.B) {
+				b.SetBytes(int64(len(data)))
+				for i := 0; i < b.N; i++ {
+					r, err := c.NewReader(bytes.NewReader(encoded))
+					if err != nil {
+						b.Fatal(err)
+					}
+					if _, err := io.Copy(io.Discard, r); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Appended to a compressed message before inflating: the empty stored
+// block the sender stripped, and a final block so the reader sees EOF
+const deflateTail = "\x00\x00\xff\xff\x01\x00\x00\xff\xff"
+
+// Size of the deflate sliding window, the history kept per direction when
+// contexts are taken over between messages
+const deflateWindow = 32 << 10
+
+// ClientCompression negotiates permessage-deflate (RFC 7692) with
+// downstream clients only (-clientCompression): the connection to Chrome
+// stays uncompressed, messages to the client of at least the threshold
+// are compressed and compressed client messages are inflated. Without
+// context takeover no compression state outlives a message, so
+// compressors are pooled instead of held per connection.
+type ClientCompression struct {
+	threshold int
+	level     int
+	takeover  bool
+	pool      sync.Pool
+
+	connections int64
+	rawBytes    int64
+	sentBytes   int64
+	inflated    int64
+}
+
+func NewClientCompression(threshold, level int, takeover bool) (*ClientCompression, error) {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return nil, fmt.Errorf("compression level %d is not between -2 and 9", level)
+	}
+	return &ClientCompression{threshold: threshold, level: level, takeover: takeover}, nil
+}
+
+// Negotiate picks the first permessage-deflate offer of an upgrade request
+// the proxy can honor. It returns the Sec-WebSocket-Extensions response
+// value and the connection's compression state, or nil when the client
+// offered none.
+func (cc *ClientCompression) Negotiate(r *http.Request) (string, *wsDeflate) {
+	if cc == nil {
+		return "", nil
+	}
+	for _, offer := range strings.Split(strings.Join(r.Header.Values("Sec-WebSocket-Extensions"), ","), ",") {
+		params := strings.Split(offer, ";")
+		if strings.TrimSpace(params[0]) != "permessage-deflate" {
+			continue
+		}
+		clientNoTakeover, ok := false, true
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			switch strings.TrimSpace(name) {
+			case "client_no_context_takeover":
+				clientNoTakeover = true
+			case "server_no_context_takeover", "client_max_window_bits":
+			case "server_max_window_bits":
+				// The compressor always uses a full window
+				ok = strings.Trim(strings.TrimSpace(value), `"`) == "15"
+			default:
+				ok = false
+			}
+		}
+		if !ok {
+			continue
+		}
+		d := &wsDeflate{cc: cc, takeover: cc.takeover, inflateTakeover: cc.takeover && !clientNoTakeover}
+		response := "permessage-deflate"
+		if !cc.takeover {
+			// The client must not rely on our history, nor we on its
+			response += "; server_no_context_takeover; client_no_context_takeover"
+		} else if clientNoTakeover {
+			response += "; client_no_context_takeover"
+		}
+		atomic.AddInt64(&cc.connections, 1)
+		return response, d
+	}
+	return "", nil
+}
+
+func (cc *ClientCompression) Metrics() map[string]interface{} {
+	return map[string]interface{}{
+		"ws_compressed_connections_total":   atomic.LoadInt64(&cc.connections),
+		"ws_compression_input_bytes_total":  atomic.LoadInt64(&cc.rawBytes),
+		"ws_compression_output_bytes_total": atomic.LoadInt64(&cc.sentBytes),
+		"ws_inflated_bytes_total":           atomic.LoadInt64(&cc.inflated),
+	}
+}
+
+// wsDeflate is the permessage-deflate state of one client connection
+type wsDeflate struct {
+	cc       *ClientCompression
+	takeover bool
+	// Compressor kept across messages with context takeover
+	writer *flate.Writer
+	buf    bytes.Buffer
+
+	inflateTakeover bool
+	// Last decompressed bytes, the dictionary of the next message
+	history []byte
+}
+
+// Compress a message, or return nil when it is below the threshold
+func (d *wsDeflate) compress(payload []byte) []byte {
+	if len(payload) < d.cc.threshold {
+		return nil
+	}
+	w := d.writer
+	if w == nil {
+		if pooled, ok := d.cc.pool.Get().(*flate.Writer); ok {
+			w = pooled
+		} else {
+			w, _ = flate.NewWriter(nil, d.cc.level)
+		}
+		w.Reset(&d.buf)
+		if d.takeover {
+			d.writer = w
+		} else {
+			defer d.cc.pool.Put(w)
+		}
+	}
+	d.buf.Reset()
+	w.Write(payload)
+	w.Flush()
+	out := bytes.TrimSuffix(d.buf.Bytes(), []byte(deflateTail[:4]))
+	atomic.AddInt64(&d.cc.rawBytes, int64(len(payload)))
+	atomic.AddInt64(&d.cc.sentBytes, int64(len(out)))
+	return append([]byte(nil), out...)
+}
+
+// Inflate a compressed message, refusing ones that would exceed the
+// message size limit
+func (d *wsDeflate) inflate(payload []byte) ([]byte, error) {
+	var dict []byte
+	if d.inflateTakeover {
+		dict = d.history
+	}
+	r := flate.NewReaderDict(io.MultiReader(bytes.NewReader(payload), strings.NewReader(deflateTail)), dict)
+	defer r.Close()
+	out, err := io.ReadAll(io.LimitReader(r, wsMaxFrameSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > wsMaxFrameSize {
+		return nil, errors.New("inflated websocket message exceeds limit")
+	}
+	if d.inflateTakeover {
+		d.history = append(d.history, out...)
+		if len(d.history) > deflateWindow {
+			d.history = append([]byte(nil), d.history[len(d.history)-deflateWindow:]...)
+		}
+	}
+	atomic.AddInt64(&d.cc.inflated, int64(len(out)))
+	return out, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Prefix of environment variables that set flags, e.g. PPIO_PROXY_MAX_LEASES
+const configEnvPrefix = "PPIO_PROXY_"
+
+// Flags whose values are never shown by /admin/config
+var secretFlags = map[string]bool{
+	"adminToken":        true,
+	"urlSigningKey":     true,
+	"receiptSigningKey": true,
+}
+
+// Where each flag's effective value came from: "flag", "env", "file",
+// "profile" or "default"
+var configSources = map[string]string{}
+
+// Environment variable for a flag name: maxLeases -> PPIO_PROXY_MAX_LEASES
+func configEnvName(flagName string) string {
+	var b strings.Builder
+	b.WriteString(configEnvPrefix)
+	runes := []rune(flagName)
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) && !unicode.IsUpper(runes[i-1]) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// Fill in flags not given on the command line from the environment, then
+// from the -config file (a JSON object of flag names to values), and
+// record the source of every value
+func loadConfig(fs *flag.FlagSet, configFile string) error {
+	fs.VisitAll(func(f *flag.Flag) { configSources[f.Name] = "default" })
+	fs.Visit(func(f *flag.Flag) { configSources[f.Name] = "flag" })
+	// -sandboxID defaults to the sandbox's own environment
+	if configSources["sandboxID"] == "default" && os.Getenv("E2B_SANDBOX_ID") != "" {
+		configSources["sandboxID"] = "env"
+	}
+
+	var file map[string]interface{}
+	if configFile != "" {
+		data, err := os.ReadFile(configFile)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &file); err != nil {
+			return fmt.Errorf("%s: %v", configFile, err)
+		}
+		for name := range file {
+			if fs.Lookup(name) == nil {
+				return fmt.Errorf("%s: unknown flag %q", configFile, name)
+			}
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || configSources[f.Name] != "default" {
+			return
+		}
+		if value, ok := os.LookupEnv(configEnvName(f.Name)); ok {
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("%s: %v", configEnvName(f.Name), setErr)
+			}
+			configSources[f.Name] = "env"
+		} else if value, ok := file[f.Name]; ok {
+			if setErr := fs.Set(f.Name, fmt.Sprint(value)); setErr != nil {
+				err = fmt.Errorf("%s: %s: %v", configFile, f.Name, setErr)
+			}
+			configSources[f.Name] = "file"
+		}
+	})
+	return err
+}
+
+// Handle GET /admin/config: every flag's effective value and its source,
+// with secrets redacted
+func (c *ChromeDevToolsClient) handleAdminConfig(w http.ResponseWriter, r *http.Request) {
+	type entry struct {
+		Name    string `json:"name"`
+		Value   string `json:"value"`
+		Default string `json:"default"`
+		Source  string `json:"source"`
+		Env     string `json:"env"`
+	}
+	var entries []entry
+	flag.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if secretFlags[f.Name] && value != "" {
+			value = "<redacted>"
+		}
+		entries = append(entries, entry{
+			Name:    f.Name,
+			Value:   value,
+			Default: f.DefValue,
+			Source:  configSources[f.Name],
+			Env:     configEnvName(f.Name),
+		})
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"version":  version,
+		"profile":  profile,
+		"features": featureList(),
+		"flags":    entries,
+	})
+}
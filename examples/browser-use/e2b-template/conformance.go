@@ -0,0 +1,546 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const conformanceUsage = `Usage:
+  reverse-proxy conformance [flags]
+
+Runs URL rewriting, WebSocket upgrade, timeout and policy checks against a
+running proxy (or any CDP endpoint) and prints a report.
+
+Flags:
+  --proxy           Base URL of the endpoint under test (default http://127.0.0.1:9223)
+  --format          Report format: json or junit (default json)
+  --out             Write the report to this file (default stdout)
+  --timeout         Timeout of each check in seconds (default 10)
+  --requestTimeout  Expect the server to drop a stalled request within this long (default 35s, 0 skips)
+  --adminToken      Admin token of the proxy; checks that /admin rejects requests without it
+  --blockedURL      A URL the deployment's navigation policy must block
+`
+
+// conformanceResult is the outcome of one check
+type conformanceResult struct {
+	Name     string  `json:"name"`
+	Category string  `json:"category"`
+	Status   string  `json:"status"` // "passed", "failed" or "skipped"
+	Message  string  `json:"message,omitempty"`
+	Duration float64 `json:"durationSeconds"`
+}
+
+type conformanceReport struct {
+	Proxy     string               `json:"proxy"`
+	StartedAt time.Time            `json:"startedAt"`
+	Duration  float64              `json:"durationSeconds"`
+	Passed    int                  `json:"passed"`
+	Failed    int                  `json:"failed"`
+	Skipped   int                  `json:"skipped"`
+	Checks    []*conformanceResult `json:"checks"`
+}
+
+// errSkipped marks a check that does not apply to the deployment
+type errSkipped struct{ reason string }
+
+func (e errSkipped) Error() string { return e.reason }
+
+// conformanceSuite holds what the checks need to reach the endpoint
+type conformanceSuite struct {
+	base           string
+	host           string
+	client         *http.Client
+	timeout        time.Duration
+	requestTimeout time.Duration
+	adminToken     string
+	blockedURL     string
+}
+
+type conformanceCheck struct {
+	category string
+	name     string
+	run      func(s *conformanceSuite) error
+}
+
+// Checks run in this order; each gets a fresh /json listing, since
+// deployments with one-time URLs hand out every URL once
+var conformanceChecks = []conformanceCheck{
+	{"rewriting", "json-version-websocket-url", checkVersionURL},
+	{"rewriting", "json-list-websocket-urls", checkListURLs},
+	{"rewriting", "json-list-frontend-urls", checkFrontendURLs},
+	{"websocket", "upgrade-browser", checkBrowserUpgrade},
+	{"websocket", "upgrade-page", checkPageUpgrade},
+	{"websocket", "upgrade-unknown-target", checkUnknownTargetUpgrade},
+	{"websocket", "unsigned-upgrade-rejected", checkUnsignedUpgrade},
+	{"timeouts", "health-responds", checkHealth},
+	{"timeouts", "command-round-trip", checkCommandRoundTrip},
+	{"timeouts", "stalled-request-dropped", checkStalledRequest},
+	{"policy", "admin-requires-token", checkAdminToken},
+	{"policy", "blocked-navigation", checkBlockedNavigation},
+}
+
+// Entry point for the "conformance" subcommand, returns the process exit
+// code: 0 when every check passed or was skipped
+func runConformanceCommand(args []string) int {
+	fs := flag.NewFlagSet("conformance", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, conformanceUsage) }
+	proxyURL := fs.String("proxy", "http://127.0.0.1:9223", "Base URL of the endpoint under test")
+	format := fs.String("format", "json", "Report format: json or junit")
+	out := fs.String("out", "", "Report file (default stdout)")
+	timeoutSec := fs.Int("timeout", 10, "Timeout of each check in seconds")
+	requestTimeout := fs.Duration("requestTimeout", 35*time.Second, "Expect a stalled request to be dropped within this long (0 skips)")
+	token := fs.String("adminToken", "", "Admin token of the proxy")
+	blockedURL := fs.String("blockedURL", "", "A URL the navigation policy must block")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *format != "json" && *format != "junit" {
+		fmt.Fprintf(os.Stderr, "❌ Unknown --format %q, expected json or junit\n", *format)
+		return 2
+	}
+	base := strings.TrimSuffix(*proxyURL, "/")
+	u, err := url.Parse(base)
+	if err != nil || u.Host == "" {
+		fmt.Fprintf(os.Stderr, "❌ Invalid --proxy %q\n", *proxyURL)
+		return 2
+	}
+
+	timeout := time.Duration(*timeoutSec) * time.Second
+	s := &conformanceSuite{
+		base:           base,
+		host:           u.Host,
+		client:         &http.Client{Timeout: timeout},
+		timeout:        timeout,
+		requestTimeout: *requestTimeout,
+		adminToken:     *token,
+		blockedURL:     *blockedURL,
+	}
+	report := &conformanceReport{Proxy: base, StartedAt: time.Now()}
+	for _, check := range conformanceChecks {
+		start := time.Now()
+		err := check.run(s)
+		result := &conformanceResult{Name: check.name, Category: check.category, Status: "passed", Duration: time.Since(start).Seconds()}
+		var skip errSkipped
+		switch {
+		case errors.As(err, &skip):
+			result.Status, result.Message = "skipped", skip.reason
+			report.Skipped++
+		case err != nil:
+			result.Status, result.Message = "failed", err.Error()
+			report.Failed++
+		default:
+			report.Passed++
+		}
+		fmt.Fprintf(os.Stderr, "%s %s/%s %s\n", map[string]string{"passed": "✅", "failed": "❌", "skipped": "⏭️"}[result.Status], check.category, check.name, result.Message)
+		report.Checks = append(report.Checks, result)
+	}
+	report.Duration = time.Since(report.StartedAt).Seconds()
+
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	if *format == "junit" {
+		err = writeJUnitReport(w, report)
+	} else {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ Failed to write report: %v\n", err)
+		return 1
+	}
+	if report.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// JUnit XML, as read by most CI systems
+func writeJUnitReport(w io.Writer, report *conformanceReport) error {
+	type message struct {
+		Message string `xml:"message,attr"`
+	}
+	type testcase struct {
+		Classname string   `xml:"classname,attr"`
+		Name      string   `xml:"name,attr"`
+		Time      float64  `xml:"time,attr"`
+		Failure   *message `xml:"failure"`
+		Skipped   *message `xml:"skipped"`
+	}
+	type testsuite struct {
+		XMLName   xml.Name   `xml:"testsuite"`
+		Name      string     `xml:"name,attr"`
+		Tests     int        `xml:"tests,attr"`
+		Failures  int        `xml:"failures,attr"`
+		Skipped   int        `xml:"skipped,attr"`
+		Time      float64    `xml:"time,attr"`
+		Timestamp string     `xml:"timestamp,attr"`
+		Cases     []testcase `xml:"testcase"`
+	}
+	suite := testsuite{
+		Name:      "conformance " + report.Proxy,
+		Tests:     len(report.Checks),
+		Failures:  report.Failed,
+		Skipped:   report.Skipped,
+		Time:      report.Duration,
+		Timestamp: report.StartedAt.UTC().Format("2006-01-02T15:04:05"),
+	}
+	for _, r := range report.Checks {
+		tc := testcase{Classname: r.Category, Name: r.Name, Time: r.Duration}
+		switch r.Status {
+		case "failed":
+			tc.Failure = &message{Message: r.Message}
+		case "skipped":
+			tc.Skipped = &message{Message: r.Message}
+		}
+		suite.Cases = append(suite.Cases, tc)
+	}
+	io.WriteString(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(suite); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func (s *conformanceSuite) listTargets() ([]map[string]interface{}, error) {
+	var targets []map[string]interface{}
+	err := getJSON(s.client, s.base+"/json/list", &targets)
+	return targets, err
+}
+
+func (s *conformanceSuite) firstPage() (map[string]interface{}, error) {
+	targets, err := s.listTargets()
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range targets {
+		if t["type"] == "page" {
+			return t, nil
+		}
+	}
+	return nil, errors.New("no page target listed")
+}
+
+// A WebSocket URL handed out by the endpoint must point back at it
+func (s *conformanceSuite) checkPublicURL(field, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("%s %q: %v", field, rawURL, err)
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return fmt.Errorf("%s %q: scheme is not ws or wss", field, rawURL)
+	}
+	if strings.HasPrefix(s.base, "https://") && u.Scheme != "wss" {
+		return fmt.Errorf("%s %q: endpoint is served over HTTPS but the URL is not wss", field, rawURL)
+	}
+	if u.Host != s.host {
+		return fmt.Errorf("%s %q: host is not the endpoint's %s (upstream address leaked?)", field, rawURL, s.host)
+	}
+	return nil
+}
+
+// Connect to the path and query of a handed-out URL through the endpoint
+// under test, since the public host may not be reachable from here
+func (s *conformanceSuite) dial(rawURL string) (*CDPConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return DialCDP(httpToWebSocketScheme(s.base)+u.RequestURI(), s.timeout)
+}
+
+func checkVersionURL(s *conformanceSuite) error {
+	var version map[string]interface{}
+	if err := getJSON(s.client, s.base+"/json/version", &version); err != nil {
+		return err
+	}
+	wsURL, _ := version["webSocketDebuggerUrl"].(string)
+	if wsURL == "" {
+		return errors.New("no webSocketDebuggerUrl in /json/version")
+	}
+	return s.checkPublicURL("webSocketDebuggerUrl", wsURL)
+}
+
+func checkListURLs(s *conformanceSuite) error {
+	targets, err := s.listTargets()
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		return errors.New("/json/list is empty")
+	}
+	for _, t := range targets {
+		wsURL, ok := t["webSocketDebuggerUrl"].(string)
+		if !ok {
+			// Chrome omits it for targets another client is attached to
+			continue
+		}
+		if err := s.checkPublicURL(fmt.Sprintf("target %v webSocketDebuggerUrl", t["id"]), wsURL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkFrontendURLs(s *conformanceSuite) error {
+	targets, err := s.listTargets()
+	if err != nil {
+		return err
+	}
+	checked := 0
+	for _, t := range targets {
+		for _, field := range []string{"devtoolsFrontendUrl", "devtoolsFrontendUrlCompat"} {
+			devURL, ok := t[field].(string)
+			if !ok {
+				continue
+			}
+			for _, m := range frontendWSParam.FindAllStringSubmatch(devURL, -1) {
+				address, err := url.QueryUnescape(m[3])
+				if err != nil {
+					return fmt.Errorf("target %v %s: %v", t["id"], field, err)
+				}
+				if err := s.checkPublicURL(fmt.Sprintf("target %v %s %s=", t["id"], field, m[2]), m[2]+"://"+address); err != nil {
+					return err
+				}
+				checked++
+			}
+		}
+	}
+	if checked == 0 {
+		return errSkipped{"no devtoolsFrontendUrl with a ws= or wss= parameter listed"}
+	}
+	return nil
+}
+
+func checkBrowserUpgrade(s *conformanceSuite) error {
+	var version map[string]interface{}
+	if err := getJSON(s.client, s.base+"/json/version", &version); err != nil {
+		return err
+	}
+	wsURL, _ := version["webSocketDebuggerUrl"].(string)
+	conn, err := s.dial(wsURL)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	_, err = conn.Call(ctx, "", "Browser.getVersion", nil)
+	return err
+}
+
+func checkPageUpgrade(s *conformanceSuite) error {
+	page, err := s.firstPage()
+	if err != nil {
+		return err
+	}
+	wsURL, _ := page["webSocketDebuggerUrl"].(string)
+	conn, err := s.dial(wsURL)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	_, err = conn.Call(ctx, "", "Runtime.evaluate", map[string]interface{}{"expression": "1 + 1", "returnByValue": true})
+	return err
+}
+
+func checkUnknownTargetUpgrade(s *conformanceSuite) error {
+	conn, err := DialWebSocket(httpToWebSocketScheme(s.base)+"/devtools/page/CONFORMANCE0000000000000000000000", s.timeout)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	// Accepting is fine as long as the connection does not stay open
+	conn.conn.SetReadDeadline(time.Now().Add(s.timeout))
+	if _, _, err := conn.ReadMessage(); err == nil {
+		return errors.New("upgrade to an unknown target was accepted and sent data")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return errors.New("upgrade to an unknown target was accepted and kept open")
+	}
+	return nil
+}
+
+func checkUnsignedUpgrade(s *conformanceSuite) error {
+	page, err := s.firstPage()
+	if err != nil {
+		return err
+	}
+	wsURL, _ := page["webSocketDebuggerUrl"].(string)
+	u, err := url.Parse(wsURL)
+	if err != nil {
+		return err
+	}
+	if u.Query().Get("sig") == "" {
+		return errSkipped{"WebSocket URLs are not signed (-urlSigningKey unset)"}
+	}
+	conn, err := DialWebSocket(httpToWebSocketScheme(s.base)+u.Path, s.timeout)
+	if err == nil {
+		conn.Close()
+		return errors.New("upgrade without a signature was accepted")
+	}
+	return nil
+}
+
+func checkHealth(s *conformanceSuite) error {
+	resp, err := s.client.Get(s.base + "/health")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return errSkipped{"no /health endpoint (not a proxy?)"}
+	}
+	return fmt.Errorf("/health: %s", resp.Status)
+}
+
+func checkCommandRoundTrip(s *conformanceSuite) error {
+	var version map[string]interface{}
+	if err := getJSON(s.client, s.base+"/json/version", &version); err != nil {
+		return err
+	}
+	wsURL, _ := version["webSocketDebuggerUrl"].(string)
+	conn, err := s.dial(wsURL)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	const rounds = 20
+	start := time.Now()
+	for i := 0; i < rounds; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+		_, err := conn.Call(ctx, "", "Browser.getVersion", nil)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("round trip %d: %v", i+1, err)
+		}
+	}
+	if avg := time.Since(start) / rounds; avg > time.Second {
+		return fmt.Errorf("average round trip %v exceeds 1s", avg)
+	}
+	return nil
+}
+
+// Send half a request and expect the server to give up on it
+func checkStalledRequest(s *conformanceSuite) error {
+	if s.requestTimeout <= 0 {
+		return errSkipped{"--requestTimeout is 0"}
+	}
+	u, _ := url.Parse(s.base)
+	if u.Scheme == "https" {
+		return errSkipped{"stalled request check needs a plain HTTP endpoint"}
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "80")
+	}
+	conn, err := net.DialTimeout("tcp", host, s.timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /health HTTP/1.1\r\nHost: %s\r\n", u.Host)
+	// The server may answer with an error first; either way it must close
+	conn.SetReadDeadline(time.Now().Add(s.requestTimeout))
+	_, err = io.Copy(io.Discard, conn)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return fmt.Errorf("stalled request still open after %v", s.requestTimeout)
+	}
+	return nil
+}
+
+func checkAdminToken(s *conformanceSuite) error {
+	if s.adminToken == "" {
+		return errSkipped{"--adminToken not given"}
+	}
+	resp, err := s.client.Get(s.base + "/admin/config")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden {
+		return fmt.Errorf("/admin/config without a token: %s, expected 401", resp.Status)
+	}
+	req, _ := http.NewRequest(http.MethodGet, s.base+"/admin/config", nil)
+	req.Header.Set("Authorization", "Bearer "+s.adminToken)
+	resp, err = s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("/admin/config with the token: %s", resp.Status)
+	}
+	return nil
+}
+
+// Navigate a fresh page to a URL the policy must block, expecting Chrome to
+// report a failed navigation
+func checkBlockedNavigation(s *conformanceSuite) error {
+	if s.blockedURL == "" {
+		return errSkipped{"--blockedURL not given"}
+	}
+	var version map[string]interface{}
+	if err := getJSON(s.client, s.base+"/json/version", &version); err != nil {
+		return err
+	}
+	wsURL, _ := version["webSocketDebuggerUrl"].(string)
+	conn, err := s.dial(wsURL)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	var created struct {
+		TargetID string `json:"targetId"`
+	}
+	if err := conn.CallResult(ctx, "", "Target.createTarget", map[string]string{"url": "about:blank"}, &created); err != nil {
+		return err
+	}
+	defer conn.Call(context.Background(), "", "Target.closeTarget", map[string]string{"targetId": created.TargetID})
+	var attached struct {
+		SessionID string `json:"sessionId"`
+	}
+	if err := conn.CallResult(ctx, "", "Target.attachToTarget", map[string]interface{}{"targetId": created.TargetID, "flatten": true}, &attached); err != nil {
+		return err
+	}
+	var nav struct {
+		ErrorText string `json:"errorText"`
+	}
+	if err := conn.CallResult(ctx, attached.SessionID, "Page.navigate", map[string]string{"url": s.blockedURL}, &nav); err != nil {
+		// Policies may also refuse the command outright
+		return nil
+	}
+	if nav.ErrorText == "" {
+		return fmt.Errorf("navigation to %s was not blocked", s.blockedURL)
+	}
+	return nil
+}
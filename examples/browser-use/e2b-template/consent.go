@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Accept buttons of common consent management platforms
+var defaultConsentSelectors = []string{
+	"#onetrust-accept-btn-handler",
+	"#accept-recommended-btn-handler",
+	"#CybotCookiebotDialogBodyLevelButtonLevelOptinAllowAll",
+	"#CybotCookiebotDialogBodyButtonAccept",
+	"#didomi-notice-agree-button",
+	"#truste-consent-button",
+	".fc-cta-consent",
+	".qc-cmp2-summary-buttons button[mode='primary']",
+	"[data-testid='uc-accept-all-button']",
+	".osano-cm-accept-all",
+	".cc-allow",
+	".cc-dismiss",
+	"button#L2AGLb",
+	"button[aria-label='Accept all']",
+}
+
+// Banners are often injected some time after the load event
+var consentRetryDelays = []time.Duration{0, time.Second, 3 * time.Second}
+
+// ConsentDismisser clicks consent banners away after every page load
+type ConsentDismisser struct {
+	clock         Clock
+	selectorsFile string
+
+	mu         sync.Mutex
+	selectors  []string
+	modTime    time.Time
+	dismissals map[string]int64
+	attempts   int64
+}
+
+func NewConsentDismisser(clock Clock, selectorsFile string) *ConsentDismisser {
+	return &ConsentDismisser{
+		clock:         clock,
+		selectorsFile: selectorsFile,
+		selectors:     defaultConsentSelectors,
+		dismissals:    make(map[string]int64),
+	}
+}
+
+func (d *ConsentDismisser) Name() string {
+	return "consent-dismiss"
+}
+
+func (d *ConsentDismisser) Attach(s *PageSession) error {
+	s.Subscribe(func(msg *CDPMessage) {
+		if msg.Method == "Page.loadEventFired" {
+			go d.dismiss(s)
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := s.Call(ctx, "Page.enable", nil)
+	return err
+}
+
+func (d *ConsentDismisser) dismiss(s *PageSession) {
+	quoted, _ := json.Marshal(d.currentSelectors())
+	expression := fmt.Sprintf(`(() => {
+		for (const selector of %s) {
+			let el;
+			try { el = document.querySelector(selector); } catch (e) { continue; }
+			if (el && el.getClientRects().length > 0) {
+				el.click();
+				return selector;
+			}
+		}
+		return "";
+	})()`, quoted)
+
+	for _, delay := range consentRetryDelays {
+		select {
+		case <-d.clock.After(delay):
+		case <-s.Done():
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		var result struct {
+			Result struct {
+				Value string `json:"value"`
+			} `json:"result"`
+		}
+		err := s.Conn.CallResult(ctx, s.SessionID, "Runtime.evaluate", map[string]interface{}{
+			"expression":    expression,
+			"returnByValue": true,
+		}, &result)
+		cancel()
+
+		d.mu.Lock()
+		d.attempts++
+		if err == nil && result.Result.Value != "" {
+			d.dismissals[result.Result.Value]++
+		}
+		d.mu.Unlock()
+
+		if err != nil {
+			return
+		}
+		if result.Result.Value != "" {
+			log.Printf("🍪 Dismissed consent banner on %s (%s)", s.Describe(), result.Result.Value)
+			return
+		}
+	}
+}
+
+// Selector list, re-read from the configured file whenever it changes
+func (d *ConsentDismisser) currentSelectors() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.selectorsFile == "" {
+		return d.selectors
+	}
+	stat, err := os.Stat(d.selectorsFile)
+	if err != nil || stat.ModTime().Equal(d.modTime) {
+		return d.selectors
+	}
+
+	f, err := os.Open(d.selectorsFile)
+	if err != nil {
+		return d.selectors
+	}
+	defer f.Close()
+
+	var selectors []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			selectors = append(selectors, line)
+		}
+	}
+	d.selectors = selectors
+	d.modTime = stat.ModTime()
+	log.Printf("🍪 Loaded %d consent selectors from %s", len(selectors), d.selectorsFile)
+	return d.selectors
+}
+
+func (d *ConsentDismisser) Metrics() map[string]interface{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var total int64
+	bySelector := make(map[string]int64, len(d.dismissals))
+	for selector, n := range d.dismissals {
+		bySelector[selector] = n
+		total += n
+	}
+	return map[string]interface{}{
+		"consent_dismissals_total":       total,
+		"consent_dismissals_by_selector": bySelector,
+		"consent_checks_total":           d.attempts,
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How long a closed page's console stays retrievable
+const consoleRetention = 5 * time.Minute
+
+// ConsoleCapture buffers the console messages (Runtime.consoleAPICalled) and
+// browser log entries (Log.entryAdded) of every page, the last -consoleBuffer
+// entries per page, for GET /targets/{id}/console
+type ConsoleCapture struct {
+	clock Clock
+	limit int
+
+	mu    sync.Mutex
+	pages map[string]*consoleBuffer
+
+	captured int64
+	dropped  int64
+}
+
+type ConsoleEntry struct {
+	// Increases by one per entry of the page; the cursor for ?since=
+	Seq  int64     `json:"seq"`
+	Time time.Time `json:"time"`
+	// console for console API calls, else the Log domain source
+	// (javascript, network, security, violation, ...)
+	Source string `json:"source"`
+	// log, info, warning, error, debug, ... as Chrome reports it
+	Level  string `json:"level"`
+	Text   string `json:"text"`
+	URL    string `json:"url,omitempty"`
+	Line   int    `json:"line,omitempty"`
+	Column int    `json:"column,omitempty"`
+}
+
+type consoleBuffer struct {
+	// Page sessions attached to the target
+	attached int
+	entries  []ConsoleEntry
+	seq      int64
+	dropped  int64
+}
+
+func NewConsoleCapture(clock Clock, limit int) *ConsoleCapture {
+	if limit < 1 {
+		limit = 1
+	}
+	return &ConsoleCapture{clock: clock, limit: limit, pages: make(map[string]*consoleBuffer)}
+}
+
+func (cc *ConsoleCapture) Name() string {
+	return "console-capture"
+}
+
+func (cc *ConsoleCapture) Attach(s *PageSession) error {
+	targetID := s.Target.TargetID
+	cc.mu.Lock()
+	buf, ok := cc.pages[targetID]
+	if !ok {
+		buf = &consoleBuffer{}
+		cc.pages[targetID] = buf
+	}
+	buf.attached++
+	cc.mu.Unlock()
+
+	s.Subscribe(func(msg *CDPMessage) {
+		var entry ConsoleEntry
+		var ok bool
+		switch msg.Method {
+		case "Runtime.consoleAPICalled":
+			entry, ok = consoleAPIEntry(msg.Params)
+		case "Log.entryAdded":
+			entry, ok = logEntry(msg.Params)
+		}
+		if ok {
+			cc.add(targetID, entry)
+		}
+	})
+	go func() {
+		<-s.Done()
+		cc.mu.Lock()
+		buf.attached--
+		cc.mu.Unlock()
+		cc.clock.AfterFunc(consoleRetention, func() {
+			cc.mu.Lock()
+			if buf.attached == 0 && cc.pages[targetID] == buf {
+				delete(cc.pages, targetID)
+			}
+			cc.mu.Unlock()
+		})
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := s.Call(ctx, "Runtime.enable", nil); err != nil {
+		return err
+	}
+	_, err := s.Call(ctx, "Log.enable", nil)
+	return err
+}
+
+func (cc *ConsoleCapture) add(targetID string, entry ConsoleEntry) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	buf, ok := cc.pages[targetID]
+	if !ok {
+		return
+	}
+	buf.seq++
+	entry.Seq = buf.seq
+	if entry.Time.IsZero() {
+		entry.Time = cc.clock.Now()
+	}
+	if len(buf.entries) >= cc.limit {
+		n := len(buf.entries) - cc.limit + 1
+		buf.entries = append(buf.entries[:0], buf.entries[n:]...)
+		buf.dropped += int64(n)
+		atomic.AddInt64(&cc.dropped, int64(n))
+	}
+	buf.entries = append(buf.entries, entry)
+	atomic.AddInt64(&cc.captured, 1)
+}
+
+// Entries of a page after seq or, when seq is 0, not before since; at most
+// limit of them, oldest first. ok is false for pages never attached.
+func (cc *ConsoleCapture) Entries(targetID string, seq int64, since time.Time, limit int) (entries []ConsoleEntry, dropped int64, ok bool) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	buf, ok := cc.pages[targetID]
+	if !ok {
+		return nil, 0, false
+	}
+	entries = []ConsoleEntry{}
+	for _, entry := range buf.entries {
+		if entry.Seq <= seq || entry.Time.Before(since) {
+			continue
+		}
+		if len(entries) == limit {
+			break
+		}
+		entries = append(entries, entry)
+	}
+	return entries, buf.dropped, true
+}
+
+// CDP Runtime.RemoteObject, as much as is needed to print it
+type consoleArg struct {
+	Type        string          `json:"type"`
+	Value       json.RawMessage `json:"value"`
+	Description string          `json:"description"`
+}
+
+type consoleCallFrame struct {
+	URL          string `json:"url"`
+	LineNumber   int    `json:"lineNumber"`
+	ColumnNumber int    `json:"columnNumber"`
+}
+
+func consoleAPIEntry(params json.RawMessage) (ConsoleEntry, bool) {
+	var ev struct {
+		Type       string       `json:"type"`
+		Args       []consoleArg `json:"args"`
+		Timestamp  float64      `json:"timestamp"`
+		StackTrace *struct {
+			CallFrames []consoleCallFrame `json:"callFrames"`
+		} `json:"stackTrace"`
+	}
+	if json.Unmarshal(params, &ev) != nil {
+		return ConsoleEntry{}, false
+	}
+	texts := make([]string, 0, len(ev.Args))
+	for _, arg := range ev.Args {
+		texts = append(texts, arg.text())
+	}
+	entry := ConsoleEntry{
+		Time:   cdpTimestamp(ev.Timestamp),
+		Source: "console",
+		Level:  ev.Type,
+		Text:   strings.Join(texts, " "),
+	}
+	if ev.StackTrace != nil && len(ev.StackTrace.CallFrames) > 0 {
+		frame := ev.StackTrace.CallFrames[0]
+		// CDP positions are zero-based
+		entry.URL, entry.Line, entry.Column = frame.URL, frame.LineNumber+1, frame.ColumnNumber+1
+	}
+	return entry, true
+}
+
+// Text of an argument as the DevTools console prints it
+func (a consoleArg) text() string {
+	if len(a.Value) > 0 {
+		var s string
+		if a.Type == "string" && json.Unmarshal(a.Value, &s) == nil {
+			return s
+		}
+		return string(a.Value)
+	}
+	if a.Description != "" {
+		return a.Description
+	}
+	return a.Type
+}
+
+func logEntry(params json.RawMessage) (ConsoleEntry, bool) {
+	var ev struct {
+		Entry struct {
+			Source     string  `json:"source"`
+			Level      string  `json:"level"`
+			Text       string  `json:"text"`
+			Timestamp  float64 `json:"timestamp"`
+			URL        string  `json:"url"`
+			LineNumber *int    `json:"lineNumber"`
+		} `json:"entry"`
+	}
+	if json.Unmarshal(params, &ev) != nil {
+		return ConsoleEntry{}, false
+	}
+	entry := ConsoleEntry{
+		Time:   cdpTimestamp(ev.Entry.Timestamp),
+		Source: ev.Entry.Source,
+		Level:  ev.Entry.Level,
+		Text:   ev.Entry.Text,
+		URL:    ev.Entry.URL,
+	}
+	if ev.Entry.LineNumber != nil {
+		entry.Line = *ev.Entry.LineNumber + 1
+	}
+	return entry, true
+}
+
+// Runtime and Log timestamps are milliseconds since the epoch
+func cdpTimestamp(ms float64) time.Time {
+	if ms <= 0 {
+		return time.Time{}
+	}
+	return time.UnixMicro(int64(ms * 1000)).UTC()
+}
+
+/*
+Handle GET /targets/{id}/console
+Query parameters:
+  - since: a seq from an earlier response, returning only later entries, or
+    an RFC 3339 time
+  - limit: at most this many entries (default 100)
+
+Returns {"entries": [...], "next": <seq to pass as since>, "dropped": N},
+oldest first; dropped counts the entries that fell out of the page's
+-consoleBuffer. A closed page's console stays available for five minutes.
+*/
+func (c *ChromeDevToolsClient) handleGetConsole(w http.ResponseWriter, r *http.Request) {
+	if c.console == nil {
+		http.Error(w, "Console capture is disabled (set -consoleCapture)", http.StatusNotFound)
+		return
+	}
+	targetID := r.PathValue("id")
+	if targetID == browserTargetID {
+		http.Error(w, "console needs a page target", http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	var seq int64
+	var since time.Time
+	if value := query.Get("since"); value != "" {
+		var err error
+		if seq, err = strconv.ParseInt(value, 10, 64); err != nil {
+			if since, err = time.Parse(time.RFC3339Nano, value); err != nil {
+				http.Error(w, "since must be a seq or an RFC 3339 time", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	limit := 100
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	entries, dropped, ok := c.console.Entries(targetID, seq, since, limit)
+	if !ok {
+		http.Error(w, "No console of target "+targetID, http.StatusNotFound)
+		return
+	}
+	next := seq
+	if len(entries) > 0 {
+		next = entries[len(entries)-1].Seq
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"entries": entries,
+		"next":    next,
+		"dropped": dropped,
+	})
+}
+
+func (cc *ConsoleCapture) Metrics() map[string]interface{} {
+	cc.mu.Lock()
+	pages := len(cc.pages)
+	cc.mu.Unlock()
+	return map[string]interface{}{
+		"console_pages":                 pages,
+		"console_entries_total":         atomic.LoadInt64(&cc.captured),
+		"console_entries_dropped_total": atomic.LoadInt64(&cc.dropped),
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Pseudo target id addressing the browser endpoint itself
+const browserTargetID = "browser"
+
+// ControlSession is the proxy's own CDP connection to Chrome's browser
+// endpoint. Server-side features attach to page targets through it with
+// flattened sessions, independently of any client connection.
+type ControlSession struct {
+	upstream *Upstream
+	client   *http.Client
+	timeout  time.Duration
+
+	mu   sync.Mutex
+	conn *CDPConn
+}
+
+func NewControlSession(upstream *Upstream, client *http.Client) *ControlSession {
+	return &ControlSession{
+		upstream: upstream,
+		client:   client,
+		timeout:  client.Timeout,
+	}
+}
+
+// Conn returns the live browser connection, dialing it on first use and
+// after Chrome has dropped it
+func (s *ControlSession) Conn() (*CDPConn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn != nil {
+		select {
+		case <-s.conn.Done():
+			log.Printf("⚠️ Control session lost, reconnecting")
+			s.conn = nil
+		default:
+			return s.conn, nil
+		}
+	}
+
+	conn, err := s.Dial()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("🎛️ Control session connected")
+	s.conn = conn
+	return conn, nil
+}
+
+// Dial opens an additional, independent connection to the browser endpoint.
+// Chrome reports attach/detach events only to the connection that attached,
+// so features that track their own sessions use a dedicated connection.
+func (s *ControlSession) Dial() (*CDPConn, error) {
+	var version map[string]interface{}
+	if err := getJSON(s.client, fmt.Sprintf("http://%s/json/version", s.upstream.HostPort()), &version); err != nil {
+		return nil, err
+	}
+	wsURL, _ := version["webSocketDebuggerUrl"].(string)
+	if wsURL == "" {
+		return nil, fmt.Errorf("no webSocketDebuggerUrl in /json/version")
+	}
+	return DialCDP(wsURL, s.timeout)
+}
+
+// ResolveTarget returns targetID unchanged, or the first page target when empty
+func (s *ControlSession) ResolveTarget(ctx context.Context, targetID string) (string, error) {
+	if targetID != "" {
+		return targetID, nil
+	}
+
+	conn, err := s.Conn()
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		TargetInfos []struct {
+			TargetID string `json:"targetId"`
+			Type     string `json:"type"`
+		} `json:"targetInfos"`
+	}
+	if err := conn.CallResult(ctx, "", "Target.getTargets", nil, &result); err != nil {
+		return "", err
+	}
+	for _, info := range result.TargetInfos {
+		if info.Type == "page" {
+			return info.TargetID, nil
+		}
+	}
+	return "", fmt.Errorf("no page target available")
+}
+
+// WithSession attaches a flattened session to the target for the duration
+// of fn and detaches afterwards. The "browser" target runs fn directly on the
+// browser connection with an empty session id.
+func (s *ControlSession) WithSession(ctx context.Context, targetID string, fn func(conn *CDPConn, sessionID string) error) error {
+	conn, err := s.Conn()
+	if err != nil {
+		return err
+	}
+	if targetID == browserTargetID {
+		return fn(conn, "")
+	}
+	targetID, err = s.ResolveTarget(ctx, targetID)
+	if err != nil {
+		return err
+	}
+
+	var attached struct {
+		SessionID string `json:"sessionId"`
+	}
+	err = conn.CallResult(ctx, "", "Target.attachToTarget", map[string]interface{}{
+		"targetId": targetID,
+		"flatten":  true,
+	}, &attached)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		detachCtx, cancel := context.WithTimeout(context.Background(), s.timeout)
+		defer cancel()
+		conn.Call(detachCtx, "", "Target.detachFromTarget", map[string]interface{}{"sessionId": attached.SessionID})
+	}()
+
+	return fn(conn, attached.SessionID)
+}
+
+// CallResult is Call followed by decoding the result into out (if non-nil)
+func (c *CDPConn) CallResult(ctx context.Context, sessionID, method string, params, out interface{}) error {
+	result, err := c.Call(ctx, sessionID, method, params)
+	if err != nil {
+		return err
+	}
+	if out == nil || len(result) == 0 {
+		return nil
+	}
+	return json.Unmarshal(result, out)
+}
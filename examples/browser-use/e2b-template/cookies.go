@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// pageCookie is the part of a Network.Cookie needed to delete it
+type pageCookie struct {
+	Name   string `json:"name"`
+	Domain string `json:"domain"`
+	Path   string `json:"path"`
+}
+
+/*
+Handle GET /targets/{id}/cookies
+Query parameters: url, repeatable, for the cookies sent to those URLs
+instead of to the page's own URL and frames.
+
+Returns {"cookies": [...]} as Network.getCookies gives them; the body can
+be POSTed back as is, or saved as a -cookieJarDir jar, to restore the
+session in a later sandbox run.
+*/
+func (c *ChromeDevToolsClient) handleGetCookies(w http.ResponseWriter, r *http.Request) {
+	targetID := r.PathValue("id")
+	if targetID == browserTargetID {
+		http.Error(w, "cookies needs a page target", http.StatusBadRequest)
+		return
+	}
+	var params map[string]interface{}
+	if urls := r.URL.Query()["url"]; len(urls) > 0 {
+		params = map[string]interface{}{"urls": urls}
+	}
+	if !c.allowCommands(w, r, "Network.getCookies") {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), c.client.Timeout)
+	defer cancel()
+	var result struct {
+		Cookies json.RawMessage `json:"cookies"`
+	}
+	err := c.control.WithSession(ctx, targetID, func(conn *CDPConn, sessionID string) error {
+		return conn.CallResult(ctx, sessionID, "Network.getCookies", params, &result)
+	})
+	if err != nil {
+		c.errorCount++
+		log.Printf("❌ Failed to get cookies of %s: %v", targetID, err)
+		http.Error(w, fmt.Sprintf("Failed to get cookies: %v", err), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{"cookies": result.Cookies})
+}
+
+/*
+Handle POST /targets/{id}/cookies
+Request example:
+
+	{"cookies": [{"name": "sid", "value": "abc", "domain": ".example.com", "path": "/", "secure": true}], "replace": true}
+
+Sets the cookies with Network.setCookies; cookies as returned by GET
+/targets/{id}/cookies are accepted as they are. With replace, the cookies
+the page currently sees are deleted first, so the page ends up with
+exactly the given ones; cookies of other sites are left alone.
+*/
+func (c *ChromeDevToolsClient) handleSetCookies(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Cookies []json.RawMessage `json:"cookies"`
+		Replace bool              `json:"replace"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Cookies == nil {
+		http.Error(w, "cookies is required", http.StatusBadRequest)
+		return
+	}
+	targetID := r.PathValue("id")
+	if targetID == browserTargetID {
+		http.Error(w, "cookies needs a page target", http.StatusBadRequest)
+		return
+	}
+	commands := []string{"Network.setCookies"}
+	if req.Replace {
+		commands = append(commands, "Network.getCookies", "Network.deleteCookies")
+	}
+	if !c.allowCommands(w, r, commands...) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), c.client.Timeout)
+	defer cancel()
+	deleted := 0
+	err := c.control.WithSession(ctx, targetID, func(conn *CDPConn, sessionID string) error {
+		if req.Replace {
+			var current struct {
+				Cookies []pageCookie `json:"cookies"`
+			}
+			if err := conn.CallResult(ctx, sessionID, "Network.getCookies", nil, &current); err != nil {
+				return err
+			}
+			for _, cookie := range current.Cookies {
+				if _, err := conn.Call(ctx, sessionID, "Network.deleteCookies", cookie); err != nil {
+					return fmt.Errorf("delete cookie %s: %w", cookie.Name, err)
+				}
+				deleted++
+			}
+		}
+		if len(req.Cookies) == 0 {
+			return nil
+		}
+		_, err := conn.Call(ctx, sessionID, "Network.setCookies", map[string]interface{}{"cookies": req.Cookies})
+		return err
+	})
+	if err != nil {
+		c.errorCount++
+		log.Printf("❌ Failed to set cookies of %s: %v", targetID, err)
+		http.Error(w, fmt.Sprintf("Failed to set cookies: %v", err), http.StatusBadGateway)
+		return
+	}
+	log.Printf("🍪 Set %d cookies on %s (%d deleted)", len(req.Cookies), c.labels.Describe(targetID), deleted)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"set":     len(req.Cookies),
+		"deleted": deleted,
+	})
+}
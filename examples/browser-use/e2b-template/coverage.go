@@ -0,0 +1,561 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A coverage capture nobody stops is discarded after this long
+const coverageMaxDuration = 30 * time.Minute
+
+type coverageRequest struct {
+	// Capture JavaScript and CSS coverage (both default true)
+	JS  *bool `json:"js"`
+	CSS *bool `json:"css"`
+	// Block-level JavaScript coverage instead of per function (default true)
+	Detailed *bool `json:"detailed"`
+}
+
+// CoverageRecorder holds the page sessions of running coverage captures
+// between the start and stop requests
+type CoverageRecorder struct {
+	mu     sync.Mutex
+	active map[string]*activeCoverage
+}
+
+type activeCoverage struct {
+	conn        *CDPConn
+	sessionID   string
+	started     time.Time
+	js          bool
+	css         bool
+	expiry      ClockTimer
+	unsubscribe func()
+
+	mu sync.Mutex
+	// Style sheets by id, from CSS.styleSheetAdded
+	sheets map[string]styleSheetHeader
+	// Coverage so far, by script URL and by style sheet
+	scripts map[string]*CoverageFile
+	styles  map[string]*CoverageFile
+}
+
+type styleSheetHeader struct {
+	StyleSheetID string  `json:"styleSheetId"`
+	SourceURL    string  `json:"sourceURL"`
+	IsInline     bool    `json:"isInline"`
+	StartLine    float64 `json:"startLine"`
+	StartColumn  float64 `json:"startColumn"`
+	Length       float64 `json:"length"`
+}
+
+// Style sheets are reported by URL; the inline sheets of a document by
+// their position in it
+func (h styleSheetHeader) key() string {
+	if h.IsInline {
+		return fmt.Sprintf("%s (inline %d:%d)", h.SourceURL, int(h.StartLine)+1, int(h.StartColumn)+1)
+	}
+	return h.SourceURL
+}
+
+// CoverageRange is a used byte range of a file, end exclusive
+type CoverageRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// CoverageFile is the coverage of one script or style sheet
+type CoverageFile struct {
+	URL        string          `json:"url"`
+	TotalBytes int             `json:"totalBytes"`
+	UsedBytes  int             `json:"usedBytes"`
+	Percent    float64         `json:"percent"`
+	Ranges     []CoverageRange `json:"ranges"`
+}
+
+// CoverageSummary totals the files of one kind
+type CoverageSummary struct {
+	TotalBytes int             `json:"totalBytes"`
+	UsedBytes  int             `json:"usedBytes"`
+	Percent    float64         `json:"percent"`
+	Files      []*CoverageFile `json:"files"`
+}
+
+// CoverageReport is returned by POST /targets/{id}/coverage/stop
+type CoverageReport struct {
+	TargetID   string           `json:"targetId"`
+	StartedAt  time.Time        `json:"startedAt"`
+	DurationMs int64            `json:"durationMs"`
+	JS         *CoverageSummary `json:"js,omitempty"`
+	CSS        *CoverageSummary `json:"css,omitempty"`
+}
+
+func NewCoverageRecorder() *CoverageRecorder {
+	return &CoverageRecorder{active: make(map[string]*activeCoverage)}
+}
+
+/*
+Handle POST /targets/{id}/coverage/start
+Request example (all optional):
+
+	{"js": true, "css": true, "detailed": true}
+
+Starts JavaScript coverage (Profiler.startPreciseCoverage, block level
+unless detailed is false) and CSS rule usage tracking
+(CSS.startRuleUsageTracking) on a session that stays attached until POST
+/targets/{id}/coverage/stop. Coverage is collected whenever the page
+navigates, so the report covers every document loaded meanwhile. Answers
+409 while a capture of the target runs; captures not stopped within 30
+minutes are discarded.
+*/
+func (c *ChromeDevToolsClient) handleCoverageStart(w http.ResponseWriter, r *http.Request) {
+	var req coverageRequest
+	if r.ContentLength != 0 && !readJSON(w, r, &req) {
+		return
+	}
+	targetID := r.PathValue("id")
+	if targetID == browserTargetID {
+		http.Error(w, "coverage needs a page target", http.StatusBadRequest)
+		return
+	}
+	js := req.JS == nil || *req.JS
+	css := req.CSS == nil || *req.CSS
+	detailed := req.Detailed == nil || *req.Detailed
+	if !js && !css {
+		http.Error(w, "nothing to capture: js and css are both false", http.StatusBadRequest)
+		return
+	}
+	if !c.allowCommands(w, r, coverageCommands(js, css)...) {
+		return
+	}
+
+	k := c.coverage
+	k.mu.Lock()
+	if _, ok := k.active[targetID]; ok {
+		k.mu.Unlock()
+		http.Error(w, "Coverage of this target is already being captured", http.StatusConflict)
+		return
+	}
+	// Reserve the slot while attaching
+	k.active[targetID] = nil
+	k.mu.Unlock()
+	cov, err := c.startCoverage(r.Context(), targetID, js, css, detailed)
+	k.mu.Lock()
+	if err != nil {
+		delete(k.active, targetID)
+	} else {
+		k.active[targetID] = cov
+	}
+	k.mu.Unlock()
+
+	var cdpErr *CDPError
+	switch {
+	case err == nil:
+		log.Printf("🧮 Capturing coverage of %s (js: %v, css: %v)", c.labels.Describe(targetID), js, css)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"targetId":  targetID,
+			"js":        js,
+			"css":       css,
+			"startedAt": cov.started,
+		})
+	case errors.As(err, &cdpErr):
+		http.Error(w, fmt.Sprintf("Failed to start coverage: %v", err), http.StatusConflict)
+	default:
+		c.errorCount++
+		log.Printf("❌ Failed to start coverage of %s: %v", targetID, err)
+		http.Error(w, fmt.Sprintf("Failed to start coverage: %v", err), http.StatusBadGateway)
+	}
+}
+
+// The CDP commands capturing coverage sends, stop included so a capture
+// that is started can be collected
+func coverageCommands(js, css bool) []string {
+	commands := []string{"Page.enable"}
+	if js {
+		commands = append(commands, "Profiler.enable", "Profiler.startPreciseCoverage", "Profiler.takePreciseCoverage")
+	}
+	if css {
+		commands = append(commands, "DOM.enable", "CSS.enable", "CSS.startRuleUsageTracking", "CSS.takeCoverageDelta", "CSS.stopRuleUsageTracking")
+	}
+	return commands
+}
+
+// Attach a session to the target and start coverage on it
+func (c *ChromeDevToolsClient) startCoverage(ctx context.Context, targetID string, js, css, detailed bool) (*activeCoverage, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.client.Timeout)
+	defer cancel()
+	conn, err := c.control.Conn()
+	if err != nil {
+		return nil, err
+	}
+	var attached struct {
+		SessionID string `json:"sessionId"`
+	}
+	err = conn.CallResult(ctx, "", "Target.attachToTarget", map[string]interface{}{"targetId": targetID, "flatten": true}, &attached)
+	if err != nil {
+		return nil, err
+	}
+	cov := &activeCoverage{
+		conn:      conn,
+		sessionID: attached.SessionID,
+		started:   c.clock.Now(),
+		js:        js,
+		css:       css,
+		sheets:    make(map[string]styleSheetHeader),
+		scripts:   make(map[string]*CoverageFile),
+		styles:    make(map[string]*CoverageFile),
+	}
+	cov.unsubscribe = conn.Subscribe(func(msg *CDPMessage) {
+		if msg.SessionID != cov.sessionID {
+			return
+		}
+		switch msg.Method {
+		case "CSS.styleSheetAdded":
+			var ev struct {
+				Header styleSheetHeader `json:"header"`
+			}
+			if json.Unmarshal(msg.Params, &ev) == nil {
+				cov.mu.Lock()
+				cov.sheets[ev.Header.StyleSheetID] = ev.Header
+				cov.mu.Unlock()
+			}
+		case "Page.frameStartedLoading":
+			var ev struct {
+				FrameID string `json:"frameId"`
+			}
+			// The main frame's id is the target's; collect before its
+			// document goes away. Not from this goroutine, which reads the
+			// responses.
+			if json.Unmarshal(msg.Params, &ev) == nil && ev.FrameID == targetID {
+				go func() {
+					ctx, cancel := context.WithTimeout(context.Background(), c.client.Timeout)
+					defer cancel()
+					cov.take(ctx)
+				}()
+			}
+		}
+	})
+
+	err = func() error {
+		if _, err := conn.Call(ctx, cov.sessionID, "Page.enable", nil); err != nil {
+			return err
+		}
+		if js {
+			if _, err := conn.Call(ctx, cov.sessionID, "Profiler.enable", nil); err != nil {
+				return err
+			}
+			if _, err := conn.Call(ctx, cov.sessionID, "Profiler.startPreciseCoverage", map[string]interface{}{"callCount": true, "detailed": detailed}); err != nil {
+				return err
+			}
+		}
+		if css {
+			// CSS needs DOM
+			if _, err := conn.Call(ctx, cov.sessionID, "DOM.enable", nil); err != nil {
+				return err
+			}
+			if _, err := conn.Call(ctx, cov.sessionID, "CSS.enable", nil); err != nil {
+				return err
+			}
+			if _, err := conn.Call(ctx, cov.sessionID, "CSS.startRuleUsageTracking", nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		cov.unsubscribe()
+		cov.detach(c.client.Timeout)
+		return nil, err
+	}
+	cov.expiry = c.clock.AfterFunc(coverageMaxDuration, func() {
+		c.coverage.mu.Lock()
+		current := c.coverage.active[targetID]
+		if current == cov {
+			delete(c.coverage.active, targetID)
+		}
+		c.coverage.mu.Unlock()
+		if current != cov {
+			return
+		}
+		log.Printf("⚠️ Discarding the coverage of %s, not stopped within %v", c.labels.Describe(targetID), coverageMaxDuration)
+		cov.unsubscribe()
+		cov.detach(c.client.Timeout)
+	})
+	return cov, nil
+}
+
+// Detaching ends the capture; Chrome stops coverage with the session
+func (a *activeCoverage) detach(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	a.conn.Call(ctx, "", "Target.detachFromTarget", map[string]interface{}{"sessionId": a.sessionID})
+}
+
+// Collect the coverage since the last take into the totals
+func (a *activeCoverage) take(ctx context.Context) error {
+	if a.js {
+		var result struct {
+			Result []struct {
+				URL       string `json:"url"`
+				Functions []struct {
+					Ranges []struct {
+						StartOffset int `json:"startOffset"`
+						EndOffset   int `json:"endOffset"`
+						Count       int `json:"count"`
+					} `json:"ranges"`
+				} `json:"functions"`
+			} `json:"result"`
+		}
+		if err := a.conn.CallResult(ctx, a.sessionID, "Profiler.takePreciseCoverage", nil, &result); err != nil {
+			return err
+		}
+		a.mu.Lock()
+		for _, script := range result.Result {
+			// Scripts without a URL are evaluated code, ours or the agent's
+			if script.URL == "" {
+				continue
+			}
+			var points []coveragePoint
+			total := 0
+			for _, fn := range script.Functions {
+				for _, r := range fn.Ranges {
+					points = append(points,
+						coveragePoint{offset: r.StartOffset, length: r.EndOffset - r.StartOffset, start: true, count: r.Count},
+						coveragePoint{offset: r.EndOffset, length: r.EndOffset - r.StartOffset})
+					// The script's top-level function spans all of it
+					if r.EndOffset > total {
+						total = r.EndOffset
+					}
+				}
+			}
+			addCoverage(a.scripts, script.URL, total, usedRanges(points))
+		}
+		a.mu.Unlock()
+	}
+	if a.css {
+		var result struct {
+			Coverage []cssRuleUsage `json:"coverage"`
+		}
+		if err := a.conn.CallResult(ctx, a.sessionID, "CSS.takeCoverageDelta", nil, &result); err != nil {
+			return err
+		}
+		a.addRuleUsage(result.Coverage)
+	}
+	return nil
+}
+
+type cssRuleUsage struct {
+	StyleSheetID string  `json:"styleSheetId"`
+	StartOffset  float64 `json:"startOffset"`
+	EndOffset    float64 `json:"endOffset"`
+	Used         bool    `json:"used"`
+}
+
+func (a *activeCoverage) addRuleUsage(usage []cssRuleUsage) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	used := make(map[string][]CoverageRange)
+	for _, rule := range usage {
+		if rule.Used {
+			used[rule.StyleSheetID] = append(used[rule.StyleSheetID], CoverageRange{int(rule.StartOffset), int(rule.EndOffset)})
+		}
+	}
+	for id, header := range a.sheets {
+		// Unused sheets are reported too, with no ranges
+		addCoverage(a.styles, header.key(), int(header.Length), used[id])
+	}
+}
+
+// Take the last coverage, stop and build the report
+func (a *activeCoverage) stop(ctx context.Context) error {
+	if a.js {
+		if err := a.take(ctx); err != nil {
+			return err
+		}
+	}
+	if a.css {
+		// Returns the rules used since the last take
+		var result struct {
+			RuleUsage []cssRuleUsage `json:"ruleUsage"`
+		}
+		if err := a.conn.CallResult(ctx, a.sessionID, "CSS.stopRuleUsageTracking", nil, &result); err != nil {
+			return err
+		}
+		a.addRuleUsage(result.RuleUsage)
+	}
+	return nil
+}
+
+func (a *activeCoverage) report(targetID string, now time.Time) *CoverageReport {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	report := &CoverageReport{
+		TargetID:   targetID,
+		StartedAt:  a.started,
+		DurationMs: now.Sub(a.started).Milliseconds(),
+	}
+	if a.js {
+		report.JS = summarizeCoverage(a.scripts)
+	}
+	if a.css {
+		report.CSS = summarizeCoverage(a.styles)
+	}
+	return report
+}
+
+// A range boundary of V8 block coverage
+type coveragePoint struct {
+	offset int
+	length int
+	start  bool
+	count  int
+}
+
+// Flatten V8's nested ranges, where inner ranges override the count of
+// the ranges they are in, into the disjoint ranges that ran
+func usedRanges(points []coveragePoint) []CoverageRange {
+	sort.Slice(points, func(i, j int) bool {
+		a, b := points[i], points[j]
+		if a.offset != b.offset {
+			return a.offset < b.offset
+		}
+		if a.start != b.start {
+			// Ends first
+			return !a.start
+		}
+		if a.start {
+			// Outer ranges open first
+			return a.length > b.length
+		}
+		// And close last
+		return a.length < b.length
+	})
+	var counts []int
+	var ranges []CoverageRange
+	last := 0
+	for _, p := range points {
+		if len(counts) > 0 && last < p.offset && counts[len(counts)-1] > 0 {
+			if n := len(ranges); n > 0 && ranges[n-1].End == last {
+				ranges[n-1].End = p.offset
+			} else {
+				ranges = append(ranges, CoverageRange{last, p.offset})
+			}
+		}
+		last = p.offset
+		if p.start {
+			counts = append(counts, p.count)
+		} else if len(counts) > 0 {
+			counts = counts[:len(counts)-1]
+		}
+	}
+	return ranges
+}
+
+// Merge used ranges into a file's coverage
+func addCoverage(files map[string]*CoverageFile, url string, total int, ranges []CoverageRange) {
+	file := files[url]
+	if file == nil {
+		file = &CoverageFile{URL: url}
+		files[url] = file
+	}
+	if total > file.TotalBytes {
+		file.TotalBytes = total
+	}
+	file.Ranges = mergeRanges(append(file.Ranges, ranges...))
+	file.UsedBytes = 0
+	for _, r := range file.Ranges {
+		file.UsedBytes += r.End - r.Start
+	}
+	file.Percent = coveragePercent(file.UsedBytes, file.TotalBytes)
+}
+
+func mergeRanges(ranges []CoverageRange) []CoverageRange {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && r.Start <= merged[n-1].End {
+			if r.End > merged[n-1].End {
+				merged[n-1].End = r.End
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+func summarizeCoverage(files map[string]*CoverageFile) *CoverageSummary {
+	summary := &CoverageSummary{Files: make([]*CoverageFile, 0, len(files))}
+	for _, file := range files {
+		summary.Files = append(summary.Files, file)
+		summary.TotalBytes += file.TotalBytes
+		summary.UsedBytes += file.UsedBytes
+	}
+	sort.Slice(summary.Files, func(i, j int) bool { return summary.Files[i].URL < summary.Files[j].URL })
+	summary.Percent = coveragePercent(summary.UsedBytes, summary.TotalBytes)
+	return summary
+}
+
+func coveragePercent(used, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(int(float64(used)*10000/float64(total))) / 100
+}
+
+/*
+Handle POST /targets/{id}/coverage/stop
+Stops the capture started by POST /targets/{id}/coverage/start and returns
+the used bytes of every script and style sheet, by URL, with totals:
+
+	{
+	   "targetId": "...",
+	   "js": {"totalBytes": 52000, "usedBytes": 18000, "percent": 34.61,
+	          "files": [{"url": "https://example.com/app.js", "totalBytes": 52000,
+	                     "usedBytes": 18000, "percent": 34.61, "ranges": [{"start": 0, "end": 120}]}]},
+	   "css": {...}
+	}
+
+Scripts without a URL (evaluated code) are left out.
+*/
+func (c *ChromeDevToolsClient) handleCoverageStop(w http.ResponseWriter, r *http.Request) {
+	targetID := r.PathValue("id")
+	k := c.coverage
+	k.mu.Lock()
+	cov := k.active[targetID]
+	if cov != nil {
+		delete(k.active, targetID)
+	}
+	k.mu.Unlock()
+	if cov == nil {
+		http.Error(w, "No coverage of this target is being captured", http.StatusNotFound)
+		return
+	}
+	cov.expiry.Stop()
+	cov.unsubscribe()
+	defer cov.detach(c.client.Timeout)
+
+	ctx, cancel := context.WithTimeout(r.Context(), c.client.Timeout)
+	defer cancel()
+	if err := cov.stop(ctx); err != nil {
+		c.errorCount++
+		log.Printf("❌ Failed to stop coverage of %s: %v", targetID, err)
+		http.Error(w, fmt.Sprintf("Failed to stop coverage: %v", err), http.StatusBadGateway)
+		return
+	}
+	report := cov.report(targetID, c.clock.Now())
+	if report.JS != nil {
+		log.Printf("🧮 JS coverage of %s: %.2f%% of %d bytes", c.labels.Describe(targetID), report.JS.Percent, report.JS.TotalBytes)
+	}
+	if report.CSS != nil {
+		log.Printf("🧮 CSS coverage of %s: %.2f%% of %d bytes", c.labels.Describe(targetID), report.CSS.Percent, report.CSS.TotalBytes)
+	}
+	writeJSON(w, http.StatusOK, report)
+}
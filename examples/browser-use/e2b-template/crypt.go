@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Encrypted artifact files start with this header, followed by the GCM
+// nonce and the sealed content
+var artifactMagic = []byte("PPAE1")
+
+const decryptUsage = `Usage:
+  reverse-proxy decrypt --keyFile /run/secrets/artifact-key --sandbox <sandbox id> --in <artifact file> [--out file] [--id artifact id]
+
+The artifact id defaults to the input file name, as stored under <artifactDir>/<kind>/<id>.
+`
+
+// Derive the per-sandbox artifact key from the master key, so one leaked
+// sandbox key does not expose other sandboxes' recordings
+func artifactKey(master []byte, sandboxID string) []byte {
+	h := hmac.New(sha256.New, master)
+	h.Write([]byte("ppio-artifacts/" + sandboxID))
+	return h.Sum(nil)
+}
+
+func readMasterKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key := bytes.TrimSpace(data)
+	if len(key) < 16 {
+		return nil, fmt.Errorf("key in %s is too short (need at least 16 bytes)", path)
+	}
+	return key, nil
+}
+
+// NewArtifactCipher returns the AES-256-GCM cipher for this sandbox's
+// artifacts, or nil when no key file is configured
+func NewArtifactCipher(keyFile, sandboxID string) (cipher.AEAD, error) {
+	if keyFile == "" {
+		return nil, nil
+	}
+	master, err := readMasterKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(artifactKey(master, sandboxID))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal encrypts an artifact, binding it to its id so files can't be swapped
+func sealArtifact(aead cipher.AEAD, id string, plaintext []byte) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	out := append(append([]byte{}, artifactMagic...), nonce...)
+	return aead.Seal(out, nonce, plaintext, []byte(id))
+}
+
+func openArtifact(aead cipher.AEAD, id string, data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, artifactMagic) || len(data) < len(artifactMagic)+aead.NonceSize() {
+		return nil, errors.New("not an encrypted artifact")
+	}
+	data = data[len(artifactMagic):]
+	nonce, sealed := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, sealed, []byte(id))
+	if err != nil {
+		return nil, fmt.Errorf("decrypt artifact %s: wrong key, sandbox or artifact id", id)
+	}
+	return plaintext, nil
+}
+
+// Entry point for the "decrypt" subcommand, returns the process exit code
+func runDecryptCommand(args []string) int {
+	fs := flag.NewFlagSet("decrypt", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, decryptUsage) }
+	keyFile := fs.String("keyFile", "", "File holding the master artifact key")
+	sandbox := fs.String("sandbox", os.Getenv("E2B_SANDBOX_ID"), "Sandbox id the artifact was written in")
+	in := fs.String("in", "", "Encrypted artifact file")
+	out := fs.String("out", "", "Output file (default stdout)")
+	id := fs.String("id", "", "Artifact id (default: input file name)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *keyFile == "" || *in == "" {
+		fs.Usage()
+		return 2
+	}
+	if *id == "" {
+		*id = filepath.Base(*in)
+	}
+
+	aead, err := NewArtifactCipher(*keyFile, *sandbox)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ Failed to load key: %v\n", err)
+		return 1
+	}
+	data, err := os.ReadFile(*in)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return 1
+	}
+	plaintext, err := openArtifact(aead, *id, data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return 1
+	}
+
+	if *out == "" {
+		os.Stdout.Write(plaintext)
+		return 0
+	}
+	if err := os.WriteFile(*out, plaintext, 0o600); err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return 1
+	}
+	return 0
+}
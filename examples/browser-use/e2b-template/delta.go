@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+func init() {
+	registerFeature("cdp-delta", "Send large repeated CDP messages as diffs against the previous one of the same kind to clients that request the cdp.delta WebSocket subprotocol", true)
+}
+
+// Subprotocol a client requests to receive large messages as diffs
+const subprotocolDelta = "cdp.delta"
+
+const (
+	// Kinds of message (session and method) kept per connection
+	maxDeltaSlots = 64
+	// Bytes of previous messages kept per connection
+	maxDeltaBytes = 64 << 20
+	// Shortest run of bytes a diff copies from the previous message
+	deltaBlockSize = 32
+)
+
+// DeltaEncoding sends clients that negotiated the cdp.delta subprotocol
+// diffs of large messages instead of the messages themselves: agents that
+// take a DOM snapshot or accessibility tree after every action receive
+// mostly what they already have. Every large event or response is tagged
+// with the slot of its kind (session and method) by inserting a
+// "ppioSlot" member first:
+//
+//	{"ppioSlot":3,"id":12,"result":{...}}
+//
+// and the next large message of that kind may arrive as a diff against the
+// last one in the slot instead:
+//
+//	{"ppioDelta":{"slot":3,"ops":[[0,1200],"changed text",[1260,80000]]}}
+//
+// A [start, length] op copies bytes of the slot's message and a string op
+// inserts its UTF-8 bytes; the reconstructed message is the tagged one,
+// which replaces the slot's. scripts/cdp_delta.py is a client helper.
+type DeltaEncoding struct {
+	threshold int
+
+	connections int64
+	diffs       int64
+	rawBytes    int64
+	sentBytes   int64
+}
+
+func NewDeltaEncoding(threshold int) *DeltaEncoding {
+	return &DeltaEncoding{threshold: threshold}
+}
+
+// Start the delta state of a connection that negotiated protocol, nil for
+// any other subprotocol
+func (e *DeltaEncoding) Connect(protocol string) *deltaEncoder {
+	if e == nil || protocol != subprotocolDelta {
+		return nil
+	}
+	atomic.AddInt64(&e.connections, 1)
+	return &deltaEncoder{
+		e:       e,
+		slots:   make(map[string]*deltaSlot),
+		pending: make(map[string]string),
+	}
+}
+
+func (e *DeltaEncoding) Metrics() map[string]interface{} {
+	return map[string]interface{}{
+		"delta_connections_total":  atomic.LoadInt64(&e.connections),
+		"delta_messages_total":     atomic.LoadInt64(&e.diffs),
+		"delta_input_bytes_total":  atomic.LoadInt64(&e.rawBytes),
+		"delta_output_bytes_total": atomic.LoadInt64(&e.sentBytes),
+	}
+}
+
+// deltaEncoder is the delta state of one client connection
+type deltaEncoder struct {
+	e *DeltaEncoding
+
+	mu    sync.Mutex
+	slots map[string]*deltaSlot
+	// Bytes of the messages held by slots
+	held int
+	// Methods of commands by session and id, to tell responses apart
+	pending map[string]string
+}
+
+// deltaSlot holds the last tagged message of one kind, as the client has it
+type deltaSlot struct {
+	n       int
+	message []byte
+}
+
+// Wrap a relay handler toward Chrome to note the method of each command
+// forwarded, so that its response is filed under it
+func (d *deltaEncoder) watchCommands(handle func(opcode byte, payload []byte) []byte) func(opcode byte, payload []byte) []byte {
+	return func(opcode byte, payload []byte) []byte {
+		out := handle(opcode, payload)
+		var msg relayEnvelope
+		if opcode != wsOpText || out == nil || json.Unmarshal(out, &msg) != nil || msg.Method == "" || msg.ID == nil {
+			return out
+		}
+		d.mu.Lock()
+		d.pending[pendingKey(msg.SessionID, msg.ID)] = msg.Method
+		d.mu.Unlock()
+		return out
+	}
+}
+
+// Wrap a relay handler toward the client to delta encode what it returns
+func (d *deltaEncoder) encodeMessages(handle func(opcode byte, payload []byte) []byte) func(opcode byte, payload []byte) []byte {
+	return func(opcode byte, payload []byte) []byte {
+		out := handle(opcode, payload)
+		if opcode != wsOpText || out == nil {
+			return out
+		}
+		return d.encode(out)
+	}
+}
+
+// Encode a message for the client: small ones pass unchanged, large ones
+// are tagged with their slot and sent as a diff when that is much smaller
+func (d *deltaEncoder) encode(payload []byte) []byte {
+	var msg struct {
+		ID        json.RawMessage `json:"id"`
+		SessionID string          `json:"sessionId"`
+		Method    string          `json:"method"`
+	}
+	if len(payload) == 0 || payload[0] != '{' || json.Unmarshal(payload, &msg) != nil {
+		return payload
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	kind := msg.Method
+	if msg.ID != nil {
+		key := pendingKey(msg.SessionID, msg.ID)
+		kind = "response " + d.pending[key]
+		delete(d.pending, key)
+	}
+	if len(payload) < d.e.threshold {
+		return payload
+	}
+	kind = msg.SessionID + " " + kind
+	slot := d.slots[kind]
+	if slot == nil {
+		if len(d.slots) >= maxDeltaSlots {
+			return payload
+		}
+		slot = &deltaSlot{n: len(d.slots) + 1}
+		d.slots[kind] = slot
+	}
+
+	tagged := make([]byte, 0, len(payload)+24)
+	tagged = append(tagged, `{"ppioSlot":`...)
+	tagged = strconv.AppendInt(tagged, int64(slot.n), 10)
+	if rest := bytes.TrimSpace(payload[1:]); len(rest) > 0 && rest[0] != '}' {
+		tagged = append(tagged, ',')
+	}
+	tagged = append(tagged, payload[1:]...)
+
+	base := slot.message
+	d.held += len(tagged) - len(base)
+	slot.message = tagged
+	if d.held > maxDeltaBytes {
+		// Send untagged instead: the client keeps its copy of the slot,
+		// which nothing refers to until the next tagged message
+		d.held -= len(tagged)
+		slot.message = nil
+		return payload
+	}
+	out := tagged
+	if base != nil {
+		if diff := encodeDelta(slot.n, base, tagged); len(diff) < len(tagged)/2 {
+			out = diff
+			atomic.AddInt64(&d.e.diffs, 1)
+		}
+	}
+	atomic.AddInt64(&d.e.rawBytes, int64(len(payload)))
+	atomic.AddInt64(&d.e.sentBytes, int64(len(out)))
+	return out
+}
+
+// Diff a message against the previous one of its slot as a ppioDelta
+// message. Ops cut messages only at UTF-8 character boundaries, so that
+// inserted text stays valid JSON.
+func encodeDelta(slot int, base, message []byte) []byte {
+	var ops []interface{}
+	literal := 0
+	copyRange := func(from, to, start int) {
+		if from > literal {
+			ops = append(ops, string(message[literal:from]))
+		}
+		ops = append(ops, [2]int{start, to - from})
+		literal = to
+	}
+
+	// Common prefix and suffix, then blocks of the previous message in
+	// between
+	prefix := 0
+	for prefix < len(base) && prefix < len(message) && base[prefix] == message[prefix] {
+		prefix++
+	}
+	for prefix > 0 && prefix < len(message) && !utf8.RuneStart(message[prefix]) {
+		prefix--
+	}
+	suffix := 0
+	for suffix < len(base)-prefix && suffix < len(message)-prefix &&
+		base[len(base)-1-suffix] == message[len(message)-1-suffix] {
+		suffix++
+	}
+	for suffix > 0 && !utf8.RuneStart(message[len(message)-suffix]) {
+		suffix--
+	}
+	if prefix > 0 {
+		copyRange(0, prefix, 0)
+	}
+
+	end := len(message) - suffix
+	blocks := make(map[string]int)
+	for i := prefix; i+deltaBlockSize <= len(base)-suffix; i += deltaBlockSize {
+		if _, ok := blocks[string(base[i:i+deltaBlockSize])]; !ok {
+			blocks[string(base[i:i+deltaBlockSize])] = i
+		}
+	}
+	for i := prefix; i+deltaBlockSize <= end; {
+		start, ok := blocks[string(message[i:i+deltaBlockSize])]
+		if !ok {
+			i++
+			continue
+		}
+		// Grow the match both ways, within character boundaries
+		from, to := i, i+deltaBlockSize
+		for from > literal && start > 0 && base[start-1] == message[from-1] {
+			from--
+			start--
+		}
+		for to < end && start+to-from < len(base) && base[start+to-from] == message[to] {
+			to++
+		}
+		for from < to && !utf8.RuneStart(message[from]) {
+			from++
+			start++
+		}
+		for to > from && to < len(message) && !utf8.RuneStart(message[to]) {
+			to--
+		}
+		if to-from < deltaBlockSize {
+			i++
+			continue
+		}
+		copyRange(from, to, start)
+		i = to
+	}
+	if suffix > 0 {
+		copyRange(end, len(message), len(base)-suffix)
+	}
+	if literal < len(message) {
+		ops = append(ops, string(message[literal:]))
+	}
+
+	// Inserted markup stays as it is rather than escaped
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(map[string]interface{}{
+		"ppioDelta": map[string]interface{}{"slot": slot, "ops": ops},
+	}); err != nil {
+		return message
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+}
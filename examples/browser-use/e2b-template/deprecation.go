@@ -0,0 +1,129 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+func init() {
+	registerFeature("deprecation-telemetry", "Count deprecated CDP methods sent by relayed clients, per client SDK (parses every client connection)", false)
+}
+
+// Shims the proxy applies for a client, and what replaces them
+var deprecatedPatterns = map[string]string{
+	"devtoolsFrontendUrlCompat": "devtoolsFrontendUrl",
+	"frontend-ws-param":         "wss= parameter of devtoolsFrontendUrl",
+}
+
+// Deprecated CDP methods and their replacements. The proxy relays them
+// unchanged; Chrome may drop them in any release.
+var deprecatedCDPMethods = map[string]string{
+	"Page.addScriptToEvaluateOnLoad":         "Page.addScriptToEvaluateOnNewDocument",
+	"Page.removeScriptToEvaluateOnLoad":      "Page.removeScriptToEvaluateOnNewDocument",
+	"Page.setDeviceMetricsOverride":          "Emulation.setDeviceMetricsOverride",
+	"Page.clearDeviceMetricsOverride":        "Emulation.clearDeviceMetricsOverride",
+	"Page.setGeolocationOverride":            "Emulation.setGeolocationOverride",
+	"Page.clearGeolocationOverride":          "Emulation.clearGeolocationOverride",
+	"Page.setTouchEmulationEnabled":          "Emulation.setTouchEmulationEnabled",
+	"Page.setDownloadBehavior":               "Browser.setDownloadBehavior",
+	"Network.setRequestInterception":         "Fetch.enable",
+	"Network.continueInterceptedRequest":     "Fetch.continueRequest",
+	"Network.getResponseBodyForInterception": "Fetch.getResponseBody",
+	"Network.canClearBrowserCache":           "",
+	"Network.canClearBrowserCookies":         "",
+	"Network.canEmulateNetworkConditions":    "",
+	"Emulation.setVisibleSize":               "Emulation.setDeviceMetricsOverride",
+	"DOM.getFlattenedDocument":               "DOM.getDocument",
+}
+
+// DeprecationUse is how often one client SDK hit one deprecated pattern
+type DeprecationUse struct {
+	Pattern     string    `json:"pattern"`
+	Replacement string    `json:"replacement,omitempty"`
+	Client      string    `json:"client"`
+	Count       int64     `json:"count"`
+	FirstSeen   time.Time `json:"firstSeen"`
+	LastSeen    time.Time `json:"lastSeen"`
+}
+
+// DeprecationTelemetry counts deprecated patterns per client
+// classification, to tell when a shim can be removed
+type DeprecationTelemetry struct {
+	clock Clock
+	mu    sync.Mutex
+	uses  map[string]*DeprecationUse
+}
+
+func NewDeprecationTelemetry(clock Clock) *DeprecationTelemetry {
+	return &DeprecationTelemetry{clock: clock, uses: make(map[string]*DeprecationUse)}
+}
+
+// Record one use of a pattern, logging the first per client
+func (d *DeprecationTelemetry) Record(pattern, replacement string, client *ClientInfo) {
+	key := pattern + " " + client.String()
+	now := d.clock.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	use, ok := d.uses[key]
+	if !ok {
+		use = &DeprecationUse{Pattern: pattern, Replacement: replacement, Client: client.String(), FirstSeen: now}
+		d.uses[key] = use
+		log.Printf("🕰️ Deprecated %s used by %s", pattern, client)
+	}
+	use.Count++
+	use.LastSeen = now
+}
+
+// RecordShim records a proxy shim applied for the request's client
+func (d *DeprecationTelemetry) RecordShim(pattern string, r *http.Request) {
+	d.Record(pattern, deprecatedPatterns[pattern], classifyClient(r))
+}
+
+// ObserveCommand records a relayed command when its method is deprecated
+func (d *DeprecationTelemetry) ObserveCommand(method string, client *ClientInfo) {
+	if replacement, ok := deprecatedCDPMethods[method]; ok {
+		d.Record(method, replacement, client)
+	}
+}
+
+func (d *DeprecationTelemetry) list() []*DeprecationUse {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	uses := make([]*DeprecationUse, 0, len(d.uses))
+	for _, use := range d.uses {
+		copied := *use
+		uses = append(uses, &copied)
+	}
+	sort.Slice(uses, func(i, j int) bool {
+		if uses[i].Pattern != uses[j].Pattern {
+			return uses[i].Pattern < uses[j].Pattern
+		}
+		return uses[i].Client < uses[j].Client
+	})
+	return uses
+}
+
+func (d *DeprecationTelemetry) Metrics() map[string]interface{} {
+	byPattern := make(map[string]map[string]int64)
+	for _, use := range d.list() {
+		if byPattern[use.Pattern] == nil {
+			byPattern[use.Pattern] = make(map[string]int64)
+		}
+		byPattern[use.Pattern][use.Client] = use.Count
+	}
+	return map[string]interface{}{
+		"deprecated_patterns_by_client": byPattern,
+	}
+}
+
+// Handle GET /admin/deprecations, every deprecated pattern seen with its
+// count per client SDK
+func (c *ChromeDevToolsClient) handleDeprecations(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"cdpMethodsTracked": featureEnabled("deprecation-telemetry"),
+		"uses":              c.deprecations.list(),
+	})
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DownloadBridge has Chrome save downloads to -downloadDir and serves them
+// at /downloads, so files an agent downloads inside the sandbox can be
+// fetched through the proxy port. Chrome saves each download under its
+// GUID; once complete it is renamed to its suggested file name, made unique
+// in the directory.
+type DownloadBridge struct {
+	clock   Clock
+	dir     string
+	control *ControlSession
+
+	mu sync.Mutex
+	// Downloads Chrome reported, by GUID
+	downloads map[string]*downloadState
+	// Source URL of the completed files, by name
+	sources map[string]string
+
+	started   int64
+	completed int64
+	canceled  int64
+}
+
+type downloadState struct {
+	GUID          string    `json:"guid"`
+	URL           string    `json:"url"`
+	Name          string    `json:"suggestedFilename"`
+	State         string    `json:"state"`
+	ReceivedBytes float64   `json:"receivedBytes"`
+	TotalBytes    float64   `json:"totalBytes"`
+	StartedAt     time.Time `json:"startedAt"`
+}
+
+// DownloadedFile is an entry of GET /downloads
+type DownloadedFile struct {
+	Name       string    `json:"name"`
+	Size       int64     `json:"size"`
+	ModifiedAt time.Time `json:"modifiedAt"`
+	URL        string    `json:"url,omitempty"`
+	Href       string    `json:"href"`
+}
+
+func NewDownloadBridge(clock Clock, dir string, control *ControlSession) (*DownloadBridge, error) {
+	// Chrome only takes an absolute download path
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &DownloadBridge{
+		clock:     clock,
+		dir:       dir,
+		control:   control,
+		downloads: make(map[string]*downloadState),
+		sources:   make(map[string]string),
+	}, nil
+}
+
+// Run keeps a connection to Chrome that sets the download directory,
+// re-dialing when it drops; Chrome resets the download behavior when the
+// connection that set it closes
+func (d *DownloadBridge) Run() {
+	for {
+		conn, err := d.control.Dial()
+		if err != nil {
+			log.Printf("⚠️ Download bridge cannot reach Chrome: %v", err)
+			<-d.clock.After(2 * time.Second)
+			continue
+		}
+		if err := d.watch(conn); err != nil {
+			log.Printf("⚠️ Failed to set the download directory: %v", err)
+			conn.Close()
+			<-d.clock.After(2 * time.Second)
+			continue
+		}
+		<-conn.Done()
+	}
+}
+
+func (d *DownloadBridge) watch(conn *CDPConn) error {
+	conn.Subscribe(func(msg *CDPMessage) {
+		switch msg.Method {
+		case "Browser.downloadWillBegin":
+			var ev struct {
+				GUID              string `json:"guid"`
+				URL               string `json:"url"`
+				SuggestedFilename string `json:"suggestedFilename"`
+			}
+			if json.Unmarshal(msg.Params, &ev) != nil {
+				return
+			}
+			atomic.AddInt64(&d.started, 1)
+			d.mu.Lock()
+			d.downloads[ev.GUID] = &downloadState{GUID: ev.GUID, URL: ev.URL, Name: ev.SuggestedFilename, State: "inProgress", StartedAt: d.clock.Now()}
+			d.mu.Unlock()
+		case "Browser.downloadProgress":
+			var ev struct {
+				GUID          string  `json:"guid"`
+				State         string  `json:"state"`
+				ReceivedBytes float64 `json:"receivedBytes"`
+				TotalBytes    float64 `json:"totalBytes"`
+			}
+			if json.Unmarshal(msg.Params, &ev) != nil {
+				return
+			}
+			d.mu.Lock()
+			state := d.downloads[ev.GUID]
+			if state != nil {
+				state.State, state.ReceivedBytes, state.TotalBytes = ev.State, ev.ReceivedBytes, ev.TotalBytes
+				if ev.State != "inProgress" {
+					delete(d.downloads, ev.GUID)
+				}
+			}
+			d.mu.Unlock()
+			switch {
+			case state == nil:
+			case ev.State == "completed":
+				atomic.AddInt64(&d.completed, 1)
+				d.finish(state)
+			case ev.State == "canceled":
+				atomic.AddInt64(&d.canceled, 1)
+				os.Remove(filepath.Join(d.dir, state.GUID))
+			}
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), d.control.timeout)
+	defer cancel()
+	_, err := conn.Call(ctx, "", "Browser.setDownloadBehavior", map[string]interface{}{
+		"behavior":      "allowAndName",
+		"downloadPath":  d.dir,
+		"eventsEnabled": true,
+	})
+	return err
+}
+
+// Rename a completed download from its GUID to its suggested name
+func (d *DownloadBridge) finish(state *downloadState) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	name := d.uniqueName(downloadFileName(state.Name, state.GUID))
+	if err := os.Rename(filepath.Join(d.dir, state.GUID), filepath.Join(d.dir, name)); err != nil {
+		log.Printf("⚠️ Failed to name download %s: %v", state.GUID, err)
+		name = state.GUID
+	}
+	d.sources[name] = state.URL
+	log.Printf("📥 Downloaded %s from %s", name, state.URL)
+}
+
+// A file name free in the directory: "report.pdf", then "report (1).pdf"
+func (d *DownloadBridge) uniqueName(name string) string {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(filepath.Join(d.dir, name)); os.IsNotExist(err) {
+			return name
+		}
+		name = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+}
+
+// The suggested name of a download made safe as a file name in the
+// directory, or its GUID when nothing is left of it
+func downloadFileName(suggested, guid string) string {
+	name := strings.NewReplacer("/", "_", "\\", "_", "\x00", "").Replace(suggested)
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+	if name == "" {
+		return guid
+	}
+	return name
+}
+
+// Whether name is a download Chrome is still writing
+func (d *DownloadBridge) inProgress(name string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.downloads[name]
+	return ok
+}
+
+func (d *DownloadBridge) List() ([]DownloadedFile, []downloadState, error) {
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	files := []DownloadedFile{}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || d.downloads[entry.Name()] != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, DownloadedFile{
+			Name:       entry.Name(),
+			Size:       info.Size(),
+			ModifiedAt: info.ModTime(),
+			URL:        d.sources[entry.Name()],
+			Href:       "/downloads/" + entry.Name(),
+		})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModifiedAt.Before(files[j].ModifiedAt) })
+	pending := []downloadState{}
+	for _, state := range d.downloads {
+		pending = append(pending, *state)
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].StartedAt.Before(pending[j].StartedAt) })
+	return files, pending, nil
+}
+
+func (d *DownloadBridge) Metrics() map[string]interface{} {
+	d.mu.Lock()
+	active := len(d.downloads)
+	d.mu.Unlock()
+	return map[string]interface{}{
+		"downloads_in_progress":    active,
+		"downloads_started_total":  atomic.LoadInt64(&d.started),
+		"downloads_complete_total": atomic.LoadInt64(&d.completed),
+		"downloads_canceled_total": atomic.LoadInt64(&d.canceled),
+	}
+}
+
+/*
+Handle GET /downloads
+Lists the files in -downloadDir, oldest first, and the downloads Chrome is
+still writing:
+
+	{
+	   "downloads": [{"name": "report.pdf", "size": 48213, "modifiedAt": "...",
+	                  "url": "https://example.com/report", "href": "/downloads/report.pdf"}],
+	   "inProgress": [{"guid": "...", "url": "...", "suggestedFilename": "data.csv",
+	                   "state": "inProgress", "receivedBytes": 1024, "totalBytes": 4096, "startedAt": "..."}]
+	}
+*/
+func (c *ChromeDevToolsClient) handleListDownloads(w http.ResponseWriter, r *http.Request) {
+	if c.downloads == nil {
+		http.Error(w, "Downloads are disabled (set -downloadDir)", http.StatusNotFound)
+		return
+	}
+	files, pending, err := c.downloads.List()
+	if err != nil {
+		c.errorCount++
+		log.Printf("❌ Failed to list downloads: %v", err)
+		http.Error(w, fmt.Sprintf("Failed to list downloads: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"downloads":  files,
+		"inProgress": pending,
+	})
+}
+
+/*
+Handle GET /downloads/{name}
+Serves a downloaded file as an attachment, with Range support; 409 while
+Chrome is still writing it.
+*/
+func (c *ChromeDevToolsClient) handleGetDownload(w http.ResponseWriter, r *http.Request) {
+	if c.downloads == nil {
+		http.Error(w, "Downloads are disabled (set -downloadDir)", http.StatusNotFound)
+		return
+	}
+	name := r.PathValue("name")
+	if name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		http.Error(w, "invalid file name", http.StatusBadRequest)
+		return
+	}
+	if c.downloads.inProgress(name) {
+		http.Error(w, "Download is still in progress", http.StatusConflict)
+		return
+	}
+	f, err := os.Open(filepath.Join(c.downloads.dir, name))
+	if os.IsNotExist(err) {
+		http.Error(w, "Download not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		http.Error(w, "Download not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
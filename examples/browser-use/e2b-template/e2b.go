@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How long a token's verdict is trusted before the E2B API is asked again
+const (
+	e2bAdmitTTL  = 5 * time.Minute
+	e2bRejectTTL = time.Minute
+)
+
+// Longest wait between two looks at the sandbox's end time
+const e2bPollInterval = 30 * time.Second
+
+// Verdicts kept at most; past it, expired ones are swept and then those
+// expiring first evicted. Keys are chosen by callers, so without a bound
+// every new one would grow the cache.
+const e2bMaxVerdicts = 4096
+
+// Lookups of keys without a verdict allowed per e2bLookupWindow; past it
+// unknown keys are answered 429 rather than each costing an E2B API call
+const (
+	e2bLookupLimit  = 30
+	e2bLookupWindow = 10 * time.Second
+)
+
+var (
+	errSandboxGone = errors.New("sandbox no longer exists")
+	errKeyRefused  = errors.New("E2B API refused the key")
+)
+
+// E2BSandbox ties the proxy to the E2B sandbox it runs in through the E2B
+// API. With admission (-e2bAdmission), a request must carry an E2B API key
+// (X-API-Key header, or e2bKey query parameter for WebSocket clients that
+// cannot set headers) that can see this sandbox, i.e. one of the team that
+// owns it. With teardown (-e2bTeardown), the proxy polls the sandbox's end
+// time and, shortly before it, flushes artifacts and shuts down instead of
+// being killed mid-write.
+type E2BSandbox struct {
+	api       string
+	sandboxID string
+	// The proxy's own key, for watching the sandbox
+	apiKey string
+	client *http.Client
+	clock  Clock
+
+	mu     sync.Mutex
+	tokens map[[32]byte]e2bVerdict
+	endAt  time.Time
+	// Lookups of unknown keys in the current window
+	lookupWindow time.Time
+	lookups      int
+
+	admitted  int64
+	rejected  int64
+	throttled int64
+	evicted   int64
+}
+
+type e2bVerdict struct {
+	owner   bool
+	expires time.Time
+}
+
+func NewE2BSandbox(clock Clock, api, sandboxID, apiKey string, timeout time.Duration) (*E2BSandbox, error) {
+	if sandboxID == "" {
+		return nil, errors.New("no sandbox id (set -sandboxID or E2B_SANDBOX_ID)")
+	}
+	return &E2BSandbox{
+		api:       strings.TrimSuffix(api, "/"),
+		sandboxID: sandboxID,
+		apiKey:    apiKey,
+		client:    &http.Client{Timeout: timeout},
+		clock:     clock,
+		tokens:    make(map[[32]byte]e2bVerdict),
+	}, nil
+}
+
+// Look the sandbox up with key, returning its scheduled end
+func (s *E2BSandbox) lookup(ctx context.Context, key string) (time.Time, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.api+"/sandboxes/"+s.sandboxID, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	req.Header.Set("X-API-Key", key)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return time.Time{}, errSandboxGone
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return time.Time{}, errKeyRefused
+	default:
+		return time.Time{}, fmt.Errorf("E2B API: %s", resp.Status)
+	}
+	var sandbox struct {
+		EndAt time.Time `json:"endAt"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&sandbox); err != nil {
+		return time.Time{}, fmt.Errorf("E2B API: %w", err)
+	}
+	return sandbox.EndAt, nil
+}
+
+// Admit reports whether the request carries a key of the sandbox's owner,
+// answering it with an error when not. Verdicts are cached per key; when
+// the E2B API cannot be reached, or too many unknown keys were looked up
+// lately, unknown keys are refused.
+func (s *E2BSandbox) Admit(w http.ResponseWriter, r *http.Request) bool {
+	key := r.Header.Get("X-API-Key")
+	if q := r.URL.Query(); q.Has("e2bKey") {
+		if key == "" {
+			key = q.Get("e2bKey")
+		}
+		// Chrome has no use for it
+		q.Del("e2bKey")
+		r.URL.RawQuery = q.Encode()
+	}
+	if key == "" {
+		atomic.AddInt64(&s.rejected, 1)
+		http.Error(w, "E2B API key required (X-API-Key header or e2bKey parameter)", http.StatusUnauthorized)
+		return false
+	}
+
+	hash := sha256.Sum256([]byte(key))
+	now := s.clock.Now()
+	s.mu.Lock()
+	verdict, ok := s.tokens[hash]
+	known := ok && now.Before(verdict.expires)
+	allowed := known || s.allowLookup(now)
+	s.mu.Unlock()
+	if !allowed {
+		atomic.AddInt64(&s.rejected, 1)
+		atomic.AddInt64(&s.throttled, 1)
+		w.Header().Set("Retry-After", fmt.Sprint(int(e2bLookupWindow.Seconds())))
+		http.Error(w, "Too many unverified E2B API keys, retry later", http.StatusTooManyRequests)
+		return false
+	}
+	if !known {
+		_, err := s.lookup(r.Context(), key)
+		switch {
+		case err == nil:
+			verdict = e2bVerdict{owner: true, expires: s.clock.Now().Add(e2bAdmitTTL)}
+		case errors.Is(err, errSandboxGone) || errors.Is(err, errKeyRefused):
+			// E2B answers 404 for sandboxes of other teams as well
+			verdict = e2bVerdict{expires: s.clock.Now().Add(e2bRejectTTL)}
+		default:
+			atomic.AddInt64(&s.rejected, 1)
+			log.Printf("⚠️ Cannot verify E2B API key of %s: %v", r.RemoteAddr, err)
+			http.Error(w, "Cannot verify E2B API key", http.StatusServiceUnavailable)
+			return false
+		}
+		s.mu.Lock()
+		s.remember(hash, verdict)
+		s.mu.Unlock()
+	}
+	if !verdict.owner {
+		atomic.AddInt64(&s.rejected, 1)
+		log.Printf("🔒 Rejected %s %s from %s: E2B API key is not of the sandbox owner", r.Method, r.URL.Path, r.RemoteAddr)
+		http.Error(w, "E2B API key does not belong to the sandbox owner", http.StatusForbidden)
+		return false
+	}
+	atomic.AddInt64(&s.admitted, 1)
+	return true
+}
+
+// Count a lookup of an unknown key, reporting false when the window's
+// allowance is spent; s.mu is held
+func (s *E2BSandbox) allowLookup(now time.Time) bool {
+	if now.Sub(s.lookupWindow) >= e2bLookupWindow {
+		s.lookupWindow, s.lookups = now, 0
+	}
+	if s.lookups >= e2bLookupLimit {
+		return false
+	}
+	s.lookups++
+	return true
+}
+
+// Cache a verdict, making room when the cache is full; s.mu is held
+func (s *E2BSandbox) remember(hash [32]byte, verdict e2bVerdict) {
+	if _, ok := s.tokens[hash]; !ok && len(s.tokens) >= e2bMaxVerdicts {
+		now := s.clock.Now()
+		for h, v := range s.tokens {
+			if !now.Before(v.expires) {
+				delete(s.tokens, h)
+			}
+		}
+		for len(s.tokens) >= e2bMaxVerdicts {
+			var first [32]byte
+			var firstAt time.Time
+			for h, v := range s.tokens {
+				if firstAt.IsZero() || v.expires.Before(firstAt) {
+					first, firstAt = h, v.expires
+				}
+			}
+			delete(s.tokens, first)
+			atomic.AddInt64(&s.evicted, 1)
+		}
+	}
+	s.tokens[hash] = verdict
+}
+
+// WatchTeardown polls the sandbox's end time with the proxy's own key and
+// calls teardown lead before it, or as soon as the sandbox is gone
+func (s *E2BSandbox) WatchTeardown(lead time.Duration, teardown func(reason string)) {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), s.client.Timeout)
+		endAt, err := s.lookup(ctx, s.apiKey)
+		cancel()
+		s.mu.Lock()
+		seen := !s.endAt.IsZero()
+		s.mu.Unlock()
+		// Before the first answer, a 404 more likely means a key of
+		// another team than a sandbox gone
+		if errors.Is(err, errSandboxGone) && seen {
+			teardown("E2B sandbox " + s.sandboxID + " is gone")
+			return
+		}
+		wait := e2bPollInterval
+		if err != nil {
+			log.Printf("⚠️ Cannot read E2B sandbox end time: %v", err)
+		} else {
+			s.mu.Lock()
+			s.endAt = endAt
+			s.mu.Unlock()
+			left := endAt.Sub(s.clock.Now()) - lead
+			if left <= 0 {
+				teardown(fmt.Sprintf("E2B sandbox %s ends at %s", s.sandboxID, endAt.Format(time.RFC3339)))
+				return
+			}
+			// The end moves when the sandbox's timeout is extended
+			if left < wait {
+				wait = left
+			}
+		}
+		<-s.clock.After(wait)
+	}
+}
+
+func (s *E2BSandbox) Metrics() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	metrics := map[string]interface{}{
+		"e2b_admitted_requests_total": atomic.LoadInt64(&s.admitted),
+		"e2b_rejected_requests_total": atomic.LoadInt64(&s.rejected),
+		"e2b_throttled_lookups_total": atomic.LoadInt64(&s.throttled),
+		"e2b_evicted_verdicts_total":  atomic.LoadInt64(&s.evicted),
+		"e2b_cached_verdicts":         len(s.tokens),
+	}
+	if !s.endAt.IsZero() {
+		metrics["e2b_sandbox_end_at"] = s.endAt.Unix()
+	}
+	return metrics
+}
+
+// Shut the proxy down ahead of the sandbox: shutdown hooks run
+// (-shutdownHooks), page modules are detached so that videos and other
+// per-page artifacts are written, artifacts are uploaded (-uploadURL), the
+// state is saved (-stateFile), then the server stops accepting requests.
+// Only the first call tears down.
+func (c *ChromeDevToolsClient) teardown(reason string) {
+	if !atomic.CompareAndSwapInt32(&c.tornDown, 0, 1) {
+		return
+	}
+	log.Printf("🛬 %s, flushing artifacts and shutting down", reason)
+	ctx, cancel := context.WithTimeout(context.Background(), e2bTeardownLead)
+	defer cancel()
+	if c.shutdown != nil {
+		c.shutdown.RunShutdown(ctx, c, reason)
+	}
+	c.pages.DetachAll()
+	c.video.Wait(ctx)
+	if c.upload != nil {
+		c.upload.Upload(c.uploadItems(reason))
+	}
+	if c.state != nil {
+		c.saveState()
+	}
+	if c.server == nil {
+		// Not serving yet
+		os.Exit(0)
+	}
+	c.server.Shutdown(ctx)
+}
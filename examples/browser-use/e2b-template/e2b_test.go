@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Unknown keys cost at most e2bLookupLimit E2B API calls per window, and
+// their verdicts do not grow the cache past e2bMaxVerdicts
+func TestE2BAdmitBoundsUnknownKeys(t *testing.T) {
+	var calls int64
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&calls, 1)
+		if r.Header.Get("X-API-Key") == "owner" {
+			fmt.Fprint(w, `{"endAt":"2030-01-01T00:00:00Z"}`)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer api.Close()
+	clock := NewFakeClock(time.Now())
+	s, err := NewE2BSandbox(clock, api.URL, "sbx", "", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admit := func(key string) int {
+		r := httptest.NewRequest("GET", "/json/version", nil)
+		r.Header.Set("X-API-Key", key)
+		w := httptest.NewRecorder()
+		s.Admit(w, r)
+		return w.Code
+	}
+
+	if code := admit("owner"); code != http.StatusOK {
+		t.Fatalf("owner key = %d, want 200", code)
+	}
+	for i := range e2bLookupLimit - 1 {
+		if code := admit(fmt.Sprint("stranger", i)); code != http.StatusForbidden {
+			t.Fatalf("unknown key %d = %d, want 403", i, code)
+		}
+	}
+	if code := admit("one too many"); code != http.StatusTooManyRequests {
+		t.Errorf("unknown key past the limit = %d, want 429", code)
+	}
+	if calls != e2bLookupLimit {
+		t.Errorf("E2B API calls = %d, want %d", calls, e2bLookupLimit)
+	}
+	// Cached verdicts are not counted
+	if code := admit("owner"); code != http.StatusOK {
+		t.Errorf("cached owner key = %d, want 200", code)
+	}
+	if code := admit("stranger0"); code != http.StatusForbidden {
+		t.Errorf("cached refused key = %d, want 403", code)
+	}
+
+	clock.Advance(e2bLookupWindow)
+	if code := admit("one too many"); code != http.StatusForbidden {
+		t.Errorf("unknown key in a new window = %d, want 403", code)
+	}
+
+	s.mu.Lock()
+	for i := range e2bMaxVerdicts + 10 {
+		s.remember([32]byte{byte(i), byte(i >> 8), 1}, e2bVerdict{expires: clock.Now().Add(time.Duration(i+1) * time.Second)})
+	}
+	size := len(s.tokens)
+	s.mu.Unlock()
+	if size > e2bMaxVerdicts {
+		t.Errorf("%d verdicts cached, want at most %d", size, e2bMaxVerdicts)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+type evaluateRequest struct {
+	Expression string `json:"expression"`
+	// Wait for a returned promise to settle (default true)
+	AwaitPromise *bool `json:"awaitPromise"`
+	UserGesture  bool  `json:"userGesture"`
+	TimeoutMs    int   `json:"timeoutMs"`
+}
+
+/*
+Handle POST /targets/{id}/evaluate
+Request example:
+
+	{"expression": "document.title", "timeoutMs": 2000}
+
+Runs the expression in the page's main world with Runtime.evaluate and
+returns its value as JSON. Execution is terminated after timeoutMs, at
+most -evaluateTimeout. Values that are not JSON (DOM nodes, functions) are
+returned by type and description; a thrown exception is answered with 422
+and its details. Disabled with -evaluateAPI=false.
+*/
+func (c *ChromeDevToolsClient) handleEvaluate(w http.ResponseWriter, r *http.Request) {
+	if !evaluateAPI {
+		http.Error(w, "Evaluation is disabled (-evaluateAPI=false)", http.StatusNotFound)
+		return
+	}
+	var req evaluateRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Expression == "" {
+		http.Error(w, "expression is required", http.StatusBadRequest)
+		return
+	}
+	targetID := r.PathValue("id")
+	if targetID == browserTargetID {
+		http.Error(w, "evaluate needs a page target", http.StatusBadRequest)
+		return
+	}
+	if !c.allowCommands(w, r, "Runtime.evaluate") {
+		return
+	}
+	timeout := time.Duration(req.TimeoutMs) * time.Millisecond
+	if timeout <= 0 || timeout > evaluateTimeout {
+		timeout = evaluateTimeout
+	}
+	// Chrome's own timeout fires first, so the script is terminated rather
+	// than abandoned
+	deadline := c.apiDeadline(timeout + time.Second/2)
+	timeout = min(timeout, deadline-min(time.Second/2, deadline/4))
+	awaitPromise := req.AwaitPromise == nil || *req.AwaitPromise
+
+	ctx, cancel := context.WithTimeout(r.Context(), deadline)
+	defer cancel()
+	var result struct {
+		Result struct {
+			Type        string          `json:"type"`
+			Subtype     string          `json:"subtype,omitempty"`
+			Value       json.RawMessage `json:"value,omitempty"`
+			Description string          `json:"description,omitempty"`
+		} `json:"result"`
+		ExceptionDetails *struct {
+			Text         string `json:"text"`
+			LineNumber   int    `json:"lineNumber"`
+			ColumnNumber int    `json:"columnNumber"`
+			Exception    *struct {
+				Description string `json:"description"`
+			} `json:"exception"`
+		} `json:"exceptionDetails"`
+	}
+	start := c.clock.Now()
+	err := c.control.WithSession(ctx, targetID, func(conn *CDPConn, sessionID string) error {
+		return conn.CallResult(ctx, sessionID, "Runtime.evaluate", map[string]interface{}{
+			"expression":    req.Expression,
+			"returnByValue": true,
+			"awaitPromise":  awaitPromise,
+			"userGesture":   req.UserGesture,
+			// Chrome terminates the script once this many milliseconds pass
+			"timeout": timeout.Milliseconds(),
+		}, &result)
+	})
+	elapsed := c.clock.Since(start).Milliseconds()
+	if err != nil {
+		c.errorCount++
+		log.Printf("❌ Failed to evaluate in %s: %v", targetID, err)
+		http.Error(w, fmt.Sprintf("Failed to evaluate: %v", err), http.StatusBadGateway)
+		return
+	}
+	log.Printf("🧮 Evaluated %d characters in %s (%dms)", len(req.Expression), c.labels.Describe(targetID), elapsed)
+
+	if details := result.ExceptionDetails; details != nil {
+		exception := map[string]interface{}{
+			"text":         details.Text,
+			"lineNumber":   details.LineNumber,
+			"columnNumber": details.ColumnNumber,
+		}
+		if details.Exception != nil {
+			exception["description"] = details.Exception.Description
+		}
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+			"exception": exception,
+			"elapsedMs": elapsed,
+		})
+		return
+	}
+	response := map[string]interface{}{
+		"type":      result.Result.Type,
+		"elapsedMs": elapsed,
+	}
+	if result.Result.Subtype != "" {
+		response["subtype"] = result.Result.Subtype
+	}
+	if len(result.Result.Value) > 0 {
+		response["value"] = result.Result.Value
+	} else if result.Result.Description != "" {
+		response["description"] = result.Result.Description
+	}
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+Events the proxy emits (the stdout ready line, server-sent events and
+-eventWebhook deliveries) carry schema_version and event fields, and their
+payloads are the structs below.
+
+Compatibility policy: within one schema version, fields are only ever
+added, and consumers must ignore fields they do not know. Removing or
+renaming a field, changing its type or meaning, or making an optional field
+required bumps EventSchemaVersion. GET /events/schemas publishes the
+current JSON schema of every event.
+*/
+const EventSchemaVersion = 1
+
+// EventHeader leads every event payload
+type EventHeader struct {
+	SchemaVersion int    `json:"schema_version"`
+	Event         string `json:"event"`
+}
+
+func newEventHeader(event string) EventHeader {
+	return EventHeader{SchemaVersion: EventSchemaVersion, Event: event}
+}
+
+// ReadyEvent is printed to stdout once the proxy listens
+type ReadyEvent struct {
+	EventHeader
+	Listen  string `json:"listen"`
+	PID     int    `json:"pid"`
+	Version string `json:"version"`
+	Target  string `json:"target"`
+}
+
+// AnomalyEvent is streamed by GET /admin/anomalies
+type AnomalyEvent struct {
+	EventHeader
+	Anomaly
+}
+
+// LeaseQueueEvent is the state of a queued lease, streamed by GET
+// /lease/queue/{ticket} as queued, granted or failed events
+type LeaseQueueEvent struct {
+	EventHeader
+	State    string      `json:"state"`
+	Position *int        `json:"position,omitempty"`
+	Error    string      `json:"error,omitempty"`
+	Lease    *LeaseGrant `json:"lease,omitempty"`
+}
+
+// LeaseGrant describes a leased target
+type LeaseGrant struct {
+	Token                string `json:"token"`
+	TargetID             string `json:"targetId"`
+	WebSocketDebuggerURL string `json:"webSocketDebuggerUrl"`
+	Task                 string `json:"task,omitempty"`
+	SessionID            string `json:"sessionId,omitempty"`
+	Channel              string `json:"channel,omitempty"`
+	Mode                 string `json:"mode,omitempty"`
+	Locale               string `json:"locale,omitempty"`
+}
+
+// SessionClosedEvent is delivered to -eventWebhook when a client WebSocket
+// connection closes, with its traffic totals
+type SessionClosedEvent struct {
+	EventHeader
+	SessionSummary
+}
+
+// LeaseEvent is delivered to -eventWebhook when a reserved target is
+// redeemed (lease.granted) and when it is released or lost
+// (lease.released)
+type LeaseEvent struct {
+	EventHeader
+	Time     time.Time `json:"time"`
+	Token    string    `json:"token"`
+	TargetID string    `json:"targetId"`
+	Task     string    `json:"task,omitempty"`
+	Channel  string    `json:"channel,omitempty"`
+}
+
+func newLeaseEvent(at time.Time, event string, res *Reservation) LeaseEvent {
+	return LeaseEvent{
+		EventHeader: newEventHeader(event),
+		Time:        at,
+		Token:       res.Token,
+		TargetID:    res.TargetID,
+		Task:        res.Task,
+		Channel:     res.Channel,
+	}
+}
+
+// Payload type of each event name
+var eventTypes = map[string]reflect.Type{
+	"ready":   reflect.TypeOf(ReadyEvent{}),
+	"anomaly": reflect.TypeOf(AnomalyEvent{}),
+	"queued":  reflect.TypeOf(LeaseQueueEvent{}),
+	"granted": reflect.TypeOf(LeaseQueueEvent{}),
+	"failed":  reflect.TypeOf(LeaseQueueEvent{}),
+
+	"session.closed": reflect.TypeOf(SessionClosedEvent{}),
+	"lease.granted":  reflect.TypeOf(LeaseEvent{}),
+	"lease.released": reflect.TypeOf(LeaseEvent{}),
+	"page.exception": reflect.TypeOf(PageExceptionEvent{}),
+
+	"request.rejected": reflect.TypeOf(RequestRejectedEvent{}),
+}
+
+// POST an event payload to a webhook, failing unless it answers 2xx
+func postEvent(client *http.Client, url, event, id string, payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-PPIO-Event", event)
+	req.Header.Set("X-PPIO-Event-Id", id)
+	if sandboxID != "" {
+		req.Header.Set("X-PPIO-Sandbox-Id", sandboxID)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+/*
+Handle GET /events/schemas
+Returns {"schemaVersion": N, "events": {"name": <JSON schema>, ...}} with
+a JSON schema (draft 2020-12) per event, generated from the payload structs.
+*/
+func (c *ChromeDevToolsClient) handleEventSchemas(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(eventTypes))
+	for name := range eventTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	events := make(map[string]interface{}, len(names))
+	for _, name := range names {
+		schema := jsonSchema(eventTypes[name])
+		schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+		schema["title"] = name
+		// Unknown fields may appear in later releases of the same version
+		schema["additionalProperties"] = true
+		events[name] = schema
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"schemaVersion": EventSchemaVersion,
+		"events":        events,
+	})
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// JSON schema of a type as encoding/json marshals it
+func jsonSchema(t reflect.Type) map[string]interface{} {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": jsonSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchema(t.Elem())}
+	case reflect.Struct:
+		properties := map[string]interface{}{}
+		required := []string{}
+		addStructFields(t, properties, &required)
+		schema := map[string]interface{}{"type": "object", "properties": properties}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return schema
+	}
+	// interface{} and raw JSON hold any value
+	return map[string]interface{}{}
+}
+
+// Add the JSON fields of struct t, flattening embedded structs like
+// encoding/json does
+func addStructFields(t reflect.Type, properties map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			addStructFields(field.Type, properties, required)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = jsonSchema(field.Type)
+		if !strings.Contains(options, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Exceptions reported per page per minute; a page stuck in an error
+	// loop should not flood the receiver
+	exceptionsPerMinute = 10
+	exceptionQueueSize  = 100
+	exceptionAttempts   = 3
+)
+
+// ExceptionWebhook POSTs the uncaught exceptions of every page
+// (Runtime.exceptionThrown) to -exceptionWebhook as page.exception events,
+// for alerting when the pages agents drive start breaking. Unlike
+// -eventWebhook deliveries these are best effort: they are queued in
+// memory, retried briefly and dropped when the receiver falls behind.
+type ExceptionWebhook struct {
+	url    string
+	client *http.Client
+	clock  Clock
+	queue  chan *PageExceptionEvent
+
+	mu sync.Mutex
+	// Start of the current minute and exceptions reported in it, by target
+	windows map[string]*exceptionWindow
+
+	reported   int64
+	suppressed int64
+	dropped    int64
+	failed     int64
+}
+
+type exceptionWindow struct {
+	start time.Time
+	count int
+}
+
+// PageExceptionEvent is POSTed to -exceptionWebhook for an uncaught
+// exception in a page
+type PageExceptionEvent struct {
+	EventHeader
+	Time     time.Time `json:"time"`
+	TargetID string    `json:"targetId"`
+	// The lease's session and task, from the target's labels
+	SessionID string `json:"sessionId,omitempty"`
+	Task      string `json:"task,omitempty"`
+	// URL of the page's main frame
+	PageURL string `json:"pageUrl"`
+	Message string `json:"message"`
+	// Where the exception was thrown
+	URL        string           `json:"url,omitempty"`
+	Line       int              `json:"line,omitempty"`
+	Column     int              `json:"column,omitempty"`
+	StackTrace []exceptionFrame `json:"stackTrace,omitempty"`
+}
+
+type exceptionFrame struct {
+	FunctionName string `json:"functionName"`
+	URL          string `json:"url"`
+	Line         int    `json:"line"`
+	Column       int    `json:"column"`
+}
+
+func NewExceptionWebhook(url string, clock Clock) *ExceptionWebhook {
+	return &ExceptionWebhook{
+		url:     url,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		clock:   clock,
+		queue:   make(chan *PageExceptionEvent, exceptionQueueSize),
+		windows: make(map[string]*exceptionWindow),
+	}
+}
+
+func (x *ExceptionWebhook) Name() string {
+	return "exception-webhook"
+}
+
+func (x *ExceptionWebhook) Attach(s *PageSession) error {
+	var mu sync.Mutex
+	pageURL := s.Target.URL
+	s.Subscribe(func(msg *CDPMessage) {
+		switch msg.Method {
+		case "Page.frameNavigated":
+			var ev struct {
+				Frame struct {
+					ParentID string `json:"parentId"`
+					URL      string `json:"url"`
+				} `json:"frame"`
+			}
+			if json.Unmarshal(msg.Params, &ev) == nil && ev.Frame.ParentID == "" {
+				mu.Lock()
+				pageURL = ev.Frame.URL
+				mu.Unlock()
+			}
+		case "Runtime.exceptionThrown":
+			mu.Lock()
+			url := pageURL
+			mu.Unlock()
+			x.report(s, url, msg.Params)
+		}
+	})
+	go func() {
+		<-s.Done()
+		x.mu.Lock()
+		delete(x.windows, s.Target.TargetID)
+		x.mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := s.Call(ctx, "Page.enable", nil); err != nil {
+		return err
+	}
+	_, err := s.Call(ctx, "Runtime.enable", nil)
+	return err
+}
+
+func (x *ExceptionWebhook) report(s *PageSession, pageURL string, params json.RawMessage) {
+	var ev struct {
+		Timestamp        float64 `json:"timestamp"`
+		ExceptionDetails struct {
+			Text         string `json:"text"`
+			URL          string `json:"url"`
+			LineNumber   int    `json:"lineNumber"`
+			ColumnNumber int    `json:"columnNumber"`
+			Exception    *struct {
+				Description string `json:"description"`
+			} `json:"exception"`
+			StackTrace *struct {
+				CallFrames []struct {
+					FunctionName string `json:"functionName"`
+					URL          string `json:"url"`
+					LineNumber   int    `json:"lineNumber"`
+					ColumnNumber int    `json:"columnNumber"`
+				} `json:"callFrames"`
+			} `json:"stackTrace"`
+		} `json:"exceptionDetails"`
+	}
+	if json.Unmarshal(params, &ev) != nil {
+		return
+	}
+	targetID := s.Target.TargetID
+	now := x.clock.Now()
+	x.mu.Lock()
+	window := x.windows[targetID]
+	if window == nil || now.Sub(window.start) >= time.Minute {
+		window = &exceptionWindow{start: now}
+		x.windows[targetID] = window
+	}
+	window.count++
+	limited := window.count > exceptionsPerMinute
+	x.mu.Unlock()
+	if limited {
+		atomic.AddInt64(&x.suppressed, 1)
+		return
+	}
+
+	details := ev.ExceptionDetails
+	labels := s.labels.Get(targetID)
+	event := &PageExceptionEvent{
+		EventHeader: newEventHeader("page.exception"),
+		Time:        cdpTimestamp(ev.Timestamp),
+		TargetID:    targetID,
+		SessionID:   labels["session"],
+		Task:        labels["task"],
+		PageURL:     pageURL,
+		Message:     details.Text,
+		URL:         details.URL,
+		// CDP positions are zero-based
+		Line:   details.LineNumber + 1,
+		Column: details.ColumnNumber + 1,
+	}
+	if event.Time.IsZero() {
+		event.Time = now
+	}
+	// The description carries the error class, message and stack as V8
+	// prints them; text is only "Uncaught"
+	if details.Exception != nil && details.Exception.Description != "" {
+		event.Message = details.Exception.Description
+	}
+	if details.StackTrace != nil {
+		for _, frame := range details.StackTrace.CallFrames {
+			event.StackTrace = append(event.StackTrace, exceptionFrame{
+				FunctionName: frame.FunctionName,
+				URL:          frame.URL,
+				Line:         frame.LineNumber + 1,
+				Column:       frame.ColumnNumber + 1,
+			})
+		}
+	}
+	select {
+	case x.queue <- event:
+	default:
+		atomic.AddInt64(&x.dropped, 1)
+	}
+}
+
+// Run delivers queued exceptions until the process exits
+func (x *ExceptionWebhook) Run() {
+	for event := range x.queue {
+		payload, _ := json.Marshal(event)
+		id := newID()
+		var err error
+		for attempt := 1; attempt <= exceptionAttempts; attempt++ {
+			if err = postEvent(x.client, x.url, event.Event, id, payload); err == nil {
+				break
+			}
+			if attempt < exceptionAttempts {
+				<-x.clock.After(time.Duration(attempt) * time.Second)
+			}
+		}
+		if err != nil {
+			atomic.AddInt64(&x.failed, 1)
+			log.Printf("❌ Failed to report exception on %s to %s: %v", event.TargetID, x.url, err)
+			continue
+		}
+		atomic.AddInt64(&x.reported, 1)
+	}
+}
+
+func (x *ExceptionWebhook) Metrics() map[string]interface{} {
+	return map[string]interface{}{
+		"page_exceptions_reported_total":   atomic.LoadInt64(&x.reported),
+		"page_exceptions_suppressed_total": atomic.LoadInt64(&x.suppressed),
+		"page_exceptions_dropped_total":    atomic.LoadInt64(&x.dropped),
+		"page_exceptions_failed_total":     atomic.LoadInt64(&x.failed),
+	}
+}
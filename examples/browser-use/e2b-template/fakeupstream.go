@@ -0,0 +1,426 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A 1x1 transparent PNG, returned for every screenshot
+const fakeScreenshotPNG = "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAQAAAC1HAwCAAAAC0lEQVR42mNkYAAAAAYAAjCB0C8AAAAASUVORK5CYII="
+
+// A minimal PDF, read from every Page.printToPDF stream
+const fakePDF = "%PDF-1.4\n1 0 obj<</Type/Catalog/Pages 2 0 R>>endobj 2 0 obj<</Type/Pages/Kids[]/Count 0>>endobj\ntrailer<</Root 1 0 R>>\n%%EOF\n"
+
+// An empty Chrome trace, read from every Tracing.end stream
+const fakeTrace = `{"traceEvents":[]}`
+
+// Resources every page reports coverage of
+const (
+	fakeScriptURL     = "https://fake.invalid/app.js"
+	fakeStyleSheetURL = "https://fake.invalid/app.css"
+)
+
+// FakeChrome stands in for the browser with -fakeUpstream, so clients can
+// integrate against the proxy's full surface without one. It serves
+// synthetic /json discovery data, starting with one blank page, and a CDP
+// endpoint that keeps the target list, sessions and page URLs consistent,
+// and answers every other command by echoing its params back as the result.
+type FakeChrome struct {
+	hostPort    string
+	browserID   string
+	nextSession int64
+
+	mu      sync.Mutex
+	targets []*fakeTarget
+	// Flattened session id -> target id
+	sessions map[string]string
+}
+
+type fakeTarget struct {
+	ID    string
+	Type  string
+	Title string
+	URL   string
+}
+
+// StartFakeChrome serves a fake browser on a free loopback port
+func StartFakeChrome() (*FakeChrome, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	f := &FakeChrome{
+		hostPort:  ln.Addr().String(),
+		browserID: newUUID(),
+		sessions:  make(map[string]string),
+	}
+	f.addTarget("about:blank")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /json/version", f.handleVersion)
+	mux.HandleFunc("GET /json", f.handleList)
+	mux.HandleFunc("GET /json/list", f.handleList)
+	mux.HandleFunc("GET /json/protocol", f.handleProtocol)
+	mux.HandleFunc("PUT /json/new", f.handleNew)
+	mux.HandleFunc("GET /json/new", f.handleNew)
+	mux.HandleFunc("GET /json/activate/{id}", f.handleActivate)
+	mux.HandleFunc("GET /json/close/{id}", f.handleClose)
+	mux.HandleFunc("GET /devtools/browser/{id}", func(w http.ResponseWriter, r *http.Request) {
+		f.serveCDP(w, r, "")
+	})
+	mux.HandleFunc("GET /devtools/page/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if f.target(r.PathValue("id")) == nil {
+			http.NotFound(w, r)
+			return
+		}
+		f.serveCDP(w, r, r.PathValue("id"))
+	})
+	go http.Serve(ln, mux)
+	return f, nil
+}
+
+func (f *FakeChrome) HostPort() string {
+	return f.hostPort
+}
+
+func (f *FakeChrome) addTarget(url string) *fakeTarget {
+	t := &fakeTarget{ID: strings.ToUpper(newToken()), Type: "page", Title: url, URL: url}
+	f.mu.Lock()
+	f.targets = append(f.targets, t)
+	f.mu.Unlock()
+	return t
+}
+
+func (f *FakeChrome) target(id string) *fakeTarget {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, t := range f.targets {
+		if t.ID == id {
+			return t
+		}
+	}
+	return nil
+}
+
+func (f *FakeChrome) removeTarget(id string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, t := range f.targets {
+		if t.ID == id {
+			f.targets = append(f.targets[:i], f.targets[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// The /json entry of a target, shaped like Chrome's
+func (f *FakeChrome) describe(t *fakeTarget) map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	wsAddress := f.hostPort + "/devtools/page/" + t.ID
+	return map[string]interface{}{
+		"description":          "",
+		"devtoolsFrontendUrl":  "/devtools/inspector.html?ws=" + wsAddress,
+		"id":                   t.ID,
+		"title":                t.Title,
+		"type":                 t.Type,
+		"url":                  t.URL,
+		"webSocketDebuggerUrl": "ws://" + wsAddress,
+	}
+}
+
+func (f *FakeChrome) handleVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"Browser":              "FakeChrome/" + version,
+		"Protocol-Version":     "1.3",
+		"User-Agent":           "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) FakeChrome/" + version,
+		"V8-Version":           "0.0",
+		"WebKit-Version":       "537.36",
+		"webSocketDebuggerUrl": "ws://" + f.hostPort + "/devtools/browser/" + f.browserID,
+	})
+}
+
+func (f *FakeChrome) handleList(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	targets := append([]*fakeTarget(nil), f.targets...)
+	f.mu.Unlock()
+	list := make([]map[string]interface{}, 0, len(targets))
+	for _, t := range targets {
+		list = append(list, f.describe(t))
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (f *FakeChrome) handleProtocol(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"version": map[string]string{"major": "1", "minor": "3"},
+		"domains": []interface{}{},
+	})
+}
+
+// /json/new?<url>, like Chrome's
+func (f *FakeChrome) handleNew(w http.ResponseWriter, r *http.Request) {
+	url := r.URL.RawQuery
+	if url == "" {
+		url = "about:blank"
+	}
+	writeJSON(w, http.StatusOK, f.describe(f.addTarget(url)))
+}
+
+func (f *FakeChrome) handleActivate(w http.ResponseWriter, r *http.Request) {
+	if f.target(r.PathValue("id")) == nil {
+		http.Error(w, "No such target id: "+r.PathValue("id"), http.StatusNotFound)
+		return
+	}
+	fmt.Fprint(w, "Target activated")
+}
+
+func (f *FakeChrome) handleClose(w http.ResponseWriter, r *http.Request) {
+	if !f.removeTarget(r.PathValue("id")) {
+		http.Error(w, "No such target id: "+r.PathValue("id"), http.StatusNotFound)
+		return
+	}
+	fmt.Fprint(w, "Target is closing")
+}
+
+// Accept a CDP WebSocket connection. pageID is the target of a page
+// endpoint, or empty for the browser endpoint.
+func (f *FakeChrome) serveCDP(w http.ResponseWriter, r *http.Request, pageID string) {
+	if !isWebSocketUpgrade(r) {
+		http.Error(w, "WebSocket upgrade expected", http.StatusBadRequest)
+		return
+	}
+	ws, err := AcceptWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+
+	send := func(msg *CDPMessage) {
+		data, _ := json.Marshal(msg)
+		ws.WriteMessage(wsOpText, data)
+	}
+	for {
+		opcode, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		if opcode != wsOpText {
+			continue
+		}
+		var cmd CDPMessage
+		if err := json.Unmarshal(data, &cmd); err != nil || cmd.Method == "" {
+			send(&CDPMessage{Error: &CDPError{Code: -32600, Message: "Message must have a method"}})
+			continue
+		}
+		if cmd.Method == "Browser.crash" {
+			// Drop the connection the way a crashing Chrome does, to
+			// exercise reconnection
+			return
+		}
+		targetID := pageID
+		if cmd.SessionID != "" {
+			f.mu.Lock()
+			id, ok := f.sessions[cmd.SessionID]
+			f.mu.Unlock()
+			if !ok {
+				send(&CDPMessage{ID: cmd.ID, SessionID: cmd.SessionID, Error: &CDPError{Code: -32001, Message: "Session with given id not found."}})
+				continue
+			}
+			targetID = id
+		}
+		result, events, cdpErr := f.call(&cmd, targetID)
+		resp := &CDPMessage{ID: cmd.ID, SessionID: cmd.SessionID, Error: cdpErr}
+		if cdpErr == nil {
+			resp.Result, _ = json.Marshal(result)
+		}
+		send(resp)
+		for _, ev := range events {
+			send(ev)
+		}
+	}
+}
+
+// Answer one command on targetID's session (empty for the browser). The
+// returned events are sent after the response.
+func (f *FakeChrome) call(cmd *CDPMessage, targetID string) (interface{}, []*CDPMessage, *CDPError) {
+	var params struct {
+		TargetID   string `json:"targetId"`
+		SessionID  string `json:"sessionId"`
+		URL        string `json:"url"`
+		Handle     string `json:"handle"`
+		Selector   string `json:"selector"`
+		Expression string `json:"expression"`
+	}
+	json.Unmarshal(cmd.Params, &params)
+	event := func(method string, sessionID string, p interface{}) *CDPMessage {
+		data, _ := json.Marshal(p)
+		return &CDPMessage{Method: method, SessionID: sessionID, Params: data}
+	}
+	noTarget := &CDPError{Code: -32602, Message: "No target with given id found"}
+
+	switch cmd.Method {
+	case "Browser.getVersion":
+		return map[string]string{
+			"protocolVersion": "1.3",
+			"product":         "FakeChrome/" + version,
+			"revision":        "0",
+			"userAgent":       "FakeChrome/" + version,
+			"jsVersion":       "0.0",
+		}, nil, nil
+	case "Target.getTargets":
+		f.mu.Lock()
+		infos := make([]map[string]interface{}, 0, len(f.targets))
+		for _, t := range f.targets {
+			infos = append(infos, map[string]interface{}{"targetId": t.ID, "type": t.Type, "title": t.Title, "url": t.URL, "attached": false})
+		}
+		f.mu.Unlock()
+		return map[string]interface{}{"targetInfos": infos}, nil, nil
+	case "Target.getTargetInfo":
+		if params.TargetID == "" {
+			return map[string]interface{}{"targetInfo": map[string]interface{}{"targetId": f.browserID, "type": "browser", "title": "", "url": "", "attached": true}}, nil, nil
+		}
+		t := f.target(params.TargetID)
+		if t == nil {
+			return nil, nil, noTarget
+		}
+		return map[string]interface{}{"targetInfo": map[string]interface{}{"targetId": t.ID, "type": t.Type, "title": t.Title, "url": t.URL, "attached": false}}, nil, nil
+	case "Target.createTarget":
+		url := params.URL
+		if url == "" {
+			url = "about:blank"
+		}
+		return map[string]string{"targetId": f.addTarget(url).ID}, nil, nil
+	case "Target.closeTarget":
+		if !f.removeTarget(params.TargetID) {
+			return nil, nil, noTarget
+		}
+		return map[string]bool{"success": true}, nil, nil
+	case "Target.activateTarget":
+		if f.target(params.TargetID) == nil {
+			return nil, nil, noTarget
+		}
+		return map[string]interface{}{}, nil, nil
+	case "Target.attachToTarget":
+		t := f.target(params.TargetID)
+		if t == nil {
+			return nil, nil, noTarget
+		}
+		sessionID := fmt.Sprintf("FAKE%016X", atomic.AddInt64(&f.nextSession, 1))
+		f.mu.Lock()
+		f.sessions[sessionID] = t.ID
+		f.mu.Unlock()
+		attached := event("Target.attachedToTarget", cmd.SessionID, map[string]interface{}{
+			"sessionId":          sessionID,
+			"targetInfo":         map[string]interface{}{"targetId": t.ID, "type": t.Type, "title": t.Title, "url": t.URL, "attached": true},
+			"waitingForDebugger": false,
+		})
+		return map[string]string{"sessionId": sessionID}, []*CDPMessage{attached}, nil
+	case "Target.detachFromTarget":
+		f.mu.Lock()
+		id, ok := f.sessions[params.SessionID]
+		delete(f.sessions, params.SessionID)
+		f.mu.Unlock()
+		if !ok {
+			return nil, nil, &CDPError{Code: -32602, Message: "No session with given id"}
+		}
+		detached := event("Target.detachedFromTarget", cmd.SessionID, map[string]string{"sessionId": params.SessionID, "targetId": id})
+		return map[string]interface{}{}, []*CDPMessage{detached}, nil
+	case "Browser.getWindowForTarget":
+		return map[string]interface{}{
+			"windowId": 1,
+			"bounds":   map[string]interface{}{"left": 0, "top": 0, "width": 1280, "height": 720, "windowState": "normal"},
+		}, nil, nil
+	case "Page.navigate":
+		t := f.target(targetID)
+		if t == nil {
+			return nil, nil, &CDPError{Code: -32601, Message: "'Page.navigate' wasn't found"}
+		}
+		f.mu.Lock()
+		t.URL, t.Title = params.URL, params.URL
+		f.mu.Unlock()
+		timestamp := map[string]float64{"timestamp": float64(time.Now().UnixNano()) / 1e9}
+		domReady := event("Page.domContentEventFired", cmd.SessionID, timestamp)
+		loaded := event("Page.loadEventFired", cmd.SessionID, timestamp)
+		return map[string]string{"frameId": t.ID, "loaderId": strings.ToUpper(newToken())}, []*CDPMessage{domReady, loaded}, nil
+	case "Page.getFrameTree":
+		t := f.target(targetID)
+		if t == nil {
+			return nil, nil, &CDPError{Code: -32601, Message: "'Page.getFrameTree' wasn't found"}
+		}
+		f.mu.Lock()
+		frame := map[string]string{"id": t.ID, "loaderId": t.ID, "url": t.URL, "securityOrigin": "://", "mimeType": "text/html"}
+		f.mu.Unlock()
+		return map[string]interface{}{"frameTree": map[string]interface{}{"frame": frame}}, nil, nil
+	case "Page.captureScreenshot":
+		return map[string]string{"data": fakeScreenshotPNG}, nil, nil
+	case "Page.printToPDF":
+		return map[string]string{"stream": "fake-pdf"}, nil, nil
+	case "IO.read":
+		if params.Handle == "fake-trace" {
+			return map[string]interface{}{"data": fakeTrace, "eof": true}, nil, nil
+		}
+		return map[string]interface{}{"data": base64.StdEncoding.EncodeToString([]byte(fakePDF)), "base64Encoded": true, "eof": true}, nil, nil
+	case "Tracing.end":
+		return map[string]interface{}{}, []*CDPMessage{event("Tracing.tracingComplete", cmd.SessionID, map[string]interface{}{"dataLossOccurred": false, "stream": "fake-trace"})}, nil
+	case "CSS.enable":
+		header := map[string]interface{}{"styleSheetId": "fake-sheet", "sourceURL": fakeStyleSheetURL, "isInline": false, "startLine": 0, "startColumn": 0, "length": 100}
+		return map[string]interface{}{}, []*CDPMessage{event("CSS.styleSheetAdded", cmd.SessionID, map[string]interface{}{"header": header})}, nil
+	case "CSS.takeCoverageDelta":
+		return map[string]interface{}{"coverage": []interface{}{}, "timestamp": 0}, nil, nil
+	case "CSS.stopRuleUsageTracking":
+		usage := []map[string]interface{}{{"styleSheetId": "fake-sheet", "startOffset": 0, "endOffset": 40, "used": true}}
+		return map[string]interface{}{"ruleUsage": usage}, nil, nil
+	case "Profiler.takePreciseCoverage":
+		// A 100-byte script whose first half ran
+		ranges := []map[string]int{{"startOffset": 0, "endOffset": 100, "count": 1}, {"startOffset": 50, "endOffset": 100, "count": 0}}
+		script := map[string]interface{}{"scriptId": "1", "url": fakeScriptURL, "functions": []interface{}{map[string]interface{}{"functionName": "", "ranges": ranges, "isBlockCoverage": true}}}
+		return map[string]interface{}{"result": []interface{}{script}, "timestamp": 0}, nil, nil
+	case "DOM.getDocument":
+		return map[string]interface{}{"root": map[string]interface{}{"nodeId": 1, "nodeName": "#document"}}, nil, nil
+	case "DOM.querySelector":
+		// Every selector but #missing matches
+		if params.Selector == "#missing" {
+			return map[string]int{"nodeId": 0}, nil, nil
+		}
+		return map[string]int{"nodeId": 2}, nil, nil
+	case "Runtime.evaluate":
+		// Fake pages are always loaded
+		if params.Expression == `document.readyState === "complete"` {
+			return map[string]interface{}{"result": map[string]interface{}{"type": "boolean", "value": true}}, nil, nil
+		}
+		return map[string]interface{}{"result": map[string]string{"type": "undefined"}}, nil, nil
+	case "Storage.getCookies", "Network.getCookies", "Network.getAllCookies":
+		return map[string]interface{}{"cookies": []interface{}{}}, nil, nil
+	}
+
+	// Everything else succeeds and echoes its params
+	if len(cmd.Params) == 0 {
+		return map[string]interface{}{}, nil, nil
+	}
+	return cmd.Params, nil, nil
+}
+
+// Start the fake browser and point the proxy at it
+func startFakeUpstream() {
+	if chromeBinary != "" {
+		log.Fatalf("❌ -fakeUpstream cannot be combined with -chromeBinary")
+	}
+	fake, err := StartFakeChrome()
+	if err != nil {
+		log.Fatalf("❌ Failed to start fake upstream: %v", err)
+	}
+	_, port, _ := net.SplitHostPort(fake.HostPort())
+	targetPort, _ = strconv.Atoi(port)
+	log.Printf("🎭 Dry run: serving a fake Chrome on %s, no browser is used", fake.HostPort())
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Feature is an experimental subsystem that ships dark (or on, while it is
+// still easy to turn off) and is switched per sandbox with -features
+type Feature struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Default     bool   `json:"default"`
+	Enabled     bool   `json:"enabled"`
+}
+
+var features = map[string]*Feature{}
+
+func registerFeature(name, description string, enabled bool) {
+	features[name] = &Feature{Name: name, Description: description, Default: enabled, Enabled: enabled}
+}
+
+func init() {
+	registerFeature("relay-inspection", "Parse relayed client CDP traffic for task usage and GET /sessions (commands, events and bytes per connection); anomaly detection taps connections regardless", true)
+}
+
+// featureEnabled reports whether a registered feature is on
+func featureEnabled(name string) bool {
+	f, ok := features[name]
+	return ok && f.Enabled
+}
+
+// Apply -features: "a,b" enables a and b, "-a" disables a
+func setFeatures(spec string) error {
+	for _, item := range splitList(spec) {
+		name, enabled := strings.TrimPrefix(item, "-"), !strings.HasPrefix(item, "-")
+		f, ok := features[name]
+		if !ok {
+			return fmt.Errorf("unknown feature %q, expected one of %s", name, strings.Join(featureNames(), ", "))
+		}
+		f.Enabled = enabled
+	}
+	return nil
+}
+
+func featureNames() []string {
+	names := make([]string, 0, len(features))
+	for name := range features {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Features in name order, for /version and /admin/config
+func featureList() []Feature {
+	list := make([]Feature, 0, len(features))
+	for _, name := range featureNames() {
+		list = append(list, *features[name])
+	}
+	return list
+}
+
+// Handle GET /version, the proxy's own build and feature flags
+func (c *ChromeDevToolsClient) handleVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"version":  version,
+		"features": featureList(),
+	})
+}
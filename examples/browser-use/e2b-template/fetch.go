@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// FetchRequestPaused holds the fields of Fetch.requestPaused the proxy uses
+type FetchRequestPaused struct {
+	RequestID string `json:"requestId"`
+	Request   struct {
+		URL     string            `json:"url"`
+		Method  string            `json:"method"`
+		Headers map[string]string `json:"headers"`
+	} `json:"request"`
+	ResourceType        string `json:"resourceType"`
+	NetworkID           string `json:"networkId"`
+	ResponseErrorReason string `json:"responseErrorReason"`
+	ResponseStatusCode  int    `json:"responseStatusCode"`
+	ResponseHeaders     []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	} `json:"responseHeaders"`
+}
+
+// IsResponseStage reports whether the request was paused after the response
+// headers arrived rather than before it was sent
+func (e *FetchRequestPaused) IsResponseStage() bool {
+	return e.ResponseStatusCode != 0 || e.ResponseErrorReason != ""
+}
+
+// FetchHandler inspects paused requests. Returning true means the handler
+// has resolved the request itself (failed, fulfilled, continued).
+type FetchHandler interface {
+	HandleRequestPaused(ctx context.Context, s *PageSession, ev *FetchRequestPaused) bool
+}
+
+// FetchResponseHandler is implemented by handlers that also need requests
+// paused at the response stage, for URLs matching the returned patterns
+type FetchResponseHandler interface {
+	FetchHandler
+	ResponsePatterns() []string
+}
+
+// FetchInterceptor is the single owner of the Fetch domain on each page
+// session. Handlers run in registration order; requests nobody resolved are
+// continued unchanged.
+type FetchInterceptor struct {
+	handlers []FetchHandler
+}
+
+func NewFetchInterceptor() *FetchInterceptor {
+	return &FetchInterceptor{}
+}
+
+func (f *FetchInterceptor) Register(h FetchHandler) {
+	f.handlers = append(f.handlers, h)
+}
+
+func (f *FetchInterceptor) Enabled() bool {
+	return len(f.handlers) > 0
+}
+
+func (f *FetchInterceptor) Name() string {
+	return "fetch-interceptor"
+}
+
+func (f *FetchInterceptor) Attach(s *PageSession) error {
+	s.Subscribe(func(msg *CDPMessage) {
+		if msg.Method != "Fetch.requestPaused" {
+			return
+		}
+		var ev FetchRequestPaused
+		if err := json.Unmarshal(msg.Params, &ev); err != nil {
+			return
+		}
+		go f.handle(s, &ev)
+	})
+
+	patterns := []map[string]interface{}{{"urlPattern": "*", "requestStage": "Request"}}
+	for _, h := range f.handlers {
+		if rh, ok := h.(FetchResponseHandler); ok {
+			for _, p := range rh.ResponsePatterns() {
+				patterns = append(patterns, map[string]interface{}{"urlPattern": p, "requestStage": "Response"})
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := s.Call(ctx, "Fetch.enable", map[string]interface{}{"patterns": patterns})
+	return err
+}
+
+func (f *FetchInterceptor) handle(s *PageSession, ev *FetchRequestPaused) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, h := range f.handlers {
+		if h.HandleRequestPaused(ctx, s, ev) {
+			return
+		}
+	}
+
+	if ev.IsResponseStage() {
+		s.Call(ctx, "Fetch.continueResponse", map[string]interface{}{"requestId": ev.RequestID})
+	} else {
+		s.Call(ctx, "Fetch.continueRequest", map[string]interface{}{"requestId": ev.RequestID})
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A file uploaded to POST /targets/{id}/upload, as written in the sandbox
+type uploadedFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	Path string `json:"path"`
+}
+
+// Write the files of a multipart form field to a new directory under
+// -fileInputDir, keeping their names, which the page sees
+func saveFileInputs(headers []*multipart.FileHeader) ([]uploadedFile, error) {
+	if err := os.MkdirAll(fileInputDir, 0o755); err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(fileInputDir, "upload-")
+	if err != nil {
+		return nil, err
+	}
+	// Chrome only takes absolute paths
+	if dir, err = filepath.Abs(dir); err != nil {
+		return nil, err
+	}
+	var files []uploadedFile
+	used := make(map[string]bool)
+	for _, header := range headers {
+		base := downloadFileName(filepath.Base(header.Filename), "file")
+		ext := filepath.Ext(base)
+		name := base
+		for i := 1; used[name]; i++ {
+			name = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(base, ext), i, ext)
+		}
+		used[name] = true
+		path := filepath.Join(dir, name)
+		size, err := saveFileInput(header, path)
+		if err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+		files = append(files, uploadedFile{Name: name, Size: size, Path: path})
+	}
+	return files, nil
+}
+
+func saveFileInput(header *multipart.FileHeader, path string) (int64, error) {
+	src, err := header.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
+
+/*
+Handle POST /targets/{id}/upload
+Multipart form with a "selector" field and one or more "file" parts:
+
+	curl -F selector='input[type=file]' -F file=@report.pdf http://<sandbox>:9223/targets/<id>/upload
+
+Writes the files under -fileInputDir and attaches them to the first element
+matching the selector with DOM.setFileInputFiles, as if the user had picked
+them, so agents can drive upload forms without access to the sandbox's
+filesystem. Answers 404 when nothing matches the selector and 400 when
+Chrome rejects the element (not a file input, multiple files on a single
+file input).
+*/
+func (c *ChromeDevToolsClient) handleUploadFile(w http.ResponseWriter, r *http.Request) {
+	targetID := r.PathValue("id")
+	if targetID == browserTargetID {
+		http.Error(w, "upload needs a page target", http.StatusBadRequest)
+		return
+	}
+	// Checked before anything is written to disk
+	if !c.allowCommands(w, r, "DOM.getDocument", "DOM.querySelector", "DOM.setFileInputFiles") {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, fileInputMaxBytes)
+	// Parts beyond 32 MB spill to temporary files
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("upload exceeds %d bytes (-fileInputMaxBytes)", fileInputMaxBytes), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, fmt.Sprintf("invalid multipart form: %v", err), http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	selector := r.FormValue("selector")
+	if selector == "" {
+		http.Error(w, "selector is required", http.StatusBadRequest)
+		return
+	}
+	headers := r.MultipartForm.File["file"]
+	if len(headers) == 0 {
+		http.Error(w, "no file part in the form", http.StatusBadRequest)
+		return
+	}
+
+	files, err := saveFileInputs(headers)
+	if err != nil {
+		c.errorCount++
+		log.Printf("❌ Failed to save uploaded files: %v", err)
+		http.Error(w, fmt.Sprintf("Failed to save uploaded files: %v", err), http.StatusInternalServerError)
+		return
+	}
+	paths := make([]string, len(files))
+	for i, file := range files {
+		paths[i] = file.Path
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), c.client.Timeout)
+	defer cancel()
+	found, rejected := true, false
+	err = c.control.WithSession(ctx, targetID, func(conn *CDPConn, sessionID string) error {
+		var doc struct {
+			Root struct {
+				NodeID int `json:"nodeId"`
+			} `json:"root"`
+		}
+		if err := conn.CallResult(ctx, sessionID, "DOM.getDocument", map[string]interface{}{"depth": 0}, &doc); err != nil {
+			return err
+		}
+		var node struct {
+			NodeID int `json:"nodeId"`
+		}
+		err := conn.CallResult(ctx, sessionID, "DOM.querySelector", map[string]interface{}{"nodeId": doc.Root.NodeID, "selector": selector}, &node)
+		if err == nil && node.NodeID == 0 {
+			found = false
+			return fmt.Errorf("no element matches %s", selector)
+		}
+		if err == nil {
+			_, err = conn.Call(ctx, sessionID, "DOM.setFileInputFiles", map[string]interface{}{"nodeId": node.NodeID, "files": paths})
+		}
+		var cdpErr *CDPError
+		rejected = errors.As(err, &cdpErr)
+		return err
+	})
+	if err != nil {
+		// The page never got the files
+		os.RemoveAll(filepath.Dir(paths[0]))
+	}
+	switch {
+	case err == nil:
+	case !found:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case rejected:
+		http.Error(w, fmt.Sprintf("Failed to attach files: %v", err), http.StatusBadRequest)
+		return
+	default:
+		c.errorCount++
+		log.Printf("❌ Failed to attach files to %s: %v", targetID, err)
+		http.Error(w, fmt.Sprintf("Failed to attach files: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	log.Printf("📎 Attached %d files to %s on %s", len(files), selector, c.labels.Describe(targetID))
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"selector": selector,
+		"files":    files,
+	})
+}
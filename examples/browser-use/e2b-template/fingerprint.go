@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// ClientInfo is the SDK a client connection was classified as
+type ClientInfo struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	// What the classification is based on: "user-agent" or "handshake"
+	Source string `json:"source"`
+}
+
+func (c *ClientInfo) String() string {
+	if c.Version == "" {
+		return c.Name
+	}
+	return c.Name + "/" + c.Version
+}
+
+// User-Agent patterns of known CDP clients, most specific first. The first
+// submatch is the version.
+var clientUserAgents = []struct {
+	name    string
+	pattern *regexp.Regexp
+}{
+	// This binary's own cdp, conformance and soak subcommands
+	{"reverse-proxy", regexp.MustCompile(`^reverse-proxy/([\w.+-]+)`)},
+	{"browser-use", regexp.MustCompile(`(?i)\bbrowser-use/([\w.+-]+)`)},
+	{"puppeteer", regexp.MustCompile(`\bPuppeteer[ /]([\w.+-]+)`)},
+	{"playwright-python", regexp.MustCompile(`\bPlaywright/([\w.+-]+) .*\bpython/`)},
+	{"playwright-java", regexp.MustCompile(`\bPlaywright/([\w.+-]+) .*\bjava/`)},
+	{"playwright-dotnet", regexp.MustCompile(`\bPlaywright/([\w.+-]+) .*(?:csharp|\.net)/`)},
+	{"playwright", regexp.MustCompile(`\bPlaywright/([\w.+-]+)`)},
+	{"chromedp", regexp.MustCompile(`(?i)\bchromedp(?:/([\w.+-]+))?`)},
+	{"python-websockets", regexp.MustCompile(`\bPython/[\d.]+ websockets/([\w.+-]+)`)},
+	{"python-aiohttp", regexp.MustCompile(`\bPython/[\d.]+ aiohttp/([\w.+-]+)`)},
+	{"go", regexp.MustCompile(`\bGo-http-client/([\d.]+)`)},
+	{"devtools-frontend", regexp.MustCompile(`\bMozilla/5\.0 .*\bChrome/([\d.]+)`)},
+}
+
+// classifyClient identifies the SDK behind a WebSocket upgrade request from
+// its User-Agent or, when it sends none, from the shape of its handshake
+func classifyClient(r *http.Request) *ClientInfo {
+	ua := r.UserAgent()
+	for _, c := range clientUserAgents {
+		if m := c.pattern.FindStringSubmatch(ua); m != nil {
+			return &ClientInfo{Name: c.name, Version: m[1], Source: "user-agent"}
+		}
+	}
+	if ua != "" {
+		return &ClientInfo{Name: "other", Source: "user-agent"}
+	}
+
+	// No User-Agent: older Puppeteer and chromedp. Node's ws library offers
+	// compression with client_max_window_bits; gobwas/ws (chromedp) sends
+	// no extensions and no Origin.
+	extensions := r.Header.Get("Sec-WebSocket-Extensions")
+	switch {
+	case strings.Contains(extensions, "permessage-deflate") && strings.Contains(extensions, "client_max_window_bits"):
+		return &ClientInfo{Name: "node-ws", Source: "handshake"}
+	case extensions == "" && r.Header.Get("Origin") == "":
+		return &ClientInfo{Name: "chromedp", Source: "handshake"}
+	}
+	return &ClientInfo{Name: "unknown", Source: "handshake"}
+}
+
+// ClientCensus counts client connections by SDK and version
+type ClientCensus struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func NewClientCensus() *ClientCensus {
+	return &ClientCensus{counts: make(map[string]int64)}
+}
+
+// Observe classifies and counts an upgrade request
+func (c *ClientCensus) Observe(r *http.Request) *ClientInfo {
+	info := classifyClient(r)
+	c.mu.Lock()
+	c.counts[info.String()]++
+	c.mu.Unlock()
+	return info
+}
+
+func (c *ClientCensus) Metrics() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := make(map[string]int64, len(c.counts))
+	for k, n := range c.counts {
+		counts[k] = n
+	}
+	return map[string]interface{}{
+		"client_connections_by_sdk": counts,
+	}
+}
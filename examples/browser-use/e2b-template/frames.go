@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// How long to keep collecting OOPIF attach events once they stop arriving
+const frameAttachQuiet = 200 * time.Millisecond
+
+// frameNode is one frame in a page's frame tree. Out-of-process iframes
+// carry the target id and public WebSocket URL clients use to drive them.
+type frameNode struct {
+	ID                   string       `json:"id"`
+	ParentID             string       `json:"parentId,omitempty"`
+	URL                  string       `json:"url"`
+	Name                 string       `json:"name,omitempty"`
+	SecurityOrigin       string       `json:"securityOrigin,omitempty"`
+	OutOfProcess         bool         `json:"outOfProcess,omitempty"`
+	TargetID             string       `json:"targetId,omitempty"`
+	WebSocketDebuggerURL string       `json:"webSocketDebuggerUrl,omitempty"`
+	Children             []*frameNode `json:"children,omitempty"`
+}
+
+// cdpFrameTree mirrors CDP Page.FrameTree
+type cdpFrameTree struct {
+	Frame struct {
+		ID             string `json:"id"`
+		ParentID       string `json:"parentId"`
+		URL            string `json:"url"`
+		Name           string `json:"name"`
+		SecurityOrigin string `json:"securityOrigin"`
+	} `json:"frame"`
+	ChildFrames []cdpFrameTree `json:"childFrames"`
+}
+
+func (t cdpFrameTree) node() *frameNode {
+	n := &frameNode{
+		ID:             t.Frame.ID,
+		ParentID:       t.Frame.ParentID,
+		URL:            t.Frame.URL,
+		Name:           t.Frame.Name,
+		SecurityOrigin: t.Frame.SecurityOrigin,
+	}
+	for _, child := range t.ChildFrames {
+		n.Children = append(n.Children, child.node())
+	}
+	return n
+}
+
+func (n *frameNode) index(byID map[string]*frameNode) {
+	byID[n.ID] = n
+	for _, child := range n.Children {
+		child.index(byID)
+	}
+}
+
+// Graft an OOPIF subtree into the tree, replacing the placeholder frame the
+// parent process reports for it
+func (n *frameNode) graft(sub *frameNode) {
+	byID := make(map[string]*frameNode)
+	n.index(byID)
+	if existing, ok := byID[sub.ID]; ok {
+		*existing = *sub
+	} else if parent, ok := byID[sub.ParentID]; ok {
+		parent.Children = append(parent.Children, sub)
+	} else {
+		n.Children = append(n.Children, sub)
+	}
+}
+
+func getFrameTree(ctx context.Context, conn *CDPConn, sessionID string) (*frameNode, error) {
+	var result struct {
+		FrameTree cdpFrameTree `json:"frameTree"`
+	}
+	if err := conn.CallResult(ctx, sessionID, "Page.getFrameTree", nil, &result); err != nil {
+		return nil, err
+	}
+	return result.FrameTree.node(), nil
+}
+
+// Build the full frame tree of a page, attaching to its out-of-process
+// iframes (recursively) to read their subtrees
+func (c *ChromeDevToolsClient) collectFrames(ctx context.Context, publicHost, targetID string) (*frameNode, error) {
+	var tree *frameNode
+	err := c.control.WithSession(ctx, targetID, func(conn *CDPConn, sessionID string) error {
+		type oopif struct {
+			sessionID string
+			info      TargetInfo
+		}
+		ours := map[string]bool{sessionID: true}
+		attached := make(chan oopif, 16)
+		unsubscribe := conn.Subscribe(func(msg *CDPMessage) {
+			if msg.Method != "Target.attachedToTarget" || !ours[msg.SessionID] {
+				return
+			}
+			var params struct {
+				SessionID  string     `json:"sessionId"`
+				TargetInfo TargetInfo `json:"targetInfo"`
+			}
+			json.Unmarshal(msg.Params, &params)
+			if params.TargetInfo.Type == "iframe" {
+				ours[params.SessionID] = true
+				select {
+				case attached <- oopif{params.SessionID, params.TargetInfo}:
+				default:
+				}
+			}
+		})
+		defer unsubscribe()
+
+		autoAttach := func(sid string) error {
+			_, err := conn.Call(ctx, sid, "Target.setAutoAttach", map[string]interface{}{
+				"autoAttach":             true,
+				"waitForDebuggerOnStart": false,
+				"flatten":                true,
+			})
+			return err
+		}
+
+		var err error
+		if tree, err = getFrameTree(ctx, conn, sessionID); err != nil {
+			return err
+		}
+		if err := autoAttach(sessionID); err != nil {
+			return err
+		}
+		for {
+			select {
+			case child := <-attached:
+				sub, err := getFrameTree(ctx, conn, child.sessionID)
+				if err != nil {
+					log.Printf("⚠️ Failed to read frame tree of OOPIF %s: %v", child.info.TargetID, err)
+					continue
+				}
+				sub.OutOfProcess = true
+				sub.TargetID = child.info.TargetID
+				sub.WebSocketDebuggerURL = c.publicPageURL(publicHost, child.info.TargetID)
+				tree.graft(sub)
+				// Without it frames nested in the OOPIF are missing
+				if err := autoAttach(child.sessionID); err != nil {
+					log.Printf("⚠️ Failed to attach to frames nested in OOPIF %s: %v", child.info.TargetID, err)
+				}
+			case <-c.clock.After(frameAttachQuiet):
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	})
+	return tree, err
+}
+
+/*
+Handle GET /targets/{id}/frames
+Returns the page's frame tree including out-of-process iframes. OOPIF nodes
+include a targetId and webSocketDebuggerUrl so clients can drive embedded
+frames (e.g. checkout iframes) directly.
+*/
+func (c *ChromeDevToolsClient) handleGetFrames(w http.ResponseWriter, r *http.Request) {
+	if !profile.FrameInspection {
+		http.Error(w, fmt.Sprintf("frame inspection is disabled by -profile %s", profile.Name), http.StatusNotFound)
+		return
+	}
+	if !c.allowCommands(w, r, "Page.getFrameTree", "Target.setAutoAttach") {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), c.client.Timeout)
+	defer cancel()
+
+	tree, err := c.collectFrames(ctx, r.Host, r.PathValue("id"))
+	if err != nil {
+		c.errorCount++
+		log.Printf("❌ Failed to get frames of %s: %v", r.PathValue("id"), err)
+		http.Error(w, fmt.Sprintf("Failed to get frames: %v", err), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, http.StatusOK, tree)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// GatewayCheck periodically reaches the proxy through its public URL
+// (-gatewayURL), i.e. through the E2B gateway, and verifies the path clients
+// take end to end: /json/version answers, its WebSocket URL is rewritten to
+// the public host, the upgrade goes through and a command round-trips.
+// /health reports Chrome; this reports whether clients can get to it.
+type GatewayCheck struct {
+	clock    Clock
+	base     string
+	host     string
+	interval time.Duration
+	timeout  time.Duration
+	client   *http.Client
+
+	mu       sync.Mutex
+	last     *gatewayResult
+	failures int
+
+	checks int64
+	failed int64
+}
+
+type gatewayResult struct {
+	OK        bool      `json:"ok"`
+	CheckedAt time.Time `json:"checkedAt"`
+	LatencyMs int64     `json:"latencyMs"`
+	// The step that failed: version, rewrite, upgrade or command
+	Stage string `json:"stage,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+func NewGatewayCheck(clock Clock, publicURL string, interval, timeout time.Duration) (*GatewayCheck, error) {
+	base := strings.TrimSuffix(publicURL, "/")
+	u, err := url.Parse(base)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("-gatewayURL %q is not an http or https URL", publicURL)
+	}
+	return &GatewayCheck{
+		clock:    clock,
+		base:     base,
+		host:     u.Host,
+		interval: interval,
+		timeout:  timeout,
+		client:   &http.Client{Timeout: timeout},
+	}, nil
+}
+
+// Run checks the path every interval until the process exits, starting
+// one interval in so that the server is listening
+func (g *GatewayCheck) Run() {
+	for {
+		<-g.clock.After(g.interval)
+		g.Check()
+	}
+}
+
+func (g *GatewayCheck) Check() *gatewayResult {
+	start := g.clock.Now()
+	stage, err := g.probe()
+	result := &gatewayResult{OK: err == nil, CheckedAt: start, LatencyMs: g.clock.Since(start).Milliseconds()}
+	atomic.AddInt64(&g.checks, 1)
+
+	g.mu.Lock()
+	wasFailing := g.failures > 0
+	if err != nil {
+		result.Stage, result.Error = stage, err.Error()
+		g.failures++
+		atomic.AddInt64(&g.failed, 1)
+	} else {
+		g.failures = 0
+	}
+	g.last = result
+	failures := g.failures
+	g.mu.Unlock()
+
+	switch {
+	case err != nil && failures == 1:
+		log.Printf("🌉 Gateway path to %s failed at %s: %v", g.base, stage, err)
+	case err == nil && wasFailing:
+		log.Printf("🌉 Gateway path to %s recovered", g.base)
+	}
+	return result
+}
+
+// Walk the client path, returning the stage that failed
+func (g *GatewayCheck) probe() (string, error) {
+	req, err := http.NewRequest(http.MethodGet, g.base+"/json/version", nil)
+	if err != nil {
+		return "version", err
+	}
+	if e2bAdmission && e2bAPIKey != "" {
+		req.Header.Set("X-API-Key", e2bAPIKey)
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return "version", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "version", fmt.Errorf("GET /json/version: %s", resp.Status)
+	}
+	var version struct {
+		WebSocketURL string `json:"webSocketDebuggerUrl"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&version); err != nil {
+		return "version", err
+	}
+	if version.WebSocketURL == "" {
+		return "rewrite", errors.New("no webSocketDebuggerUrl in /json/version")
+	}
+	// The same rule the conformance suite applies to handed-out URLs
+	suite := &conformanceSuite{base: g.base, host: g.host, timeout: g.timeout}
+	if err := suite.checkPublicURL("webSocketDebuggerUrl", version.WebSocketURL); err != nil {
+		return "rewrite", err
+	}
+
+	wsURL := version.WebSocketURL
+	if e2bAdmission && e2bAPIKey != "" {
+		u, _ := url.Parse(wsURL)
+		q := u.Query()
+		q.Set("e2bKey", e2bAPIKey)
+		u.RawQuery = q.Encode()
+		wsURL = u.String()
+	}
+	conn, err := suite.dial(wsURL)
+	if err != nil {
+		return "upgrade", err
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), g.timeout)
+	defer cancel()
+	if _, err := conn.Call(ctx, "", "Browser.getVersion", nil); err != nil {
+		return "command", err
+	}
+	return "", nil
+}
+
+// Latest result, nil before the first check finishes
+func (g *GatewayCheck) Status() *gatewayResult {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.last
+}
+
+/*
+Handle GET /health/gateway
+Runs a check through the gateway now and answers 200 when the path works
+or 503 with the failed stage, for monitors that alert on client
+reachability apart from Chrome's health.
+*/
+func (c *ChromeDevToolsClient) handleGatewayHealth(w http.ResponseWriter, r *http.Request) {
+	if c.gateway == nil {
+		http.Error(w, "Gateway self-check is disabled (set -gatewayURL)", http.StatusNotFound)
+		return
+	}
+	result := c.gateway.Check()
+	code := http.StatusOK
+	if !result.OK {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, map[string]interface{}{
+		"url":    c.gateway.base,
+		"result": result,
+	})
+}
+
+func (g *GatewayCheck) Metrics() map[string]interface{} {
+	g.mu.Lock()
+	last, failures := g.last, g.failures
+	g.mu.Unlock()
+	metrics := map[string]interface{}{
+		"gateway_checks_total":         atomic.LoadInt64(&g.checks),
+		"gateway_check_failures_total": atomic.LoadInt64(&g.failed),
+		"gateway_consecutive_failures": failures,
+	}
+	if last != nil {
+		metrics["gateway_ok"] = last.OK
+		metrics["gateway_latency_ms"] = last.LatencyMs
+	}
+	return metrics
+}
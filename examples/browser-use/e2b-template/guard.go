@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Header, or query parameter for clients that cannot set one, with which a
+// caller proves it holds a target's lease
+const leaseTokenHeader = "X-PPIO-Lease"
+
+// Codes of the rejections in the error body and audit events
+const (
+	rejectTargetNotOwned   = "target_not_owned"
+	rejectSchemeNotAllowed = "scheme_not_allowed"
+)
+
+// URL schemes /json/new may not open: they would read the sandbox's files
+var blockedNewTargetSchemes = map[string]bool{
+	"file":       true,
+	"filesystem": true,
+}
+
+// RequestRejectedEvent is delivered to -eventWebhook when the proxy
+// rejects a DevTools HTTP request (-guardDevToolsHTTP)
+type RequestRejectedEvent struct {
+	EventHeader
+	Time     time.Time `json:"time"`
+	Code     string    `json:"code"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	TargetID string    `json:"targetId,omitempty"`
+	URL      string    `json:"url,omitempty"`
+	Actor    string    `json:"actor"`
+	// Unverified X-PPIO-Actor header
+	ClaimedActor string `json:"claimedActor,omitempty"`
+}
+
+// EndpointGuard answers the DevTools HTTP endpoints that could disturb
+// other tenants or the sandbox itself with a JSON error instead of passing
+// them to Chrome: /json/close of a leased target by anyone but the lease
+// holder (or an admin), and /json/new of a file:// or filesystem: URL.
+// Every rejection is logged and audited.
+type EndpointGuard struct {
+	reservations *ReservationManager
+	isAdmin      func(*http.Request) bool
+	actor        func(*http.Request) string
+	clock        Clock
+
+	onAudit []func(RequestRejectedEvent)
+
+	mu       sync.Mutex
+	rejected map[string]int64
+}
+
+func NewEndpointGuard(reservations *ReservationManager, isAdmin func(*http.Request) bool, actor func(*http.Request) string, clock Clock) *EndpointGuard {
+	return &EndpointGuard{
+		reservations: reservations,
+		isAdmin:      isAdmin,
+		actor:        actor,
+		clock:        clock,
+		rejected:     make(map[string]int64),
+	}
+}
+
+// OnAudit registers fn to receive every rejection; a no-op without a guard
+func (g *EndpointGuard) OnAudit(fn func(RequestRejectedEvent)) {
+	if g == nil {
+		return
+	}
+	g.onAudit = append(g.onAudit, fn)
+}
+
+// Allow reports whether r may go on to Chrome, answering it when not
+func (g *EndpointGuard) Allow(w http.ResponseWriter, r *http.Request) bool {
+	if g == nil {
+		return true
+	}
+	// Match what Chrome will route to, so //json/new or /json/./close/ID
+	// cannot slip past
+	p := path.Clean("/" + r.URL.Path)
+	switch {
+	case strings.HasPrefix(p, "/json/close/"):
+		targetID := strings.TrimPrefix(p, "/json/close/")
+		holder := g.reservations.TokenOf(targetID)
+		if holder == "" || g.isAdmin(r) {
+			return true
+		}
+		token := r.Header.Get(leaseTokenHeader)
+		if token == "" {
+			token = r.URL.Query().Get("lease")
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(holder)) == 1 {
+			return true
+		}
+		g.reject(w, r, RequestRejectedEvent{
+			Code:     rejectTargetNotOwned,
+			TargetID: targetID,
+		}, fmt.Sprintf("target %s is leased to another client; send its lease token as %s to close it", targetID, leaseTokenHeader))
+		return false
+	case p == "/json/new":
+		// Chrome takes the whole query as the URL to open
+		target := unescapeLeniently(r.URL.RawQuery)
+		scheme, ok := newTargetScheme(target)
+		if ok && !blockedNewTargetSchemes[scheme] {
+			return true
+		}
+		message := fmt.Sprintf("%s: URLs may not be opened through this proxy", scheme)
+		if !ok {
+			// Fail closed on what cannot be read the way Chrome reads it
+			message = "the scheme of the URL to open is not valid"
+		}
+		g.reject(w, r, RequestRejectedEvent{
+			Code: rejectSchemeNotAllowed,
+			URL:  target,
+		}, message)
+		return false
+	}
+	return true
+}
+
+// The scheme of a URL to open, looking through view-source:, read the way
+// Chrome's URL parser reads it rather than with url.Parse: leading C0
+// controls and spaces are skipped, tabs and newlines dropped, and nothing
+// after the scheme matters. A URL without a scheme is fine (Chrome opens
+// about:blank instead); one whose scheme is not valid is not.
+func newTargetScheme(target string) (string, bool) {
+	for {
+		target = strings.TrimLeftFunc(target, func(r rune) bool { return r <= ' ' })
+		target = strings.Map(func(r rune) rune {
+			if r == '\t' || r == '\n' || r == '\r' {
+				return -1
+			}
+			return r
+		}, target)
+		scheme, rest, found := strings.Cut(target, ":")
+		if !found {
+			return "", true
+		}
+		if !validScheme(scheme) {
+			return "", false
+		}
+		scheme = strings.ToLower(scheme)
+		if scheme != "view-source" {
+			return scheme, true
+		}
+		target = rest
+	}
+}
+
+// RFC 3986 scheme syntax: a letter, then letters, digits, '+', '-' or '.'
+func validScheme(scheme string) bool {
+	for i, r := range scheme {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z':
+		case i > 0 && ('0' <= r && r <= '9' || r == '+' || r == '-' || r == '.'):
+		default:
+			return false
+		}
+	}
+	return scheme != ""
+}
+
+// Decode %XX escapes as Chrome does, leaving malformed ones as they are
+func unescapeLeniently(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]) {
+			v, _ := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			b.WriteByte(byte(v))
+			i += 2
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func (g *EndpointGuard) reject(w http.ResponseWriter, r *http.Request, ev RequestRejectedEvent, message string) {
+	ev.EventHeader = newEventHeader("request.rejected")
+	ev.Time = g.clock.Now()
+	ev.Method = r.Method
+	ev.Path = r.URL.Path
+	ev.Actor = g.actor(r)
+	ev.ClaimedActor = claimedActor(r)
+	g.mu.Lock()
+	g.rejected[ev.Code]++
+	g.mu.Unlock()
+	actor := ev.Actor
+	if ev.ClaimedActor != "" {
+		actor = fmt.Sprintf("%s (claims %q)", actor, ev.ClaimedActor)
+	}
+	log.Printf("🛡️ Rejected %s %s from %s: %s", r.Method, r.URL.Path, actor, message)
+	for _, fn := range g.onAudit {
+		fn(ev)
+	}
+	body := map[string]interface{}{"code": ev.Code, "message": message}
+	if ev.TargetID != "" {
+		body["targetId"] = ev.TargetID
+	}
+	if ev.URL != "" {
+		body["url"] = ev.URL
+	}
+	writeJSON(w, http.StatusForbidden, map[string]interface{}{"error": body})
+}
+
+func (g *EndpointGuard) Metrics() map[string]interface{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	byCode := make(map[string]int64, len(g.rejected))
+	var total int64
+	for code, n := range g.rejected {
+		byCode[code] = n
+		total += n
+	}
+	return map[string]interface{}{
+		"devtools_http_rejected_total":   total,
+		"devtools_http_rejected_by_code": byCode,
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGuardNormalizesPaths(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	m := newTestReservations(t, clock)
+	g := NewEndpointGuard(m, func(*http.Request) bool { return false }, func(*http.Request) string { return "anonymous" }, clock)
+	var events []RequestRejectedEvent
+	g.OnAudit(func(ev RequestRejectedEvent) { events = append(events, ev) })
+
+	res, err := m.Reserve(t.Context(), reserveRequest{TTLSeconds: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{
+		"/json/new?file:///etc/passwd",
+		"//json/new?file:///etc/passwd",
+		"/json/./new?file:///etc/passwd",
+		"/json/new/?file:///etc/passwd",
+		"/json/new?file:///%25zz/../etc/passwd",
+		"/json/new?file:///%zz/../etc/passwd",
+		"/json/new?%01file:///etc/passwd",
+		"/json/new?%20%09FILE:///etc/passwd",
+		"/json/new?fi%0Ale:///etc/passwd",
+		"/json/new?view-source:%01file:///etc/passwd",
+		"/json/new?%66ile:///etc/passwd",
+		"/json/new?%zzfile:///etc/passwd",
+		"/json/close/" + res.TargetID,
+		"//json/close/" + res.TargetID,
+		"/json/./close/" + res.TargetID,
+		"/json/x/../close/" + res.TargetID + "/",
+	} {
+		r := httptest.NewRequest("PUT", target, nil)
+		r.Header.Set(actorHeader, "bob")
+		if g.Allow(httptest.NewRecorder(), r) {
+			t.Errorf("%s was let through", target)
+		}
+	}
+	for _, ev := range events {
+		if ev.ClaimedActor != "bob" {
+			t.Errorf("rejection of %s claims actor %q, want %q", ev.Path, ev.ClaimedActor, "bob")
+		}
+	}
+
+	for _, target := range []string{
+		"/json/new",
+		"/json/new?https://example.com",
+		"/json/new?https://example.com/%zz",
+		"/json/new?about:blank",
+		"/json/new?example.com",
+	} {
+		if !g.Allow(httptest.NewRecorder(), httptest.NewRequest("PUT", target, nil)) {
+			t.Errorf("%s was rejected", target)
+		}
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	hookStartup  = "startup"
+	hookShutdown = "shutdown"
+)
+
+// Time a hook may take when it does not set "timeout"
+var defaultHookTimeout = map[string]time.Duration{
+	hookStartup:  30 * time.Second,
+	hookShutdown: 5 * time.Second,
+}
+
+/*
+Hooks let templates customize startup and cleanup without patching the
+proxy or wrapping it in shell scripts. Each hook has exactly one of http,
+command, cdp or waitFor (startup only) and a timeout. Example:
+
+	[
+	   {"name": "app", "waitFor": {"url": "http://127.0.0.1:3000/health"}},
+	   {"name": "seed", "after": ["app"], "command": ["/app/seed.sh"]},
+	   {"name": "downloads", "cdp": {"targets": "browser", "steps": [
+	      {"method": "Browser.setDownloadBehavior", "params": {"behavior": "allow", "downloadPath": "/tmp/downloads"}}
+	   ]}},
+	   {"name": "notify", "optional": true, "timeout": "3s", "http": {"method": "POST", "url": "https://hooks.example.com/up?sandbox=${args.sandboxId}"}}
+	]
+
+Startup hooks (-startupHooks) run before the proxy listens and reports
+ready: a hook starts once every hook in its "after" list has succeeded,
+so independent hooks run in parallel. A failed hook that is not
+"optional" stops the proxy, and hooks after it are skipped.
+
+Shutdown hooks (-shutdownHooks) run in order at teardown, before page
+modules are detached and artifacts uploaded, each within its timeout and
+the teardown lead; a failed hook is logged and the next one runs. For
+example, to navigate every tab to about:blank:
+
+	[{"name": "blank-tabs", "cdp": {"steps": [{"method": "Page.navigate", "params": {"url": "about:blank"}}]}}]
+
+CDP steps are macro steps, run on every page ("targets": "pages", the
+default) or on the browser endpoint ("browser"). Strings may reference
+${args.sandboxId}, ${env.PPIO_MACRO_X}, at shutdown ${args.reason} and, in
+CDP steps, ${args.targetId} and ${args.url}. Commands see the phase in
+PPIO_HOOK_PHASE and, at shutdown, the reason in PPIO_SHUTDOWN_REASON.
+*/
+type Hooks struct {
+	phase string
+	hooks []*hook
+
+	run    int64
+	failed int64
+}
+
+type hook struct {
+	Name     string    `json:"name"`
+	Timeout  string    `json:"timeout,omitempty"`
+	After    []string  `json:"after,omitempty"`
+	Optional bool      `json:"optional,omitempty"`
+	HTTP     *hookHTTP `json:"http,omitempty"`
+	Command  []string  `json:"command,omitempty"`
+	CDP      *hookCDP  `json:"cdp,omitempty"`
+	WaitFor  *hookWait `json:"waitFor,omitempty"`
+
+	timeout time.Duration
+}
+
+type hookHTTP struct {
+	Method  string            `json:"method,omitempty"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+}
+
+type hookCDP struct {
+	Targets string      `json:"targets,omitempty"`
+	Steps   []macroStep `json:"steps"`
+}
+
+// Poll a URL until it answers with a status below 500, or Status if set
+type hookWait struct {
+	URL      string `json:"url"`
+	Status   int    `json:"status,omitempty"`
+	Interval string `json:"interval,omitempty"`
+
+	interval time.Duration
+}
+
+func LoadHooks(path, phase string) (*Hooks, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var hooks []*hook
+	if err := json.Unmarshal(data, &hooks); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	names := make(map[string]*hook)
+	for i, h := range hooks {
+		if h.Name == "" {
+			h.Name = fmt.Sprintf("hook %d", i)
+		}
+		if names[h.Name] != nil {
+			return nil, fmt.Errorf("%s: two hooks are named %s", path, h.Name)
+		}
+		names[h.Name] = h
+		if err := h.validate(phase); err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", path, h.Name, err)
+		}
+	}
+	for _, h := range hooks {
+		for _, dep := range h.After {
+			if names[dep] == nil {
+				return nil, fmt.Errorf("%s: %s runs after unknown hook %s", path, h.Name, dep)
+			}
+		}
+	}
+	// Depth-first search for a hook that is, through "after", its own dependency
+	state := make(map[*hook]int)
+	var visit func(h *hook) error
+	visit = func(h *hook) error {
+		switch state[h] {
+		case 1:
+			return fmt.Errorf("%s: hooks wait for each other through %s", path, h.Name)
+		case 2:
+			return nil
+		}
+		state[h] = 1
+		for _, dep := range h.After {
+			if err := visit(names[dep]); err != nil {
+				return err
+			}
+		}
+		state[h] = 2
+		return nil
+	}
+	for _, h := range hooks {
+		if err := visit(h); err != nil {
+			return nil, err
+		}
+	}
+	return &Hooks{phase: phase, hooks: hooks}, nil
+}
+
+func (h *hook) validate(phase string) error {
+	kinds := 0
+	if h.HTTP != nil {
+		kinds++
+		if h.HTTP.URL == "" {
+			return errors.New("http has no url")
+		}
+	}
+	if h.Command != nil {
+		kinds++
+		if len(h.Command) == 0 {
+			return errors.New("command is empty")
+		}
+	}
+	if h.CDP != nil {
+		kinds++
+		if t := h.CDP.Targets; t != "" && t != "pages" && t != browserTargetID {
+			return fmt.Errorf("targets must be pages or browser, not %q", t)
+		}
+	}
+	if h.WaitFor != nil {
+		kinds++
+		if phase != hookStartup {
+			return errors.New("waitFor is for startup hooks")
+		}
+		if h.WaitFor.URL == "" {
+			return errors.New("waitFor has no url")
+		}
+		h.WaitFor.interval = 500 * time.Millisecond
+		if h.WaitFor.Interval != "" {
+			var err error
+			if h.WaitFor.interval, err = time.ParseDuration(h.WaitFor.Interval); err != nil || h.WaitFor.interval <= 0 {
+				return errors.New("waitFor interval must be a duration such as 500ms")
+			}
+		}
+	}
+	if kinds != 1 {
+		return errors.New("must have exactly one of http, command, cdp or waitFor")
+	}
+	if phase == hookShutdown && (len(h.After) > 0 || h.Optional) {
+		return errors.New("shutdown hooks run in order and always continue, after and optional do not apply")
+	}
+	h.timeout = defaultHookTimeout[phase]
+	if h.Timeout != "" {
+		var err error
+		if h.timeout, err = time.ParseDuration(h.Timeout); err != nil || h.timeout <= 0 {
+			return errors.New("timeout must be a duration such as 5s")
+		}
+	}
+	return nil
+}
+
+// Run the shutdown hooks in order, giving up on the rest once ctx is done
+func (hs *Hooks) RunShutdown(ctx context.Context, c *ChromeDevToolsClient, reason string) {
+	args := map[string]interface{}{"reason": reason, "sandboxId": sandboxID}
+	for _, h := range hs.hooks {
+		if ctx.Err() != nil {
+			log.Printf("⚠️ Teardown out of time, skipping shutdown hook %s", h.Name)
+			atomic.AddInt64(&hs.failed, 1)
+			continue
+		}
+		hs.runHook(ctx, c, h, args)
+	}
+}
+
+// Run the startup hooks, each once the hooks it comes after have succeeded.
+// Returns an error naming the first required hook that failed.
+func (hs *Hooks) RunStartup(c *ChromeDevToolsClient) error {
+	args := map[string]interface{}{"sandboxId": sandboxID}
+	done := make(map[string]chan struct{}, len(hs.hooks))
+	for _, h := range hs.hooks {
+		done[h.Name] = make(chan struct{})
+	}
+	var mu sync.Mutex
+	succeeded := make(map[string]bool)
+	var firstErr error
+	var wg sync.WaitGroup
+	for _, h := range hs.hooks {
+		wg.Add(1)
+		go func(h *hook) {
+			defer wg.Done()
+			defer close(done[h.Name])
+			for _, dep := range h.After {
+				<-done[dep]
+				mu.Lock()
+				ok := succeeded[dep]
+				mu.Unlock()
+				if !ok {
+					log.Printf("⚠️ Skipping startup hook %s, %s did not succeed", h.Name, dep)
+					return
+				}
+			}
+			err := hs.runHook(context.Background(), c, h, args)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				succeeded[h.Name] = true
+			case h.Optional:
+				// Optional hooks fail without holding up the hooks after them
+				succeeded[h.Name] = true
+			case firstErr == nil:
+				firstErr = fmt.Errorf("startup hook %s: %w", h.Name, err)
+			}
+		}(h)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+func (hs *Hooks) runHook(ctx context.Context, c *ChromeDevToolsClient, h *hook, args map[string]interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	start := c.clock.Now()
+	title := strings.ToUpper(hs.phase[:1]) + hs.phase[1:]
+	err := h.run(ctx, c, hs.phase, args)
+	atomic.AddInt64(&hs.run, 1)
+	if err != nil {
+		atomic.AddInt64(&hs.failed, 1)
+		log.Printf("❌ %s hook %s failed after %v: %v", title, h.Name, c.clock.Since(start).Round(time.Millisecond), err)
+		return err
+	}
+	log.Printf("🪝 %s hook %s done in %v", title, h.Name, c.clock.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+func (h *hook) run(ctx context.Context, c *ChromeDevToolsClient, phase string, args map[string]interface{}) error {
+	scope := &macroScope{args: args}
+	expand := func(s string) string {
+		v, _ := scope.expand(s).(string)
+		return v
+	}
+	switch {
+	case h.HTTP != nil:
+		return h.runHTTP(ctx, c.client, expand)
+	case h.WaitFor != nil:
+		return h.waitFor(ctx, c.clock, c.client, expand(h.WaitFor.URL))
+	case h.Command != nil:
+		argv := make([]string, len(h.Command))
+		for i, arg := range h.Command {
+			argv[i] = expand(arg)
+		}
+		cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+		cmd.Env = append(os.Environ(), "PPIO_HOOK_PHASE="+phase)
+		if reason, ok := args["reason"].(string); ok {
+			cmd.Env = append(cmd.Env, "PPIO_SHUTDOWN_REASON="+reason)
+		}
+		output, err := cmd.CombinedOutput()
+		if err != nil && len(output) > 0 {
+			return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+		}
+		return err
+	default:
+		return h.runCDP(ctx, c, args)
+	}
+}
+
+func (h *hook) runHTTP(ctx context.Context, client *http.Client, expand func(string) string) error {
+	method := h.HTTP.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	req, err := http.NewRequestWithContext(ctx, method, expand(h.HTTP.URL), strings.NewReader(expand(h.HTTP.Body)))
+	if err != nil {
+		return err
+	}
+	for name, value := range h.HTTP.Headers {
+		req.Header.Set(name, expand(value))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: %s", method, req.URL.Redacted(), resp.Status)
+	}
+	return nil
+}
+
+func (h *hook) waitFor(ctx context.Context, clock Clock, client *http.Client, url string) error {
+	var last error
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if h.WaitFor.Status == 0 && resp.StatusCode < 500 || resp.StatusCode == h.WaitFor.Status {
+				return nil
+			}
+			err = errors.New(resp.Status)
+		}
+		last = err
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s not up: %v", url, last)
+		case <-clock.After(h.WaitFor.interval):
+		}
+	}
+}
+
+// Run the steps on the browser endpoint or on each page, continuing past
+// pages that fail so that one hung tab does not hold up the others
+func (h *hook) runCDP(ctx context.Context, c *ChromeDevToolsClient, args map[string]interface{}) error {
+	// At startup Chrome may still be coming up
+	for {
+		_, err := c.control.Conn()
+		if err == nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("chrome unreachable: %v", err)
+		case <-c.clock.After(time.Second):
+		}
+	}
+	macro := &Macro{Steps: h.CDP.Steps}
+	if h.CDP.Targets == browserTargetID {
+		return c.control.WithSession(ctx, browserTargetID, func(conn *CDPConn, sessionID string) error {
+			_, _, err := macro.Run(ctx, c.clock, conn, sessionID, args, nil)
+			return err
+		})
+	}
+	infos, err := c.listTargets(ctx)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, info := range infos {
+		if info.Type != "page" {
+			continue
+		}
+		pageArgs := map[string]interface{}{"targetId": info.TargetID, "url": info.URL}
+		for k, v := range args {
+			pageArgs[k] = v
+		}
+		err := c.control.WithSession(ctx, info.TargetID, func(conn *CDPConn, sessionID string) error {
+			_, _, err := macro.Run(ctx, c.clock, conn, sessionID, pageArgs, nil)
+			return err
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c.labels.Describe(info.TargetID), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (hs *Hooks) Metrics() map[string]interface{} {
+	return map[string]interface{}{
+		hs.phase + "_hooks":              len(hs.hooks),
+		hs.phase + "_hooks_run_total":    atomic.LoadInt64(&hs.run),
+		hs.phase + "_hooks_failed_total": atomic.LoadInt64(&hs.failed),
+	}
+}
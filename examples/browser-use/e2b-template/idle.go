@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// IdleTimeout closes debugger WebSocket connections whose client has sent
+// no CDP message for the timeout (-wsIdleTimeout), so that abandoned agent
+// sessions stop pinning Chrome targets. Events from Chrome do not count:
+// an open page keeps sending them after its agent is gone.
+type IdleTimeout struct {
+	clock   Clock
+	timeout time.Duration
+
+	closed int64
+}
+
+func NewIdleTimeout(clock Clock, timeout time.Duration) *IdleTimeout {
+	return &IdleTimeout{clock: clock, timeout: timeout}
+}
+
+// idleWatch is the client activity of one connection
+type idleWatch struct {
+	clock Clock
+	// monotonicNow of the last client message
+	last int64
+}
+
+// Watch the client connection ws, described by name in logs, until done is
+// closed. The client's messages are reported through the returned watch.
+func (t *IdleTimeout) Watch(ws *WebSocketConn, name string, done <-chan struct{}) *idleWatch {
+	if t == nil {
+		return nil
+	}
+	w := &idleWatch{clock: t.clock}
+	w.active()
+	go t.run(ws, w, name, done)
+	return w
+}
+
+func (t *IdleTimeout) run(ws *WebSocketConn, w *idleWatch, name string, done <-chan struct{}) {
+	// Check often enough to close within a tenth of the timeout
+	check := t.timeout / 10
+	if check < time.Second {
+		check = time.Second
+	}
+	ticker := t.clock.NewTicker(check)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C():
+		}
+		idle := monotonicSince(t.clock, atomic.LoadInt64(&w.last))
+		if idle < t.timeout {
+			continue
+		}
+		atomic.AddInt64(&t.closed, 1)
+		log.Printf("⏱️ Closing idle WebSocket session %s: no CDP traffic for %s", name, idle.Round(time.Second))
+		// Start the close handshake; a client that does not finish it is
+		// cut off after the grace period
+		ws.writeFrame(wsOpClose, append(binary.BigEndian.AppendUint16(nil, wsCloseGoingAway), "idle timeout"...))
+		ws.conn.SetReadDeadline(time.Now().Add(wsCloseGrace))
+		return
+	}
+}
+
+func (w *idleWatch) active() {
+	if w != nil {
+		atomic.StoreInt64(&w.last, monotonicNow(w.clock))
+	}
+}
+
+// Wrap a relay handler of the client's messages to note each as activity
+func (w *idleWatch) wrap(handle func(opcode byte, payload []byte) []byte) func(opcode byte, payload []byte) []byte {
+	return func(opcode byte, payload []byte) []byte {
+		w.active()
+		return handle(opcode, payload)
+	}
+}
+
+func (t *IdleTimeout) Metrics() map[string]interface{} {
+	return map[string]interface{}{
+		"ws_idle_closed_total": atomic.LoadInt64(&t.closed),
+	}
+}
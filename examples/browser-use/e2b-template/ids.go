@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Header carrying the caller's own session (connection) ID
+const sessionHeader = "X-PPIO-Session"
+
+// Caller-supplied task and session IDs must look like database keys: they
+// end up in URLs, labels and log lines
+var validID = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:-]{0,127}$`)
+
+// IDGenerator produces the proxy's own task and session IDs
+type IDGenerator func() string
+
+var idGenerators = map[string]IDGenerator{
+	"hex":  newToken,
+	"uuid": newUUID,
+}
+
+// newID generates task and session IDs the caller did not supply; chosen
+// with -idFormat
+var newID IDGenerator = newToken
+
+// Select the ID generator by name
+func setIDFormat(name string) error {
+	gen, ok := idGenerators[name]
+	if !ok {
+		names := make([]string, 0, len(idGenerators))
+		for n := range idGenerators {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown ID format %q, expected one of %s", name, strings.Join(names, ", "))
+	}
+	newID = gen
+	return nil
+}
+
+// Random (version 4) UUID
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func checkID(kind, id string) error {
+	if !validID.MatchString(id) {
+		return fmt.Errorf("invalid %s ID %q: use up to 128 letters, digits, '.', '_', ':' or '-'", kind, id)
+	}
+	return nil
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// MessageContext identifies the connection and CDP session a relayed
+// message belongs to
+type MessageContext struct {
+	TargetID   string
+	Task       string
+	Session    string
+	Client     *ClientInfo
+	RemoteAddr string
+	// Flattened CDP session of the message, empty for the target itself
+	CDPSessionID string
+	// Admitted with a break-glass grant, which bypasses the CDP policy
+	BreakGlass bool
+}
+
+func (m *MessageContext) String() string {
+	return fmt.Sprintf("%s (client %s)", m.TargetID, m.Client)
+}
+
+// Interceptor hooks. Each returns the payload to forward, modified or not;
+// an error rejects the message.
+type (
+	// A rejected command is not forwarded; the client receives the error
+	// (a *CDPError keeps its code) as the command's response
+	CommandHook func(ctx *MessageContext, method string, params json.RawMessage) (json.RawMessage, error)
+	// cdpErr is set for failed commands, with a nil result. A rejected
+	// response reaches the client as an error response.
+	ResponseHook func(ctx *MessageContext, method string, result json.RawMessage, cdpErr *CDPError) (json.RawMessage, error)
+	// A rejected event is dropped
+	EventHook func(ctx *MessageContext, method string, params json.RawMessage) (json.RawMessage, error)
+)
+
+// Interceptors is the chain of Go callbacks every CDP message relayed
+// between clients and Chrome passes through, in registration order. While
+// none are registered, frames are copied without being decoded.
+type Interceptors struct {
+	commands  []CommandHook
+	responses []ResponseHook
+	events    []EventHook
+}
+
+func NewInterceptors() *Interceptors {
+	return &Interceptors{}
+}
+
+// OnCommand registers fn for commands sent by clients
+func (i *Interceptors) OnCommand(fn CommandHook) {
+	i.commands = append(i.commands, fn)
+}
+
+// OnResponse registers fn for Chrome's responses to client commands
+func (i *Interceptors) OnResponse(fn ResponseHook) {
+	i.responses = append(i.responses, fn)
+}
+
+// OnEvent registers fn for events Chrome sends to clients
+func (i *Interceptors) OnEvent(fn EventHook) {
+	i.events = append(i.events, fn)
+}
+
+func (i *Interceptors) Enabled() bool {
+	return len(i.commands)+len(i.responses)+len(i.events) > 0
+}
+
+// relayEnvelope keeps the raw id so that it is re-encoded exactly as sent
+type relayEnvelope struct {
+	ID        json.RawMessage `json:"id,omitempty"`
+	SessionID string          `json:"sessionId,omitempty"`
+	Method    string          `json:"method,omitempty"`
+	Params    json.RawMessage `json:"params,omitempty"`
+	Result    json.RawMessage `json:"result,omitempty"`
+	Error     json.RawMessage `json:"error,omitempty"`
+}
+
+// messageRelay runs one connection's messages through the interceptors
+type messageRelay struct {
+	chain    *Interceptors
+	ctx      MessageContext
+	client   *WebSocketConn
+	upstream *WebSocketConn
+
+	mu sync.Mutex
+	// Methods of forwarded commands by session and id, to name responses
+	pending map[string]string
+	// Negotiated with the client: large messages are sent as diffs
+	delta *deltaEncoder
+	// Notes the client's messages for the idle timeout
+	idle *idleWatch
+	// Set with -maxMessageSize
+	limit *MessageLimit
+}
+
+// Build the relay for an upgraded connection. Writes to Chrome go through
+// body so that the taps observe them.
+func (i *Interceptors) newRelay(r *http.Request, client, upstream net.Conn, body interface{ Write([]byte) (int, error) }) *messageRelay {
+	targetID := devtoolsTargetID(r.URL.Path)
+	if targetID == "" {
+		targetID = browserTargetID
+	}
+	_, breakGlass := r.Context().Value(breakGlassGrantKey{}).(*breakGlassGrant)
+	return &messageRelay{
+		chain: i,
+		ctx: MessageContext{
+			TargetID:   targetID,
+			Task:       r.Header.Get(taskHeader),
+			Session:    r.Header.Get(sessionHeader),
+			Client:     classifyClient(r),
+			RemoteAddr: r.RemoteAddr,
+			BreakGlass: breakGlass,
+		},
+		client:   &WebSocketConn{conn: client},
+		upstream: &WebSocketConn{conn: &writeThroughConn{Conn: upstream, w: body}, client: true},
+		pending:  make(map[string]string),
+	}
+}
+
+// writeThroughConn sends writes through w instead of the connection
+type writeThroughConn struct {
+	net.Conn
+	w interface{ Write([]byte) (int, error) }
+}
+
+func (c *writeThroughConn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+func (m *messageRelay) toChrome(src *bufio.Reader) (bool, error) {
+	handle := m.fromClient
+	if !m.chain.Enabled() {
+		handle = passMessage
+	}
+	if m.delta != nil {
+		handle = m.delta.watchCommands(handle)
+	}
+	if m.idle != nil {
+		handle = m.idle.wrap(handle)
+	}
+	// Messages from a compressing or transcoding client are restored to
+	// Chrome's JSON
+	return relayMessages(&WebSocketConn{br: src, deflate: m.client.deflate, codec: m.client.codec, keepalive: m.client.keepalive, limit: m.limit.bytes()}, m.upstream, handle, m.oversize(true))
+}
+
+func (m *messageRelay) toClient(src *bufio.Reader) (bool, error) {
+	handle := m.fromChrome
+	if !m.chain.Enabled() {
+		handle = passMessage
+	}
+	if m.delta != nil {
+		handle = m.delta.encodeMessages(handle)
+	}
+	// Queued messages are written before the bridge closes the client
+	defer m.client.lanes.close()
+	return relayMessages(&WebSocketConn{br: src, keepalive: m.upstream.keepalive, limit: m.limit.bytes()}, m.client, handle, m.oversize(false))
+}
+
+// Relay handler forwarding messages unchanged
+func passMessage(opcode byte, payload []byte) []byte {
+	return payload
+}
+
+// relayMessages reassembles data messages from src, inflating compressed
+// ones and decoding transcoded ones, writes what handle returns for each to dst (nothing when it
+// returns nil) and forwards control frames as they come, until a close
+// frame or an error. With a limit, messages over it are read past and
+// passed to tooBig instead.
+func relayMessages(src, dst *WebSocketConn, handle func(opcode byte, payload []byte) []byte, tooBig func(o *oversizeMessage)) (bool, error) {
+	var opcode byte
+	var message []byte
+	var compressed bool
+	// The message being read past
+	var over *oversizeMessage
+	limit := src.limit
+	for {
+		if limit > 0 {
+			// A frame may bring the message up to the limit
+			src.limit = limit - len(message)
+			if src.limit < 1 {
+				src.limit = 1
+			}
+		}
+		fin, op, data, err := src.readFrame()
+		var skimmed *oversizeFrame
+		if errors.As(err, &skimmed) {
+			if over == nil {
+				if skimmed.opcode != wsOpContinuation {
+					opcode, message, compressed = skimmed.opcode, nil, src.rsv1
+				}
+				if opcode == 0 {
+					return false, errors.New("unexpected continuation frame")
+				}
+				over = &oversizeMessage{opcode: opcode}
+				over.add(int64(len(message)), message, message)
+				message = nil
+			}
+			over.add(skimmed.size, skimmed.head, skimmed.tail)
+			fin = skimmed.fin
+		} else if err != nil {
+			return false, err
+		}
+		switch {
+		case skimmed != nil:
+		case op == wsOpClose || op == wsOpPing || op == wsOpPong:
+			if op == wsOpPong && src.keepalive != nil && string(data) == keepalivePayload {
+				// Answers the proxy's own ping
+				continue
+			}
+			if op == wsOpClose {
+				// Messages still queued go before the close frame
+				dst.lanes.flush()
+			}
+			if err := dst.writeFrame(op, data); err != nil {
+				return false, err
+			}
+			if op == wsOpClose {
+				return true, nil
+			}
+			continue
+		case op == wsOpContinuation:
+			if opcode == 0 {
+				return false, errors.New("unexpected continuation frame")
+			}
+			if over != nil {
+				over.add(int64(len(data)), data, data)
+			} else {
+				message = append(message, data...)
+			}
+		default:
+			opcode, message, compressed = op, data, src.rsv1
+		}
+		if limit > 0 && over == nil && len(message) > limit {
+			over = &oversizeMessage{opcode: opcode}
+			over.add(int64(len(message)), message, message)
+			message = nil
+		}
+		if len(message) > wsMaxFrameSize {
+			return false, fmt.Errorf("websocket message of %d bytes exceeds limit", len(message))
+		}
+		if !fin {
+			continue
+		}
+		if over != nil {
+			if compressed {
+				// The inflater's window now misses what was read past
+				return false, fmt.Errorf("compressed websocket message of %d bytes exceeds limit", over.size)
+			}
+			tooBig(over)
+			opcode, over = 0, nil
+			continue
+		}
+		if compressed {
+			if src.deflate == nil {
+				return false, errors.New("compressed websocket message without permessage-deflate")
+			}
+			if message, err = src.deflate.inflate(message); err != nil {
+				return false, err
+			}
+			if limit > 0 && len(message) > limit {
+				over = &oversizeMessage{opcode: opcode}
+				over.add(int64(len(message)), message, message)
+				tooBig(over)
+				over = nil
+				opcode, message = 0, nil
+				continue
+			}
+		}
+		if src.codec != nil && opcode == wsOpBinary {
+			if message, err = src.codec.toJSON(message); err != nil {
+				return false, err
+			}
+			opcode = wsOpText
+		}
+		if out := handle(opcode, message); out != nil {
+			if err := dst.WriteMessage(opcode, out); err != nil {
+				return false, err
+			}
+		}
+		opcode, message = 0, nil
+	}
+}
+
+func pendingKey(sessionID string, id json.RawMessage) string {
+	return sessionID + " " + string(id)
+}
+
+func (m *messageRelay) fromClient(opcode byte, payload []byte) []byte {
+	var msg relayEnvelope
+	if opcode != wsOpText || json.Unmarshal(payload, &msg) != nil || msg.Method == "" {
+		return payload
+	}
+	ctx := m.ctx
+	ctx.CDPSessionID = msg.SessionID
+	params := msg.Params
+	for _, fn := range m.chain.commands {
+		var err error
+		if params, err = fn(&ctx, msg.Method, params); err != nil {
+			m.reject(&msg, err)
+			return nil
+		}
+	}
+	m.mu.Lock()
+	m.pending[pendingKey(msg.SessionID, msg.ID)] = msg.Method
+	m.mu.Unlock()
+	if bytes.Equal(params, msg.Params) {
+		return payload
+	}
+	msg.Params = params
+	return encodeEnvelope(&msg, payload)
+}
+
+func (m *messageRelay) fromChrome(opcode byte, payload []byte) []byte {
+	var msg relayEnvelope
+	if opcode != wsOpText || json.Unmarshal(payload, &msg) != nil {
+		return payload
+	}
+	ctx := m.ctx
+	ctx.CDPSessionID = msg.SessionID
+
+	if msg.Method != "" {
+		params := msg.Params
+		for _, fn := range m.chain.events {
+			var err error
+			if params, err = fn(&ctx, msg.Method, params); err != nil {
+				return nil
+			}
+		}
+		if bytes.Equal(params, msg.Params) {
+			return payload
+		}
+		msg.Params = params
+		return encodeEnvelope(&msg, payload)
+	}
+
+	key := pendingKey(msg.SessionID, msg.ID)
+	m.mu.Lock()
+	method := m.pending[key]
+	delete(m.pending, key)
+	m.mu.Unlock()
+	var cdpErr *CDPError
+	if msg.Error != nil {
+		cdpErr = &CDPError{}
+		json.Unmarshal(msg.Error, cdpErr)
+	}
+	result := msg.Result
+	for _, fn := range m.chain.responses {
+		var err error
+		if result, err = fn(&ctx, method, result, cdpErr); err != nil {
+			msg.Result, msg.Error = nil, encodeCDPError(err)
+			return encodeEnvelope(&msg, payload)
+		}
+	}
+	if bytes.Equal(result, msg.Result) {
+		return payload
+	}
+	msg.Result = result
+	return encodeEnvelope(&msg, payload)
+}
+
+// Answer a rejected command on Chrome's behalf
+func (m *messageRelay) reject(cmd *relayEnvelope, err error) {
+	reply := &relayEnvelope{ID: cmd.ID, SessionID: cmd.SessionID, Error: encodeCDPError(err)}
+	if err := m.client.WriteMessage(wsOpText, encodeEnvelope(reply, nil)); err != nil {
+		log.Printf("⚠️ Failed to reject %s: %v", cmd.Method, err)
+	}
+}
+
+func encodeCDPError(err error) json.RawMessage {
+	cdpErr := &CDPError{Code: -32000, Message: err.Error()}
+	errors.As(err, &cdpErr)
+	data, _ := json.Marshal(cdpErr)
+	return data
+}
+
+// Marshal a modified message, keeping the original when that fails
+func encodeEnvelope(msg *relayEnvelope, original []byte) []byte {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("⚠️ Failed to re-encode intercepted %s: %v", msg.Method, err)
+		return original
+	}
+	return data
+}
+
+// Log relayed commands and failed responses (-logCDP)
+func registerCDPLogger(chain *Interceptors) {
+	chain.OnCommand(func(ctx *MessageContext, method string, params json.RawMessage) (json.RawMessage, error) {
+		log.Printf("🛰️ %s → %s (%d bytes)", ctx, method, len(params))
+		return params, nil
+	})
+	chain.OnResponse(func(ctx *MessageContext, method string, result json.RawMessage, cdpErr *CDPError) (json.RawMessage, error) {
+		if cdpErr != nil {
+			log.Printf("🛰️ %s ← %s failed: %v", ctx, method, cdpErr)
+		}
+		return result, nil
+	})
+}
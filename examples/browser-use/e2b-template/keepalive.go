@@ -0,0 +1,93 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Payload of the proxy's own pings, so that the pongs answering them are
+// not relayed to the other side
+const keepalivePayload = "ppio-keepalive"
+
+// Keepalive pings both legs of relayed WebSocket connections
+// (-wsPingInterval): a leg quiet for an interval is pinged, and one that
+// stays quiet for -wsPingMisses pings in a row is closed, so connections
+// dropped silently by a NAT or the E2B ingress are cleaned up instead of
+// holding their session until TCP gives up.
+type Keepalive struct {
+	clock    Clock
+	interval time.Duration
+	misses   int
+
+	pings int64
+	dead  int64
+}
+
+func NewKeepalive(clock Clock, interval time.Duration, misses int) *Keepalive {
+	if misses < 1 {
+		misses = 1
+	}
+	return &Keepalive{clock: clock, interval: interval, misses: misses}
+}
+
+// wsKeepalive is the liveness of one leg: when a frame was last read, as a
+// monotonicNow reading
+type wsKeepalive struct {
+	clock Clock
+	last  int64
+}
+
+func (k *wsKeepalive) seen() {
+	if k != nil {
+		atomic.StoreInt64(&k.last, monotonicNow(k.clock))
+	}
+}
+
+// Start pinging ws, described by name in logs, until done is closed.
+// Frames read from ws count as answers, so it must be read through its
+// own WebSocketConn or one sharing its keepalive.
+func (k *Keepalive) Start(ws *WebSocketConn, name string, done <-chan struct{}) {
+	if k == nil {
+		return
+	}
+	ws.keepalive = &wsKeepalive{clock: k.clock}
+	ws.keepalive.seen()
+	go k.run(ws, name, done)
+}
+
+func (k *Keepalive) run(ws *WebSocketConn, name string, done <-chan struct{}) {
+	ticker := k.clock.NewTicker(k.interval)
+	defer ticker.Stop()
+	missed := 0
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C():
+		}
+		if monotonicSince(k.clock, atomic.LoadInt64(&ws.keepalive.last)) < k.interval {
+			missed = 0
+			continue
+		}
+		if missed >= k.misses {
+			atomic.AddInt64(&k.dead, 1)
+			log.Printf("💔 %s did not answer %d keepalive pings, closing", name, missed)
+			ws.conn.Close()
+			return
+		}
+		missed++
+		atomic.AddInt64(&k.pings, 1)
+		if err := ws.writeFrame(wsOpPing, []byte(keepalivePayload)); err != nil {
+			ws.conn.Close()
+			return
+		}
+	}
+}
+
+func (k *Keepalive) Metrics() map[string]interface{} {
+	return map[string]interface{}{
+		"ws_keepalive_pings_total": atomic.LoadInt64(&k.pings),
+		"ws_keepalive_dead_total":  atomic.LoadInt64(&k.dead),
+	}
+}
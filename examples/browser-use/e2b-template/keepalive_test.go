@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestKeepaliveClosesSilentLeg(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	k := NewKeepalive(clock, 10*time.Second, 2)
+	local, remote := net.Pipe()
+	defer remote.Close()
+	ws := &WebSocketConn{conn: local, br: bufio.NewReader(local)}
+	done := make(chan struct{})
+	defer close(done)
+
+	// The silent end: reads what the proxy sends and never answers
+	frames := make(chan byte)
+	go func() {
+		peer := &WebSocketConn{conn: remote, br: bufio.NewReader(remote), client: true}
+		for {
+			_, opcode, _, err := peer.readFrame()
+			if err != nil {
+				close(frames)
+				return
+			}
+			frames <- opcode
+		}
+	}()
+	k.Start(ws, "test leg", done)
+	clock.BlockUntil(1)
+
+	for i := 0; i < 2; i++ {
+		clock.Advance(10 * time.Second)
+		if opcode := <-frames; opcode != wsOpPing {
+			t.Fatalf("tick %d sent opcode %d, want a ping", i, opcode)
+		}
+	}
+	clock.Advance(10 * time.Second)
+	if _, open := <-frames; open {
+		t.Fatal("leg not closed after two unanswered pings")
+	}
+	if dead := k.Metrics()["ws_keepalive_dead_total"]; dead != int64(1) {
+		t.Fatalf("ws_keepalive_dead_total = %v, want 1", dead)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var labelKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,63}$`)
+
+// TargetLabels holds client-assigned key/value labels per target, such as
+// the orchestration task or customer a tab belongs to
+type TargetLabels struct {
+	mu     sync.Mutex
+	labels map[string]map[string]string
+}
+
+func NewTargetLabels() *TargetLabels {
+	return &TargetLabels{labels: make(map[string]map[string]string)}
+}
+
+// Get returns a copy of the target's labels
+func (l *TargetLabels) Get(targetID string) map[string]string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	labels := make(map[string]string, len(l.labels[targetID]))
+	for k, v := range l.labels[targetID] {
+		labels[k] = v
+	}
+	return labels
+}
+
+// Set merges labels into the target's labels; an empty value removes a key
+func (l *TargetLabels) Set(targetID string, labels map[string]string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	current := l.labels[targetID]
+	if current == nil {
+		current = make(map[string]string)
+		l.labels[targetID] = current
+	}
+	for k, v := range labels {
+		if v == "" {
+			delete(current, k)
+		} else {
+			current[k] = v
+		}
+	}
+	if len(current) == 0 {
+		delete(l.labels, targetID)
+	}
+}
+
+// Prune drops labels of targets that no longer exist
+func (l *TargetLabels) Prune(live map[string]bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for id := range l.labels {
+		if !live[id] {
+			delete(l.labels, id)
+		}
+	}
+}
+
+// Describe formats a target id with its labels for log lines, e.g.
+// "27E1... {customer=42 task=a1}"
+func (l *TargetLabels) Describe(targetID string) string {
+	labels := l.Get(targetID)
+	if len(labels) == 0 {
+		return targetID
+	}
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return fmt.Sprintf("%s {%s}", targetID, strings.Join(pairs, " "))
+}
+
+// All returns a copy of the labels of every target
+func (l *TargetLabels) All() map[string]map[string]string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	byTarget := make(map[string]map[string]string, len(l.labels))
+	for id, labels := range l.labels {
+		byTarget[id] = make(map[string]string, len(labels))
+		for k, v := range labels {
+			byTarget[id][k] = v
+		}
+	}
+	return byTarget
+}
+
+func (l *TargetLabels) Metrics() map[string]interface{} {
+	byTarget := l.All()
+	return map[string]interface{}{
+		"targets_labeled": len(byTarget),
+		"target_labels":   byTarget,
+	}
+}
+
+// List the browser's targets, pruning labels of closed ones
+func (c *ChromeDevToolsClient) listTargets(ctx context.Context) ([]TargetInfo, error) {
+	conn, err := c.control.Conn()
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		TargetInfos []TargetInfo `json:"targetInfos"`
+	}
+	if err := conn.CallResult(ctx, "", "Target.getTargets", nil, &result); err != nil {
+		return nil, err
+	}
+	live := make(map[string]bool, len(result.TargetInfos))
+	for _, info := range result.TargetInfos {
+		live[info.TargetID] = true
+	}
+	c.labels.Prune(live)
+	return result.TargetInfos, nil
+}
+
+/*
+Handle GET /targets
+Lists targets with their labels. ?label=key=value keeps only targets
+carrying that label; ?includeWorkers=true also lists -hideTargetTypes.
+*/
+func (c *ChromeDevToolsClient) handleListTargets(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), c.client.Timeout)
+	defer cancel()
+
+	infos, err := c.listTargets(ctx)
+	if err != nil {
+		c.errorCount++
+		log.Printf("❌ Failed to list targets: %v", err)
+		http.Error(w, fmt.Sprintf("Failed to list targets: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	filterKey, filterValue, _ := strings.Cut(r.URL.Query().Get("label"), "=")
+	targets := make([]map[string]interface{}, 0, len(infos))
+	for _, info := range infos {
+		if !targetTypeVisible(info.Type, r) {
+			continue
+		}
+		labels := c.labels.Get(info.TargetID)
+		if filterKey != "" && (labels[filterKey] == "" || (filterValue != "" && labels[filterKey] != filterValue)) {
+			continue
+		}
+		targets = append(targets, map[string]interface{}{
+			"targetId": info.TargetID,
+			"type":     info.Type,
+			"title":    info.Title,
+			"url":      info.URL,
+			"labels":   labels,
+		})
+	}
+	writeJSON(w, http.StatusOK, targets)
+}
+
+/*
+Handle POST /targets/{id}/labels
+Request example:
+
+	{"task": "a1b2", "customer": "42"}
+
+Labels are merged into existing ones; an empty value removes a label.
+*/
+func (c *ChromeDevToolsClient) handleSetLabels(w http.ResponseWriter, r *http.Request) {
+	var labels map[string]string
+	if !readJSON(w, r, &labels) {
+		return
+	}
+	for k := range labels {
+		if !labelKeyPattern.MatchString(k) {
+			http.Error(w, fmt.Sprintf("invalid label key %q", k), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), c.client.Timeout)
+	defer cancel()
+	infos, err := c.listTargets(ctx)
+	if err != nil {
+		c.errorCount++
+		log.Printf("❌ Failed to list targets: %v", err)
+		http.Error(w, fmt.Sprintf("Failed to list targets: %v", err), http.StatusBadGateway)
+		return
+	}
+	targetID := r.PathValue("id")
+	found := false
+	for _, info := range infos {
+		found = found || info.TargetID == targetID
+	}
+	if !found {
+		http.Error(w, "unknown target", http.StatusNotFound)
+		return
+	}
+
+	c.labels.Set(targetID, labels)
+	log.Printf("🏷️ Labeled target %s", c.labels.Describe(targetID))
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"targetId": targetID,
+		"labels":   c.labels.Get(targetID),
+	})
+}
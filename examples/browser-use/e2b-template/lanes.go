@@ -0,0 +1,166 @@
+package main
+
+import (
+	"sync/atomic"
+)
+
+func init() {
+	registerFeature("priority-lanes", "Queue messages to clients in an interactive and a bulk lane (messages of at least -bulkThreshold bytes, e.g. screencast frames and body dumps), always sending interactive ones first", false)
+}
+
+// Messages a lane holds before the relay from Chrome waits for the client
+const (
+	interactiveLaneDepth = 1024
+	bulkLaneDepth        = 64
+)
+
+// PriorityLanes splits the messages written to a client into two queues:
+// large ones (screencast frames, response bodies, snapshots) wait in a bulk
+// lane while small ones (command responses, input acks, most events) go
+// first, so that a transfer in progress does not hold up interactive
+// traffic. Order is kept within a lane, not across lanes. A message being
+// written is never interrupted, as WebSocket messages cannot interleave.
+type PriorityLanes struct {
+	threshold int
+
+	interactive int64
+	bulk        int64
+	overtaken   int64
+}
+
+func NewPriorityLanes(threshold int) *PriorityLanes {
+	return &PriorityLanes{threshold: threshold}
+}
+
+// laneMessage is a queued message, or a flush marker when flushed is set
+type laneMessage struct {
+	opcode  byte
+	payload []byte
+	flushed chan struct{}
+}
+
+// laneQueue is the lanes of one client connection, emptied by a writer
+// goroutine
+type laneQueue struct {
+	p           *PriorityLanes
+	ws          *WebSocketConn
+	interactive chan laneMessage
+	bulk        chan laneMessage
+	stop        chan struct{}
+	done        chan struct{}
+	// The first write error, after which messages are dropped
+	err atomic.Value
+}
+
+// Start the lanes of ws: its WriteMessage queues from now on, until
+// closed
+func (p *PriorityLanes) Start(ws *WebSocketConn) *laneQueue {
+	if p == nil {
+		return nil
+	}
+	q := &laneQueue{
+		p:           p,
+		ws:          ws,
+		interactive: make(chan laneMessage, interactiveLaneDepth),
+		bulk:        make(chan laneMessage, bulkLaneDepth),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	ws.lanes = q
+	go q.run()
+	return q
+}
+
+// Queue a message in its lane, waiting while the lane is full
+func (q *laneQueue) push(opcode byte, payload []byte) error {
+	if err, ok := q.err.Load().(error); ok {
+		return err
+	}
+	m := laneMessage{opcode: opcode, payload: payload}
+	lane := q.interactive
+	if len(payload) >= q.p.threshold {
+		lane = q.bulk
+	}
+	select {
+	case lane <- m:
+		return nil
+	case <-q.done:
+		return errWebSocketClosed
+	}
+}
+
+// Wait until every message queued so far has been written
+func (q *laneQueue) flush() {
+	if q == nil {
+		return
+	}
+	// The marker goes last in the bulk lane, which the writer only takes
+	// from once the interactive lane is empty
+	m := laneMessage{flushed: make(chan struct{})}
+	select {
+	case q.bulk <- m:
+	case <-q.done:
+		return
+	}
+	select {
+	case <-m.flushed:
+	case <-q.done:
+	}
+}
+
+// Write what is queued and stop the writer
+func (q *laneQueue) close() {
+	if q == nil {
+		return
+	}
+	q.flush()
+	close(q.stop)
+	<-q.done
+}
+
+func (q *laneQueue) run() {
+	defer close(q.done)
+	for {
+		var m laneMessage
+		select {
+		case m = <-q.interactive:
+		default:
+			select {
+			case m = <-q.interactive:
+			case m = <-q.bulk:
+			case <-q.stop:
+				return
+			}
+		}
+		q.write(m)
+	}
+}
+
+func (q *laneQueue) write(m laneMessage) {
+	if m.flushed != nil {
+		close(m.flushed)
+		return
+	}
+	if len(m.payload) >= q.p.threshold {
+		atomic.AddInt64(&q.p.bulk, 1)
+	} else {
+		atomic.AddInt64(&q.p.interactive, 1)
+		if len(q.bulk) > 0 {
+			atomic.AddInt64(&q.p.overtaken, 1)
+		}
+	}
+	if _, failed := q.err.Load().(error); failed {
+		return
+	}
+	if err := q.ws.sendMessage(m.opcode, m.payload); err != nil {
+		q.err.Store(err)
+	}
+}
+
+func (p *PriorityLanes) Metrics() map[string]interface{} {
+	return map[string]interface{}{
+		"ws_lane_interactive_messages_total": atomic.LoadInt64(&p.interactive),
+		"ws_lane_bulk_messages_total":        atomic.LoadInt64(&p.bulk),
+		"ws_lane_overtaking_messages_total":  atomic.LoadInt64(&p.overtaken),
+	}
+}
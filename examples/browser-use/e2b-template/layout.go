@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+)
+
+const (
+	defaultScreenWidth  = 1920
+	defaultScreenHeight = 1080
+)
+
+// windowBounds mirrors CDP Browser.Bounds; nil fields are left unchanged
+type windowBounds struct {
+	Left        *int   `json:"left,omitempty"`
+	Top         *int   `json:"top,omitempty"`
+	Width       *int   `json:"width,omitempty"`
+	Height      *int   `json:"height,omitempty"`
+	WindowState string `json:"windowState,omitempty"`
+}
+
+func (b windowBounds) hasGeometry() bool {
+	return b.Left != nil || b.Top != nil || b.Width != nil || b.Height != nil
+}
+
+type targetWindow struct {
+	WindowID int          `json:"windowId"`
+	Bounds   windowBounds `json:"bounds"`
+}
+
+func getTargetWindow(ctx context.Context, conn *CDPConn, targetID string) (*targetWindow, error) {
+	var window targetWindow
+	if err := conn.CallResult(ctx, "", "Browser.getWindowForTarget", map[string]interface{}{"targetId": targetID}, &window); err != nil {
+		return nil, err
+	}
+	return &window, nil
+}
+
+// Chrome refuses to move or resize a minimized, maximized or fullscreen
+// window, so such windows are restored to normal first
+func setWindowBounds(ctx context.Context, conn *CDPConn, window *targetWindow, bounds windowBounds) error {
+	if bounds.hasGeometry() {
+		if bounds.WindowState != "" && bounds.WindowState != "normal" {
+			return fmt.Errorf("windowState %q cannot be combined with position or size", bounds.WindowState)
+		}
+		if window.Bounds.WindowState != "" && window.Bounds.WindowState != "normal" {
+			if _, err := conn.Call(ctx, "", "Browser.setWindowBounds", map[string]interface{}{
+				"windowId": window.WindowID,
+				"bounds":   windowBounds{WindowState: "normal"},
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := conn.Call(ctx, "", "Browser.setWindowBounds", map[string]interface{}{
+		"windowId": window.WindowID,
+		"bounds":   bounds,
+	})
+	return err
+}
+
+// Handle GET /targets/{id}/window, returning the window id and bounds
+func (c *ChromeDevToolsClient) handleGetWindow(w http.ResponseWriter, r *http.Request) {
+	if !c.allowCommands(w, r, "Browser.getWindowForTarget") {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), c.client.Timeout)
+	defer cancel()
+
+	conn, err := c.control.Conn()
+	if err == nil {
+		var window *targetWindow
+		if window, err = getTargetWindow(ctx, conn, r.PathValue("id")); err == nil {
+			writeJSON(w, http.StatusOK, window)
+			return
+		}
+	}
+	c.errorCount++
+	log.Printf("❌ Failed to get window of %s: %v", r.PathValue("id"), err)
+	http.Error(w, fmt.Sprintf("Failed to get window: %v", err), http.StatusBadGateway)
+}
+
+/*
+Handle PUT /targets/{id}/window
+Request example:
+
+	{"left": 0, "top": 0, "width": 960, "height": 1080}
+	{"windowState": "maximized"}
+*/
+func (c *ChromeDevToolsClient) handleSetWindow(w http.ResponseWriter, r *http.Request) {
+	var bounds windowBounds
+	if !readJSON(w, r, &bounds) {
+		return
+	}
+	if bounds.hasGeometry() && bounds.WindowState != "" && bounds.WindowState != "normal" {
+		http.Error(w, "windowState other than normal cannot be combined with position or size", http.StatusBadRequest)
+		return
+	}
+	if !c.allowCommands(w, r, "Browser.getWindowForTarget", "Browser.setWindowBounds") {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), c.client.Timeout)
+	defer cancel()
+
+	targetID := r.PathValue("id")
+	conn, err := c.control.Conn()
+	if err == nil {
+		var window *targetWindow
+		if window, err = getTargetWindow(ctx, conn, targetID); err == nil {
+			if err = setWindowBounds(ctx, conn, window, bounds); err == nil {
+				window, err = getTargetWindow(ctx, conn, targetID)
+			}
+		}
+		if err == nil {
+			log.Printf("🪟 Updated window %d of %s", window.WindowID, c.labels.Describe(targetID))
+			writeJSON(w, http.StatusOK, window)
+			return
+		}
+	}
+	c.errorCount++
+	log.Printf("❌ Failed to set window of %s: %v", targetID, err)
+	http.Error(w, fmt.Sprintf("Failed to set window: %v", err), http.StatusBadGateway)
+}
+
+// Handle POST /targets/{id}/activate, bringing the tab and its window to front
+func (c *ChromeDevToolsClient) handleActivateTarget(w http.ResponseWriter, r *http.Request) {
+	if !c.allowCommands(w, r, "Target.activateTarget") {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), c.client.Timeout)
+	defer cancel()
+
+	conn, err := c.control.Conn()
+	if err == nil {
+		_, err = conn.Call(ctx, "", "Target.activateTarget", map[string]interface{}{"targetId": r.PathValue("id")})
+	}
+	if err != nil {
+		c.errorCount++
+		log.Printf("❌ Failed to activate %s: %v", r.PathValue("id"), err)
+		http.Error(w, fmt.Sprintf("Failed to activate target: %v", err), http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+Handle POST /layout/tile
+Request example:
+
+	{"targetIds": ["A1...", "B2..."], "columns": 2, "screen": {"width": 1920, "height": 1080}}
+
+Arranges the windows of the given page targets (default: all) in a grid
+for the human-takeover view. Tabs sharing a window are tiled once.
+*/
+func (c *ChromeDevToolsClient) handleTile(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		TargetIDs []string `json:"targetIds"`
+		Columns   int      `json:"columns"`
+		Screen    struct {
+			Width  int `json:"width"`
+			Height int `json:"height"`
+		} `json:"screen"`
+	}
+	if r.ContentLength != 0 && !readJSON(w, r, &req) {
+		return
+	}
+	if req.Screen.Width <= 0 || req.Screen.Height <= 0 {
+		req.Screen.Width, req.Screen.Height = defaultScreenWidth, defaultScreenHeight
+	}
+	if !c.allowCommands(w, r, "Browser.getWindowForTarget", "Browser.setWindowBounds") {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), c.client.Timeout)
+	defer cancel()
+
+	fail := func(err error) {
+		c.errorCount++
+		log.Printf("❌ Failed to tile windows: %v", err)
+		http.Error(w, fmt.Sprintf("Failed to tile windows: %v", err), http.StatusBadGateway)
+	}
+
+	if len(req.TargetIDs) == 0 {
+		infos, err := c.listTargets(ctx)
+		if err != nil {
+			fail(err)
+			return
+		}
+		for _, info := range infos {
+			if info.Type == "page" {
+				req.TargetIDs = append(req.TargetIDs, info.TargetID)
+			}
+		}
+	}
+	conn, err := c.control.Conn()
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	var windows []*targetWindow
+	seen := make(map[int]bool)
+	for _, targetID := range req.TargetIDs {
+		window, err := getTargetWindow(ctx, conn, targetID)
+		if err != nil {
+			fail(fmt.Errorf("%s: %w", targetID, err))
+			return
+		}
+		if !seen[window.WindowID] {
+			seen[window.WindowID] = true
+			windows = append(windows, window)
+		}
+	}
+	if len(windows) == 0 {
+		writeJSON(w, http.StatusOK, []*targetWindow{})
+		return
+	}
+
+	columns := req.Columns
+	if columns <= 0 {
+		columns = int(math.Ceil(math.Sqrt(float64(len(windows)))))
+	}
+	rows := (len(windows) + columns - 1) / columns
+	width, height := req.Screen.Width/columns, req.Screen.Height/rows
+	for i, window := range windows {
+		left, top := (i%columns)*width, (i/columns)*height
+		bounds := windowBounds{Left: &left, Top: &top, Width: &width, Height: &height, WindowState: "normal"}
+		if err := setWindowBounds(ctx, conn, window, bounds); err != nil {
+			fail(fmt.Errorf("window %d: %w", window.WindowID, err))
+			return
+		}
+		window.Bounds = bounds
+	}
+	log.Printf("🪟 Tiled %d windows in %d columns", len(windows), columns)
+	writeJSON(w, http.StatusOK, windows)
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long finished queue tickets stay pollable
+const leaseTicketRetention = 5 * time.Minute
+
+var errPoolExhausted = errors.New("lease pool exhausted")
+
+type leaseWaiter struct {
+	priority int
+	seq      int64
+	enqueued time.Time
+	granted  chan struct{}
+}
+
+// LeasePool limits the number of concurrently reserved targets. Requests
+// beyond the capacity wait in a priority queue (higher first, FIFO within a
+// priority) instead of failing immediately.
+type LeasePool struct {
+	clock    Clock
+	capacity int
+
+	mu     sync.Mutex
+	active int
+	queue  []*leaseWaiter
+	seq    int64
+
+	waits     int64
+	waitTotal time.Duration
+	waitMax   time.Duration
+	timeouts  int64
+}
+
+// NewLeasePool creates a pool; capacity 0 means unlimited
+func NewLeasePool(clock Clock, capacity int) *LeasePool {
+	return &LeasePool{clock: clock, capacity: capacity}
+}
+
+// Enqueue requests a slot. The waiter is granted immediately when the pool
+// has room, otherwise it is queued by priority.
+func (p *LeasePool) Enqueue(priority int) *leaseWaiter {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.seq++
+	w := &leaseWaiter{priority: priority, seq: p.seq, enqueued: p.clock.Now(), granted: make(chan struct{})}
+	if p.capacity <= 0 || (p.active < p.capacity && len(p.queue) == 0) {
+		p.active++
+		close(w.granted)
+		return w
+	}
+
+	p.queue = append(p.queue, w)
+	sort.SliceStable(p.queue, func(i, j int) bool {
+		if p.queue[i].priority != p.queue[j].priority {
+			return p.queue[i].priority > p.queue[j].priority
+		}
+		return p.queue[i].seq < p.queue[j].seq
+	})
+	return w
+}
+
+// Wait blocks until the waiter holds a slot. A non-positive queueTimeout
+// fails at once when the pool is full.
+func (p *LeasePool) Wait(ctx context.Context, w *leaseWaiter, queueTimeout time.Duration) error {
+	select {
+	case <-w.granted:
+		return nil
+	default:
+	}
+
+	if queueTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, queueTimeout)
+		defer cancel()
+
+		select {
+		case <-w.granted:
+			p.recordWait(p.clock.Since(w.enqueued))
+			return nil
+		case <-ctx.Done():
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-w.granted:
+		// Granted while timing out; keep the slot
+		p.recordWaitLocked(p.clock.Since(w.enqueued))
+		return nil
+	default:
+	}
+	p.removeLocked(w)
+	if queueTimeout > 0 {
+		p.timeouts++
+		return fmt.Errorf("%w: timed out after %v in queue", errPoolExhausted, queueTimeout)
+	}
+	return errPoolExhausted
+}
+
+// Position returns the 1-based queue position, or 0 when not queued
+func (p *LeasePool) Position(w *leaseWaiter) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, q := range p.queue {
+		if q == w {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Release frees a slot and hands it to the head of the queue
+func (p *LeasePool) Release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.active--
+	if len(p.queue) > 0 && (p.capacity <= 0 || p.active < p.capacity) {
+		next := p.queue[0]
+		p.queue = p.queue[1:]
+		p.active++
+		close(next.granted)
+	}
+}
+
+// Occupy takes a slot without queueing, for a lease that already exists
+// such as one restored from -stateFile; the pool may go over capacity
+func (p *LeasePool) Occupy() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.active++
+}
+
+func (p *LeasePool) removeLocked(w *leaseWaiter) {
+	for i, q := range p.queue {
+		if q == w {
+			p.queue = append(p.queue[:i], p.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+func (p *LeasePool) recordWait(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.recordWaitLocked(d)
+}
+
+func (p *LeasePool) recordWaitLocked(d time.Duration) {
+	p.waits++
+	p.waitTotal += d
+	if d > p.waitMax {
+		p.waitMax = d
+	}
+}
+
+func (p *LeasePool) Metrics() map[string]interface{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return map[string]interface{}{
+		"leases_active":              p.active,
+		"lease_capacity":             p.capacity,
+		"lease_queue_length":         len(p.queue),
+		"lease_queue_waits_total":    p.waits,
+		"lease_queue_wait_seconds":   p.waitTotal.Seconds(),
+		"lease_queue_wait_max":       p.waitMax.Seconds(),
+		"lease_queue_timeouts_total": p.timeouts,
+	}
+}
+
+// leaseTicket tracks an asynchronous lease request through the queue
+type leaseTicket struct {
+	ID     string
+	waiter *leaseWaiter
+	host   string
+	done   chan struct{}
+
+	res *Reservation
+	err error
+}
+
+type leaseRequest struct {
+	reserveRequest
+	// Return a queue ticket immediately instead of blocking
+	Async bool `json:"async"`
+}
+
+func (c *ChromeDevToolsClient) leaseResponse(host string, res *Reservation) *LeaseGrant {
+	return &LeaseGrant{
+		Token:                res.Token,
+		TargetID:             res.TargetID,
+		WebSocketDebuggerURL: c.publicPageURL(host, res.TargetID),
+		Task:                 res.Task,
+		SessionID:            res.SessionID,
+		Channel:              res.Channel,
+		Mode:                 res.Mode,
+		Locale:               res.Locale,
+	}
+}
+
+/*
+Handle POST /lease: reserve and redeem a target in one step
+Request example:
+
+	{"priority": 10, "queueTimeoutMs": 60000, "async": true, "startUrl": "https://example.com", "channel": "beta", "mode": "headful"}
+
+Accepts the same bootstrap fields as /reserve. When the pool is full the
+request waits in the priority queue for up to queueTimeoutMs; with "async"
+it returns 202 and a ticket to poll at GET /lease/queue/{ticket}.
+*/
+func (c *ChromeDevToolsClient) handleLease(w http.ResponseWriter, r *http.Request) {
+	var req leaseRequest
+	if r.ContentLength != 0 && !readJSON(w, r, &req) {
+		return
+	}
+	var ok bool
+	if req.Task, ok = c.requestTask(w, r, req.Task); !ok {
+		return
+	}
+	if req.SessionID, ok = requestSessionID(w, r, req.SessionID); !ok {
+		return
+	}
+	if err := req.bootstrapSpec.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !c.resolveInstance(w, req.reserveRequest) {
+		return
+	}
+	if !c.allowCommands(w, r, "Target.createTarget") {
+		return
+	}
+
+	m := c.reservations
+	ticket := &leaseTicket{
+		ID:     newToken(),
+		waiter: m.pool.Enqueue(req.Priority),
+		host:   r.Host,
+		done:   make(chan struct{}),
+	}
+
+	if req.Async {
+		m.mu.Lock()
+		m.tickets[ticket.ID] = ticket
+		m.mu.Unlock()
+
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(req.QueueTimeoutMs)*time.Millisecond+c.client.Timeout)
+			defer cancel()
+			ticket.res, ticket.err = m.leaseWith(ctx, req.reserveRequest, ticket.waiter)
+			if ticket.err == nil {
+				c.tasks.RecordLease(req.Task)
+			}
+			close(ticket.done)
+			m.clock.AfterFunc(leaseTicketRetention, func() {
+				m.mu.Lock()
+				delete(m.tickets, ticket.ID)
+				m.mu.Unlock()
+			})
+		}()
+
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{
+			"ticket":    ticket.ID,
+			"position":  m.pool.Position(ticket.waiter),
+			"statusUrl": "/lease/queue/" + ticket.ID,
+		})
+		return
+	}
+
+	// Synchronous waits are bounded by the server write timeout
+	ctx, cancel := context.WithTimeout(r.Context(), c.apiDeadline(0))
+	defer cancel()
+
+	res, err := m.leaseWith(ctx, req.reserveRequest, ticket.waiter)
+	if errors.Is(err, errPoolExhausted) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		c.errorCount++
+		log.Printf("❌ Lease failed: %v", err)
+		http.Error(w, fmt.Sprintf("Lease failed: %v", err), http.StatusBadGateway)
+		return
+	}
+	c.tasks.RecordLease(req.Task)
+	writeJSON(w, http.StatusCreated, c.leaseResponse(r.Host, res))
+}
+
+// Reserve and immediately redeem using an already enqueued waiter
+func (m *ReservationManager) leaseWith(ctx context.Context, req reserveRequest, w *leaseWaiter) (*Reservation, error) {
+	res, err := m.reserve(ctx, req, w)
+	if err != nil {
+		return nil, err
+	}
+	return m.Redeem(res.Token)
+}
+
+/*
+Handle GET /lease/queue/{ticket}
+Returns {"state": "queued", "position": N} until the lease is granted or
+fails. Clients sending "Accept: text/event-stream" receive position updates
+as server-sent events instead of polling.
+*/
+func (c *ChromeDevToolsClient) handleLeaseQueue(w http.ResponseWriter, r *http.Request) {
+	m := c.reservations
+	m.mu.Lock()
+	ticket, ok := m.tickets[r.PathValue("ticket")]
+	m.mu.Unlock()
+	if !ok {
+		http.Error(w, "unknown ticket", http.StatusNotFound)
+		return
+	}
+
+	if !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		writeJSON(w, http.StatusOK, c.ticketStatus(ticket))
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	rc := http.NewResponseController(w)
+	ticker := c.clock.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	lastPosition := -1
+	for {
+		status := c.ticketStatus(ticket)
+		position := -1
+		if status.Position != nil {
+			position = *status.Position
+		}
+		if status.State != "queued" || position != lastPosition {
+			// The stream outlives the server's write timeout
+			if c.client.Timeout > 0 {
+				rc.SetWriteDeadline(time.Now().Add(c.client.Timeout))
+			}
+			writeSSE(w, status.Event, status)
+			flusher.Flush()
+			lastPosition = position
+		}
+		if status.State != "queued" {
+			return
+		}
+		select {
+		case <-ticker.C():
+		case <-ticket.done:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (c *ChromeDevToolsClient) ticketStatus(t *leaseTicket) *LeaseQueueEvent {
+	select {
+	case <-t.done:
+	default:
+		position := c.reservations.pool.Position(t.waiter)
+		return &LeaseQueueEvent{EventHeader: newEventHeader("queued"), State: "queued", Position: &position}
+	}
+	if t.err != nil {
+		return &LeaseQueueEvent{EventHeader: newEventHeader("failed"), State: "failed", Error: t.err.Error()}
+	}
+	return &LeaseQueueEvent{EventHeader: newEventHeader("granted"), State: "granted", Lease: c.leaseResponse(t.host, t.res)}
+}
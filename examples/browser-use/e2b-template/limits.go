@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+)
+
+// Bytes kept from each end of an oversize message: enough for the id and
+// session id CDP messages carry first or last
+const oversizeKeep = 256
+
+// Close code for a peer sending a message too big to process
+const wsCloseMessageTooBig = 1009
+
+// MessageLimit caps the size of CDP messages relayed either way
+// (-maxMessageSize). An oversize message is read past in chunks instead of
+// held in memory. The client gets a CDP error in place of an oversize
+// response, and for an oversize command it sent; oversize events are
+// dropped.
+type MessageLimit struct {
+	max int
+
+	commands  int64
+	responses int64
+	events    int64
+}
+
+func NewMessageLimit(max int) *MessageLimit {
+	return &MessageLimit{max: max}
+}
+
+// The limit in bytes, zero when there is none
+func (l *MessageLimit) bytes() int {
+	if l == nil {
+		return 0
+	}
+	return l.max
+}
+
+func (l *MessageLimit) Metrics() map[string]interface{} {
+	return map[string]interface{}{
+		"ws_oversize_commands_total":  atomic.LoadInt64(&l.commands),
+		"ws_oversize_responses_total": atomic.LoadInt64(&l.responses),
+		"ws_oversize_events_total":    atomic.LoadInt64(&l.events),
+	}
+}
+
+// oversizeFrame is what readFrame keeps of a frame over the connection's
+// limit, returned as an error
+type oversizeFrame struct {
+	fin    bool
+	opcode byte
+	size   int64
+	head   []byte
+	tail   []byte
+}
+
+func (f *oversizeFrame) Error() string {
+	return fmt.Sprintf("websocket frame of %d bytes exceeds limit", f.size)
+}
+
+// Read past a frame payload, keeping only its ends
+func (c *WebSocketConn) skimFrame(fin bool, opcode byte, length int64, masked bool, mask [4]byte) error {
+	f := &oversizeFrame{fin: fin, opcode: opcode, size: length}
+	buf := make([]byte, 32<<10)
+	for off := int64(0); off < length; {
+		n := int64(len(buf))
+		if length-off < n {
+			n = length - off
+		}
+		chunk := buf[:n]
+		if _, err := io.ReadFull(c.br, chunk); err != nil {
+			return err
+		}
+		if masked {
+			for i := range chunk {
+				chunk[i] ^= mask[(off+int64(i))%4]
+			}
+		}
+		f.head, f.tail = keepEnds(f.head, f.tail, chunk)
+		off += n
+	}
+	return f
+}
+
+// Extend the kept ends of a message by data
+func keepEnds(head, tail, data []byte) ([]byte, []byte) {
+	if n := oversizeKeep - len(head); n > 0 {
+		if n > len(data) {
+			n = len(data)
+		}
+		head = append(head, data[:n]...)
+	}
+	if len(data) >= oversizeKeep {
+		return head, append(tail[:0], data[len(data)-oversizeKeep:]...)
+	}
+	tail = append(tail, data...)
+	if len(tail) > oversizeKeep {
+		tail = append(tail[:0], tail[len(tail)-oversizeKeep:]...)
+	}
+	return head, tail
+}
+
+// oversizeMessage is what the relay keeps of a message over the limit
+type oversizeMessage struct {
+	opcode byte
+	size   int64
+	head   []byte
+	tail   []byte
+}
+
+func (o *oversizeMessage) Error() string {
+	return fmt.Sprintf("websocket message of %d bytes exceeds limit", o.size)
+}
+
+func (o *oversizeMessage) add(size int64, head, tail []byte) {
+	o.size += size
+	o.head, _ = keepEnds(o.head, nil, head)
+	_, o.tail = keepEnds(nil, o.tail, tail)
+}
+
+// The id and session id of a CDP message, found at the start (Chrome puts
+// "id" first, clients often after "method") or the end (Chrome puts
+// "sessionId" last)
+var (
+	oversizeHeadID      = regexp.MustCompile(`^\s*\{\s*(?:"method"\s*:\s*"[^"]*"\s*,\s*)?"id"\s*:\s*(\d+)`)
+	oversizeTailID      = regexp.MustCompile(`"id"\s*:\s*(\d+)\s*(?:,\s*"sessionId"\s*:\s*"[^"]*"\s*)?\}\s*$`)
+	oversizeHeadSession = regexp.MustCompile(`^\s*\{[^{]*?"sessionId"\s*:\s*"([^"]*)"`)
+	oversizeTailSession = regexp.MustCompile(`"sessionId"\s*:\s*"([^"]*)"\s*(?:,\s*"id"\s*:\s*\d+\s*)?\}\s*$`)
+	oversizeHeadMethod  = regexp.MustCompile(`^\s*\{[^{]*?"method"\s*:\s*"([^"]*)"`)
+)
+
+func (o *oversizeMessage) ids() (id, sessionID, method string) {
+	if m := oversizeHeadID.FindSubmatch(o.head); m != nil {
+		id = string(m[1])
+	} else if m := oversizeTailID.FindSubmatch(o.tail); m != nil {
+		id = string(m[1])
+	}
+	if m := oversizeHeadSession.FindSubmatch(o.head); m != nil {
+		sessionID = string(m[1])
+	} else if m := oversizeTailSession.FindSubmatch(o.tail); m != nil {
+		sessionID = string(m[1])
+	}
+	if m := oversizeHeadMethod.FindSubmatch(o.head); m != nil {
+		method = string(m[1])
+	}
+	return id, sessionID, method
+}
+
+// Handle an oversize message from the client (a command) or Chrome (a
+// response or event) by answering the client in Chrome's place
+func (m *messageRelay) oversize(fromClient bool) func(o *oversizeMessage) {
+	return func(o *oversizeMessage) {
+		id, sessionID, method := o.ids()
+		kind := "Response"
+		switch {
+		case fromClient:
+			kind = "Command"
+			atomic.AddInt64(&m.limit.commands, 1)
+		case id == "":
+			atomic.AddInt64(&m.limit.events, 1)
+			log.Printf("📏 Dropped %s event of %d bytes to %s: over the %d byte message limit", method, o.size, &m.ctx, m.limit.max)
+			return
+		default:
+			atomic.AddInt64(&m.limit.responses, 1)
+			m.mu.Lock()
+			method = m.pending[pendingKey(sessionID, []byte(id))]
+			delete(m.pending, pendingKey(sessionID, []byte(id)))
+			m.mu.Unlock()
+		}
+		log.Printf("📏 %s %s (id %s) of %d bytes from %s exceeds the %d byte message limit", kind, method, id, o.size, &m.ctx, m.limit.max)
+		if id == "" {
+			return
+		}
+		m.reject(&relayEnvelope{ID: []byte(id), SessionID: sessionID, Method: method}, m.limit.rejection(kind, o.size))
+	}
+}
+
+// The error the client gets in place of an oversize command or response
+func (l *MessageLimit) rejection(kind string, size int64) *CDPError {
+	return &CDPError{
+		Code:    -32000,
+		Message: fmt.Sprintf("%s of %d bytes exceeds the proxy's message size limit of %d bytes", kind, size, l.max),
+	}
+}
+
+// Answer an oversize command from a client sharing a connection
+// (cdp-multiplexing) in Chrome's place
+func (l *MessageLimit) rejectShared(client *muxClient, o *oversizeMessage, from string) {
+	id, sessionID, method := o.ids()
+	atomic.AddInt64(&l.commands, 1)
+	log.Printf("📏 Command %s (id %s) of %d bytes from %s exceeds the %d byte message limit", method, id, o.size, from, l.max)
+	if id != "" {
+		client.fail(json.RawMessage(id), sessionID, l.rejection("Command", o.size).Message)
+	}
+}
+
+// Answer the client of an oversize response on a shared connection in
+// Chrome's place; oversize events are dropped
+func (l *MessageLimit) answerShared(up *muxUpstream, o *oversizeMessage) {
+	id, _, method := o.ids()
+	upstreamID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		atomic.AddInt64(&l.events, 1)
+		log.Printf("📏 Dropped %s event of %d bytes on shared connection %s: over the %d byte message limit", method, o.size, up.key, l.max)
+		return
+	}
+	atomic.AddInt64(&l.responses, 1)
+	up.mu.Lock()
+	p, ok := up.pending[upstreamID]
+	delete(up.pending, upstreamID)
+	ok = ok && up.clients[p.client]
+	up.mu.Unlock()
+	log.Printf("📏 Response %s (id %s) of %d bytes on shared connection %s exceeds the %d byte message limit", p.method, id, o.size, up.key, l.max)
+	if ok {
+		p.client.fail(p.id, p.sessionID, l.rejection("Response", o.size).Message)
+	}
+}
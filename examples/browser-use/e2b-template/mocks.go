@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+MockRule answers matching requests with a static response. Rules are loaded
+from the -mockRules JSON file, for example:
+
+	[
+	   {"urlPattern": "https://api.example.com/user*", "status": 200,
+	    "headers": {"Content-Type": "application/json"}, "body": "{\"name\":\"test\"}"},
+	   {"urlPattern": "https://cdn.example.com/logo.png", "file": "/app/fixtures/logo.png"}
+	]
+
+The first matching rule wins. "file" takes precedence over "body".
+*/
+type MockRule struct {
+	URLPattern string            `json:"urlPattern"`
+	Method     string            `json:"method,omitempty"`
+	Status     int               `json:"status,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Body       string            `json:"body,omitempty"`
+	File       string            `json:"file,omitempty"`
+
+	matcher *regexp.Regexp
+	hits    int64
+}
+
+// RequestMocker fulfills requests from mock rules. Mocking is on for every
+// target by default and can be toggled per page through the admin API; the
+// toggle of a page also covers its out-of-process iframes.
+type RequestMocker struct {
+	rules []*MockRule
+
+	mu        sync.Mutex
+	overrides map[string]bool
+}
+
+func LoadRequestMocker(path string) (*RequestMocker, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []*MockRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for i, rule := range rules {
+		if rule.URLPattern == "" {
+			return nil, fmt.Errorf("rule %d: urlPattern is required", i)
+		}
+		rule.matcher = compileURLPattern(rule.URLPattern)
+		if rule.Status == 0 {
+			rule.Status = http.StatusOK
+		}
+	}
+	log.Printf("🎭 Loaded %d mock rules from %s", len(rules), path)
+	return &RequestMocker{rules: rules, overrides: make(map[string]bool)}, nil
+}
+
+func (m *RequestMocker) enabledFor(targetID string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	enabled, ok := m.overrides[targetID]
+	return !ok || enabled
+}
+
+func (m *RequestMocker) SetEnabled(targetID string, enabled bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.overrides[targetID] = enabled
+}
+
+func (m *RequestMocker) match(method, rawURL string) *MockRule {
+	for _, rule := range m.rules {
+		if (rule.Method == "" || strings.EqualFold(rule.Method, method)) && rule.matcher.MatchString(rawURL) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (m *RequestMocker) HandleRequestPaused(ctx context.Context, s *PageSession, ev *FetchRequestPaused) bool {
+	// The toggle is per page, covering the page's out-of-process iframes
+	if ev.IsResponseStage() || !m.enabledFor(s.PageID) {
+		return false
+	}
+	rule := m.match(ev.Request.Method, ev.Request.URL)
+	if rule == nil {
+		return false
+	}
+
+	body := []byte(rule.Body)
+	if rule.File != "" {
+		data, err := os.ReadFile(rule.File)
+		if err != nil {
+			log.Printf("⚠️ Mock file %s unreadable: %v", rule.File, err)
+			return false
+		}
+		body = data
+	}
+
+	headers := make([]map[string]string, 0, len(rule.Headers))
+	for name, value := range rule.Headers {
+		headers = append(headers, map[string]string{"name": name, "value": value})
+	}
+	_, err := s.Call(ctx, "Fetch.fulfillRequest", map[string]interface{}{
+		"requestId":       ev.RequestID,
+		"responseCode":    rule.Status,
+		"responseHeaders": headers,
+		"body":            base64.StdEncoding.EncodeToString(body),
+	})
+	if err != nil {
+		log.Printf("⚠️ Failed to fulfill mock for %s: %v", ev.Request.URL, err)
+		return false
+	}
+
+	m.mu.Lock()
+	rule.hits++
+	m.mu.Unlock()
+	log.Printf("🎭 Mocked %s %s", ev.Request.Method, ev.Request.URL)
+	return true
+}
+
+// Handle GET /admin/mocks, listing rules, hit counts and per-target state
+func (c *ChromeDevToolsClient) handleGetMocks(w http.ResponseWriter, r *http.Request) {
+	if c.mocks == nil {
+		http.Error(w, "Mocking is disabled (set -mockRules)", http.StatusNotFound)
+		return
+	}
+	m := c.mocks
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rules := make([]map[string]interface{}, 0, len(m.rules))
+	for _, rule := range m.rules {
+		rules = append(rules, map[string]interface{}{
+			"urlPattern": rule.URLPattern,
+			"method":     rule.Method,
+			"status":     rule.Status,
+			"hits":       rule.hits,
+		})
+	}
+	targets := make([]string, 0, len(m.overrides))
+	for id := range m.overrides {
+		targets = append(targets, id)
+	}
+	sort.Strings(targets)
+	overrides := make(map[string]bool, len(targets))
+	for _, id := range targets {
+		overrides[id] = m.overrides[id]
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"rules":     rules,
+		"overrides": overrides,
+	})
+}
+
+/*
+Handle POST /admin/mocks, toggling mocking for one target
+Request example:
+
+	{"targetId": "27E1...", "enabled": false}
+*/
+func (c *ChromeDevToolsClient) handleSetMocks(w http.ResponseWriter, r *http.Request) {
+	if c.mocks == nil {
+		http.Error(w, "Mocking is disabled (set -mockRules)", http.StatusNotFound)
+		return
+	}
+	var req struct {
+		TargetID string `json:"targetId"`
+		Enabled  *bool  `json:"enabled"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.TargetID == "" || req.Enabled == nil {
+		http.Error(w, "targetId and enabled are required", http.StatusBadRequest)
+		return
+	}
+	c.mocks.SetEnabled(req.TargetID, *req.Enabled)
+	log.Printf("🎭 Mocking for %s set to %v", req.TargetID, *req.Enabled)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"targetId": req.TargetID, "enabled": *req.Enabled})
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Register the optional page modules enabled by command-line flags
+func (c *ChromeDevToolsClient) registerModules() {
+	if artifactDir != "" {
+		aead, err := NewArtifactCipher(artifactKeyFile, sandboxID)
+		if err != nil {
+			log.Fatalf("❌ Failed to load artifact key: %v", err)
+		}
+		codec, err := lookupCodec(artifactCodec, artifactCodecLevel)
+		if err != nil {
+			log.Fatalf("❌ Invalid -artifactCodec: %v", err)
+		}
+		store, err := NewArtifactStore(c.clock, artifactDir, aead, codec, artifactCodecLevel)
+		if err != nil {
+			log.Fatalf("❌ Failed to open artifact store %s: %v", artifactDir, err)
+		}
+		c.artifacts = store
+		log.Printf("🗄️ Artifact store: %s (encrypted: %v, codec: %s)", artifactDir, aead != nil, codec.Name)
+	}
+
+	if recordSnapshot != "" {
+		recorder, err := NewSnapshotRecorder(recordSnapshot, c.upstream.HostPort())
+		if err != nil {
+			log.Fatalf("❌ Failed to create snapshot %s: %v", recordSnapshot, err)
+		}
+		c.recorder = recorder
+		log.Printf("📼 Recording discovery responses and client CDP traffic to %s", recordSnapshot)
+	}
+
+	if recordDir != "" {
+		recorder, err := NewCDPRecorder(c.clock, recordDir, c.artifacts)
+		if err != nil {
+			log.Fatalf("❌ Failed to create recording directory %s: %v", recordDir, err)
+		}
+		c.cdpRecorder = recorder
+		c.metricSources = append(c.metricSources, recorder.Metrics)
+		if c.artifacts != nil {
+			log.Printf("📼 Recording client CDP traffic per session into the artifact store (spooled in %s)", recordDir)
+		} else {
+			log.Printf("⚠️ Recording client CDP traffic per session to %s unencrypted; set -artifactDir to store recordings as artifacts", recordDir)
+		}
+	}
+
+	if downloadDir != "" {
+		downloads, err := NewDownloadBridge(c.clock, downloadDir, c.control)
+		if err != nil {
+			log.Fatalf("❌ Failed to create download directory %s: %v", downloadDir, err)
+		}
+		c.downloads = downloads
+		c.metricSources = append(c.metricSources, downloads.Metrics)
+		go downloads.Run()
+		log.Printf("📥 Serving browser downloads from %s at /downloads", downloads.dir)
+	}
+
+	c.warmup = NewWarmup(c.clock, splitList(warmupURLs), warmupTabs)
+
+	if dismissConsent {
+		consent := NewConsentDismisser(c.clock, consentSelectors)
+		c.pages.Register(consent)
+		c.metricSources = append(c.metricSources, consent.Metrics)
+	}
+
+	if consoleCapture {
+		c.console = NewConsoleCapture(c.clock, consoleBufferSize)
+		c.pages.Register(c.console)
+		c.metricSources = append(c.metricSources, c.console.Metrics)
+	}
+
+	if exceptionWebhook != "" {
+		exceptions := NewExceptionWebhook(exceptionWebhook, c.clock)
+		c.pages.Register(exceptions)
+		c.metricSources = append(c.metricSources, exceptions.Metrics)
+		go exceptions.Run()
+	}
+
+	if recordVideo {
+		if c.artifacts == nil {
+			log.Printf("⚠️ -recordVideo requires -artifactDir, video recording disabled")
+		} else if video, err := NewSessionVideo(c.clock, c.artifacts, ffmpegBinary, videoFormat, videoFPS, videoMaxWidth, videoMaxHeight); err != nil {
+			log.Printf("⚠️ Video recording disabled: %v", err)
+		} else {
+			c.video = video
+			c.pages.Register(video)
+			c.metricSources = append(c.metricSources, video.Metrics)
+		}
+	}
+
+	if thumbnailInterval > 0 {
+		if c.artifacts == nil {
+			log.Printf("⚠️ -thumbnailInterval requires -artifactDir, thumbnails disabled")
+		} else {
+			thumbnails := NewSessionThumbnails(c.clock, c.artifacts, thumbnailInterval, thumbnailWidth)
+			c.pages.Register(thumbnails)
+			c.metricSources = append(c.metricSources, thumbnails.Metrics)
+		}
+	}
+
+	if deterministic {
+		rendering := NewDeterministicRendering()
+		c.pages.Register(rendering)
+		c.metricSources = append(c.metricSources, rendering.Metrics)
+	}
+
+	if networkThrottle != "" {
+		conditions, err := ParseNetworkConditions(networkThrottle)
+		if err != nil {
+			log.Fatalf("❌ Invalid -networkThrottle: %v", err)
+		}
+		c.throttle = NewNetworkThrottle(conditions, c.pages)
+		c.pages.Register(c.throttle)
+		c.metricSources = append(c.metricSources, c.throttle.Metrics)
+	}
+
+	// Handler order matters: mocks answer before the blocker sees a request
+	fetch := NewFetchInterceptor()
+	if mockRules != "" {
+		mocker, err := LoadRequestMocker(mockRules)
+		if err != nil {
+			log.Fatalf("❌ Failed to load mock rules: %v", err)
+		}
+		c.mocks = mocker
+		fetch.Register(mocker)
+	}
+	if reputationList != "" || reputationURL != "" {
+		var blocklist map[string]bool
+		if reputationList != "" {
+			var err error
+			if blocklist, err = loadDomainBlocklist(reputationList); err != nil {
+				log.Fatalf("❌ Failed to load domain blocklist: %v", err)
+			}
+		}
+		var services []ReputationService
+		if reputationURL != "" {
+			services = append(services, NewHTTPReputationService(reputationURL, c.client))
+		}
+		reputation := NewDomainReputation(c.clock, blocklist, services, reputationCacheTTL, reputationFailClosed)
+		fetch.Register(reputation)
+		c.metricSources = append(c.metricSources, reputation.Metrics)
+	}
+	if robotsUserAgent != "" {
+		c.robots = NewRobotsPolicy(c.clock, robotsUserAgent, robotsCacheTTL, c.client)
+		fetch.Register(c.robots)
+		c.metricSources = append(c.metricSources, c.robots.Metrics)
+	}
+	if originRateLimits != "" {
+		rates, err := parseOriginRates(originRateLimits)
+		if err != nil {
+			log.Fatalf("❌ Failed to parse -originRateLimits: %v", err)
+		}
+		limiter := NewOriginRateLimiter(c.clock, rates, originBurst, originMaxDelay)
+		fetch.Register(limiter)
+		c.metricSources = append(c.metricSources, limiter.Metrics)
+	}
+	if blockLists != "" {
+		blocker := NewRequestBlocker(c.clock, splitList(blockLists), blockListRefresh, c.client)
+		fetch.Register(blocker)
+		c.metricSources = append(c.metricSources, blocker.Metrics)
+	}
+	if capturePatterns != "" {
+		if c.artifacts == nil {
+			log.Printf("⚠️ -capturePatterns requires -artifactDir, response capture disabled")
+		} else {
+			capture := NewResponseCapture(splitList(capturePatterns), c.artifacts)
+			fetch.Register(capture)
+			c.metricSources = append(c.metricSources, capture.Metrics)
+		}
+	}
+	if fetch.Enabled() {
+		c.pages.Register(fetch)
+	}
+
+	if clientCompression {
+		compression, err := NewClientCompression(compressThreshold, compressLevel, compressTakeover)
+		if err != nil {
+			log.Fatalf("❌ Invalid client compression settings: %v", err)
+		}
+		c.compression = compression
+		c.metricSources = append(c.metricSources, compression.Metrics)
+	}
+	if wsPingInterval > 0 {
+		c.keepalive = NewKeepalive(c.clock, wsPingInterval, wsPingMisses)
+		c.metricSources = append(c.metricSources, c.keepalive.Metrics)
+	}
+	if wsIdleTimeout > 0 {
+		c.idle = NewIdleTimeout(c.clock, wsIdleTimeout)
+		c.metricSources = append(c.metricSources, c.idle.Metrics)
+	}
+	if featureEnabled("priority-lanes") {
+		c.lanes = NewPriorityLanes(bulkThreshold)
+		c.metricSources = append(c.metricSources, c.lanes.Metrics)
+	}
+	if maxMessageSize > 0 {
+		c.limit = NewMessageLimit(maxMessageSize)
+		c.metricSources = append(c.metricSources, c.limit.Metrics)
+	}
+	if uploadURL != "" {
+		codec, err := lookupCodec(uploadCodec, uploadCodecLevel)
+		if err != nil {
+			log.Fatalf("❌ Invalid -uploadCodec: %v", err)
+		}
+		upload, err := NewArtifactUpload(c.clock, uploadURL, uploadToken, uploadDeadline, uploadQueue, uploadPartSize, uploadAttempts, codec, uploadCodecLevel)
+		if err != nil {
+			log.Fatalf("❌ Artifact upload unavailable: %v", err)
+		}
+		c.upload = upload
+		c.metricSources = append(c.metricSources, upload.Metrics)
+		log.Printf("☁️ Uploading artifacts to %s at teardown", upload.base)
+	}
+	if startupHooks != "" {
+		hooks, err := LoadHooks(startupHooks, hookStartup)
+		if err != nil {
+			log.Fatalf("❌ Failed to load startup hooks: %v", err)
+		}
+		c.startup = hooks
+		c.metricSources = append(c.metricSources, hooks.Metrics)
+		log.Printf("🪝 %d startup hooks from %s", len(hooks.hooks), startupHooks)
+	}
+	if shutdownHooks != "" {
+		hooks, err := LoadHooks(shutdownHooks, hookShutdown)
+		if err != nil {
+			log.Fatalf("❌ Failed to load shutdown hooks: %v", err)
+		}
+		c.shutdown = hooks
+		c.metricSources = append(c.metricSources, hooks.Metrics)
+		log.Printf("🪝 %d shutdown hooks from %s", len(hooks.hooks), shutdownHooks)
+	}
+	if c.upload != nil || c.shutdown != nil || stateFile != "" {
+		c.watchSignals()
+	}
+	if adminACL != "" {
+		acl, err := LoadAdminACL(adminACL)
+		if err != nil {
+			log.Fatalf("❌ Failed to load admin ACL: %v", err)
+		}
+		c.acl = acl
+		c.metricSources = append(c.metricSources, acl.Metrics)
+		log.Printf("🔐 Admin ACL: %d roles from %s", len(acl.roles), adminACL)
+	}
+	if targetOverride && adminToken == "" && c.acl == nil {
+		// Without admin authentication anyone could reroute requests
+		log.Fatalf("❌ -targetOverride requires -adminToken or -adminACL")
+	}
+	if e2bAdmission || e2bTeardown {
+		sandbox, err := NewE2BSandbox(c.clock, e2bAPI, sandboxID, e2bAPIKey, c.client.Timeout)
+		if err != nil {
+			log.Fatalf("❌ E2B integration unavailable: %v", err)
+		}
+		c.e2b = sandbox
+		c.metricSources = append(c.metricSources, sandbox.Metrics)
+		if e2bTeardown {
+			if e2bAPIKey == "" {
+				log.Fatalf("❌ -e2bTeardown requires -e2bAPIKey or E2B_API_KEY")
+			}
+			go sandbox.WatchTeardown(e2bTeardownLead, c.teardown)
+		}
+		log.Printf("🏝️ E2B sandbox %s: admission %v, teardown %v", sandboxID, e2bAdmission, e2bTeardown)
+	}
+	if gatewayURL != "" {
+		gateway, err := NewGatewayCheck(c.clock, gatewayURL, gatewayInterval, c.client.Timeout)
+		if err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		c.gateway = gateway
+		c.metricSources = append(c.metricSources, gateway.Metrics)
+		go gateway.Run()
+		log.Printf("🌉 Checking the gateway path through %s every %v", gateway.base, gatewayInterval)
+	}
+	if guardDevTools {
+		c.guard = NewEndpointGuard(c.reservations, c.isAdminCaller, func(r *http.Request) string { return requestActor(r, c.acl) }, c.clock)
+		c.metricSources = append(c.metricSources, c.guard.Metrics)
+	}
+	if storeFile != "" {
+		store, err := LoadSessionStore(storeFile, storeRetention, c.clock)
+		if err != nil {
+			log.Fatalf("❌ Failed to open session store %s: %v", storeFile, err)
+		}
+		c.store = store
+		c.metricSources = append(c.metricSources, store.Metrics)
+		c.traffic.Track()
+		c.traffic.OnClose(store.RecordSession)
+		c.reservations.OnChange(func(event string, res *Reservation) {
+			store.RecordLease(newLeaseEvent(c.clock.Now(), event, res))
+		})
+		c.breakGlass.OnAudit(func(ev breakGlassEvent) {
+			store.RecordAudit(AuditEntry{Time: ev.Time, Actor: ev.Actor, ClaimedActor: ev.ClaimedActor, Action: "breakglass." + ev.Event, Target: ev.TargetID, Detail: "grant=" + ev.GrantID + " " + ev.Detail})
+		})
+		c.guard.OnAudit(func(ev RequestRejectedEvent) {
+			store.RecordAudit(AuditEntry{Time: ev.Time, Actor: ev.Actor, ClaimedActor: ev.ClaimedActor, Action: "devtools.rejected", Target: ev.TargetID, Detail: ev.Code + " " + ev.Method + " " + ev.Path, Status: http.StatusForbidden})
+		})
+		go store.Run()
+		log.Printf("🗃️ Recording sessions, leases and audit entries in %s", storeFile)
+	}
+	if eventWebhook != "" {
+		outbox, err := LoadOutbox(eventWebhook, outboxFile, c.clock)
+		if err != nil {
+			log.Fatalf("❌ Failed to open outbox %s: %v", outboxFile, err)
+		}
+		c.outbox = outbox
+		c.metricSources = append(c.metricSources, outbox.Metrics)
+		// Billing needs every connection, not only those analyzers watch
+		c.traffic.Track()
+		c.traffic.OnClose(func(summary *SessionSummary) {
+			c.outbox.Emit(summary.TargetID, "session.closed", SessionClosedEvent{newEventHeader("session.closed"), *summary})
+		})
+		c.reservations.OnChange(func(event string, res *Reservation) {
+			c.outbox.Emit(res.TargetID, event, newLeaseEvent(c.clock.Now(), event, res))
+		})
+		c.guard.OnAudit(func(ev RequestRejectedEvent) {
+			c.outbox.Emit(ev.TargetID, ev.Event, ev)
+		})
+		log.Printf("📮 Delivering events to %s through %s", eventWebhook, outboxFile)
+	}
+	if stateFile != "" {
+		// After the lease listeners, which hear of leases lost while down
+		c.state = NewStateFile(stateFile, stateInterval, c.clock)
+		c.metricSources = append(c.metricSources, c.state.Metrics)
+		c.restoreState()
+		go c.state.Run(c.saveState)
+		log.Printf("💾 Saving state to %s every %v", stateFile, stateInterval)
+	}
+	if featureEnabled("cdp-delta") {
+		c.deltas = NewDeltaEncoding(deltaThreshold)
+		c.metricSources = append(c.metricSources, c.deltas.Metrics)
+	}
+
+	if cdpAllow != "" || cdpDeny != "" {
+		if !featureEnabled("native-websocket") && !featureEnabled("cdp-multiplexing") {
+			// Clients would reach Chrome unfiltered
+			log.Fatalf("❌ -cdpAllow and -cdpDeny require the native-websocket or cdp-multiplexing feature")
+		}
+		policy, err := NewMethodPolicy(splitList(cdpAllow), splitList(cdpDeny))
+		if err != nil {
+			log.Fatalf("❌ Invalid CDP method policy: %v", err)
+		}
+		// Ahead of other interceptors, so blocked commands go no further
+		policy.Register(c.interceptors)
+		c.policy = policy
+		c.metricSources = append(c.metricSources, policy.Metrics)
+		log.Printf("🚫 CDP method policy: allow %q, deny %q", cdpAllow, cdpDeny)
+	}
+	if protectBrowser {
+		if !featureEnabled("native-websocket") && !featureEnabled("cdp-multiplexing") {
+			log.Fatalf("❌ -protectBrowser requires the native-websocket or cdp-multiplexing feature")
+		}
+		c.protection = NewBrowserProtection(c.control)
+		c.protection.Register(c.interceptors)
+		c.metricSources = append(c.metricSources, c.protection.Metrics)
+		log.Printf("🛡️ Browser lifecycle commands are blocked for clients")
+	}
+	if logCDP {
+		registerCDPLogger(c.interceptors)
+	}
+	if c.interceptors.Enabled() && !featureEnabled("native-websocket") && !featureEnabled("cdp-multiplexing") {
+		log.Printf("⚠️ CDP message interception requires the native-websocket or cdp-multiplexing feature, interceptors disabled")
+	}
+
+	if anomalyWindow > 0 {
+		detector, err := NewRateDetector(anomalyThresholds)
+		if err != nil {
+			log.Fatalf("❌ Failed to parse -anomalyThresholds: %v", err)
+		}
+		c.traffic.Register(detector)
+		c.metricSources = append(c.metricSources, c.traffic.Metrics)
+	}
+}
+
+// Split a comma-separated flag value, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,745 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	registerFeature("cdp-multiplexing", "Let several clients share one /devtools WebSocket URL over a single upstream connection, with command ids remapped per client and events fanned out", false)
+}
+
+// Multiplexer shares one upstream CDP connection per DevTools URL among the
+// clients connected to it. Command ids are remapped so that each response
+// reaches the client that sent the command with its own id; events of
+// flattened sessions a client attached go to that client, all others to
+// every client.
+type Multiplexer struct {
+	mu        sync.Mutex
+	upstreams map[string]*muxUpstream
+	// Dials in progress by key; clients of a key being dialed wait for it
+	// instead of dialing again
+	dialing map[string]*muxDial
+
+	reconnects int64
+	reattached int64
+	held       int64
+	overflows  int64
+	slow       int64
+}
+
+func NewMultiplexer() *Multiplexer {
+	return &Multiplexer{upstreams: make(map[string]*muxUpstream), dialing: make(map[string]*muxDial)}
+}
+
+// muxDial is a shared connection being dialed
+type muxDial struct {
+	done chan struct{}
+	up   *muxUpstream
+	err  error
+}
+
+// muxUpstream is the shared connection to one DevTools URL
+type muxUpstream struct {
+	key  string
+	ws   *WebSocketConn
+	body io.Closer
+
+	mu      sync.Mutex
+	clients map[*muxClient]bool
+	nextID  int64
+	// Upstream command id -> the client and its own id
+	pending map[int64]muxPending
+	// Flattened CDP sessions by the client that attached them
+	owners map[string]*muxClient
+	closed bool
+
+	// Request that opened the connection, to dial it again
+	req *http.Request
+	// Set while the connection to Chrome is being re-established
+	reconnecting bool
+	// Flattened sessions clients attached, by the session id they know,
+	// to attach again after a reconnect
+	attached map[string]*muxAttachment
+	// Commands of the root session replayed after a reconnect
+	replay []muxCommand
+	// Ids of re-attached sessions: the client's to Chrome's and back
+	toChrome   map[string]string
+	fromChrome map[string]string
+	// Client messages sent while reconnecting, forwarded in order once
+	// the connection is back
+	held      []muxHeld
+	holdLimit int
+	mux       *Multiplexer
+}
+
+// muxHeld is a client message held during a reconnect
+type muxHeld struct {
+	client    *muxClient
+	opcode    byte
+	payload   []byte
+	id        json.RawMessage
+	sessionID string
+}
+
+type muxPending struct {
+	client *muxClient
+	id     json.RawMessage
+	method string
+	// Session of the command, as the client knows it
+	sessionID string
+	// Parameters of Target.attachToTarget
+	params json.RawMessage
+}
+
+// muxAttachment is a flattened session attached by a client
+type muxAttachment struct {
+	targetID string
+	client   *muxClient
+	// Commands replayed on the session after it is attached again
+	replay []muxCommand
+}
+
+// muxCommand is a state-setting command, e.g. Page.enable
+type muxCommand struct {
+	method string
+	params json.RawMessage
+}
+
+// Messages queued for one client of a shared connection. A client further
+// behind is disconnected rather than holding up the connection's reader and
+// with it every other client.
+const muxClientQueueDepth = 1024
+
+// muxClient is one client connection sharing an upstream
+type muxClient struct {
+	ws    *WebSocketConn
+	relay *messageRelay
+	// Negotiated with the client (cdp.delta)
+	delta *deltaEncoder
+	from  string
+
+	// Messages to the client, written by its own goroutine
+	out chan muxOutbound
+	// Longest a write to the client may block
+	timeout time.Duration
+	// Closed when the client is disconnected
+	gone     chan struct{}
+	goneOnce sync.Once
+	// Closed when the writer has stopped
+	done chan struct{}
+	mux  *Multiplexer
+}
+
+// muxOutbound is a message queued for a client
+type muxOutbound struct {
+	opcode  byte
+	payload []byte
+	// Written as is, past the client's relay and delta encoding: replies
+	// the proxy makes in Chrome's place and the close frame
+	raw bool
+}
+
+// multiplexWebSocket attaches a client upgrade to the shared upstream
+// connection of its URL, dialing Chrome for the first client
+func (c *ChromeDevToolsClient) multiplexWebSocket(w http.ResponseWriter, r *http.Request) {
+	hostPort := c.upstreamForRequest(r).HostPort()
+	key := hostPort + r.URL.RequestURI()
+	up, err := c.sharedUpstream(r, hostPort, key)
+	if err != nil {
+		c.errorCount++
+		log.Printf("❌ WebSocket upstream dial failed: %v", err)
+		http.Error(w, fmt.Sprintf("WebSocket upstream unavailable: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	// Compression, transcoding and delta encoding are per client; the
+	// shared connection to Chrome stays plain JSON
+	extensions, deflate := c.compression.Negotiate(r)
+	protocol, _ := proxySubprotocolOf(r)
+	ws, err := acceptWebSocket(w, r, extensions, deflate, protocol)
+	if err != nil {
+		c.leaveMux(up, nil)
+		return
+	}
+	if err := consumeURLNonce(r); err != nil {
+		refuseReusedUpgrade(ws.conn)
+		c.leaveMux(up, nil)
+		return
+	}
+	// The server's read and write timeouts must not end a long session
+	ws.conn.SetDeadline(time.Time{})
+	ws.limit = c.limit.bytes()
+	c.lanes.Start(ws)
+	defer ws.lanes.close()
+	ws.codec = cdpCodecs[protocol]
+	client := &muxClient{
+		ws:      ws,
+		delta:   c.deltas.Connect(protocol),
+		from:    "client " + r.RemoteAddr + " of " + r.URL.Path,
+		out:     make(chan muxOutbound, muxClientQueueDepth),
+		timeout: c.client.Timeout,
+		gone:    make(chan struct{}),
+		done:    make(chan struct{}),
+		mux:     c.mux,
+	}
+	handle := passMessage
+	if c.interceptors.Enabled() {
+		client.relay = c.interceptors.newRelay(r, ws.conn, up.ws.conn, up.ws.conn)
+		client.relay.client = ws
+		handle = client.relay.fromClient
+	}
+	if client.delta != nil {
+		handle = client.delta.watchCommands(handle)
+	}
+	up.mu.Lock()
+	if up.closed {
+		up.mu.Unlock()
+		writeCloseFrame(ws.conn, false, wsCloseGoingAway)
+		ws.conn.Close()
+		return
+	}
+	up.clients[client] = true
+	clients := len(up.clients)
+	up.mu.Unlock()
+	go client.run()
+	if clients > 1 {
+		log.Printf("🔀 Client %d joined shared connection %s", clients, r.URL.Path)
+	}
+
+	defer c.leaveMux(up, client)
+	done := make(chan struct{})
+	defer close(done)
+	c.keepalive.Start(ws, "Client "+r.RemoteAddr, done)
+	idle := c.idle.Watch(ws, r.URL.Path+" (client "+r.RemoteAddr+")", done)
+	for {
+		opcode, payload, err := ws.ReadMessage()
+		var over *oversizeMessage
+		if errors.As(err, &over) {
+			idle.active()
+			c.limit.rejectShared(client, over, "client "+r.RemoteAddr+" of "+r.URL.Path)
+			continue
+		}
+		if err != nil {
+			return
+		}
+		idle.active()
+		if ws.codec != nil && opcode == wsOpBinary {
+			if payload, err = ws.codec.toJSON(payload); err != nil {
+				log.Printf("❌ Closing client %s of %s: %v", r.RemoteAddr, r.URL.Path, err)
+				client.close(wsCloseInvalidData)
+				<-client.done
+				return
+			}
+			opcode = wsOpText
+		}
+		if payload = handle(opcode, payload); payload == nil {
+			continue
+		}
+		if err := up.send(client, opcode, payload); err != nil {
+			return
+		}
+	}
+}
+
+// The shared connection of key, dialed for the first client. The dial runs
+// outside c.mux.mu so that other URLs are not held up by a slow Chrome;
+// clients of the same key arriving meanwhile wait for its outcome.
+func (c *ChromeDevToolsClient) sharedUpstream(r *http.Request, hostPort, key string) (*muxUpstream, error) {
+	c.mux.mu.Lock()
+	if up := c.mux.upstreams[key]; up != nil {
+		c.mux.mu.Unlock()
+		return up, nil
+	}
+	if d := c.mux.dialing[key]; d != nil {
+		c.mux.mu.Unlock()
+		select {
+		case <-d.done:
+			return d.up, d.err
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		}
+	}
+	d := &muxDial{done: make(chan struct{})}
+	c.mux.dialing[key] = d
+	c.mux.mu.Unlock()
+
+	d.up, d.err = c.dialMuxUpstream(r, hostPort, key)
+	c.mux.mu.Lock()
+	delete(c.mux.dialing, key)
+	if d.err == nil {
+		c.mux.upstreams[key] = d.up
+		go c.readMuxUpstream(d.up)
+	}
+	c.mux.mu.Unlock()
+	close(d.done)
+	return d.up, d.err
+}
+
+// Dial the shared connection, letting the taps observe it as the session
+// of the client that opened it
+func (c *ChromeDevToolsClient) dialMuxUpstream(r *http.Request, hostPort, key string) (*muxUpstream, error) {
+	ws, body, err := c.dialMuxConn(r, hostPort, r.URL.RequestURI())
+	if err != nil {
+		return nil, err
+	}
+	return &muxUpstream{
+		key:        key,
+		ws:         ws,
+		body:       body,
+		clients:    make(map[*muxClient]bool),
+		pending:    make(map[int64]muxPending),
+		owners:     make(map[string]*muxClient),
+		req:        r.Clone(context.Background()),
+		attached:   make(map[string]*muxAttachment),
+		toChrome:   make(map[string]string),
+		fromChrome: make(map[string]string),
+		holdLimit:  c.muxBuffer,
+		mux:        c.mux,
+	}, nil
+}
+
+// Dial a connection to requestURI on Chrome, tapped as the session of r
+func (c *ChromeDevToolsClient) dialMuxConn(r *http.Request, hostPort, requestURI string) (*WebSocketConn, io.Closer, error) {
+	ws, err := DialWebSocket("ws://"+hostPort+requestURI, c.client.Timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	ws.limit = c.limit.bytes()
+	out := r.Clone(r.Context())
+	out.Host = hostPort
+	body := c.cdpRecorder.Tap(out, c.recorder.Tap(out, c.traffic.Tap(out, &upstreamConn{Conn: ws.conn, br: ws.br})))
+	ws.br = bufio.NewReaderSize(body, profile.WebSocketReadBuffer)
+	ws.conn = &writeThroughConn{Conn: ws.conn, w: body}
+	return ws, body, nil
+}
+
+// Forward a client message upstream under a fresh command id, or hold it
+// while the connection is being re-established
+func (u *muxUpstream) send(client *muxClient, opcode byte, payload []byte) error {
+	return u.forward(client, opcode, payload, false)
+}
+
+func (u *muxUpstream) forward(client *muxClient, opcode byte, payload []byte, flushing bool) error {
+	var msg map[string]json.RawMessage
+	command := opcode == wsOpText && json.Unmarshal(payload, &msg) == nil && msg["id"] != nil
+	var method, sessionID string
+	json.Unmarshal(msg["method"], &method)
+	json.Unmarshal(msg["sessionId"], &sessionID)
+	u.mu.Lock()
+	if u.reconnecting && !flushing {
+		held := u.hold(muxHeld{client: client, opcode: opcode, payload: payload, id: msg["id"], sessionID: sessionID})
+		u.mu.Unlock()
+		if held || !command {
+			return nil
+		}
+		return client.fail(msg["id"], sessionID, "Timed out: too many commands waiting for the Chrome connection to be re-established")
+	}
+	ws := u.ws
+	if !command {
+		u.mu.Unlock()
+		return u.write(ws, opcode, payload)
+	}
+	u.nextID++
+	id := u.nextID
+	p := muxPending{client: client, id: msg["id"], method: method, sessionID: sessionID}
+	if method == "Target.attachToTarget" {
+		p.params = msg["params"]
+	}
+	u.pending[id] = p
+	u.remember(sessionID, method, msg["params"])
+	if chromeSession, ok := u.toChrome[sessionID]; ok {
+		msg["sessionId"], _ = json.Marshal(chromeSession)
+	}
+	u.mu.Unlock()
+	msg["id"] = json.RawMessage(fmt.Sprint(id))
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return u.write(ws, opcode, data)
+}
+
+// Write to Chrome. A failed write means the connection dropped: it is
+// closed so that the reader notices and reconnects, keeping the client.
+func (u *muxUpstream) write(ws *WebSocketConn, opcode byte, data []byte) error {
+	if err := ws.WriteMessage(opcode, data); err != nil {
+		ws.conn.Close()
+	}
+	return nil
+}
+
+// Keep a client message until the connection is re-established, returning
+// false when the buffer is full; the caller holds u.mu
+func (u *muxUpstream) hold(h muxHeld) bool {
+	if len(u.held) >= u.holdLimit {
+		atomic.AddInt64(&u.mux.overflows, 1)
+		return false
+	}
+	h.payload = append([]byte(nil), h.payload...)
+	u.held = append(u.held, h)
+	atomic.AddInt64(&u.mux.held, 1)
+	return true
+}
+
+// Note a state-setting command of a session, to replay it after a
+// reconnect; the caller holds u.mu
+func (u *muxUpstream) remember(sessionID, method string, params json.RawMessage) {
+	replay := &u.replay
+	if sessionID != "" {
+		a := u.attached[sessionID]
+		if a == nil {
+			return
+		}
+		replay = &a.replay
+	}
+	enable := strings.TrimSuffix(method, ".disable") + ".enable"
+	kept := (*replay)[:0]
+	for _, cmd := range *replay {
+		if cmd.method != method && cmd.method != enable {
+			kept = append(kept, cmd)
+		}
+	}
+	*replay = kept
+	switch {
+	case strings.HasSuffix(method, ".enable"), method == "Target.setAutoAttach", method == "Target.setDiscoverTargets", method == "Page.setLifecycleEventsEnabled":
+		*replay = append(*replay, muxCommand{method: method, params: params})
+	}
+}
+
+// Answer a client's command with an error on Chrome's behalf
+func (m *muxClient) fail(id json.RawMessage, sessionID, message string) error {
+	reply := &relayEnvelope{ID: id, SessionID: sessionID, Error: encodeCDPError(&CDPError{Code: -32000, Message: message})}
+	return m.queue(muxOutbound{opcode: wsOpText, payload: encodeEnvelope(reply, nil), raw: true})
+}
+
+// Deliver Chrome's messages to clients until the upstream connection ends
+// and cannot be re-established, then close every client
+func (c *ChromeDevToolsClient) readMuxUpstream(up *muxUpstream) {
+	for {
+		done := make(chan struct{})
+		c.keepalive.Start(up.ws, "Shared Chrome connection "+up.key, done)
+		for {
+			opcode, payload, err := up.ws.ReadMessage()
+			var over *oversizeMessage
+			if errors.As(err, &over) {
+				c.limit.answerShared(up, over)
+				continue
+			}
+			if err != nil {
+				break
+			}
+			up.dispatch(opcode, payload)
+		}
+		close(done)
+		if !c.reconnectMux(up) {
+			break
+		}
+	}
+
+	c.mux.mu.Lock()
+	if c.mux.upstreams[up.key] == up {
+		delete(c.mux.upstreams, up.key)
+	}
+	c.mux.mu.Unlock()
+	up.mu.Lock()
+	up.closed = true
+	clients := up.clients
+	up.clients = map[*muxClient]bool{}
+	up.mu.Unlock()
+	for client := range clients {
+		client.close(wsCloseGoingAway)
+	}
+	up.body.Close()
+}
+
+// Route a message from Chrome to its clients
+func (u *muxUpstream) dispatch(opcode byte, payload []byte) {
+	var msg struct {
+		ID        *int64          `json:"id"`
+		SessionID string          `json:"sessionId"`
+		Method    string          `json:"method"`
+		Params    json.RawMessage `json:"params"`
+		Result    json.RawMessage `json:"result"`
+	}
+	if opcode != wsOpText || json.Unmarshal(payload, &msg) != nil {
+		return
+	}
+	// Re-attached sessions keep the ids their clients know
+	u.mu.Lock()
+	sessionID, renamed := u.fromChrome[msg.SessionID]
+	detachedID, reattached := "", false
+	if msg.Method == "Target.detachedFromTarget" || msg.Method == "Target.attachedToTarget" {
+		var target struct {
+			SessionID string `json:"sessionId"`
+		}
+		json.Unmarshal(msg.Params, &target)
+		if msg.Method == "Target.attachedToTarget" {
+			_, reattached = u.fromChrome[target.SessionID]
+		} else {
+			detachedID = u.fromChrome[target.SessionID]
+		}
+	}
+	u.mu.Unlock()
+	if reattached {
+		// The client already knows the session under its old id
+		return
+	}
+	if renamed || detachedID != "" {
+		var fields map[string]json.RawMessage
+		if json.Unmarshal(payload, &fields) != nil {
+			return
+		}
+		if renamed {
+			msg.SessionID = sessionID
+			fields["sessionId"], _ = json.Marshal(sessionID)
+		}
+		if detachedID != "" {
+			var params map[string]json.RawMessage
+			json.Unmarshal(msg.Params, &params)
+			params["sessionId"], _ = json.Marshal(detachedID)
+			msg.Params, _ = json.Marshal(params)
+			fields["params"] = msg.Params
+		}
+		payload, _ = json.Marshal(fields)
+	}
+	if msg.ID != nil {
+		u.respond(*msg.ID, msg.Result, payload)
+		return
+	}
+	for _, client := range u.eventClients(msg.SessionID, msg.Method, msg.Params) {
+		client.deliver(opcode, payload)
+	}
+}
+
+// Route a response back to the client that sent the command, under its id
+func (u *muxUpstream) respond(id int64, result json.RawMessage, payload []byte) {
+	u.mu.Lock()
+	p, ok := u.pending[id]
+	delete(u.pending, id)
+	if ok && !u.clients[p.client] {
+		ok = false
+	}
+	if ok && p.method == "Target.attachToTarget" {
+		var attached struct {
+			SessionID string `json:"sessionId"`
+		}
+		if json.Unmarshal(result, &attached) == nil && attached.SessionID != "" {
+			u.owners[attached.SessionID] = p.client
+			var target struct {
+				TargetID string `json:"targetId"`
+				Flatten  bool   `json:"flatten"`
+			}
+			if json.Unmarshal(p.params, &target) == nil && target.Flatten {
+				u.attached[attached.SessionID] = &muxAttachment{targetID: target.TargetID, client: p.client}
+			}
+		}
+	}
+	u.mu.Unlock()
+	if !ok {
+		return
+	}
+	var msg map[string]json.RawMessage
+	if json.Unmarshal(payload, &msg) != nil {
+		return
+	}
+	msg["id"] = p.id
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	p.client.deliver(wsOpText, data)
+}
+
+// Clients an event goes to: the owner of its flattened session when one
+// attached it, every client otherwise
+func (u *muxUpstream) eventClients(sessionID, method string, params json.RawMessage) []*muxClient {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	owner := u.owners[sessionID]
+	if method == "Target.detachedFromTarget" {
+		var detached struct {
+			SessionID string `json:"sessionId"`
+		}
+		json.Unmarshal(params, &detached)
+		if o := u.owners[detached.SessionID]; o != nil && sessionID == "" {
+			owner = o
+		}
+		delete(u.owners, detached.SessionID)
+		delete(u.attached, detached.SessionID)
+		if chromeSession, ok := u.toChrome[detached.SessionID]; ok {
+			delete(u.toChrome, detached.SessionID)
+			delete(u.fromChrome, chromeSession)
+		}
+	}
+	if owner != nil && u.clients[owner] {
+		return []*muxClient{owner}
+	}
+	clients := make([]*muxClient, 0, len(u.clients))
+	for client := range u.clients {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// Queue a message from Chrome for the client
+func (m *muxClient) deliver(opcode byte, payload []byte) {
+	m.queue(muxOutbound{opcode: opcode, payload: payload})
+}
+
+// Queue a message without waiting, disconnecting the client when its
+// queue is full
+func (m *muxClient) queue(o muxOutbound) error {
+	select {
+	case <-m.gone:
+		return errWebSocketClosed
+	default:
+	}
+	select {
+	case m.out <- o:
+		return nil
+	default:
+		atomic.AddInt64(&m.mux.slow, 1)
+		m.disconnect(fmt.Sprintf("more than %d messages behind", muxClientQueueDepth))
+		return errWebSocketClosed
+	}
+}
+
+// Queue a close frame; the writer closes the connection once it is sent
+func (m *muxClient) close(code int) {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	if m.queue(muxOutbound{opcode: wsOpClose, payload: payload, raw: true}) != nil {
+		m.ws.conn.Close()
+	}
+}
+
+// Drop a client that cannot keep up. Its connection is closed without a
+// close frame, which could not be sent past the message being written; its
+// read loop then ends and removes it from the shared connection.
+func (m *muxClient) disconnect(reason string) {
+	m.goneOnce.Do(func() {
+		log.Printf("🐢 Disconnecting %s: %s", m.from, reason)
+		close(m.gone)
+		m.ws.conn.Close()
+	})
+}
+
+// Stop the writer of a client that left
+func (m *muxClient) stop() {
+	m.goneOnce.Do(func() { close(m.gone) })
+}
+
+// Write the client's queue until it is disconnected. Each write must
+// finish within the client timeout: a client that stops reading is dropped
+// once the kernel buffers fill, instead of blocking its queue forever.
+func (m *muxClient) run() {
+	defer close(m.done)
+	for {
+		select {
+		case o := <-m.out:
+			if !m.write(o) {
+				return
+			}
+		case <-m.gone:
+			return
+		}
+	}
+}
+
+func (m *muxClient) write(o muxOutbound) bool {
+	if o.opcode == wsOpClose {
+		m.ws.lanes.flush()
+		writeCloseFrame(m.ws.conn, false, int(binary.BigEndian.Uint16(o.payload)))
+		m.stop()
+		m.ws.conn.Close()
+		return false
+	}
+	payload := o.payload
+	if !o.raw && m.relay != nil {
+		if payload = m.relay.fromChrome(o.opcode, payload); payload == nil {
+			return true
+		}
+	}
+	if !o.raw && m.delta != nil && o.opcode == wsOpText {
+		payload = m.delta.encode(payload)
+	}
+	if m.timeout > 0 {
+		m.ws.conn.SetWriteDeadline(time.Now().Add(m.timeout))
+	}
+	if err := m.ws.WriteMessage(o.opcode, payload); err != nil {
+		m.disconnect(fmt.Sprintf("write failed: %v", err))
+		return false
+	}
+	return true
+}
+
+// Remove a client from its shared connection, closing the connection when
+// it was the last one
+func (c *ChromeDevToolsClient) leaveMux(up *muxUpstream, client *muxClient) {
+	if client != nil {
+		client.stop()
+		client.ws.conn.Close()
+	}
+	c.mux.mu.Lock()
+	up.mu.Lock()
+	delete(up.clients, client)
+	for id, p := range up.pending {
+		if p.client == client {
+			delete(up.pending, id)
+		}
+	}
+	for sessionID, owner := range up.owners {
+		if owner == client {
+			delete(up.owners, sessionID)
+		}
+	}
+	for sessionID, a := range up.attached {
+		if a.client == client {
+			delete(up.attached, sessionID)
+		}
+	}
+	last := len(up.clients) == 0 && !up.closed
+	if last {
+		up.closed = true
+	}
+	ws := up.ws
+	up.mu.Unlock()
+	if last && c.mux.upstreams[up.key] == up {
+		delete(c.mux.upstreams, up.key)
+	}
+	c.mux.mu.Unlock()
+	if last {
+		ws.Close()
+	}
+}
+
+func (m *Multiplexer) Metrics() map[string]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	clients := 0
+	for _, up := range m.upstreams {
+		up.mu.Lock()
+		clients += len(up.clients)
+		up.mu.Unlock()
+	}
+	return map[string]interface{}{
+		"mux_upstream_connections": len(m.upstreams),
+		"mux_clients":              clients,
+		"mux_reconnects_total":     atomic.LoadInt64(&m.reconnects),
+		"mux_reattached_total":     atomic.LoadInt64(&m.reattached),
+		"mux_held_messages_total":  atomic.LoadInt64(&m.held),
+		"mux_held_overflows_total": atomic.LoadInt64(&m.overflows),
+		"mux_slow_clients_total":   atomic.LoadInt64(&m.slow),
+	}
+}
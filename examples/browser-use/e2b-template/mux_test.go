@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestMuxClient(conn net.Conn) *muxClient {
+	return &muxClient{
+		ws:      &WebSocketConn{conn: conn},
+		from:    "test client",
+		out:     make(chan muxOutbound, muxClientQueueDepth),
+		timeout: 50 * time.Millisecond,
+		gone:    make(chan struct{}),
+		done:    make(chan struct{}),
+		mux:     NewMultiplexer(),
+	}
+}
+
+// A client that stops reading is disconnected without blocking the reader
+// of the shared connection
+func TestMuxSlowClientDisconnected(t *testing.T) {
+	server, peer := net.Pipe()
+	defer peer.Close()
+	client := newTestMuxClient(server)
+	go client.run()
+
+	delivered := make(chan struct{})
+	go func() {
+		for range muxClientQueueDepth + 2 {
+			client.deliver(wsOpText, []byte(`{"method":"Page.frameNavigated"}`))
+		}
+		close(delivered)
+	}()
+	select {
+	case <-delivered:
+	case <-time.After(time.Second):
+		t.Fatal("deliver blocked on a client that does not read")
+	}
+	select {
+	case <-client.done:
+	case <-time.After(time.Second):
+		t.Fatal("slow client was not disconnected")
+	}
+	if client.mux.slow != 1 {
+		t.Errorf("slow clients = %d, want 1", client.mux.slow)
+	}
+}
+
+// A write that does not finish within the client timeout disconnects the
+// client even when its queue is not full
+func TestMuxClientWriteDeadline(t *testing.T) {
+	server, peer := net.Pipe()
+	defer peer.Close()
+	client := newTestMuxClient(server)
+	go client.run()
+
+	client.deliver(wsOpText, []byte(`{"id":1,"result":{}}`))
+	select {
+	case <-client.done:
+	case <-time.After(time.Second):
+		t.Fatal("client stuck in a write was not disconnected")
+	}
+	if err := client.fail([]byte("2"), "", "late"); err != errWebSocketClosed {
+		t.Errorf("queue after disconnect = %v, want errWebSocketClosed", err)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	navigateLoad             = "load"
+	navigateDOMContentLoaded = "domcontentloaded"
+	navigateNetworkIdle      = "networkidle"
+)
+
+type navigateRequest struct {
+	URL       string `json:"url"`
+	WaitUntil string `json:"waitUntil"`
+	Referrer  string `json:"referrer"`
+	TimeoutMs int    `json:"timeoutMs"`
+	// Quiet window for networkidle
+	IdleMs int `json:"idleMs"`
+}
+
+/*
+Handle POST /targets/{id}/navigate
+Request example:
+
+	{"url": "https://example.com/login", "waitUntil": "networkidle", "timeoutMs": 15000}
+
+waitUntil is load (default), domcontentloaded or networkidle (the load
+event, then no requests for idleMs, default 500). Answers once the
+condition holds, 408 when it does not within the timeout and 502 with
+Chrome's error text when the navigation itself fails.
+*/
+func (c *ChromeDevToolsClient) handleNavigate(w http.ResponseWriter, r *http.Request) {
+	var req navigateRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if u, err := url.Parse(req.URL); err != nil || u.Scheme == "" {
+		http.Error(w, "url must be an absolute URL", http.StatusBadRequest)
+		return
+	}
+	switch req.WaitUntil {
+	case "":
+		req.WaitUntil = navigateLoad
+	case navigateLoad, navigateDOMContentLoaded, navigateNetworkIdle:
+	default:
+		http.Error(w, fmt.Sprintf("Unknown waitUntil: %q (load, domcontentloaded or networkidle)", req.WaitUntil), http.StatusBadRequest)
+		return
+	}
+	if req.IdleMs <= 0 {
+		req.IdleMs = 500
+	}
+	targetID := r.PathValue("id")
+	if targetID == browserTargetID {
+		http.Error(w, "navigate needs a page target", http.StatusBadRequest)
+		return
+	}
+	commands := []string{"Page.enable", "Page.navigate"}
+	if req.WaitUntil == navigateNetworkIdle {
+		commands = append(commands, waitCommands(waitNetworkIdle)...)
+	}
+	if !c.allowCommands(w, r, commands...) {
+		return
+	}
+
+	start := c.clock.Now()
+	ctx, cancel := context.WithTimeout(r.Context(), c.apiDeadline(time.Duration(req.TimeoutMs)*time.Millisecond))
+	defer cancel()
+	var nav struct {
+		FrameID   string `json:"frameId"`
+		LoaderID  string `json:"loaderId"`
+		ErrorText string `json:"errorText"`
+	}
+	navigated := false
+	err := c.control.WithSession(ctx, targetID, func(conn *CDPConn, sessionID string) error {
+		event := "Page.loadEventFired"
+		if req.WaitUntil == navigateDOMContentLoaded {
+			event = "Page.domContentEventFired"
+		}
+		fired := make(chan struct{}, 1)
+		unsubscribe := conn.Subscribe(func(msg *CDPMessage) {
+			if msg.SessionID == sessionID && msg.Method == event {
+				select {
+				case fired <- struct{}{}:
+				default:
+				}
+			}
+		})
+		defer unsubscribe()
+
+		if _, err := conn.Call(ctx, sessionID, "Page.enable", nil); err != nil {
+			return err
+		}
+		params := map[string]interface{}{"url": req.URL}
+		if req.Referrer != "" {
+			params["referrer"] = req.Referrer
+		}
+		if err := conn.CallResult(ctx, sessionID, "Page.navigate", params, &nav); err != nil {
+			return err
+		}
+		navigated = true
+		if nav.ErrorText != "" || nav.LoaderID == "" {
+			// Failed, or a same-document navigation that fires no events
+			return nil
+		}
+
+		select {
+		case <-fired:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if req.WaitUntil == navigateNetworkIdle {
+			return waitForNetworkIdle(ctx, c.clock, conn, sessionID, time.Duration(req.IdleMs)*time.Millisecond)
+		}
+		return nil
+	})
+
+	elapsed := c.clock.Since(start).Milliseconds()
+	result := map[string]interface{}{
+		"url":       req.URL,
+		"waitUntil": req.WaitUntil,
+		"frameId":   nav.FrameID,
+		"loaderId":  nav.LoaderID,
+		"elapsedMs": elapsed,
+	}
+	switch {
+	case err == nil && nav.ErrorText != "":
+		log.Printf("🧭 Navigation of %s to %s failed: %s", c.labels.Describe(targetID), req.URL, nav.ErrorText)
+		result["error"] = nav.ErrorText
+		writeJSON(w, http.StatusBadGateway, result)
+	case err == nil:
+		log.Printf("🧭 Navigated %s to %s (%s after %dms)", c.labels.Describe(targetID), req.URL, req.WaitUntil, elapsed)
+		writeJSON(w, http.StatusOK, result)
+	case navigated && errors.Is(err, context.DeadlineExceeded):
+		result["satisfied"] = false
+		writeJSON(w, http.StatusGatewayTimeout, result)
+	default:
+		c.errorCount++
+		log.Printf("❌ Failed to navigate %s: %v", targetID, err)
+		http.Error(w, fmt.Sprintf("Failed to navigate: %v", err), http.StatusBadGateway)
+	}
+}
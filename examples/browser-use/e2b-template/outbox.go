@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	outboxRetryMin = time.Second
+	outboxRetryMax = 5 * time.Minute
+	// Rewrite the outbox file without delivered events this often
+	outboxCompactEvery = 1000
+)
+
+// Outbox delivers events to -eventWebhook at least once. Each event is
+// appended to a local file and synced before it is sent, and marked done
+// in the file once the receiver accepts it, so events outlive proxy
+// crashes and receiver downtime. Events with the same key (the target)
+// are delivered one at a time in the order they were emitted; a failing
+// event is retried with backoff and holds back the later ones.
+type Outbox struct {
+	url    string
+	path   string
+	client *http.Client
+	clock  Clock
+
+	mu      sync.Mutex
+	file    *os.File
+	nextID  int64
+	pending map[string][]*outboxRecord
+	// Keys with a delivery goroutine
+	active map[string]bool
+	acks   int
+	// The file belongs to the proxy that took over in an upgrade
+	handedOff bool
+
+	delivered int64
+	failures  int64
+}
+
+// outboxRecord is one line of the outbox file: an event, the ack of a
+// delivered one, or the next event ID, which leads a rewritten file so that
+// IDs are never reused
+type outboxRecord struct {
+	Op      string          `json:"op"`
+	ID      int64           `json:"id"`
+	Key     string          `json:"key,omitempty"`
+	Event   string          `json:"event,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// LoadOutbox opens the outbox file, creating it when missing, and resumes
+// delivering the events it holds
+func LoadOutbox(url, path string, clock Clock) (*Outbox, error) {
+	o := &Outbox{
+		url:     url,
+		path:    path,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		clock:   clock,
+		nextID:  1,
+		pending: make(map[string][]*outboxRecord),
+		active:  make(map[string]bool),
+	}
+	undelivered, err := o.replay()
+	if err != nil {
+		return nil, err
+	}
+	if err := o.rewrite(undelivered); err != nil {
+		return nil, err
+	}
+	for _, rec := range undelivered {
+		o.pending[rec.Key] = append(o.pending[rec.Key], rec)
+	}
+	for key := range o.pending {
+		o.active[key] = true
+		go o.deliver(key)
+	}
+	if len(undelivered) > 0 {
+		log.Printf("📮 Resuming delivery of %d events from %s", len(undelivered), path)
+	}
+	return o, nil
+}
+
+// Read the undelivered events from the file, in emission order
+func (o *Outbox) replay() ([]*outboxRecord, error) {
+	f, err := os.Open(o.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	events := make(map[int64]*outboxRecord)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var rec outboxRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// A write cut short by a crash or a full disk
+			log.Printf("⚠️ Ignoring damaged outbox line %d in %s: %v", line, o.path, err)
+			continue
+		}
+		switch rec.Op {
+		case "next":
+			if rec.ID > o.nextID {
+				o.nextID = rec.ID
+			}
+			continue
+		case "event":
+			events[rec.ID] = &rec
+		case "ack":
+			delete(events, rec.ID)
+		}
+		if rec.ID >= o.nextID {
+			o.nextID = rec.ID + 1
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	undelivered := make([]*outboxRecord, 0, len(events))
+	for _, rec := range events {
+		undelivered = append(undelivered, rec)
+	}
+	sort.Slice(undelivered, func(i, j int) bool { return undelivered[i].ID < undelivered[j].ID })
+	return undelivered, nil
+}
+
+// Replace the file with just the given events and reopen it for appending
+func (o *Outbox) rewrite(records []*outboxRecord) error {
+	tmp := o.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	next, _ := json.Marshal(&outboxRecord{Op: "next", ID: o.nextID})
+	w.Write(append(next, '\n'))
+	for _, rec := range records {
+		line, _ := json.Marshal(rec)
+		w.Write(append(line, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	if err := os.Rename(tmp, o.path); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(o.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if o.file != nil {
+		o.file.Close()
+	}
+	o.file = file
+	o.acks = 0
+	return nil
+}
+
+// Append a record and sync it to disk; o.mu must be held
+func (o *Outbox) append(rec *outboxRecord) error {
+	line, _ := json.Marshal(rec)
+	if _, err := o.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return o.file.Sync()
+}
+
+// Emit queues an event for delivery after the earlier events of key. It
+// returns once the event is on disk.
+func (o *Outbox) Emit(key, event string, payload interface{}) error {
+	if o == nil {
+		return nil
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	rec := &outboxRecord{Op: "event", ID: o.nextID, Key: key, Event: event, Payload: data}
+	if err := o.append(rec); err != nil {
+		log.Printf("❌ Failed to store %s event in outbox: %v", event, err)
+		return err
+	}
+	o.nextID++
+	o.pending[key] = append(o.pending[key], rec)
+	if !o.active[key] {
+		o.active[key] = true
+		go o.deliver(key)
+	}
+	return nil
+}
+
+// Deliver the events of key in order until none are left
+func (o *Outbox) deliver(key string) {
+	for {
+		o.mu.Lock()
+		queue := o.pending[key]
+		if len(queue) == 0 {
+			delete(o.pending, key)
+			delete(o.active, key)
+			o.mu.Unlock()
+			return
+		}
+		rec := queue[0]
+		o.mu.Unlock()
+
+		for backoff := outboxRetryMin; ; {
+			err := o.post(rec)
+			if err == nil {
+				break
+			}
+			if atomic.AddInt64(&o.failures, 1); backoff == outboxRetryMin {
+				log.Printf("📮 Delivery of %s event %d failed, retrying: %v", rec.Event, rec.ID, err)
+			}
+			<-o.clock.After(backoff)
+			if backoff *= 2; backoff > outboxRetryMax {
+				backoff = outboxRetryMax
+			}
+		}
+		atomic.AddInt64(&o.delivered, 1)
+
+		o.mu.Lock()
+		o.pending[key] = o.pending[key][1:]
+		if err := o.append(&outboxRecord{Op: "ack", ID: rec.ID}); err != nil {
+			// Delivered again after a restart, which receivers tolerate
+			log.Printf("⚠️ Failed to mark outbox event %d delivered: %v", rec.ID, err)
+		}
+		if o.acks++; o.acks >= outboxCompactEvery && !o.handedOff {
+			if err := o.rewrite(o.undeliveredLocked()); err != nil {
+				log.Printf("⚠️ Failed to compact outbox %s: %v", o.path, err)
+			}
+		}
+		o.mu.Unlock()
+	}
+}
+
+// ReserveIDs sets aside the next n event IDs for this process, so that the
+// proxy replacing it in an upgrade, which loads the file meanwhile, starts
+// numbering after them
+func (o *Outbox) ReserveIDs(n int64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.append(&outboxRecord{Op: "next", ID: o.nextID + n})
+}
+
+// Handoff appends to the file the proxy replacing this one rewrote on
+// start, and leaves compacting it to that proxy. Events still pending here
+// are delivered by both, under the same IDs.
+func (o *Outbox) Handoff() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.handedOff = true
+	file, err := os.OpenFile(o.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("⚠️ Failed to reopen outbox %s after the upgrade: %v", o.path, err)
+		return
+	}
+	o.file.Close()
+	o.file = file
+}
+
+// Pending counts the events not delivered yet
+func (o *Outbox) Pending() int {
+	if o == nil {
+		return 0
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	pending := 0
+	for _, queue := range o.pending {
+		pending += len(queue)
+	}
+	return pending
+}
+
+func (o *Outbox) undeliveredLocked() []*outboxRecord {
+	var records []*outboxRecord
+	for _, queue := range o.pending {
+		records = append(records, queue...)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].ID < records[j].ID })
+	return records
+}
+
+// POST one event to the webhook. Receivers deduplicate by X-PPIO-Event-Id,
+// since an event whose ack was lost is sent again.
+func (o *Outbox) post(rec *outboxRecord) error {
+	return postEvent(o.client, o.url, rec.Event, strconv.FormatInt(rec.ID, 10), rec.Payload)
+}
+
+func (o *Outbox) Metrics() map[string]interface{} {
+	return map[string]interface{}{
+		"outbox_pending":                o.Pending(),
+		"outbox_delivered_total":        atomic.LoadInt64(&o.delivered),
+		"outbox_attempt_failures_total": atomic.LoadInt64(&o.failures),
+	}
+}
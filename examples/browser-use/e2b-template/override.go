@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// X-PPIO-Target: host:port sends one request, or one WebSocket session, to
+// the named browser among those the proxy runs (the default upstream and
+// its -chromeChannels instances) instead of the one it would be routed to,
+// e.g. to inspect a single browser of a pool without changing any config.
+// Off unless -targetOverride is set, which requires admin authentication;
+// only admin callers may set it. It applies to the /json endpoints and to
+// everything relayed to Chrome; the proxy's own API ignores it.
+const targetOverrideHeader = "X-PPIO-Target"
+
+// Whether r is from an admin: it carries the -adminToken token or that of
+// an -adminACL role allowed every route. With neither configured no one
+// is, unlike on the admin endpoints, which are then open.
+func (c *ChromeDevToolsClient) isAdminCaller(r *http.Request) bool {
+	if adminToken == "" && c.acl == nil {
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1 {
+		return true
+	}
+	role := c.acl.role(token)
+	return role != nil && role.allows("*")
+}
+
+// The configured upstream serving on hostPort, or nil
+func (c *ChromeDevToolsClient) namedUpstream(hostPort string) *Upstream {
+	if c.upstream.HostPort() == hostPort {
+		return c.upstream
+	}
+	for _, ch := range c.channels.List() {
+		if ch.upstream.HostPort() == hostPort {
+			return ch.upstream
+		}
+	}
+	return nil
+}
+
+// The upstream r goes to: the one X-PPIO-Target names, which
+// checkTargetOverride has vetted, or the one of its path
+func (c *ChromeDevToolsClient) upstreamForRequest(r *http.Request) *Upstream {
+	if hostPort := r.Header.Get(targetOverrideHeader); hostPort != "" {
+		if upstream := c.namedUpstream(hostPort); upstream != nil {
+			return upstream
+		}
+	}
+	return c.upstreamFor(r.URL.Path)
+}
+
+// Answer 403 to an X-PPIO-Target while -targetOverride is off or from a
+// non-admin, and 400 to one naming a browser the proxy does not run
+func (c *ChromeDevToolsClient) checkTargetOverride(w http.ResponseWriter, r *http.Request) bool {
+	hostPort := r.Header.Get(targetOverrideHeader)
+	if !targetOverride {
+		http.Error(w, fmt.Sprintf("Forbidden: %s is disabled (set -targetOverride)", targetOverrideHeader), http.StatusForbidden)
+		return false
+	}
+	if !c.isAdminCaller(r) {
+		log.Printf("🔐 Rejected %s: %s from non-admin %s", targetOverrideHeader, hostPort, actorLabel(r, c.acl))
+		http.Error(w, fmt.Sprintf("Forbidden: %s requires an admin token", targetOverrideHeader), http.StatusForbidden)
+		return false
+	}
+	if c.namedUpstream(hostPort) == nil {
+		known := []string{c.upstream.HostPort()}
+		for _, ch := range c.channels.List() {
+			known = append(known, ch.upstream.HostPort())
+		}
+		http.Error(w, fmt.Sprintf("%s %s is not a configured upstream (one of %s)", targetOverrideHeader, hostPort, strings.Join(known, ", ")), http.StatusBadRequest)
+		return false
+	}
+	log.Printf("🎯 %s %s routed to %s by %s", r.Method, r.URL.Path, hostPort, actorLabel(r, c.acl))
+	return true
+}
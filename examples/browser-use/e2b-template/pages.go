@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+// PageModule is a server-side feature applied to every page target the
+// control session attaches to
+type PageModule interface {
+	Name() string
+	// Attach runs once per page session before the page is resumed. It must
+	// return promptly and spawn goroutines for long-running work.
+	Attach(s *PageSession) error
+}
+
+// TargetInfo mirrors the CDP Target.TargetInfo fields the proxy uses
+type TargetInfo struct {
+	TargetID string `json:"targetId"`
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	URL      string `json:"url"`
+}
+
+// PageSession is the control session's flattened session on one page
+type PageSession struct {
+	Conn      *CDPConn
+	SessionID string
+	Target    TargetInfo
+	// Target id of the top-level page: the target's own for pages, the
+	// embedding page's for out-of-process iframes
+	PageID string
+
+	labels *TargetLabels
+	done   chan struct{}
+}
+
+// Call issues a command on this page session
+func (s *PageSession) Call(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
+	return s.Conn.Call(ctx, s.SessionID, method, params)
+}
+
+// Subscribe delivers this session's events to fn until the session detaches
+func (s *PageSession) Subscribe(fn func(*CDPMessage)) {
+	unsubscribe := s.Conn.Subscribe(func(msg *CDPMessage) {
+		if msg.SessionID == s.SessionID {
+			fn(msg)
+		}
+	})
+	go func() {
+		select {
+		case <-s.done:
+		case <-s.Conn.Done():
+		}
+		unsubscribe()
+	}()
+}
+
+// Describe returns the target id with its client-assigned labels, for logs
+func (s *PageSession) Describe() string {
+	return s.labels.Describe(s.Target.TargetID)
+}
+
+// Done is closed when the page session detaches
+func (s *PageSession) Done() <-chan struct{} {
+	return s.done
+}
+
+// PageWatcher keeps a dedicated control connection auto-attached to every
+// page target and runs the registered modules on each new session
+type PageWatcher struct {
+	clock   Clock
+	control *ControlSession
+	labels  *TargetLabels
+	modules []PageModule
+
+	mu       sync.Mutex
+	sessions map[string]*PageSession
+	// The watch connection, and whether Stop was called
+	conn    *CDPConn
+	stopped bool
+}
+
+func NewPageWatcher(clock Clock, control *ControlSession, labels *TargetLabels) *PageWatcher {
+	return &PageWatcher{
+		clock:    clock,
+		control:  control,
+		labels:   labels,
+		sessions: make(map[string]*PageSession),
+	}
+}
+
+func (p *PageWatcher) Register(m PageModule) {
+	p.modules = append(p.modules, m)
+}
+
+// Start runs the watcher in the background when any module is registered,
+// re-establishing auto-attach whenever the control session reconnects
+func (p *PageWatcher) Start() {
+	if len(p.modules) == 0 {
+		return
+	}
+	for _, m := range p.modules {
+		log.Printf("🧱 Page module enabled: %s", m.Name())
+	}
+
+	go func() {
+		for {
+			conn, err := p.control.Dial()
+			if err != nil {
+				log.Printf("⚠️ Page watcher cannot reach Chrome: %v", err)
+				<-p.clock.After(2 * time.Second)
+				continue
+			}
+			p.mu.Lock()
+			stopped := p.stopped
+			p.conn = conn
+			p.mu.Unlock()
+			if stopped {
+				conn.Close()
+				return
+			}
+			if err := p.watch(conn); err != nil {
+				log.Printf("⚠️ Page watcher setup failed: %v", err)
+				conn.Close()
+				<-p.clock.After(2 * time.Second)
+				continue
+			}
+			<-conn.Done()
+			p.mu.Lock()
+			for id, s := range p.sessions {
+				close(s.done)
+				delete(p.sessions, id)
+			}
+			stopped = p.stopped
+			p.mu.Unlock()
+			if stopped {
+				return
+			}
+		}
+	}()
+}
+
+// DetachAll ends every current page session as if its page had detached,
+// so that modules finish their per-page work (e.g. store the video) ahead
+// of a shutdown
+func (p *PageWatcher) DetachAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id, s := range p.sessions {
+		close(s.done)
+		delete(p.sessions, id)
+	}
+}
+
+// Stop detaches from every page for good, leaving them to the proxy that
+// took over in an upgrade
+func (p *PageWatcher) Stop() {
+	p.mu.Lock()
+	p.stopped = true
+	conn := p.conn
+	p.mu.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+	p.DetachAll()
+}
+
+// Sessions returns a snapshot of the currently attached page sessions
+func (p *PageWatcher) Sessions() []*PageSession {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sessions := make([]*PageSession, 0, len(p.sessions))
+	for _, s := range p.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+func (p *PageWatcher) watch(conn *CDPConn) error {
+	conn.Subscribe(func(msg *CDPMessage) {
+		switch msg.Method {
+		case "Target.attachedToTarget":
+			var params struct {
+				SessionID          string     `json:"sessionId"`
+				TargetInfo         TargetInfo `json:"targetInfo"`
+				WaitingForDebugger bool       `json:"waitingForDebugger"`
+			}
+			json.Unmarshal(msg.Params, &params)
+			// Targets auto-attached through a page's session belong to it
+			go p.attached(conn, msg.SessionID, params.SessionID, params.TargetInfo, params.WaitingForDebugger)
+		case "Target.detachedFromTarget":
+			var params struct {
+				SessionID string `json:"sessionId"`
+			}
+			json.Unmarshal(msg.Params, &params)
+			p.mu.Lock()
+			if s, ok := p.sessions[params.SessionID]; ok {
+				close(s.done)
+				delete(p.sessions, params.SessionID)
+			}
+			p.mu.Unlock()
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.control.timeout)
+	defer cancel()
+
+	// New targets pause until the modules have been applied
+	if _, err := conn.Call(ctx, "", "Target.setAutoAttach", map[string]interface{}{
+		"autoAttach":             true,
+		"waitForDebuggerOnStart": true,
+		"flatten":                true,
+	}); err != nil {
+		return err
+	}
+
+	var existing struct {
+		TargetInfos []TargetInfo `json:"targetInfos"`
+	}
+	if err := conn.CallResult(ctx, "", "Target.getTargets", nil, &existing); err != nil {
+		return err
+	}
+	for _, info := range existing.TargetInfos {
+		if info.Type != "page" {
+			continue
+		}
+		if _, err := conn.Call(ctx, "", "Target.attachToTarget", map[string]interface{}{
+			"targetId": info.TargetID,
+			"flatten":  true,
+		}); err != nil {
+			log.Printf("⚠️ Page watcher failed to attach to %s: %v", info.TargetID, err)
+		}
+	}
+	return nil
+}
+
+func (p *PageWatcher) attached(conn *CDPConn, parentSessionID, sessionID string, info TargetInfo, waiting bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.control.timeout)
+	defer cancel()
+
+	// Out-of-process iframes get their own flattened sessions; modules apply
+	// to them like to pages so interception also covers embedded frames
+	if info.Type == "page" || info.Type == "iframe" {
+		s := &PageSession{Conn: conn, SessionID: sessionID, Target: info, PageID: info.TargetID, labels: p.labels, done: make(chan struct{})}
+		p.mu.Lock()
+		if parent, ok := p.sessions[parentSessionID]; ok {
+			s.PageID = parent.PageID
+		}
+		p.sessions[sessionID] = s
+		p.mu.Unlock()
+
+		for _, m := range p.modules {
+			if err := m.Attach(s); err != nil {
+				log.Printf("⚠️ Page module %s failed on %s: %v", m.Name(), s.Describe(), err)
+			}
+		}
+
+		// Attach to the session's OOPIFs, paused until set up like this one
+		if _, err := conn.Call(ctx, sessionID, "Target.setAutoAttach", map[string]interface{}{
+			"autoAttach":             true,
+			"waitForDebuggerOnStart": true,
+			"flatten":                true,
+		}); err != nil {
+			log.Printf("⚠️ Page watcher failed to auto-attach iframes of %s: %v", s.Describe(), err)
+		}
+	}
+
+	if waiting {
+		conn.Call(ctx, sessionID, "Runtime.runIfWaitingForDebugger", nil)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Bytes requested per IO.read while streaming a PDF or trace
+const ioReadChunk = 256 << 10
+
+type pdfMargins struct {
+	Top    *float64 `json:"top"`
+	Bottom *float64 `json:"bottom"`
+	Left   *float64 `json:"left"`
+	Right  *float64 `json:"right"`
+}
+
+type pdfOptions struct {
+	Landscape         bool        `json:"landscape"`
+	PrintBackground   bool        `json:"printBackground"`
+	Scale             float64     `json:"scale"`
+	PaperWidth        float64     `json:"paperWidth"`
+	PaperHeight       float64     `json:"paperHeight"`
+	Margins           *pdfMargins `json:"margins"`
+	PageRanges        string      `json:"pageRanges"`
+	PreferCSSPageSize bool        `json:"preferCSSPageSize"`
+}
+
+// Page.printToPDF parameters for the options; sizes are in inches as in CDP
+func (o *pdfOptions) params() (map[string]interface{}, error) {
+	params := map[string]interface{}{
+		"landscape":         o.Landscape,
+		"printBackground":   o.PrintBackground,
+		"preferCSSPageSize": o.PreferCSSPageSize,
+		"transferMode":      "ReturnAsStream",
+	}
+	if o.Scale != 0 {
+		if o.Scale < 0.1 || o.Scale > 2 {
+			return nil, errors.New("scale must be from 0.1 to 2")
+		}
+		params["scale"] = o.Scale
+	}
+	for name, size := range map[string]float64{"paperWidth": o.PaperWidth, "paperHeight": o.PaperHeight} {
+		if size < 0 {
+			return nil, fmt.Errorf("%s must be positive", name)
+		}
+		if size > 0 {
+			params[name] = size
+		}
+	}
+	if o.Margins != nil {
+		for name, margin := range map[string]*float64{"marginTop": o.Margins.Top, "marginBottom": o.Margins.Bottom, "marginLeft": o.Margins.Left, "marginRight": o.Margins.Right} {
+			if margin == nil {
+				continue
+			}
+			if *margin < 0 {
+				return nil, errors.New("margins must not be negative")
+			}
+			params[name] = *margin
+		}
+	}
+	if o.PageRanges != "" {
+		params["pageRanges"] = o.PageRanges
+	}
+	return params, nil
+}
+
+/*
+Handle POST /targets/{id}/pdf
+Request example (every field optional, sizes in inches):
+
+	{"landscape": true, "printBackground": true, "margins": {"top": 0.4, "bottom": 0.4}, "pageRanges": "1-3, 5"}
+
+Prints the page with Page.printToPDF and streams the PDF back as Chrome
+produces it, so report-generation services need no CDP client. Chrome's
+own errors, such as an invalid page range, are answered with 400.
+*/
+func (c *ChromeDevToolsClient) handlePrintPDF(w http.ResponseWriter, r *http.Request) {
+	var options pdfOptions
+	if r.ContentLength != 0 && !readJSON(w, r, &options) {
+		return
+	}
+	params, err := options.params()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	targetID := r.PathValue("id")
+	if targetID == browserTargetID {
+		http.Error(w, "pdf needs a page target", http.StatusBadRequest)
+		return
+	}
+	if !c.allowCommands(w, r, "Page.printToPDF", "IO.read", "IO.close") {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), c.client.Timeout)
+	defer cancel()
+	started, rejected := false, false
+	var written int64
+	err = c.control.WithSession(ctx, targetID, func(conn *CDPConn, sessionID string) error {
+		var printed struct {
+			Stream string `json:"stream"`
+		}
+		if err := conn.CallResult(ctx, sessionID, "Page.printToPDF", params, &printed); err != nil {
+			var cdpErr *CDPError
+			rejected = errors.As(err, &cdpErr)
+			return err
+		}
+		var err error
+		written, err = c.copyIOStream(ctx, conn, printed.Stream, w, "application/pdf", &started)
+		return err
+	})
+	if err == nil {
+		return
+	}
+	if started {
+		// Too late for an error status; the client sees a truncated PDF
+		log.Printf("⚠️ PDF of %s cut short after %d bytes: %v", c.labels.Describe(targetID), written, err)
+		return
+	}
+	if rejected {
+		http.Error(w, fmt.Sprintf("Failed to print PDF: %v", err), http.StatusBadRequest)
+		return
+	}
+	c.errorCount++
+	log.Printf("❌ Failed to print PDF of %s: %v", targetID, err)
+	http.Error(w, fmt.Sprintf("Failed to print PDF: %v", err), http.StatusBadGateway)
+}
+
+// Stream a CDP IO stream (a PDF, a trace) to w and close it. The header is
+// written with the first chunk, after which *started is set and errors
+// can no longer be answered with a status.
+func (c *ChromeDevToolsClient) copyIOStream(ctx context.Context, conn *CDPConn, handle string, w http.ResponseWriter, contentType string, started *bool) (int64, error) {
+	defer func() {
+		closeCtx, cancel := context.WithTimeout(context.Background(), c.client.Timeout)
+		defer cancel()
+		conn.Call(closeCtx, "", "IO.close", map[string]string{"handle": handle})
+	}()
+
+	rc := http.NewResponseController(w)
+	var written int64
+	for {
+		var chunk struct {
+			Data          string `json:"data"`
+			Base64Encoded bool   `json:"base64Encoded"`
+			EOF           bool   `json:"eof"`
+		}
+		// Reads share the request timeout, each chunk extends the write deadline
+		if err := conn.CallResult(ctx, "", "IO.read", map[string]interface{}{"handle": handle, "size": ioReadChunk}, &chunk); err != nil {
+			return written, err
+		}
+		data := []byte(chunk.Data)
+		if chunk.Base64Encoded {
+			var err error
+			if data, err = base64.StdEncoding.DecodeString(chunk.Data); err != nil {
+				return written, err
+			}
+		}
+		if !*started {
+			w.Header().Set("Content-Type", contentType)
+			w.Header().Set("Cache-Control", "no-store")
+			w.WriteHeader(http.StatusOK)
+			*started = true
+		}
+		rc.SetWriteDeadline(time.Now().Add(c.client.Timeout))
+		n, err := w.Write(data)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+		if chunk.EOF {
+			return written, nil
+		}
+		rc.Flush()
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// MethodPolicy decides which CDP commands clients may send (-cdpAllow,
+// -cdpDeny). Patterns are a method (Page.setDownloadBehavior), a whole
+// domain (Browser.*) or *. With an allowlist, only matching methods pass;
+// the denylist wins over it.
+type MethodPolicy struct {
+	allow []string
+	deny  []string
+
+	mu      sync.Mutex
+	blocked map[string]int64
+}
+
+func NewMethodPolicy(allow, deny []string) (*MethodPolicy, error) {
+	for _, pattern := range append(append([]string(nil), allow...), deny...) {
+		if !validMethodPattern(pattern) {
+			return nil, fmt.Errorf("invalid CDP method pattern %q (use Domain.method, Domain.* or *)", pattern)
+		}
+	}
+	return &MethodPolicy{allow: allow, deny: deny, blocked: make(map[string]int64)}, nil
+}
+
+func validMethodPattern(pattern string) bool {
+	if pattern == "*" {
+		return true
+	}
+	domain, method, ok := strings.Cut(pattern, ".")
+	return ok && domain != "" && method != "" && !strings.Contains(domain, "*") &&
+		(method == "*" || !strings.Contains(method, "*"))
+}
+
+func matchMethod(patterns []string, method string) bool {
+	for _, pattern := range patterns {
+		if pattern == "*" || pattern == method {
+			return true
+		}
+		if domain, ok := strings.CutSuffix(pattern, ".*"); ok && strings.HasPrefix(method, domain+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed reports whether clients may send method
+func (p *MethodPolicy) Allowed(method string) bool {
+	if matchMethod(p.deny, method) {
+		return false
+	}
+	return len(p.allow) == 0 || matchMethod(p.allow, method)
+}
+
+// Check counts and returns the error for a method the policy blocks, or
+// nil; who names the caller in the log. A nil policy allows everything.
+func (p *MethodPolicy) Check(method, who string) *CDPError {
+	if p == nil || p.Allowed(method) {
+		return nil
+	}
+	p.mu.Lock()
+	first := p.blocked[method] == 0
+	p.blocked[method]++
+	p.mu.Unlock()
+	if first {
+		log.Printf("🚫 Blocked CDP method %s from %s", method, who)
+	}
+	return &CDPError{Code: -32601, Message: fmt.Sprintf("'%s' is blocked by the proxy's CDP policy", method)}
+}
+
+// Register the policy on the interceptor chain: blocked commands are
+// answered with a CDP error and never reach Chrome. Connections admitted
+// with a break-glass grant are exempt.
+func (p *MethodPolicy) Register(chain *Interceptors) {
+	chain.OnCommand(func(ctx *MessageContext, method string, params json.RawMessage) (json.RawMessage, error) {
+		if ctx.BreakGlass {
+			return params, nil
+		}
+		if err := p.Check(method, ctx.String()); err != nil {
+			return nil, err
+		}
+		return params, nil
+	})
+}
+
+// Answer 403 unless the policy allows every method, for the API endpoints
+// that send commands to Chrome on a client's behalf
+func (c *ChromeDevToolsClient) allowCommands(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if err := c.policy.Check(method, apiCaller(r)); err != nil {
+			http.Error(w, err.Message, http.StatusForbidden)
+			return false
+		}
+	}
+	return true
+}
+
+func (p *MethodPolicy) Metrics() map[string]interface{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	byMethod := make(map[string]int64, len(p.blocked))
+	var total int64
+	for method, n := range p.blocked {
+		byMethod[method] = n
+		total += n
+	}
+	return map[string]interface{}{
+		"cdp_commands_blocked_total":     total,
+		"cdp_commands_blocked_by_method": byMethod,
+	}
+}
+
+// Name the caller of an API endpoint in logs
+func apiCaller(r *http.Request) string {
+	return fmt.Sprintf("%s (%s %s)", r.RemoteAddr, r.Method, r.URL.Path)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPolicyCoversAPIEndpoints(t *testing.T) {
+	chrome, err := StartFakeChrome()
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := NewMethodPolicy(nil, []string{"Browser.*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := chrome.addTarget("about:blank")
+	client := &http.Client{Timeout: 5 * time.Second}
+	c := &ChromeDevToolsClient{
+		client:  client,
+		control: NewControlSession(NewUpstream(chrome.HostPort()), client),
+		policy:  policy,
+	}
+
+	r := httptest.NewRequest("PUT", "/targets/ABC/window", strings.NewReader(`{"width": 800, "height": 600}`))
+	r.SetPathValue("id", "ABC")
+	w := httptest.NewRecorder()
+	c.handleSetWindow(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("PUT /targets/{id}/window with Browser.* denied = %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	// Other domains still pass
+	r = httptest.NewRequest("POST", "/targets/"+page.ID+"/activate", nil)
+	r.SetPathValue("id", page.ID)
+	w = httptest.NewRecorder()
+	c.handleActivateTarget(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("POST /targets/{id}/activate = %d %s, want %d", w.Code, w.Body, http.StatusNoContent)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// TuningProfile is a preset of resource settings selected with -profile
+type TuningProfile struct {
+	Name string `json:"name"`
+	// Copy buffer of each proxied HTTP response
+	ProxyBufferSize int `json:"proxyBufferSize"`
+	// Read buffer of the CDP connections the proxy opens itself
+	WebSocketReadBuffer int `json:"webSocketReadBuffer"`
+	// Requests (including open WebSocket connections) served at once, each
+	// costing a few goroutines; further ones get 503 (0 = unlimited)
+	MaxConcurrentRequests int `json:"maxConcurrentRequests"`
+	// GET /targets/{id}/frames attaches to every frame of a page
+	FrameInspection bool `json:"frameInspection"`
+	// Default for -maxLeases when it is not given (0 = unlimited)
+	MaxLeases int `json:"maxLeases"`
+}
+
+var tuningProfiles = map[string]TuningProfile{
+	"default": {
+		Name:                "default",
+		ProxyBufferSize:     32 << 10,
+		WebSocketReadBuffer: 4 << 10,
+		FrameInspection:     true,
+	},
+	// Tiny (e.g. ARM64) sandboxes with little memory and one or two cores
+	"small": {
+		Name:                  "small",
+		ProxyBufferSize:       8 << 10,
+		WebSocketReadBuffer:   2 << 10,
+		MaxConcurrentRequests: 32,
+		FrameInspection:       false,
+		MaxLeases:             2,
+	},
+}
+
+// The active profile
+var profile = tuningProfiles["default"]
+
+// Select the tuning profile by name
+func setProfile(name string) error {
+	p, ok := tuningProfiles[name]
+	if !ok {
+		names := make([]string, 0, len(tuningProfiles))
+		for n := range tuningProfiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown profile %q, expected one of %s", name, strings.Join(names, ", "))
+	}
+	profile = p
+	return nil
+}
+
+// bufferPool hands the reverse proxy copy buffers of the profile's size
+type bufferPool struct {
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	return &bufferPool{pool: sync.Pool{New: func() interface{} { return make([]byte, size) }}}
+}
+
+func (p *bufferPool) Get() []byte  { return p.pool.Get().([]byte) }
+func (p *bufferPool) Put(b []byte) { p.pool.Put(b) }
+
+// requestLimiter caps the requests served at once
+type requestLimiter struct {
+	slots    chan struct{}
+	mu       sync.Mutex
+	rejected int64
+}
+
+func newRequestLimiter(max int) *requestLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &requestLimiter{slots: make(chan struct{}, max)}
+}
+
+// Acquire a slot, or report false when all are taken. Release with the
+// returned function.
+func (l *requestLimiter) Acquire() (func(), bool) {
+	if l == nil {
+		return func() {}, true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return func() { <-l.slots }, true
+	default:
+		l.mu.Lock()
+		l.rejected++
+		l.mu.Unlock()
+		return nil, false
+	}
+}
+
+func (l *requestLimiter) Metrics() map[string]interface{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return map[string]interface{}{
+		"requests_in_flight":      len(l.slots),
+		"requests_rejected_total": l.rejected,
+	}
+}
+
+// Handle GET /config, the active tuning profile and the limits it set
+func (c *ChromeDevToolsClient) handleConfig(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"profile":   profile,
+		"maxLeases": maxLeases,
+	})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// BrowserProtection keeps clients from tearing down the shared Chrome
+// (-protectBrowser): Browser.close, Browser.crash and Target.closeTarget of
+// the browser target are answered with an error instead of reaching it.
+type BrowserProtection struct {
+	control *ControlSession
+
+	mu sync.Mutex
+	// Target id of the browser itself, looked up on first use, and the
+	// control connection it was looked up on: a new connection means the
+	// upstream Chrome restarted or failed over, with a new id
+	browserID   string
+	browserConn *CDPConn
+
+	blocked int64
+}
+
+func NewBrowserProtection(control *ControlSession) *BrowserProtection {
+	return &BrowserProtection{control: control}
+}
+
+// Check returns the error for a command that would tear down the browser,
+// or nil; who names the caller in the log. A nil protection allows
+// everything.
+func (p *BrowserProtection) Check(method string, params json.RawMessage, who string) *CDPError {
+	if p == nil {
+		return nil
+	}
+	switch method {
+	case "Browser.close", "Browser.crash":
+	case "Target.closeTarget":
+		var target struct {
+			TargetID string `json:"targetId"`
+		}
+		json.Unmarshal(params, &target)
+		browserID, err := p.browserTargetID()
+		if err != nil {
+			// Fail closed: the target may well be the browser
+			return &CDPError{Code: -32000, Message: fmt.Sprintf("Target.closeTarget is unavailable: %v", err)}
+		}
+		if target.TargetID != browserID {
+			return nil
+		}
+	default:
+		return nil
+	}
+	atomic.AddInt64(&p.blocked, 1)
+	log.Printf("🛡️ Blocked %s from %s", method, who)
+	return &CDPError{Code: -32000, Message: fmt.Sprintf("'%s' of the browser is not allowed through this proxy", method)}
+}
+
+// Register the protection on the interceptor chain
+func (p *BrowserProtection) Register(chain *Interceptors) {
+	chain.OnCommand(func(ctx *MessageContext, method string, params json.RawMessage) (json.RawMessage, error) {
+		if err := p.Check(method, params, ctx.String()); err != nil {
+			return nil, err
+		}
+		return params, nil
+	})
+}
+
+// Ask Chrome for the target id of the browser, which stays the same for the
+// life of the process and so of the control connection to it
+func (p *BrowserProtection) browserTargetID() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conn, err := p.control.Conn()
+	if err != nil {
+		return "", err
+	}
+	if conn == p.browserConn {
+		return p.browserID, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.control.timeout)
+	defer cancel()
+	var info struct {
+		TargetInfo TargetInfo `json:"targetInfo"`
+	}
+	if err := conn.CallResult(ctx, "", "Target.getTargetInfo", nil, &info); err != nil {
+		return "", err
+	}
+	p.browserID, p.browserConn = info.TargetInfo.TargetID, conn
+	return p.browserID, nil
+}
+
+func (p *BrowserProtection) Metrics() map[string]interface{} {
+	return map[string]interface{}{
+		"cdp_browser_commands_blocked_total": atomic.LoadInt64(&p.blocked),
+	}
+}
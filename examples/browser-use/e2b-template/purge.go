@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type deletedArtifact struct {
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// deletionReceipt is returned by the purge endpoints as proof of erasure.
+// It lists only artifact ids, never their content or metadata.
+type deletionReceipt struct {
+	ReceiptID string            `json:"receiptId"`
+	SandboxID string            `json:"sandboxId,omitempty"`
+	Identity  string            `json:"identity,omitempty"`
+	SessionID string            `json:"sessionId,omitempty"`
+	DeletedAt time.Time         `json:"deletedAt"`
+	Artifacts []deletedArtifact `json:"artifacts"`
+	// Rows of -storeFile and entries of the upload queue deleted
+	StoreRows     int    `json:"storeRows"`
+	QueuedUploads int    `json:"queuedUploads"`
+	Algorithm     string `json:"algorithm,omitempty"`
+	Signature     string `json:"signature,omitempty"`
+}
+
+// The signed payload is one field per line: receiptId, sandboxId, identity,
+// sessionId, deletedAt (RFC 3339 nanoseconds), the comma-joined ids, then
+// storeRows and queuedUploads
+func (r *deletionReceipt) payload() string {
+	ids := make([]string, len(r.Artifacts))
+	for i, a := range r.Artifacts {
+		ids[i] = a.ID
+	}
+	return strings.Join([]string{
+		r.ReceiptID,
+		r.SandboxID,
+		r.Identity,
+		r.SessionID,
+		r.DeletedAt.Format(time.RFC3339Nano),
+		strings.Join(ids, ","),
+		strconv.Itoa(r.StoreRows),
+		strconv.Itoa(r.QueuedUploads),
+	}, "\n")
+}
+
+func (r *deletionReceipt) sign(key string) {
+	if key == "" {
+		return
+	}
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write([]byte(r.payload()))
+	r.Algorithm = "HMAC-SHA256"
+	r.Signature = hex.EncodeToString(h.Sum(nil))
+}
+
+// Match artifacts by identity: "key=value" matches that label of the
+// capturing target, a bare value matches any label value
+func identityMatcher(identity string) func(*Artifact) bool {
+	key, value, exact := strings.Cut(identity, "=")
+	return func(a *Artifact) bool {
+		if exact {
+			return a.Meta["label."+key] == value
+		}
+		for k, v := range a.Meta {
+			if strings.HasPrefix(k, "label.") && v == identity {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Delete matching data from every place the proxy keeps it: the artifact
+// store, recordings left in -record, the rows of -storeFile (for a session
+// purge) and the upload queue. The receipt is signed only once all of it
+// is gone; a store that fails answers 500 so that the purge is retried.
+func (c *ChromeDevToolsClient) purge(w http.ResponseWriter, receipt *deletionReceipt, match func(*Artifact) bool) {
+	if c.artifacts == nil && c.cdpRecorder == nil && (c.store == nil || receipt.SessionID == "") {
+		http.Error(w, "Artifact store is disabled (set -artifactDir)", http.StatusNotFound)
+		return
+	}
+	var deleted []deletedArtifact
+	fail := func(what string, err error) {
+		c.errorCount++
+		log.Printf("❌ Purge %s deleted %d artifacts before failing to delete %s: %v", receipt.ReceiptID, len(deleted), what, err)
+		http.Error(w, "Purge incomplete, retry to delete the remaining data: "+err.Error(), http.StatusInternalServerError)
+	}
+
+	// Keys the deleted data would be uploaded under
+	uploadKeys := make(map[string]bool)
+	if c.artifacts != nil {
+		artifacts, err := c.artifacts.Delete(match)
+		for _, a := range artifacts {
+			deleted = append(deleted, deletedArtifact{ID: a.ID, Kind: a.Kind, CreatedAt: a.CreatedAt})
+			uploadKeys["artifacts/"+a.Kind+"/"+a.ID] = true
+		}
+		if err != nil {
+			fail("artifacts", err)
+			return
+		}
+	}
+	if c.cdpRecorder != nil {
+		recordings, err := c.cdpRecorder.Purge(match)
+		for _, a := range recordings {
+			deleted = append(deleted, a)
+			uploadKeys["recordings/"+a.ID] = true
+		}
+		if err != nil {
+			fail("recordings", err)
+			return
+		}
+	}
+	if c.store != nil && receipt.SessionID != "" {
+		rows, err := c.store.PurgeSession(receipt.SessionID)
+		receipt.StoreRows = rows
+		if err != nil {
+			fail("store rows", err)
+			return
+		}
+	}
+	if c.upload != nil && len(uploadKeys) > 0 {
+		queued, err := c.upload.Purge(func(key string) bool {
+			// Compressed uploads carry the codec's extension
+			return uploadKeys[key] || uploadKeys[strings.TrimSuffix(key, filepath.Ext(key))]
+		})
+		receipt.QueuedUploads = queued
+		if err != nil {
+			fail("queued uploads", err)
+			return
+		}
+	}
+
+	receipt.SandboxID = sandboxID
+	receipt.DeletedAt = c.clock.Now().UTC()
+	receipt.Artifacts = deleted
+	if receipt.Artifacts == nil {
+		receipt.Artifacts = []deletedArtifact{}
+	}
+	receipt.sign(receiptSigningKey)
+	log.Printf("🧹 Purge %s deleted %d artifacts, %d store rows and %d queued uploads", receipt.ReceiptID, len(deleted), receipt.StoreRows, receipt.QueuedUploads)
+	writeJSON(w, http.StatusOK, receipt)
+}
+
+/*
+Handle DELETE /artifacts?identity=...
+Erases every artifact captured from targets labeled with the identity,
+e.g. ?identity=customer=42, and returns a deletion receipt.
+*/
+func (c *ChromeDevToolsClient) handlePurgeIdentity(w http.ResponseWriter, r *http.Request) {
+	identity := r.URL.Query().Get("identity")
+	if identity == "" || strings.HasSuffix(identity, "=") {
+		http.Error(w, "identity query parameter is required", http.StatusBadRequest)
+		return
+	}
+	c.purge(w, &deletionReceipt{ReceiptID: newToken(), Identity: identity}, identityMatcher(identity))
+}
+
+// Handle DELETE /sessions/{id}/data, erasing everything kept of a session:
+// a page target id, or the session ID the page was leased with
+func (c *ChromeDevToolsClient) handlePurgeSession(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.PathValue("id")
+	c.purge(w, &deletionReceipt{ReceiptID: newToken(), SessionID: sessionID}, func(a *Artifact) bool {
+		return belongsToSession(a, sessionID)
+	})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A session purge reaches every place the session's data is kept, by the
+// same lookup the readers use
+func TestPurgeSession(t *testing.T) {
+	dir := t.TempDir()
+	artifacts, err := NewArtifactStore(systemClock, filepath.Join(dir, "artifacts"), nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder, err := NewCDPRecorder(systemClock, filepath.Join(dir, "record"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := LoadSessionStore(filepath.Join(dir, "store.jsonl"), 0, systemClock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &ChromeDevToolsClient{clock: systemClock, artifacts: artifacts, cdpRecorder: recorder, store: store}
+
+	// Stored under the leased session ID only, as videos and thumbnails are
+	artifacts.Put("video", "a.webm", []byte("video"), "video/webm", map[string]string{"targetId": "T1", "label.session": "s1"})
+	kept, _ := artifacts.Put("video", "b.webm", []byte("video"), "video/webm", map[string]string{"targetId": "T2", "label.session": "s2"})
+	now := time.Now()
+	for session, target := range map[string]string{"s1": "T1", "s2": "T2"} {
+		line, _ := json.Marshal(cdpRecord{Time: &now, Type: "connection", Session: session, Target: target})
+		os.WriteFile(filepath.Join(dir, "record", "20260101T000000.000Z-"+session+".ndjson"), append(line, '\n'), 0o600)
+	}
+	store.RecordSession(&SessionSummary{SessionID: "s1", TargetID: "T1", ClosedAt: &now})
+	store.RecordLease(LeaseEvent{Time: now, TargetID: "T1"})
+	store.RecordSession(&SessionSummary{SessionID: "s2", TargetID: "T2", ClosedAt: &now})
+
+	r := httptest.NewRequest("DELETE", "/sessions/s1/data", nil)
+	r.SetPathValue("id", "s1")
+	w := httptest.NewRecorder()
+	c.handlePurgeSession(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("purge = %d %s", w.Code, w.Body)
+	}
+	var receipt deletionReceipt
+	json.Unmarshal(w.Body.Bytes(), &receipt)
+	kinds := map[string]int{}
+	for _, a := range receipt.Artifacts {
+		kinds[a.Kind]++
+	}
+	if kinds["video"] != 1 || kinds["recording"] != 1 || len(receipt.Artifacts) != 2 {
+		t.Errorf("receipt artifacts = %+v, want one video and one recording", receipt.Artifacts)
+	}
+	if receipt.StoreRows != 2 {
+		t.Errorf("receipt store rows = %d, want 2", receipt.StoreRows)
+	}
+
+	if left := artifacts.List(nil); len(left) != 1 || left[0].ID != kept.ID {
+		t.Errorf("artifacts left = %v, want only %s", left, kept.ID)
+	}
+	if files, _ := os.ReadDir(filepath.Join(dir, "record")); len(files) != 1 {
+		t.Errorf("%d recordings left, want 1", len(files))
+	}
+	reloaded, err := LoadSessionStore(filepath.Join(dir, "store.jsonl"), 0, systemClock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reloaded.sessions) != 1 || reloaded.sessions[0].SessionID != "s2" || len(reloaded.leases) != 0 {
+		t.Errorf("store rows left: sessions %+v, leases %+v", reloaded.sessions, reloaded.leases)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Delays that would end this close to the interceptor's deadline are
+// rejected instead, leaving time to continue the request
+const originDelayMargin = time.Second
+
+// OriginRateLimiter spaces out page loads (document requests) to the same
+// host across every session of the sandbox. Requests over the budget are
+// held until their slot, or failed when the wait would exceed maxDelay.
+type OriginRateLimiter struct {
+	// Requests per second by host; "*" is the default for other hosts.
+	// A parent domain's limit applies to its subdomains, each separately.
+	rates    map[string]float64
+	burst    int
+	maxDelay time.Duration
+	clock    Clock
+
+	mu       sync.Mutex
+	next     map[string]time.Time // theoretical arrival time per host
+	delayed  int64
+	rejected int64
+	waited   time.Duration
+}
+
+// Parse "*=1,example.com=0.2" into requests per second by host
+func parseOriginRates(spec string) (map[string]float64, error) {
+	rates := make(map[string]float64)
+	for _, item := range splitList(spec) {
+		host, value, ok := strings.Cut(item, "=")
+		rate, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if !ok || err != nil || rate <= 0 {
+			return nil, fmt.Errorf("invalid rate %q, expected host=requestsPerSecond", item)
+		}
+		rates[strings.ToLower(strings.TrimSpace(host))] = rate
+	}
+	return rates, nil
+}
+
+func NewOriginRateLimiter(clock Clock, rates map[string]float64, burst int, maxDelay time.Duration) *OriginRateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &OriginRateLimiter{clock: clock, rates: rates, burst: burst, maxDelay: maxDelay, next: make(map[string]time.Time)}
+}
+
+// Rate for a host, from the host itself, its parent domains or the default
+func (l *OriginRateLimiter) rate(host string) float64 {
+	for h := host; h != ""; {
+		if rate, ok := l.rates[h]; ok {
+			return rate
+		}
+		i := strings.IndexByte(h, '.')
+		if i < 0 {
+			break
+		}
+		h = h[i+1:]
+	}
+	return l.rates["*"]
+}
+
+// Reserve returns how long a request to host must wait for its slot, or
+// ok=false when that exceeds limit. Uses the generic cell rate algorithm:
+// each request pushes the host's arrival time one interval into the
+// future, and up to burst requests may run ahead of it.
+func (l *OriginRateLimiter) Reserve(host string, limit time.Duration) (delay time.Duration, ok bool) {
+	rate := l.rate(host)
+	if rate <= 0 {
+		return 0, true
+	}
+	interval := time.Duration(float64(time.Second) / rate)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.clock.Now()
+	if len(l.next) > 1000 {
+		for h, t := range l.next {
+			if t.Before(now) {
+				delete(l.next, h)
+			}
+		}
+	}
+	tat := l.next[host]
+	if tat.Before(now) {
+		tat = now
+	}
+	delay = tat.Sub(now) - time.Duration(l.burst-1)*interval
+	if delay < 0 {
+		delay = 0
+	}
+	if delay > limit {
+		l.rejected++
+		return delay, false
+	}
+	l.next[host] = tat.Add(interval)
+	if delay > 0 {
+		l.delayed++
+		l.waited += delay
+	}
+	return delay, true
+}
+
+func (l *OriginRateLimiter) HandleRequestPaused(ctx context.Context, s *PageSession, ev *FetchRequestPaused) bool {
+	if ev.IsResponseStage() || ev.ResourceType != "Document" {
+		return false
+	}
+	u, err := url.Parse(ev.Request.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+
+	limit := l.maxDelay
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline)-originDelayMargin < limit {
+		limit = time.Until(deadline) - originDelayMargin
+	}
+	delay, ok := l.Reserve(host, limit)
+	if !ok {
+		log.Printf("🐢 Page load of %s in %s rejected: %s is over its rate budget (wait would be %v)", ev.Request.URL, s.Describe(), host, delay.Round(time.Millisecond))
+		s.Call(ctx, "Fetch.failRequest", map[string]interface{}{
+			"requestId":   ev.RequestID,
+			"errorReason": "BlockedByClient",
+		})
+		return true
+	}
+	if delay > 0 {
+		log.Printf("🐢 Delaying page load of %s in %s by %v", ev.Request.URL, s.Describe(), delay.Round(time.Millisecond))
+		select {
+		case <-l.clock.After(delay):
+		case <-ctx.Done():
+		}
+	}
+	return false
+}
+
+func (l *OriginRateLimiter) Metrics() map[string]interface{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return map[string]interface{}{
+		"origin_rate_hosts":          len(l.next),
+		"origin_rate_delayed_total":  l.delayed,
+		"origin_rate_rejected_total": l.rejected,
+		"origin_rate_wait_seconds":   l.waited.Seconds(),
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOriginRateLimiterReserve(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	l := NewOriginRateLimiter(clock, map[string]float64{"example.com": 2}, 1, time.Second)
+
+	steps := []struct {
+		host    string
+		advance time.Duration
+		delay   time.Duration
+		ok      bool
+	}{
+		{host: "example.com", delay: 0, ok: true},
+		{host: "example.com", delay: 500 * time.Millisecond, ok: true},
+		{host: "example.com", delay: time.Second, ok: true},
+		// Over the limit, and not counted against the budget
+		{host: "example.com", delay: 1500 * time.Millisecond, ok: false},
+		// Subdomains share the parent's rate but have their own budget
+		{host: "www.example.com", delay: 0, ok: true},
+		// Hosts without a rate are not limited
+		{host: "other.test", delay: 0, ok: true},
+		{host: "other.test", delay: 0, ok: true},
+		{host: "example.com", advance: 600 * time.Millisecond, delay: 900 * time.Millisecond, ok: true},
+		{host: "example.com", advance: 5 * time.Second, delay: 0, ok: true},
+	}
+	for i, step := range steps {
+		clock.Advance(step.advance)
+		delay, ok := l.Reserve(step.host, time.Second)
+		if delay != step.delay || ok != step.ok {
+			t.Fatalf("step %d: Reserve(%s) = %v, %v; want %v, %v", i, step.host, delay, ok, step.delay, step.ok)
+		}
+	}
+}
+
+func TestOriginRateLimiterBurst(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	l := NewOriginRateLimiter(clock, map[string]float64{"*": 1}, 3, time.Minute)
+	for i := 0; i < 3; i++ {
+		if delay, _ := l.Reserve("example.com", time.Minute); delay != 0 {
+			t.Fatalf("request %d of the burst delayed by %v", i, delay)
+		}
+	}
+	if delay, _ := l.Reserve("example.com", time.Minute); delay != time.Second {
+		t.Fatalf("request past the burst delayed by %v, want 1s", delay)
+	}
+}
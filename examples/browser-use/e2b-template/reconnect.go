@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Wait between two dials of a dropped shared connection
+const muxRedialInterval = 500 * time.Millisecond
+
+var errTargetGone = errors.New("target no longer exists")
+
+// Re-establish a shared connection Chrome dropped (a crash, a restart by
+// the supervisor, a closed DevTools socket) within -upstreamReconnect,
+// keeping its clients connected: commands in flight are answered with an
+// error, flattened sessions are attached again (to the target's restored
+// copy after a failover with checkpoints) under the ids clients know, and
+// state-setting commands such as Page.enable are replayed. Messages clients
+// send meanwhile are held (up to -reconnectBuffer) and forwarded once the
+// sessions are back. Sessions whose target is gone are reported to their
+// client as detached. Returns false when the clients must be closed instead.
+func (c *ChromeDevToolsClient) reconnectMux(up *muxUpstream) (ok bool) {
+	if c.reconnect <= 0 {
+		return false
+	}
+	up.mu.Lock()
+	if up.closed {
+		up.mu.Unlock()
+		return false
+	}
+	up.reconnecting = true
+	lost := up.pending
+	up.pending = make(map[int64]muxPending)
+	up.mu.Unlock()
+	defer func() { releaseMux(up, ok) }()
+	for _, p := range lost {
+		p.client.fail(p.id, p.sessionID, "Chrome connection was lost before the command was answered")
+	}
+	log.Printf("🔌 Shared Chrome connection %s dropped, reconnecting for up to %s", up.key, c.reconnect)
+
+	start := c.clock.Now()
+	for {
+		up.mu.Lock()
+		closed := up.closed
+		up.mu.Unlock()
+		if closed {
+			return false
+		}
+		hostPort := c.upstreamForRequest(up.req).HostPort()
+		requestURI, err := c.redialURI(up.req.URL, hostPort)
+		if err == nil {
+			var ws *WebSocketConn
+			var body io.Closer
+			if ws, body, err = c.dialMuxConn(up.req, hostPort, requestURI); err == nil {
+				up.body.Close()
+				up.mu.Lock()
+				up.ws, up.body = ws, body
+				closed = up.closed
+				up.mu.Unlock()
+				if closed {
+					// The last client left while dialing
+					ws.Close()
+					return false
+				}
+				break
+			}
+		}
+		if errors.Is(err, errTargetGone) || c.clock.Since(start) > c.reconnect {
+			log.Printf("❌ Cannot reconnect shared Chrome connection %s: %v", up.key, err)
+			return false
+		}
+		<-c.clock.After(muxRedialInterval)
+	}
+	atomic.AddInt64(&c.mux.reconnects, 1)
+
+	reattached, total := c.reattachMux(up)
+	log.Printf("🔌 Reconnected shared Chrome connection %s in %s, %d/%d sessions attached again", up.key, c.clock.Since(start).Round(time.Millisecond), reattached, total)
+	return true
+}
+
+// Forward the messages held during a reconnect, or when it failed answer
+// the held commands with a timeout, then let clients send again
+func releaseMux(up *muxUpstream, reconnected bool) {
+	for {
+		up.mu.Lock()
+		held := up.held
+		up.held = nil
+		if len(held) == 0 {
+			up.reconnecting = false
+			up.mu.Unlock()
+			return
+		}
+		up.mu.Unlock()
+		for _, h := range held {
+			up.mu.Lock()
+			present := up.clients[h.client]
+			up.mu.Unlock()
+			switch {
+			case !present:
+			case reconnected:
+				up.forward(h.client, h.opcode, h.payload, true)
+			case h.id != nil:
+				h.client.fail(h.id, h.sessionID, "Timed out: the Chrome connection could not be re-established")
+			}
+		}
+	}
+}
+
+// The request URI to dial on hostPort for a dropped connection: the
+// browser endpoint of the current Chrome, or the page's restored copy
+func (c *ChromeDevToolsClient) redialURI(u *url.URL, hostPort string) (string, error) {
+	next := *u
+	if strings.HasPrefix(u.Path, "/devtools/browser/") {
+		var version struct {
+			WebSocketDebuggerURL string `json:"webSocketDebuggerUrl"`
+		}
+		if err := getJSON(c.client, "http://"+hostPort+"/json/version", &version); err != nil {
+			return "", err
+		}
+		browserURL, err := url.Parse(version.WebSocketDebuggerURL)
+		if err != nil {
+			return "", err
+		}
+		next.Path = browserURL.Path
+		return next.RequestURI(), nil
+	}
+	targetID := c.checkpoints.Moved(devtoolsTargetID(u.Path))
+	var targets []struct {
+		ID string `json:"id"`
+	}
+	if err := getJSON(c.client, "http://"+hostPort+"/json/list", &targets); err != nil {
+		return "", err
+	}
+	for _, t := range targets {
+		if t.ID == targetID {
+			next.Path = strings.TrimSuffix(u.Path, devtoolsTargetID(u.Path)) + targetID
+			return next.RequestURI(), nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s", errTargetGone, targetID)
+}
+
+// Attach the flattened sessions of clients again and replay their state,
+// returning how many of how many sessions were attached
+func (c *ChromeDevToolsClient) reattachMux(up *muxUpstream) (int, int) {
+	up.mu.Lock()
+	replay := append([]muxCommand(nil), up.replay...)
+	attached := make(map[string]*muxAttachment, len(up.attached))
+	for sessionID, a := range up.attached {
+		attached[sessionID] = a
+	}
+	up.toChrome, up.fromChrome = make(map[string]string), make(map[string]string)
+	up.mu.Unlock()
+
+	for _, cmd := range replay {
+		if _, err := c.muxCall(up, "", cmd.method, cmd.params); err != nil {
+			log.Printf("⚠️ Replaying %s on reconnected %s failed: %v", cmd.method, up.key, err)
+		}
+	}
+	done := 0
+	for sessionID, a := range attached {
+		targetID := c.checkpoints.Moved(a.targetID)
+		params, _ := json.Marshal(map[string]interface{}{"targetId": targetID, "flatten": true})
+		result, err := c.muxCall(up, "", "Target.attachToTarget", params)
+		var session struct {
+			SessionID string `json:"sessionId"`
+		}
+		if err == nil {
+			err = json.Unmarshal(result, &session)
+		}
+		if err != nil {
+			log.Printf("⚠️ Cannot attach session %s to %s again: %v", sessionID, targetID, err)
+			up.mu.Lock()
+			delete(up.attached, sessionID)
+			delete(up.owners, sessionID)
+			up.mu.Unlock()
+			event, _ := json.Marshal(map[string]interface{}{
+				"method": "Target.detachedFromTarget",
+				"params": map[string]string{"sessionId": sessionID, "targetId": a.targetID},
+			})
+			a.client.deliver(wsOpText, event)
+			continue
+		}
+		up.mu.Lock()
+		up.toChrome[sessionID], up.fromChrome[session.SessionID] = session.SessionID, sessionID
+		a.targetID = targetID
+		replay := append([]muxCommand(nil), a.replay...)
+		up.mu.Unlock()
+		for _, cmd := range replay {
+			if _, err := c.muxCall(up, session.SessionID, cmd.method, cmd.params); err != nil {
+				log.Printf("⚠️ Replaying %s on session %s failed: %v", cmd.method, sessionID, err)
+			}
+		}
+		done++
+		atomic.AddInt64(&c.mux.reattached, 1)
+	}
+	return done, len(attached)
+}
+
+// Send a command of the proxy's own on the shared connection and wait for
+// its response, routing other messages to clients meanwhile. Only the
+// connection's reader may call it.
+func (c *ChromeDevToolsClient) muxCall(up *muxUpstream, sessionID, method string, params json.RawMessage) (json.RawMessage, error) {
+	up.mu.Lock()
+	up.nextID++
+	id := up.nextID
+	ws := up.ws
+	up.mu.Unlock()
+	data, err := json.Marshal(&relayEnvelope{ID: json.RawMessage(fmt.Sprint(id)), SessionID: sessionID, Method: method, Params: params})
+	if err != nil {
+		return nil, err
+	}
+	if err := ws.WriteMessage(wsOpText, data); err != nil {
+		return nil, err
+	}
+	ws.conn.SetReadDeadline(time.Now().Add(c.client.Timeout))
+	defer ws.conn.SetReadDeadline(time.Time{})
+	for {
+		opcode, payload, err := ws.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		var resp struct {
+			ID     *int64          `json:"id"`
+			Method string          `json:"method"`
+			Result json.RawMessage `json:"result"`
+			Error  *CDPError       `json:"error"`
+		}
+		if opcode != wsOpText || json.Unmarshal(payload, &resp) != nil || resp.ID == nil || *resp.ID != id {
+			// Clients know the session the proxy attaches by its old id
+			if method == "Target.attachToTarget" && resp.Method == "Target.attachedToTarget" && sessionID == "" {
+				continue
+			}
+			up.dispatch(opcode, payload)
+			continue
+		}
+		if resp.Error != nil {
+			return nil, resp.Error
+		}
+		return resp.Result, nil
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Timestamp prefix of recording file names, sorting in connection order
+const recordingTimeFormat = "20060102T150405.000Z"
+
+// cdpRecord is one line of a recording (NDJSON). The first line is a
+// "connection" record describing the client connection; the others are
+// "command" records sent by the client and "response" and "event" records
+// sent by Chrome, with the message as relayed. Only the connection record
+// has a wall clock time; every record has the monotonic microseconds since
+// it, so that clock jumps in the sandbox do not reorder or stretch a
+// recording.
+type cdpRecord struct {
+	Time      *time.Time `json:"time,omitempty"`
+	ElapsedUs int64      `json:"elapsedUs"`
+	Type      string     `json:"type"`
+
+	Session    string      `json:"session,omitempty"`
+	Task       string      `json:"task,omitempty"`
+	Target     string      `json:"target,omitempty"`
+	Path       string      `json:"path,omitempty"`
+	RemoteAddr string      `json:"remoteAddr,omitempty"`
+	Client     *ClientInfo `json:"client,omitempty"`
+
+	// Flattened CDP session the message belongs to
+	CDPSessionID string          `json:"sessionId,omitempty"`
+	ID           json.RawMessage `json:"id,omitempty"`
+	// For responses, the method of the command answered
+	Method  string          `json:"method,omitempty"`
+	Message json.RawMessage `json:"message,omitempty"`
+}
+
+// CDPRecorder writes every CDP command, response and event of each client
+// connection to its own timestamped NDJSON file (-record), for debugging
+// agent runs after the fact. With an artifact store the file in -record is
+// only a private spool: the finished recording is moved into the store as
+// a "recording" artifact, encrypted, compressed and purgeable like the
+// others.
+type CDPRecorder struct {
+	clock Clock
+	dir   string
+	store *ArtifactStore
+
+	mu sync.Mutex
+	// Recordings of open connections by file name
+	open map[string]*cdpRecording
+
+	recordings int64
+	messages   int64
+	failed     int64
+}
+
+func NewCDPRecorder(clock Clock, dir string, store *ArtifactStore) (*CDPRecorder, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &CDPRecorder{clock: clock, dir: dir, store: store, open: make(map[string]*cdpRecording)}, nil
+}
+
+// cdpRecording is the file of one client connection
+type cdpRecording struct {
+	rec *CDPRecorder
+
+	// Connection time, which record offsets are measured from
+	start time.Time
+
+	// File name, and the metadata it is stored with
+	name string
+	meta map[string]string
+
+	mu   sync.Mutex
+	file *os.File
+	// Methods of recorded commands by CDP session and id, to name responses
+	pending map[string]string
+	// Parsers still running; the file is closed when both are done
+	open int
+	// Deleted by a purge while the connection was open: nothing more is
+	// written and nothing is stored
+	purged bool
+}
+
+// Tap records the CDP messages of an upgraded client connection, as
+// exchanged with Chrome
+func (rec *CDPRecorder) Tap(r *http.Request, body io.ReadWriteCloser) io.ReadWriteCloser {
+	if rec == nil {
+		return body
+	}
+	now := rec.clock.Now()
+	sessionID := r.Header.Get(sessionHeader)
+	if sessionID == "" {
+		sessionID = newID()
+	} else if err := checkID("session", sessionID); err != nil {
+		// The ID names the file, so it must not reach outside -record
+		atomic.AddInt64(&rec.failed, 1)
+		log.Printf("⚠️ Not recording connection from %s: %v", r.RemoteAddr, err)
+		return body
+	}
+	name := fmt.Sprintf("%s-%s.ndjson", now.UTC().Format(recordingTimeFormat), strings.ReplaceAll(sessionID, ":", "."))
+	f, err := os.OpenFile(filepath.Join(rec.dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		atomic.AddInt64(&rec.failed, 1)
+		log.Printf("⚠️ Failed to record session %s: %v", sessionID, err)
+		return body
+	}
+	atomic.AddInt64(&rec.recordings, 1)
+
+	targetID := devtoolsTargetID(r.URL.Path)
+	if targetID == "" {
+		targetID = browserTargetID
+	}
+	meta := map[string]string{"targetId": targetID, "label.session": sessionID}
+	if task := r.Header.Get(taskHeader); task != "" {
+		meta["label.task"] = task
+	}
+	recording := &cdpRecording{rec: rec, start: now, name: name, meta: meta, file: f, pending: make(map[string]string), open: 2}
+	rec.mu.Lock()
+	rec.open[name] = recording
+	rec.mu.Unlock()
+	recording.write(&cdpRecord{
+		Time:       &now,
+		Type:       "connection",
+		Session:    sessionID,
+		Task:       r.Header.Get(taskHeader),
+		Target:     targetID,
+		Path:       r.URL.Path,
+		RemoteAddr: r.RemoteAddr,
+		Client:     classifyClient(r),
+	})
+	return &recordedConn{
+		ReadWriteCloser: body,
+		toChrome:        parseWebSocketStream(recording.fromClient, recording.done),
+		fromChrome:      parseWebSocketStream(recording.fromChrome, recording.done),
+	}
+}
+
+func (c *cdpRecording) write(record *cdpRecord) {
+	record.ElapsedUs = c.rec.clock.Since(c.start).Microseconds()
+	line, err := json.Marshal(record)
+	if err != nil {
+		atomic.AddInt64(&c.rec.failed, 1)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file == nil {
+		return
+	}
+	if _, err := c.file.Write(append(line, '\n')); err != nil {
+		atomic.AddInt64(&c.rec.failed, 1)
+		return
+	}
+	if record.Type != "connection" {
+		atomic.AddInt64(&c.rec.messages, 1)
+	}
+}
+
+func (c *cdpRecording) fromClient(payload []byte) {
+	var msg relayEnvelope
+	if json.Unmarshal(payload, &msg) != nil || msg.Method == "" {
+		return
+	}
+	c.mu.Lock()
+	c.pending[pendingKey(msg.SessionID, msg.ID)] = msg.Method
+	c.mu.Unlock()
+	c.write(&cdpRecord{Type: "command", CDPSessionID: msg.SessionID, ID: msg.ID, Method: msg.Method, Message: payload})
+}
+
+func (c *cdpRecording) fromChrome(payload []byte) {
+	var msg relayEnvelope
+	if json.Unmarshal(payload, &msg) != nil {
+		return
+	}
+	record := &cdpRecord{Type: "event", CDPSessionID: msg.SessionID, Method: msg.Method, Message: payload}
+	if msg.Method == "" {
+		key := pendingKey(msg.SessionID, msg.ID)
+		c.mu.Lock()
+		record.Method = c.pending[key]
+		delete(c.pending, key)
+		c.mu.Unlock()
+		record.Type, record.ID = "response", msg.ID
+	}
+	c.write(record)
+}
+
+// Close the file once both directions have been parsed to the end
+func (c *cdpRecording) done() {
+	c.mu.Lock()
+	if c.open--; c.open > 0 {
+		c.mu.Unlock()
+		return
+	}
+	if c.file != nil {
+		c.file.Close()
+		c.file = nil
+	}
+	purged := c.purged
+	c.mu.Unlock()
+	c.rec.mu.Lock()
+	delete(c.rec.open, c.name)
+	c.rec.mu.Unlock()
+	if c.rec.store != nil && !purged {
+		c.store()
+	}
+}
+
+// Move the finished spool file into the artifact store. A spool that could
+// not be stored is left in -record.
+func (c *cdpRecording) store() {
+	spool := filepath.Join(c.rec.dir, c.name)
+	data, err := os.ReadFile(spool)
+	if err == nil {
+		_, err = c.rec.store.Put("recording", c.name, data, "application/x-ndjson", c.meta)
+	}
+	if err != nil {
+		atomic.AddInt64(&c.rec.failed, 1)
+		log.Printf("⚠️ Failed to store recording %s: %v", c.name, err)
+		return
+	}
+	os.Remove(spool)
+}
+
+// Purge deletes the recordings left in -record whose connection matches,
+// spools of open connections included; those stop being written and are
+// not stored when the connection ends. Each recording is matched as an
+// artifact with the metadata it would be stored with.
+func (rec *CDPRecorder) Purge(match func(*Artifact) bool) ([]deletedArtifact, error) {
+	entries, err := os.ReadDir(rec.dir)
+	if err != nil {
+		return nil, err
+	}
+	var deleted []deletedArtifact
+	var removeErr error
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".ndjson") {
+			continue
+		}
+		path := filepath.Join(rec.dir, e.Name())
+		rec.mu.Lock()
+		recording := rec.open[e.Name()]
+		rec.mu.Unlock()
+		a := &Artifact{ID: e.Name(), Kind: "recording"}
+		if recording != nil {
+			a.Meta, a.CreatedAt = recording.meta, recording.start
+		} else if a.Meta, a.CreatedAt, err = recordingMeta(path); err != nil {
+			// A recording that cannot be read might match
+			removeErr = err
+			continue
+		}
+		if !match(a) {
+			continue
+		}
+		if recording != nil {
+			recording.mu.Lock()
+			recording.purged = true
+			recording.file.Close()
+			recording.file = nil
+			recording.mu.Unlock()
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			removeErr = err
+			continue
+		}
+		deleted = append(deleted, deletedArtifact{ID: a.ID, Kind: a.Kind, CreatedAt: a.CreatedAt})
+	}
+	return deleted, removeErr
+}
+
+// The metadata of a recording file, from its connection record
+func recordingMeta(path string) (map[string]string, time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer f.Close()
+	var first cdpRecord
+	if err := json.NewDecoder(f).Decode(&first); err != nil || first.Type != "connection" || first.Time == nil {
+		return nil, time.Time{}, fmt.Errorf("recording %s does not start with a connection record", filepath.Base(path))
+	}
+	meta := map[string]string{"targetId": first.Target, "label.session": first.Session}
+	if first.Task != "" {
+		meta["label.task"] = first.Task
+	}
+	return meta, *first.Time, nil
+}
+
+// Handle GET /sessions/{id}/recordings, the JSON index of the stored CDP
+// recordings of a session
+func (c *ChromeDevToolsClient) handleListRecordings(w http.ResponseWriter, r *http.Request) {
+	if c.cdpRecorder == nil || c.artifacts == nil {
+		http.Error(w, "Recording storage is disabled (set -record and -artifactDir)", http.StatusNotFound)
+		return
+	}
+	id := r.PathValue("id")
+	recordings := c.artifacts.Session("recording", id)
+	entries := make([]map[string]interface{}, 0, len(recordings))
+	for _, a := range recordings {
+		entries = append(entries, map[string]interface{}{
+			"id":        a.ID,
+			"name":      a.Name,
+			"targetId":  a.Meta["targetId"],
+			"size":      a.Size,
+			"createdAt": a.CreatedAt,
+			"url":       "/sessions/" + id + "/recordings/" + a.ID,
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"sessionId": id, "recordings": entries})
+}
+
+// Handle GET /sessions/{id}/recordings/{recording}, one recording as NDJSON
+func (c *ChromeDevToolsClient) handleGetRecording(w http.ResponseWriter, r *http.Request) {
+	if c.cdpRecorder == nil || c.artifacts == nil {
+		http.Error(w, "Recording storage is disabled (set -record and -artifactDir)", http.StatusNotFound)
+		return
+	}
+	body, a, err := c.artifacts.Open(r.PathValue("recording"))
+	if err != nil || a.Kind != "recording" || !belongsToSession(a, r.PathValue("id")) {
+		if err == nil {
+			body.Close()
+		}
+		if err == nil || os.IsNotExist(err) {
+			http.Error(w, "Recording not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", a.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(a.Size, 10))
+	io.Copy(w, body)
+}
+
+func (rec *CDPRecorder) Metrics() map[string]interface{} {
+	return map[string]interface{}{
+		"cdp_recordings_total":        atomic.LoadInt64(&rec.recordings),
+		"cdp_recorded_messages_total": atomic.LoadInt64(&rec.messages),
+		"cdp_record_errors_total":     atomic.LoadInt64(&rec.failed),
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Stylesheet freezing CSS animations and transitions at their end state
+// and hiding the blinking caret, injected before page scripts run
+const deterministicRenderingScript = `(() => {
+	const css = "*, *::before, *::after {" +
+		"animation-duration: 0s !important; animation-delay: 0s !important;" +
+		"transition-duration: 0s !important; transition-delay: 0s !important;" +
+		"caret-color: transparent !important; scroll-behavior: auto !important; }";
+	const add = () => {
+		const style = document.createElement("style");
+		style.textContent = css;
+		(document.head || document.documentElement).appendChild(style);
+	};
+	if (document.documentElement) add();
+	else document.addEventListener("DOMContentLoaded", add, { once: true });
+})()`
+
+// Chrome switches for stable glyph rasterization and colors, added when the
+// proxy launches Chrome itself
+var deterministicRenderingSwitches = []string{
+	"--font-render-hinting=none",
+	"--disable-font-subpixel-positioning",
+	"--disable-lcd-text",
+	"--force-color-profile=srgb",
+}
+
+// DeterministicRendering makes screenshots of a page reproducible for
+// visual testing: device scale 1, no animations, a fixed white default
+// background and hidden scrollbars, on every page and iframe target
+type DeterministicRendering struct {
+	applied int64
+	failed  int64
+}
+
+type renderingStep struct {
+	method string
+	params map[string]interface{}
+}
+
+func NewDeterministicRendering() *DeterministicRendering {
+	return &DeterministicRendering{}
+}
+
+func (d *DeterministicRendering) Name() string {
+	return "deterministic-rendering"
+}
+
+func (d *DeterministicRendering) Attach(s *PageSession) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	steps := []renderingStep{
+		{"Page.addScriptToEvaluateOnNewDocument", map[string]interface{}{"source": deterministicRenderingScript}},
+		// Pages that were already loaded when the proxy attached
+		{"Runtime.evaluate", map[string]interface{}{"expression": deterministicRenderingScript}},
+		// Web Animations not covered by the stylesheet stay at their start
+		{"Animation.setPlaybackRate", map[string]interface{}{"playbackRate": 0}},
+	}
+	if s.Target.Type == "page" {
+		steps = append(steps,
+			renderingStep{"Emulation.setDeviceMetricsOverride", map[string]interface{}{"width": 0, "height": 0, "deviceScaleFactor": 1, "mobile": false}},
+			renderingStep{"Emulation.setDefaultBackgroundColorOverride", map[string]interface{}{"color": map[string]interface{}{"r": 255, "g": 255, "b": 255, "a": 1}}},
+			renderingStep{"Emulation.setScrollbarsHidden", map[string]interface{}{"hidden": true}},
+		)
+	}
+	for _, step := range steps {
+		if _, err := s.Call(ctx, step.method, step.params); err != nil {
+			atomic.AddInt64(&d.failed, 1)
+			return err
+		}
+	}
+	atomic.AddInt64(&d.applied, 1)
+	return nil
+}
+
+func (d *DeterministicRendering) Metrics() map[string]interface{} {
+	return map[string]interface{}{
+		"deterministic_rendering_applied_total": atomic.LoadInt64(&d.applied),
+		"deterministic_rendering_failed_total":  atomic.LoadInt64(&d.failed),
+	}
+}
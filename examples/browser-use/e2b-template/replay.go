@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Address in synthesized discovery responses, replaced with the stub's own
+// when served
+const replayUpstream = "replay.upstream"
+
+// LoadRecordings builds a stub browser from -record recordings (one file,
+// or every .ndjson file of a directory in name order, which is connection
+// order). Each recording is replayed on its connection's path like a
+// snapshot connection; /json/version and /json/list are synthesized from
+// the recorded browser and page targets.
+func LoadRecordings(path string) (*SnapshotServer, error) {
+	files := []string{path}
+	if info, err := os.Stat(path); err != nil {
+		return nil, err
+	} else if info.IsDir() {
+		if files, err = filepath.Glob(filepath.Join(path, "*.ndjson")); err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("no recordings in %s", path)
+		}
+		sort.Strings(files)
+	}
+
+	s := &SnapshotServer{
+		upstreamAddrs: []string{replayUpstream},
+		http:          make(map[string][]*snapshotEntry),
+		served:        make(map[string]int),
+		conns:         make(map[string][][]*snapshotEntry),
+		replays:       make(map[string]int),
+	}
+	browserPath := ""
+	// Last URL each page was navigated to, in first-seen order
+	var pages []string
+	pageURLs := make(map[string]string)
+	for _, file := range files {
+		connPath, script, url, err := loadRecording(file)
+		if err != nil {
+			return nil, err
+		}
+		s.conns[connPath] = append(s.conns[connPath], script)
+		if strings.HasPrefix(connPath, "/devtools/browser/") {
+			browserPath = connPath
+			continue
+		}
+		id := devtoolsTargetID(connPath)
+		if id == "" {
+			continue
+		}
+		if _, seen := pageURLs[id]; !seen {
+			pages = append(pages, id)
+			pageURLs[id] = "about:blank"
+		}
+		if url != "" {
+			pageURLs[id] = url
+		}
+	}
+
+	if browserPath == "" {
+		browserPath = "/devtools/browser/" + newUUID()
+	}
+	versionJSON, _ := json.Marshal(map[string]interface{}{
+		"Browser":              "Replay/" + version,
+		"Protocol-Version":     "1.3",
+		"User-Agent":           "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Replay/" + version,
+		"webSocketDebuggerUrl": "ws://" + replayUpstream + browserPath,
+	})
+	list := make([]map[string]interface{}, 0, len(pages))
+	for _, id := range pages {
+		wsAddress := replayUpstream + "/devtools/page/" + id
+		list = append(list, map[string]interface{}{
+			"description":          "",
+			"devtoolsFrontendUrl":  "/devtools/inspector.html?ws=" + wsAddress,
+			"id":                   id,
+			"title":                pageURLs[id],
+			"type":                 "page",
+			"url":                  pageURLs[id],
+			"webSocketDebuggerUrl": "ws://" + wsAddress,
+		})
+	}
+	targets, _ := json.Marshal(list)
+	s.http["/json/version"] = []*snapshotEntry{{Type: "http", Path: "/json/version", Status: 200, Data: versionJSON}}
+	s.http["/json/list"] = []*snapshotEntry{{Type: "http", Path: "/json/list", Status: 200, Data: targets}}
+	return s, nil
+}
+
+// Read one recording as a snapshot connection script, with the connection's
+// path and the last URL its client navigated to
+func loadRecording(file string) (connPath string, script []*snapshotEntry, url string, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", nil, "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	// Lines wrap a message of up to wsMaxFrameSize bytes
+	scanner.Buffer(nil, wsMaxFrameSize+64<<10)
+	for line := 1; scanner.Scan(); line++ {
+		var record cdpRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return "", nil, "", fmt.Errorf("%s:%d: %v", file, line, err)
+		}
+		switch record.Type {
+		case "connection":
+			connPath = record.Path
+		case "command":
+			script = append(script, &snapshotEntry{Type: "ws", Path: connPath, Dir: "send", Data: record.Message})
+			if record.Method == "Page.navigate" && record.CDPSessionID == "" {
+				var cmd struct {
+					Params struct {
+						URL string `json:"url"`
+					} `json:"params"`
+				}
+				if json.Unmarshal(record.Message, &cmd) == nil && cmd.Params.URL != "" {
+					url = cmd.Params.URL
+				}
+			}
+		case "response", "event":
+			script = append(script, &snapshotEntry{Type: "ws", Path: connPath, Dir: "recv", Data: record.Message})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", nil, "", fmt.Errorf("%s: %v", file, err)
+	}
+	if connPath == "" {
+		return "", nil, "", fmt.Errorf("%s: not a recording (no connection record)", file)
+	}
+	return connPath, script, url, nil
+}
+
+// Start the stub browser from -replay and point the proxy at it
+func startReplayServer(path string) {
+	if chromeBinary != "" || fakeUpstream || serveSnapshot != "" {
+		log.Fatalf("❌ -replay cannot be combined with -chromeBinary, -fakeUpstream or -serveSnapshot")
+	}
+	stub, err := LoadRecordings(path)
+	if err != nil {
+		log.Fatalf("❌ Failed to load recordings: %v", err)
+	}
+	if err := stub.Start(); err != nil {
+		log.Fatalf("❌ Failed to serve recordings: %v", err)
+	}
+	_, port, _ := net.SplitHostPort(stub.HostPort())
+	targetPort, _ = strconv.Atoi(port)
+	conns := 0
+	for _, recorded := range stub.conns {
+		conns += len(recorded)
+	}
+	log.Printf("📼 Replaying %d recorded connections from %s on %s, no browser is used", conns, path, stub.HostPort())
+}
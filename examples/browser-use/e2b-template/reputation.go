@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a reputation service may take before the check counts as failed
+const reputationTimeout = 3 * time.Second
+
+// ReputationVerdict is a reputation service's opinion of one host
+type ReputationVerdict struct {
+	Allowed  bool   `json:"allowed"`
+	Category string `json:"category,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// ReputationService looks up the reputation of a host name
+type ReputationService interface {
+	Name() string
+	Check(ctx context.Context, host string) (ReputationVerdict, error)
+}
+
+// HTTPReputationService queries GET <endpoint>?domain=<host>, which must
+// answer 200 with a JSON ReputationVerdict
+type HTTPReputationService struct {
+	endpoint string
+	client   *http.Client
+}
+
+func NewHTTPReputationService(endpoint string, client *http.Client) *HTTPReputationService {
+	return &HTTPReputationService{endpoint: endpoint, client: client}
+}
+
+func (h *HTTPReputationService) Name() string {
+	return h.endpoint
+}
+
+func (h *HTTPReputationService) Check(ctx context.Context, host string) (ReputationVerdict, error) {
+	var verdict ReputationVerdict
+	u, err := url.Parse(h.endpoint)
+	if err != nil {
+		return verdict, err
+	}
+	q := u.Query()
+	q.Set("domain", host)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return verdict, err
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return verdict, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return verdict, fmt.Errorf("reputation service answered %s", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&verdict)
+	return verdict, err
+}
+
+// Load a blocklist file with one domain per line; '#' starts a comment
+func loadDomainBlocklist(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	domains := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.ToLower(strings.TrimSpace(line)); line != "" {
+			domains[line] = true
+		}
+	}
+	return domains, scanner.Err()
+}
+
+type reputationEntry struct {
+	verdict ReputationVerdict
+	expires time.Time
+}
+
+// DomainReputation fails navigations (document requests) to hosts on the
+// local blocklist or rated as not allowed by the reputation services.
+// Service verdicts are cached; when a service fails the navigation is
+// allowed unless failClosed is set.
+type DomainReputation struct {
+	clock      Clock
+	blocklist  map[string]bool
+	services   []ReputationService
+	cacheTTL   time.Duration
+	failClosed bool
+
+	mu        sync.Mutex
+	cache     map[string]reputationEntry
+	checks    int64
+	cacheHits int64
+	blocked   int64
+	failures  int64
+}
+
+func NewDomainReputation(clock Clock, blocklist map[string]bool, services []ReputationService, cacheTTL time.Duration, failClosed bool) *DomainReputation {
+	return &DomainReputation{
+		clock:      clock,
+		blocklist:  blocklist,
+		services:   services,
+		cacheTTL:   cacheTTL,
+		failClosed: failClosed,
+		cache:      make(map[string]reputationEntry),
+	}
+}
+
+// Check returns the verdict for a host, consulting the blocklist, the cache
+// and then each service in turn
+func (d *DomainReputation) Check(ctx context.Context, host string) ReputationVerdict {
+	if domainMatch(d.blocklist, host) {
+		return ReputationVerdict{Category: "blocklist", Reason: "listed in local blocklist"}
+	}
+
+	d.mu.Lock()
+	d.checks++
+	if entry, ok := d.cache[host]; ok && d.clock.Now().Before(entry.expires) {
+		d.cacheHits++
+		d.mu.Unlock()
+		return entry.verdict
+	}
+	d.mu.Unlock()
+
+	verdict := ReputationVerdict{Allowed: true}
+	for _, service := range d.services {
+		checkCtx, cancel := context.WithTimeout(ctx, reputationTimeout)
+		v, err := service.Check(checkCtx, host)
+		cancel()
+		if err != nil {
+			d.mu.Lock()
+			d.failures++
+			d.mu.Unlock()
+			log.Printf("⚠️ Reputation check of %s via %s failed: %v", host, service.Name(), err)
+			// Failures are not cached so the next navigation retries
+			if d.failClosed {
+				return ReputationVerdict{Category: "unavailable", Reason: "reputation service unavailable"}
+			}
+			return ReputationVerdict{Allowed: true}
+		}
+		if !v.Allowed {
+			verdict = v
+			break
+		}
+	}
+
+	d.mu.Lock()
+	d.cache[host] = reputationEntry{verdict: verdict, expires: d.clock.Now().Add(d.cacheTTL)}
+	d.mu.Unlock()
+	return verdict
+}
+
+func (d *DomainReputation) HandleRequestPaused(ctx context.Context, s *PageSession, ev *FetchRequestPaused) bool {
+	// Only navigations are checked; subresources are left to the blocker
+	if ev.IsResponseStage() || ev.ResourceType != "Document" {
+		return false
+	}
+	u, err := url.Parse(ev.Request.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	verdict := d.Check(ctx, host)
+	if verdict.Allowed {
+		return false
+	}
+
+	d.mu.Lock()
+	d.blocked++
+	d.mu.Unlock()
+	log.Printf("⛔ Navigation of %s to %s blocked: %s %s", s.Describe(), host, verdict.Category, verdict.Reason)
+	s.Call(ctx, "Fetch.failRequest", map[string]interface{}{
+		"requestId":   ev.RequestID,
+		"errorReason": "BlockedByClient",
+	})
+	return true
+}
+
+func (d *DomainReputation) Metrics() map[string]interface{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return map[string]interface{}{
+		"reputation_checks_total":     d.checks,
+		"reputation_cache_hits_total": d.cacheHits,
+		"reputation_blocked_total":    d.blocked,
+		"reputation_failures_total":   d.failures,
+		"reputation_blocklist_size":   len(d.blocklist),
+	}
+}
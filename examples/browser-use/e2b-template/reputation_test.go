@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// countingReputation answers every host with its verdict and counts lookups
+type countingReputation struct {
+	verdict ReputationVerdict
+	calls   int
+}
+
+func (s *countingReputation) Name() string {
+	return "counting"
+}
+
+func (s *countingReputation) Check(ctx context.Context, host string) (ReputationVerdict, error) {
+	s.calls++
+	return s.verdict, nil
+}
+
+func TestDomainReputationCacheTTL(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	service := &countingReputation{verdict: ReputationVerdict{Category: "malware"}}
+	d := NewDomainReputation(clock, nil, []ReputationService{service}, time.Minute, false)
+	ctx := context.Background()
+
+	if v := d.Check(ctx, "bad.example"); v.Allowed || v.Category != "malware" {
+		t.Fatalf("Check = %+v, want the service's verdict", v)
+	}
+	clock.Advance(59 * time.Second)
+	d.Check(ctx, "bad.example")
+	if service.calls != 1 {
+		t.Fatalf("service called %d times within the TTL, want 1", service.calls)
+	}
+	clock.Advance(time.Second)
+	d.Check(ctx, "bad.example")
+	if service.calls != 2 {
+		t.Fatalf("service called %d times after the TTL, want 2", service.calls)
+	}
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultReservationTTL = 60 * time.Second
+
+var (
+	errReservationNotFound = errors.New("unknown or expired reservation")
+	errReservationRedeemed = errors.New("reservation already redeemed")
+	errUnknownChannel      = errors.New("unknown browser channel")
+)
+
+type viewportSpec struct {
+	Width             int     `json:"width"`
+	Height            int     `json:"height"`
+	DeviceScaleFactor float64 `json:"deviceScaleFactor,omitempty"`
+	Mobile            bool    `json:"mobile,omitempty"`
+}
+
+type reserveRequest struct {
+	TTLSeconds int `json:"ttlSeconds"`
+	// Queue ordering when -maxLeases is reached; higher goes first
+	Priority int `json:"priority"`
+	// How long to wait for a free slot; 0 fails at once when the pool is full
+	QueueTimeoutMs int `json:"queueTimeoutMs"`
+	// Task the target belongs to (see POST /tasks); defaults to X-PPIO-Task
+	Task string `json:"task"`
+	// Caller's own ID for connections to the target; defaults to X-PPIO-Session
+	SessionID string `json:"sessionId"`
+	// Browser install to create the target in (see GET /channels)
+	Channel string `json:"channel"`
+	// "headful" runs the target in a Chrome with a visible window, which
+	// some anti-bot checks require; default "headless"
+	Mode string `json:"mode"`
+	bootstrapSpec
+}
+
+// Reservation is a prepared target waiting to be redeemed by an agent. The
+// control session stays attached because CDP emulation overrides only live
+// as long as the session that set them.
+type Reservation struct {
+	Token     string    `json:"token"`
+	TargetID  string    `json:"targetId"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	Redeemed  bool      `json:"redeemed"`
+	Task      string    `json:"task,omitempty"`
+	SessionID string    `json:"sessionId,omitempty"`
+	Channel   string    `json:"channel,omitempty"`
+	Mode      string    `json:"mode,omitempty"`
+	Locale    string    `json:"locale,omitempty"`
+
+	sessionID string
+	// Channel instance the target lives in, empty for the default browser
+	instance string
+	expiry   ClockTimer
+}
+
+// ReservationManager prepares targets ahead of time and tracks their tokens
+type ReservationManager struct {
+	clock   Clock
+	control *ControlSession
+	labels  *TargetLabels
+	pool    *LeasePool
+	// Control sessions of the -chromeChannels browsers, by name
+	channels map[string]*ControlSession
+
+	// Called with lease.granted and lease.released
+	onChange []func(event string, res *Reservation)
+
+	mu           sync.Mutex
+	reservations map[string]*Reservation
+	tickets      map[string]*leaseTicket
+}
+
+func NewReservationManager(clock Clock, control *ControlSession, labels *TargetLabels, maxActive int) *ReservationManager {
+	return &ReservationManager{
+		clock:        clock,
+		control:      control,
+		labels:       labels,
+		pool:         NewLeasePool(clock, maxActive),
+		channels:     make(map[string]*ControlSession),
+		reservations: make(map[string]*Reservation),
+		tickets:      make(map[string]*leaseTicket),
+	}
+}
+
+// OnChange registers fn to be told when a reservation is redeemed
+// (lease.granted) and when a redeemed one is released or lost
+// (lease.released)
+func (m *ReservationManager) OnChange(fn func(event string, res *Reservation)) {
+	m.onChange = append(m.onChange, fn)
+}
+
+func (m *ReservationManager) notify(event string, res *Reservation) {
+	for _, fn := range m.onChange {
+		fn(event, res)
+	}
+}
+
+// AddChannel makes a channel instance available to reservations
+func (m *ReservationManager) AddChannel(name string, control *ControlSession) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.channels[name] = control
+}
+
+// HasChannel reports whether name is a running channel instance; empty
+// means the default browser
+func (m *ReservationManager) HasChannel(name string) bool {
+	_, err := m.controlFor(name)
+	return err == nil
+}
+
+func (m *ReservationManager) controlFor(channel string) (*ControlSession, error) {
+	if channel == "" {
+		return m.control, nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if control, ok := m.channels[channel]; ok {
+		return control, nil
+	}
+	return nil, fmt.Errorf("%w %q", errUnknownChannel, channel)
+}
+
+// ChannelOf returns the channel instance a reserved target lives in, empty
+// for the default browser and unreserved targets
+func (m *ReservationManager) ChannelOf(targetID string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, res := range m.reservations {
+		if res.TargetID == targetID {
+			return res.instance
+		}
+	}
+	return ""
+}
+
+// TokenOf returns the token of the reservation holding targetID, or ""
+func (m *ReservationManager) TokenOf(targetID string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, res := range m.reservations {
+		if res.TargetID == targetID {
+			return res.Token
+		}
+	}
+	return ""
+}
+
+// LeasesByChannel counts live reservations per channel instance
+func (m *ReservationManager) LeasesByChannel() map[string]int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts := make(map[string]int)
+	for _, res := range m.reservations {
+		name := res.instance
+		if name == "" {
+			name = defaultChannel
+		}
+		counts[name]++
+	}
+	return counts
+}
+
+func newToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Reserve waits for a pool slot, then creates and prepares a new target
+func (m *ReservationManager) Reserve(ctx context.Context, req reserveRequest) (*Reservation, error) {
+	return m.reserve(ctx, req, m.pool.Enqueue(req.Priority))
+}
+
+func (m *ReservationManager) reserve(ctx context.Context, req reserveRequest, w *leaseWaiter) (*Reservation, error) {
+	if err := m.pool.Wait(ctx, w, time.Duration(req.QueueTimeoutMs)*time.Millisecond); err != nil {
+		return nil, err
+	}
+	res, err := m.create(ctx, req)
+	if err != nil {
+		m.pool.Release()
+		return nil, err
+	}
+	return res, nil
+}
+
+func (m *ReservationManager) create(ctx context.Context, req reserveRequest) (*Reservation, error) {
+	if req.Channel == defaultChannel {
+		req.Channel = ""
+	}
+	if req.Mode != modeHeadful {
+		req.Mode = ""
+	}
+	instance := channelInstance(req.Channel, req.Mode)
+	control, err := m.controlFor(instance)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := control.Conn()
+	if err != nil {
+		return nil, err
+	}
+
+	var created struct {
+		TargetID string `json:"targetId"`
+	}
+	if err := conn.CallResult(ctx, "", "Target.createTarget", map[string]interface{}{"url": "about:blank"}, &created); err != nil {
+		return nil, err
+	}
+	var attached struct {
+		SessionID string `json:"sessionId"`
+	}
+	err = conn.CallResult(ctx, "", "Target.attachToTarget", map[string]interface{}{
+		"targetId": created.TargetID,
+		"flatten":  true,
+	}, &attached)
+	if err != nil {
+		m.closeTarget(conn, created.TargetID)
+		return nil, err
+	}
+
+	if err := req.bootstrapSpec.Apply(ctx, conn, attached.SessionID); err != nil {
+		m.closeTarget(conn, created.TargetID)
+		return nil, err
+	}
+
+	ttl := time.Duration(req.TTLSeconds) * time.Second
+	if ttl <= 0 {
+		ttl = defaultReservationTTL
+	}
+	res := &Reservation{
+		Token:     newToken(),
+		TargetID:  created.TargetID,
+		CreatedAt: m.clock.Now(),
+		ExpiresAt: m.clock.Now().Add(ttl),
+		Task:      req.Task,
+		SessionID: req.SessionID,
+		Channel:   req.Channel,
+		Mode:      req.Mode,
+		Locale:    req.Locale,
+		sessionID: attached.SessionID,
+		instance:  instance,
+	}
+	// Connections to the target pick up its task and session ID from labels
+	m.labels.Set(created.TargetID, map[string]string{"task": req.Task, "session": req.SessionID, "channel": instance, "locale": req.Locale})
+	res.expiry = m.clock.AfterFunc(ttl, func() { m.expire(res.Token) })
+
+	m.mu.Lock()
+	m.reservations[res.Token] = res
+	m.mu.Unlock()
+
+	if instance != "" {
+		log.Printf("🎟️ Reserved target %s in channel %s (ttl %v)", res.TargetID, instance, ttl)
+	} else {
+		log.Printf("🎟️ Reserved target %s (ttl %v)", res.TargetID, ttl)
+	}
+	return res, nil
+}
+
+// Redeem marks the reservation as taken; it then lives until released
+func (m *ReservationManager) Redeem(token string) (*Reservation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	res, ok := m.reservations[token]
+	if !ok {
+		return nil, errReservationNotFound
+	}
+	if res.Redeemed {
+		return nil, errReservationRedeemed
+	}
+	res.expiry.Stop()
+	res.Redeemed = true
+	m.notify("lease.granted", res)
+	return res, nil
+}
+
+// Release closes the reserved target
+func (m *ReservationManager) Release(token string) bool {
+	m.mu.Lock()
+	res, ok := m.reservations[token]
+	delete(m.reservations, token)
+	m.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	res.expiry.Stop()
+	if control, err := m.controlFor(res.instance); err == nil {
+		if conn, err := control.Conn(); err == nil {
+			m.closeTarget(conn, res.TargetID)
+		}
+	}
+	m.pool.Release()
+	if res.Redeemed {
+		m.notify("lease.released", res)
+	}
+	log.Printf("🎟️ Released target %s", m.labels.Describe(res.TargetID))
+	return true
+}
+
+// Reset forgets the reservations of a channel instance ("" for the default browser)
+// after its browser went away, freeing the pool slots without trying to
+// close the lost targets
+func (m *ReservationManager) Reset(channel string) {
+	m.mu.Lock()
+	var lost []*Reservation
+	for token, res := range m.reservations {
+		if res.instance == channel {
+			lost = append(lost, res)
+			delete(m.reservations, token)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, res := range lost {
+		res.expiry.Stop()
+		m.pool.Release()
+		if res.Redeemed {
+			m.notify("lease.released", res)
+		}
+	}
+	if len(lost) > 0 {
+		log.Printf("🎟️ Dropped %d reservations from the previous browser", len(lost))
+	}
+}
+
+// savedReservation is a reservation as -stateFile keeps it
+type savedReservation struct {
+	Reservation
+	Instance string `json:"instance,omitempty"`
+}
+
+// Snapshot returns copies of the current reservations
+func (m *ReservationManager) Snapshot() []savedReservation {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	saved := make([]savedReservation, 0, len(m.reservations))
+	for _, res := range m.reservations {
+		saved = append(saved, savedReservation{Reservation: *res, Instance: res.instance})
+	}
+	sort.Slice(saved, func(i, j int) bool { return saved[i].CreatedAt.Before(saved[j].CreatedAt) })
+	return saved
+}
+
+// Restore adopts the reservations of a previous proxy whose targets are
+// still open in their browser. Unredeemed ones keep their expiry; the
+// others were lost with their targets and are reported released.
+func (m *ReservationManager) Restore(ctx context.Context, saved []savedReservation) (restored []*Reservation, lost []*Reservation) {
+	// Live targets by channel instance
+	live := make(map[string]map[string]bool)
+	for i := range saved {
+		instance := saved[i].Instance
+		if _, ok := live[instance]; ok {
+			continue
+		}
+		targets, err := m.liveTargets(ctx, instance)
+		if err != nil {
+			log.Printf("⚠️ Failed to list the targets of %q to restore leases: %v", instance, err)
+		}
+		live[instance] = targets
+	}
+
+	for i := range saved {
+		res := new(Reservation)
+		*res = saved[i].Reservation
+		res.instance = saved[i].Instance
+		if !live[res.instance][res.TargetID] {
+			lost = append(lost, res)
+			continue
+		}
+		m.mu.Lock()
+		_, exists := m.reservations[res.Token]
+		if !exists {
+			m.reservations[res.Token] = res
+		}
+		m.mu.Unlock()
+		if exists {
+			continue
+		}
+		m.pool.Occupy()
+		// Fires at once for reservations that expired while no proxy ran;
+		// expire ignores redeemed ones
+		res.expiry = m.clock.AfterFunc(res.ExpiresAt.Sub(m.clock.Now()), func() { m.expire(res.Token) })
+		restored = append(restored, res)
+	}
+	for _, res := range lost {
+		if res.Redeemed {
+			m.notify("lease.released", res)
+		}
+	}
+	return restored, lost
+}
+
+// IDs of the targets open in a channel instance's browser
+func (m *ReservationManager) liveTargets(ctx context.Context, instance string) (map[string]bool, error) {
+	control, err := m.controlFor(instance)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := control.Conn()
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		TargetInfos []TargetInfo `json:"targetInfos"`
+	}
+	if err := conn.CallResult(ctx, "", "Target.getTargets", nil, &result); err != nil {
+		return nil, err
+	}
+	live := make(map[string]bool, len(result.TargetInfos))
+	for _, info := range result.TargetInfos {
+		live[info.TargetID] = true
+	}
+	return live, nil
+}
+
+func (m *ReservationManager) expire(token string) {
+	m.mu.Lock()
+	res, ok := m.reservations[token]
+	if !ok || res.Redeemed {
+		m.mu.Unlock()
+		return
+	}
+	m.mu.Unlock()
+
+	log.Printf("⌛ Reservation for %s expired unredeemed", m.labels.Describe(res.TargetID))
+	m.Release(token)
+}
+
+func (m *ReservationManager) closeTarget(conn *CDPConn, targetID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), m.control.timeout)
+	defer cancel()
+	conn.Call(ctx, "", "Target.closeTarget", map[string]interface{}{"targetId": targetID})
+}
+
+// Public (and, when enabled, signed) WebSocket URL of a page target as seen
+// through this proxy at host
+func (c *ChromeDevToolsClient) publicPageURL(host, targetID string) string {
+	return c.signer.Sign(rewriteWebSocketURL(fmt.Sprintf("ws://%s/devtools/page/%s", c.upstream.HostPort(), targetID), c.upstream.HostPort(), host))
+}
+
+/*
+Handle POST /reserve
+Request example:
+
+	{
+	   "ttlSeconds": 120,
+	   "startUrl": "https://example.com/login",
+	   "viewport": {"width": 1280, "height": 800},
+	   "cookieJar": "customer-42",
+	   "locale": "zh-CN",
+	   "channel": "beta",
+	   "mode": "headful"
+	}
+
+The target is created in the named -chromeChannels browser, or the default
+one when channel is empty; "mode": "headful" uses the channel's headful
+instance, launched on first use. The bootstrap fields are applied before the token is returned, which is
+redeemable via POST /reserve/{token}/redeem within the TTL.
+*/
+func (c *ChromeDevToolsClient) handleReserve(w http.ResponseWriter, r *http.Request) {
+	var req reserveRequest
+	if r.ContentLength != 0 && !readJSON(w, r, &req) {
+		return
+	}
+	var ok bool
+	if req.Task, ok = c.requestTask(w, r, req.Task); !ok {
+		return
+	}
+	if req.SessionID, ok = requestSessionID(w, r, req.SessionID); !ok {
+		return
+	}
+	if err := req.bootstrapSpec.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !c.resolveInstance(w, req) {
+		return
+	}
+	if !c.allowCommands(w, r, "Target.createTarget") {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), c.client.Timeout)
+	defer cancel()
+
+	res, err := c.reservations.Reserve(ctx, req)
+	if errors.Is(err, errPoolExhausted) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		c.errorCount++
+		log.Printf("❌ Reservation failed: %v", err)
+		http.Error(w, fmt.Sprintf("Reservation failed: %v", err), http.StatusBadGateway)
+		return
+	}
+	c.tasks.RecordLease(res.Task)
+	writeJSON(w, http.StatusCreated, res)
+}
+
+// Handle POST /reserve/{token}/redeem, returning the target's public URL
+func (c *ChromeDevToolsClient) handleRedeem(w http.ResponseWriter, r *http.Request) {
+	res, err := c.reservations.Redeem(r.PathValue("token"))
+	if errors.Is(err, errReservationRedeemed) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	log.Printf("🎟️ Reservation for %s redeemed", c.labels.Describe(res.TargetID))
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"targetId":             res.TargetID,
+		"webSocketDebuggerUrl": c.publicPageURL(r.Host, res.TargetID),
+	})
+}
+
+// Handle DELETE /reserve/{token}, closing the reserved target
+func (c *ChromeDevToolsClient) handleRelease(w http.ResponseWriter, r *http.Request) {
+	if !c.reservations.Release(r.PathValue("token")) {
+		http.Error(w, "unknown reservation", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
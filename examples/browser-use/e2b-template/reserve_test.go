@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func newTestReservations(t *testing.T, clock Clock) *ReservationManager {
+	t.Helper()
+	chrome, err := StartFakeChrome()
+	if err != nil {
+		t.Fatal(err)
+	}
+	control := NewControlSession(NewUpstream(chrome.HostPort()), &http.Client{Timeout: 5 * time.Second})
+	return NewReservationManager(clock, control, NewTargetLabels(), 0)
+}
+
+func TestReservationExpiresUnredeemed(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	m := newTestReservations(t, clock)
+	res, err := m.Reserve(context.Background(), reserveRequest{TTLSeconds: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(59 * time.Second)
+	if m.TokenOf(res.TargetID) != res.Token {
+		t.Fatal("reservation reaped before its TTL")
+	}
+	clock.Advance(time.Second)
+	if m.TokenOf(res.TargetID) != "" {
+		t.Fatal("reservation not reaped at its TTL")
+	}
+	if _, err := m.Redeem(res.Token); err != errReservationNotFound {
+		t.Fatalf("Redeem after expiry = %v, want %v", err, errReservationNotFound)
+	}
+}
+
+func TestRedeemedReservationOutlivesTTL(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	m := newTestReservations(t, clock)
+	res, err := m.Reserve(context.Background(), reserveRequest{TTLSeconds: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Redeem(res.Token); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(time.Hour)
+	if m.TokenOf(res.TargetID) != res.Token {
+		t.Fatal("redeemed reservation was reaped")
+	}
+	if !m.Release(res.Token) {
+		t.Fatal("Release of a redeemed reservation failed")
+	}
+}
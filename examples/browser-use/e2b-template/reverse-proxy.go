@@ -1,7 +1,10 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -10,8 +13,12 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,17 +27,301 @@ var (
 	listenPort  int
 	enableDebug bool
 	timeout     int
+	macrosDir   string
+
+	dismissConsent       bool
+	consoleCapture       bool
+	exceptionWebhook     string
+	consoleBufferSize    int
+	consentSelectors     string
+	blockLists           string
+	blockListRefresh     time.Duration
+	artifactDir          string
+	downloadDir          string
+	fileInputDir         string
+	fileInputMaxBytes    int64
+	capturePatterns      string
+	mockRules            string
+	adminToken           string
+	adminACL             string
+	targetOverride       bool
+	warmupURLs           string
+	warmupTabs           int
+	cookieJarDir         string
+	maxLeases            int
+	chromeBinary         string
+	chromeDataDir        string
+	chromeStandby        bool
+	chromeChannels       string
+	checkpointInterval   time.Duration
+	hideTargetTypes      string
+	urlSigningKey        string
+	urlTTL               time.Duration
+	oneTimeURLs          bool
+	artifactKeyFile      string
+	artifactCodec        string
+	artifactCodecLevel   int
+	sandboxID            string
+	receiptSigningKey    string
+	anomalyWindow        time.Duration
+	anomalyThresholds    string
+	reputationList       string
+	reputationURL        string
+	reputationCacheTTL   time.Duration
+	reputationFailClosed bool
+	robotsUserAgent      string
+	robotsCacheTTL       time.Duration
+	originRateLimits     string
+	originBurst          int
+	originMaxDelay       time.Duration
+	idFormat             string
+	quiet                bool
+	logFile              string
+	profileName          string
+	configFile           string
+	featureFlags         string
+	fakeUpstream         bool
+	recordSnapshot       string
+	serveSnapshot        string
+	recordDir            string
+	replayPath           string
+	recordVideo          bool
+	videoFPS             int
+	videoMaxWidth        int
+	videoMaxHeight       int
+	videoFormat          string
+	ffmpegBinary         string
+	thumbnailInterval    time.Duration
+	thumbnailWidth       int
+	clientCompression    bool
+	compressThreshold    int
+	compressLevel        int
+	compressTakeover     bool
+	deltaThreshold       int
+	wsPingInterval       time.Duration
+	wsPingMisses         int
+	wsIdleTimeout        time.Duration
+	bulkThreshold        int
+	maxMessageSize       int
+	e2bAdmission         bool
+	e2bTeardown          bool
+	e2bTeardownLead      time.Duration
+	e2bAPI               string
+	e2bAPIKey            string
+	uploadURL            string
+	uploadToken          string
+	uploadDeadline       time.Duration
+	uploadQueue          string
+	uploadPartSize       int64
+	uploadAttempts       int
+	uploadCodec          string
+	uploadCodecLevel     int
+	startupHooks         string
+	shutdownHooks        string
+	gatewayURL           string
+	gatewayInterval      time.Duration
+	eventWebhook         string
+	outboxFile           string
+	storeFile            string
+	storeRetention       time.Duration
+	stateFile            string
+	stateInterval        time.Duration
+	upgradeBinary        string
+	upgradeDrain         time.Duration
+	upstreamReconnect    time.Duration
+	reconnectBuffer      int
+	logCDP               bool
+	advertiseCaps        bool
+	cdpAllow             string
+	cdpDeny              string
+	protectBrowser       bool
+	guardDevTools        bool
+	evaluateAPI          bool
+	evaluateTimeout      time.Duration
+	deterministic        bool
+	networkThrottle      string
 )
 
+// Set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "cdp" {
+		os.Exit(runCDPCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "decrypt" {
+		os.Exit(runDecryptCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "codecs" {
+		os.Exit(runCodecsCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "conformance" {
+		os.Exit(runConformanceCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "soak" {
+		os.Exit(runSoakCommand(os.Args[2:]))
+	}
+
 	flag.IntVar(&targetPort, "targetPort", 9222, "Target Chrome DevTools port")
 	flag.IntVar(&listenPort, "listenPort", 9223, "Listen port for proxy")
 	flag.BoolVar(&enableDebug, "debug", true, "Enable debug logging")
 	flag.IntVar(&timeout, "timeout", 30, "HTTP client timeout in seconds")
+	flag.StringVar(&macrosDir, "macrosDir", "", "Directory of server-side macro definitions (*.json)")
+	flag.BoolVar(&dismissConsent, "dismissConsent", false, "Automatically dismiss cookie consent banners on page load")
+	flag.StringVar(&consentSelectors, "consentSelectors", "", "File with consent button selectors, one per line (default: built-in list)")
+	flag.BoolVar(&consoleCapture, "consoleCapture", false, "Buffer the console messages and log entries of every page (GET /targets/{id}/console)")
+	flag.StringVar(&exceptionWebhook, "exceptionWebhook", "", "URL that uncaught page exceptions (Runtime.exceptionThrown) are POSTed to as page.exception events, at most 10 per page per minute")
+	flag.IntVar(&consoleBufferSize, "consoleBuffer", 1000, "Console entries kept per page with -consoleCapture")
+	flag.StringVar(&blockLists, "blockLists", "", "Comma-separated EasyList-style filter lists (files or URLs) for ad/tracker blocking")
+	flag.DurationVar(&blockListRefresh, "blockListRefresh", 24*time.Hour, "Filter list refresh interval (0 disables refresh)")
+	flag.StringVar(&artifactDir, "artifactDir", "", "Directory for captured artifacts (disabled when empty)")
+	flag.StringVar(&downloadDir, "downloadDir", "", "Directory Chrome saves downloads to, served at /downloads (disabled when empty)")
+	flag.StringVar(&fileInputDir, "fileInputDir", filepath.Join(os.TempDir(), "ppio-uploads"), "Directory files posted to /targets/{id}/upload are written to")
+	flag.Int64Var(&fileInputMaxBytes, "fileInputMaxBytes", 100<<20, "Largest request accepted by /targets/{id}/upload, in bytes")
+	flag.StringVar(&capturePatterns, "capturePatterns", "", "Comma-separated URL patterns whose response bodies are captured (requires -artifactDir)")
+	flag.StringVar(&mockRules, "mockRules", "", "JSON file of request mock rules enforced via Fetch interception")
+	flag.StringVar(&adminToken, "adminToken", "", "Bearer token required for /admin endpoints (open when empty)")
+	flag.StringVar(&adminACL, "adminACL", "", "JSON file of roles, each with bearer tokens and the admin routes it may call (e.g. \"GET /admin/anomalies\"), alongside -adminToken")
+	flag.BoolVar(&targetOverride, "targetOverride", false, "Let admins route a request to a chosen upstream with the X-PPIO-Target header; requires -adminToken or -adminACL")
+	flag.StringVar(&warmupURLs, "warmupURLs", "", "Comma-separated URLs loaded once on startup to warm caches")
+	flag.IntVar(&warmupTabs, "warmupTabs", 0, "Number of about:blank tabs opened on startup to pre-spawn renderers")
+	flag.StringVar(&cookieJarDir, "cookieJarDir", "", "Directory of named cookie jars (<name>.json) for reservation bootstrap")
+	flag.IntVar(&maxLeases, "maxLeases", 0, "Maximum concurrently reserved targets; further requests queue (0 = unlimited)")
+	flag.StringVar(&chromeBinary, "chromeBinary", "", "Launch and supervise Chrome from this binary (\"auto\" finds an installed Chrome) instead of expecting it on -targetPort")
+	flag.StringVar(&chromeDataDir, "chromeDataDir", defaultChromeDataDir(), "User data directory of the supervised Chrome")
+	flag.BoolVar(&chromeStandby, "standby", false, "Keep a warm standby Chrome for fast failover (requires -chromeBinary)")
+	flag.StringVar(&chromeChannels, "chromeChannels", "", "Additional supervised Chrome installs leases can request by name, e.g. beta=/usr/bin/google-chrome-beta,dev=/usr/bin/google-chrome-unstable")
+	flag.DurationVar(&checkpointInterval, "checkpointInterval", 0, "Interval for checkpointing page URLs and cookies, restored after a Chrome crash (requires -chromeBinary; 0 disables)")
+	flag.StringVar(&hideTargetTypes, "hideTargetTypes", "", "Comma-separated target types (e.g. service_worker,shared_worker,background_page,webview) hidden from /json and /targets unless ?includeWorkers=true")
+	flag.StringVar(&urlSigningKey, "urlSigningKey", "", "HMAC key for signing WebSocket URLs; upgrades without a valid signature are rejected (disabled when empty)")
+	flag.DurationVar(&urlTTL, "urlTTL", 10*time.Minute, "Validity of signed WebSocket URLs")
+	flag.BoolVar(&oneTimeURLs, "oneTimeURLs", false, "Make signed WebSocket URLs single-use; reuse is rejected and alerted (requires -urlSigningKey)")
+	flag.StringVar(&artifactKeyFile, "artifactKeyFile", "", "File with the master key for encrypting artifacts at rest (AES-256-GCM, derived per sandbox)")
+	flag.StringVar(&artifactCodec, "artifactCodec", "none", "Compress artifacts at rest (before encryption) with this codec: "+strings.Join(codecNames(), ", ")+"; see the codecs subcommand")
+	flag.IntVar(&artifactCodecLevel, "artifactCodecLevel", -1, "Level of -artifactCodec ("+codecLevelRanges()+"); -1 is the codec's default")
+	flag.StringVar(&sandboxID, "sandboxID", os.Getenv("E2B_SANDBOX_ID"), "Sandbox id used to derive the per-sandbox artifact key")
+	flag.StringVar(&receiptSigningKey, "receiptSigningKey", "", "HMAC key for signing data deletion receipts (unsigned when empty)")
+	flag.DurationVar(&anomalyWindow, "anomalyWindow", 0, "Analyze per-session CDP traffic for anomalies over this window, e.g. 1m (0 = disabled)")
+	flag.StringVar(&anomalyThresholds, "anomalyThresholds", "", "Built-in detector thresholds per window, e.g. methodsPerSec=100,navigationsPerMin=30,domains=30")
+	flag.StringVar(&reputationList, "reputationBlocklist", "", "File of domains (one per line) that navigations are never allowed to")
+	flag.StringVar(&reputationURL, "reputationURL", "", "Reputation service queried as GET <url>?domain=<host> before each navigation")
+	flag.DurationVar(&reputationCacheTTL, "reputationCacheTTL", time.Hour, "How long reputation verdicts are cached per host")
+	flag.BoolVar(&reputationFailClosed, "reputationFailClosed", false, "Block navigations when the reputation service is unavailable (default fail open)")
+	flag.StringVar(&robotsUserAgent, "robotsUserAgent", "", "Obey robots.txt for this user-agent token, blocking disallowed navigations and fetches (empty = disabled)")
+	flag.DurationVar(&robotsCacheTTL, "robotsCacheTTL", 24*time.Hour, "How long fetched robots.txt files are cached per origin")
+	flag.StringVar(&originRateLimits, "originRateLimits", "", "Page loads per second allowed per host across all sessions, e.g. *=1,example.com=0.2")
+	flag.IntVar(&originBurst, "originBurst", 1, "Page loads per host allowed at once before -originRateLimits applies")
+	flag.DurationVar(&originMaxDelay, "originMaxDelay", 5*time.Second, "Longest a page load is delayed for its host's rate budget before it is rejected")
+	flag.StringVar(&idFormat, "idFormat", "hex", "Format of generated task and session IDs: hex or uuid")
+	flag.BoolVar(&quiet, "quiet", false, "Log nothing to stderr; only the JSON startup line is printed (on stdout) and logs go to -logFile")
+	flag.StringVar(&logFile, "logFile", "", "Append logs to this file instead of stderr")
+	flag.StringVar(&configFile, "config", "", "JSON file of flag values ({\"maxLeases\": 4, ...}); command-line flags and PPIO_PROXY_* environment variables take precedence")
+	flag.StringVar(&featureFlags, "features", "", "Experimental features to enable (name) or disable (-name), comma-separated; see GET /version")
+	flag.BoolVar(&fakeUpstream, "fakeUpstream", false, "Dry run: serve synthetic /json data and an echoing CDP endpoint from a built-in fake Chrome instead of proxying a browser")
+	flag.StringVar(&recordSnapshot, "recordSnapshot", "", "Record discovery responses and client CDP traffic to this snapshot file (JSON Lines) for -serveSnapshot")
+	flag.StringVar(&serveSnapshot, "serveSnapshot", "", "Replay a snapshot file recorded with -recordSnapshot as a deterministic stub browser instead of proxying one")
+	flag.StringVar(&recordDir, "record", "", "Write every CDP command, response and event of each client connection to a timestamped NDJSON file in this directory")
+	flag.StringVar(&replayPath, "replay", "", "Serve /json and CDP traffic from -record recordings (a file or directory) as a stub browser instead of proxying one")
+	flag.BoolVar(&recordVideo, "recordVideo", false, "Record every page as a video from screencast frames, stored in -artifactDir when the page closes (GET /sessions/{id}/video); requires ffmpeg")
+	flag.IntVar(&videoFPS, "videoFPS", 5, "Frames per second of session videos")
+	flag.IntVar(&videoMaxWidth, "videoMaxWidth", 1280, "Width of session videos; pages are scaled down to fit")
+	flag.IntVar(&videoMaxHeight, "videoMaxHeight", 720, "Height of session videos; pages are scaled down to fit")
+	flag.StringVar(&videoFormat, "videoFormat", "webm", "Container of session videos: webm (VP8) or mp4 (H.264)")
+	flag.StringVar(&ffmpegBinary, "ffmpegBinary", "ffmpeg", "ffmpeg executable used to encode session videos")
+	flag.DurationVar(&thumbnailInterval, "thumbnailInterval", 0, "Capture a thumbnail of every page this often into -artifactDir (GET /sessions/{id}/thumbnails), e.g. 5s; 0 disables")
+	flag.IntVar(&thumbnailWidth, "thumbnailWidth", 320, "Width of session thumbnails in pixels")
+	flag.BoolVar(&clientCompression, "clientCompression", false, "Negotiate permessage-deflate with WebSocket clients on the proxy's side; the connection to Chrome stays uncompressed")
+	flag.IntVar(&compressThreshold, "compressionThreshold", 512, "Smallest message, in bytes, compressed toward clients")
+	flag.IntVar(&compressLevel, "compressionLevel", 1, "Deflate level of client compression, 1 (fastest) to 9 (smallest)")
+	flag.BoolVar(&compressTakeover, "compressionContextTakeover", false, "Keep a compression window (about 1 MB) per client connection across messages for better ratios; off, no compression state outlives a message")
+	flag.BoolVar(&deterministic, "deterministicRendering", false, "Render every page reproducibly for visual testing: device scale 1, no animations, white default background, hidden scrollbars (and font switches when -chromeBinary is set)")
+	flag.StringVar(&networkThrottle, "networkThrottle", "", "Throttle the network of every page: a preset ("+networkPresetNames()+") or latencyMs:downloadKbps:uploadKbps; changeable at /admin/throttle (disabled when empty)")
+	flag.StringVar(&cdpAllow, "cdpAllow", "", "CDP methods clients may send, comma-separated (Domain.method, Domain.* or *); others are answered with an error. Empty allows all")
+	flag.StringVar(&cdpDeny, "cdpDeny", "", "CDP methods clients may not send, comma-separated, e.g. Browser.*,Page.setDownloadBehavior; wins over -cdpAllow")
+	flag.BoolVar(&protectBrowser, "protectBrowser", false, "Reject Browser.close, Browser.crash and Target.closeTarget of the browser target from clients, so no one can tear down the shared Chrome")
+	flag.BoolVar(&guardDevTools, "guardDevToolsHTTP", true, "Answer /json/close of a target leased to someone else and /json/new of file:// URLs with a 403 JSON error and an audit event instead of passing them to Chrome")
+	flag.BoolVar(&evaluateAPI, "evaluateAPI", true, "Serve POST /targets/{id}/evaluate; false keeps HTTP clients from running script in pages")
+	flag.DurationVar(&evaluateTimeout, "evaluateTimeout", 10*time.Second, "Longest a script run by POST /targets/{id}/evaluate may execute")
+	flag.IntVar(&deltaThreshold, "deltaThreshold", 16<<10, "Smallest message, in bytes, sent as a diff to clients that request the cdp.delta subprotocol")
+	flag.DurationVar(&wsPingInterval, "wsPingInterval", 0, "Ping both legs of relayed WebSocket connections after this long without traffic, to detect connections dropped by NATs or the ingress; 0 disables")
+	flag.IntVar(&wsPingMisses, "wsPingMisses", 3, "Unanswered keepalive pings in a row after which a WebSocket connection is closed")
+	flag.DurationVar(&wsIdleTimeout, "wsIdleTimeout", 0, "Close debugger WebSocket connections whose client has sent no CDP message for this long, e.g. 10m; 0 disables")
+	flag.IntVar(&bulkThreshold, "bulkThreshold", 32<<10, "Smallest message, in bytes, queued in the bulk lane behind interactive traffic (priority-lanes feature)")
+	flag.IntVar(&maxMessageSize, "maxMessageSize", 0, "Largest CDP message, in bytes, relayed either way; larger commands and responses are answered with a CDP error and larger events dropped, without buffering them. 0 allows up to 256 MB per frame")
+	flag.BoolVar(&e2bAdmission, "e2bAdmission", false, "Admit only requests carrying an E2B API key of the team that owns this sandbox (X-API-Key header or e2bKey query parameter), checked with the E2B API")
+	flag.BoolVar(&e2bTeardown, "e2bTeardown", false, "Watch the sandbox's end time with the E2B API and flush artifacts and shut down -e2bTeardownLead before it")
+	flag.DurationVar(&e2bTeardownLead, "e2bTeardownLead", 30*time.Second, "How long before the sandbox ends the proxy shuts down, and the most time artifact flushing may take")
+	flag.StringVar(&e2bAPI, "e2bAPI", "https://api.e2b.dev", "E2B API base URL")
+	flag.StringVar(&e2bAPIKey, "e2bAPIKey", os.Getenv("E2B_API_KEY"), "E2B API key the proxy watches its sandbox with (-e2bTeardown)")
+	flag.StringVar(&uploadURL, "uploadURL", "", "Remote store base URL that artifacts, recordings, usage and a teardown bundle are PUT under (<uploadURL>/<sandbox id>/...) when the proxy is torn down by -e2bTeardown, SIGTERM or SIGINT")
+	flag.StringVar(&uploadToken, "uploadToken", "", "Bearer token sent with uploads to -uploadURL")
+	flag.DurationVar(&uploadDeadline, "uploadDeadline", 20*time.Second, "Most time teardown uploads may take; what is left is logged and skipped")
+	flag.StringVar(&uploadQueue, "uploadQueue", filepath.Join(os.TempDir(), "ppio-upload-queue"), "Directory of the persistent upload queue; uploads left at exit resume at the next start")
+	flag.Int64Var(&uploadPartSize, "uploadPartSize", 8<<20, "Objects larger than this many bytes are uploaded in resumable parts of this size (Content-Range)")
+	flag.IntVar(&uploadAttempts, "uploadAttempts", 10, "Attempts per object before an upload is given up and moved to the queue's failed directory")
+	flag.StringVar(&uploadCodec, "uploadCodec", "none", "Compress uploaded recordings, snapshot and log with this codec ("+strings.Join(codecNames(), ", ")+"), adding its extension to their keys")
+	flag.IntVar(&uploadCodecLevel, "uploadCodecLevel", -1, "Level of -uploadCodec ("+codecLevelRanges()+"); -1 is the codec's default")
+	flag.StringVar(&gatewayURL, "gatewayURL", "", "Public URL of this proxy through the E2B gateway (e.g. https://9223-<sandbox id>.e2b.app); when set the proxy checks the path clients take through it, see GET /health/gateway")
+	flag.DurationVar(&gatewayInterval, "gatewayCheckInterval", time.Minute, "How often the -gatewayURL path is checked")
+	flag.StringVar(&eventWebhook, "eventWebhook", "", "URL that session and lease events are POSTed to, at least once and in order per target, through the -outboxFile")
+	flag.StringVar(&storeFile, "storeFile", "", "Journal file recording sessions, leases and admin audit entries across restarts, queried with GET /admin/query (disabled when empty)")
+	flag.DurationVar(&storeRetention, "storeRetention", 30*24*time.Hour, "How long -storeFile keeps rows; 0 keeps them forever")
+	flag.StringVar(&stateFile, "stateFile", "", "File the proxy saves target labels, leases and counters to, restoring them at the next start for the targets Chrome still has open (disabled when empty)")
+	flag.DurationVar(&stateInterval, "stateInterval", 30*time.Second, "How often -stateFile is saved; it is also saved at teardown")
+	flag.StringVar(&upgradeBinary, "upgradeBinary", defaultUpgradeBinary(), "Binary started with the same flags on SIGUSR2 or POST /admin/upgrade, taking over the listening socket while this process drains")
+	flag.DurationVar(&upgradeDrain, "upgradeDrain", 30*time.Minute, "How long the process replaced by an upgrade waits for its WebSocket sessions to close before exiting")
+	flag.StringVar(&outboxFile, "outboxFile", filepath.Join(os.TempDir(), "cdp-proxy-outbox.jsonl"), "File holding -eventWebhook events until they are delivered, so they survive restarts")
+	flag.StringVar(&startupHooks, "startupHooks", "", "JSON file of hooks (waits for URLs, HTTP calls, commands or CDP steps, ordered by \"after\") run before the proxy listens and reports ready")
+	flag.StringVar(&shutdownHooks, "shutdownHooks", "", "JSON file of hooks (HTTP calls, commands or CDP steps) run in order at teardown, before artifacts are flushed")
+	flag.DurationVar(&upstreamReconnect, "upstreamReconnect", 30*time.Second, "Only with -features cdp-multiplexing: how long clients sharing a connection stay connected while the proxy re-dials Chrome after the connection drops; 0 closes them at once. Without it a dropped Chrome connection closes its client")
+	flag.IntVar(&reconnectBuffer, "reconnectBuffer", 1000, "Only with -features cdp-multiplexing: client messages held per shared connection while it is re-established; commands past it are answered with a timeout error")
+	flag.BoolVar(&advertiseCaps, "advertiseCapabilities", false, "Add a \"ppio-proxy\" field to /json/version listing the proxy's version, features and subprotocols, for clients that discover them")
+	flag.BoolVar(&logCDP, "logCDP", false, "Log the method of every relayed CDP command and each failed response")
+	flag.StringVar(&profileName, "profile", "default", "Resource tuning preset: default, or small for tiny (e.g. ARM64) sandboxes; see GET /config")
 	flag.Parse()
+	if configFile == "" {
+		configFile = os.Getenv(configEnvName("config"))
+	}
+	if err := loadConfig(flag.CommandLine, configFile); err != nil {
+		fmt.Fprintf(os.Stderr, "❌ Invalid configuration: %v\n", err)
+		os.Exit(1)
+	}
 
-	if !enableDebug {
+	switch {
+	case !enableDebug:
 		log.SetOutput(io.Discard)
+	case logFile != "":
+		f, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "❌ Failed to open log file: %v\n", err)
+			os.Exit(1)
+		}
+		log.SetOutput(f)
+	case quiet:
+		log.SetOutput(io.Discard)
+	}
+	if err := setIDFormat(idFormat); err != nil {
+		log.Fatalf("❌ Invalid -idFormat: %v", err)
+	}
+	if err := setProfile(profileName); err != nil {
+		log.Fatalf("❌ Invalid -profile: %v", err)
+	}
+	if err := setFeatures(featureFlags); err != nil {
+		log.Fatalf("❌ Invalid -features: %v", err)
+	}
+	// Configured values win over the profile's defaults
+	if configSources["maxLeases"] == "default" && profile.MaxLeases > 0 {
+		maxLeases = profile.MaxLeases
+		configSources["maxLeases"] = "profile"
+	}
+	if fakeUpstream {
+		startFakeUpstream()
+	}
+	if serveSnapshot != "" {
+		startSnapshotServer(serveSnapshot)
+	}
+	if replayPath != "" {
+		startReplayServer(replayPath)
 	}
 
 	log.Printf("🚀 Starting Enhanced Chrome DevTools Reverse Proxy")
@@ -38,9 +329,33 @@ func main() {
 	log.Printf("🎯 Target Port: %d (Chrome DevTools)", targetPort)
 	log.Printf("🐛 Debug Mode: %v", enableDebug)
 	log.Printf("⏱️  Request Timeout: %ds", timeout)
+	log.Printf("🎛️ Profile: %s", profile.Name)
+	for _, f := range featureList() {
+		if f.Enabled != f.Default {
+			log.Printf("🧪 Feature %s: enabled=%v", f.Name, f.Enabled)
+		}
+	}
+	// The native relay closes the client with its Chrome connection
+	if !featureEnabled("cdp-multiplexing") && (configSources["upstreamReconnect"] != "default" || configSources["reconnectBuffer"] != "default") {
+		log.Printf("⚠️ -upstreamReconnect and -reconnectBuffer only apply with -features cdp-multiplexing; clients are disconnected when Chrome drops their connection")
+	}
 	log.Printf("=====================================")
 
 	chromeDevToolsClient := NewChromeDevToolsClient(targetPort, timeout)
+	chromeDevToolsClient.startSupervisor()
+	chromeDevToolsClient.startChannels()
+	chromeDevToolsClient.registerModules()
+	chromeDevToolsClient.pages.Start()
+	chromeDevToolsClient.traffic.Start()
+	if chromeDevToolsClient.warmup.Enabled() {
+		go chromeDevToolsClient.warmup.Run(chromeDevToolsClient.control)
+	}
+
+	if chromeDevToolsClient.startup != nil {
+		if err := chromeDevToolsClient.startup.RunStartup(chromeDevToolsClient); err != nil {
+			log.Fatalf("❌ Startup failed: %v", err)
+		}
+	}
 
 	server := &http.Server{
 		Addr:         fmt.Sprintf(":%d", listenPort),
@@ -49,34 +364,125 @@ func main() {
 		WriteTimeout: time.Duration(timeout) * time.Second,
 	}
 
+	ln, err := listen(server.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
 	log.Printf("✅ Proxy server started, waiting for connections...")
-	log.Fatal(server.ListenAndServe())
+	// Supervising scripts parse this line to learn the proxy is ready
+	json.NewEncoder(os.Stdout).Encode(ReadyEvent{
+		EventHeader: newEventHeader("ready"),
+		Listen:      ln.Addr().String(),
+		PID:         os.Getpid(),
+		Version:     version,
+		Target:      chromeDevToolsClient.upstream.HostPort(),
+	})
+	notifyUpgradeReady()
+	chromeDevToolsClient.server = server
+	chromeDevToolsClient.listener = ln
+	chromeDevToolsClient.watchUpgradeSignal()
+	if err := server.Serve(ln); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	// Sessions opened before an upgrade still run here
+	chromeDevToolsClient.waitDrained()
+	log.Printf("👋 Proxy server stopped")
 }
 
 type ChromeDevToolsClient struct {
-	targetHostPort string
-	client         *http.Client
-	proxy          *httputil.ReverseProxy
+	upstream     *Upstream
+	client       *http.Client
+	proxy        *httputil.ReverseProxy
+	control      *ControlSession
+	pages        *PageWatcher
+	artifacts    *ArtifactStore
+	mocks        *RequestMocker
+	warmup       *Warmup
+	supervisor   *Supervisor
+	channels     *ChannelSet
+	checkpoints  *Checkpointer
+	reservations *ReservationManager
+	labels       *TargetLabels
+	signer       *URLSigner
+	breakGlass   *BreakGlass
+	policy       *MethodPolicy
+	protection   *BrowserProtection
+	traffic      *TrafficMonitor
+	tasks        *TaskStore
+	validator    *UpstreamValidator
+	clients      *ClientCensus
+	deprecations *DeprecationTelemetry
+	interceptors *Interceptors
+	recorder     *SnapshotRecorder
+	cdpRecorder  *CDPRecorder
+	video        *SessionVideo
+	mux          *Multiplexer
+	compression  *ClientCompression
+	keepalive    *Keepalive
+	console      *ConsoleCapture
+	tracer       *Tracer
+	coverage     *CoverageRecorder
+	downloads    *DownloadBridge
+	throttle     *NetworkThrottle
+	guard        *EndpointGuard
+	idle         *IdleTimeout
+	lanes        *PriorityLanes
+	limit        *MessageLimit
+	e2b          *E2BSandbox
+	server       *http.Server
+	listener     net.Listener
+	upload       *ArtifactUpload
+	screencasts  *ScreencastRelay
+	acl          *AdminACL
+	startup      *Hooks
+	shutdown     *Hooks
+	gateway      *GatewayCheck
+	outbox       *Outbox
+	store        *SessionStore
+	state        *StateFile
+	reconnect    time.Duration
+	muxBuffer    int
+	tornDown     int32
+	deltas       *DeltaEncoding
+	limiter      *requestLimiter
+	robots       *RobotsPolicy
+	api          *http.ServeMux
+	// Time source of the timers, caches and limiters
+	clock Clock
+	// Extra /metrics entries contributed by optional modules
+	metricSources []func() map[string]interface{}
 	// Performance metrics
 	requestCount int64
 	errorCount   int64
 	startTime    time.Time
+	// Client WebSocket connections being relayed
+	openWebSockets int64
+	// Set while an upgrade hands over; drained is closed once it is done
+	upgrading int32
+	drained   chan struct{}
 }
 
 func NewChromeDevToolsClient(port, timeoutSec int) *ChromeDevToolsClient {
-	hostPort := net.JoinHostPort("localhost", strconv.Itoa(port))
+	upstream := NewUpstream(net.JoinHostPort("localhost", strconv.Itoa(port)))
 
 	client := &http.Client{
 		Timeout: time.Duration(timeoutSec) * time.Second,
 	}
 
-	targetURL := &url.URL{Scheme: "http", Host: hostPort}
+	targetURL := &url.URL{Scheme: "http", Host: upstream.HostPort()}
 	proxy := httputil.NewSingleHostReverseProxy(targetURL)
+	proxy.BufferPool = newBufferPool(profile.ProxyBufferSize)
 
 	// Enhance proxy Director to handle WebSocket
+	var c *ChromeDevToolsClient
 	originalDirector := proxy.Director
 	proxy.Director = func(req *http.Request) {
 		originalDirector(req)
+		// Follow the current upstream across browser failovers, route
+		// pages leased from a channel to that channel's browser, and
+		// honor X-PPIO-Target
+		req.URL.Host = c.upstreamForRequest(req).HostPort()
+		req.Header.Del(targetOverrideHeader)
 
 		// Check WebSocket upgrade request
 		if isWebSocketUpgrade(req) {
@@ -84,29 +490,115 @@ func NewChromeDevToolsClient(port, timeoutSec int) *ChromeDevToolsClient {
 			// Ensure WebSocket headers are correctly set
 			req.Header.Set("Connection", "Upgrade")
 			req.Header.Set("Upgrade", "websocket")
+			if c.cdpRecorder != nil {
+				// Compressed frames could not be recorded
+				req.Header.Del("Sec-WebSocket-Extensions")
+			}
 		}
 	}
 
-	return &ChromeDevToolsClient{
-		targetHostPort: hostPort,
-		client:         client,
-		proxy:          proxy,
-		startTime:      time.Now(),
+	control := NewControlSession(upstream, client)
+	labels := NewTargetLabels()
+	c = &ChromeDevToolsClient{
+		clock:        systemClock,
+		upstream:     upstream,
+		client:       client,
+		proxy:        proxy,
+		control:      control,
+		channels:     NewChannelSet(),
+		pages:        NewPageWatcher(systemClock, control, labels),
+		reservations: NewReservationManager(systemClock, control, labels, maxLeases),
+		labels:       labels,
+		signer:       NewURLSigner(urlSigningKey, urlTTL, oneTimeURLs, systemClock),
+		breakGlass:   NewBreakGlass(systemClock),
+		traffic:      NewTrafficMonitor(systemClock, anomalyWindow),
+		tasks:        NewTaskStore(systemClock),
+		validator:    NewUpstreamValidator(upstream),
+		clients:      NewClientCensus(),
+		deprecations: NewDeprecationTelemetry(systemClock),
+		interceptors: NewInterceptors(),
+		mux:          NewMultiplexer(),
+		screencasts:  NewScreencastRelay(),
+		tracer:       NewTracer(),
+		coverage:     NewCoverageRecorder(),
+		reconnect:    upstreamReconnect,
+		muxBuffer:    reconnectBuffer,
+		limiter:      newRequestLimiter(profile.MaxConcurrentRequests),
+		api:          http.NewServeMux(),
+		drained:      make(chan struct{}),
+		startTime:    systemClock.Now(),
+	}
+	c.metricSources = append(c.metricSources, c.reservations.pool.Metrics, labels.Metrics, c.breakGlass.Metrics, c.validator.Metrics, c.clients.Metrics, c.deprecations.Metrics, c.channelMetrics, c.mux.Metrics, c.screencasts.Metrics, runtimeMetrics)
+	if c.signer != nil {
+		c.metricSources = append(c.metricSources, c.signer.Metrics)
+	}
+	if c.limiter != nil {
+		c.metricSources = append(c.metricSources, c.limiter.Metrics)
+	}
+	c.traffic.OnClose(c.tasks.RecordSession)
+	c.traffic.OnCommand(c.deprecations.ObserveCommand)
+	// Let the traffic monitor and the recorders observe upgraded client
+	// connections
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if body, ok := resp.Body.(io.ReadWriteCloser); ok && resp.StatusCode == http.StatusSwitchingProtocols {
+			// The reverse proxy writes the 101 only after this returns;
+			// Chrome accepting the upgrade is the closest point to it
+			if err := consumeURLNonce(resp.Request); err != nil {
+				body.Close()
+				return err
+			}
+			resp.Body = c.cdpRecorder.Tap(resp.Request, c.recorder.Tap(resp.Request, c.traffic.Tap(resp.Request, body)))
+			return nil
+		}
+		if c.recorder != nil && snapshotHTTPPath(resp.Request.URL.Path) {
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				return err
+			}
+			c.recorder.RecordHTTP(resp.Request.URL.RequestURI(), resp.StatusCode, body)
+			resp.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		return nil
 	}
+	c.registerRoutes()
+	return c
 }
 
 func (c *ChromeDevToolsClient) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	c.requestCount++
 
 	// Enhanced logging
-	start := time.Now()
+	start := c.clock.Now()
 	log.Printf("📥 [%s] %s %s (from: %s)", r.Method, r.URL.Path, r.URL.RawQuery, r.RemoteAddr)
 
 	defer func() {
-		duration := time.Since(start)
+		duration := c.clock.Since(start)
 		log.Printf("📤 Request completed - duration: %v", duration)
 	}()
 
+	// Health checks must get through even when the proxy is saturated
+	if r.URL.Path != "/health" {
+		release, ok := c.limiter.Acquire()
+		if !ok {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many concurrent requests", http.StatusServiceUnavailable)
+			return
+		}
+		defer release()
+	}
+
+	if c.e2b != nil && e2bAdmission && r.URL.Path != "/health" && !c.e2b.Admit(w, r) {
+		return
+	}
+
+	if r.Header.Get(targetOverrideHeader) != "" && !c.checkTargetOverride(w, r) {
+		return
+	}
+	if !c.guard.Allow(w, r) {
+		return
+	}
+
 	// Handle special endpoints
 	switch {
 	case r.Method == http.MethodGet && r.URL.Path == "/health":
@@ -122,10 +614,44 @@ func (c *ChromeDevToolsClient) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		c.handleJsonList(w, r)
 		return
 	case isWebSocketUpgrade(r):
-		log.Printf("🔌 Direct proxy WebSocket connection: %s", r.URL.Path)
-		c.proxy.ServeHTTP(w, r)
+		if grant := c.breakGlass.Authorize(r, devtoolsTargetID(r.URL.Path)); grant != nil {
+			stripSignature(r.URL)
+			if !c.connectionIDs(w, r) {
+				return
+			}
+			log.Printf("🔌 Break-glass WebSocket connection: %s (grant %s, client %s)", r.URL.Path, grant.ID, c.clients.Observe(r))
+			c.relayWebSocket(w, r.WithContext(context.WithValue(r.Context(), breakGlassGrantKey{}, grant)))
+			return
+		}
+		nonce, err := c.signer.Verify(r.URL)
+		if errors.Is(err, errURLReused) {
+			// A second use means the URL leaked somewhere along the way
+			log.Printf("🚨 ALERT: reuse of one-time WebSocket URL for %s from %s (User-Agent %q)", r.URL.Path, r.RemoteAddr, r.UserAgent())
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		} else if err != nil {
+			log.Printf("🔏 Rejected WebSocket upgrade for %s from %s: %v", r.URL.Path, r.RemoteAddr, err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if !c.connectionIDs(w, r) {
+			return
+		}
+		log.Printf("🔌 Direct proxy WebSocket connection: %s (client %s)", r.URL.Path, c.clients.Observe(r))
+		c.relayWebSocket(w, withURLNonce(r, nonce))
 		return
 	default:
+		// Proxy-owned API endpoints
+		if _, pattern := c.api.Handler(r); pattern != "" {
+			c.api.ServeHTTP(w, r)
+			return
+		}
+		// Upgrades are only relayed by the WebSocket branch and its checks
+		if len(r.Header.Values("Upgrade")) > 0 {
+			log.Printf("🔏 Rejected upgrade request for %s from %s: not a WebSocket upgrade", r.URL.Path, r.RemoteAddr)
+			http.Error(w, "unsupported upgrade request", http.StatusBadRequest)
+			return
+		}
 		// Other requests go directly to proxy
 		c.proxy.ServeHTTP(w, r)
 		return
@@ -135,7 +661,7 @@ func (c *ChromeDevToolsClient) ServeHTTP(w http.ResponseWriter, r *http.Request)
 // Health check endpoint
 func (c *ChromeDevToolsClient) handleHealth(w http.ResponseWriter, r *http.Request) {
 	// Check connection to Chrome
-	resp, err := c.client.Get(fmt.Sprintf("http://%s/json/version", c.targetHostPort))
+	resp, err := c.client.Get(fmt.Sprintf("http://%s/json/version", c.upstream.HostPort()))
 	if err != nil {
 		w.WriteHeader(http.StatusServiceUnavailable)
 		json.NewEncoder(w).Encode(map[string]interface{}{
@@ -146,24 +672,52 @@ func (c *ChromeDevToolsClient) handleHealth(w http.ResponseWriter, r *http.Reque
 	}
 	resp.Body.Close()
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
+	health := map[string]interface{}{
 		"status":    "healthy",
-		"uptime":    time.Since(c.startTime).String(),
-		"target":    c.targetHostPort,
-		"timestamp": time.Now().Unix(),
-	})
+		"startedAt": c.startTime.UTC(),
+		"uptime":    c.clock.Since(c.startTime).String(),
+		"target":    c.upstream.HostPort(),
+		"timestamp": c.clock.Now().Unix(),
+	}
+	// Channel browsers are reported but do not fail the default one's check
+	if statuses := c.channelStatuses(); len(statuses) > 0 {
+		channels := make(map[string]bool)
+		for _, status := range statuses {
+			channels[status.Name] = status.Healthy
+		}
+		health["channels"] = channels
+	}
+	// So is the path through the E2B gateway
+	if c.gateway != nil {
+		if status := c.gateway.Status(); status != nil {
+			health["gateway"] = status
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(health)
 }
 
 // Performance metrics endpoint
 func (c *ChromeDevToolsClient) handleMetrics(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"requests_total": c.requestCount,
-		"errors_total":   c.errorCount,
-		"uptime_seconds": time.Since(c.startTime).Seconds(),
-		"target_host":    c.targetHostPort,
-	})
+	json.NewEncoder(w).Encode(c.metricsSnapshot())
+}
+
+func (c *ChromeDevToolsClient) metricsSnapshot() map[string]interface{} {
+	metrics := map[string]interface{}{
+		"requests_total":     c.requestCount,
+		"errors_total":       c.errorCount,
+		"websockets_open":    atomic.LoadInt64(&c.openWebSockets),
+		"start_time_seconds": c.startTime.Unix(),
+		"uptime_seconds":     c.clock.Since(c.startTime).Seconds(),
+		"target_host":        c.upstream.HostPort(),
+	}
+	for _, source := range c.metricSources {
+		for k, v := range source() {
+			metrics[k] = v
+		}
+	}
+	return metrics
 }
 
 /*
@@ -180,10 +734,11 @@ Response format example:
 	}
 */
 func (c *ChromeDevToolsClient) handleJsonVersion(w http.ResponseWriter, r *http.Request) {
-	publicHostPort := r.Host
-	log.Printf("🔄 Processing /json/version - Public address: %s, Target address: %s", publicHostPort, c.targetHostPort)
+	publicHostPort := bracketHost(r.Host)
+	targetHostPort := c.upstreamForRequest(r).HostPort()
+	log.Printf("🔄 Processing /json/version - Public address: %s, Target address: %s", publicHostPort, targetHostPort)
 
-	resp, err := c.client.Get(fmt.Sprintf("http://%s/json/version", c.targetHostPort))
+	resp, err := c.client.Get(fmt.Sprintf("http://%s/json/version", targetHostPort))
 	if err != nil {
 		c.errorCount++
 		log.Printf("❌ Failed to get JSON version: %v", err)
@@ -199,6 +754,7 @@ func (c *ChromeDevToolsClient) handleJsonVersion(w http.ResponseWriter, r *http.
 		http.Error(w, fmt.Sprintf("Failed to read response body: %v", err), http.StatusInternalServerError)
 		return
 	}
+	c.recorder.RecordHTTP("/json/version", resp.StatusCode, body)
 
 	// Use more flexible interface{} type
 	var versionData map[string]interface{}
@@ -208,12 +764,13 @@ func (c *ChromeDevToolsClient) handleJsonVersion(w http.ResponseWriter, r *http.
 		http.Error(w, fmt.Sprintf("Failed to unmarshal response body: %v", err), http.StatusInternalServerError)
 		return
 	}
+	c.validator.Check("/json/version", versionData)
 
 	// Rewrite webSocketDebuggerUrl
 	if wsURLRaw, exists := versionData["webSocketDebuggerUrl"]; exists {
 		if wsURLStr, ok := wsURLRaw.(string); ok {
 			// More flexible URL rewriting, supporting different formats
-			newWSURL := rewriteWebSocketURL(wsURLStr, c.targetHostPort, publicHostPort)
+			newWSURL := c.signer.Sign(rewriteWebSocketURL(wsURLStr, targetHostPort, publicHostPort))
 			versionData["webSocketDebuggerUrl"] = newWSURL
 
 			log.Printf("🔧 Rewrite WebSocket URL:")
@@ -221,6 +778,9 @@ func (c *ChromeDevToolsClient) handleJsonVersion(w http.ResponseWriter, r *http.
 			log.Printf("   New: %s", newWSURL)
 		}
 	}
+	if advertiseCaps {
+		versionData[capabilitiesField] = c.capabilities()
+	}
 
 	newBody, err := json.Marshal(versionData)
 	if err != nil {
@@ -252,10 +812,11 @@ Response format example:
 	}]
 */
 func (c *ChromeDevToolsClient) handleJsonList(w http.ResponseWriter, r *http.Request) {
-	publicHostPort := r.Host
-	log.Printf("🔄 Processing /json - Public address: %s, Target address: %s", publicHostPort, c.targetHostPort)
+	publicHostPort := bracketHost(r.Host)
+	targetHostPort := c.upstreamForRequest(r).HostPort()
+	log.Printf("🔄 Processing /json - Public address: %s, Target address: %s", publicHostPort, targetHostPort)
 
-	resp, err := c.client.Get(fmt.Sprintf("http://%s%s", c.targetHostPort, r.URL.Path))
+	resp, err := c.client.Get(fmt.Sprintf("http://%s%s", targetHostPort, r.URL.Path))
 	if err != nil {
 		c.errorCount++
 		log.Printf("❌ Failed to get JSON list: %v", err)
@@ -271,6 +832,7 @@ func (c *ChromeDevToolsClient) handleJsonList(w http.ResponseWriter, r *http.Req
 		http.Error(w, fmt.Sprintf("Failed to read response body: %v", err), http.StatusInternalServerError)
 		return
 	}
+	c.recorder.RecordHTTP(r.URL.Path, resp.StatusCode, body)
 
 	// Use more flexible interface{} type
 	var targetsData []map[string]interface{}
@@ -281,21 +843,44 @@ func (c *ChromeDevToolsClient) handleJsonList(w http.ResponseWriter, r *http.Req
 		return
 	}
 
+	// Drop hidden target types
+	visible := targetsData[:0]
+	for _, target := range targetsData {
+		c.validator.Check("/json", target)
+		if targetType, _ := target["type"].(string); targetTypeVisible(targetType, r) {
+			visible = append(visible, target)
+		}
+	}
+	targetsData = visible
+
 	// Iterate and rewrite URLs for each target
 	for i, target := range targetsData {
-		// Rewrite devtoolsFrontendUrl
-		if devURLRaw, exists := target["devtoolsFrontendUrl"]; exists {
-			if devURLStr, ok := devURLRaw.(string); ok {
-				newDevURL := strings.Replace(devURLStr, fmt.Sprintf("ws=%s", c.targetHostPort), fmt.Sprintf("ws=%s", publicHostPort), 1)
-				target["devtoolsFrontendUrl"] = newDevURL
-				log.Printf("🔧 Rewrite devtoolsFrontendUrl [%d]: %s -> %s", i, devURLStr, newDevURL)
+		// Rewrite devtoolsFrontendUrl(Compat); the DevTools frontend
+		// connects with its ws= parameter, which must be signed too
+		for _, field := range []string{"devtoolsFrontendUrl", "devtoolsFrontendUrlCompat"} {
+			if devURLStr, ok := target[field].(string); ok {
+				if field == "devtoolsFrontendUrlCompat" {
+					c.deprecations.RecordShim(field, r)
+				}
+				newDevURL := rewriteFrontendURL(devURLStr, func(wsURL string) (string, bool) {
+					newURL, ok := rewriteUpstreamURL(wsURL, targetHostPort, publicHostPort)
+					if ok {
+						if strings.HasPrefix(wsURL, "ws://") {
+							c.deprecations.RecordShim("frontend-ws-param", r)
+						}
+						newURL = c.signer.Sign(newURL)
+					}
+					return newURL, ok
+				})
+				target[field] = newDevURL
+				log.Printf("🔧 Rewrite %s [%d]: %s -> %s", field, i, devURLStr, newDevURL)
 			}
 		}
 
 		// Rewrite webSocketDebuggerUrl
 		if wsURLRaw, exists := target["webSocketDebuggerUrl"]; exists {
 			if wsURLStr, ok := wsURLRaw.(string); ok {
-				newWSURL := rewriteWebSocketURL(wsURLStr, c.targetHostPort, publicHostPort)
+				newWSURL := c.signer.Sign(rewriteWebSocketURL(wsURLStr, targetHostPort, publicHostPort))
 				target["webSocketDebuggerUrl"] = newWSURL
 				log.Printf("🔧 Rewrite webSocketDebuggerUrl [%d]: %s -> %s", i, wsURLStr, newWSURL)
 			}
@@ -317,21 +902,25 @@ func (c *ChromeDevToolsClient) handleJsonList(w http.ResponseWriter, r *http.Req
 	log.Printf("✅ /json response rewritten and sent")
 }
 
+// Whether targets of this type are listed for the request. -hideTargetTypes
+// hides noisy worker targets from simple clients; ?includeWorkers=true
+// shows everything.
+func targetTypeVisible(targetType string, r *http.Request) bool {
+	if hideTargetTypes == "" || r.URL.Query().Get("includeWorkers") == "true" {
+		return true
+	}
+	for _, hidden := range splitList(hideTargetTypes) {
+		if hidden == targetType {
+			return false
+		}
+	}
+	return true
+}
+
 // Smart WebSocket URL rewriting function
 func rewriteWebSocketURL(originalURL, targetHostPort, publicHostPort string) string {
-	// Try multiple possible formats for replacement
-	patterns := []string{
-		fmt.Sprintf("ws://%s", targetHostPort),
-		fmt.Sprintf("ws://127.0.0.1:%s", strings.Split(targetHostPort, ":")[1]),
-		"ws://localhost:" + strings.Split(targetHostPort, ":")[1],
-	}
-
-	for _, pattern := range patterns {
-		if strings.Contains(originalURL, pattern) {
-			// E2B sandbox uses HTTPS, so use wss
-			newURL := strings.Replace(originalURL, pattern, fmt.Sprintf("wss://%s", publicHostPort), 1)
-			return newURL
-		}
+	if newURL, ok := rewriteUpstreamURL(originalURL, targetHostPort, publicHostPort); ok {
+		return newURL
 	}
 
 	// If no matching pattern found, return original URL (may need manual check)
@@ -339,8 +928,81 @@ func rewriteWebSocketURL(originalURL, targetHostPort, publicHostPort string) str
 	return originalURL
 }
 
-// Check if this is a WebSocket upgrade request
+// Point a WebSocket URL of the upstream Chrome at the public address.
+// Chrome may report itself as the upstream host, or any loopback name,
+// including the IPv6 one.
+func rewriteUpstreamURL(originalURL, targetHostPort, publicHostPort string) (string, bool) {
+	targetHost, targetPort, _ := net.SplitHostPort(targetHostPort)
+	u, err := url.Parse(originalURL)
+	if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Port() != targetPort {
+		return originalURL, false
+	}
+	switch u.Hostname() {
+	case targetHost, "127.0.0.1", "localhost", "::1":
+		// E2B sandbox uses HTTPS, so use wss
+		u.Scheme = "wss"
+		u.Host = bracketHost(publicHostPort)
+		return u.String(), true
+	}
+	return originalURL, false
+}
+
+// ws= and wss= parameters of a devtoolsFrontendUrl, in its query or its
+// fragment (devtools://devtools/bundled/inspector.html#ws=...)
+var frontendWSParam = regexp.MustCompile(`([?&#])(wss?)=([^&#]*)`)
+
+// Rewrite the WebSocket address parameters of a devtoolsFrontendUrl with
+// rewrite, which receives and returns full ws:// or wss:// URLs. Values may
+// be plain or URL-encoded; rewritten ones become wss= parameters and are
+// encoded whenever they carry a query (e.g. a signature).
+func rewriteFrontendURL(devURL string, rewrite func(wsURL string) (string, bool)) string {
+	return frontendWSParam.ReplaceAllStringFunc(devURL, func(param string) string {
+		m := frontendWSParam.FindStringSubmatch(param)
+		sep, scheme, value := m[1], m[2], m[3]
+		decoded, err := url.QueryUnescape(value)
+		if err != nil {
+			return param
+		}
+		newURL, ok := rewrite(scheme + "://" + decoded)
+		if !ok {
+			return param
+		}
+		scheme, address, _ := strings.Cut(newURL, "://")
+		if value != decoded || strings.ContainsAny(address, "?#") {
+			address = url.QueryEscape(address)
+		}
+		return sep + scheme + "=" + address
+	})
+}
+
+// Bracket a bare IPv6 literal, e.g. a Host of "::1" becomes "[::1]"; hosts
+// with a port are already bracketed
+func bracketHost(host string) string {
+	if strings.HasPrefix(host, "[") {
+		return host
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		return "[" + host + "]"
+	}
+	return host
+}
+
+// Check if this is a WebSocket upgrade request. Every Connection and
+// Upgrade line counts, as for Go's own reverse proxy: a token on a second
+// line would otherwise slip past the upgrade checks.
 func isWebSocketUpgrade(r *http.Request) bool {
-	return strings.ToLower(r.Header.Get("Upgrade")) == "websocket" &&
-		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+	return headerValuesContainToken(r.Header.Values("Upgrade"), "websocket") &&
+		headerValuesContainToken(r.Header.Values("Connection"), "upgrade")
+}
+
+// Whether any of the comma-separated header values holds token, ignoring case
+func headerValuesContainToken(values []string, token string) bool {
+	for _, v := range values {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
 }
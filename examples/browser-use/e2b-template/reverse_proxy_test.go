@@ -0,0 +1,170 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBracketHost(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"sandbox.e2b.dev", "sandbox.e2b.dev"},
+		{"sandbox.e2b.dev:9223", "sandbox.e2b.dev:9223"},
+		{"127.0.0.1", "127.0.0.1"},
+		{"127.0.0.1:9223", "127.0.0.1:9223"},
+		{"::1", "[::1]"},
+		{"fd00::5", "[fd00::5]"},
+		{"[::1]", "[::1]"},
+		{"[::1]:9223", "[::1]:9223"},
+		// An IPv4-mapped address parses as IPv4
+		{"::ffff:10.0.0.1", "::ffff:10.0.0.1"},
+	}
+	for _, tt := range tests {
+		if got := bracketHost(tt.host); got != tt.want {
+			t.Errorf("bracketHost(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestRewriteUpstreamURL(t *testing.T) {
+	tests := []struct {
+		name     string
+		original string
+		target   string
+		public   string
+		want     string
+		ok       bool
+	}{
+		{
+			name:     "loopback upstream",
+			original: "ws://127.0.0.1:9222/devtools/page/ABC",
+			target:   "127.0.0.1:9222",
+			public:   "sandbox.e2b.dev",
+			want:     "wss://sandbox.e2b.dev/devtools/page/ABC",
+			ok:       true,
+		},
+		{
+			name:     "localhost alias",
+			original: "ws://localhost:9222/devtools/browser/XYZ",
+			target:   "127.0.0.1:9222",
+			public:   "sandbox.e2b.dev:443",
+			want:     "wss://sandbox.e2b.dev:443/devtools/browser/XYZ",
+			ok:       true,
+		},
+		{
+			name:     "bracketed v6 Host header",
+			original: "ws://127.0.0.1:9222/devtools/page/ABC",
+			target:   "127.0.0.1:9222",
+			public:   "[::1]:9223",
+			want:     "wss://[::1]:9223/devtools/page/ABC",
+			ok:       true,
+		},
+		{
+			name:     "bare v6 Host header",
+			original: "ws://127.0.0.1:9222/devtools/page/ABC",
+			target:   "127.0.0.1:9222",
+			public:   "::1",
+			want:     "wss://[::1]/devtools/page/ABC",
+			ok:       true,
+		},
+		{
+			name:     "v6 loopback upstream",
+			original: "ws://[::1]:9222/devtools/page/ABC",
+			target:   "[::1]:9222",
+			public:   "[::1]:9223",
+			want:     "wss://[::1]:9223/devtools/page/ABC",
+			ok:       true,
+		},
+		{
+			name:     "v6 upstream address",
+			original: "ws://[fd00::5]:9222/devtools/page/ABC",
+			target:   "[fd00::5]:9222",
+			public:   "sandbox.e2b.dev",
+			want:     "wss://sandbox.e2b.dev/devtools/page/ABC",
+			ok:       true,
+		},
+		{
+			name:     "query kept",
+			original: "ws://127.0.0.1:9222/devtools/page/ABC?sig=1",
+			target:   "127.0.0.1:9222",
+			public:   "sandbox.e2b.dev",
+			want:     "wss://sandbox.e2b.dev/devtools/page/ABC?sig=1",
+			ok:       true,
+		},
+		{
+			name:     "port mismatch",
+			original: "ws://127.0.0.1:9333/devtools/page/ABC",
+			target:   "127.0.0.1:9222",
+			public:   "sandbox.e2b.dev",
+			want:     "ws://127.0.0.1:9333/devtools/page/ABC",
+		},
+		{
+			name:     "v6 port mismatch",
+			original: "ws://[::1]:9333/devtools/page/ABC",
+			target:   "[::1]:9222",
+			public:   "[::1]:9223",
+			want:     "ws://[::1]:9333/devtools/page/ABC",
+		},
+		{
+			name:     "missing port",
+			original: "ws://127.0.0.1/devtools/page/ABC",
+			target:   "127.0.0.1:9222",
+			public:   "sandbox.e2b.dev",
+			want:     "ws://127.0.0.1/devtools/page/ABC",
+		},
+		{
+			name:     "foreign host",
+			original: "ws://example.com:9222/devtools/page/ABC",
+			target:   "127.0.0.1:9222",
+			public:   "sandbox.e2b.dev",
+			want:     "ws://example.com:9222/devtools/page/ABC",
+		},
+		{
+			name:     "not a WebSocket URL",
+			original: "http://127.0.0.1:9222/json/list",
+			target:   "127.0.0.1:9222",
+			public:   "sandbox.e2b.dev",
+			want:     "http://127.0.0.1:9222/json/list",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := rewriteUpstreamURL(tt.original, tt.target, tt.public)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("rewriteUpstreamURL(%q, %q, %q) = %q, %v; want %q, %v", tt.original, tt.target, tt.public, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestIsWebSocketUpgrade(t *testing.T) {
+	tests := []struct {
+		name       string
+		connection []string
+		upgrade    []string
+		want       bool
+	}{
+		{"single line", []string{"Upgrade"}, []string{"websocket"}, true},
+		{"token list", []string{"keep-alive, Upgrade"}, []string{"WebSocket"}, true},
+		{"second Connection line", []string{"keep-alive", "Upgrade"}, []string{"websocket"}, true},
+		{"second Upgrade line", []string{"Upgrade"}, []string{"h2c", "websocket"}, true},
+		{"no upgrade token", []string{"keep-alive"}, []string{"websocket"}, false},
+		{"token substring", []string{"not-upgrade"}, []string{"websocket"}, false},
+		{"other protocol", []string{"Upgrade"}, []string{"h2c"}, false},
+		{"no Upgrade header", []string{"Upgrade"}, nil, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/devtools/page/ABC", nil)
+		for _, v := range tt.connection {
+			r.Header.Add("Connection", v)
+		}
+		for _, v := range tt.upgrade {
+			r.Header.Add("Upgrade", v)
+		}
+		if got := isWebSocketUpgrade(r); got != tt.want {
+			t.Errorf("%s: isWebSocketUpgrade = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// robots.txt files are read up to this size (RFC 9309 section 2.5)
+	robotsMaxSize = 500 << 10
+	// Blocked URLs kept per origin for the compliance report
+	robotsReportURLs = 20
+)
+
+type robotsRule struct {
+	allow   bool
+	pattern string
+	re      *regexp.Regexp
+}
+
+// Compile a robots.txt path pattern: '*' matches any characters and a
+// trailing '$' anchors the end
+func newRobotsRule(allow bool, pattern string) robotsRule {
+	anchored := strings.HasSuffix(pattern, "$")
+	parts := strings.Split(strings.TrimSuffix(pattern, "$"), "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	expr := "^" + strings.Join(parts, ".*")
+	if anchored {
+		expr += "$"
+	}
+	return robotsRule{allow: allow, pattern: pattern, re: regexp.MustCompile(expr)}
+}
+
+// robotsRules are the rules of the group applying to the configured agent
+type robotsRules []robotsRule
+
+// Parse a robots.txt and keep the rules of the groups matching agent,
+// falling back to the "*" groups (RFC 9309 section 2.2.1)
+func parseRobots(r io.Reader, agent string) robotsRules {
+	agent = strings.ToLower(agent)
+	var specific, wildcard robotsRules
+	var groupAgents []string
+	inRules := false
+
+	scanner := bufio.NewScanner(io.LimitReader(r, robotsMaxSize))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+		switch key {
+		case "user-agent":
+			// A user-agent line after rules starts a new group
+			if inRules {
+				groupAgents, inRules = nil, false
+			}
+			groupAgents = append(groupAgents, strings.ToLower(value))
+		case "allow", "disallow":
+			inRules = true
+			if value == "" {
+				continue
+			}
+			rule := newRobotsRule(key == "allow", value)
+			for _, ua := range groupAgents {
+				if ua == "*" {
+					wildcard = append(wildcard, rule)
+				} else if ua != "" && strings.Contains(agent, ua) {
+					specific = append(specific, rule)
+				}
+			}
+		}
+	}
+	if specific != nil {
+		return specific
+	}
+	return wildcard
+}
+
+// Allowed applies the most specific (longest) matching rule; allow wins ties
+func (rules robotsRules) Allowed(path string) bool {
+	if path == "/robots.txt" {
+		return true
+	}
+	best, allowed := -1, true
+	for _, rule := range rules {
+		if !rule.re.MatchString(path) {
+			continue
+		}
+		if n := len(rule.pattern); n > best || (n == best && rule.allow) {
+			best, allowed = n, rule.allow
+		}
+	}
+	return allowed
+}
+
+// robotsOrigin is the cached robots.txt of one origin and its report
+type robotsOrigin struct {
+	ready     chan struct{}
+	rules     robotsRules
+	status    string
+	fetchedAt time.Time
+
+	checked int64
+	allowed int64
+	blocked int64
+	recent  []string
+}
+
+// RobotsPolicy fails navigations and XHR/fetch requests disallowed by the
+// target origin's robots.txt for the configured user-agent token. Files
+// are fetched by the proxy itself and cached per origin.
+type RobotsPolicy struct {
+	clock    Clock
+	agent    string
+	cacheTTL time.Duration
+	client   *http.Client
+
+	mu      sync.Mutex
+	origins map[string]*robotsOrigin
+}
+
+func NewRobotsPolicy(clock Clock, agent string, cacheTTL time.Duration, client *http.Client) *RobotsPolicy {
+	return &RobotsPolicy{clock: clock, agent: agent, cacheTTL: cacheTTL, client: client, origins: make(map[string]*robotsOrigin)}
+}
+
+// Return the origin's entry, fetching robots.txt when missing or stale.
+// Concurrent requests for the same origin share one fetch.
+func (p *RobotsPolicy) origin(ctx context.Context, origin string) *robotsOrigin {
+	p.mu.Lock()
+	o, ok := p.origins[origin]
+	if ok && o.fetchedAt.IsZero() || ok && p.clock.Since(o.fetchedAt) < p.cacheTTL {
+		p.mu.Unlock()
+		<-o.ready
+		return o
+	}
+	fresh := &robotsOrigin{ready: make(chan struct{})}
+	if ok {
+		fresh.checked, fresh.allowed, fresh.blocked, fresh.recent = o.checked, o.allowed, o.blocked, o.recent
+	}
+	p.origins[origin] = fresh
+	p.mu.Unlock()
+
+	rules, status := p.fetch(ctx, origin)
+	p.mu.Lock()
+	fresh.rules, fresh.status, fresh.fetchedAt = rules, status, p.clock.Now()
+	p.mu.Unlock()
+	close(fresh.ready)
+	log.Printf("🤖 Loaded robots.txt of %s: %s, %d rules for %q", origin, status, len(rules), p.agent)
+	return fresh
+}
+
+// Unreachable or failing robots.txt disallows everything, a missing one
+// (4xx) allows everything (RFC 9309 section 2.3.1)
+func (p *RobotsPolicy) fetch(ctx context.Context, origin string) (robotsRules, string) {
+	disallowAll := robotsRules{newRobotsRule(false, "/")}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, origin+"/robots.txt", nil)
+	if err != nil {
+		return disallowAll, err.Error()
+	}
+	req.Header.Set("User-Agent", p.agent)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return disallowAll, "unreachable: " + err.Error()
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 500:
+		return disallowAll, resp.Status
+	case resp.StatusCode >= 400:
+		return nil, resp.Status
+	case resp.StatusCode != http.StatusOK:
+		return disallowAll, resp.Status
+	}
+	return parseRobots(resp.Body, p.agent), resp.Status
+}
+
+// Allowed checks one URL and records the decision in the report
+func (p *RobotsPolicy) Allowed(ctx context.Context, rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return true
+	}
+	origin := u.Scheme + "://" + u.Host
+	o := p.origin(ctx, origin)
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	allowed := o.rules.Allowed(path)
+	o.checked++
+	if allowed {
+		o.allowed++
+	} else {
+		o.blocked++
+		o.recent = append(o.recent, rawURL)
+		if len(o.recent) > robotsReportURLs {
+			o.recent = o.recent[len(o.recent)-robotsReportURLs:]
+		}
+	}
+	return allowed
+}
+
+func (p *RobotsPolicy) HandleRequestPaused(ctx context.Context, s *PageSession, ev *FetchRequestPaused) bool {
+	if ev.IsResponseStage() {
+		return false
+	}
+	switch ev.ResourceType {
+	case "Document", "XHR", "Fetch":
+	default:
+		return false
+	}
+	if p.Allowed(ctx, ev.Request.URL) {
+		return false
+	}
+	log.Printf("🤖 robots.txt disallows %s for %q, blocked in %s", ev.Request.URL, p.agent, s.Describe())
+	s.Call(ctx, "Fetch.failRequest", map[string]interface{}{
+		"requestId":   ev.RequestID,
+		"errorReason": "BlockedByClient",
+	})
+	return true
+}
+
+// Report summarizes robots.txt decisions per origin
+func (p *RobotsPolicy) Report() map[string]interface{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	origins := make([]string, 0, len(p.origins))
+	for origin := range p.origins {
+		origins = append(origins, origin)
+	}
+	sort.Strings(origins)
+
+	entries := make([]map[string]interface{}, 0, len(origins))
+	var checked, blocked int64
+	for _, origin := range origins {
+		o := p.origins[origin]
+		checked += o.checked
+		blocked += o.blocked
+		entry := map[string]interface{}{
+			"origin":          origin,
+			"checked":         o.checked,
+			"allowed":         o.allowed,
+			"blocked":         o.blocked,
+			"recentlyBlocked": o.recent,
+		}
+		if !o.fetchedAt.IsZero() {
+			entry["robotsStatus"] = o.status
+			entry["fetchedAt"] = o.fetchedAt
+		}
+		entries = append(entries, entry)
+	}
+	return map[string]interface{}{
+		"userAgent":   p.agent,
+		"generatedAt": p.clock.Now(),
+		"checked":     checked,
+		"blocked":     blocked,
+		"origins":     entries,
+	}
+}
+
+func (p *RobotsPolicy) Metrics() map[string]interface{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var checked, blocked int64
+	for _, o := range p.origins {
+		checked += o.checked
+		blocked += o.blocked
+	}
+	return map[string]interface{}{
+		"robots_origins":       len(p.origins),
+		"robots_checked_total": checked,
+		"robots_blocked_total": blocked,
+	}
+}
+
+// Handle GET /robots/report, the robots.txt compliance report
+func (c *ChromeDevToolsClient) handleRobotsReport(w http.ResponseWriter, r *http.Request) {
+	if c.robots == nil {
+		http.Error(w, "robots.txt compliance is disabled (set -robotsUserAgent)", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, c.robots.Report())
+}
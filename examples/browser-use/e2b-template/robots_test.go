@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRobotsPolicyCacheTTL(t *testing.T) {
+	var fetches int64
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&fetches, 1)
+		fmt.Fprint(w, "User-agent: *\nDisallow: /private\n")
+	}))
+	defer site.Close()
+
+	clock := NewFakeClock(time.Now())
+	p := NewRobotsPolicy(clock, "ppio-bot", time.Hour, site.Client())
+	ctx := context.Background()
+
+	if !p.Allowed(ctx, site.URL+"/public") {
+		t.Fatal("/public disallowed")
+	}
+	if p.Allowed(ctx, site.URL+"/private/page") {
+		t.Fatal("/private/page allowed")
+	}
+	clock.Advance(59 * time.Minute)
+	p.Allowed(ctx, site.URL+"/public")
+	if n := atomic.LoadInt64(&fetches); n != 1 {
+		t.Fatalf("robots.txt fetched %d times within the TTL, want 1", n)
+	}
+	clock.Advance(time.Minute)
+	p.Allowed(ctx, site.URL+"/public")
+	if n := atomic.LoadInt64(&fetches); n != 2 {
+		t.Fatalf("robots.txt fetched %d times after the TTL, want 2", n)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// upstreamField describes one field Chrome is known to return
+type upstreamField struct {
+	required bool
+	// Carries an upstream address that the proxy rewrites
+	rewritten bool
+	// Page-controlled content, which may mention any address
+	content bool
+}
+
+// Known shapes of Chrome's /json/version and /json (list) objects
+var upstreamSchemas = map[string]map[string]upstreamField{
+	"/json/version": {
+		"Browser":              {required: true},
+		"Protocol-Version":     {},
+		"User-Agent":           {},
+		"V8-Version":           {},
+		"WebKit-Version":       {},
+		"Android-Package":      {},
+		"webSocketDebuggerUrl": {rewritten: true},
+	},
+	"/json": {
+		"id":                        {required: true},
+		"type":                      {required: true},
+		"url":                       {required: true, content: true},
+		"title":                     {content: true},
+		"description":               {content: true},
+		"faviconUrl":                {content: true},
+		"parentId":                  {},
+		"devtoolsFrontendUrl":       {rewritten: true},
+		"devtoolsFrontendUrlCompat": {rewritten: true},
+		"webSocketDebuggerUrl":      {rewritten: true},
+	},
+}
+
+// UpstreamValidator checks Chrome's discovery responses against the shapes
+// the proxy knows how to rewrite. Unexpected fields and types are logged
+// once per field; string fields carrying the upstream address that the
+// proxy does not rewrite would hand clients an unreachable address, so
+// they are counted separately.
+type UpstreamValidator struct {
+	upstream *Upstream
+
+	mu            sync.Mutex
+	violations    int64
+	unrewritten   int64
+	unknown       map[string]int64
+	unrewrittenBy map[string]int64
+	reported      map[string]bool
+}
+
+func NewUpstreamValidator(upstream *Upstream) *UpstreamValidator {
+	return &UpstreamValidator{
+		upstream:      upstream,
+		unknown:       make(map[string]int64),
+		unrewrittenBy: make(map[string]int64),
+		reported:      make(map[string]bool),
+	}
+}
+
+// Check one object of the endpoint's response, before it is rewritten
+func (v *UpstreamValidator) Check(endpoint string, obj map[string]interface{}) {
+	schema := upstreamSchemas[endpoint]
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for name, field := range schema {
+		if _, ok := obj[name]; field.required && !ok {
+			v.violations++
+			v.report(endpoint, name, "missing required field")
+		}
+	}
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := obj[name]
+		field, known := schema[name]
+		if !known {
+			v.unknown[endpoint+" "+name]++
+			v.report(endpoint, name, fmt.Sprintf("unexpected field (%T)", value))
+		}
+		s, isString := value.(string)
+		if known && !isString && value != nil {
+			v.violations++
+			v.report(endpoint, name, fmt.Sprintf("expected a string, got %T", value))
+		}
+		if field.rewritten || field.content {
+			continue
+		}
+		if !isString {
+			raw, _ := json.Marshal(value)
+			s = string(raw)
+		}
+		if v.carriesUpstream(s) {
+			v.unrewritten++
+			v.unrewrittenBy[endpoint+" "+name]++
+			v.report(endpoint, name, "carries the upstream address but is not rewritten")
+		}
+	}
+}
+
+// Whether a value refers to the upstream Chrome: a WebSocket URL or its
+// host:port
+func (v *UpstreamValidator) carriesUpstream(s string) bool {
+	if strings.Contains(s, "ws://") || strings.Contains(s, "wss://") {
+		return true
+	}
+	hostPort := v.upstream.HostPort()
+	_, port, _ := net.SplitHostPort(hostPort)
+	return strings.Contains(s, hostPort) || strings.Contains(s, "127.0.0.1:"+port) || strings.Contains(s, "[::1]:"+port)
+}
+
+// Log a finding the first time it is seen. Caller must hold v.mu.
+func (v *UpstreamValidator) report(endpoint, field, problem string) {
+	key := endpoint + " " + field + " " + problem
+	if v.reported[key] {
+		return
+	}
+	v.reported[key] = true
+	log.Printf("🧪 Upstream %s response: field %q %s", endpoint, field, problem)
+}
+
+func (v *UpstreamValidator) Metrics() map[string]interface{} {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	unknown := make(map[string]int64, len(v.unknown))
+	for k, n := range v.unknown {
+		unknown[k] = n
+	}
+	unrewritten := make(map[string]int64, len(v.unrewrittenBy))
+	for k, n := range v.unrewrittenBy {
+		unrewritten[k] = n
+	}
+	return map[string]interface{}{
+		"upstream_schema_violations_total":      v.violations,
+		"upstream_unexpected_fields":            unknown,
+		"upstream_unrewritten_url_fields_total": v.unrewritten,
+		"upstream_unrewritten_url_fields":       unrewritten,
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Boundary between the JPEG parts of an MJPEG stream
+const screencastBoundary = "ppio-screencast-frame"
+
+// ScreencastRelay streams a page's screencast to plain HTTP clients as
+// MJPEG (multipart/x-mixed-replace), which browsers and players such as
+// VLC show as live video, so that people can watch an agent at work
+// without a CDP client
+type ScreencastRelay struct {
+	viewers int64
+	frames  int64
+	dropped int64
+}
+
+func NewScreencastRelay() *ScreencastRelay {
+	return &ScreencastRelay{}
+}
+
+func (s *ScreencastRelay) Metrics() map[string]interface{} {
+	return map[string]interface{}{
+		"screencast_viewers":              atomic.LoadInt64(&s.viewers),
+		"screencast_frames_total":         atomic.LoadInt64(&s.frames),
+		"screencast_dropped_frames_total": atomic.LoadInt64(&s.dropped),
+	}
+}
+
+// Integer query parameter within [min, max], def when absent
+func queryInt(r *http.Request, name string, def, min, max int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < min || n > max {
+		return 0, fmt.Errorf("%s must be an integer from %d to %d", name, min, max)
+	}
+	return n, nil
+}
+
+/*
+Handle GET /targets/{id}/screencast
+Query parameters: fps (1-30, default 5), quality (1-100, default 60),
+maxWidth and maxHeight (default 1280x720).
+
+Starts Page.startScreencast on the page and streams its frames as MJPEG
+until the client goes away or the page closes. Frames arriving faster than
+fps are skipped, as are frames the client is too slow to take.
+*/
+func (c *ChromeDevToolsClient) handleScreencast(w http.ResponseWriter, r *http.Request) {
+	var fps, quality, maxWidth, maxHeight int
+	var err error
+	for _, p := range []struct {
+		v                  *int
+		name               string
+		def, min, maxValue int
+	}{
+		{&fps, "fps", 5, 1, 30},
+		{&quality, "quality", 60, 1, 100},
+		{&maxWidth, "maxWidth", 1280, 16, 7680},
+		{&maxHeight, "maxHeight", 720, 16, 4320},
+	} {
+		if *p.v, err = queryInt(r, p.name, p.def, p.min, p.maxValue); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	targetID := r.PathValue("id")
+	if targetID == browserTargetID {
+		http.Error(w, "screencast needs a page target", http.StatusBadRequest)
+		return
+	}
+	if !c.allowCommands(w, r, "Page.startScreencast", "Page.screencastFrameAck", "Page.stopScreencast") {
+		return
+	}
+	relay := c.screencasts
+	frames := make(chan []byte, 2)
+	started := false
+	ctx := r.Context()
+
+	err = c.control.WithSession(ctx, targetID, func(conn *CDPConn, sessionID string) error {
+		detached := make(chan struct{})
+		var detach sync.Once
+		unsubscribe := conn.Subscribe(func(msg *CDPMessage) {
+			if msg.Method == "Target.detachedFromTarget" {
+				var params struct {
+					SessionID string `json:"sessionId"`
+				}
+				if json.Unmarshal(msg.Params, &params) == nil && params.SessionID == sessionID {
+					detach.Do(func() { close(detached) })
+				}
+				return
+			}
+			if msg.SessionID != sessionID || msg.Method != "Page.screencastFrame" {
+				return
+			}
+			var frame struct {
+				Data      string `json:"data"`
+				SessionID int    `json:"sessionId"`
+			}
+			if json.Unmarshal(msg.Params, &frame) != nil {
+				return
+			}
+			// Chrome sends the next frame only once this one is acknowledged
+			go conn.Call(context.Background(), sessionID, "Page.screencastFrameAck", map[string]interface{}{"sessionId": frame.SessionID})
+			data, err := base64.StdEncoding.DecodeString(frame.Data)
+			if err != nil {
+				return
+			}
+			select {
+			case frames <- data:
+			default:
+				atomic.AddInt64(&relay.dropped, 1)
+			}
+		})
+		defer unsubscribe()
+
+		startCtx, cancel := context.WithTimeout(ctx, c.client.Timeout)
+		_, err := conn.Call(startCtx, sessionID, "Page.startScreencast", map[string]interface{}{
+			"format":        "jpeg",
+			"quality":       quality,
+			"maxWidth":      maxWidth,
+			"maxHeight":     maxHeight,
+			"everyNthFrame": 1,
+		})
+		cancel()
+		if err != nil {
+			return err
+		}
+		started = true
+		defer func() {
+			stopCtx, cancel := context.WithTimeout(context.Background(), c.client.Timeout)
+			defer cancel()
+			conn.Call(stopCtx, sessionID, "Page.stopScreencast", nil)
+		}()
+
+		atomic.AddInt64(&relay.viewers, 1)
+		defer atomic.AddInt64(&relay.viewers, -1)
+		log.Printf("📺 Screencast of %s started for %s (%d fps)", c.labels.Describe(targetID), r.RemoteAddr, fps)
+		defer log.Printf("📺 Screencast of %s ended for %s", c.labels.Describe(targetID), r.RemoteAddr)
+
+		rc := http.NewResponseController(w)
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+screencastBoundary)
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		rc.Flush()
+
+		interval := time.Second / time.Duration(fps)
+		var last time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-conn.Done():
+				return nil
+			case <-detached:
+				return nil
+			case data := <-frames:
+				now := c.clock.Now()
+				if now.Sub(last) < interval {
+					atomic.AddInt64(&relay.dropped, 1)
+					continue
+				}
+				last = now
+				// The stream outlives the server's write timeout
+				rc.SetWriteDeadline(time.Now().Add(c.client.Timeout))
+				fmt.Fprintf(w, "--%s\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n", screencastBoundary, len(data))
+				w.Write(data)
+				if _, err := w.Write([]byte("\r\n")); err != nil {
+					return nil
+				}
+				if rc.Flush() != nil {
+					return nil
+				}
+				atomic.AddInt64(&relay.frames, 1)
+			}
+		}
+	})
+	if err != nil && !started {
+		c.errorCount++
+		log.Printf("❌ Failed to start screencast of %s: %v", targetID, err)
+		http.Error(w, fmt.Sprintf("Failed to start screencast: %v", err), http.StatusBadGateway)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// Tallest full-page screenshot taken, in CSS pixels: Chrome fails to
+// capture beyond its maximum texture size
+const maxScreenshotHeight = 16384
+
+/*
+Handle GET /targets/{id}/screenshot
+Query parameters: format (png, jpeg or webp; default png), quality (1-100,
+jpeg and webp only) and fullPage=true to capture the whole document rather
+than the viewport (up to 16384 CSS pixels high).
+
+Returns the image itself, for dashboards that poll pages without speaking
+CDP.
+*/
+func (c *ChromeDevToolsClient) handleScreenshot(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	format := query.Get("format")
+	switch format {
+	case "":
+		format = "png"
+	case "png", "jpeg", "webp":
+	default:
+		http.Error(w, "format must be png, jpeg or webp", http.StatusBadRequest)
+		return
+	}
+	params := map[string]interface{}{"format": format}
+	if query.Get("quality") != "" {
+		quality, err := queryInt(r, "quality", 0, 1, 100)
+		if err != nil || format == "png" {
+			http.Error(w, "quality must be an integer from 1 to 100, for jpeg or webp", http.StatusBadRequest)
+			return
+		}
+		params["quality"] = quality
+	}
+	fullPage := false
+	if v := query.Get("fullPage"); v != "" {
+		var err error
+		if fullPage, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "fullPage must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+	targetID := r.PathValue("id")
+	if targetID == browserTargetID {
+		http.Error(w, "screenshot needs a page target", http.StatusBadRequest)
+		return
+	}
+	commands := []string{"Page.captureScreenshot"}
+	if fullPage {
+		commands = append(commands, "Page.getLayoutMetrics")
+	}
+	if !c.allowCommands(w, r, commands...) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), c.client.Timeout)
+	defer cancel()
+	var image []byte
+	err := c.control.WithSession(ctx, targetID, func(conn *CDPConn, sessionID string) error {
+		if fullPage {
+			var metrics struct {
+				ContentSize struct {
+					Width  float64 `json:"width"`
+					Height float64 `json:"height"`
+				} `json:"cssContentSize"`
+			}
+			if err := conn.CallResult(ctx, sessionID, "Page.getLayoutMetrics", nil, &metrics); err != nil {
+				return err
+			}
+			height := metrics.ContentSize.Height
+			if height > maxScreenshotHeight {
+				height = maxScreenshotHeight
+			}
+			if metrics.ContentSize.Width > 0 && height > 0 {
+				params["clip"] = map[string]interface{}{"x": 0, "y": 0, "width": metrics.ContentSize.Width, "height": height, "scale": 1}
+				params["captureBeyondViewport"] = true
+			}
+		}
+		var shot struct {
+			Data string `json:"data"`
+		}
+		if err := conn.CallResult(ctx, sessionID, "Page.captureScreenshot", params, &shot); err != nil {
+			return err
+		}
+		var err error
+		image, err = base64.StdEncoding.DecodeString(shot.Data)
+		return err
+	})
+	if err != nil {
+		c.errorCount++
+		log.Printf("❌ Failed to take screenshot of %s: %v", targetID, err)
+		http.Error(w, fmt.Sprintf("Failed to take screenshot: %v", err), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "image/"+format)
+	w.Header().Set("Content-Length", strconv.Itoa(len(image)))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(image)
+}
@@ -0,0 +1,41 @@
+"""Client helper for the proxy's cdp.delta WebSocket subprotocol.
+
+Connect with the subprotocol and pass every text message received through
+a CDPDeltaDecoder, one per connection:
+
+    ws = websockets.connect(url, subprotocols=["cdp.delta"])
+    decoder = CDPDeltaDecoder()
+    message = decoder.decode(await ws.recv())
+
+decode returns the message Chrome sent, as text.
+"""
+
+import json
+import re
+
+_TAG = re.compile(rb'^\{"ppioSlot":(\d+),?')
+
+
+class CDPDeltaDecoder:
+    def __init__(self):
+        # Last tagged message of each slot, as UTF-8 bytes
+        self.slots = {}
+
+    def decode(self, message):
+        data = message.encode("utf-8") if isinstance(message, str) else message
+        if data.startswith(b'{"ppioDelta":'):
+            delta = json.loads(data)["ppioDelta"]
+            base = self.slots[delta["slot"]]
+            parts = []
+            for op in delta["ops"]:
+                if isinstance(op, str):
+                    parts.append(op.encode("utf-8"))
+                else:
+                    start, length = op
+                    parts.append(base[start:start + length])
+            data = b"".join(parts)
+        tag = _TAG.match(data)
+        if tag:
+            self.slots[int(tag.group(1))] = data
+            data = b"{" + data[tag.end():]
+        return data.decode("utf-8")
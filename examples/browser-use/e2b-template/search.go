@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Counts case-insensitive occurrences of the query in the page's visible
+// text and returns the first one with some surrounding context
+const searchExpression = `(() => {
+	const q = %s.toLowerCase();
+	const text = document.body ? document.body.innerText : "";
+	const lower = text.toLowerCase();
+	let matches = 0, first = lower.indexOf(q);
+	for (let i = first; i !== -1; i = lower.indexOf(q, i + q.length)) matches++;
+	const snippet = first < 0 ? "" : text.slice(Math.max(0, first - 60), first + q.length + 60);
+	return {matches, snippet};
+})()`
+
+type searchHit struct {
+	TargetID string            `json:"targetId"`
+	Title    string            `json:"title"`
+	URL      string            `json:"url"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Matches  int               `json:"matches"`
+	Snippet  string            `json:"snippet"`
+}
+
+func searchTarget(ctx context.Context, conn *CDPConn, sessionID, query string) (matches int, snippet string, err error) {
+	quoted, _ := json.Marshal(query)
+	var result struct {
+		Result struct {
+			Value json.RawMessage `json:"value"`
+		} `json:"result"`
+		ExceptionDetails *struct {
+			Text string `json:"text"`
+		} `json:"exceptionDetails"`
+	}
+	err = conn.CallResult(ctx, sessionID, "Runtime.evaluate", map[string]interface{}{
+		"expression":    fmt.Sprintf(searchExpression, quoted),
+		"returnByValue": true,
+	}, &result)
+	if err != nil {
+		return 0, "", err
+	}
+	if result.ExceptionDetails != nil {
+		return 0, "", fmt.Errorf("evaluation failed: %s", result.ExceptionDetails.Text)
+	}
+	var found struct {
+		Matches int    `json:"matches"`
+		Snippet string `json:"snippet"`
+	}
+	if err := json.Unmarshal(result.Result.Value, &found); err != nil {
+		return 0, "", fmt.Errorf("unexpected search result: %s", result.Result.Value)
+	}
+	return found.Matches, found.Snippet, nil
+}
+
+/*
+Handle GET /search?q=invoice
+Searches the visible text of every open page target and returns the ones
+containing the query, most matches first. Targets that could not be
+searched are reported under "errors".
+*/
+func (c *ChromeDevToolsClient) handleSearch(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("q")
+	if query == "" {
+		http.Error(w, "q is required", http.StatusBadRequest)
+		return
+	}
+	if !c.allowCommands(w, r, "Runtime.evaluate") {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), c.apiDeadline(0))
+	defer cancel()
+
+	infos, err := c.listTargets(ctx)
+	if err != nil {
+		c.errorCount++
+		log.Printf("❌ Failed to list targets: %v", err)
+		http.Error(w, fmt.Sprintf("Failed to list targets: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		hits   = []searchHit{}
+		errors = map[string]string{}
+	)
+	for _, info := range infos {
+		if info.Type != "page" {
+			continue
+		}
+		wg.Add(1)
+		go func(info TargetInfo) {
+			defer wg.Done()
+			var matches int
+			var snippet string
+			err := c.control.WithSession(ctx, info.TargetID, func(conn *CDPConn, sessionID string) (err error) {
+				matches, snippet, err = searchTarget(ctx, conn, sessionID, query)
+				return err
+			})
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errors[info.TargetID] = err.Error()
+			} else if matches > 0 {
+				hits = append(hits, searchHit{
+					TargetID: info.TargetID,
+					Title:    info.Title,
+					URL:      info.URL,
+					Labels:   c.labels.Get(info.TargetID),
+					Matches:  matches,
+					Snippet:  snippet,
+				})
+			}
+		}(info)
+	}
+	wg.Wait()
+
+	sort.Slice(hits, func(i, j int) bool { return hits[i].Matches > hits[j].Matches })
+	response := map[string]interface{}{"query": query, "results": hits}
+	if len(errors) > 0 {
+		response["errors"] = errors
+	}
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	errURLUnsigned  = errors.New("missing URL signature")
+	errURLExpired   = errors.New("signed URL expired")
+	errURLSignature = errors.New("invalid URL signature")
+	errURLReused    = errors.New("one-time URL already used")
+)
+
+// Close code for a connection upgraded with a one-time URL that another
+// upgrade consumed first
+const wsClosePolicyViolation = 1008
+
+// URLSigner signs the public WebSocket URLs handed out by /json and the
+// lease API with an HMAC of the path and an expiry, so a leaked URL only
+// works for its own target and only until the TTL. In one-time mode each
+// URL also carries a nonce that the first successful upgrade consumes. A
+// nil signer leaves URLs unsigned and accepts every upgrade.
+type URLSigner struct {
+	key     []byte
+	ttl     time.Duration
+	oneTime bool
+	clock   Clock
+
+	mu       sync.Mutex
+	consumed map[string]int64
+	signed   int64
+	rejected int64
+	reused   int64
+}
+
+func NewURLSigner(key string, ttl time.Duration, oneTime bool, clock Clock) *URLSigner {
+	if key == "" {
+		return nil
+	}
+	return &URLSigner{key: []byte(key), ttl: ttl, oneTime: oneTime, clock: clock, consumed: make(map[string]int64)}
+}
+
+func (s *URLSigner) mac(path string, expires int64, nonce string) string {
+	h := hmac.New(sha256.New, s.key)
+	fmt.Fprintf(h, "%s\n%d\n%s", path, expires, nonce)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Sign appends exp, sig and (in one-time mode) n query parameters to a
+// WebSocket URL
+func (s *URLSigner) Sign(rawURL string) string {
+	if s == nil {
+		return rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	expires := s.clock.Now().Add(s.ttl).Unix()
+	q := u.Query()
+	var nonce string
+	if s.oneTime {
+		nonce = newToken()
+		q.Set("n", nonce)
+	}
+	q.Set("exp", strconv.FormatInt(expires, 10))
+	q.Set("sig", s.mac(u.Path, expires, nonce))
+	u.RawQuery = q.Encode()
+
+	s.mu.Lock()
+	s.signed++
+	s.mu.Unlock()
+	return u.String()
+}
+
+// Verify checks the signature of an upgrade request URL and strips the
+// signing parameters before it is passed on to Chrome. A one-time URL is
+// only checked against the nonces already used here: the returned nonce
+// is consumed once the upgrade has succeeded, so a refused or failed
+// upgrade leaves the URL usable.
+func (s *URLSigner) Verify(u *url.URL) (*urlNonce, error) {
+	if s == nil {
+		return nil, nil
+	}
+	nonce, err := s.verify(u)
+	if err != nil {
+		s.mu.Lock()
+		s.rejected++
+		s.mu.Unlock()
+	}
+	return nonce, err
+}
+
+func (s *URLSigner) verify(u *url.URL) (*urlNonce, error) {
+	q := u.Query()
+	sig := q.Get("sig")
+	if sig == "" {
+		return nil, errURLUnsigned
+	}
+	expires, err := strconv.ParseInt(q.Get("exp"), 10, 64)
+	if err != nil {
+		return nil, errURLSignature
+	}
+	nonce := q.Get("n")
+	if !hmac.Equal([]byte(sig), []byte(s.mac(u.Path, expires, nonce))) {
+		return nil, errURLSignature
+	}
+	if s.clock.Now().Unix() > expires {
+		return nil, errURLExpired
+	}
+	var claim *urlNonce
+	if s.oneTime {
+		if nonce == "" {
+			return nil, errURLSignature
+		}
+		s.mu.Lock()
+		_, used := s.consumed[nonce]
+		if used {
+			s.reused++
+		}
+		s.mu.Unlock()
+		if used {
+			return nil, errURLReused
+		}
+		claim = &urlNonce{signer: s, nonce: nonce, expires: expires}
+	}
+
+	stripSignature(u)
+	return claim, nil
+}
+
+// Remove the signing parameters, which Chrome doesn't expect
+func stripSignature(u *url.URL) {
+	q := u.Query()
+	q.Del("n")
+	q.Del("exp")
+	q.Del("sig")
+	u.RawQuery = q.Encode()
+}
+
+// urlNonce is the nonce of a verified one-time URL, not yet used
+type urlNonce struct {
+	signer  *URLSigner
+	nonce   string
+	expires int64
+}
+
+// The verified nonce of a WebSocket upgrade, in its request context
+type urlNonceKey struct{}
+
+// consumeURLNonce uses up the one-time URL r was upgraded with, once the
+// upgrade has been answered. It fails when a concurrent upgrade with the
+// same URL got there first; without a one-time URL it does nothing.
+func consumeURLNonce(r *http.Request) error {
+	n, _ := r.Context().Value(urlNonceKey{}).(*urlNonce)
+	if n == nil {
+		return nil
+	}
+	err := n.signer.consume(n.nonce, n.expires, n.signer.clock.Now().Unix())
+	if err != nil {
+		log.Printf("🚨 ALERT: reuse of one-time WebSocket URL for %s from %s (User-Agent %q)", r.URL.Path, r.RemoteAddr, r.UserAgent())
+	}
+	return err
+}
+
+// withURLNonce carries a verified nonce to the upgrade
+func withURLNonce(r *http.Request, n *urlNonce) *http.Request {
+	if n == nil {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), urlNonceKey{}, n))
+}
+
+// Close an upgraded connection whose one-time URL was consumed by another
+// upgrade in the meantime
+func refuseReusedUpgrade(conn net.Conn) {
+	writeCloseFrame(conn, false, wsClosePolicyViolation)
+	conn.Close()
+}
+
+// Mark a one-time nonce used. Nonces are remembered until their URL
+// expires, after which the expiry check rejects them anyway.
+func (s *URLSigner) consume(nonce string, expires, now int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for n, exp := range s.consumed {
+		if exp < now {
+			delete(s.consumed, n)
+		}
+	}
+	if _, used := s.consumed[nonce]; used {
+		s.reused++
+		return errURLReused
+	}
+	s.consumed[nonce] = expires
+	return nil
+}
+
+func (s *URLSigner) Metrics() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return map[string]interface{}{
+		"ws_urls_signed_total":    s.signed,
+		"ws_url_rejections_total": s.rejected,
+		"ws_url_reuse_total":      s.reused,
+	}
+}
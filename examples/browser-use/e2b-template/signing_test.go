@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestOneTimeURLConsumedAfterUpgrade(t *testing.T) {
+	s := NewURLSigner("key", time.Minute, true, NewFakeClock(time.Now()))
+	signed := s.Sign("ws://sandbox.e2b.dev/devtools/page/ABC")
+	upgrade := func() (*urlNonce, error) {
+		u, err := url.Parse(signed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.Verify(u)
+	}
+
+	// An upgrade that fails after verification leaves the URL usable
+	if _, err := upgrade(); err != nil {
+		t.Fatal(err)
+	}
+	first, err := upgrade()
+	if err != nil {
+		t.Fatalf("Verify after an unfinished upgrade = %v", err)
+	}
+	// Two upgrades racing with the same URL both verify; only the first
+	// to be answered may keep its connection
+	second, err := upgrade()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/devtools/page/ABC", nil)
+	if err := consumeURLNonce(withURLNonce(r, first)); err != nil {
+		t.Fatalf("consuming the first upgrade = %v", err)
+	}
+	if err := consumeURLNonce(withURLNonce(r, second)); err != errURLReused {
+		t.Fatalf("consuming the second upgrade = %v, want %v", err, errURLReused)
+	}
+	if _, err := upgrade(); err != errURLReused {
+		t.Fatalf("Verify after use = %v, want %v", err, errURLReused)
+	}
+}
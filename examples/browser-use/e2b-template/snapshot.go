@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// snapshotEntry is one line of a snapshot file (JSON Lines). The first
+// line is a "meta" entry naming the recorded upstream; "http" entries are
+// discovery responses and "ws" entries are CDP messages of client
+// connections, "send" from the client and "recv" from Chrome.
+type snapshotEntry struct {
+	Type     string          `json:"type"`
+	Upstream string          `json:"upstream,omitempty"`
+	Path     string          `json:"path,omitempty"`
+	Status   int             `json:"status,omitempty"`
+	Conn     int64           `json:"conn,omitempty"`
+	Dir      string          `json:"dir,omitempty"`
+	Data     json.RawMessage `json:"data,omitempty"`
+}
+
+// SnapshotRecorder appends the discovery responses and client CDP traffic
+// the proxy relays to a snapshot file, for -serveSnapshot to replay
+type SnapshotRecorder struct {
+	mu       sync.Mutex
+	file     *os.File
+	nextConn int64
+}
+
+func NewSnapshotRecorder(path, upstream string) (*SnapshotRecorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	rec := &SnapshotRecorder{file: f}
+	rec.write(&snapshotEntry{Type: "meta", Upstream: upstream})
+	return rec, nil
+}
+
+func (rec *SnapshotRecorder) write(e *snapshotEntry) {
+	line, _ := json.Marshal(e)
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.file.Write(append(line, '\n'))
+}
+
+// RecordHTTP records an upstream /json response to requestURI. Bodies that
+// are not JSON (e.g. "Target is closing") are stored as strings.
+func (rec *SnapshotRecorder) RecordHTTP(requestURI string, status int, body []byte) {
+	if rec == nil {
+		return
+	}
+	data := json.RawMessage(body)
+	if !json.Valid(body) {
+		data, _ = json.Marshal(string(body))
+	}
+	rec.write(&snapshotEntry{Type: "http", Path: requestURI, Status: status, Data: data})
+}
+
+// Tap records the CDP messages of an upgraded client connection
+func (rec *SnapshotRecorder) Tap(r *http.Request, body io.ReadWriteCloser) io.ReadWriteCloser {
+	if rec == nil {
+		return body
+	}
+	rec.mu.Lock()
+	rec.nextConn++
+	conn := rec.nextConn
+	rec.mu.Unlock()
+	record := func(dir string) func([]byte) {
+		return func(payload []byte) {
+			if json.Valid(payload) {
+				rec.write(&snapshotEntry{Type: "ws", Conn: conn, Path: r.URL.Path, Dir: dir, Data: payload})
+			}
+		}
+	}
+	return &recordedConn{ReadWriteCloser: body, toChrome: parseWebSocketStream(record("send"), nil), fromChrome: parseWebSocketStream(record("recv"), nil)}
+}
+
+// recordedConn copies both directions of a connection into frame parsers
+type recordedConn struct {
+	io.ReadWriteCloser
+	toChrome   *io.PipeWriter
+	fromChrome *io.PipeWriter
+	closeOnce  sync.Once
+}
+
+func (t *recordedConn) Read(p []byte) (int, error) {
+	n, err := t.ReadWriteCloser.Read(p)
+	if n > 0 {
+		t.fromChrome.Write(p[:n])
+	}
+	return n, err
+}
+
+func (t *recordedConn) Write(p []byte) (int, error) {
+	n, err := t.ReadWriteCloser.Write(p)
+	if n > 0 {
+		t.toChrome.Write(p[:n])
+	}
+	return n, err
+}
+
+func (t *recordedConn) Close() error {
+	t.closeOnce.Do(func() {
+		t.toChrome.Close()
+		t.fromChrome.Close()
+	})
+	return t.ReadWriteCloser.Close()
+}
+
+// SnapshotServer replays a snapshot file as a stub browser. Discovery
+// requests get the recorded responses for the same path and query in
+// order, repeating the last one. Each CDP connection replays the next
+// recorded connection of its path: a command is answered with the
+// responses and events Chrome sent after the recorded command of the same
+// method, with ids mapped to the client's. Commands the snapshot does not
+// contain fail with a CDP error.
+type SnapshotServer struct {
+	hostPort string
+	// Loopback addresses of the recorded upstream, replaced with hostPort
+	upstreamAddrs []string
+
+	mu      sync.Mutex
+	http    map[string][]*snapshotEntry
+	served  map[string]int
+	conns   map[string][][]*snapshotEntry
+	replays map[string]int
+}
+
+func LoadSnapshotServer(path string) (*SnapshotServer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := &SnapshotServer{
+		http:    make(map[string][]*snapshotEntry),
+		served:  make(map[string]int),
+		conns:   make(map[string][][]*snapshotEntry),
+		replays: make(map[string]int),
+	}
+	connIndex := make(map[int64]int)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, wsMaxFrameSize)
+	for line := 1; scanner.Scan(); line++ {
+		var e snapshotEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		switch e.Type {
+		case "meta":
+			if _, port, err := net.SplitHostPort(e.Upstream); err == nil {
+				s.upstreamAddrs = []string{e.Upstream, "127.0.0.1:" + port, "localhost:" + port, "[::1]:" + port}
+			}
+		case "http":
+			key := snapshotHTTPKey(e.Path)
+			s.http[key] = append(s.http[key], &e)
+		case "ws":
+			i, ok := connIndex[e.Conn]
+			if !ok {
+				i = len(s.conns[e.Path])
+				connIndex[e.Conn] = i
+				s.conns[e.Path] = append(s.conns[e.Path], nil)
+			}
+			s.conns[e.Path][i] = append(s.conns[e.Path][i], &e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return s, nil
+}
+
+// Start serving on a free loopback port
+func (s *SnapshotServer) Start() error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	s.hostPort = ln.Addr().String()
+	go http.Serve(ln, s)
+	return nil
+}
+
+func (s *SnapshotServer) HostPort() string {
+	return s.hostPort
+}
+
+// Point recorded upstream addresses at the stub
+func (s *SnapshotServer) localize(data []byte) []byte {
+	for _, addr := range s.upstreamAddrs {
+		data = bytes.ReplaceAll(data, []byte(addr), []byte(s.hostPort))
+	}
+	return data
+}
+
+func (s *SnapshotServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if isWebSocketUpgrade(r) {
+		s.serveCDP(w, r)
+		return
+	}
+	key := snapshotHTTPKey(r.URL.RequestURI())
+	s.mu.Lock()
+	responses := s.http[key]
+	i := s.served[key]
+	if i < len(responses)-1 {
+		s.served[key]++
+	}
+	s.mu.Unlock()
+	if len(responses) == 0 {
+		http.Error(w, "Not in snapshot: "+key, http.StatusNotFound)
+		return
+	}
+	e := responses[i]
+	var text string
+	if json.Unmarshal(e.Data, &text) == nil {
+		w.WriteHeader(e.Status)
+		io.WriteString(w, text)
+		return
+	}
+	data := s.localize(e.Data)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(e.Status)
+	w.Write(data)
+}
+
+func (s *SnapshotServer) serveCDP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	recorded := s.conns[r.URL.Path]
+	var script []*snapshotEntry
+	if len(recorded) > 0 {
+		script = recorded[s.replays[r.URL.Path]%len(recorded)]
+		s.replays[r.URL.Path]++
+	}
+	s.mu.Unlock()
+	if script == nil {
+		http.Error(w, "Not in snapshot: "+r.URL.Path, http.StatusNotFound)
+		return
+	}
+
+	ws, err := AcceptWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+	newSnapshotReplay(script, s.localize).Run(ws)
+}
+
+// snapshotReplay plays one recorded connection back
+type snapshotReplay struct {
+	script   []*snapshotEntry
+	localize func([]byte) []byte
+	used     []bool
+	// Recorded command id -> the client's id for the same command
+	ids map[int64]int64
+	// Recorded responses waiting for their command
+	held []*CDPMessage
+}
+
+func newSnapshotReplay(script []*snapshotEntry, localize func([]byte) []byte) *snapshotReplay {
+	return &snapshotReplay{script: script, localize: localize, used: make([]bool, len(script)), ids: make(map[int64]int64)}
+}
+
+func (p *snapshotReplay) Run(ws *WebSocketConn) {
+	send := func(msg *CDPMessage) {
+		data, _ := json.Marshal(msg)
+		ws.WriteMessage(wsOpText, data)
+	}
+	// Events Chrome sent before the first command
+	for _, msg := range p.following(-1) {
+		send(msg)
+	}
+	for {
+		opcode, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		if opcode != wsOpText {
+			continue
+		}
+		var cmd CDPMessage
+		if err := json.Unmarshal(data, &cmd); err != nil || cmd.Method == "" {
+			continue
+		}
+		i := p.match(&cmd)
+		if i < 0 {
+			send(&CDPMessage{ID: cmd.ID, SessionID: cmd.SessionID, Error: &CDPError{Code: -32000, Message: "Not in snapshot", Data: cmd.Method}})
+			continue
+		}
+		var recorded CDPMessage
+		json.Unmarshal(p.script[i].Data, &recorded)
+		p.ids[recorded.ID] = cmd.ID
+		for _, msg := range p.following(i) {
+			send(msg)
+		}
+	}
+}
+
+// The first unused recorded command of the client command's method and
+// session
+func (p *snapshotReplay) match(cmd *CDPMessage) int {
+	for i, e := range p.script {
+		if p.used[i] || e.Dir != "send" {
+			continue
+		}
+		var recorded CDPMessage
+		if json.Unmarshal(e.Data, &recorded) == nil && recorded.Method == cmd.Method && recorded.SessionID == cmd.SessionID {
+			p.used[i] = true
+			return i
+		}
+	}
+	return -1
+}
+
+// Messages Chrome sent between recorded command i and the next command,
+// plus held responses whose command has now arrived. Responses to commands
+// the client has not sent yet are held back.
+func (p *snapshotReplay) following(i int) []*CDPMessage {
+	var out []*CDPMessage
+	for j := i + 1; j < len(p.script) && p.script[j].Dir == "recv"; j++ {
+		if p.used[j] {
+			continue
+		}
+		p.used[j] = true
+		var msg CDPMessage
+		if json.Unmarshal(p.localize(p.script[j].Data), &msg) != nil {
+			continue
+		}
+		p.held = append(p.held, &msg)
+	}
+	held := p.held[:0]
+	for _, msg := range p.held {
+		if msg.Method != "" {
+			out = append(out, msg)
+			continue
+		}
+		if id, ok := p.ids[msg.ID]; ok {
+			msg.ID = id
+			out = append(out, msg)
+			continue
+		}
+		held = append(held, msg)
+	}
+	p.held = held
+	return out
+}
+
+// Start the stub browser from -serveSnapshot and point the proxy at it
+func startSnapshotServer(path string) {
+	if chromeBinary != "" || fakeUpstream {
+		log.Fatalf("❌ -serveSnapshot cannot be combined with -chromeBinary or -fakeUpstream")
+	}
+	stub, err := LoadSnapshotServer(path)
+	if err != nil {
+		log.Fatalf("❌ Failed to load snapshot: %v", err)
+	}
+	if err := stub.Start(); err != nil {
+		log.Fatalf("❌ Failed to serve snapshot: %v", err)
+	}
+	_, port, _ := net.SplitHostPort(stub.HostPort())
+	targetPort, _ = strconv.Atoi(port)
+	conns := 0
+	for _, recorded := range stub.conns {
+		conns += len(recorded)
+	}
+	log.Printf("📼 Replaying snapshot %s on %s (%d discovery paths, %d connections), no browser is used",
+		path, stub.HostPort(), len(stub.http), conns)
+}
+
+// Chrome lists targets under three paths
+func snapshotHTTPKey(requestURI string) string {
+	switch requestURI {
+	case "/json", "/json/":
+		return "/json/list"
+	}
+	return requestURI
+}
+
+// Whether a proxied response is a discovery response worth recording
+func snapshotHTTPPath(path string) bool {
+	return path == "/json" || strings.HasPrefix(path, "/json/")
+}
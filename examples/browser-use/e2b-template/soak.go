@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const soakUsage = `Usage:
+  reverse-proxy soak [flags]
+
+Opens and closes CDP sessions through a running proxy and pumps commands
+over them, sampling the proxy's goroutines, open file descriptors and heap
+from /metrics. Fails when a resource grows monotonically.
+
+Flags:
+  --proxy           Proxy base URL (default http://127.0.0.1:9223)
+  --duration        How long to run (default 1h)
+  --concurrency     Sessions open at once (default 4)
+  --commands        Commands sent per session (default 20)
+  --sampleInterval  How often /metrics is sampled (default 30s)
+  --warmup          Samples taken before this are ignored (default 5m)
+  --windows         Leak detection windows; growth in every one fails (default 4)
+  --timeout         Timeout in seconds (default 30)
+`
+
+// Resource metrics watched for leaks, and the growth over the whole run
+// below which a steady rise is not reported (e.g. a pool filling up)
+var soakResources = []struct {
+	metric    string
+	tolerance float64
+}{
+	{"goroutines", 20},
+	{"open_fds", 20},
+	{"heap_alloc_bytes", 16 << 20},
+}
+
+// Process resource usage, sampled by the soak subcommand
+func runtimeMetrics() map[string]interface{} {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	fds := -1
+	if entries, err := os.ReadDir("/proc/self/fd"); err == nil {
+		fds = len(entries)
+	}
+	return map[string]interface{}{
+		"goroutines":       runtime.NumGoroutine(),
+		"open_fds":         fds,
+		"heap_alloc_bytes": mem.HeapAlloc,
+		"heap_objects":     mem.HeapObjects,
+	}
+}
+
+type soakSample struct {
+	Time     time.Time          `json:"time"`
+	Sessions int64              `json:"sessions"`
+	Values   map[string]float64 `json:"values"`
+}
+
+type soakLeak struct {
+	Metric string `json:"metric"`
+	// Lowest value of each detection window
+	WindowMinimums []float64 `json:"windowMinimums"`
+}
+
+type soakReport struct {
+	Proxy    string        `json:"proxy"`
+	Duration float64       `json:"durationSeconds"`
+	Sessions int64         `json:"sessions"`
+	Commands int64         `json:"commands"`
+	Errors   int64         `json:"errors"`
+	Samples  []*soakSample `json:"samples"`
+	Leaks    []*soakLeak   `json:"leaks"`
+	Passed   bool          `json:"passed"`
+}
+
+// Entry point for the "soak" subcommand, returns the process exit code
+func runSoakCommand(args []string) int {
+	fs := flag.NewFlagSet("soak", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, soakUsage) }
+	proxyURL := fs.String("proxy", "http://127.0.0.1:9223", "Proxy base URL")
+	duration := fs.Duration("duration", time.Hour, "How long to run")
+	concurrency := fs.Int("concurrency", 4, "Sessions open at once")
+	commands := fs.Int("commands", 20, "Commands sent per session")
+	sampleInterval := fs.Duration("sampleInterval", 30*time.Second, "How often /metrics is sampled")
+	warmup := fs.Duration("warmup", 5*time.Minute, "Samples taken before this are ignored")
+	windows := fs.Int("windows", 4, "Leak detection windows")
+	timeoutSec := fs.Int("timeout", 30, "Timeout in seconds")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *windows < 2 || *concurrency < 1 || *sampleInterval <= 0 {
+		fmt.Fprintln(os.Stderr, "❌ --windows must be at least 2, --concurrency at least 1 and --sampleInterval positive")
+		return 2
+	}
+
+	base := strings.TrimSuffix(*proxyURL, "/")
+	timeout := time.Duration(*timeoutSec) * time.Second
+	client := &http.Client{Timeout: timeout}
+	report := &soakReport{Proxy: base}
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for n := 0; ctx.Err() == nil; n++ {
+				sent, err := soakSession(base, n%2 == 0, *commands, timeout, n%5 == 4)
+				atomic.AddInt64(&report.Sessions, 1)
+				atomic.AddInt64(&report.Commands, int64(sent))
+				if err != nil && ctx.Err() == nil {
+					if atomic.AddInt64(&report.Errors, 1) <= 10 {
+						fmt.Fprintf(os.Stderr, "⚠️ Session error (worker %d): %v\n", worker, err)
+					}
+					time.Sleep(time.Second)
+				}
+			}
+		}(i)
+	}
+
+	ticker := time.NewTicker(*sampleInterval)
+	defer ticker.Stop()
+	for done := false; !done; {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			done = true
+		}
+		var metrics map[string]interface{}
+		if err := getJSON(client, base+"/metrics", &metrics); err != nil {
+			fmt.Fprintf(os.Stderr, "⚠️ Failed to sample /metrics: %v\n", err)
+			continue
+		}
+		sample := &soakSample{Time: time.Now(), Sessions: atomic.LoadInt64(&report.Sessions), Values: make(map[string]float64)}
+		for _, r := range soakResources {
+			if v, ok := metrics[r.metric].(float64); ok && v >= 0 {
+				sample.Values[r.metric] = v
+			}
+		}
+		fmt.Fprintf(os.Stderr, "📈 %s sessions=%d goroutines=%v fds=%v heap=%v\n", time.Since(start).Round(time.Second),
+			sample.Sessions, sample.Values["goroutines"], sample.Values["open_fds"], sample.Values["heap_alloc_bytes"])
+		if time.Since(start) >= *warmup {
+			report.Samples = append(report.Samples, sample)
+		}
+	}
+	wg.Wait()
+	report.Duration = time.Since(start).Seconds()
+
+	if len(report.Samples) < 2**windows {
+		fmt.Fprintf(os.Stderr, "❌ Only %d samples after warmup, need at least %d; run longer or sample more often\n", len(report.Samples), 2**windows)
+		json.NewEncoder(os.Stdout).Encode(report)
+		return 1
+	}
+	report.Leaks = detectLeaks(report.Samples, *windows)
+	report.Passed = len(report.Leaks) == 0
+	for _, leak := range report.Leaks {
+		fmt.Fprintf(os.Stderr, "🚨 %s grew in every window: %v\n", leak.Metric, leak.WindowMinimums)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+	if !report.Passed {
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "✅ No monotonic growth over %d sessions\n", report.Sessions)
+	return 0
+}
+
+// Open one session to the browser or the first page, send commands and
+// close it; abrupt sessions drop the TCP connection without a close frame,
+// like a crashed client
+func soakSession(base string, browser bool, commands int, timeout time.Duration, abrupt bool) (int, error) {
+	target := ""
+	if browser {
+		target = browserTargetID
+	}
+	wsURL, err := resolveDebuggerURL(base, target, timeout)
+	if err != nil {
+		return 0, err
+	}
+	conn, err := DialCDP(wsURL, timeout)
+	if err != nil {
+		return 0, err
+	}
+	if abrupt {
+		defer conn.ws.conn.Close()
+	} else {
+		defer conn.Close()
+	}
+	method, params := "Browser.getVersion", interface{}(nil)
+	if target == "" {
+		method, params = "Runtime.evaluate", map[string]string{"expression": "navigator.userAgent"}
+	}
+	for i := 0; i < commands; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		_, err := conn.Call(ctx, "", method, params)
+		cancel()
+		if err != nil {
+			return i, err
+		}
+	}
+	return commands, nil
+}
+
+// A resource leaks when the lowest value of every window is higher than the
+// previous window's, and the total rise exceeds its tolerance. Minimums
+// ignore the churn of sessions open at sampling time.
+func detectLeaks(samples []*soakSample, windows int) []*soakLeak {
+	var leaks []*soakLeak
+	for _, r := range soakResources {
+		minimums := make([]float64, windows)
+		for w := 0; w < windows; w++ {
+			lo, hi := w*len(samples)/windows, (w+1)*len(samples)/windows
+			minimums[w] = -1
+			for _, s := range samples[lo:hi] {
+				if v, ok := s.Values[r.metric]; ok && (minimums[w] < 0 || v < minimums[w]) {
+					minimums[w] = v
+				}
+			}
+		}
+		growing := minimums[0] >= 0
+		for w := 1; w < windows && growing; w++ {
+			growing = minimums[w] > minimums[w-1]
+		}
+		if growing && minimums[windows-1]-minimums[0] > r.tolerance {
+			leaks = append(leaks, &soakLeak{Metric: r.metric, WindowMinimums: minimums})
+		}
+	}
+	return leaks
+}
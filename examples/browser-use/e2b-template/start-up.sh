@@ -78,21 +78,10 @@ else
     exit 1
 fi
 
-# Check if port is listening
-echo "Checking if Chrome is listening on port 9222..."
-for i in {1..10}; do
-    if netstat -tlnp 2>/dev/null | grep :9222 > /dev/null; then
-        echo "✅ Chrome is listening on port 9222"
-        break
-    else
-        echo "Waiting for Chrome to listen on port... (attempt $i/10)"
-        sleep 1
-    fi
-done
-
 # Start reverse proxy: 0.0.0.0:9223 -> 127.0.0.1:9222 (supports Host header rewriting)
+# The proxy's startup hooks wait for Chrome to listen before it reports ready
 echo "Starting reverse proxy 0.0.0.0:9223 -> 127.0.0.1:9222..."
-/app/reverse-proxy &
+/app/reverse-proxy -startupHooks /app/startup-hooks.json &
 
 PROXY_PID=$!
 echo "reverse proxy started with PID: $PROXY_PID"
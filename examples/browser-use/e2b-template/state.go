@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ProxyState is what -stateFile keeps of the proxy between runs
+type ProxyState struct {
+	SavedAt time.Time `json:"savedAt"`
+	Version string    `json:"version"`
+	// Target labels, which carry the task, session and customer of each tab
+	Labels       map[string]map[string]string `json:"labels,omitempty"`
+	Reservations []savedReservation           `json:"reservations,omitempty"`
+	RequestCount int64                        `json:"requestsTotal"`
+	ErrorCount   int64                        `json:"errorsTotal"`
+}
+
+// StateFile saves the proxy's labels, leases and counters periodically and
+// at teardown, so that a restarted proxy (an upgrade, a crash) still knows
+// which customer holds which browser. The state is restored at startup,
+// keeping only the targets still open in Chrome.
+type StateFile struct {
+	path     string
+	interval time.Duration
+	clock    Clock
+
+	// Serializes saves
+	mu sync.Mutex
+	// The file belongs to the proxy that took over in an upgrade
+	handedOff bool
+
+	saves          int64
+	failures       int64
+	restoredLeases int
+	lostLeases     int
+}
+
+func NewStateFile(path string, interval time.Duration, clock Clock) *StateFile {
+	return &StateFile{path: path, interval: interval, clock: clock}
+}
+
+// Load reads the saved state; nil without error when there is none
+func (f *StateFile) Load() (*ProxyState, error) {
+	data, err := os.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state ProxyState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// Save replaces the state file atomically
+func (f *StateFile) Save(state *ProxyState) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.handedOff {
+		return nil
+	}
+	err := f.write(state)
+	if err != nil {
+		atomic.AddInt64(&f.failures, 1)
+		return err
+	}
+	atomic.AddInt64(&f.saves, 1)
+	return nil
+}
+
+func (f *StateFile) write(state *ProxyState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := f.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	// A crash right after the rename must not leave an empty file
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	file.Close()
+	return os.Rename(tmp, f.path)
+}
+
+// Handoff stops saving, leaving the file to the proxy that restored it in
+// an upgrade
+func (f *StateFile) Handoff() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.handedOff = true
+}
+
+// Run calls save every interval until the process exits
+func (f *StateFile) Run(save func()) {
+	ticker := f.clock.NewTicker(f.interval)
+	defer ticker.Stop()
+	for range ticker.C() {
+		save()
+	}
+}
+
+func (f *StateFile) Metrics() map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return map[string]interface{}{
+		"state_saves_total":         atomic.LoadInt64(&f.saves),
+		"state_save_failures_total": atomic.LoadInt64(&f.failures),
+		"state_restored_leases":     f.restoredLeases,
+		"state_lost_leases":         f.lostLeases,
+	}
+}
+
+func (c *ChromeDevToolsClient) captureState() *ProxyState {
+	return &ProxyState{
+		SavedAt:      c.clock.Now(),
+		Version:      version,
+		Labels:       c.labels.All(),
+		Reservations: c.reservations.Snapshot(),
+		RequestCount: c.requestCount,
+		ErrorCount:   c.errorCount,
+	}
+}
+
+func (c *ChromeDevToolsClient) saveState() {
+	if err := c.state.Save(c.captureState()); err != nil {
+		log.Printf("❌ Failed to save state to %s: %v", c.state.path, err)
+	}
+}
+
+// Restore the state saved by the previous proxy, reconciled with the
+// targets Chrome still has open; called before the proxy serves
+func (c *ChromeDevToolsClient) restoreState() {
+	state, err := c.state.Load()
+	if err != nil {
+		log.Printf("⚠️ Ignoring unreadable state file %s: %v", c.state.path, err)
+		return
+	}
+	if state == nil {
+		return
+	}
+	c.requestCount += state.RequestCount
+	c.errorCount += state.ErrorCount
+	for id, labels := range state.Labels {
+		c.labels.Set(id, labels)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.client.Timeout)
+	defer cancel()
+	restored, lost := c.reservations.Restore(ctx, state.Reservations)
+	// Labels of closed targets go, as on any listing
+	if _, err := c.listTargets(ctx); err != nil {
+		log.Printf("⚠️ Failed to list targets to reconcile restored labels: %v", err)
+	}
+	for _, res := range lost {
+		log.Printf("🎟️ Lease of %s was lost while the proxy was down", res.TargetID)
+	}
+	c.state.mu.Lock()
+	c.state.restoredLeases = len(restored)
+	c.state.lostLeases = len(lost)
+	c.state.mu.Unlock()
+	log.Printf("♻️ Restored state saved %v ago: %d leases, %d lost, labels of %d targets",
+		c.clock.Since(state.SavedAt).Round(time.Second), len(restored), len(lost), len(c.labels.All()))
+}
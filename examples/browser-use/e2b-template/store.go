@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+SessionStore records closed sessions, leases and audit entries in
+-storeFile so that they survive restarts, and answers the predefined
+queries of GET /admin/query from them.
+
+The file is a journal of JSON lines, one {"table": ..., "row": ...} per
+record, appended and synced as records come in, loaded into memory at
+start and rewritten without the rows older than -storeRetention hourly.
+It stands in for an embedded SQLite database, which would need cgo or a
+third-party driver this stdlib-only build avoids; the query API is kept
+to predefined queries so that a database can replace the journal without
+changing it.
+*/
+type SessionStore struct {
+	path      string
+	retention time.Duration
+	clock     Clock
+
+	mu       sync.Mutex
+	file     *os.File
+	sessions []SessionSummary
+	leases   []LeaseEvent
+	audit    []AuditEntry
+	written  int64
+	// The journal belongs to the proxy that took over in an upgrade
+	handedOff bool
+}
+
+// AuditEntry is an administrative action: a change made through the
+// admin API, or a break-glass grant being minted, used, revoked or expiring
+type AuditEntry struct {
+	Time time.Time `json:"time"`
+	// Who the caller authenticated as, see requestActor
+	Actor string `json:"actor,omitempty"`
+	// The unverified X-PPIO-Actor name it gave
+	ClaimedActor string `json:"claimedActor,omitempty"`
+	Action       string `json:"action"`
+	Target       string `json:"target,omitempty"`
+	Detail       string `json:"detail,omitempty"`
+	Status       int    `json:"status,omitempty"`
+}
+
+type storeRecord struct {
+	Table string          `json:"table"`
+	Row   json.RawMessage `json:"row"`
+}
+
+func LoadSessionStore(path string, retention time.Duration, clock Clock) (*SessionStore, error) {
+	s := &SessionStore{path: path, retention: retention, clock: clock}
+	f, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 16<<20)
+		for line := 1; scanner.Scan(); line++ {
+			if err := s.load(scanner.Bytes()); err != nil {
+				log.Printf("⚠️ Ignoring damaged store line %d in %s: %v", line, path, err)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.compactLocked(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Load one journal line into memory
+func (s *SessionStore) load(line []byte) error {
+	var rec storeRecord
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return err
+	}
+	switch rec.Table {
+	case "sessions":
+		var row SessionSummary
+		if err := json.Unmarshal(rec.Row, &row); err != nil {
+			return err
+		}
+		if row.ClosedAt == nil {
+			return fmt.Errorf("session %s has no closedAt", row.SessionID)
+		}
+		s.sessions = append(s.sessions, row)
+	case "leases":
+		var row LeaseEvent
+		if err := json.Unmarshal(rec.Row, &row); err != nil {
+			return err
+		}
+		s.leases = append(s.leases, row)
+	case "audit":
+		var row AuditEntry
+		if err := json.Unmarshal(rec.Row, &row); err != nil {
+			return err
+		}
+		s.audit = append(s.audit, row)
+	default:
+		return fmt.Errorf("unknown table %q", rec.Table)
+	}
+	return nil
+}
+
+// Run compacts the journal hourly until the process exits
+func (s *SessionStore) Run() {
+	ticker := s.clock.NewTicker(time.Hour)
+	for range ticker.C() {
+		s.mu.Lock()
+		if s.handedOff {
+			s.mu.Unlock()
+			return
+		}
+		if err := s.compactLocked(); err != nil {
+			log.Printf("⚠️ Failed to compact store %s: %v", s.path, err)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Handoff appends to the journal the proxy replacing this one compacted on
+// start, and leaves compacting it to that proxy
+func (s *SessionStore) Handoff() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handedOff = true
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("⚠️ Failed to reopen store %s after the upgrade: %v", s.path, err)
+		return
+	}
+	s.file.Close()
+	s.file = file
+}
+
+// Drop the rows past retention and rewrite the journal with the rest;
+// s.mu must be held
+func (s *SessionStore) compactLocked() error {
+	if s.retention > 0 {
+		cutoff := s.clock.Now().Add(-s.retention)
+		// Rows are appended in time order, so the old ones lead
+		i := sort.Search(len(s.sessions), func(i int) bool { return !s.sessions[i].ClosedAt.Before(cutoff) })
+		s.sessions = append([]SessionSummary(nil), s.sessions[i:]...)
+		i = sort.Search(len(s.leases), func(i int) bool { return !s.leases[i].Time.Before(cutoff) })
+		s.leases = append([]LeaseEvent(nil), s.leases[i:]...)
+		i = sort.Search(len(s.audit), func(i int) bool { return !s.audit[i].Time.Before(cutoff) })
+		s.audit = append([]AuditEntry(nil), s.audit[i:]...)
+	}
+
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	write := func(table string, row interface{}) {
+		data, _ := json.Marshal(row)
+		line, _ := json.Marshal(storeRecord{Table: table, Row: data})
+		w.Write(append(line, '\n'))
+	}
+	for _, row := range s.sessions {
+		write("sessions", row)
+	}
+	for _, row := range s.leases {
+		write("leases", row)
+	}
+	for _, row := range s.audit {
+		write("audit", row)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file = file
+	return nil
+}
+
+// Append a row to the journal; s.mu must be held
+func (s *SessionStore) appendLocked(table string, row interface{}) {
+	data, _ := json.Marshal(row)
+	line, _ := json.Marshal(storeRecord{Table: table, Row: data})
+	_, err := s.file.Write(append(line, '\n'))
+	if err == nil {
+		err = s.file.Sync()
+	}
+	if err != nil {
+		log.Printf("❌ Failed to write %s row to store %s: %v", table, s.path, err)
+		return
+	}
+	s.written++
+}
+
+func (s *SessionStore) RecordSession(summary *SessionSummary) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions = append(s.sessions, *summary)
+	s.appendLocked("sessions", summary)
+}
+
+func (s *SessionStore) RecordLease(event LeaseEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.leases = append(s.leases, event)
+	s.appendLocked("leases", event)
+}
+
+func (s *SessionStore) RecordAudit(entry AuditEntry) {
+	if entry.Time.IsZero() {
+		entry.Time = s.clock.Now()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.audit = append(s.audit, entry)
+	s.appendLocked("audit", entry)
+}
+
+// PurgeSession drops the sessions, leases and audit entries of a session
+// ID or target id, and those of the targets of the session, and rewrites
+// the journal without them, returning how many rows were dropped
+func (s *SessionStore) PurgeSession(id string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	targets := map[string]bool{id: true}
+	for _, row := range s.sessions {
+		if row.SessionID == id {
+			targets[row.TargetID] = true
+		}
+	}
+	n := len(s.sessions) + len(s.leases) + len(s.audit)
+	sessions := s.sessions[:0]
+	for _, row := range s.sessions {
+		if row.SessionID != id && !targets[row.TargetID] {
+			sessions = append(sessions, row)
+		}
+	}
+	leases := s.leases[:0]
+	for _, row := range s.leases {
+		if !targets[row.TargetID] {
+			leases = append(leases, row)
+		}
+	}
+	audit := s.audit[:0]
+	for _, row := range s.audit {
+		if !targets[row.Target] {
+			audit = append(audit, row)
+		}
+	}
+	s.sessions, s.leases, s.audit = sessions, leases, audit
+	dropped := n - len(s.sessions) - len(s.leases) - len(s.audit)
+	if dropped == 0 {
+		return 0, nil
+	}
+	return dropped, s.compactLocked()
+}
+
+// storeQuery is one of the predefined queries of GET /admin/query
+type storeQuery struct {
+	Description string   `json:"description"`
+	Params      []string `json:"params"`
+	run         func(s *SessionStore, q storeQueryParams) interface{}
+}
+
+type storeQueryParams struct {
+	task, target, actor string
+	since               time.Time
+	limit               int
+}
+
+var storeQueries = map[string]storeQuery{
+	"sessions": {
+		Description: "Closed client connections, newest first",
+		Params:      []string{"task", "target", "since", "limit"},
+		run: func(s *SessionStore, q storeQueryParams) interface{} {
+			rows := []SessionSummary{}
+			for i := len(s.sessions) - 1; i >= 0 && len(rows) < q.limit; i-- {
+				row := s.sessions[i]
+				if row.ClosedAt.Before(q.since) {
+					break
+				}
+				if (q.task == "" || row.TaskID == q.task) && (q.target == "" || row.TargetID == q.target) {
+					rows = append(rows, row)
+				}
+			}
+			return rows
+		},
+	},
+	"leases": {
+		Description: "lease.granted and lease.released events, newest first",
+		Params:      []string{"task", "target", "since", "limit"},
+		run: func(s *SessionStore, q storeQueryParams) interface{} {
+			rows := []LeaseEvent{}
+			for i := len(s.leases) - 1; i >= 0 && len(rows) < q.limit; i-- {
+				row := s.leases[i]
+				if row.Time.Before(q.since) {
+					break
+				}
+				if (q.task == "" || row.Task == q.task) && (q.target == "" || row.TargetID == q.target) {
+					rows = append(rows, row)
+				}
+			}
+			return rows
+		},
+	},
+	"usage": {
+		Description: "Leases, sessions and traffic per task (\"\" for untasked use), busiest first",
+		Params:      []string{"task", "since"},
+		run: func(s *SessionStore, q storeQueryParams) interface{} {
+			type usageRow struct {
+				Task string `json:"task"`
+				taskUsage
+			}
+			byTask := make(map[string]*usageRow)
+			row := func(task string) *usageRow {
+				if byTask[task] == nil {
+					byTask[task] = &usageRow{Task: task}
+				}
+				return byTask[task]
+			}
+			for _, lease := range s.leases {
+				if lease.Event == "lease.granted" && !lease.Time.Before(q.since) && (q.task == "" || lease.Task == q.task) {
+					row(lease.Task).Leases++
+				}
+			}
+			for _, session := range s.sessions {
+				if session.ClosedAt.Before(q.since) || (q.task != "" && session.TaskID != q.task) {
+					continue
+				}
+				u := row(session.TaskID)
+				u.Sessions++
+				u.Commands += session.Commands
+				u.BytesSent += session.BytesSent
+				u.BytesReceived += session.BytesReceived
+				u.ConnectedSeconds += session.ClosedAt.Sub(session.ConnectedAt).Seconds()
+			}
+			rows := make([]*usageRow, 0, len(byTask))
+			for _, u := range byTask {
+				rows = append(rows, u)
+			}
+			sort.Slice(rows, func(i, j int) bool { return rows[i].ConnectedSeconds > rows[j].ConnectedSeconds })
+			return rows
+		},
+	},
+	"audit": {
+		Description: "Admin API changes, break-glass events and rejected DevTools requests, newest first",
+		Params:      []string{"actor", "target", "since", "limit"},
+		run: func(s *SessionStore, q storeQueryParams) interface{} {
+			rows := []AuditEntry{}
+			for i := len(s.audit) - 1; i >= 0 && len(rows) < q.limit; i-- {
+				row := s.audit[i]
+				if row.Time.Before(q.since) {
+					break
+				}
+				if (q.actor == "" || row.Actor == q.actor) && (q.target == "" || row.Target == q.target) {
+					rows = append(rows, row)
+				}
+			}
+			return rows
+		},
+	},
+}
+
+// Serve an admin API request, auditing it when it changes something
+func (c *ChromeDevToolsClient) serveAdmin(next http.HandlerFunc, w http.ResponseWriter, r *http.Request) {
+	if c.store == nil || r.Method == http.MethodGet || r.Method == http.MethodHead {
+		next(w, r)
+		return
+	}
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	next(sw, r)
+	c.store.RecordAudit(AuditEntry{
+		Actor:        requestActor(r, c.acl),
+		ClaimedActor: claimedActor(r),
+		Action:       r.Method + " " + r.URL.Path,
+		Status:       sw.status,
+	})
+}
+
+// statusWriter notes the status code a handler answers with
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+/*
+Handle GET /admin/query
+Query parameters: name, the predefined query to run, and its parameters
+(task, target, actor, since as an RFC 3339 time, limit, default 100).
+
+Without a name, lists the queries. Returns {"name": ..., "rows": [...]};
+arbitrary queries are not accepted.
+*/
+func (c *ChromeDevToolsClient) handleStoreQuery(w http.ResponseWriter, r *http.Request) {
+	if c.store == nil {
+		http.Error(w, "Session store is disabled (set -storeFile)", http.StatusNotFound)
+		return
+	}
+	values := r.URL.Query()
+	name := values.Get("name")
+	if name == "" {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"queries": storeQueries})
+		return
+	}
+	query, ok := storeQueries[name]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown query %q, see GET /admin/query", name), http.StatusBadRequest)
+		return
+	}
+	params := storeQueryParams{
+		task:   values.Get("task"),
+		target: values.Get("target"),
+		actor:  values.Get("actor"),
+		limit:  100,
+	}
+	if since := values.Get("since"); since != "" {
+		t, err := time.Parse(time.RFC3339Nano, since)
+		if err != nil {
+			http.Error(w, "since must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+		params.since = t
+	}
+	if limit := values.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		params.limit = n
+	}
+
+	c.store.mu.Lock()
+	rows := query.run(c.store, params)
+	c.store.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{"name": name, "rows": rows})
+}
+
+func (s *SessionStore) Metrics() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return map[string]interface{}{
+		"store_sessions":      len(s.sessions),
+		"store_leases":        len(s.leases),
+		"store_audit_entries": len(s.audit),
+		"store_writes_total":  s.written,
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	chromeStartTimeout   = 20 * time.Second
+	chromeHealthInterval = time.Second
+	// Consecutive failed health probes before a live but hung browser is
+	// replaced
+	chromeHealthFailures = 3
+)
+
+// ChromeProcess is one browser launched and owned by the proxy
+type ChromeProcess struct {
+	HostPort string
+	DataDir  string
+
+	cmd    *exec.Cmd
+	exited chan struct{}
+}
+
+// Default profile directory of the supervised Chrome: the template's path
+// in the sandbox image, a temporary directory on desktop systems
+func defaultChromeDataDir() string {
+	if runtime.GOOS == "linux" {
+		return "/app/user-data-dir"
+	}
+	return filepath.Join(os.TempDir(), "ppio-chrome-profile")
+}
+
+// Locate an installed Chrome or Chromium for -chromeBinary auto
+func findChromeBinary() (string, error) {
+	var candidates []string
+	switch runtime.GOOS {
+	case "darwin":
+		for _, app := range []string{"Google Chrome", "Google Chrome Canary", "Chromium"} {
+			bundle := filepath.Join(app+".app", "Contents", "MacOS", app)
+			candidates = append(candidates, filepath.Join("/Applications", bundle))
+			if home, err := os.UserHomeDir(); err == nil {
+				candidates = append(candidates, filepath.Join(home, "Applications", bundle))
+			}
+		}
+	case "windows":
+		for _, env := range []string{"ProgramFiles", "ProgramFiles(x86)", "LocalAppData"} {
+			if dir := os.Getenv(env); dir != "" {
+				candidates = append(candidates,
+					filepath.Join(dir, "Google", "Chrome", "Application", "chrome.exe"),
+					filepath.Join(dir, "Chromium", "Application", "chrome.exe"))
+			}
+		}
+	}
+	for _, path := range candidates {
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path, nil
+		}
+	}
+	for _, name := range []string{"google-chrome", "google-chrome-stable", "chromium", "chromium-browser", "chrome"} {
+		if path, err := exec.LookPath(name); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("no Chrome or Chromium installation found on %s", runtime.GOOS)
+}
+
+func launchChrome(clock Clock, binary string, port int, dataDir string, headful bool, probe *http.Client) (*ChromeProcess, error) {
+	args := []string{
+		"--remote-debugging-port=" + strconv.Itoa(port),
+		"--no-sandbox",
+		"--disable-gpu",
+		"--no-first-run",
+		"--user-data-dir=" + dataDir,
+	}
+	if !headful {
+		args = append(args, "--headless=new")
+	}
+	if deterministic {
+		args = append(args, deterministicRenderingSwitches...)
+	}
+	if runtime.GOOS == "linux" {
+		args = append(args, "--disable-dev-shm-usage")
+	}
+	cmd := exec.Command(binary, args...)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	p := &ChromeProcess{
+		HostPort: net.JoinHostPort("localhost", strconv.Itoa(port)),
+		DataDir:  dataDir,
+		cmd:      cmd,
+		exited:   make(chan struct{}),
+	}
+	go func() {
+		cmd.Wait()
+		close(p.exited)
+	}()
+
+	deadline := clock.Now().Add(chromeStartTimeout)
+	for !p.Healthy(probe) {
+		if p.Exited() {
+			return nil, fmt.Errorf("chrome exited during startup: %v", cmd.ProcessState)
+		}
+		if clock.Now().After(deadline) {
+			p.Kill()
+			return nil, fmt.Errorf("chrome not ready after %v", chromeStartTimeout)
+		}
+		<-clock.After(200 * time.Millisecond)
+	}
+	return p, nil
+}
+
+func (p *ChromeProcess) Healthy(probe *http.Client) bool {
+	resp, err := probe.Get(fmt.Sprintf("http://%s/json/version", p.HostPort))
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+func (p *ChromeProcess) Exited() bool {
+	select {
+	case <-p.exited:
+		return true
+	default:
+		return false
+	}
+}
+
+// Kill stops the browser at once. Its helpers exit when they lose the
+// browser process, except on Windows, where taskkill /T ends the whole
+// process tree.
+func (p *ChromeProcess) Kill() {
+	if runtime.GOOS == "windows" {
+		exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(p.cmd.Process.Pid)).Run()
+	}
+	p.cmd.Process.Kill()
+	<-p.exited
+}
+
+// Pick a free local port for an additional browser
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// Supervisor runs Chrome as a child process and keeps an optional warm
+// standby. When the primary crashes or stops answering, the upstream is
+// repointed to the standby and a new standby is started in the background.
+type Supervisor struct {
+	clock      Clock
+	binary     string
+	dataDir    string
+	standbyOn  bool
+	upstream   *Upstream
+	probe      *http.Client
+	onPromote  []func(hostPort string)
+	onFailover []func()
+	// Warm prepares a freshly launched standby before it is marked ready
+	Warm func(hostPort string)
+	// Headful launches Chrome with a window instead of --headless=new
+	Headful bool
+
+	mu           sync.Mutex
+	primary      *ChromeProcess
+	standby      *ChromeProcess
+	generation   int
+	failovers    int64
+	restarts     int64
+	lastFailover time.Duration
+}
+
+func NewSupervisor(clock Clock, binary, dataDir string, standby bool, upstream *Upstream) *Supervisor {
+	return &Supervisor{
+		clock:     clock,
+		binary:    binary,
+		dataDir:   dataDir,
+		standbyOn: standby,
+		upstream:  upstream,
+		probe:     &http.Client{Timeout: 2 * time.Second},
+	}
+}
+
+// OnPromote registers fn to prepare a replacement browser before clients
+// are switched to it
+func (s *Supervisor) OnPromote(fn func(hostPort string)) {
+	s.onPromote = append(s.onPromote, fn)
+}
+
+// OnFailover registers fn to run after the upstream has been repointed
+func (s *Supervisor) OnFailover(fn func()) {
+	s.onFailover = append(s.onFailover, fn)
+}
+
+// Start launches the primary browser on port and begins monitoring it
+func (s *Supervisor) Start(port int) error {
+	primary, err := launchChrome(s.clock, s.binary, port, s.dataDir, s.Headful, s.probe)
+	if err != nil {
+		return err
+	}
+	log.Printf("🧭 Chrome started on %s (pid %d)", primary.HostPort, primary.cmd.Process.Pid)
+	s.mu.Lock()
+	s.primary = primary
+	s.mu.Unlock()
+	s.upstream.Set(primary.HostPort)
+
+	if s.standbyOn {
+		go s.startStandby()
+	}
+	go s.monitor()
+	return nil
+}
+
+// Launch a browser on a free port with its own profile directory
+func (s *Supervisor) launchSpare() (*ChromeProcess, error) {
+	port, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.generation++
+	dataDir := fmt.Sprintf("%s-%d", s.dataDir, s.generation)
+	s.mu.Unlock()
+	return launchChrome(s.clock, s.binary, port, dataDir, s.Headful, s.probe)
+}
+
+func (s *Supervisor) startStandby() {
+	for attempt := 0; ; attempt++ {
+		standby, err := s.launchSpare()
+		if err == nil {
+			if s.Warm != nil {
+				s.Warm(standby.HostPort)
+			}
+			s.mu.Lock()
+			s.standby = standby
+			s.mu.Unlock()
+			log.Printf("🧭 Standby Chrome ready on %s", standby.HostPort)
+			return
+		}
+		log.Printf("⚠️ Standby Chrome failed to start: %v", err)
+		<-s.clock.After(time.Duration(attempt+1) * time.Second)
+	}
+}
+
+func (s *Supervisor) monitor() {
+	ticker := s.clock.NewTicker(chromeHealthInterval)
+	defer ticker.Stop()
+
+	failures := 0
+	for range ticker.C() {
+		s.mu.Lock()
+		primary, standby := s.primary, s.standby
+		s.mu.Unlock()
+
+		if standby != nil && standby.Exited() {
+			log.Printf("⚠️ Standby Chrome exited, replacing it")
+			s.mu.Lock()
+			s.standby = nil
+			s.mu.Unlock()
+			s.discard(standby)
+			go s.startStandby()
+		}
+
+		switch {
+		case primary.Exited():
+			log.Printf("❌ Chrome exited: %v", primary.cmd.ProcessState)
+		case !primary.Healthy(s.probe):
+			if failures++; failures < chromeHealthFailures {
+				continue
+			}
+			log.Printf("❌ Chrome unresponsive for %d health checks", failures)
+		default:
+			failures = 0
+			continue
+		}
+		failures = 0
+		s.failover(primary)
+	}
+}
+
+// Replace the failed primary, preferring the warm standby over a cold start
+func (s *Supervisor) failover(failed *ChromeProcess) {
+	start := s.clock.Now()
+	s.discard(failed)
+
+	s.mu.Lock()
+	next := s.standby
+	s.standby = nil
+	s.mu.Unlock()
+
+	promoted := next != nil && !next.Exited()
+	for !promoted {
+		var err error
+		if next, err = s.launchSpare(); err == nil {
+			break
+		}
+		log.Printf("⚠️ Chrome restart failed: %v", err)
+		<-s.clock.After(time.Second)
+	}
+
+	for _, fn := range s.onPromote {
+		fn(next.HostPort)
+	}
+
+	elapsed := s.clock.Since(start)
+	s.mu.Lock()
+	s.primary = next
+	if promoted {
+		s.failovers++
+	} else {
+		s.restarts++
+	}
+	s.lastFailover = elapsed
+	s.mu.Unlock()
+	s.upstream.Set(next.HostPort)
+
+	if promoted {
+		log.Printf("🧭 Failed over to standby Chrome on %s in %v", next.HostPort, elapsed.Round(time.Millisecond))
+	} else {
+		log.Printf("🧭 Restarted Chrome on %s in %v", next.HostPort, elapsed.Round(time.Millisecond))
+	}
+	for _, fn := range s.onFailover {
+		fn()
+	}
+	if s.standbyOn {
+		go s.startStandby()
+	}
+}
+
+// Kill a browser and remove its profile unless it is the configured one
+func (s *Supervisor) discard(p *ChromeProcess) {
+	p.Kill()
+	if p.DataDir != s.dataDir {
+		os.RemoveAll(p.DataDir)
+	}
+}
+
+func (s *Supervisor) Metrics() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return map[string]interface{}{
+		"chrome_failovers_total":  s.failovers,
+		"chrome_restarts_total":   s.restarts,
+		"chrome_last_failover_ms": s.lastFailover.Milliseconds(),
+		"chrome_standby_ready":    s.standby != nil,
+	}
+}
+
+// Launch Chrome under supervision when -chromeBinary is set
+func (c *ChromeDevToolsClient) startSupervisor() {
+	if chromeBinary == "" {
+		return
+	}
+	if chromeBinary == "auto" {
+		binary, err := findChromeBinary()
+		if err != nil {
+			log.Fatalf("❌ Failed to start Chrome: %v", err)
+		}
+		log.Printf("🧭 Found Chrome at %s", binary)
+		chromeBinary = binary
+	}
+	c.supervisor = NewSupervisor(c.clock, chromeBinary, chromeDataDir, chromeStandby, c.upstream)
+	c.supervisor.Warm = func(hostPort string) {
+		if w := NewWarmup(c.clock, splitList(warmupURLs), warmupTabs); w.Enabled() {
+			w.Run(NewControlSession(NewUpstream(hostPort), c.client))
+		}
+	}
+	if checkpointInterval > 0 {
+		c.checkpoints = NewCheckpointer(c.clock, c.control, c.labels, checkpointInterval)
+		c.supervisor.OnPromote(c.checkpoints.Restore)
+		c.metricSources = append(c.metricSources, c.checkpoints.Metrics)
+		go c.checkpoints.Run()
+	}
+	// Reserved targets lived in the old browser
+	c.supervisor.OnFailover(func() { c.reservations.Reset("") })
+	if err := c.supervisor.Start(targetPort); err != nil {
+		log.Fatalf("❌ Failed to start Chrome: %v", err)
+	}
+	c.metricSources = append(c.metricSources, c.supervisor.Metrics)
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Header (or "task" URL parameter) tying API calls and connections to a task
+	taskHeader = "X-PPIO-Task"
+	// Closed sessions kept per task for its report
+	taskSessionHistory = 100
+)
+
+var errTaskExists = errors.New("task already exists")
+
+// Task groups the targets, connections, artifacts and usage of one unit of
+// orchestrated work. Targets leased under a task carry a "task" label, so
+// captures and logs of them are attributed to it as well.
+type Task struct {
+	ID        string            `json:"id"`
+	Name      string            `json:"name,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	CreatedAt time.Time         `json:"createdAt"`
+
+	sessions []*SessionSummary
+	usage    taskUsage
+}
+
+type taskUsage struct {
+	Leases           int     `json:"leases"`
+	Sessions         int     `json:"sessions"`
+	Commands         int64   `json:"commands"`
+	BytesSent        int64   `json:"bytesSent"`
+	BytesReceived    int64   `json:"bytesReceived"`
+	ConnectedSeconds float64 `json:"connectedSeconds"`
+}
+
+// TaskStore keeps tasks in memory for the lifetime of the proxy
+type TaskStore struct {
+	clock Clock
+	mu    sync.Mutex
+	tasks map[string]*Task
+}
+
+func NewTaskStore(clock Clock) *TaskStore {
+	return &TaskStore{clock: clock, tasks: make(map[string]*Task)}
+}
+
+// Create a task with the caller's ID, or a generated one when id is empty
+func (s *TaskStore) Create(id, name string, labels map[string]string) (*Task, error) {
+	if id == "" {
+		id = newID()
+	}
+	t := &Task{ID: id, Name: name, Labels: labels, CreatedAt: s.clock.Now()}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tasks[id]; ok {
+		return nil, errTaskExists
+	}
+	s.tasks[id] = t
+	return t, nil
+}
+
+func (s *TaskStore) Exists(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.tasks[id]
+	return ok
+}
+
+func (s *TaskStore) RecordLease(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.tasks[id]; ok {
+		t.usage.Leases++
+	}
+}
+
+// RecordSession adds a closed connection's traffic to its task
+func (s *TaskStore) RecordSession(summary *SessionSummary) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tasks[summary.TaskID]
+	if !ok {
+		return
+	}
+	t.usage.Sessions++
+	t.usage.Commands += summary.Commands
+	t.usage.BytesSent += summary.BytesSent
+	t.usage.BytesReceived += summary.BytesReceived
+	t.usage.ConnectedSeconds += summary.ClosedAt.Sub(summary.ConnectedAt).Seconds()
+	t.sessions = append(t.sessions, summary)
+	if len(t.sessions) > taskSessionHistory {
+		t.sessions = t.sessions[len(t.sessions)-taskSessionHistory:]
+	}
+}
+
+func (s *TaskStore) List() []Task {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tasks := make([]Task, 0, len(s.tasks))
+	for _, t := range s.tasks {
+		tasks = append(tasks, Task{ID: t.ID, Name: t.Name, Labels: t.Labels, CreatedAt: t.CreatedAt})
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].CreatedAt.Before(tasks[j].CreatedAt) })
+	return tasks
+}
+
+// Resolve the task of an API request from the body field or the header,
+// replying 404 for unknown tasks
+func (c *ChromeDevToolsClient) requestTask(w http.ResponseWriter, r *http.Request, task string) (string, bool) {
+	if task == "" {
+		task = r.Header.Get(taskHeader)
+	}
+	if task != "" && !c.tasks.Exists(task) {
+		http.Error(w, "unknown task", http.StatusNotFound)
+		return "", false
+	}
+	return task, true
+}
+
+// Resolve the session ID requested for a lease from the body field or the
+// header, replying 400 for malformed IDs
+func requestSessionID(w http.ResponseWriter, r *http.Request, sessionID string) (string, bool) {
+	if sessionID == "" {
+		sessionID = r.Header.Get(sessionHeader)
+	}
+	if sessionID != "" {
+		if err := checkID("session", sessionID); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return "", false
+		}
+	}
+	return sessionID, true
+}
+
+// Attach a WebSocket upgrade to its task and session ID. Each is taken from
+// its header (X-PPIO-Task, X-PPIO-Session), URL parameter (task, session)
+// or the target's label, in that order. The parameters are stripped before
+// the request reaches Chrome.
+func (c *ChromeDevToolsClient) connectionIDs(w http.ResponseWriter, r *http.Request) bool {
+	targetID := devtoolsTargetID(r.URL.Path)
+	labels := map[string]string{}
+	if targetID != "" {
+		labels = c.labels.Get(targetID)
+	}
+	q := r.URL.Query()
+	ids := map[string]string{}
+	for key, header := range map[string]string{"task": taskHeader, "session": sessionHeader} {
+		id := r.Header.Get(header)
+		if id == "" {
+			id = q.Get(key)
+		}
+		if id == "" {
+			id = labels[key]
+		}
+		q.Del(key)
+		if id != "" {
+			if err := checkID(key, id); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return false
+			}
+			r.Header.Set(header, id)
+		}
+		ids[key] = id
+	}
+	r.URL.RawQuery = q.Encode()
+
+	if task := ids["task"]; task != "" {
+		if !c.tasks.Exists(task) {
+			log.Printf("🗂️ Rejected WebSocket upgrade for %s from %s: unknown task %s", r.URL.Path, r.RemoteAddr, task)
+			http.Error(w, "unknown task", http.StatusNotFound)
+			return false
+		}
+		if targetID != "" {
+			c.labels.Set(targetID, map[string]string{"task": task})
+		}
+	}
+	return true
+}
+
+/*
+Handle POST /tasks
+Request example:
+
+	{"id": "order-1234", "name": "checkout-flow", "labels": {"customer": "42"}}
+
+The id (or X-PPIO-Task header) lets orchestrators use their own keys; it
+is generated per -idFormat when omitted. Leases made with {"task": id} or the X-PPIO-Task header belong to the
+task, as do WebSocket connections carrying the header or ?task=id.
+*/
+func (c *ChromeDevToolsClient) handleCreateTask(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID     string            `json:"id"`
+		Name   string            `json:"name"`
+		Labels map[string]string `json:"labels"`
+	}
+	if r.ContentLength != 0 && !readJSON(w, r, &req) {
+		return
+	}
+	if req.ID == "" {
+		req.ID = r.Header.Get(taskHeader)
+	}
+	if req.ID != "" {
+		if err := checkID("task", req.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	t, err := c.tasks.Create(req.ID, req.Name, req.Labels)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	log.Printf("🗂️ Created task %s %s", t.ID, req.Name)
+	writeJSON(w, http.StatusCreated, t)
+}
+
+// Handle GET /tasks
+func (c *ChromeDevToolsClient) handleListTasks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, c.tasks.List())
+}
+
+/*
+Handle GET /tasks/{id}
+Returns the consolidated report of a task: its live targets, connections
+(open and recently closed), artifacts and accumulated usage.
+*/
+func (c *ChromeDevToolsClient) handleGetTask(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	c.tasks.mu.Lock()
+	t, ok := c.tasks.tasks[id]
+	var task Task
+	sessions := []*SessionSummary{}
+	var usage taskUsage
+	if ok {
+		task = Task{ID: t.ID, Name: t.Name, Labels: t.Labels, CreatedAt: t.CreatedAt}
+		sessions = append(sessions, t.sessions...)
+		usage = t.usage
+	}
+	c.tasks.mu.Unlock()
+	if !ok {
+		http.Error(w, "unknown task", http.StatusNotFound)
+		return
+	}
+
+	// Open connections count towards usage up to now
+	for _, open := range c.traffic.OpenSessions(id) {
+		sessions = append(sessions, open)
+		usage.Sessions++
+		usage.Commands += open.Commands
+		usage.BytesSent += open.BytesSent
+		usage.BytesReceived += open.BytesReceived
+		usage.ConnectedSeconds += c.clock.Since(open.ConnectedAt).Seconds()
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), c.client.Timeout)
+	defer cancel()
+	targets := []map[string]interface{}{}
+	if infos, err := c.listTargets(ctx); err == nil {
+		for _, info := range infos {
+			if c.labels.Get(info.TargetID)["task"] == id {
+				targets = append(targets, map[string]interface{}{
+					"targetId": info.TargetID,
+					"type":     info.Type,
+					"title":    info.Title,
+					"url":      info.URL,
+				})
+			}
+		}
+	} else {
+		log.Printf("⚠️ Failed to list targets for task %s: %v", id, err)
+	}
+
+	artifacts := []map[string]interface{}{}
+	if c.artifacts != nil {
+		for _, a := range c.artifacts.List(func(a *Artifact) bool { return a.Meta["label.task"] == id }) {
+			artifacts = append(artifacts, map[string]interface{}{
+				"id":        a.ID,
+				"kind":      a.Kind,
+				"name":      a.Name,
+				"size":      a.Size,
+				"targetId":  a.Meta["targetId"],
+				"createdAt": a.CreatedAt,
+			})
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"task":      task,
+		"targets":   targets,
+		"sessions":  sessions,
+		"artifacts": artifacts,
+		"usage":     usage,
+	})
+}
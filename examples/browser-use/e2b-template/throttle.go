@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// NetworkConditions is a throttling profile. Throughputs are in kbit/s;
+// zero leaves a direction unthrottled.
+type NetworkConditions struct {
+	Preset       string  `json:"preset,omitempty"`
+	Offline      bool    `json:"offline"`
+	LatencyMs    float64 `json:"latencyMs"`
+	DownloadKbps float64 `json:"downloadKbps"`
+	UploadKbps   float64 `json:"uploadKbps"`
+}
+
+// The profiles of Chrome DevTools' network panel
+var networkPresets = map[string]NetworkConditions{
+	"none":    {},
+	"offline": {Offline: true},
+	"slow-3g": {LatencyMs: 2000, DownloadKbps: 400, UploadKbps: 400},
+	"fast-3g": {LatencyMs: 562.5, DownloadKbps: 1440, UploadKbps: 675},
+	"fast-4g": {LatencyMs: 165, DownloadKbps: 8100, UploadKbps: 1350},
+}
+
+func networkPresetNames() string {
+	names := make([]string, 0, len(networkPresets))
+	for name := range networkPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// Parse -networkThrottle: a preset name, or latency in ms and download and
+// upload throughput in kbit/s as "300:1000:500"
+func ParseNetworkConditions(spec string) (NetworkConditions, error) {
+	if preset, ok := networkPresets[spec]; ok {
+		preset.Preset = spec
+		return preset, nil
+	}
+	parts := strings.Split(spec, ":")
+	if len(parts) != 3 {
+		return NetworkConditions{}, fmt.Errorf("%q is neither a preset (%s) nor latencyMs:downloadKbps:uploadKbps", spec, networkPresetNames())
+	}
+	var values [3]float64
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return NetworkConditions{}, fmt.Errorf("%q: %v", spec, err)
+		}
+		values[i] = v
+	}
+	conditions := NetworkConditions{LatencyMs: values[0], DownloadKbps: values[1], UploadKbps: values[2]}
+	return conditions, conditions.validate()
+}
+
+// Fill in a preset named in a request body and check the values
+func (n *NetworkConditions) resolve() error {
+	if n.Preset != "" {
+		preset, ok := networkPresets[n.Preset]
+		if !ok {
+			return fmt.Errorf("unknown preset %q (one of %s)", n.Preset, networkPresetNames())
+		}
+		preset.Preset = n.Preset
+		*n = preset
+		return nil
+	}
+	return n.validate()
+}
+
+func (n *NetworkConditions) validate() error {
+	if n.LatencyMs < 0 || n.DownloadKbps < 0 || n.UploadKbps < 0 {
+		return errors.New("latency and throughput must not be negative")
+	}
+	return nil
+}
+
+// Network.emulateNetworkConditions parameters, throughputs in bytes/s
+// with -1 disabling throttling
+func (n NetworkConditions) params() map[string]interface{} {
+	throughput := func(kbps float64) float64 {
+		if kbps == 0 {
+			return -1
+		}
+		return kbps * 1000 / 8
+	}
+	return map[string]interface{}{
+		"offline":            n.Offline,
+		"latency":            n.LatencyMs,
+		"downloadThroughput": throughput(n.DownloadKbps),
+		"uploadThroughput":   throughput(n.UploadKbps),
+	}
+}
+
+// NetworkThrottle applies Network.emulateNetworkConditions to every page
+// and iframe target, so agents can be tested on degraded networks without
+// changing their code. The default profile comes from -networkThrottle and
+// can be changed at runtime; single targets can be given their own.
+type NetworkThrottle struct {
+	pages *PageWatcher
+
+	mu       sync.Mutex
+	defaults NetworkConditions
+	// Profiles of single targets, by target ID
+	overrides map[string]NetworkConditions
+
+	applied int64
+	failed  int64
+}
+
+func NewNetworkThrottle(defaults NetworkConditions, pages *PageWatcher) *NetworkThrottle {
+	return &NetworkThrottle{pages: pages, defaults: defaults, overrides: make(map[string]NetworkConditions)}
+}
+
+func (t *NetworkThrottle) Name() string {
+	return "network-throttle"
+}
+
+func (t *NetworkThrottle) Attach(s *PageSession) error {
+	go func() {
+		<-s.Done()
+		select {
+		case <-s.Conn.Done():
+			// The watcher reconnects and attaches again
+		default:
+			t.mu.Lock()
+			delete(t.overrides, s.Target.TargetID)
+			t.mu.Unlock()
+		}
+	}()
+	return t.apply(s, t.conditionsOf(s.Target.TargetID))
+}
+
+func (t *NetworkThrottle) conditionsOf(targetID string) NetworkConditions {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if conditions, ok := t.overrides[targetID]; ok {
+		return conditions
+	}
+	return t.defaults
+}
+
+func (t *NetworkThrottle) apply(s *PageSession, conditions NetworkConditions) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := s.Call(ctx, "Network.emulateNetworkConditions", conditions.params()); err != nil {
+		atomic.AddInt64(&t.failed, 1)
+		return err
+	}
+	atomic.AddInt64(&t.applied, 1)
+	return nil
+}
+
+// SetDefault changes the profile of every target without its own,
+// including the open ones
+func (t *NetworkThrottle) SetDefault(conditions NetworkConditions) int {
+	t.mu.Lock()
+	t.defaults = conditions
+	t.mu.Unlock()
+	updated := 0
+	for _, s := range t.pages.Sessions() {
+		t.mu.Lock()
+		_, own := t.overrides[s.Target.TargetID]
+		t.mu.Unlock()
+		if own {
+			continue
+		}
+		if err := t.apply(s, conditions); err != nil {
+			log.Printf("⚠️ Failed to throttle %s: %v", s.Describe(), err)
+			continue
+		}
+		updated++
+	}
+	return updated
+}
+
+// SetTarget gives one open target its own profile, or with nil the
+// default again. Returns false when the target has no page session.
+func (t *NetworkThrottle) SetTarget(targetID string, conditions *NetworkConditions) (bool, error) {
+	var session *PageSession
+	for _, s := range t.pages.Sessions() {
+		if s.Target.TargetID == targetID {
+			session = s
+		}
+	}
+	if session == nil {
+		return false, nil
+	}
+	t.mu.Lock()
+	if conditions != nil {
+		t.overrides[targetID] = *conditions
+	} else {
+		delete(t.overrides, targetID)
+	}
+	t.mu.Unlock()
+	return true, t.apply(session, t.conditionsOf(targetID))
+}
+
+func (t *NetworkThrottle) Snapshot() (NetworkConditions, map[string]NetworkConditions) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	overrides := make(map[string]NetworkConditions, len(t.overrides))
+	for id, conditions := range t.overrides {
+		overrides[id] = conditions
+	}
+	return t.defaults, overrides
+}
+
+func (t *NetworkThrottle) Metrics() map[string]interface{} {
+	t.mu.Lock()
+	overrides := len(t.overrides)
+	t.mu.Unlock()
+	return map[string]interface{}{
+		"network_throttle_applied_total": atomic.LoadInt64(&t.applied),
+		"network_throttle_failed_total":  atomic.LoadInt64(&t.failed),
+		"network_throttle_overrides":     overrides,
+	}
+}
+
+// Handle GET /admin/throttle, returning the default profile and those of
+// single targets
+func (c *ChromeDevToolsClient) handleGetThrottle(w http.ResponseWriter, r *http.Request) {
+	if c.throttle == nil {
+		http.Error(w, "Network throttling is disabled (set -networkThrottle)", http.StatusNotFound)
+		return
+	}
+	defaults, overrides := c.throttle.Snapshot()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"default":   defaults,
+		"overrides": overrides,
+	})
+}
+
+/*
+Handle PUT /admin/throttle
+Request example:
+
+	{"preset": "slow-3g"}
+	{"latencyMs": 300, "downloadKbps": 1000, "uploadKbps": 500}
+
+Sets the profile applied to new pages and to the open pages without a
+profile of their own; {"preset": "none"} turns throttling off.
+*/
+func (c *ChromeDevToolsClient) handleSetThrottle(w http.ResponseWriter, r *http.Request) {
+	if c.throttle == nil {
+		http.Error(w, "Network throttling is disabled (set -networkThrottle)", http.StatusNotFound)
+		return
+	}
+	var conditions NetworkConditions
+	if !readJSON(w, r, &conditions) {
+		return
+	}
+	if err := conditions.resolve(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !c.allowCommands(w, r, "Network.emulateNetworkConditions") {
+		return
+	}
+	updated := c.throttle.SetDefault(conditions)
+	log.Printf("🐢 Network throttling set to %+v on %d open targets", conditions, updated)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"default": conditions,
+		"updated": updated,
+	})
+}
+
+/*
+Handle PUT /targets/{id}/throttle and DELETE /targets/{id}/throttle
+The PUT body is as for PUT /admin/throttle and applies to this page only,
+until it closes; DELETE returns the page to the default profile.
+*/
+func (c *ChromeDevToolsClient) handleSetTargetThrottle(w http.ResponseWriter, r *http.Request) {
+	if c.throttle == nil {
+		http.Error(w, "Network throttling is disabled (set -networkThrottle)", http.StatusNotFound)
+		return
+	}
+	targetID := r.PathValue("id")
+	if !c.allowCommands(w, r, "Network.emulateNetworkConditions") {
+		return
+	}
+	var conditions *NetworkConditions
+	if r.Method == http.MethodPut {
+		conditions = &NetworkConditions{}
+		if !readJSON(w, r, conditions) {
+			return
+		}
+		if err := conditions.resolve(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	found, err := c.throttle.SetTarget(targetID, conditions)
+	if !found {
+		http.Error(w, "Target not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		c.errorCount++
+		log.Printf("❌ Failed to throttle %s: %v", targetID, err)
+		http.Error(w, fmt.Sprintf("Failed to throttle: %v", err), http.StatusBadGateway)
+		return
+	}
+	applied := c.throttle.conditionsOf(targetID)
+	log.Printf("🐢 Network throttling of %s set to %+v", c.labels.Describe(targetID), applied)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"targetId":   targetID,
+		"conditions": applied,
+		"override":   conditions != nil,
+	})
+}
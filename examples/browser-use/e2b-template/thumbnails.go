@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Thumbnails kept per page; at the default interval, an hour of activity
+const maxThumbnailsPerPage = 720
+
+// Viewport assumed when Chrome does not report one
+const (
+	defaultViewportWidth  = 1280
+	defaultViewportHeight = 720
+)
+
+// SessionThumbnails captures a low-resolution screenshot of every page
+// periodically into the artifact store, a cheap scrubber view of a session
+// next to full videos. Unchanged screenshots are skipped.
+type SessionThumbnails struct {
+	clock    Clock
+	store    *ArtifactStore
+	interval time.Duration
+	width    int
+
+	captured int64
+	skipped  int64
+	failed   int64
+}
+
+func NewSessionThumbnails(clock Clock, store *ArtifactStore, interval time.Duration, width int) *SessionThumbnails {
+	return &SessionThumbnails{clock: clock, store: store, interval: interval, width: width}
+}
+
+func (t *SessionThumbnails) Name() string {
+	return "session-thumbnails"
+}
+
+func (t *SessionThumbnails) Attach(s *PageSession) error {
+	if s.Target.Type != "page" {
+		return nil
+	}
+	go t.run(s)
+	return nil
+}
+
+// Capture thumbnails until the page session detaches
+func (t *SessionThumbnails) run(s *PageSession) {
+	ticker := t.clock.NewTicker(t.interval)
+	defer ticker.Stop()
+	var previous []byte
+	for count := 0; count < maxThumbnailsPerPage; {
+		select {
+		case <-s.Done():
+			return
+		case <-ticker.C():
+		}
+		data, err := t.capture(s)
+		if err != nil {
+			atomic.AddInt64(&t.failed, 1)
+			continue
+		}
+		if bytes.Equal(data, previous) {
+			atomic.AddInt64(&t.skipped, 1)
+			continue
+		}
+		previous = data
+		count++
+		meta := map[string]string{
+			"targetId": s.Target.TargetID,
+			"seq":      strconv.Itoa(count),
+		}
+		for k, v := range s.labels.Get(s.Target.TargetID) {
+			meta["label."+k] = v
+		}
+		if _, err := t.store.Put("thumbnail", s.Target.TargetID+"-"+strconv.Itoa(count)+".jpg", data, "image/jpeg", meta); err != nil {
+			atomic.AddInt64(&t.failed, 1)
+			log.Printf("⚠️ Failed to store thumbnail of %s: %v", s.Describe(), err)
+			continue
+		}
+		atomic.AddInt64(&t.captured, 1)
+	}
+}
+
+// Screenshot the viewport scaled down to the thumbnail width
+func (t *SessionThumbnails) capture(s *PageSession) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var metrics struct {
+		CSSVisualViewport struct {
+			ClientWidth  float64 `json:"clientWidth"`
+			ClientHeight float64 `json:"clientHeight"`
+		} `json:"cssVisualViewport"`
+	}
+	s.Conn.CallResult(ctx, s.SessionID, "Page.getLayoutMetrics", nil, &metrics)
+	width, height := metrics.CSSVisualViewport.ClientWidth, metrics.CSSVisualViewport.ClientHeight
+	if width <= 0 || height <= 0 {
+		width, height = defaultViewportWidth, defaultViewportHeight
+	}
+
+	var shot struct {
+		Data string `json:"data"`
+	}
+	if err := s.Conn.CallResult(ctx, s.SessionID, "Page.captureScreenshot", map[string]interface{}{
+		"format":  "jpeg",
+		"quality": 60,
+		"clip":    map[string]interface{}{"x": 0, "y": 0, "width": width, "height": height, "scale": float64(t.width) / width},
+	}, &shot); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(shot.Data)
+}
+
+func (t *SessionThumbnails) Metrics() map[string]interface{} {
+	return map[string]interface{}{
+		"thumbnails_captured_total":  atomic.LoadInt64(&t.captured),
+		"thumbnails_unchanged_total": atomic.LoadInt64(&t.skipped),
+		"thumbnails_failed_total":    atomic.LoadInt64(&t.failed),
+	}
+}
+
+// Thumbnails of a session: a page target id, or the session ID the page
+// was leased with, oldest first
+func (c *ChromeDevToolsClient) sessionThumbnails(id string) []*Artifact {
+	return c.artifacts.Session("thumbnail", id)
+}
+
+// Handle GET /sessions/{id}/thumbnails, the JSON index of a session's
+// thumbnail strip
+func (c *ChromeDevToolsClient) handleListThumbnails(w http.ResponseWriter, r *http.Request) {
+	if c.artifacts == nil {
+		http.Error(w, "Artifact store is disabled (set -artifactDir)", http.StatusNotFound)
+		return
+	}
+	id := r.PathValue("id")
+	thumbnails := c.sessionThumbnails(id)
+	entries := make([]map[string]interface{}, 0, len(thumbnails))
+	for _, a := range thumbnails {
+		entries = append(entries, map[string]interface{}{
+			"id":         a.ID,
+			"targetId":   a.Meta["targetId"],
+			"seq":        a.Meta["seq"],
+			"size":       a.Size,
+			"capturedAt": a.CreatedAt,
+			"url":        "/sessions/" + id + "/thumbnails/" + a.ID,
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"sessionId":       id,
+		"intervalSeconds": thumbnailInterval.Seconds(),
+		"thumbnails":      entries,
+	})
+}
+
+// Handle GET /sessions/{id}/thumbnails/{thumbnail}, one thumbnail image
+func (c *ChromeDevToolsClient) handleGetThumbnail(w http.ResponseWriter, r *http.Request) {
+	if c.artifacts == nil {
+		http.Error(w, "Artifact store is disabled (set -artifactDir)", http.StatusNotFound)
+		return
+	}
+	id := r.PathValue("id")
+	body, a, err := c.artifacts.Open(r.PathValue("thumbnail"))
+	if err != nil || a.Kind != "thumbnail" || !belongsToSession(a, id) {
+		if err == nil {
+			body.Close()
+		}
+		if err == nil || os.IsNotExist(err) {
+			http.Error(w, "Thumbnail not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", a.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(a.Size, 10))
+	io.Copy(w, body)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A trace nobody stops is ended and discarded after this long
+const traceMaxDuration = 10 * time.Minute
+
+// Categories recorded when the request names none, as the DevTools
+// Performance panel records them
+var defaultTraceCategories = []string{
+	"-*",
+	"devtools.timeline",
+	"v8.execute",
+	"disabled-by-default-devtools.timeline",
+	"disabled-by-default-devtools.timeline.frame",
+	"toplevel",
+	"blink.console",
+	"blink.user_timing",
+	"latencyInfo",
+	"disabled-by-default-devtools.timeline.stack",
+	"disabled-by-default-v8.cpu_profiler",
+}
+
+// Tracer holds the page sessions of running traces between the start and
+// stop requests
+type Tracer struct {
+	mu     sync.Mutex
+	active map[string]*activeTrace
+}
+
+type activeTrace struct {
+	conn      *CDPConn
+	sessionID string
+	started   time.Time
+	expiry    ClockTimer
+}
+
+func NewTracer() *Tracer {
+	return &Tracer{active: make(map[string]*activeTrace)}
+}
+
+/*
+Handle POST /targets/{id}/trace/start
+Request example (all optional):
+
+	{"categories": ["devtools.timeline", "v8.execute"], "screenshots": true}
+
+Starts Chrome tracing with the Tracing domain on a session that stays
+attached until POST /targets/{id}/trace/stop; the default categories are
+those of the DevTools Performance panel. Chrome runs one trace at a time,
+so 409 is answered while another is recording. Traces not stopped within
+ten minutes are discarded.
+*/
+func (c *ChromeDevToolsClient) handleTraceStart(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Categories  []string `json:"categories"`
+		Screenshots bool     `json:"screenshots"`
+	}
+	if r.ContentLength != 0 && !readJSON(w, r, &req) {
+		return
+	}
+	targetID := r.PathValue("id")
+	if targetID == browserTargetID {
+		http.Error(w, "trace needs a page target", http.StatusBadRequest)
+		return
+	}
+	// Tracing.end too, so a trace that is started can be stopped
+	if !c.allowCommands(w, r, "Tracing.start", "Tracing.end") {
+		return
+	}
+	categories := req.Categories
+	if len(categories) == 0 {
+		categories = defaultTraceCategories
+	}
+	if req.Screenshots {
+		categories = append(categories[:len(categories):len(categories)], "disabled-by-default-devtools.screenshot")
+	}
+
+	t := c.tracer
+	t.mu.Lock()
+	if _, ok := t.active[targetID]; ok {
+		t.mu.Unlock()
+		http.Error(w, "A trace of this target is already recording", http.StatusConflict)
+		return
+	}
+	// Reserve the slot while attaching
+	t.active[targetID] = nil
+	t.mu.Unlock()
+	trace, err := c.startTrace(r.Context(), targetID, categories)
+	t.mu.Lock()
+	if err != nil {
+		delete(t.active, targetID)
+	} else {
+		t.active[targetID] = trace
+	}
+	t.mu.Unlock()
+
+	var cdpErr *CDPError
+	switch {
+	case err == nil:
+		log.Printf("🔬 Tracing %s (%d categories)", c.labels.Describe(targetID), len(categories))
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"targetId":   targetID,
+			"categories": categories,
+			"startedAt":  trace.started,
+		})
+	case errors.As(err, &cdpErr):
+		// Most likely a trace started elsewhere, by us or a client
+		http.Error(w, fmt.Sprintf("Failed to start tracing: %v", err), http.StatusConflict)
+	default:
+		c.errorCount++
+		log.Printf("❌ Failed to start tracing %s: %v", targetID, err)
+		http.Error(w, fmt.Sprintf("Failed to start tracing: %v", err), http.StatusBadGateway)
+	}
+}
+
+// Attach a session to the target and start tracing on it
+func (c *ChromeDevToolsClient) startTrace(ctx context.Context, targetID string, categories []string) (*activeTrace, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.client.Timeout)
+	defer cancel()
+	conn, err := c.control.Conn()
+	if err != nil {
+		return nil, err
+	}
+	var attached struct {
+		SessionID string `json:"sessionId"`
+	}
+	err = conn.CallResult(ctx, "", "Target.attachToTarget", map[string]interface{}{"targetId": targetID, "flatten": true}, &attached)
+	if err != nil {
+		return nil, err
+	}
+	trace := &activeTrace{conn: conn, sessionID: attached.SessionID, started: c.clock.Now()}
+	_, err = conn.Call(ctx, trace.sessionID, "Tracing.start", map[string]interface{}{
+		"transferMode": "ReturnAsStream",
+		"streamFormat": "json",
+		"traceConfig": map[string]interface{}{
+			"recordMode":         "recordContinuously",
+			"includedCategories": categories,
+		},
+	})
+	if err != nil {
+		trace.detach(c.client.Timeout)
+		return nil, err
+	}
+	trace.expiry = c.clock.AfterFunc(traceMaxDuration, func() {
+		c.tracer.mu.Lock()
+		current := c.tracer.active[targetID]
+		if current == trace {
+			delete(c.tracer.active, targetID)
+		}
+		c.tracer.mu.Unlock()
+		if current != trace {
+			return
+		}
+		log.Printf("⚠️ Discarding the trace of %s, not stopped within %v", c.labels.Describe(targetID), traceMaxDuration)
+		ctx, cancel := context.WithTimeout(context.Background(), c.client.Timeout)
+		defer cancel()
+		conn.Call(ctx, trace.sessionID, "Tracing.end", nil)
+		trace.detach(c.client.Timeout)
+	})
+	return trace, nil
+}
+
+func (t *activeTrace) detach(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	t.conn.Call(ctx, "", "Target.detachFromTarget", map[string]interface{}{"sessionId": t.sessionID})
+}
+
+/*
+Handle POST /targets/{id}/trace/stop
+Ends the trace started by POST /targets/{id}/trace/start and streams it as
+Chrome trace JSON ({"traceEvents": [...]}), which chrome://tracing, the
+DevTools Performance panel and Perfetto (ui.perfetto.dev) open directly.
+*/
+func (c *ChromeDevToolsClient) handleTraceStop(w http.ResponseWriter, r *http.Request) {
+	targetID := r.PathValue("id")
+	if !c.allowCommands(w, r, "Tracing.end") {
+		return
+	}
+	t := c.tracer
+	t.mu.Lock()
+	trace := t.active[targetID]
+	if trace != nil {
+		delete(t.active, targetID)
+	}
+	t.mu.Unlock()
+	if trace == nil {
+		http.Error(w, "No trace of this target is recording", http.StatusNotFound)
+		return
+	}
+	trace.expiry.Stop()
+	defer trace.detach(c.client.Timeout)
+
+	ctx, cancel := context.WithTimeout(r.Context(), c.client.Timeout)
+	defer cancel()
+	complete := make(chan string, 1)
+	unsubscribe := trace.conn.Subscribe(func(msg *CDPMessage) {
+		if msg.SessionID == trace.sessionID && msg.Method == "Tracing.tracingComplete" {
+			var ev struct {
+				Stream string `json:"stream"`
+			}
+			json.Unmarshal(msg.Params, &ev)
+			select {
+			case complete <- ev.Stream:
+			default:
+			}
+		}
+	})
+	defer unsubscribe()
+
+	started := false
+	var written int64
+	err := func() error {
+		if _, err := trace.conn.Call(ctx, trace.sessionID, "Tracing.end", nil); err != nil {
+			return err
+		}
+		var stream string
+		select {
+		case stream = <-complete:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if stream == "" {
+			return errors.New("Chrome returned no trace stream")
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"trace-%s.json\"", targetID))
+		var err error
+		written, err = c.copyIOStream(ctx, trace.conn, stream, w, "application/json", &started)
+		return err
+	}()
+	duration := c.clock.Since(trace.started).Round(time.Millisecond)
+	switch {
+	case err == nil:
+		log.Printf("🔬 Trace of %s: %v, %d bytes", c.labels.Describe(targetID), duration, written)
+	case started:
+		log.Printf("⚠️ Trace of %s cut short after %d bytes: %v", c.labels.Describe(targetID), written, err)
+	default:
+		c.errorCount++
+		w.Header().Del("Content-Disposition")
+		log.Printf("❌ Failed to stop tracing %s: %v", targetID, err)
+		http.Error(w, fmt.Sprintf("Failed to stop tracing: %v", err), http.StatusBadGateway)
+	}
+}
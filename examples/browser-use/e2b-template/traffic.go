@@ -0,0 +1,583 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Anomalies kept in memory for GET /admin/anomalies
+const anomalyHistorySize = 200
+
+// SessionStats summarizes one client WebSocket session's CDP traffic over
+// the last analysis window
+type SessionStats struct {
+	SessionID         string         `json:"sessionId"`
+	TargetID          string         `json:"targetId"`
+	RemoteAddr        string         `json:"remoteAddr"`
+	Client            *ClientInfo    `json:"client,omitempty"`
+	ConnectedAt       time.Time      `json:"connectedAt"`
+	WindowSeconds     float64        `json:"windowSeconds"`
+	Commands          int            `json:"commands"`
+	MethodsPerSec     float64        `json:"methodsPerSec"`
+	Methods           map[string]int `json:"methods"`
+	Navigations       int            `json:"navigations"`
+	NavigationsPerMin float64        `json:"navigationsPerMin"`
+	Domains           []string       `json:"domains"`
+	Flagged           int            `json:"flagged"`
+}
+
+// Anomaly is one finding of an analyzer about a session
+type Anomaly struct {
+	Time       time.Time `json:"time"`
+	Analyzer   string    `json:"analyzer"`
+	Kind       string    `json:"kind"`
+	Detail     string    `json:"detail"`
+	SessionID  string    `json:"sessionId"`
+	TargetID   string    `json:"targetId"`
+	RemoteAddr string    `json:"remoteAddr"`
+}
+
+// TrafficAnalyzer inspects per-session CDP statistics once per window.
+// Analyzers only fill in Kind and Detail; the monitor adds the rest.
+type TrafficAnalyzer interface {
+	Name() string
+	Analyze(stats *SessionStats) []Anomaly
+}
+
+// SessionSummary is the lifetime usage of one client connection
+type SessionSummary struct {
+	SessionID   string      `json:"sessionId"`
+	TaskID      string      `json:"taskId,omitempty"`
+	TargetID    string      `json:"targetId"`
+	RemoteAddr  string      `json:"remoteAddr"`
+	Client      *ClientInfo `json:"client,omitempty"`
+	ConnectedAt time.Time   `json:"connectedAt"`
+	ClosedAt    *time.Time  `json:"closedAt,omitempty"`
+	Commands    int64       `json:"commands"`
+	// Events Chrome sent the client
+	Events int64 `json:"events"`
+	// Raw WebSocket bytes from the client to Chrome and back
+	BytesSent     int64 `json:"bytesSent"`
+	BytesReceived int64 `json:"bytesReceived"`
+}
+
+// trafficSession counts one client connection's traffic for the current
+// window, and in total
+type trafficSession struct {
+	// Callers may reuse their session ID across reconnections, so the
+	// monitor tracks connections by key
+	key         string
+	id          string
+	taskID      string
+	targetID    string
+	remoteAddr  string
+	client      *ClientInfo
+	connectedAt time.Time
+
+	mu            sync.Mutex
+	commands      int
+	methods       map[string]int
+	navigations   int
+	domains       map[string]bool
+	flagged       int
+	totalCommands int64
+	events        int64
+	bytesSent     int64
+	bytesReceived int64
+
+	onCommand []func(method string, client *ClientInfo)
+	// Closes the connection to Chrome, ending the client's session
+	close func() error
+}
+
+// Record a command sent by the client
+func (s *trafficSession) observeCommand(payload []byte) {
+	var msg struct {
+		Method string `json:"method"`
+		Params struct {
+			URL string `json:"url"`
+		} `json:"params"`
+	}
+	if json.Unmarshal(payload, &msg) != nil || msg.Method == "" {
+		return
+	}
+	for _, fn := range s.onCommand {
+		fn(msg.Method, s.client)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commands++
+	s.totalCommands++
+	s.methods[msg.Method]++
+	switch msg.Method {
+	case "Page.navigate":
+		s.navigations++
+		s.addDomain(msg.Params.URL)
+	case "Target.createTarget":
+		s.addDomain(msg.Params.URL)
+	}
+}
+
+// Count a message from Chrome that is an event rather than a response
+// (Chrome writes "id" first in responses), and record hosts of requests
+// reported to the client, when it enabled Network
+func (s *trafficSession) observeEvent(payload []byte) {
+	if !bytes.HasPrefix(payload, []byte(`{"id":`)) {
+		s.mu.Lock()
+		s.events++
+		s.mu.Unlock()
+	}
+	if !bytes.Contains(payload, []byte(`"Network.requestWillBeSent"`)) {
+		return
+	}
+	var msg struct {
+		Method string `json:"method"`
+		Params struct {
+			Request struct {
+				URL string `json:"url"`
+			} `json:"request"`
+		} `json:"params"`
+	}
+	if json.Unmarshal(payload, &msg) != nil || msg.Method != "Network.requestWillBeSent" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.addDomain(msg.Params.Request.URL)
+}
+
+// Caller must hold s.mu
+func (s *trafficSession) addDomain(rawURL string) {
+	if u, err := url.Parse(rawURL); err == nil && u.Hostname() != "" {
+		s.domains[u.Hostname()] = true
+	}
+}
+
+// Take the window's statistics and start a new window
+func (s *trafficSession) roll(window time.Duration) *SessionStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := &SessionStats{
+		SessionID:         s.id,
+		TargetID:          s.targetID,
+		RemoteAddr:        s.remoteAddr,
+		Client:            s.client,
+		ConnectedAt:       s.connectedAt,
+		WindowSeconds:     window.Seconds(),
+		Commands:          s.commands,
+		MethodsPerSec:     float64(s.commands) / window.Seconds(),
+		Methods:           s.methods,
+		Navigations:       s.navigations,
+		NavigationsPerMin: float64(s.navigations) / window.Minutes(),
+		Domains:           make([]string, 0, len(s.domains)),
+		Flagged:           s.flagged,
+	}
+	for domain := range s.domains {
+		stats.Domains = append(stats.Domains, domain)
+	}
+	sort.Strings(stats.Domains)
+	s.commands, s.navigations = 0, 0
+	s.methods = make(map[string]int)
+	s.domains = make(map[string]bool)
+	return stats
+}
+
+func (s *trafficSession) countBytes(sent, received int) {
+	s.mu.Lock()
+	s.bytesSent += int64(sent)
+	s.bytesReceived += int64(received)
+	s.mu.Unlock()
+}
+
+func (s *trafficSession) summary() *SessionSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &SessionSummary{
+		SessionID:     s.id,
+		TaskID:        s.taskID,
+		TargetID:      s.targetID,
+		RemoteAddr:    s.remoteAddr,
+		Client:        s.client,
+		ConnectedAt:   s.connectedAt,
+		Commands:      s.totalCommands,
+		Events:        s.events,
+		BytesSent:     s.bytesSent,
+		BytesReceived: s.bytesReceived,
+	}
+}
+
+// TrafficMonitor taps client WebSocket connections proxied to Chrome,
+// keeps per-session CDP statistics and feeds them to the registered
+// analyzers once per window
+type TrafficMonitor struct {
+	clock     Clock
+	window    time.Duration
+	analyzers []TrafficAnalyzer
+
+	mu          sync.Mutex
+	sessions    map[string]*trafficSession
+	last        map[string]*SessionStats
+	history     []Anomaly
+	byKind      map[string]int64
+	total       int64
+	subscribers map[chan Anomaly]struct{}
+	onClose     []func(*SessionSummary)
+	// Tap every connection for the onClose callbacks
+	track     bool
+	onCommand []func(method string, client *ClientInfo)
+}
+
+func NewTrafficMonitor(clock Clock, window time.Duration) *TrafficMonitor {
+	return &TrafficMonitor{
+		clock:       clock,
+		window:      window,
+		sessions:    make(map[string]*trafficSession),
+		last:        make(map[string]*SessionStats),
+		byKind:      make(map[string]int64),
+		subscribers: make(map[chan Anomaly]struct{}),
+	}
+}
+
+func (m *TrafficMonitor) Register(a TrafficAnalyzer) {
+	m.analyzers = append(m.analyzers, a)
+}
+
+// OnClose registers fn to receive the summary of each closed connection
+func (m *TrafficMonitor) OnClose(fn func(*SessionSummary)) {
+	m.onClose = append(m.onClose, fn)
+}
+
+// Track makes Tap count every connection even without analyzers, for
+// OnClose callbacks that must see all of them
+func (m *TrafficMonitor) Track() {
+	m.track = true
+}
+
+// OnCommand registers fn to see the method of every command a tapped
+// client sends
+func (m *TrafficMonitor) OnCommand(fn func(method string, client *ClientInfo)) {
+	m.onCommand = append(m.onCommand, fn)
+}
+
+func (m *TrafficMonitor) Enabled() bool {
+	return m.window > 0 && len(m.analyzers) > 0
+}
+
+// Start analyzing sessions every window
+func (m *TrafficMonitor) Start() {
+	if !m.Enabled() {
+		return
+	}
+	for _, a := range m.analyzers {
+		log.Printf("🕵️ Traffic analyzer enabled: %s (window %v)", a.Name(), m.window)
+	}
+	go func() {
+		ticker := m.clock.NewTicker(m.window)
+		for range ticker.C() {
+			m.analyze()
+		}
+	}()
+}
+
+func (m *TrafficMonitor) analyze() {
+	m.mu.Lock()
+	sessions := make([]*trafficSession, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		sessions = append(sessions, s)
+	}
+	m.mu.Unlock()
+
+	last := make(map[string]*SessionStats, len(sessions))
+	for _, s := range sessions {
+		stats := s.roll(m.window)
+		for _, a := range m.analyzers {
+			for _, anomaly := range a.Analyze(stats) {
+				anomaly.Time = m.clock.Now()
+				anomaly.Analyzer = a.Name()
+				anomaly.SessionID, anomaly.TargetID, anomaly.RemoteAddr = s.id, s.targetID, s.remoteAddr
+				m.record(anomaly)
+				s.mu.Lock()
+				s.flagged++
+				stats.Flagged = s.flagged
+				s.mu.Unlock()
+			}
+		}
+		last[s.key] = stats
+	}
+	m.mu.Lock()
+	m.last = last
+	m.mu.Unlock()
+}
+
+func (m *TrafficMonitor) record(a Anomaly) {
+	log.Printf("🚨 Anomaly in session %s (target %s, from %s): %s %s", a.SessionID, a.TargetID, a.RemoteAddr, a.Kind, a.Detail)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.total++
+	m.byKind[a.Kind]++
+	m.history = append(m.history, a)
+	if len(m.history) > anomalyHistorySize {
+		m.history = m.history[len(m.history)-anomalyHistorySize:]
+	}
+	for ch := range m.subscribers {
+		select {
+		case ch <- a:
+		default:
+		}
+	}
+}
+
+// Subscribe delivers new anomalies on the returned channel until cancelled
+func (m *TrafficMonitor) Subscribe() (<-chan Anomaly, func()) {
+	ch := make(chan Anomaly, 16)
+	m.mu.Lock()
+	m.subscribers[ch] = struct{}{}
+	m.mu.Unlock()
+	return ch, func() {
+		m.mu.Lock()
+		delete(m.subscribers, ch)
+		m.mu.Unlock()
+	}
+}
+
+// Snapshot returns the last window's statistics of live sessions and the
+// recent anomalies
+func (m *TrafficMonitor) Snapshot() ([]*SessionStats, []Anomaly) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sessions := make([]*SessionStats, 0, len(m.last))
+	for key, stats := range m.last {
+		if m.sessions[key] != nil {
+			sessions = append(sessions, stats)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ConnectedAt.Before(sessions[j].ConnectedAt) })
+	return sessions, append([]Anomaly(nil), m.history...)
+}
+
+// OpenSessions returns the usage so far of the task's open connections
+func (m *TrafficMonitor) OpenSessions(taskID string) []*SessionSummary {
+	return m.summaries(func(s *trafficSession) bool { return s.taskID == taskID })
+}
+
+// Sessions returns the usage so far of every tapped open connection
+func (m *TrafficMonitor) Sessions() []*SessionSummary {
+	return m.summaries(func(*trafficSession) bool { return true })
+}
+
+// CloseSessions ends the open connections match selects, returning their
+// usage up to then; with dryRun it only lists them
+func (m *TrafficMonitor) CloseSessions(match func(*SessionSummary) bool, dryRun bool) []*SessionSummary {
+	m.mu.Lock()
+	open := make([]*trafficSession, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		open = append(open, s)
+	}
+	m.mu.Unlock()
+
+	closed := []*SessionSummary{}
+	for _, s := range open {
+		summary := s.summary()
+		if !match(summary) {
+			continue
+		}
+		if !dryRun {
+			s.close()
+		}
+		closed = append(closed, summary)
+	}
+	sort.Slice(closed, func(i, j int) bool { return closed[i].ConnectedAt.Before(closed[j].ConnectedAt) })
+	return closed
+}
+
+func (m *TrafficMonitor) summaries(match func(*trafficSession) bool) []*SessionSummary {
+	m.mu.Lock()
+	var open []*trafficSession
+	for _, s := range m.sessions {
+		if match(s) {
+			open = append(open, s)
+		}
+	}
+	m.mu.Unlock()
+
+	summaries := make([]*SessionSummary, 0, len(open))
+	for _, s := range open {
+		summaries = append(summaries, s.summary())
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].ConnectedAt.Before(summaries[j].ConnectedAt) })
+	return summaries
+}
+
+func (m *TrafficMonitor) Metrics() map[string]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	byKind := make(map[string]int64, len(m.byKind))
+	for k, v := range m.byKind {
+		byKind[k] = v
+	}
+	return map[string]interface{}{
+		"cdp_sessions_monitored": len(m.sessions),
+		"cdp_anomalies_total":    m.total,
+		"cdp_anomalies_by_kind":  byKind,
+	}
+}
+
+// Tap wraps the upstream side of an upgraded WebSocket connection so both
+// directions are parsed as they are copied. Returns body unchanged when
+// monitoring, the relay-inspection feature and deprecation telemetry are
+// all off.
+func (m *TrafficMonitor) Tap(r *http.Request, body io.ReadWriteCloser) io.ReadWriteCloser {
+	taskID := r.Header.Get(taskHeader)
+	if !m.Enabled() && !m.track && !featureEnabled("relay-inspection") && !featureEnabled("deprecation-telemetry") {
+		return body
+	}
+	targetID := devtoolsTargetID(r.URL.Path)
+	if targetID == "" {
+		targetID = "browser"
+	}
+	sessionID := r.Header.Get(sessionHeader)
+	if sessionID == "" {
+		sessionID = newID()
+	}
+	s := &trafficSession{
+		key:         newToken(),
+		id:          sessionID,
+		taskID:      taskID,
+		targetID:    targetID,
+		remoteAddr:  r.RemoteAddr,
+		client:      classifyClient(r),
+		connectedAt: m.clock.Now(),
+		methods:     make(map[string]int),
+		domains:     make(map[string]bool),
+	}
+	if featureEnabled("deprecation-telemetry") {
+		s.onCommand = m.onCommand
+	}
+	m.mu.Lock()
+	m.sessions[s.key] = s
+	m.mu.Unlock()
+
+	t := &tappedConn{ReadWriteCloser: body, session: s, toChrome: parseWebSocketStream(s.observeCommand, nil), fromChrome: parseWebSocketStream(s.observeEvent, nil)}
+	s.close = t.Close
+	t.onClose = func() {
+		m.mu.Lock()
+		delete(m.sessions, s.key)
+		m.mu.Unlock()
+		summary := s.summary()
+		closedAt := m.clock.Now()
+		summary.ClosedAt = &closedAt
+		for _, fn := range m.onClose {
+			fn(summary)
+		}
+	}
+	return t
+}
+
+// tappedConn copies everything read from and written to Chrome into the
+// frame parsers. A parser that fails (e.g. on a compressed stream) closes
+// its pipe and further copies to it are dropped.
+type tappedConn struct {
+	io.ReadWriteCloser
+	session    *trafficSession
+	toChrome   *io.PipeWriter
+	fromChrome *io.PipeWriter
+	onClose    func()
+	closeOnce  sync.Once
+}
+
+func (t *tappedConn) Read(p []byte) (int, error) {
+	n, err := t.ReadWriteCloser.Read(p)
+	if n > 0 {
+		t.session.countBytes(0, n)
+		t.fromChrome.Write(p[:n])
+	}
+	return n, err
+}
+
+func (t *tappedConn) Write(p []byte) (int, error) {
+	n, err := t.ReadWriteCloser.Write(p)
+	if n > 0 {
+		t.session.countBytes(n, 0)
+		t.toChrome.Write(p[:n])
+	}
+	return n, err
+}
+
+func (t *tappedConn) Close() error {
+	t.closeOnce.Do(func() {
+		t.toChrome.Close()
+		t.fromChrome.Close()
+		t.onClose()
+	})
+	return t.ReadWriteCloser.Close()
+}
+
+// Parse a raw WebSocket byte stream, passing each complete data message to
+// fn. done, when set, runs once the stream has ended and fn is done.
+func parseWebSocketStream(fn func([]byte), done func()) *io.PipeWriter {
+	pr, pw := io.Pipe()
+	go func() {
+		if done != nil {
+			defer done()
+		}
+		ws := &WebSocketConn{br: bufio.NewReader(pr)}
+		var message []byte
+		for {
+			fin, opcode, data, err := ws.readFrame()
+			if err != nil {
+				pr.CloseWithError(err)
+				return
+			}
+			switch opcode {
+			case wsOpText, wsOpBinary:
+				message = data
+			case wsOpContinuation:
+				message = append(message, data...)
+			default:
+				// Control frames may arrive between fragments
+				continue
+			}
+			if fin {
+				fn(message)
+				message = nil
+			}
+		}
+	}()
+	return pw
+}
+
+/*
+Handle GET /sessions
+
+Returns the usage so far of every open client WebSocket session: client
+address and SDK, target, connect time, commands sent, events received and
+bytes each way. ?sort=commands or ?sort=bytes lists the busiest first
+instead of the oldest.
+*/
+func (c *ChromeDevToolsClient) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	sessions := c.traffic.Sessions()
+	switch r.URL.Query().Get("sort") {
+	case "", "connected":
+	case "commands":
+		sort.SliceStable(sessions, func(i, j int) bool { return sessions[i].Commands > sessions[j].Commands })
+	case "bytes":
+		sort.SliceStable(sessions, func(i, j int) bool {
+			return sessions[i].BytesSent+sessions[i].BytesReceived > sessions[j].BytesSent+sessions[j].BytesReceived
+		})
+	default:
+		http.Error(w, "sort must be connected, commands or bytes", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"sessions":   sessions,
+		"inspecting": featureEnabled("relay-inspection"),
+	})
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+func init() {
+	registerFeature("cdp-transcoding", "Transcode CDP JSON to MessagePack or CBOR for clients that request the cdp.msgpack or cdp.cbor WebSocket subprotocol", true)
+}
+
+// Subprotocols a client requests to receive CDP messages as binary frames
+const (
+	subprotocolMsgpack = "cdp.msgpack"
+	subprotocolCBOR    = "cdp.cbor"
+)
+
+// Binary encodings nest no deeper than this; CDP messages are shallow
+const maxTranscodeDepth = 256
+
+// cdpCodec converts CDP messages between Chrome's JSON and the binary
+// encoding a client negotiated: text messages written to the client are
+// encoded, binary messages read from it are decoded back to JSON
+type cdpCodec struct {
+	name   string
+	encode func(buf *bytes.Buffer, v interface{})
+	decode func(d *binaryDecoder, depth int) (interface{}, error)
+}
+
+var cdpCodecs = map[string]*cdpCodec{
+	subprotocolMsgpack: {name: subprotocolMsgpack, encode: encodeMsgpack, decode: decodeMsgpack},
+	subprotocolCBOR:    {name: subprotocolCBOR, encode: encodeCBOR, decode: decodeCBOR},
+}
+
+// Pick the first subprotocol the proxy implements itself (transcoding or
+// delta encoding) the client requested, removing all of them from the
+// request that goes on to Chrome
+func negotiateSubprotocol(r, out *http.Request) string {
+	chosen, rest := proxySubprotocolOf(r)
+	if chosen == "" {
+		return ""
+	}
+	out.Header.Del("Sec-WebSocket-Protocol")
+	if len(rest) > 0 {
+		out.Header.Set("Sec-WebSocket-Protocol", strings.Join(rest, ", "))
+	}
+	return chosen
+}
+
+// The first subprotocol of r the proxy implements itself, and the others
+// r requested
+func proxySubprotocolOf(r *http.Request) (chosen string, rest []string) {
+	for _, value := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(value, ",") {
+			protocol = strings.TrimSpace(protocol)
+			if proxySubprotocol(protocol) {
+				if chosen == "" {
+					chosen = protocol
+				}
+				continue
+			}
+			if protocol != "" {
+				rest = append(rest, protocol)
+			}
+		}
+	}
+	return chosen, rest
+}
+
+func proxySubprotocol(protocol string) bool {
+	if _, ok := cdpCodecs[protocol]; ok {
+		return featureEnabled("cdp-transcoding")
+	}
+	return protocol == subprotocolDelta && featureEnabled("cdp-delta")
+}
+
+// Encode a JSON message for the client
+func (c *cdpCodec) fromJSON(payload []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	c.encode(&buf, v)
+	return buf.Bytes(), nil
+}
+
+// Decode a client's binary message to JSON
+func (c *cdpCodec) toJSON(payload []byte) ([]byte, error) {
+	d := &binaryDecoder{data: payload}
+	v, err := c.decode(d, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", c.name, err)
+	}
+	if d.pos != len(d.data) {
+		return nil, fmt.Errorf("%s: %d trailing bytes", c.name, len(d.data)-d.pos)
+	}
+	return json.Marshal(v)
+}
+
+// Integer value of a JSON number, when it has one
+func jsonInteger(n json.Number) (int64, bool) {
+	if strings.ContainsAny(string(n), ".eE") {
+		return 0, false
+	}
+	i, err := n.Int64()
+	return i, err == nil
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func encodeMsgpack(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		i, ok := jsonInteger(v)
+		switch {
+		case !ok:
+			f, _ := v.Float64()
+			buf.WriteByte(0xcb)
+			binary.Write(buf, binary.BigEndian, f)
+		case i >= 0 && i < 128:
+			buf.WriteByte(byte(i))
+		case i < 0 && i >= -32:
+			buf.WriteByte(byte(int8(i)))
+		case i >= 0:
+			buf.WriteByte(0xcf)
+			binary.Write(buf, binary.BigEndian, uint64(i))
+		default:
+			buf.WriteByte(0xd3)
+			binary.Write(buf, binary.BigEndian, i)
+		}
+	case string:
+		writeMsgpackLength(buf, len(v), 0xa0, 32, 0xd9, 0xda, 0xdb)
+		buf.WriteString(v)
+	case []interface{}:
+		writeMsgpackLength(buf, len(v), 0x90, 16, 0, 0xdc, 0xdd)
+		for _, item := range v {
+			encodeMsgpack(buf, item)
+		}
+	case map[string]interface{}:
+		writeMsgpackLength(buf, len(v), 0x80, 16, 0, 0xde, 0xdf)
+		for _, k := range sortedKeys(v) {
+			encodeMsgpack(buf, k)
+			encodeMsgpack(buf, v[k])
+		}
+	}
+}
+
+// Write a length header: a fix type below fixLimit, else the 8-bit (when
+// the type has one), 16-bit or 32-bit form
+func writeMsgpackLength(buf *bytes.Buffer, n int, fix byte, fixLimit int, tag8, tag16, tag32 byte) {
+	switch {
+	case n < fixLimit:
+		buf.WriteByte(fix | byte(n))
+	case tag8 != 0 && n <= math.MaxUint8:
+		buf.WriteByte(tag8)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(tag16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(tag32)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+func encodeCBOR(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xf6)
+	case bool:
+		if v {
+			buf.WriteByte(0xf5)
+		} else {
+			buf.WriteByte(0xf4)
+		}
+	case json.Number:
+		i, ok := jsonInteger(v)
+		switch {
+		case !ok:
+			f, _ := v.Float64()
+			buf.WriteByte(0xfb)
+			binary.Write(buf, binary.BigEndian, f)
+		case i >= 0:
+			writeCBORHead(buf, 0, uint64(i))
+		default:
+			writeCBORHead(buf, 1, uint64(-1-i))
+		}
+	case string:
+		writeCBORHead(buf, 3, uint64(len(v)))
+		buf.WriteString(v)
+	case []interface{}:
+		writeCBORHead(buf, 4, uint64(len(v)))
+		for _, item := range v {
+			encodeCBOR(buf, item)
+		}
+	case map[string]interface{}:
+		writeCBORHead(buf, 5, uint64(len(v)))
+		for _, k := range sortedKeys(v) {
+			encodeCBOR(buf, k)
+			encodeCBOR(buf, v[k])
+		}
+	}
+}
+
+func writeCBORHead(buf *bytes.Buffer, major byte, n uint64) {
+	major <<= 5
+	switch {
+	case n < 24:
+		buf.WriteByte(major | byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(major | 24)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(major | 25)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		buf.WriteByte(major | 26)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	default:
+		buf.WriteByte(major | 27)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+var errTruncated = errors.New("truncated message")
+
+// binaryDecoder reads a binary-encoded message
+type binaryDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *binaryDecoder) next(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return nil, errTruncated
+	}
+	b := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b, nil
+}
+
+func (d *binaryDecoder) byte() (byte, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// Read a big-endian unsigned integer of size bytes
+func (d *binaryDecoder) uint(size int) (uint64, error) {
+	b, err := d.next(uint64(size))
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n, nil
+}
+
+// Decode a collection of n items, refusing counts the data cannot hold
+func decodeItems(d *binaryDecoder, n uint64, depth int, decode func(*binaryDecoder, int) (interface{}, error)) ([]interface{}, error) {
+	if depth >= maxTranscodeDepth {
+		return nil, errors.New("nesting too deep")
+	}
+	if n > uint64(len(d.data)-d.pos) {
+		return nil, errTruncated
+	}
+	items := make([]interface{}, 0, n)
+	for ; n > 0; n-- {
+		item, err := decode(d, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// Pair decoded keys and values into an object; keys must be strings
+func itemsToMap(items []interface{}) (map[string]interface{}, error) {
+	m := make(map[string]interface{}, len(items)/2)
+	for i := 0; i+1 < len(items); i += 2 {
+		key, ok := items[i].(string)
+		if !ok {
+			return nil, fmt.Errorf("map key of type %T", items[i])
+		}
+		m[key] = items[i+1]
+	}
+	return m, nil
+}
+
+func decodeMsgpack(d *binaryDecoder, depth int) (interface{}, error) {
+	tag, err := d.byte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case tag <= 0x7f:
+		return int64(tag), nil
+	case tag >= 0xe0:
+		return int64(int8(tag)), nil
+	case tag&0xe0 == 0xa0:
+		b, err := d.next(uint64(tag & 0x1f))
+		return string(b), err
+	case tag&0xf0 == 0x90:
+		return decodeItems(d, uint64(tag&0x0f), depth, decodeMsgpack)
+	case tag&0xf0 == 0x80:
+		items, err := decodeItems(d, 2*uint64(tag&0x0f), depth, decodeMsgpack)
+		if err != nil {
+			return nil, err
+		}
+		return itemsToMap(items)
+	}
+	switch tag {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6, 0xd9, 0xda, 0xdb:
+		size := map[byte]int{0xc4: 1, 0xc5: 2, 0xc6: 4, 0xd9: 1, 0xda: 2, 0xdb: 4}[tag]
+		n, err := d.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		b, err := d.next(n)
+		return string(b), err
+	case 0xca:
+		n, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(n))), err
+	case 0xcb:
+		n, err := d.uint(8)
+		return math.Float64frombits(n), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		n, err := d.uint(1 << (tag - 0xcc))
+		if n > math.MaxInt64 {
+			return float64(n), err
+		}
+		return int64(n), err
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (tag - 0xd0)
+		n, err := d.uint(size)
+		// Sign-extend from size bytes
+		shift := 64 - 8*size
+		return int64(n<<shift) >> shift, err
+	case 0xdc, 0xdd, 0xde, 0xdf:
+		n, err := d.uint(2 << ((tag - 0xdc) % 2))
+		if err != nil {
+			return nil, err
+		}
+		if tag >= 0xde {
+			items, err := decodeItems(d, 2*n, depth, decodeMsgpack)
+			if err != nil {
+				return nil, err
+			}
+			return itemsToMap(items)
+		}
+		return decodeItems(d, n, depth, decodeMsgpack)
+	}
+	return nil, fmt.Errorf("unsupported type 0x%02x", tag)
+}
+
+func decodeCBOR(d *binaryDecoder, depth int) (interface{}, error) {
+	head, err := d.byte()
+	if err != nil {
+		return nil, err
+	}
+	major, info := head>>5, head&0x1f
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		case 22, 23:
+			return nil, nil
+		case 25:
+			n, err := d.uint(2)
+			return float16ToFloat64(uint16(n)), err
+		case 26:
+			n, err := d.uint(4)
+			return float64(math.Float32frombits(uint32(n))), err
+		case 27:
+			n, err := d.uint(8)
+			return math.Float64frombits(n), err
+		}
+		return nil, fmt.Errorf("unsupported simple value %d", info)
+	}
+
+	var n uint64
+	switch {
+	case info < 24:
+		n = uint64(info)
+	case info <= 27:
+		if n, err = d.uint(1 << (info - 24)); err != nil {
+			return nil, err
+		}
+	default:
+		// Indefinite lengths are not produced by CDP clients' encoders
+		return nil, fmt.Errorf("unsupported length encoding %d", info)
+	}
+	switch major {
+	case 0:
+		if n > math.MaxInt64 {
+			return float64(n), nil
+		}
+		return int64(n), nil
+	case 1:
+		if n > math.MaxInt64 {
+			return -1 - float64(n), nil
+		}
+		return -1 - int64(n), nil
+	case 2, 3:
+		b, err := d.next(n)
+		return string(b), err
+	case 4:
+		return decodeItems(d, n, depth, decodeCBOR)
+	case 5:
+		if n > math.MaxInt64/2 {
+			return nil, errTruncated
+		}
+		items, err := decodeItems(d, 2*n, depth, decodeCBOR)
+		if err != nil {
+			return nil, err
+		}
+		return itemsToMap(items)
+	default:
+		// A tag: decode the value it annotates
+		if depth >= maxTranscodeDepth {
+			return nil, errors.New("nesting too deep")
+		}
+		return decodeCBOR(d, depth+1)
+	}
+}
+
+func float16ToFloat64(h uint16) float64 {
+	sign := 1.0
+	if h&0x8000 != 0 {
+		sign = -1
+	}
+	exp, frac := int(h>>10&0x1f), float64(h&0x3ff)
+	switch exp {
+	case 0:
+		return sign * math.Ldexp(frac, -24)
+	case 31:
+		if frac == 0 {
+			return sign * math.Inf(1)
+		}
+		return math.NaN()
+	}
+	return sign * math.Ldexp(frac+1024, exp-25)
+}
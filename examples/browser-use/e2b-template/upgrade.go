@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+/*
+In-place upgrades: on SIGUSR2 or POST /admin/upgrade the proxy starts
+-upgradeBinary with its own flags and hands it the listening socket as an
+inherited file descriptor. Once the new process serves (it reports ready
+through a pipe), this one stops accepting connections, leaves its -stateFile,
+-storeFile and -outboxFile to the new process and exits after its open
+WebSocket sessions have closed, at most -upgradeDrain later. Clients never
+see the port closed.
+
+Open sessions are drained rather than handed over: a CDP relay holds more
+than its sockets (compression contexts, multiplexed command IDs, attached
+sessions, interceptors), which a new binary cannot take over mid-stream.
+*/
+const (
+	// Environment variables naming the descriptors a new binary inherits
+	listenFDEnv       = "PPIO_LISTEN_FD"
+	upgradeReadyFDEnv = "PPIO_UPGRADE_READY_FD"
+	// How long the new binary may take to serve
+	upgradeReadyTimeout = time.Minute
+	// Outbox event IDs kept for the events of the sessions draining here
+	outboxHandoffIDs = 1 << 20
+)
+
+var errUpgradeRunning = errors.New("an upgrade is already running")
+
+// Default -upgradeBinary: the path this binary was started from, resolved
+// now since a binary replaced in place leaves os.Executable pointing at the
+// deleted one
+func defaultUpgradeBinary() string {
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return os.Args[0]
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// Listen on addr, or take over the socket of the proxy this one replaces
+func listen(addr string) (net.Listener, error) {
+	fd := os.Getenv(listenFDEnv)
+	if fd == "" {
+		return net.Listen("tcp", addr)
+	}
+	// Not for the binary that replaces this one in turn
+	os.Unsetenv(listenFDEnv)
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", listenFDEnv, err)
+	}
+	f := os.NewFile(uintptr(n), "listener")
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("🔁 Took over listening socket %s from the previous proxy", ln.Addr())
+	return ln, nil
+}
+
+// Tell the proxy this one replaces that it serves now
+func notifyUpgradeReady() {
+	fd := os.Getenv(upgradeReadyFDEnv)
+	if fd == "" {
+		return
+	}
+	os.Unsetenv(upgradeReadyFDEnv)
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(n), "upgrade-ready")
+	f.Write([]byte("ready\n"))
+	f.Close()
+}
+
+// Upgrade on SIGUSR2
+func (c *ChromeDevToolsClient) watchUpgradeSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+	go func() {
+		for range signals {
+			if _, err := c.upgrade(); err != nil {
+				log.Printf("❌ Upgrade failed: %v", err)
+			}
+		}
+	}()
+}
+
+// Start -upgradeBinary on the listening socket and, once it serves, drain
+// this process in the background. Returns the new process's PID.
+func (c *ChromeDevToolsClient) upgrade() (int, error) {
+	if chromeBinary != "" || chromeChannels != "" {
+		return 0, errors.New("the proxy owns its browsers (-chromeBinary, -chromeChannels), which a new process cannot take over")
+	}
+	tcp, ok := c.listener.(*net.TCPListener)
+	if !ok || c.server == nil {
+		return 0, errors.New("not serving on a TCP socket")
+	}
+	if !atomic.CompareAndSwapInt32(&c.upgrading, 0, 1) {
+		return 0, errUpgradeRunning
+	}
+	handedOver := false
+	defer func() {
+		if !handedOver {
+			atomic.StoreInt32(&c.upgrading, 0)
+		}
+	}()
+
+	listenFile, err := tcp.File()
+	if err != nil {
+		return 0, err
+	}
+	defer listenFile.Close()
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer readyR.Close()
+
+	// The new process restores leases from the state file and numbers its
+	// events after ours
+	if c.state != nil {
+		c.saveState()
+	}
+	if c.outbox != nil {
+		if err := c.outbox.ReserveIDs(outboxHandoffIDs); err != nil {
+			readyW.Close()
+			return 0, err
+		}
+	}
+
+	cmd := exec.Command(upgradeBinary, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	// ExtraFiles start at descriptor 3
+	cmd.ExtraFiles = []*os.File{listenFile, readyW}
+	cmd.Env = append(os.Environ(), listenFDEnv+"=3", upgradeReadyFDEnv+"=4")
+	log.Printf("🔁 Upgrading: starting %s", upgradeBinary)
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return 0, err
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	ready := make(chan bool, 1)
+	go func() {
+		line, _ := bufio.NewReader(readyR).ReadString('\n')
+		ready <- line == "ready\n"
+	}()
+
+	select {
+	case ok := <-ready:
+		if !ok {
+			// The pipe closed without a word: the new process exited
+			return 0, fmt.Errorf("%s exited before serving: %v", upgradeBinary, <-exited)
+		}
+	case <-c.clock.After(upgradeReadyTimeout):
+		cmd.Process.Kill()
+		return 0, fmt.Errorf("%s did not serve within %v", upgradeBinary, upgradeReadyTimeout)
+	}
+	handedOver = true
+	go c.drain(cmd.Process.Pid)
+	return cmd.Process.Pid, nil
+}
+
+// Leave new connections and the persistent files to the new process, wait
+// for the sessions open here to close and the events they produced to be
+// delivered, then let main return
+func (c *ChromeDevToolsClient) drain(pid int) {
+	defer close(c.drained)
+	log.Printf("🔁 Process %d serves now; draining %d WebSocket sessions", pid, atomic.LoadInt64(&c.openWebSockets))
+	if c.state != nil {
+		c.state.Handoff()
+	}
+	if c.store != nil {
+		c.store.Handoff()
+	}
+	if c.outbox != nil {
+		c.outbox.Handoff()
+	}
+	c.pages.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), upgradeDrain)
+	defer cancel()
+	// The listening socket stays open in the new process
+	c.server.Shutdown(ctx)
+	ticker := c.clock.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		sessions, pending := atomic.LoadInt64(&c.openWebSockets), c.outbox.Pending()
+		if sessions == 0 && pending == 0 {
+			log.Printf("🔁 Drained, handing over to process %d", pid)
+			return
+		}
+		select {
+		case <-ticker.C():
+		case <-ctx.Done():
+			log.Printf("⚠️ Drain timed out after %v with %d WebSocket sessions and %d undelivered events", upgradeDrain, sessions, pending)
+			return
+		}
+	}
+}
+
+// Block while an upgrade drains this process
+func (c *ChromeDevToolsClient) waitDrained() {
+	if atomic.LoadInt32(&c.upgrading) == 1 {
+		<-c.drained
+	}
+}
+
+/*
+Handle POST /admin/upgrade
+Upgrades in place as on SIGUSR2: starts -upgradeBinary on the listening
+socket and answers {"pid": <new process>} once it serves, after which this
+process drains. Answers 409 while an upgrade runs and 502 when the new
+binary fails to start, leaving this process serving.
+*/
+func (c *ChromeDevToolsClient) handleUpgrade(w http.ResponseWriter, r *http.Request) {
+	pid, err := c.upgrade()
+	if errors.Is(err, errUpgradeRunning) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		c.errorCount++
+		log.Printf("❌ Upgrade failed: %v", err)
+		http.Error(w, fmt.Sprintf("Upgrade failed: %v", err), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"pid": pid, "binary": upgradeBinary})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ArtifactUpload copies what a sandbox leaves behind to a remote store
+// (-uploadURL) when the proxy is torn down: the artifact store (videos,
+// thumbnails, captures, as stored and so still encrypted when they are at
+// rest), CDP recordings, the snapshot, task usage and a teardown bundle
+// with the reason, metrics and the proxy log. Each file is sent as
+// PUT <uploadURL>/<sandbox id>/<key>, which suits presigned prefixes,
+// WebDAV and S3-compatible gateways alike.
+//
+// Uploads go through a queue on disk (-uploadQueue) and are retried with
+// backoff, so that a flaky egress does not lose recordings: what is left
+// at exit is resumed by the next start. Objects over -uploadPartSize are
+// sent in parts with Content-Range, resuming where the store left off
+// (308 Resume Incomplete), and every request carries the object's SHA-256
+// as Repr-Digest. With -uploadCodec, recordings, the snapshot and the log
+// are compressed into the queue and uploaded under the codec's extension.
+type ArtifactUpload struct {
+	clock    Clock
+	base     string
+	token    string
+	deadline time.Duration
+	client   *http.Client
+	dir      string
+	partSize int64
+	attempts int
+	codec    *Codec
+	level    int
+
+	mu       sync.Mutex
+	queue    map[string]*queuedUpload
+	draining bool
+	wake     chan struct{}
+
+	uploaded int64
+	failed   int64
+	retries  int64
+	bytes    int64
+}
+
+func NewArtifactUpload(clock Clock, base, token string, deadline time.Duration, dir string, partSize int64, attempts int, codec *Codec, level int) (*ArtifactUpload, error) {
+	u, err := url.Parse(base)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid upload URL %q", base)
+	}
+	if sandboxID == "" {
+		return nil, fmt.Errorf("no sandbox id to upload under (set -sandboxID or E2B_SANDBOX_ID)")
+	}
+	if partSize < 1 {
+		return nil, fmt.Errorf("invalid upload part size %d", partSize)
+	}
+	upload := &ArtifactUpload{
+		clock:    clock,
+		base:     strings.TrimSuffix(base, "/") + "/" + url.PathEscape(sandboxID),
+		token:    token,
+		deadline: deadline,
+		client:   &http.Client{},
+		dir:      dir,
+		partSize: partSize,
+		attempts: attempts,
+		codec:    codec,
+		level:    level,
+		queue:    make(map[string]*queuedUpload),
+		wake:     make(chan struct{}, 1),
+	}
+	if err := upload.loadQueue(); err != nil {
+		return nil, fmt.Errorf("upload queue %s: %w", dir, err)
+	}
+	go upload.run()
+	return upload, nil
+}
+
+// uploadItem is one object to upload, read from path or given as data
+type uploadItem struct {
+	key         string
+	path        string
+	data        []byte
+	contentType string
+	// Compressed with -uploadCodec
+	compress bool
+}
+
+// What the proxy has to upload, small records first so that a deadline
+// cuts off artifacts rather than them
+func (c *ChromeDevToolsClient) uploadItems(reason string) []uploadItem {
+	usage, _ := json.MarshalIndent(c.tasks.List(), "", "  ")
+	bundle, _ := json.MarshalIndent(map[string]interface{}{
+		"reason":  reason,
+		"time":    c.clock.Now().UTC(),
+		"version": version,
+		"metrics": c.metricsSnapshot(),
+	}, "", "  ")
+	items := []uploadItem{
+		{key: "teardown.json", data: bundle, contentType: "application/json"},
+		{key: "usage.json", data: usage, contentType: "application/json"},
+	}
+	if logFile != "" {
+		items = append(items, uploadItem{key: "proxy.log", path: logFile, contentType: "text/plain", compress: true})
+	}
+	// With an artifact store, finished recordings are artifacts and the
+	// -record directory only holds spools of open connections
+	if recordDir != "" && c.artifacts == nil {
+		entries, _ := os.ReadDir(recordDir)
+		for _, e := range entries {
+			if !e.IsDir() {
+				items = append(items, uploadItem{key: "recordings/" + e.Name(), path: filepath.Join(recordDir, e.Name()), contentType: "application/x-ndjson", compress: true})
+			}
+		}
+	}
+	if recordSnapshot != "" {
+		items = append(items, uploadItem{key: "snapshot/" + filepath.Base(recordSnapshot), path: recordSnapshot, contentType: "application/x-ndjson", compress: true})
+	}
+	if c.artifacts == nil {
+		return items
+	}
+	if artifacts := c.artifacts.List(nil); len(artifacts) > 0 {
+		items = append(items, uploadItem{key: "artifacts/index.jsonl", path: c.artifacts.indexPath(), contentType: "application/x-ndjson"})
+		for _, a := range artifacts {
+			contentType := a.ContentType
+			if a.Encrypted || a.Codec != "" || contentType == "" {
+				contentType = "application/octet-stream"
+			}
+			items = append(items, uploadItem{key: "artifacts/" + a.Kind + "/" + a.ID, path: c.artifacts.path(a), contentType: contentType})
+		}
+	}
+	return items
+}
+
+// Upload queues items and waits up to the deadline for the queue to
+// empty, logging what is left for the next start
+func (u *ArtifactUpload) Upload(items []uploadItem) {
+	start := u.clock.Now()
+	u.Enqueue(items)
+	ctx, cancel := context.WithTimeout(context.Background(), u.deadline)
+	defer cancel()
+	if left := u.Drain(ctx); left > 0 {
+		log.Printf("⚠️ Upload deadline of %s reached, %d objects stay queued in %s: %s", u.deadline, left, u.dir, strings.Join(u.queued(), ", "))
+		return
+	}
+	log.Printf("☁️ Upload queue drained to %s in %s", u.base, u.clock.Since(start).Round(time.Millisecond))
+}
+
+func (u *ArtifactUpload) Metrics() map[string]interface{} {
+	u.mu.Lock()
+	queued := len(u.queue)
+	u.mu.Unlock()
+	return map[string]interface{}{
+		"upload_objects_total":        atomic.LoadInt64(&u.uploaded),
+		"upload_failed_objects_total": atomic.LoadInt64(&u.failed),
+		"upload_retries_total":        atomic.LoadInt64(&u.retries),
+		"upload_bytes_total":          atomic.LoadInt64(&u.bytes),
+		"upload_queue_length":         queued,
+	}
+}
+
+// Tear down on SIGTERM or SIGINT, so that a sandbox stopped by its
+// supervisor still uploads; a second signal exits at once
+func (c *ChromeDevToolsClient) watchSignals() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-signals
+		go c.teardown("Received signal " + sig.String())
+		sig = <-signals
+		log.Fatalf("❌ Received %s during teardown, exiting without waiting", sig)
+	}()
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Longest wait between two attempts of a queued upload, and the wait while
+// draining at teardown
+const (
+	uploadMaxBackoff   = 5 * time.Minute
+	uploadDrainBackoff = time.Second
+)
+
+// Longest a single upload request may take
+const uploadRequestTimeout = 2 * time.Minute
+
+var (
+	errUploadRejected = errors.New("rejected by the remote store")
+	errUploadChanged  = errors.New("file changed since it was queued")
+)
+
+// queuedUpload is an object waiting in the upload queue, persisted as
+// <queue>/<id>.json so that uploads survive restarts and sandbox pauses
+type queuedUpload struct {
+	ID  string `json:"id"`
+	Key string `json:"key"`
+	// File uploaded; objects given as data are kept as <queue>/<id>.data
+	Path        string `json:"path"`
+	ContentType string `json:"contentType"`
+	// Size and checksum when queued: files still being appended to are
+	// uploaded up to this size
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	// Bytes the store has acknowledged, where an upload in parts resumes
+	Offset      int64     `json:"offset,omitempty"`
+	Attempts    int       `json:"attempts,omitempty"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	LastError   string    `json:"lastError,omitempty"`
+	// When this run last attempted it
+	tried time.Time
+}
+
+func (u *ArtifactUpload) entryPath(id string) string {
+	return filepath.Join(u.dir, id+".json")
+}
+
+// Load uploads left queued by an earlier run
+func (u *ArtifactUpload) loadQueue() error {
+	if err := os.MkdirAll(filepath.Join(u.dir, "failed"), 0o755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(u.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(u.dir, e.Name()))
+		if err != nil {
+			return err
+		}
+		var q queuedUpload
+		if err := json.Unmarshal(data, &q); err != nil {
+			log.Printf("⚠️ Skipping unreadable upload queue entry %s: %v", e.Name(), err)
+			continue
+		}
+		u.queue[q.ID] = &q
+	}
+	if len(u.queue) > 0 {
+		log.Printf("☁️ Resuming %d queued uploads from %s", len(u.queue), u.dir)
+	}
+	return nil
+}
+
+// Persist an entry, replacing the file atomically
+func (u *ArtifactUpload) save(q *queuedUpload) error {
+	data, err := json.Marshal(q)
+	if err != nil {
+		return err
+	}
+	tmp := u.entryPath(q.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, u.entryPath(q.ID))
+}
+
+// Enqueue queues items for upload, noting their size and checksum
+func (u *ArtifactUpload) Enqueue(items []uploadItem) {
+	for _, item := range items {
+		q := &queuedUpload{ID: newArtifactID(u.clock), Key: item.key, Path: item.path, ContentType: item.contentType, NextAttempt: u.clock.Now()}
+		var err error
+		switch {
+		case item.compress && u.codec != nil && u.codec.Name != "none":
+			// The compressed copy is what is queued, so that resumed
+			// parts and the checksum stay those of one encoding
+			q.Path = filepath.Join(u.dir, q.ID+".data")
+			q.Key, q.ContentType = item.key+u.codec.Extension, u.codec.ContentType
+			if item.path == "" {
+				var encoded []byte
+				if encoded, err = u.codec.encode(item.data, u.level); err == nil {
+					err = os.WriteFile(q.Path, encoded, 0o644)
+				}
+			} else {
+				_, err = u.codec.encodeFile(item.path, q.Path, u.level)
+			}
+		case item.path == "":
+			q.Path = filepath.Join(u.dir, q.ID+".data")
+			err = os.WriteFile(q.Path, item.data, 0o644)
+		}
+		if err != nil {
+			os.Remove(filepath.Join(u.dir, q.ID+".data"))
+			log.Printf("⚠️ Failed to queue upload of %s: %v", item.key, err)
+			continue
+		}
+		if err := q.measure(); err != nil {
+			log.Printf("⚠️ Failed to queue upload of %s: %v", item.key, err)
+			continue
+		}
+		if err := u.save(q); err != nil {
+			log.Printf("⚠️ Failed to queue upload of %s: %v", item.key, err)
+			continue
+		}
+		u.mu.Lock()
+		u.queue[q.ID] = q
+		u.mu.Unlock()
+	}
+	u.notify()
+}
+
+// Note the size and checksum of the file as it is now
+func (q *queuedUpload) measure() error {
+	f, err := os.Open(q.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	q.Size, q.SHA256 = size, hex.EncodeToString(h.Sum(nil))
+	return nil
+}
+
+// Check the queued part of the file is still what was queued
+func (q *queuedUpload) verify(f *os.File) error {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, q.Size)); err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != q.SHA256 {
+		return errUploadChanged
+	}
+	return nil
+}
+
+func (u *ArtifactUpload) notify() {
+	select {
+	case u.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Upload queued objects as they come due, oldest first
+func (u *ArtifactUpload) run() {
+	for {
+		q, wait := u.due()
+		if q == nil || wait > 0 {
+			// With nothing queued only a new entry wakes the loop
+			var due <-chan time.Time
+			if q != nil {
+				due = u.clock.After(wait)
+			}
+			select {
+			case <-u.wake:
+			case <-due:
+			}
+			continue
+		}
+		u.attempt(q)
+	}
+}
+
+// The next entry to attempt and how long until it is due, or nil
+func (u *ArtifactUpload) due() (*queuedUpload, time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var next *queuedUpload
+	var nextAt time.Time
+	for _, q := range u.queue {
+		at := q.NextAttempt
+		if u.draining && q.tried.Add(uploadDrainBackoff).Before(at) {
+			at = q.tried.Add(uploadDrainBackoff)
+		}
+		if next == nil || at.Before(nextAt) || (at.Equal(nextAt) && q.ID < next.ID) {
+			next, nextAt = q, at
+		}
+	}
+	if next == nil {
+		return nil, 0
+	}
+	return next, nextAt.Sub(u.clock.Now())
+}
+
+func (u *ArtifactUpload) attempt(q *queuedUpload) {
+	err := u.send(q)
+	u.mu.Lock()
+	q.tried = u.clock.Now()
+	_, queued := u.queue[q.ID]
+	u.mu.Unlock()
+	if !queued {
+		// Purged while it was being sent
+		return
+	}
+	if err == nil {
+		atomic.AddInt64(&u.uploaded, 1)
+		log.Printf("☁️ Uploaded %s (%d bytes, attempt %d)", q.Key, q.Size, q.Attempts+1)
+		u.remove(q, "")
+		return
+	}
+	q.Attempts++
+	q.LastError = err.Error()
+	if errors.Is(err, errUploadRejected) || errors.Is(err, errUploadChanged) || errors.Is(err, os.ErrNotExist) || q.Attempts >= u.attempts {
+		atomic.AddInt64(&u.failed, 1)
+		log.Printf("⚠️ Giving up upload of %s after %d attempts: %v", q.Key, q.Attempts, err)
+		u.save(q)
+		u.remove(q, "failed")
+		return
+	}
+	atomic.AddInt64(&u.retries, 1)
+	backoff := time.Second << q.Attempts
+	if backoff > uploadMaxBackoff || backoff <= 0 {
+		backoff = uploadMaxBackoff
+	}
+	q.NextAttempt = u.clock.Now().Add(backoff)
+	u.mu.Lock()
+	if u.draining {
+		backoff = uploadDrainBackoff
+	}
+	u.mu.Unlock()
+	log.Printf("⚠️ Upload of %s failed (attempt %d, %d/%d bytes acknowledged), retrying in %s: %v", q.Key, q.Attempts, q.Offset, q.Size, backoff, err)
+	if err := u.save(q); err != nil {
+		log.Printf("⚠️ Failed to update upload queue entry of %s: %v", q.Key, err)
+	}
+}
+
+// Take an entry off the queue, deleting its files or moving them to a
+// subdirectory of the queue
+func (u *ArtifactUpload) remove(q *queuedUpload, to string) {
+	u.mu.Lock()
+	delete(u.queue, q.ID)
+	u.mu.Unlock()
+	files := []string{u.entryPath(q.ID)}
+	if q.Path == filepath.Join(u.dir, q.ID+".data") {
+		files = append(files, q.Path)
+	}
+	for _, file := range files {
+		if to == "" {
+			os.Remove(file)
+		} else {
+			os.Rename(file, filepath.Join(u.dir, to, filepath.Base(file)))
+		}
+	}
+}
+
+// Purge takes the entries whose key matches off the queue, given-up ones
+// included, deleting their files, and returns how many were removed
+func (u *ArtifactUpload) Purge(match func(key string) bool) (int, error) {
+	u.mu.Lock()
+	var purged []*queuedUpload
+	for _, q := range u.queue {
+		if match(q.Key) {
+			purged = append(purged, q)
+		}
+	}
+	u.mu.Unlock()
+	for _, q := range purged {
+		u.remove(q, "")
+	}
+
+	failed := filepath.Join(u.dir, "failed")
+	entries, err := os.ReadDir(failed)
+	if err != nil && !os.IsNotExist(err) {
+		return len(purged), err
+	}
+	n := len(purged)
+	var removeErr error
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(failed, e.Name()))
+		if err != nil {
+			removeErr = err
+			continue
+		}
+		var q queuedUpload
+		if err := json.Unmarshal(data, &q); err != nil {
+			removeErr = err
+			continue
+		}
+		if !match(q.Key) {
+			continue
+		}
+		for _, file := range []string{filepath.Join(failed, q.ID+".data"), filepath.Join(failed, e.Name())} {
+			if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+				removeErr = err
+			}
+		}
+		n++
+	}
+	return n, removeErr
+}
+
+// Upload an entry in one request, or in parts from where the store left
+// off when it is larger than -uploadPartSize
+func (u *ArtifactUpload) send(q *queuedUpload) error {
+	f, err := os.Open(q.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := q.verify(f); err != nil {
+		return err
+	}
+	if q.Size <= u.partSize {
+		resp, err := u.put(q, io.NewSectionReader(f, 0, q.Size), 0, q.Size, false)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if err := uploadStatus(resp); err != nil {
+			return err
+		}
+		atomic.AddInt64(&u.bytes, q.Size)
+		return nil
+	}
+
+	if q.Attempts > 0 {
+		// Ask the store how much of an interrupted upload it kept
+		resp, err := u.put(q, nil, 0, 0, true)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode/100 == 2:
+			return nil
+		case resp.StatusCode == http.StatusPermanentRedirect:
+			q.Offset = acknowledgedBytes(resp)
+		}
+	}
+	for q.Offset < q.Size {
+		end := q.Offset + u.partSize
+		if end > q.Size {
+			end = q.Size
+		}
+		resp, err := u.put(q, io.NewSectionReader(f, q.Offset, end-q.Offset), q.Offset, end, false)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		start := q.Offset
+		switch {
+		case resp.StatusCode/100 == 2 && end == q.Size:
+			atomic.AddInt64(&u.bytes, end-start)
+			return nil
+		case resp.StatusCode/100 == 2:
+			q.Offset = end
+		case resp.StatusCode == http.StatusPermanentRedirect:
+			q.Offset = acknowledgedBytes(resp)
+		default:
+			return uploadStatus(resp)
+		}
+		atomic.AddInt64(&u.bytes, q.Offset-start)
+		log.Printf("☁️ %s: %d/%d bytes", q.Key, q.Offset, q.Size)
+		u.save(q)
+	}
+	return nil
+}
+
+// PUT bytes start to end of an entry, with a Content-Range when it goes
+// in parts, or only ask for the upload's state when query is set
+func (u *ArtifactUpload) put(q *queuedUpload, body io.Reader, start, end int64, query bool) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), uploadRequestTimeout)
+	if body == nil {
+		body = http.NoBody
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.base+"/"+q.Key, body)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.ContentLength = end - start
+	req.Header.Set("Content-Type", q.ContentType)
+	sum, _ := hex.DecodeString(q.SHA256)
+	// The checksum of the whole object (RFC 9530), for the store to verify
+	req.Header.Set("Repr-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(sum)+":")
+	switch {
+	case query:
+		req.Header.Set("Content-Range", "bytes */"+strconv.FormatInt(q.Size, 10))
+	case q.Size > u.partSize:
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, q.Size))
+	}
+	if u.token != "" {
+		req.Header.Set("Authorization", "Bearer "+u.token)
+	}
+	resp, err := u.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelBody releases a request's context once its response is read
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	io.Copy(io.Discard, b.ReadCloser)
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// Error for a response that does not complete an upload. Client errors
+// other than timeouts and throttling will not go away with a retry.
+func uploadStatus(resp *http.Response) error {
+	switch {
+	case resp.StatusCode/100 == 2:
+		return nil
+	case resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests:
+		return fmt.Errorf("%w: %s", errUploadRejected, resp.Status)
+	default:
+		return fmt.Errorf("remote store: %s", resp.Status)
+	}
+}
+
+// Bytes a 308 Resume Incomplete response acknowledges ("Range: bytes=0-N")
+func acknowledgedBytes(resp *http.Response) int64 {
+	_, last, ok := strings.Cut(resp.Header.Get("Range"), "-")
+	if !ok {
+		return 0
+	}
+	n, err := strconv.ParseInt(last, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n + 1
+}
+
+// Drain waits until the queue is empty or ctx is done, retrying failed
+// uploads every uploadDrainBackoff meanwhile, and reports how many are
+// left
+func (u *ArtifactUpload) Drain(ctx context.Context) int {
+	u.mu.Lock()
+	u.draining = true
+	u.mu.Unlock()
+	u.notify()
+	ticker := u.clock.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		u.mu.Lock()
+		left := len(u.queue)
+		u.mu.Unlock()
+		if left == 0 {
+			return 0
+		}
+		select {
+		case <-ctx.Done():
+			return left
+		case <-ticker.C():
+		}
+	}
+}
+
+// Keys still queued, oldest first
+func (u *ArtifactUpload) queued() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var ids []string
+	for id := range u.queue {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = u.queue[id].Key
+	}
+	return keys
+}
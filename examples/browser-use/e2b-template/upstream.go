@@ -0,0 +1,26 @@
+package main
+
+import "sync"
+
+// Upstream is the Chrome DevTools address currently being proxied. It
+// changes when the supervisor fails over to another browser process.
+type Upstream struct {
+	mu       sync.RWMutex
+	hostPort string
+}
+
+func NewUpstream(hostPort string) *Upstream {
+	return &Upstream{hostPort: hostPort}
+}
+
+func (u *Upstream) HostPort() string {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.hostPort
+}
+
+func (u *Upstream) Set(hostPort string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.hostPort = hostPort
+}
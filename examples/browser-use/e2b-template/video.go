@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Content types of the supported video containers
+var videoContentTypes = map[string]string{
+	"webm": "video/webm",
+	"mp4":  "video/mp4",
+}
+
+// SessionVideo records every page as a video for reviewing agent runs:
+// screencast frames, bounded to -videoFPS and -videoMaxWidth/-videoMaxHeight,
+// are encoded by ffmpeg and the video is stored in the artifact store when
+// the page closes
+type SessionVideo struct {
+	clock  Clock
+	store  *ArtifactStore
+	ffmpeg string
+	format string
+	fps    int
+	width  int
+	height int
+
+	mu sync.Mutex
+	// Pages being recorded, by target id
+	active map[string]*videoRecording
+
+	stored  int64
+	failed  int64
+	frames  int64
+	dropped int64
+}
+
+func NewSessionVideo(clock Clock, store *ArtifactStore, ffmpeg, format string, fps, width, height int) (*SessionVideo, error) {
+	if _, ok := videoContentTypes[format]; !ok {
+		return nil, fmt.Errorf("unsupported video format %q (webm or mp4)", format)
+	}
+	if fps <= 0 || width <= 0 || height <= 0 {
+		return nil, fmt.Errorf("video fps and size must be positive")
+	}
+	path, err := exec.LookPath(ffmpeg)
+	if err != nil {
+		return nil, err
+	}
+	return &SessionVideo{
+		clock:  clock,
+		store:  store,
+		ffmpeg: path,
+		format: format,
+		fps:    fps,
+		// yuv420p needs even dimensions
+		width:  width &^ 1,
+		height: height &^ 1,
+		active: make(map[string]*videoRecording),
+	}, nil
+}
+
+func (v *SessionVideo) Name() string {
+	return "session-video"
+}
+
+// videoRecording is the encoder of one page
+type videoRecording struct {
+	video  *SessionVideo
+	s      *PageSession
+	frames chan []byte
+	// When the last frame was queued, for the frame rate bound
+	last time.Time
+
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	output string
+	stderr bytes.Buffer
+	count  int
+	err    error
+}
+
+func (v *SessionVideo) Attach(s *PageSession) error {
+	if s.Target.Type != "page" {
+		return nil
+	}
+	rec := &videoRecording{video: v, s: s, frames: make(chan []byte, 2*v.fps)}
+	interval := time.Second / time.Duration(v.fps)
+	s.Subscribe(func(msg *CDPMessage) {
+		if msg.Method != "Page.screencastFrame" {
+			return
+		}
+		var frame struct {
+			Data      string `json:"data"`
+			SessionID int    `json:"sessionId"`
+		}
+		if json.Unmarshal(msg.Params, &frame) != nil {
+			return
+		}
+		// Chrome sends the next frame only once this one is acknowledged
+		go s.Call(context.Background(), "Page.screencastFrameAck", map[string]interface{}{"sessionId": frame.SessionID})
+		now := v.clock.Now()
+		if now.Sub(rec.last) < interval {
+			atomic.AddInt64(&v.dropped, 1)
+			return
+		}
+		data, err := base64.StdEncoding.DecodeString(frame.Data)
+		if err != nil {
+			return
+		}
+		select {
+		case rec.frames <- data:
+			rec.last = now
+		default:
+			// The encoder is behind
+			atomic.AddInt64(&v.dropped, 1)
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := s.Call(ctx, "Page.startScreencast", map[string]interface{}{
+		"format":        "jpeg",
+		"quality":       80,
+		"maxWidth":      v.width,
+		"maxHeight":     v.height,
+		"everyNthFrame": 1,
+	}); err != nil {
+		return err
+	}
+	v.mu.Lock()
+	v.active[s.Target.TargetID] = rec
+	v.mu.Unlock()
+	go rec.run()
+	return nil
+}
+
+// Encode frames until the page session detaches, then store the video
+func (r *videoRecording) run() {
+	for {
+		select {
+		case frame := <-r.frames:
+			r.write(frame)
+		case <-r.s.Done():
+			for len(r.frames) > 0 {
+				r.write(<-r.frames)
+			}
+			r.finish()
+			return
+		}
+	}
+}
+
+// Feed one JPEG frame to ffmpeg, started on the first frame so that pages
+// that never paint leave no video
+func (r *videoRecording) write(frame []byte) {
+	if r.err != nil {
+		return
+	}
+	if r.cmd == nil {
+		if r.err = r.start(); r.err != nil {
+			atomic.AddInt64(&r.video.failed, 1)
+			log.Printf("⚠️ Failed to start video encoder for %s: %v", r.s.Describe(), r.err)
+			return
+		}
+	}
+	if _, err := r.stdin.Write(frame); err != nil {
+		r.err = err
+		return
+	}
+	r.count++
+	atomic.AddInt64(&r.video.frames, 1)
+}
+
+func (r *videoRecording) start() error {
+	f, err := os.CreateTemp("", "session-video-*."+r.video.format)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	r.output = f.Name()
+	r.cmd = exec.Command(r.video.ffmpeg, r.video.ffmpegArgs(r.output)...)
+	r.cmd.Stderr = &r.stderr
+	if r.stdin, err = r.cmd.StdinPipe(); err != nil {
+		return err
+	}
+	return r.cmd.Start()
+}
+
+// ffmpeg arguments reading JPEG frames timestamped on arrival from stdin
+// and writing a constant frame rate video of a fixed size to output
+func (v *SessionVideo) ffmpegArgs(output string) []string {
+	filter := fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,format=yuv420p",
+		v.width, v.height, v.width, v.height)
+	args := []string{
+		"-hide_banner", "-loglevel", "error", "-y",
+		"-use_wallclock_as_timestamps", "1", "-f", "mjpeg", "-i", "pipe:0",
+		"-vf", filter, "-r", strconv.Itoa(v.fps),
+	}
+	if v.format == "mp4" {
+		args = append(args, "-c:v", "libx264", "-preset", "veryfast", "-movflags", "+faststart", "-f", "mp4")
+	} else {
+		args = append(args, "-c:v", "libvpx", "-b:v", "1M", "-deadline", "realtime", "-cpu-used", "8", "-f", "webm")
+	}
+	return append(args, output)
+}
+
+// Close the encoder and store the video of the page
+func (r *videoRecording) finish() {
+	v := r.video
+	v.mu.Lock()
+	delete(v.active, r.s.Target.TargetID)
+	v.mu.Unlock()
+	if r.cmd == nil {
+		return
+	}
+	defer os.Remove(r.output)
+
+	r.stdin.Close()
+	err := r.cmd.Wait()
+	if err == nil {
+		err = r.err
+	}
+	if err != nil {
+		atomic.AddInt64(&v.failed, 1)
+		log.Printf("⚠️ Video encoding for %s failed: %v %s", r.s.Describe(), err, strings.TrimSpace(r.stderr.String()))
+		return
+	}
+	data, err := os.ReadFile(r.output)
+	if err != nil {
+		atomic.AddInt64(&v.failed, 1)
+		log.Printf("⚠️ Failed to read video of %s: %v", r.s.Describe(), err)
+		return
+	}
+	meta := map[string]string{
+		"targetId": r.s.Target.TargetID,
+		"url":      r.s.Target.URL,
+		"frames":   strconv.Itoa(r.count),
+		"fps":      strconv.Itoa(v.fps),
+	}
+	// Keep the target's labels so videos can be found by session and
+	// purged by identity
+	for k, val := range r.s.labels.Get(r.s.Target.TargetID) {
+		meta["label."+k] = val
+	}
+	a, err := v.store.Put("video", r.s.Target.TargetID+"."+v.format, data, videoContentTypes[v.format], meta)
+	if err != nil {
+		atomic.AddInt64(&v.failed, 1)
+		log.Printf("⚠️ Failed to store video of %s: %v", r.s.Describe(), err)
+		return
+	}
+	atomic.AddInt64(&v.stored, 1)
+	log.Printf("🎬 Stored video of %s: %d frames, %d bytes (%s)", r.s.Describe(), r.count, len(data), a.ID)
+}
+
+// Wait until recordings of detached pages are stored, or ctx ends
+func (v *SessionVideo) Wait(ctx context.Context) {
+	if v == nil {
+		return
+	}
+	for {
+		v.mu.Lock()
+		active := len(v.active)
+		v.mu.Unlock()
+		if active == 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			log.Printf("⚠️ %d videos not stored before shutdown", active)
+			return
+		case <-v.clock.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// Whether a page of the session (target id or session label) is being
+// recorded
+func (v *SessionVideo) recording(id string) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for targetID, rec := range v.active {
+		if targetID == id || rec.s.labels.Get(targetID)["session"] == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *SessionVideo) Metrics() map[string]interface{} {
+	v.mu.Lock()
+	active := len(v.active)
+	v.mu.Unlock()
+	return map[string]interface{}{
+		"videos_recording":           active,
+		"videos_stored_total":        atomic.LoadInt64(&v.stored),
+		"videos_failed_total":        atomic.LoadInt64(&v.failed),
+		"video_frames_total":         atomic.LoadInt64(&v.frames),
+		"video_frames_dropped_total": atomic.LoadInt64(&v.dropped),
+	}
+}
+
+/*
+Handle GET /sessions/{id}/video, the newest video of a session: a page
+target id, or the session ID the page was leased with. Videos are stored
+when the page closes; 409 while it is still being recorded.
+*/
+func (c *ChromeDevToolsClient) handleGetVideo(w http.ResponseWriter, r *http.Request) {
+	if c.artifacts == nil || c.video == nil {
+		http.Error(w, "Video recording is disabled (set -recordVideo and -artifactDir)", http.StatusNotFound)
+		return
+	}
+	id := r.PathValue("id")
+	videos := c.artifacts.Session("video", id)
+	if len(videos) == 0 {
+		if c.video.recording(id) {
+			http.Error(w, "Video is still recording; it is stored when the page closes", http.StatusConflict)
+		} else {
+			http.Error(w, "Video not found", http.StatusNotFound)
+		}
+		return
+	}
+	body, a, err := c.artifacts.Open(videos[len(videos)-1].ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", a.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(a.Size, 10))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", a.Name))
+	io.Copy(w, body)
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	waitLoadEventFired  = "loadEventFired"
+	waitNetworkIdle     = "networkIdle"
+	waitSelectorVisible = "selectorVisible"
+)
+
+type waitRequest struct {
+	TargetID  string `json:"targetId"`
+	Condition string `json:"condition"`
+	Selector  string `json:"selector"`
+	TimeoutMs int    `json:"timeoutMs"`
+	// Quiet window for networkIdle
+	IdleMs int `json:"idleMs"`
+}
+
+/*
+Handle POST /wait, blocking until a page condition holds
+Request example:
+
+	{"targetId": "27E1...", "condition": "selectorVisible", "selector": "#login", "timeoutMs": 10000}
+
+Conditions: loadEventFired, networkIdle, selectorVisible. An empty targetId
+selects the first page target. A condition still unmet at the timeout is
+answered with 504 and satisfied false.
+*/
+func (c *ChromeDevToolsClient) handleWait(w http.ResponseWriter, r *http.Request) {
+	var req waitRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	switch req.Condition {
+	case waitLoadEventFired, waitNetworkIdle:
+	case waitSelectorVisible:
+		if req.Selector == "" {
+			http.Error(w, "selector is required for selectorVisible", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, fmt.Sprintf("Unknown condition: %q", req.Condition), http.StatusBadRequest)
+		return
+	}
+	if req.IdleMs <= 0 {
+		req.IdleMs = 500
+	}
+	if !c.allowCommands(w, r, waitCommands(req.Condition)...) {
+		return
+	}
+
+	start := c.clock.Now()
+	ctx, cancel := context.WithTimeout(r.Context(), c.apiDeadline(time.Duration(req.TimeoutMs)*time.Millisecond))
+	defer cancel()
+
+	err := c.control.WithSession(ctx, req.TargetID, func(conn *CDPConn, sessionID string) error {
+		switch req.Condition {
+		case waitLoadEventFired:
+			return waitForLoad(ctx, conn, sessionID)
+		case waitNetworkIdle:
+			return waitForNetworkIdle(ctx, c.clock, conn, sessionID, time.Duration(req.IdleMs)*time.Millisecond)
+		default:
+			return waitForSelector(ctx, c.clock, conn, sessionID, req.Selector)
+		}
+	})
+
+	elapsed := c.clock.Since(start).Milliseconds()
+	switch {
+	case err != nil && r.Context().Err() != nil:
+		// The caller went away; there is no one to answer
+		return
+	case err == nil:
+		log.Printf("⏳ Wait %s satisfied after %dms", req.Condition, elapsed)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"condition": req.Condition,
+			"satisfied": true,
+			"elapsedMs": elapsed,
+		})
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		// The page, not the caller, was too slow
+		writeJSON(w, http.StatusGatewayTimeout, map[string]interface{}{
+			"condition": req.Condition,
+			"satisfied": false,
+			"elapsedMs": elapsed,
+		})
+	default:
+		c.errorCount++
+		log.Printf("❌ Wait %s failed: %v", req.Condition, err)
+		http.Error(w, fmt.Sprintf("Wait failed: %v", err), http.StatusBadGateway)
+	}
+}
+
+// The CDP commands waiting for a condition sends
+func waitCommands(condition string) []string {
+	switch condition {
+	case waitLoadEventFired:
+		return []string{"Page.enable", "Runtime.evaluate"}
+	case waitNetworkIdle:
+		return []string{"Network.enable", "Runtime.evaluate"}
+	case waitSelectorVisible:
+		return []string{"Runtime.evaluate"}
+	}
+	return nil
+}
+
+// Wait until the page has fired its load event, or already has
+func waitForLoad(ctx context.Context, conn *CDPConn, sessionID string) error {
+	loaded := make(chan struct{}, 1)
+	unsubscribe := conn.Subscribe(func(msg *CDPMessage) {
+		if msg.SessionID == sessionID && msg.Method == "Page.loadEventFired" {
+			select {
+			case loaded <- struct{}{}:
+			default:
+			}
+		}
+	})
+	defer unsubscribe()
+
+	if _, err := conn.Call(ctx, sessionID, "Page.enable", nil); err != nil {
+		return err
+	}
+	if ready, err := evaluateBool(ctx, conn, sessionID, `document.readyState === "complete"`); err != nil {
+		return err
+	} else if ready {
+		return nil
+	}
+
+	select {
+	case <-loaded:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Wait until no requests have been in flight for the idle window.
+// Network.enable only announces requests sent after it, so requests already
+// in flight are picked up from their later events, and the network only
+// counts as idle once the document has finished loading.
+func waitForNetworkIdle(ctx context.Context, clock Clock, conn *CDPConn, sessionID string, idle time.Duration) error {
+	var mu sync.Mutex
+	inflight := make(map[string]bool)
+	activity := make(chan struct{}, 1)
+
+	unsubscribe := conn.Subscribe(func(msg *CDPMessage) {
+		if msg.SessionID != sessionID {
+			return
+		}
+		var params struct {
+			RequestID string `json:"requestId"`
+		}
+		switch msg.Method {
+		case "Network.requestWillBeSent", "Network.responseReceived", "Network.dataReceived":
+			json.Unmarshal(msg.Params, &params)
+			mu.Lock()
+			inflight[params.RequestID] = true
+			mu.Unlock()
+		case "Network.loadingFinished", "Network.loadingFailed":
+			json.Unmarshal(msg.Params, &params)
+			mu.Lock()
+			delete(inflight, params.RequestID)
+			mu.Unlock()
+		default:
+			return
+		}
+		select {
+		case activity <- struct{}{}:
+		default:
+		}
+	})
+	defer unsubscribe()
+
+	if _, err := conn.Call(ctx, sessionID, "Network.enable", nil); err != nil {
+		return err
+	}
+
+	quiet := clock.After(idle)
+	for {
+		select {
+		case <-activity:
+			quiet = clock.After(idle)
+		case <-quiet:
+			mu.Lock()
+			n := len(inflight)
+			mu.Unlock()
+			if n == 0 {
+				loaded, err := evaluateBool(ctx, conn, sessionID, `document.readyState === "complete"`)
+				if err != nil {
+					return err
+				}
+				if loaded {
+					return nil
+				}
+			}
+			quiet = clock.After(idle)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Poll until an element matching selector is rendered and visible
+func waitForSelector(ctx context.Context, clock Clock, conn *CDPConn, sessionID, selector string) error {
+	quoted, _ := json.Marshal(selector)
+	expression := fmt.Sprintf(`(() => {
+		const el = document.querySelector(%s);
+		if (!el) return false;
+		const style = getComputedStyle(el);
+		return style.visibility !== "hidden" && style.display !== "none" && el.getClientRects().length > 0;
+	})()`, quoted)
+
+	ticker := clock.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		visible, err := evaluateBool(ctx, conn, sessionID, expression)
+		if err != nil {
+			return err
+		}
+		if visible {
+			return nil
+		}
+		select {
+		case <-ticker.C():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func evaluateBool(ctx context.Context, conn *CDPConn, sessionID, expression string) (bool, error) {
+	var result struct {
+		Result struct {
+			Value interface{} `json:"value"`
+		} `json:"result"`
+		ExceptionDetails *struct {
+			Text string `json:"text"`
+		} `json:"exceptionDetails"`
+	}
+	err := conn.CallResult(ctx, sessionID, "Runtime.evaluate", map[string]interface{}{
+		"expression":    expression,
+		"returnByValue": true,
+	}, &result)
+	if err != nil {
+		return false, err
+	}
+	if result.ExceptionDetails != nil {
+		return false, fmt.Errorf("evaluation failed: %s", result.ExceptionDetails.Text)
+	}
+	value, _ := result.Result.Value.(bool)
+	return value, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Warmup pre-spawns renderers and warms caches on startup so the first agent
+// request doesn't pay Chrome's cold-start cost
+type Warmup struct {
+	clock Clock
+	urls  []string
+	tabs  int
+
+	mu       sync.Mutex
+	done     bool
+	started  time.Time
+	finished time.Time
+	errors   []string
+}
+
+func NewWarmup(clock Clock, urls []string, tabs int) *Warmup {
+	return &Warmup{clock: clock, urls: urls, tabs: tabs}
+}
+
+func (w *Warmup) Enabled() bool {
+	return len(w.urls) > 0 || w.tabs > 0
+}
+
+// Run performs the warm-up, waiting for Chrome to come up first
+func (w *Warmup) Run(control *ControlSession) {
+	w.mu.Lock()
+	w.started = w.clock.Now()
+	w.mu.Unlock()
+
+	var conn *CDPConn
+	for attempt := 0; ; attempt++ {
+		var err error
+		if conn, err = control.Conn(); err == nil {
+			break
+		}
+		if attempt == 30 {
+			w.finish(fmt.Sprintf("Chrome unreachable: %v", err))
+			return
+		}
+		<-w.clock.After(time.Second)
+	}
+
+	// Load each URL once to warm DNS, connection and HTTP caches
+	for _, u := range w.urls {
+		if err := w.warmURL(control, conn, u); err != nil {
+			w.addError(fmt.Sprintf("%s: %v", u, err))
+		}
+	}
+
+	// Keep blank tabs open so their renderer processes stay warm
+	for i := 0; i < w.tabs; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), control.timeout)
+		_, err := conn.Call(ctx, "", "Target.createTarget", map[string]interface{}{"url": "about:blank"})
+		cancel()
+		if err != nil {
+			w.addError(fmt.Sprintf("about:blank tab %d: %v", i, err))
+		}
+	}
+
+	w.finish("")
+}
+
+func (w *Warmup) warmURL(control *ControlSession, conn *CDPConn, u string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var created struct {
+		TargetID string `json:"targetId"`
+	}
+	if err := conn.CallResult(ctx, "", "Target.createTarget", map[string]interface{}{"url": "about:blank"}, &created); err != nil {
+		return err
+	}
+	defer conn.Call(context.Background(), "", "Target.closeTarget", map[string]interface{}{"targetId": created.TargetID})
+
+	return control.WithSession(ctx, created.TargetID, func(conn *CDPConn, sessionID string) error {
+		if _, err := conn.Call(ctx, sessionID, "Page.navigate", map[string]interface{}{"url": u}); err != nil {
+			return err
+		}
+		return waitForLoad(ctx, conn, sessionID)
+	})
+}
+
+func (w *Warmup) addError(msg string) {
+	log.Printf("⚠️ Warm-up: %s", msg)
+	w.mu.Lock()
+	w.errors = append(w.errors, msg)
+	w.mu.Unlock()
+}
+
+func (w *Warmup) finish(failure string) {
+	if failure != "" {
+		w.addError(failure)
+	}
+	w.mu.Lock()
+	w.done = true
+	w.finished = w.clock.Now()
+	elapsed := w.finished.Sub(w.started)
+	w.mu.Unlock()
+	log.Printf("🔥 Warm-up complete in %v (%d URLs, %d tabs)", elapsed.Round(time.Millisecond), len(w.urls), w.tabs)
+}
+
+func (w *Warmup) Status() map[string]interface{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	status := map[string]interface{}{
+		"enabled": w.Enabled(),
+		"done":    w.done,
+	}
+	if w.done {
+		status["durationMs"] = w.finished.Sub(w.started).Milliseconds()
+	}
+	if len(w.errors) > 0 {
+		status["errors"] = append([]string(nil), w.errors...)
+	}
+	return status
+}
+
+func (w *Warmup) Done() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.done || !w.Enabled()
+}
+
+// Readiness endpoint: Chrome reachable and startup warm-up finished
+func (c *ChromeDevToolsClient) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	status := map[string]interface{}{
+		"warmup": c.warmup.Status(),
+	}
+
+	ready := c.warmup.Done()
+	resp, err := c.client.Get(fmt.Sprintf("http://%s/json/version", c.upstream.HostPort()))
+	if err != nil {
+		ready = false
+		status["chrome"] = err.Error()
+	} else {
+		resp.Body.Close()
+		status["chrome"] = "ok"
+	}
+	status["ready"] = ready
+
+	code := http.StatusOK
+	if !ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, status)
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket opcodes (RFC 6455 section 5.2)
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+// First header byte bit of a compressed message (RFC 7692)
+const wsRSV1 = 0x40
+
+const wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Larger frames are rejected rather than allocated
+const wsMaxFrameSize = 256 << 20
+
+var errWebSocketClosed = errors.New("websocket closed")
+
+// WebSocketConn is a minimal RFC 6455 connection used by the proxy's own CDP
+// clients. It handles fragmentation, ping/pong and close frames; the only
+// extension is permessage-deflate toward downstream clients.
+type WebSocketConn struct {
+	conn   net.Conn
+	br     *bufio.Reader
+	client bool // client connections mask outgoing frames
+	// Negotiated with a downstream client: data messages written are
+	// compressed, and the relay inflates the compressed ones read
+	deflate *wsDeflate
+	// RSV1 of the last frame read, set on the first frame of a compressed
+	// message
+	rsv1 bool
+	// Negotiated with a downstream client: JSON messages written are sent
+	// in its binary encoding, and the relay decodes the binary ones read
+	codec *cdpCodec
+	// Set while the proxy pings the other end; frames read count as alive
+	keepalive *wsKeepalive
+	// Set for clients with priority lanes: data messages written are
+	// queued by size
+	lanes *laneQueue
+	// Bytes a data message read may have; larger ones are skimmed and
+	// reported as an *oversizeFrame error by readFrame, an
+	// *oversizeMessage one by ReadMessage. Zero allows up to
+	// wsMaxFrameSize.
+	limit int
+
+	wmu       sync.Mutex
+	closeOnce sync.Once
+}
+
+// DialWebSocket opens a client connection to a ws:// or wss:// URL
+func DialWebSocket(rawURL string, timeout time.Duration) (*WebSocketConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		switch u.Scheme {
+		case "ws":
+			host = net.JoinHostPort(u.Hostname(), "80")
+		case "wss":
+			host = net.JoinHostPort(u.Hostname(), "443")
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ws":
+		conn, err = dialer.Dial("tcp", host)
+	case "wss":
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	default:
+		return nil, fmt.Errorf("unsupported WebSocket scheme: %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keyBytes := make([]byte, 16)
+	if _, err := rand.Read(keyBytes); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(keyBytes)
+
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Path: u.Path, RawQuery: u.RawQuery},
+		Host:       u.Host,
+		Header:     make(http.Header),
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("User-Agent", "reverse-proxy/"+version)
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReaderSize(conn, profile.WebSocketReadBuffer)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("WebSocket handshake failed: %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(key) {
+		conn.Close()
+		return nil, errors.New("WebSocket handshake failed: bad Sec-WebSocket-Accept")
+	}
+	conn.SetDeadline(time.Time{})
+
+	return &WebSocketConn{conn: conn, br: br, client: true}, nil
+}
+
+// AcceptWebSocket completes the server side of an upgrade request, for the
+// stub browsers that stand in for Chrome and multiplexed clients
+func AcceptWebSocket(w http.ResponseWriter, r *http.Request) (*WebSocketConn, error) {
+	return acceptWebSocket(w, r, "", nil, "")
+}
+
+// Accept an upgrade with the client's permessage-deflate offer, as
+// negotiated by ClientCompression, when deflate is set, and with the
+// subprotocol the proxy picked when protocol is set
+func acceptWebSocket(w http.ResponseWriter, r *http.Request, extensions string, deflate *wsDeflate, protocol string) (*WebSocketConn, error) {
+	conn, brw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n",
+		webSocketAccept(r.Header.Get("Sec-WebSocket-Key")))
+	if deflate != nil {
+		fmt.Fprintf(brw, "Sec-WebSocket-Extensions: %s\r\n", extensions)
+	}
+	if protocol != "" {
+		fmt.Fprintf(brw, "Sec-WebSocket-Protocol: %s\r\n", protocol)
+	}
+	brw.WriteString("\r\n")
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &WebSocketConn{conn: conn, br: brw.Reader, deflate: deflate}, nil
+}
+
+func webSocketAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + wsAcceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// ReadMessage returns the next complete data message, inflated when it was
+// compressed. Control frames are handled internally: pings are answered
+// and a close frame ends the stream. With a limit, a message growing past
+// it is read to its end without being kept and returned as an
+// *oversizeMessage error, after which reading may go on.
+func (c *WebSocketConn) ReadMessage() (opcode byte, payload []byte, err error) {
+	var message []byte
+	var compressed bool
+	// The message being read past
+	var over *oversizeMessage
+	limit := c.limit
+	defer func() { c.limit = limit }()
+	for {
+		if limit > 0 {
+			// A frame may bring the message up to the limit
+			c.limit = max(1, limit-len(message))
+		}
+		fin, op, data, err := c.readFrame()
+		var skimmed *oversizeFrame
+		if errors.As(err, &skimmed) {
+			if over == nil {
+				if skimmed.opcode != wsOpContinuation {
+					opcode, message, compressed = skimmed.opcode, nil, c.rsv1
+				}
+				if opcode == 0 {
+					return 0, nil, errors.New("unexpected continuation frame")
+				}
+				over = &oversizeMessage{opcode: opcode}
+				over.add(int64(len(message)), message, message)
+				message = nil
+			}
+			over.add(skimmed.size, skimmed.head, skimmed.tail)
+			fin = skimmed.fin
+		} else if err != nil {
+			return 0, nil, err
+		}
+
+		switch {
+		case skimmed != nil:
+		case op == wsOpPing:
+			c.writeFrame(wsOpPong, data)
+			continue
+		case op == wsOpPong:
+			continue
+		case op == wsOpClose:
+			c.writeFrame(wsOpClose, data)
+			c.conn.Close()
+			return 0, nil, errWebSocketClosed
+		case op == wsOpContinuation:
+			if opcode == 0 {
+				return 0, nil, errors.New("unexpected continuation frame")
+			}
+			if over != nil {
+				over.add(int64(len(data)), data, data)
+			} else {
+				message = append(message, data...)
+			}
+		default:
+			opcode, message, compressed = op, data, c.rsv1
+		}
+		if len(message) > wsMaxFrameSize {
+			return 0, nil, fmt.Errorf("websocket message of %d bytes exceeds limit", len(message))
+		}
+		if !fin {
+			continue
+		}
+		if over != nil {
+			if compressed {
+				// The inflater's window now misses what was read past
+				return 0, nil, fmt.Errorf("compressed websocket message of %d bytes exceeds limit", over.size)
+			}
+			return opcode, nil, over
+		}
+		if compressed {
+			if c.deflate == nil {
+				return 0, nil, errors.New("compressed websocket message without permessage-deflate")
+			}
+			if message, err = c.deflate.inflate(message); err != nil {
+				return 0, nil, err
+			}
+			if limit > 0 && len(message) > limit {
+				over = &oversizeMessage{opcode: opcode}
+				over.add(int64(len(message)), message, message)
+				return opcode, nil, over
+			}
+		}
+		return opcode, message, nil
+	}
+}
+
+func (c *WebSocketConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(c.br, header[:]); err != nil {
+		return
+	}
+	c.keepalive.seen()
+	fin = header[0]&0x80 != 0
+	c.rsv1 = header[0]&wsRSV1 != 0
+	opcode = header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(c.br, mask[:]); err != nil {
+			return
+		}
+	}
+	if c.limit > 0 && length > uint64(c.limit) && opcode&0x08 == 0 {
+		err = c.skimFrame(fin, opcode, int64(length), masked, mask)
+		return
+	}
+	if length > wsMaxFrameSize {
+		err = fmt.Errorf("websocket frame of %d bytes exceeds limit", length)
+		return
+	}
+
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return
+}
+
+// WriteMessage sends a single unfragmented frame
+func (c *WebSocketConn) WriteMessage(opcode byte, payload []byte) error {
+	if c.lanes != nil {
+		return c.lanes.push(opcode, payload)
+	}
+	return c.sendMessage(opcode, payload)
+}
+
+func (c *WebSocketConn) sendMessage(opcode byte, payload []byte) error {
+	if c.codec != nil && opcode == wsOpText {
+		if encoded, err := c.codec.fromJSON(payload); err == nil {
+			opcode, payload = wsOpBinary, encoded
+		}
+	}
+	if c.deflate == nil {
+		return c.writeFrame(opcode, payload)
+	}
+	// Compress under the write lock: with context takeover the client
+	// inflates messages in the order they were compressed
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	first := 0x80 | opcode
+	if compressed := c.deflate.compress(payload); compressed != nil {
+		first |= wsRSV1
+		payload = compressed
+	}
+	return c.write(first, payload)
+}
+
+func (c *WebSocketConn) writeFrame(opcode byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.write(0x80|opcode, payload)
+}
+
+// Send one frame starting with the given first header byte; c.wmu is held
+func (c *WebSocketConn) write(first byte, payload []byte) error {
+	header := make([]byte, 0, 14)
+	header = append(header, first)
+
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, maskBit|byte(n))
+	case n <= 0xFFFF:
+		header = append(header, maskBit|126)
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header = append(header, maskBit|127)
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+
+	data := payload
+	if c.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		header = append(header, mask[:]...)
+		data = make([]byte, len(payload))
+		for i := range payload {
+			data[i] = payload[i] ^ mask[i%4]
+		}
+	}
+
+	if _, err := c.conn.Write(header); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(data)
+	return err
+}
+
+// Close sends a normal-closure frame and closes the underlying connection
+func (c *WebSocketConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.writeFrame(wsOpClose, []byte{0x03, 0xE8})
+		err = c.conn.Close()
+	})
+	return err
+}
+
+// Convert an http(s) base URL into the matching ws(s) scheme
+func httpToWebSocketScheme(base string) string {
+	switch {
+	case strings.HasPrefix(base, "https://"):
+		return "wss://" + strings.TrimPrefix(base, "https://")
+	case strings.HasPrefix(base, "http://"):
+		return "ws://" + strings.TrimPrefix(base, "http://")
+	}
+	return base
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	registerFeature("native-websocket", "Relay /devtools WebSocket upgrades over hijacked connections frame by frame, propagating close frames and half-closes (off: httputil.ReverseProxy)", true)
+}
+
+// How long the peer of a closing side gets to finish the close handshake
+// or drain pending responses
+const wsCloseGrace = 5 * time.Second
+
+// Close status sent on behalf of a side that disappeared without a close
+// frame
+const wsCloseGoingAway = 1001
+
+// Close status for a message that does not decode, e.g. malformed
+// MessagePack from a transcoding client
+const wsCloseInvalidData = 1007
+
+// upstreamConn reads through the buffer the handshake response was parsed
+// from, which may already hold the first frames
+type upstreamConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (u *upstreamConn) Read(p []byte) (int, error) {
+	return u.br.Read(p)
+}
+
+// relayWebSocket hands an authorized upgrade to the multiplexer, the native
+// relay or, with both features off, to the reverse proxy
+func (c *ChromeDevToolsClient) relayWebSocket(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&c.openWebSockets, 1)
+	defer atomic.AddInt64(&c.openWebSockets, -1)
+	if featureEnabled("cdp-multiplexing") {
+		c.multiplexWebSocket(w, r)
+		return
+	}
+	if featureEnabled("native-websocket") {
+		c.proxyWebSocket(w, r)
+		return
+	}
+	c.proxy.ServeHTTP(w, r)
+}
+
+// proxyWebSocket relays a client WebSocket upgrade to Chrome over its own
+// connection: the handshake is forwarded unchanged, then both connections
+// are hijacked and frames are bridged verbatim, so the traffic and snapshot
+// taps see the same byte stream as with the reverse proxy
+func (c *ChromeDevToolsClient) proxyWebSocket(w http.ResponseWriter, r *http.Request) {
+	hostPort := c.upstreamForRequest(r).HostPort()
+	conn, err := net.DialTimeout("tcp", hostPort, c.client.Timeout)
+	if err != nil {
+		c.errorCount++
+		log.Printf("❌ WebSocket upstream dial failed: %v", err)
+		http.Error(w, fmt.Sprintf("WebSocket upstream unavailable: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	out := r.Clone(r.Context())
+	out.URL.Scheme, out.URL.Host = "http", hostPort
+	// Chrome only accepts DevTools connections addressed to localhost or an IP
+	out.Host = hostPort
+	out.RequestURI = ""
+	out.Header.Set("Connection", "Upgrade")
+	out.Header.Set("Upgrade", "websocket")
+	out.Header.Del(targetOverrideHeader)
+	// The client's compression, transcoding and delta encoding are
+	// negotiated by the proxy, not Chrome
+	extensions, deflate := c.compression.Negotiate(r)
+	protocol := negotiateSubprotocol(r, out)
+	codec, delta := cdpCodecs[protocol], c.deltas.Connect(protocol)
+	if c.interceptors.Enabled() || c.cdpRecorder != nil || deflate != nil {
+		// Interceptors and the recorder read message payloads, which
+		// compression would hide
+		out.Header.Del("Sec-WebSocket-Extensions")
+	}
+
+	conn.SetDeadline(time.Now().Add(c.client.Timeout))
+	if err := out.Write(conn); err != nil {
+		conn.Close()
+		c.errorCount++
+		http.Error(w, fmt.Sprintf("WebSocket handshake failed: %v", err), http.StatusBadGateway)
+		return
+	}
+	br := bufio.NewReaderSize(conn, profile.WebSocketReadBuffer)
+	resp, err := http.ReadResponse(br, out)
+	if err != nil {
+		conn.Close()
+		c.errorCount++
+		log.Printf("❌ WebSocket handshake with Chrome failed: %v", err)
+		http.Error(w, fmt.Sprintf("WebSocket handshake failed: %v", err), http.StatusBadGateway)
+		return
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// Pass Chrome's refusal (e.g. 404 for an unknown target) through
+		defer conn.Close()
+		defer resp.Body.Close()
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	client, clientBuf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		conn.Close()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// The server's read and write timeouts must not end a long session
+	client.SetDeadline(time.Time{})
+	resp.Body = nil
+	if deflate != nil {
+		resp.Header.Set("Sec-WebSocket-Extensions", extensions)
+	}
+	if protocol != "" {
+		resp.Header.Set("Sec-WebSocket-Protocol", protocol)
+	}
+	if err := resp.Write(client); err != nil {
+		client.Close()
+		conn.Close()
+		return
+	}
+	if err := consumeURLNonce(r); err != nil {
+		refuseReusedUpgrade(client)
+		conn.Close()
+		return
+	}
+
+	body := c.cdpRecorder.Tap(out, c.recorder.Tap(out, c.traffic.Tap(out, &upstreamConn{Conn: conn, br: br})))
+	fromChrome := bufio.NewReaderSize(body, profile.WebSocketReadBuffer)
+	toChrome := func() (bool, error) { return copyFrames(body, clientBuf.Reader) }
+	toClient := func() (bool, error) { return copyFrames(client, fromChrome) }
+	if c.interceptors.Enabled() || deflate != nil || protocol != "" || c.keepalive != nil || c.idle != nil || c.lanes != nil || c.limit != nil {
+		relay := c.interceptors.newRelay(r, client, conn, body)
+		relay.client.deflate, relay.client.codec = deflate, codec
+		relay.delta, relay.limit = delta, c.limit
+		c.lanes.Start(relay.client)
+		done := make(chan struct{})
+		defer close(done)
+		c.keepalive.Start(relay.client, "Client "+r.RemoteAddr, done)
+		c.keepalive.Start(relay.upstream, "Chrome connection "+r.URL.Path, done)
+		relay.idle = c.idle.Watch(relay.client, r.URL.Path+" (client "+r.RemoteAddr+")", done)
+		toChrome = func() (bool, error) { return relay.toChrome(clientBuf.Reader) }
+		toClient = func() (bool, error) { return relay.toClient(fromChrome) }
+	}
+	bridgeWebSocket(client, conn, body, toChrome, toClient)
+}
+
+// frameResult is how one direction of a bridge ended
+type frameResult struct {
+	fromClient bool
+	// A close frame was relayed: the close handshake has started
+	closed bool
+	err    error
+}
+
+// Run both relay directions until they end. upstream carries the raw
+// connection for deadlines and half-closes; reads and writes go through
+// body.
+func bridgeWebSocket(client, upstream net.Conn, body io.Closer, toChrome, toClient func() (closed bool, err error)) {
+	defer client.Close()
+	defer body.Close()
+
+	results := make(chan frameResult, 2)
+	go func() {
+		closed, err := toChrome()
+		results <- frameResult{fromClient: true, closed: closed, err: err}
+	}()
+	go func() {
+		closed, err := toClient()
+		results <- frameResult{closed: closed, err: err}
+	}()
+
+	first := <-results
+	// The side that stopped sending; the other is the peer
+	from, peer, fromName := client, upstream, "client"
+	if !first.fromClient {
+		from, peer, fromName = upstream, client, "Chrome"
+	}
+	if !first.closed {
+		// The side went away without a close frame (e.g. Chrome crashed):
+		// close on its behalf so the peer sees a clean close, not a reset
+		writeCloseFrame(peer, peer == upstream, wsCloseGoingAway)
+		if errors.Is(first.err, io.EOF) {
+			// Half-close: pass the FIN on and let the peer finish sending
+			if tcp, ok := peer.(*net.TCPConn); ok {
+				tcp.CloseWrite()
+			}
+		} else {
+			log.Printf("🔌 WebSocket relay from %s ended: %v", fromName, first.err)
+		}
+	}
+	// Otherwise a close frame was relayed and the peer answers with its own
+	from.SetReadDeadline(time.Now().Add(wsCloseGrace))
+	peer.SetReadDeadline(time.Now().Add(wsCloseGrace))
+	<-results
+}
+
+// copyFrames copies WebSocket frames from src to dst verbatim (masking is
+// kept as the sender applied it) until a close frame has been copied or
+// src fails. Frames are not reassembled, so large messages stream through.
+func copyFrames(dst io.Writer, src *bufio.Reader) (closed bool, err error) {
+	bw := bufio.NewWriterSize(dst, profile.WebSocketReadBuffer)
+	defer bw.Flush()
+
+	var header [14]byte
+	for {
+		if _, err := io.ReadFull(src, header[:2]); err != nil {
+			return false, err
+		}
+		n := 2
+		length := uint64(header[1] & 0x7F)
+		switch length {
+		case 126:
+			if _, err := io.ReadFull(src, header[n:n+2]); err != nil {
+				return false, err
+			}
+			length = uint64(binary.BigEndian.Uint16(header[n:]))
+			n += 2
+		case 127:
+			if _, err := io.ReadFull(src, header[n:n+8]); err != nil {
+				return false, err
+			}
+			length = binary.BigEndian.Uint64(header[n:])
+			n += 8
+		}
+		if length > wsMaxFrameSize {
+			return false, fmt.Errorf("websocket frame of %d bytes exceeds limit", length)
+		}
+		if header[1]&0x80 != 0 {
+			if _, err := io.ReadFull(src, header[n:n+4]); err != nil {
+				return false, err
+			}
+			n += 4
+		}
+
+		if _, err := bw.Write(header[:n]); err != nil {
+			return false, err
+		}
+		if _, err := io.CopyN(bw, src, int64(length)); err != nil {
+			return false, err
+		}
+		// Batch small frames that arrived together
+		if src.Buffered() == 0 || header[0]&0x0F == wsOpClose {
+			if err := bw.Flush(); err != nil {
+				return false, err
+			}
+		}
+		if header[0]&0x0F == wsOpClose {
+			return true, nil
+		}
+	}
+}
+
+// Send a close frame with a status code; frames to Chrome are masked as a
+// client's must be
+func writeCloseFrame(conn net.Conn, masked bool, code int) {
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	ws := &WebSocketConn{conn: conn, client: masked}
+	ws.writeFrame(wsOpClose, binary.BigEndian.AppendUint16(nil, uint16(code)))
+}
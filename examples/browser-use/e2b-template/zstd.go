@@ -0,0 +1,1625 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"sort"
+)
+
+// zstd (RFC 8878) without third-party packages. The encoder is a greedy
+// LZ77 matcher that Huffman codes literals and codes sequences with the
+// predefined FSE tables, so it compresses less than the reference zstd at
+// a similar level, but any zstd decoder reads its output. Levels 1 to 9
+// search deeper hash chains for longer matches. The decoder reads every
+// frame but those needing a dictionary.
+func init() {
+	registerCodec(&Codec{
+		Name:        "zstd",
+		Extension:   ".zst",
+		ContentType: "application/zstd",
+		MinLevel:    1,
+		MaxLevel:    zstdMaxLevel,
+		NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return newZstdWriter(w, level), nil
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(newZstdReader(r)), nil
+		},
+	})
+}
+
+const (
+	zstdMagic          = 0xFD2FB528
+	zstdBlockMaxSize   = 128 << 10
+	zstdWindowLog      = 19
+	zstdWindowSize     = 1 << zstdWindowLog
+	zstdMaxWindowSize  = 1 << 27 // largest window the decoder accepts, as zstd's default
+	zstdMinMatch       = 4
+	zstdHashLog        = 17
+	zstdHuffMaxBits    = 11
+	zstdDefaultLevel   = 3
+	zstdMaxLevel       = 9
+	zstdBlockRaw       = 0
+	zstdBlockRLE       = 1
+	zstdBlockCompresed = 2
+)
+
+var errZstdCorrupt = errors.New("zstd: corrupt input")
+
+// Baselines and extra bits of the literals length and match length codes
+var (
+	zstdLLBase = [36]uint32{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096, 8192, 16384, 32768, 65536}
+	zstdLLBits = [36]uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	zstdMLBase = [53]uint32{3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+		35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051, 4099, 8195, 16387, 32771, 65539}
+	zstdMLBits = [53]uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+)
+
+// The predefined distributions of the three sequence codes
+var (
+	zstdLLNorm = []int16{4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1, 2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1, -1, -1, -1, -1}
+	zstdMLNorm = []int16{1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1, -1, -1}
+	zstdOFNorm = []int16{1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1}
+
+	zstdLLEncTable = newFSEEncTable(zstdLLNorm, 6)
+	zstdMLEncTable = newFSEEncTable(zstdMLNorm, 6)
+	zstdOFEncTable = newFSEEncTable(zstdOFNorm, 5)
+	zstdLLDecTable = newFSEDecTable(zstdLLNorm, 6)
+	zstdMLDecTable = newFSEDecTable(zstdMLNorm, 6)
+	zstdOFDecTable = newFSEDecTable(zstdOFNorm, 5)
+)
+
+func zstdLLCode(ll uint32) uint8 {
+	if ll < 16 {
+		return uint8(ll)
+	}
+	code := len(zstdLLBase) - 1
+	for zstdLLBase[code] > ll {
+		code--
+	}
+	return uint8(code)
+}
+
+func zstdMLCode(ml uint32) uint8 {
+	code := len(zstdMLBase) - 1
+	for zstdMLBase[code] > ml {
+		code--
+	}
+	return uint8(code)
+}
+
+// The symbol of each state of an FSE table: symbols with a "less than one"
+// probability take the last states, the others are spread over the rest
+func fseSpread(norm []int16, tableLog uint) []uint8 {
+	size := 1 << tableLog
+	high := size - 1
+	table := make([]uint8, size)
+	for s, n := range norm {
+		if n == -1 {
+			table[high] = uint8(s)
+			high--
+		}
+	}
+	step, mask, pos := size>>1+size>>3+3, size-1, 0
+	for s, n := range norm {
+		for i := 0; i < int(n); i++ {
+			table[pos] = uint8(s)
+			pos = (pos + step) & mask
+			for pos > high {
+				pos = (pos + step) & mask
+			}
+		}
+	}
+	return table
+}
+
+type fseDecEntry struct {
+	symbol   uint8
+	nbBits   uint8
+	baseline uint16
+}
+
+type fseDecTable struct {
+	tableLog uint
+	entries  []fseDecEntry
+}
+
+func newFSEDecTable(norm []int16, tableLog uint) *fseDecTable {
+	size := 1 << tableLog
+	next := make([]uint32, len(norm))
+	for s, n := range norm {
+		if n == -1 {
+			next[s] = 1
+		} else {
+			next[s] = uint32(n)
+		}
+	}
+	t := &fseDecTable{tableLog: tableLog, entries: make([]fseDecEntry, size)}
+	for u, s := range fseSpread(norm, tableLog) {
+		state := next[s]
+		next[s]++
+		nbBits := tableLog - uint(bits.Len32(state)-1)
+		t.entries[u] = fseDecEntry{symbol: s, nbBits: uint8(nbBits), baseline: uint16(state<<nbBits) - uint16(size)}
+	}
+	return t
+}
+
+// A table always decoding symbol, for the RLE mode
+func newFSERLETable(symbol uint8) *fseDecTable {
+	return &fseDecTable{entries: []fseDecEntry{{symbol: symbol}}}
+}
+
+type fseSymbolTransform struct {
+	deltaNbBits    uint32
+	deltaFindState int32
+}
+
+type fseEncTable struct {
+	tableLog uint
+	states   []uint16
+	symbols  []fseSymbolTransform
+}
+
+func newFSEEncTable(norm []int16, tableLog uint) *fseEncTable {
+	size := 1 << tableLog
+	cumul := make([]int, len(norm)+1)
+	for s, n := range norm {
+		if n == -1 {
+			n = 1
+		}
+		cumul[s+1] = cumul[s] + int(n)
+	}
+	t := &fseEncTable{tableLog: tableLog, states: make([]uint16, size), symbols: make([]fseSymbolTransform, len(norm))}
+	for u, s := range fseSpread(norm, tableLog) {
+		t.states[cumul[s]] = uint16(size + u)
+		cumul[s]++
+	}
+	total := 0
+	for s, n := range norm {
+		switch n {
+		case 0:
+			t.symbols[s].deltaNbBits = uint32((tableLog+1)<<16) - uint32(size)
+		case -1, 1:
+			t.symbols[s] = fseSymbolTransform{deltaNbBits: uint32(tableLog<<16) - uint32(size), deltaFindState: int32(total - 1)}
+			total++
+		default:
+			maxBitsOut := tableLog - uint(bits.Len32(uint32(n-1))-1)
+			minStatePlus := uint32(n) << maxBitsOut
+			t.symbols[s] = fseSymbolTransform{deltaNbBits: uint32(maxBitsOut<<16) - minStatePlus, deltaFindState: int32(total - int(n))}
+			total += int(n)
+		}
+	}
+	return t
+}
+
+type fseEncoder struct {
+	t     *fseEncTable
+	state uint32
+}
+
+func (e *fseEncoder) init(t *fseEncTable, symbol uint8) {
+	e.t = t
+	tt := t.symbols[symbol]
+	nbBitsOut := (tt.deltaNbBits + 1<<15) >> 16
+	value := nbBitsOut<<16 - tt.deltaNbBits
+	e.state = uint32(t.states[int32(value>>nbBitsOut)+tt.deltaFindState])
+}
+
+func (e *fseEncoder) encode(w *zstdBitWriter, symbol uint8) {
+	tt := e.t.symbols[symbol]
+	nbBitsOut := (e.state + tt.deltaNbBits) >> 16
+	w.add(uint64(e.state), uint(nbBitsOut))
+	e.state = uint32(e.t.states[int32(e.state>>nbBitsOut)+tt.deltaFindState])
+}
+
+func (e *fseEncoder) flush(w *zstdBitWriter) {
+	w.add(uint64(e.state), e.t.tableLog)
+}
+
+// zstdBitWriter writes the little-endian bitstreams that are read back to
+// front
+type zstdBitWriter struct {
+	out []byte
+	acc uint64
+	n   uint
+}
+
+// Add the low n bits of v, n at most 32
+func (w *zstdBitWriter) add(v uint64, n uint) {
+	w.acc |= (v & (1<<n - 1)) << w.n
+	w.n += n
+	for w.n >= 8 {
+		w.out = append(w.out, byte(w.acc))
+		w.acc >>= 8
+		w.n -= 8
+	}
+}
+
+// End the stream with the marker bit the reader starts after
+func (w *zstdBitWriter) close() []byte {
+	w.add(1, 1)
+	if w.n > 0 {
+		w.out = append(w.out, byte(w.acc))
+	}
+	return w.out
+}
+
+// zstdBackwardReader reads a bitstream from its last bit down. Bits before
+// the start read as zero; pos going negative shows the stream overran.
+type zstdBackwardReader struct {
+	data []byte
+	pos  int
+}
+
+func newZstdBackwardReader(data []byte) (*zstdBackwardReader, error) {
+	if len(data) == 0 || data[len(data)-1] == 0 {
+		return nil, errZstdCorrupt
+	}
+	return &zstdBackwardReader{data: data, pos: (len(data)-1)*8 + bits.Len8(data[len(data)-1]) - 1}, nil
+}
+
+// The n bits from bit start on, n at most 56
+func (b *zstdBackwardReader) bits(start int, n uint) uint64 {
+	if n == 0 {
+		return 0
+	}
+	end := start + int(n)
+	if start < 0 {
+		if end <= 0 {
+			return 0
+		}
+		return b.bits(0, uint(end)) << uint(-start)
+	}
+	if start>>3+8 <= len(b.data) {
+		return binary.LittleEndian.Uint64(b.data[start>>3:]) >> uint(start&7) & (1<<n - 1)
+	}
+	var v uint64
+	for i := (end - 1) >> 3; i >= start>>3; i-- {
+		v = v<<8 | uint64(b.data[i])
+	}
+	return v >> uint(start&7) & (1<<n - 1)
+}
+
+func (b *zstdBackwardReader) read(n uint) uint64 {
+	b.pos -= int(n)
+	return b.bits(b.pos, n)
+}
+
+func (b *zstdBackwardReader) peek(n uint) uint64 {
+	return b.bits(b.pos-int(n), n)
+}
+
+// Read an FSE table description (RFC 8878 section 4.1.1), returning the
+// normalized counts, the accuracy log and the bytes used
+func readFSENorm(src []byte, maxSymbol int, maxLog uint) ([]int16, uint, int, error) {
+	pos := 0
+	get := func(n int) int {
+		v := 0
+		for i := 0; i < n; i++ {
+			if byteAt := (pos + i) >> 3; byteAt < len(src) && src[byteAt]>>uint((pos+i)&7)&1 != 0 {
+				v |= 1 << i
+			}
+		}
+		return v
+	}
+	tableLog := uint(get(4)) + 5
+	pos = 4
+	if tableLog > maxLog {
+		return nil, 0, 0, errZstdCorrupt
+	}
+	remaining := 1<<tableLog + 1
+	threshold := 1 << tableLog
+	nbBits := int(tableLog) + 1
+	var norm []int16
+	prev0 := false
+	for remaining > 1 && len(norm) <= maxSymbol {
+		if prev0 {
+			n0 := len(norm)
+			for {
+				repeat := get(2)
+				pos += 2
+				n0 += repeat
+				if repeat != 3 {
+					break
+				}
+			}
+			if n0 > maxSymbol {
+				return nil, 0, 0, errZstdCorrupt
+			}
+			for len(norm) < n0 {
+				norm = append(norm, 0)
+			}
+		}
+		max := 2*threshold - 1 - remaining
+		v := get(nbBits)
+		var count int
+		if v&(threshold-1) < max {
+			count = v & (threshold - 1)
+			pos += nbBits - 1
+		} else {
+			count = v & (2*threshold - 1)
+			if count >= threshold {
+				count -= max
+			}
+			pos += nbBits
+		}
+		count--
+		if count < 0 {
+			remaining += count
+		} else {
+			remaining -= count
+		}
+		norm = append(norm, int16(count))
+		prev0 = count == 0
+		for remaining < threshold && threshold > 1 {
+			nbBits--
+			threshold >>= 1
+		}
+	}
+	used := (pos + 7) >> 3
+	if remaining != 1 || used > len(src) {
+		return nil, 0, 0, errZstdCorrupt
+	}
+	return norm, tableLog, used, nil
+}
+
+// xxh64 is the XXH64 hash (seed 0) of zstd's content checksum
+type xxh64 struct {
+	v     [4]uint64
+	buf   [32]byte
+	n     int
+	total uint64
+}
+
+const (
+	xxhPrime1 uint64 = 11400714785074694791
+	xxhPrime2 uint64 = 14029467366897019727
+	xxhPrime3 uint64 = 1609587929392839161
+	xxhPrime4 uint64 = 9650029242287828579
+	xxhPrime5 uint64 = 2870177450012600261
+)
+
+func newXXH64() *xxh64 {
+	p1, p2 := xxhPrime1, xxhPrime2
+	return &xxh64{v: [4]uint64{p1 + p2, p2, 0, -p1}}
+}
+
+func xxhRound(acc, input uint64) uint64 {
+	return bits.RotateLeft64(acc+input*xxhPrime2, 31) * xxhPrime1
+}
+
+func xxhMerge(acc, v uint64) uint64 {
+	return (acc^xxhRound(0, v))*xxhPrime1 + xxhPrime4
+}
+
+func (x *xxh64) stripe(p []byte) {
+	for i := range x.v {
+		x.v[i] = xxhRound(x.v[i], binary.LittleEndian.Uint64(p[i*8:]))
+	}
+}
+
+func (x *xxh64) Write(p []byte) {
+	x.total += uint64(len(p))
+	if x.n > 0 {
+		n := copy(x.buf[x.n:], p)
+		x.n += n
+		p = p[n:]
+		if x.n < 32 {
+			return
+		}
+		x.stripe(x.buf[:])
+		x.n = 0
+	}
+	for ; len(p) >= 32; p = p[32:] {
+		x.stripe(p)
+	}
+	x.n = copy(x.buf[:], p)
+}
+
+func (x *xxh64) Sum64() uint64 {
+	var h uint64
+	if x.total >= 32 {
+		h = bits.RotateLeft64(x.v[0], 1) + bits.RotateLeft64(x.v[1], 7) + bits.RotateLeft64(x.v[2], 12) + bits.RotateLeft64(x.v[3], 18)
+		for _, v := range x.v {
+			h = xxhMerge(h, v)
+		}
+	} else {
+		h = xxhPrime5
+	}
+	h += x.total
+	p := x.buf[:x.n]
+	for ; len(p) >= 8; p = p[8:] {
+		h ^= xxhRound(0, binary.LittleEndian.Uint64(p))
+		h = bits.RotateLeft64(h, 27)*xxhPrime1 + xxhPrime4
+	}
+	if len(p) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(p)) * xxhPrime1
+		h = bits.RotateLeft64(h, 23)*xxhPrime2 + xxhPrime3
+		p = p[4:]
+	}
+	for _, b := range p {
+		h ^= uint64(b) * xxhPrime5
+		h = bits.RotateLeft64(h, 11) * xxhPrime1
+	}
+	h ^= h >> 33
+	h *= xxhPrime2
+	h ^= h >> 29
+	h *= xxhPrime3
+	h ^= h >> 32
+	return h
+}
+
+type zstdSequence struct {
+	litLen, matchLen uint32
+	// Offset plus 3, or a repeat code
+	offsetValue uint32
+}
+
+// zstdWriter compresses into a single frame with a content checksum
+type zstdWriter struct {
+	w     io.Writer
+	depth int
+	err   error
+
+	started bool
+	digest  *xxh64
+	// Recent input, which matches may refer to; the last pending bytes
+	// are the block not compressed yet
+	hist    []byte
+	pending int
+	// Position in hist plus one of the last occurrence of each hash, and
+	// with deeper levels of the one before each position
+	head  []int32
+	chain []int32
+	// Repeat offsets as the decoder holds them
+	reps  [3]uint32
+	block []byte
+	out   []byte
+}
+
+func newZstdWriter(w io.Writer, level int) *zstdWriter {
+	if level < 1 {
+		level = zstdDefaultLevel
+	}
+	if level > zstdMaxLevel {
+		level = zstdMaxLevel
+	}
+	z := &zstdWriter{w: w, depth: 1 << (level - 1), digest: newXXH64(), head: make([]int32, 1<<zstdHashLog), reps: [3]uint32{1, 4, 8}}
+	if z.depth > 1 {
+		z.chain = make([]int32, 0, 2*zstdWindowSize)
+	}
+	return z
+}
+
+func (z *zstdWriter) Write(p []byte) (int, error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+	z.digest.Write(p)
+	written := len(p)
+	for len(p) > 0 {
+		// The last block is only known at Close, so a full one waits for
+		// more input
+		if z.pending == zstdBlockMaxSize {
+			if z.err = z.flushBlock(false); z.err != nil {
+				return 0, z.err
+			}
+		}
+		n := zstdBlockMaxSize - z.pending
+		if n > len(p) {
+			n = len(p)
+		}
+		z.hist = append(z.hist, p[:n]...)
+		z.pending += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (z *zstdWriter) Close() error {
+	if z.err != nil {
+		return z.err
+	}
+	if z.err = z.flushBlock(true); z.err != nil {
+		return z.err
+	}
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], uint32(z.digest.Sum64()))
+	_, z.err = z.w.Write(sum[:])
+	if z.err == nil {
+		z.err = errors.New("zstd: writer closed")
+		return nil
+	}
+	return z.err
+}
+
+func (z *zstdWriter) flushBlock(last bool) error {
+	z.out = z.out[:0]
+	if !z.started {
+		z.started = true
+		var header [6]byte
+		binary.LittleEndian.PutUint32(header[:], zstdMagic)
+		// Content checksum, no content size or dictionary
+		header[4] = 0x04
+		header[5] = byte(zstdWindowLog-10) << 3
+		z.out = append(z.out, header[:]...)
+	}
+
+	start := len(z.hist) - z.pending
+	block := z.hist[start:]
+	blockType, content := zstdBlockRaw, block
+	if len(block) > 1 && isRun(block) {
+		blockType, content = zstdBlockRLE, block[:1]
+	} else if compressed, reps := z.compress(start); compressed != nil && len(compressed) < len(block) {
+		blockType, content = zstdBlockCompresed, compressed
+		z.reps = reps
+	}
+	size := len(content)
+	if blockType == zstdBlockRLE {
+		size = len(block)
+	}
+	header := uint32(size)<<3 | uint32(blockType)<<1
+	if last {
+		header |= 1
+	}
+	z.out = append(z.out, byte(header), byte(header>>8), byte(header>>16))
+	z.out = append(z.out, content...)
+	z.pending = 0
+	z.slide()
+	_, err := z.w.Write(z.out)
+	return err
+}
+
+func isRun(block []byte) bool {
+	for _, b := range block[1:] {
+		if b != block[0] {
+			return false
+		}
+	}
+	return true
+}
+
+// Drop history matches can no longer reach, once enough piled up
+func (z *zstdWriter) slide() {
+	if len(z.hist) < 2*zstdWindowSize {
+		return
+	}
+	d := len(z.hist) - zstdWindowSize
+	z.hist = append(z.hist[:0], z.hist[d:]...)
+	shift := func(v int32) int32 {
+		if int(v) <= d {
+			return 0
+		}
+		return v - int32(d)
+	}
+	for i, v := range z.head {
+		z.head[i] = shift(v)
+	}
+	if z.chain != nil {
+		z.chain = append(z.chain[:0], z.chain[d:]...)
+		for i, v := range z.chain {
+			z.chain[i] = shift(v)
+		}
+	}
+}
+
+func zstdHash(b []byte) uint32 {
+	return binary.LittleEndian.Uint32(b) * 2654435761 >> (32 - zstdHashLog)
+}
+
+func (z *zstdWriter) insert(i int) {
+	h := zstdHash(z.hist[i:])
+	if z.chain != nil {
+		for len(z.chain) <= i {
+			z.chain = append(z.chain, 0)
+		}
+		z.chain[i] = z.head[h]
+	}
+	z.head[h] = int32(i + 1)
+}
+
+// Compress the block at hist[start:] into literals and sequences sections,
+// or nil when it has no matches. Also returns the repeat offsets the
+// decoder will hold after the block.
+func (z *zstdWriter) compress(start int) ([]byte, [3]uint32) {
+	hist, end := z.hist, len(z.hist)
+	reps := z.reps
+	var seqs []zstdSequence
+	var literals []byte
+	litStart := start
+	for i := start; i+zstdMinMatch <= end; {
+		// The last offset is the cheapest to code, so it is tried first
+		best, bestOffset := 0, 0
+		if cand := i - int(reps[0]); cand >= 0 {
+			best, bestOffset = matchLength(hist[cand:], hist[i:end]), int(reps[0])
+		}
+		cand := int(z.head[zstdHash(hist[i:])]) - 1
+		for depth := 0; cand >= 0 && depth < z.depth && i-cand <= zstdWindowSize && i+best < end; depth++ {
+			if hist[cand+best] == hist[i+best] {
+				if n := matchLength(hist[cand:], hist[i:end]); n > best {
+					best, bestOffset = n, i-cand
+				}
+			}
+			if z.chain == nil || cand >= len(z.chain) {
+				break
+			}
+			cand = int(z.chain[cand]) - 1
+		}
+		z.insert(i)
+		if best < zstdMinMatch {
+			i++
+			continue
+		}
+		litLen := uint32(i - litStart)
+		literals = append(literals, hist[litStart:i]...)
+		seqs = append(seqs, zstdSequence{
+			litLen:      litLen,
+			matchLen:    uint32(best),
+			offsetValue: zstdOffsetValue(uint32(bestOffset), litLen, &reps),
+		})
+		for j := i + 1; j < i+best && j+zstdMinMatch <= end; j++ {
+			z.insert(j)
+		}
+		i += best
+		litStart = i
+	}
+	if len(seqs) == 0 {
+		return nil, z.reps
+	}
+	literals = append(literals, hist[litStart:end]...)
+
+	out := appendZstdLiterals(z.block[:0], literals)
+	switch n := len(seqs); {
+	case n < 128:
+		out = append(out, byte(n))
+	case n < 0x7F00:
+		out = append(out, byte(n>>8+128), byte(n))
+	default:
+		out = append(out, 0xFF, byte(n-0x7F00), byte((n-0x7F00)>>8))
+	}
+	z.block = appendZstdSequences(out, seqs)
+	return z.block, reps
+}
+
+// The length of the common prefix of a and b, a being at least as long
+func matchLength(a, b []byte) int {
+	n := 0
+	for ; n+8 <= len(b); n += 8 {
+		if diff := binary.LittleEndian.Uint64(a[n:]) ^ binary.LittleEndian.Uint64(b[n:]); diff != 0 {
+			return n + bits.TrailingZeros64(diff)/8
+		}
+	}
+	for n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// The offset value coding a match: a repeat code when the offset is one of
+// the last three, which updates reps as the decoder will
+func zstdOffsetValue(offset, litLen uint32, reps *[3]uint32) uint32 {
+	r := *reps
+	if litLen > 0 {
+		switch offset {
+		case r[0]:
+			return 1
+		case r[1]:
+			*reps = [3]uint32{r[1], r[0], r[2]}
+			return 2
+		case r[2]:
+			*reps = [3]uint32{r[2], r[0], r[1]}
+			return 3
+		}
+	} else {
+		switch offset {
+		case r[1]:
+			*reps = [3]uint32{r[1], r[0], r[2]}
+			return 1
+		case r[2]:
+			*reps = [3]uint32{r[2], r[0], r[1]}
+			return 2
+		case r[0] - 1:
+			*reps = [3]uint32{r[0] - 1, r[0], r[1]}
+			return 3
+		}
+	}
+	*reps = [3]uint32{offset, r[0], r[1]}
+	return offset + 3
+}
+
+func appendZstdRawLiterals(out, literals []byte) []byte {
+	switch n := len(literals); {
+	case n < 32:
+		out = append(out, byte(n<<3))
+	case n < 4096:
+		out = append(out, byte(1<<2|n<<4), byte(n>>4))
+	default:
+		out = append(out, byte(3<<2|n<<4), byte(n>>4), byte(n>>12))
+	}
+	return append(out, literals...)
+}
+
+// Append the literals section, Huffman coded when that is smaller. Weights
+// are only written uncompressed, which covers the symbols below 128; other
+// literals are stored raw.
+func appendZstdLiterals(out, literals []byte) []byte {
+	var counts [256]int
+	maxSymbol, distinct := 0, 0
+	for _, b := range literals {
+		if counts[b] == 0 {
+			distinct++
+		}
+		counts[b]++
+		if int(b) > maxSymbol {
+			maxSymbol = int(b)
+		}
+	}
+	if len(literals) < 64 || distinct < 2 || maxSymbol > 128 {
+		return appendZstdRawLiterals(out, literals)
+	}
+	lengths := huffmanLengths(counts[:maxSymbol+1], zstdHuffMaxBits)
+	var tableLog uint8
+	for _, n := range lengths {
+		if n > tableLog {
+			tableLog = n
+		}
+	}
+	// Canonical codes, in the order the decoder fills its table: longest
+	// codes first, then by symbol
+	var codes [256]uint16
+	next := 0
+	for length := tableLog; length > 0; length-- {
+		for s, n := range lengths {
+			if n == length {
+				codes[s] = uint16(next >> (tableLog - length))
+				next += 1 << (tableLog - length)
+			}
+		}
+	}
+
+	description := []byte{byte(127 + maxSymbol)}
+	for s := 0; s < maxSymbol; s += 2 {
+		b := huffmanWeight(lengths[s], tableLog) << 4
+		if s+1 < maxSymbol {
+			b |= huffmanWeight(lengths[s+1], tableLog)
+		}
+		description = append(description, b)
+	}
+	stream := func(literals []byte) []byte {
+		w := &zstdBitWriter{}
+		for i := len(literals) - 1; i >= 0; i-- {
+			w.add(uint64(codes[literals[i]]), uint(lengths[literals[i]]))
+		}
+		return w.close()
+	}
+
+	var streams []byte
+	format := 0
+	if len(literals) <= 1023 {
+		streams = stream(literals)
+	}
+	if streams == nil || len(description)+len(streams) > 1023 {
+		segment := (len(literals) + 3) / 4
+		var parts [4][]byte
+		for i := range parts {
+			end := (i + 1) * segment
+			if i == 3 {
+				end = len(literals)
+			}
+			parts[i] = stream(literals[i*segment : end])
+		}
+		streams = []byte{byte(len(parts[0])), byte(len(parts[0]) >> 8), byte(len(parts[1])), byte(len(parts[1]) >> 8), byte(len(parts[2])), byte(len(parts[2]) >> 8)}
+		for _, part := range parts {
+			streams = append(streams, part...)
+		}
+		format = 1
+	}
+	compressed := len(description) + len(streams)
+	headerSize, sizeBits := 3, uint(10)
+	if largest := max(len(literals), compressed); largest > 16383 {
+		headerSize, sizeBits, format = 5, 18, 3
+	} else if largest > 1023 {
+		headerSize, sizeBits, format = 4, 14, 2
+	}
+	if headerSize+compressed >= len(literals) {
+		return appendZstdRawLiterals(out, literals)
+	}
+	header := uint64(2) | uint64(format)<<2 | uint64(len(literals))<<4 | uint64(compressed)<<(4+sizeBits)
+	for i := 0; i < headerSize; i++ {
+		out = append(out, byte(header>>(8*i)))
+	}
+	out = append(out, description...)
+	return append(out, streams...)
+}
+
+func huffmanWeight(length, tableLog uint8) byte {
+	if length == 0 {
+		return 0
+	}
+	return tableLog + 1 - length
+}
+
+// Code lengths of a Huffman code for counts, at most maxBits long and
+// forming a complete tree as zstd requires
+func huffmanLengths(counts []int, maxBits uint8) []uint8 {
+	var symbols []int
+	for s, n := range counts {
+		if n > 0 {
+			symbols = append(symbols, s)
+		}
+	}
+	sort.SliceStable(symbols, func(i, j int) bool { return counts[symbols[i]] < counts[symbols[j]] })
+
+	// Two-queue construction: leaves in order of count, then the internal
+	// nodes, which are made in order of weight
+	n := len(symbols)
+	weight := make([]int, 2*n-1)
+	parent := make([]int, 2*n-1)
+	for i, s := range symbols {
+		weight[i] = counts[s]
+	}
+	leaf, inner := 0, n
+	smallest := func(k int) int {
+		if leaf < n && (inner >= k || weight[leaf] <= weight[inner]) {
+			leaf++
+			return leaf - 1
+		}
+		inner++
+		return inner - 1
+	}
+	for k := n; k < 2*n-1; k++ {
+		a, b := smallest(k), smallest(k)
+		weight[k] = weight[a] + weight[b]
+		parent[a], parent[b] = k, k
+	}
+	depth := make([]uint8, 2*n-1)
+	for k := 2*n - 3; k >= 0; k-- {
+		depth[k] = depth[parent[k]] + 1
+	}
+
+	lengths := make([]uint8, len(counts))
+	kraft := 0 // in units of 2^-maxBits
+	for i, s := range symbols {
+		lengths[s] = min(depth[i], maxBits)
+		kraft += 1 << (maxBits - lengths[s])
+	}
+	// Lengthen codes of the rarest symbols until the lengths fit, then
+	// shorten the longest while the tree has room, to complete it
+	for i := 0; kraft > 1<<maxBits; i = (i + 1) % n {
+		if s := symbols[i]; lengths[s] < maxBits {
+			kraft -= 1 << (maxBits - lengths[s] - 1)
+			lengths[s]++
+		}
+	}
+	for kraft < 1<<maxBits {
+		best := -1
+		for _, s := range symbols {
+			if gain := 1 << (maxBits - lengths[s]); kraft+gain <= 1<<maxBits && (best < 0 || lengths[s] > lengths[best]) {
+				best = s
+			}
+		}
+		kraft += 1 << (maxBits - lengths[best])
+		lengths[best]--
+	}
+	return lengths
+}
+
+// Pick the table of one sequence code: the predefined one for a few
+// sequences, else one fitted to them, returning the compression mode and
+// the table's description
+func zstdSequenceTable(codes []uint8, maxLog uint, predefined *fseEncTable) (byte, *fseEncTable, []byte) {
+	var counts [53]int
+	maxSymbol, distinct := 0, 0
+	for _, c := range codes {
+		if counts[c] == 0 {
+			distinct++
+		}
+		counts[c]++
+		maxSymbol = max(maxSymbol, int(c))
+	}
+	if len(codes) < 64 || distinct < 2 {
+		return 0, predefined, nil
+	}
+	tableLog := uint(max(6, min(int(maxLog), bits.Len(uint(len(codes)))-2)))
+	norm := fseNormalize(counts[:maxSymbol+1], len(codes), tableLog)
+	return 2, newFSEEncTable(norm, tableLog), appendFSENorm(nil, norm, tableLog)
+}
+
+// Scale counts to sum to 2^tableLog, every present symbol keeping at
+// least 1
+func fseNormalize(counts []int, total int, tableLog uint) []int16 {
+	size := 1 << tableLog
+	norm := make([]int16, len(counts))
+	sum, largest := 0, 0
+	for s, c := range counts {
+		if c == 0 {
+			continue
+		}
+		n := max(1, (c*size+total/2)/total)
+		norm[s] = int16(n)
+		sum += n
+		if n > int(norm[largest]) {
+			largest = s
+		}
+	}
+	if sum < size {
+		norm[largest] += int16(size - sum)
+	}
+	for ; sum > size; sum-- {
+		largest = 0
+		for s, n := range norm {
+			if n > norm[largest] {
+				largest = s
+			}
+		}
+		norm[largest]--
+	}
+	return norm
+}
+
+// Append an FSE table description, the inverse of readFSENorm
+func appendFSENorm(out []byte, norm []int16, tableLog uint) []byte {
+	w := &zstdBitWriter{out: out}
+	w.add(uint64(tableLog-5), 4)
+	remaining := 1<<tableLog + 1
+	threshold := 1 << tableLog
+	nbBits := uint(tableLog) + 1
+	prev0 := false
+	for symbol := 0; remaining > 1 && symbol < len(norm); {
+		if prev0 {
+			start := symbol
+			for norm[symbol] == 0 {
+				symbol++
+			}
+			for ; symbol >= start+24; start += 24 {
+				w.add(0xFFFF, 16)
+			}
+			for ; symbol >= start+3; start += 3 {
+				w.add(3, 2)
+			}
+			w.add(uint64(symbol-start), 2)
+		}
+		count := int(norm[symbol])
+		symbol++
+		max := 2*threshold - 1 - remaining
+		if count < 0 {
+			remaining += count
+		} else {
+			remaining -= count
+		}
+		count++
+		if count >= threshold {
+			count += max
+		}
+		if count < max {
+			w.add(uint64(count), nbBits-1)
+		} else {
+			w.add(uint64(count), nbBits)
+		}
+		prev0 = count == 1
+		for remaining < threshold {
+			nbBits--
+			threshold >>= 1
+		}
+	}
+	if w.n > 0 {
+		w.out = append(w.out, byte(w.acc))
+	}
+	return w.out
+}
+
+// Append the compression modes, table descriptions and bitstream of the
+// sequences. The bitstream is written back to front, as the decoder
+// reads it front to back.
+func appendZstdSequences(out []byte, seqs []zstdSequence) []byte {
+	llCodes := make([]uint8, len(seqs))
+	mlCodes := make([]uint8, len(seqs))
+	ofCodes := make([]uint8, len(seqs))
+	for i, s := range seqs {
+		llCodes[i] = zstdLLCode(s.litLen)
+		mlCodes[i] = zstdMLCode(s.matchLen)
+		ofCodes[i] = uint8(bits.Len32(s.offsetValue) - 1)
+	}
+	llMode, llTable, llDescription := zstdSequenceTable(llCodes, 9, zstdLLEncTable)
+	ofMode, ofTable, ofDescription := zstdSequenceTable(ofCodes, 8, zstdOFEncTable)
+	mlMode, mlTable, mlDescription := zstdSequenceTable(mlCodes, 9, zstdMLEncTable)
+	out = append(out, llMode<<6|ofMode<<4|mlMode<<2)
+	out = append(out, llDescription...)
+	out = append(out, ofDescription...)
+	out = append(out, mlDescription...)
+
+	w := &zstdBitWriter{out: out}
+	var ll, ml, of fseEncoder
+	add := func(i int) {
+		s := seqs[i]
+		w.add(uint64(s.litLen-zstdLLBase[llCodes[i]]), uint(zstdLLBits[llCodes[i]]))
+		w.add(uint64(s.matchLen-zstdMLBase[mlCodes[i]]), uint(zstdMLBits[mlCodes[i]]))
+		w.add(uint64(s.offsetValue-1<<ofCodes[i]), uint(ofCodes[i]))
+	}
+	last := len(seqs) - 1
+	ml.init(mlTable, mlCodes[last])
+	of.init(ofTable, ofCodes[last])
+	ll.init(llTable, llCodes[last])
+	add(last)
+	for i := last - 1; i >= 0; i-- {
+		of.encode(w, ofCodes[i])
+		ml.encode(w, mlCodes[i])
+		ll.encode(w, llCodes[i])
+		add(i)
+	}
+	ml.flush(w)
+	of.flush(w)
+	ll.flush(w)
+	return w.close()
+}
+
+type huffEntry struct {
+	symbol uint8
+	nbBits uint8
+}
+
+type huffTable struct {
+	tableLog uint
+	entries  []huffEntry
+}
+
+// zstdReader decodes a stream of zstd frames
+type zstdReader struct {
+	r   *bufio.Reader
+	err error
+
+	inFrame  bool
+	checksum bool
+	window   int
+	digest   *xxh64
+	// Output of the frame: the window matches may refer to, then the
+	// bytes not read yet
+	hist   []byte
+	unread int
+
+	huff       *huffTable
+	ll, of, ml *fseDecTable
+	rep        [3]uint32
+	block      []byte
+	literals   []byte
+}
+
+func newZstdReader(r io.Reader) *zstdReader {
+	return &zstdReader{r: bufio.NewReader(r)}
+}
+
+func (z *zstdReader) Read(p []byte) (int, error) {
+	for z.unread == 0 {
+		if z.err != nil {
+			return 0, z.err
+		}
+		z.err = z.next()
+	}
+	n := copy(p, z.hist[len(z.hist)-z.unread:])
+	z.unread -= n
+	return n, nil
+}
+
+// Decode the next block, starting a frame when none is open
+func (z *zstdReader) next() error {
+	if !z.inFrame {
+		return z.readFrameHeader()
+	}
+	var header [3]byte
+	if _, err := io.ReadFull(z.r, header[:]); err != nil {
+		return zstdUnexpectedEOF(err)
+	}
+	h := uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16
+	last, blockType, size := h&1 != 0, int(h>>1&3), int(h>>3)
+	if size > zstdBlockMaxSize {
+		return errZstdCorrupt
+	}
+	if len(z.hist) > 2*z.window+zstdBlockMaxSize {
+		z.hist = append(z.hist[:0], z.hist[len(z.hist)-z.window:]...)
+	}
+	start := len(z.hist)
+	switch blockType {
+	case zstdBlockRaw:
+		z.hist = append(z.hist, make([]byte, size)...)
+		if _, err := io.ReadFull(z.r, z.hist[start:]); err != nil {
+			return zstdUnexpectedEOF(err)
+		}
+	case zstdBlockRLE:
+		b, err := z.r.ReadByte()
+		if err != nil {
+			return zstdUnexpectedEOF(err)
+		}
+		for i := 0; i < size; i++ {
+			z.hist = append(z.hist, b)
+		}
+	case zstdBlockCompresed:
+		if cap(z.block) < size {
+			z.block = make([]byte, size)
+		}
+		z.block = z.block[:size]
+		if _, err := io.ReadFull(z.r, z.block); err != nil {
+			return zstdUnexpectedEOF(err)
+		}
+		if err := z.decodeBlock(z.block); err != nil {
+			return err
+		}
+		if len(z.hist)-start > zstdBlockMaxSize {
+			return errZstdCorrupt
+		}
+	default:
+		return errZstdCorrupt
+	}
+	z.unread = len(z.hist) - start
+	z.digest.Write(z.hist[start:])
+	if last {
+		z.inFrame = false
+		if z.checksum {
+			var sum [4]byte
+			if _, err := io.ReadFull(z.r, sum[:]); err != nil {
+				return zstdUnexpectedEOF(err)
+			}
+			if binary.LittleEndian.Uint32(sum[:]) != uint32(z.digest.Sum64()) {
+				return errors.New("zstd: checksum mismatch")
+			}
+		}
+	}
+	return nil
+}
+
+func zstdUnexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (z *zstdReader) readFrameHeader() error {
+	var magic [4]byte
+	if _, err := io.ReadFull(z.r, magic[:]); err != nil {
+		if err == io.EOF {
+			return io.EOF
+		}
+		return zstdUnexpectedEOF(err)
+	}
+	switch m := binary.LittleEndian.Uint32(magic[:]); {
+	case m&0xFFFFFFF0 == 0x184D2A50:
+		// Skippable frame
+		var size [4]byte
+		if _, err := io.ReadFull(z.r, size[:]); err != nil {
+			return zstdUnexpectedEOF(err)
+		}
+		_, err := io.CopyN(io.Discard, z.r, int64(binary.LittleEndian.Uint32(size[:])))
+		return zstdUnexpectedEOF(err)
+	case m != zstdMagic:
+		return errors.New("zstd: not a zstd stream")
+	}
+	descriptor, err := z.r.ReadByte()
+	if err != nil {
+		return zstdUnexpectedEOF(err)
+	}
+	if descriptor&0x08 != 0 {
+		return errZstdCorrupt
+	}
+	singleSegment := descriptor&0x20 != 0
+	window := 0
+	if !singleSegment {
+		b, err := z.r.ReadByte()
+		if err != nil {
+			return zstdUnexpectedEOF(err)
+		}
+		base := 1 << (10 + b>>3)
+		window = base + base/8*int(b&7)
+	}
+	dictSize := [4]int{0, 1, 2, 4}[descriptor&3]
+	fcsSize := [4]int{0, 2, 4, 8}[descriptor>>6]
+	if singleSegment && fcsSize == 0 {
+		fcsSize = 1
+	}
+	var field [12]byte
+	if _, err := io.ReadFull(z.r, field[:dictSize+fcsSize]); err != nil {
+		return zstdUnexpectedEOF(err)
+	}
+	for _, b := range field[:dictSize] {
+		if b != 0 {
+			return errors.New("zstd: frames using a dictionary are not supported")
+		}
+	}
+	if singleSegment {
+		var fcs [8]byte
+		copy(fcs[:], field[dictSize:dictSize+fcsSize])
+		size := binary.LittleEndian.Uint64(fcs[:])
+		if fcsSize == 2 {
+			size += 256
+		}
+		if size > zstdMaxWindowSize {
+			return fmt.Errorf("zstd: window of %d bytes exceeds the limit", size)
+		}
+		window = int(size)
+	}
+	if window > zstdMaxWindowSize {
+		return fmt.Errorf("zstd: window of %d bytes exceeds the limit", window)
+	}
+	z.inFrame, z.checksum, z.window = true, descriptor&0x04 != 0, window
+	z.digest = newXXH64()
+	z.hist = z.hist[:0]
+	z.huff, z.ll, z.of, z.ml = nil, nil, nil, nil
+	z.rep = [3]uint32{1, 4, 8}
+	return nil
+}
+
+func (z *zstdReader) decodeBlock(data []byte) error {
+	literals, n, err := z.decodeLiterals(data)
+	if err != nil {
+		return err
+	}
+	data = data[n:]
+	if len(data) == 0 {
+		return errZstdCorrupt
+	}
+	var nbSeq int
+	switch b := int(data[0]); {
+	case b < 128:
+		nbSeq, data = b, data[1:]
+	case b < 255:
+		if len(data) < 2 {
+			return errZstdCorrupt
+		}
+		nbSeq, data = (b-128)<<8+int(data[1]), data[2:]
+	default:
+		if len(data) < 3 {
+			return errZstdCorrupt
+		}
+		nbSeq, data = int(data[1])+int(data[2])<<8+0x7F00, data[3:]
+	}
+	if nbSeq == 0 {
+		z.hist = append(z.hist, literals...)
+		return nil
+	}
+	if len(data) == 0 || data[0]&3 != 0 {
+		return errZstdCorrupt
+	}
+	modes := data[0]
+	data = data[1:]
+	for _, kind := range []struct {
+		mode       byte
+		table      **fseDecTable
+		predefined *fseDecTable
+		maxSymbol  int
+		maxLog     uint
+	}{
+		{modes >> 6, &z.ll, zstdLLDecTable, 35, 9},
+		{modes >> 4 & 3, &z.of, zstdOFDecTable, 31, 8},
+		{modes >> 2 & 3, &z.ml, zstdMLDecTable, 52, 9},
+	} {
+		switch kind.mode {
+		case 0:
+			*kind.table = kind.predefined
+		case 1:
+			if len(data) == 0 || int(data[0]) > kind.maxSymbol {
+				return errZstdCorrupt
+			}
+			*kind.table = newFSERLETable(data[0])
+			data = data[1:]
+		case 2:
+			norm, tableLog, used, err := readFSENorm(data, kind.maxSymbol, kind.maxLog)
+			if err != nil {
+				return err
+			}
+			*kind.table = newFSEDecTable(norm, tableLog)
+			data = data[used:]
+		case 3:
+			if *kind.table == nil {
+				return errZstdCorrupt
+			}
+		}
+	}
+	return z.executeSequences(data, nbSeq, literals)
+}
+
+func (z *zstdReader) executeSequences(data []byte, nbSeq int, literals []byte) error {
+	br, err := newZstdBackwardReader(data)
+	if err != nil {
+		return err
+	}
+	llState := br.read(z.ll.tableLog)
+	ofState := br.read(z.of.tableLog)
+	mlState := br.read(z.ml.tableLog)
+	for i := 0; i < nbSeq; i++ {
+		llEntry, ofEntry, mlEntry := z.ll.entries[llState], z.of.entries[ofState], z.ml.entries[mlState]
+		llCode, ofCode, mlCode := llEntry.symbol, ofEntry.symbol, mlEntry.symbol
+		if llCode > 35 || mlCode > 52 || ofCode > 31 {
+			return errZstdCorrupt
+		}
+		offsetValue := uint32(1)<<ofCode + uint32(br.read(uint(ofCode)))
+		matchLen := zstdMLBase[mlCode] + uint32(br.read(uint(zstdMLBits[mlCode])))
+		litLen := zstdLLBase[llCode] + uint32(br.read(uint(zstdLLBits[llCode])))
+		if i < nbSeq-1 {
+			llState = uint64(llEntry.baseline) + br.read(uint(llEntry.nbBits))
+			mlState = uint64(mlEntry.baseline) + br.read(uint(mlEntry.nbBits))
+			ofState = uint64(ofEntry.baseline) + br.read(uint(ofEntry.nbBits))
+		}
+		if br.pos < 0 {
+			return errZstdCorrupt
+		}
+
+		var offset uint32
+		if offsetValue > 3 {
+			offset = offsetValue - 3
+			z.rep = [3]uint32{offset, z.rep[0], z.rep[1]}
+		} else {
+			index := offsetValue
+			if litLen == 0 {
+				index++
+			}
+			switch index {
+			case 1:
+				offset = z.rep[0]
+			case 2:
+				offset = z.rep[1]
+				z.rep = [3]uint32{offset, z.rep[0], z.rep[2]}
+			case 3:
+				offset = z.rep[2]
+				z.rep = [3]uint32{offset, z.rep[0], z.rep[1]}
+			default:
+				offset = z.rep[0] - 1
+				z.rep = [3]uint32{offset, z.rep[0], z.rep[1]}
+			}
+		}
+
+		if int(litLen) > len(literals) {
+			return errZstdCorrupt
+		}
+		z.hist = append(z.hist, literals[:litLen]...)
+		literals = literals[litLen:]
+		if offset == 0 || int(offset) > len(z.hist) || int(offset) > z.window {
+			return errZstdCorrupt
+		}
+		from := len(z.hist) - int(offset)
+		for remaining := int(matchLen); remaining > 0; {
+			n := remaining
+			if n > int(offset) {
+				n = int(offset)
+			}
+			z.hist = append(z.hist, z.hist[from:from+n]...)
+			from += n
+			remaining -= n
+		}
+		if len(z.hist) > 2*z.window+2*zstdBlockMaxSize {
+			return errZstdCorrupt
+		}
+	}
+	z.hist = append(z.hist, literals...)
+	return nil
+}
+
+// Decode the literals section at the start of a compressed block,
+// returning the literals and the section's size
+func (z *zstdReader) decodeLiterals(data []byte) ([]byte, int, error) {
+	if len(data) == 0 {
+		return nil, 0, errZstdCorrupt
+	}
+	litType, format := data[0]&3, data[0]>>2&3
+	if litType <= 1 {
+		var size, headerSize int
+		switch format {
+		case 0, 2:
+			size, headerSize = int(data[0]>>3), 1
+		case 1:
+			if len(data) < 2 {
+				return nil, 0, errZstdCorrupt
+			}
+			size, headerSize = int(data[0]>>4)+int(data[1])<<4, 2
+		default:
+			if len(data) < 3 {
+				return nil, 0, errZstdCorrupt
+			}
+			size, headerSize = int(data[0]>>4)+int(data[1])<<4+int(data[2])<<12, 3
+		}
+		if size > zstdBlockMaxSize {
+			return nil, 0, errZstdCorrupt
+		}
+		if litType == 0 {
+			if len(data) < headerSize+size {
+				return nil, 0, errZstdCorrupt
+			}
+			return data[headerSize : headerSize+size], headerSize + size, nil
+		}
+		if len(data) < headerSize+1 {
+			return nil, 0, errZstdCorrupt
+		}
+		z.literals = z.literals[:0]
+		for i := 0; i < size; i++ {
+			z.literals = append(z.literals, data[headerSize])
+		}
+		return z.literals, headerSize + 1, nil
+	}
+
+	headerSize, sizeBits, streams := 3, uint(10), 4
+	switch format {
+	case 0:
+		streams = 1
+	case 2:
+		headerSize, sizeBits = 4, 14
+	case 3:
+		headerSize, sizeBits = 5, 18
+	}
+	if len(data) < headerSize {
+		return nil, 0, errZstdCorrupt
+	}
+	var h uint64
+	for i := headerSize - 1; i >= 0; i-- {
+		h = h<<8 | uint64(data[i])
+	}
+	regenerated := int(h >> 4 & (1<<sizeBits - 1))
+	compressed := int(h >> (4 + sizeBits) & (1<<sizeBits - 1))
+	if regenerated > zstdBlockMaxSize || len(data) < headerSize+compressed {
+		return nil, 0, errZstdCorrupt
+	}
+	src := data[headerSize : headerSize+compressed]
+	if litType == 2 {
+		table, used, err := readHuffmanTable(src)
+		if err != nil {
+			return nil, 0, err
+		}
+		z.huff = table
+		src = src[used:]
+	} else if z.huff == nil {
+		return nil, 0, errZstdCorrupt
+	}
+
+	if cap(z.literals) < regenerated {
+		z.literals = make([]byte, regenerated)
+	}
+	out := z.literals[:regenerated]
+	if streams == 1 {
+		if err := z.huff.decode(out, src); err != nil {
+			return nil, 0, err
+		}
+		return out, headerSize + compressed, nil
+	}
+	if len(src) < 6 {
+		return nil, 0, errZstdCorrupt
+	}
+	sizes := [4]int{int(binary.LittleEndian.Uint16(src)), int(binary.LittleEndian.Uint16(src[2:])), int(binary.LittleEndian.Uint16(src[4:]))}
+	sizes[3] = len(src) - 6 - sizes[0] - sizes[1] - sizes[2]
+	segment := (regenerated + 3) / 4
+	if sizes[3] < 0 || 3*segment > regenerated {
+		return nil, 0, errZstdCorrupt
+	}
+	src = src[6:]
+	for i, size := range sizes {
+		end := (i + 1) * segment
+		if i == 3 {
+			end = regenerated
+		}
+		if err := z.huff.decode(out[i*segment:end], src[:size]); err != nil {
+			return nil, 0, err
+		}
+		src = src[size:]
+	}
+	return out, headerSize + compressed, nil
+}
+
+func (t *huffTable) decode(out, src []byte) error {
+	br, err := newZstdBackwardReader(src)
+	if err != nil {
+		return err
+	}
+	for i := range out {
+		e := t.entries[br.peek(t.tableLog)]
+		out[i] = e.symbol
+		br.pos -= int(e.nbBits)
+	}
+	if br.pos != 0 {
+		return errZstdCorrupt
+	}
+	return nil
+}
+
+// Read a Huffman tree description, returning the table and the bytes used
+func readHuffmanTable(src []byte) (*huffTable, int, error) {
+	if len(src) == 0 {
+		return nil, 0, errZstdCorrupt
+	}
+	var weights []uint8
+	used := 1
+	if header := int(src[0]); header < 128 {
+		if len(src) < 1+header {
+			return nil, 0, errZstdCorrupt
+		}
+		var err error
+		if weights, err = decodeHuffmanWeights(src[1 : 1+header]); err != nil {
+			return nil, 0, err
+		}
+		used += header
+	} else {
+		count := header - 127
+		if len(src) < 1+(count+1)/2 {
+			return nil, 0, errZstdCorrupt
+		}
+		for i := 0; i < count; i++ {
+			b := src[1+i/2]
+			if i%2 == 0 {
+				b >>= 4
+			}
+			weights = append(weights, b&0xF)
+		}
+		used += (count + 1) / 2
+	}
+
+	// The last symbol's weight makes the total a power of two
+	var total uint32
+	for _, w := range weights {
+		if w > 11 {
+			return nil, 0, errZstdCorrupt
+		}
+		if w > 0 {
+			total += 1 << (w - 1)
+		}
+	}
+	if total == 0 || len(weights) > 255 {
+		return nil, 0, errZstdCorrupt
+	}
+	tableLog := uint(bits.Len32(total))
+	rest := uint32(1)<<tableLog - total
+	if tableLog > 11 || rest&(rest-1) != 0 {
+		return nil, 0, errZstdCorrupt
+	}
+	weights = append(weights, uint8(bits.Len32(rest)))
+
+	var start [13]uint32
+	for _, w := range weights {
+		if w > 0 {
+			start[w+1] += 1 << (w - 1)
+		}
+	}
+	for w := 2; w < len(start); w++ {
+		start[w] += start[w-1]
+	}
+	t := &huffTable{tableLog: tableLog, entries: make([]huffEntry, 1<<tableLog)}
+	for s, w := range weights {
+		if w == 0 {
+			continue
+		}
+		for i := uint32(0); i < 1<<(w-1); i++ {
+			t.entries[start[w]+i] = huffEntry{symbol: uint8(s), nbBits: uint8(tableLog + 1 - uint(w))}
+		}
+		start[w] += 1 << (w - 1)
+	}
+	return t, used, nil
+}
+
+// Huffman weights compressed with FSE are decoded with two interleaved
+// states until the bitstream runs out
+func decodeHuffmanWeights(src []byte) ([]uint8, error) {
+	norm, tableLog, used, err := readFSENorm(src, 255, 6)
+	if err != nil {
+		return nil, err
+	}
+	table := newFSEDecTable(norm, tableLog)
+	br, err := newZstdBackwardReader(src[used:])
+	if err != nil {
+		return nil, err
+	}
+	states := [2]uint64{br.read(tableLog), br.read(tableLog)}
+	var weights []uint8
+	for i := 0; ; i ^= 1 {
+		if len(weights) > 254 {
+			return nil, errZstdCorrupt
+		}
+		e := table.entries[states[i]]
+		weights = append(weights, e.symbol)
+		states[i] = uint64(e.baseline) + br.read(uint(e.nbBits))
+		if br.pos < 0 {
+			weights = append(weights, table.entries[states[i^1]].symbol)
+			return weights, nil
+		}
+	}
+}